@@ -0,0 +1,85 @@
+package dga
+
+import (
+	"fmt"
+	"log/slog"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/validate"
+)
+
+// Action is an enumeration of the actions taken on the requests for the
+// domains scored at or above the threshold.
+type Action string
+
+const (
+	// ActionLog makes the middleware only log the flagged requests.
+	ActionLog Action = "log"
+
+	// ActionBlock makes the middleware reply with NXDOMAIN to the flagged
+	// requests.
+	ActionBlock Action = "block"
+
+	// ActionQuarantine makes the middleware resolve the flagged requests with
+	// the quarantine upstreams.
+	ActionQuarantine Action = "quarantine"
+)
+
+// DefaultThreshold is the default score, at and above which a domain is
+// flagged by [DefaultScorer].
+const DefaultThreshold = 0.6
+
+// Config is the configuration for the DGA detection middleware.
+type Config struct {
+	// Logger is used for logging in the middleware.  It must not be nil.
+	Logger *slog.Logger
+
+	// Scorer scores the requested domain names.  If nil, [DefaultScorer] is
+	// used.
+	Scorer Scorer
+
+	// MessageConstructor constructs the NXDOMAIN responses for [ActionBlock].
+	// It must not be nil if Action is [ActionBlock].
+	MessageConstructor proxy.MessageConstructor
+
+	// Quarantine is the upstream configuration for [ActionQuarantine].  It
+	// must not be nil if Action is [ActionQuarantine].
+	Quarantine *proxy.CustomUpstreamConfig
+
+	// Action is the action taken on the flagged requests.  It must be one of
+	// [ActionLog], [ActionBlock], or [ActionQuarantine].
+	Action Action
+
+	// Threshold is the score, at and above which a domain is flagged.  It
+	// must be positive.
+	Threshold float64
+}
+
+// type check
+var _ validate.Interface = (*Config)(nil)
+
+// Validate implements the [validate.Interface] interface for *Config.
+func (c *Config) Validate() (err error) {
+	if c == nil {
+		return errors.ErrNoValue
+	}
+
+	errs := []error{
+		validate.NotNil("Logger", c.Logger),
+		validate.Positive("Threshold", c.Threshold),
+	}
+
+	switch c.Action {
+	case ActionLog:
+		// Go on.
+	case ActionBlock:
+		errs = append(errs, validate.NotNilInterface("MessageConstructor", c.MessageConstructor))
+	case ActionQuarantine:
+		errs = append(errs, validate.NotNil("Quarantine", c.Quarantine))
+	default:
+		errs = append(errs, fmt.Errorf("Action: %w: %q", errors.ErrBadEnumValue, c.Action))
+	}
+
+	return errors.Join(errs...)
+}
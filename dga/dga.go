@@ -0,0 +1,96 @@
+// Package dga provides the detection of domain names likely generated by domain
+// generation algorithms.
+package dga
+
+import (
+	"cmp"
+	"context"
+	"log/slog"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+)
+
+// scoreCtxKey is the type of the context key for the domain name score.
+type scoreCtxKey struct{}
+
+// ContextWithScore returns a copy of parent with the score of the requested
+// domain name.
+func ContextWithScore(parent context.Context, score float64) (ctx context.Context) {
+	return context.WithValue(parent, scoreCtxKey{}, score)
+}
+
+// ScoreFromContext returns the score of the requested domain name stored in
+// ctx by the middleware.  ok is false if there is no score.
+func ScoreFromContext(ctx context.Context) (score float64, ok bool) {
+	score, ok = ctx.Value(scoreCtxKey{}).(float64)
+
+	return score, ok
+}
+
+// middleware implements [proxy.Middleware] scoring the requested domain names.
+type middleware struct {
+	logger     *slog.Logger
+	scorer     Scorer
+	messages   proxy.MessageConstructor
+	quarantine *proxy.CustomUpstreamConfig
+	action     Action
+	threshold  float64
+}
+
+// NewMiddleware returns a middleware scoring the requested domain names and
+// taking the configured action on the ones scored at or above the threshold.
+// The score is also available to the wrapped handlers via [ScoreFromContext].
+// c must be valid.
+func NewMiddleware(c *Config) (m proxy.Middleware) {
+	return &middleware{
+		logger:     c.Logger,
+		scorer:     cmp.Or[Scorer](c.Scorer, DefaultScorer{}),
+		messages:   c.MessageConstructor,
+		quarantine: c.Quarantine,
+		action:     c.Action,
+		threshold:  c.Threshold,
+	}
+}
+
+// type check
+var _ proxy.Middleware = (*middleware)(nil)
+
+// Wrap implements the [proxy.Middleware] interface for *middleware.
+func (m *middleware) Wrap(h proxy.Handler) (wrapped proxy.Handler) {
+	f := func(ctx context.Context, p *proxy.Proxy, dctx *proxy.DNSContext) (err error) {
+		if dctx.Req == nil || len(dctx.Req.Question) == 0 {
+			return h.ServeDNS(ctx, p, dctx)
+		}
+
+		qname := dctx.Req.Question[0].Name
+		score := m.scorer.Score(qname)
+		ctx = ContextWithScore(ctx, score)
+
+		if score < m.threshold {
+			return h.ServeDNS(ctx, p, dctx)
+		}
+
+		m.logger.InfoContext(
+			ctx,
+			"domain is likely generated",
+			"qname", qname,
+			"score", score,
+			"action", m.action,
+		)
+
+		switch m.action {
+		case ActionBlock:
+			dctx.Res = m.messages.NewMsgNXDOMAIN(dctx.Req)
+
+			return nil
+		case ActionQuarantine:
+			dctx.CustomUpstreamConfig = m.quarantine
+		default:
+			// Go on.
+		}
+
+		return h.ServeDNS(ctx, p, dctx)
+	}
+
+	return proxy.HandlerFunc(f)
+}
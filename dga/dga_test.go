@@ -0,0 +1,176 @@
+package dga_test
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/dga"
+	"github.com/AdguardTeam/dnsproxy/internal/dnsmsg"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// defaultTimeout is a default timeout for tests and contexts.
+const defaultTimeout = 1 * time.Second
+
+// testLogger is a test logger used in tests.
+var testLogger = slogutil.NewDiscardLogger()
+
+// Domain names used in tests.
+const (
+	testFQDNCommon    = "www.google.com."
+	testFQDNGenerated = "xj4k2qz8w9p1r7t5v3n6.com."
+)
+
+func TestDefaultScorer_Score(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		want assert.ComparisonAssertionFunc
+		name string
+		fqdn string
+	}{{
+		want: assert.Less,
+		name: "common",
+		fqdn: testFQDNCommon,
+	}, {
+		want: assert.Less,
+		name: "common_long",
+		fqdn: "www.stackoverflow.com.",
+	}, {
+		want: assert.GreaterOrEqual,
+		name: "generated",
+		fqdn: testFQDNGenerated,
+	}, {
+		want: assert.GreaterOrEqual,
+		name: "generated_subdomain",
+		fqdn: "a.qwx7bv0zk3mlp9rj2ty5.example.net.",
+	}, {
+		want: assert.Less,
+		name: "tld",
+		fqdn: "com.",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			tc.want(t, dga.DefaultScorer{}.Score(tc.fqdn), dga.DefaultThreshold)
+		})
+	}
+}
+
+func TestMiddleware_Wrap(t *testing.T) {
+	t.Parallel()
+
+	quarantine := proxy.NewCustomUpstreamConfig(&proxy.UpstreamConfig{}, false, 0, false)
+
+	testCases := []struct {
+		wantCustom *proxy.CustomUpstreamConfig
+		name       string
+		fqdn       string
+		action     dga.Action
+		wantRcode  int
+		wantCalled bool
+	}{{
+		wantCustom: nil,
+		name:       "log",
+		fqdn:       testFQDNGenerated,
+		action:     dga.ActionLog,
+		wantRcode:  dns.RcodeSuccess,
+		wantCalled: true,
+	}, {
+		wantCustom: nil,
+		name:       "block",
+		fqdn:       testFQDNGenerated,
+		action:     dga.ActionBlock,
+		wantRcode:  dns.RcodeNameError,
+		wantCalled: false,
+	}, {
+		wantCustom: quarantine,
+		name:       "quarantine",
+		fqdn:       testFQDNGenerated,
+		action:     dga.ActionQuarantine,
+		wantRcode:  dns.RcodeSuccess,
+		wantCalled: true,
+	}, {
+		wantCustom: nil,
+		name:       "not_flagged",
+		fqdn:       testFQDNCommon,
+		action:     dga.ActionBlock,
+		wantRcode:  dns.RcodeSuccess,
+		wantCalled: true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			conf := &dga.Config{
+				Logger:             testLogger,
+				MessageConstructor: dnsmsg.DefaultMessageConstructor{},
+				Quarantine:         quarantine,
+				Action:             tc.action,
+				Threshold:          dga.DefaultThreshold,
+			}
+			require.NoError(t, conf.Validate())
+
+			var called bool
+			h := dga.NewMiddleware(conf).Wrap(proxy.HandlerFunc(func(
+				ctx context.Context,
+				_ *proxy.Proxy,
+				dctx *proxy.DNSContext,
+			) (err error) {
+				called = true
+
+				_, ok := dga.ScoreFromContext(ctx)
+				assert.True(t, ok)
+
+				dctx.Res = (&dns.Msg{}).SetReply(dctx.Req)
+
+				return nil
+			}))
+
+			dctx := &proxy.DNSContext{
+				Req:  (&dns.Msg{}).SetQuestion(tc.fqdn, dns.TypeA),
+				Addr: netip.MustParseAddrPort("192.0.2.1:53"),
+			}
+
+			ctx := testutil.ContextWithTimeout(t, defaultTimeout)
+			require.NoError(t, h.ServeDNS(ctx, nil, dctx))
+			require.NotNil(t, dctx.Res)
+
+			assert.Equal(t, tc.wantCalled, called)
+			assert.Equal(t, tc.wantRcode, dctx.Res.Rcode)
+			assert.Same(t, tc.wantCustom, dctx.CustomUpstreamConfig)
+		})
+	}
+}
+
+func TestConfig_Validate(t *testing.T) {
+	t.Parallel()
+
+	assert.NoError(t, (&dga.Config{
+		Logger:    testLogger,
+		Action:    dga.ActionLog,
+		Threshold: dga.DefaultThreshold,
+	}).Validate())
+
+	assert.Error(t, (&dga.Config{
+		Logger:    testLogger,
+		Action:    dga.ActionBlock,
+		Threshold: dga.DefaultThreshold,
+	}).Validate())
+
+	assert.Error(t, (&dga.Config{
+		Logger:    testLogger,
+		Action:    "bad",
+		Threshold: dga.DefaultThreshold,
+	}).Validate())
+}
@@ -0,0 +1,99 @@
+package dga
+
+import (
+	"math"
+	"strings"
+)
+
+// Scorer scores domain names by how likely they are generated by a domain
+// generation algorithm.
+type Scorer interface {
+	// Score returns the score of fqdn in the range of [0, 1].  Higher scores
+	// mean more likely generated domain names.  It must be safe for concurrent
+	// use.
+	Score(fqdn string) (score float64)
+}
+
+// Weights of the metrics used by [DefaultScorer].
+const (
+	entropyWeight = 0.5
+	lengthWeight  = 0.3
+	numericWeight = 0.2
+)
+
+// maxScoredLabelLen is the label length, at and above which the length metric
+// of [DefaultScorer] is maximal.
+const maxScoredLabelLen = 32
+
+// alphabetLen is the number of characters commonly used in hostname labels,
+// excluding the hyphen.
+const alphabetLen = 36
+
+// DefaultScorer is the default [Scorer].  It scores the longest label of the
+// domain name excluding the top-level domain by its Shannon entropy, length,
+// and the ratio of digits.
+type DefaultScorer struct{}
+
+// type check
+var _ Scorer = DefaultScorer{}
+
+// Score implements the [Scorer] interface for DefaultScorer.
+func (DefaultScorer) Score(fqdn string) (score float64) {
+	label := longestLabel(fqdn)
+	if label == "" {
+		return 0
+	}
+
+	l := float64(len(label))
+	entropy := labelEntropy(label) / math.Log2(alphabetLen)
+	length := min(l/maxScoredLabelLen, 1)
+
+	digits := 0
+	for _, c := range []byte(label) {
+		if c >= '0' && c <= '9' {
+			digits++
+		}
+	}
+
+	numeric := float64(digits) / l
+
+	return min(entropyWeight*entropy+lengthWeight*length+numericWeight*numeric, 1)
+}
+
+// longestLabel returns the lowercased longest label of fqdn excluding the
+// top-level domain.
+func longestLabel(fqdn string) (label string) {
+	labels := strings.Split(strings.ToLower(strings.TrimSuffix(fqdn, ".")), ".")
+	if len(labels) < 2 {
+		return ""
+	}
+
+	for _, l := range labels[:len(labels)-1] {
+		if len(l) > len(label) {
+			label = l
+		}
+	}
+
+	return label
+}
+
+// labelEntropy returns the Shannon entropy of the characters of label in bits.
+// label must not be empty.
+func labelEntropy(label string) (entropy float64) {
+	var counts [256]uint
+	for _, c := range []byte(label) {
+		counts[c]++
+	}
+
+	l := float64(len(label))
+	for _, n := range counts {
+		if n == 0 {
+			continue
+		}
+
+		p := float64(n) / l
+		entropy -= p * math.Log2(p)
+	}
+
+	return entropy
+}
@@ -10,6 +10,7 @@ import (
 	"net/netip"
 	"net/url"
 	"slices"
+	"sync/atomic"
 	"time"
 
 	"github.com/AdguardTeam/golibs/errors"
@@ -110,29 +111,65 @@ func NewDialContext(timeout time.Duration, l *slog.Logger, addrs ...string) (h D
 	}
 
 	return func(ctx context.Context, network Network, _ string) (conn net.Conn, err error) {
-		var errs []error
+		// Note that we're using addrs instead of what's passed to the function.
+		return dialFirst(ctx, dialer, l, network, addrs)
+	}
+}
+
+// NewRotatingDialContext is like [NewDialContext], but each call of the
+// returned handler starts dialing from the address next to the one the previous
+// call has started from.  It spreads the connections between addrs while still
+// falling back to the other addresses on failure.  l must not be nil.
+func NewRotatingDialContext(timeout time.Duration, l *slog.Logger, addrs ...string) (h DialHandler) {
+	addrLen := len(addrs)
+	if addrLen < 2 {
+		return NewDialContext(timeout, l, addrs...)
+	}
+
+	dialer := &net.Dialer{
+		Timeout: timeout,
+	}
 
-		// Return first succeeded connection.  Note that we're using addrs
-		// instead of what's passed to the function.
-		for i, addr := range addrs {
-			a := l.With("addr", addr)
-			a.DebugContext(ctx, "dialing", "idx", i+1, "total", addrLen)
+	next := &atomic.Uint64{}
 
-			start := time.Now()
-			conn, err = dialer.DialContext(ctx, network, addr)
-			elapsed := time.Since(start)
-			if err != nil {
-				a.DebugContext(ctx, "connection failed", "elapsed", elapsed, slogutil.KeyError, err)
-				errs = append(errs, err)
+	return func(ctx context.Context, network Network, _ string) (conn net.Conn, err error) {
+		start := int((next.Add(1) - 1) % uint64(addrLen))
+		rotated := append(slices.Clone(addrs[start:]), addrs[:start]...)
 
-				continue
-			}
+		return dialFirst(ctx, dialer, l, network, rotated)
+	}
+}
 
-			a.DebugContext(ctx, "connection succeeded", "elapsed", elapsed)
+// dialFirst dials addrs in order and returns the first successful connection.
+// addrs must not be empty.
+func dialFirst(
+	ctx context.Context,
+	dialer *net.Dialer,
+	l *slog.Logger,
+	network Network,
+	addrs []string,
+) (conn net.Conn, err error) {
+	addrLen := len(addrs)
 
-			return conn, nil
+	var errs []error
+	for i, addr := range addrs {
+		a := l.With("addr", addr)
+		a.DebugContext(ctx, "dialing", "idx", i+1, "total", addrLen)
+
+		start := time.Now()
+		conn, err = dialer.DialContext(ctx, network, addr)
+		elapsed := time.Since(start)
+		if err != nil {
+			a.DebugContext(ctx, "connection failed", "elapsed", elapsed, slogutil.KeyError, err)
+			errs = append(errs, err)
+
+			continue
 		}
 
-		return nil, errors.Join(errs...)
+		a.DebugContext(ctx, "connection succeeded", "elapsed", elapsed)
+
+		return conn, nil
 	}
+
+	return nil, errors.Join(errs...)
 }
@@ -172,3 +172,51 @@ func TestResolveDialContext(t *testing.T) {
 		assert.Nil(t, dialContext)
 	})
 }
+
+func TestNewRotatingDialContext(t *testing.T) {
+	sigFirst, sigSecond := make(chan net.Addr, 1), make(chan net.Addr, 1)
+	first := newListener(t, "tcp", sigFirst).String()
+	second := newListener(t, "tcp", sigSecond).String()
+
+	l := slogutil.NewDiscardLogger()
+
+	t.Run("rotate", func(t *testing.T) {
+		dialContext := bootstrap.NewRotatingDialContext(testTimeout, l, first, second)
+
+		for _, want := range []string{first, second, first, second} {
+			conn, err := dialContext(context.Background(), bootstrap.NetworkTCP, "")
+			require.NoError(t, err)
+
+			assert.Equal(t, want, conn.RemoteAddr().String())
+
+			sig := sigFirst
+			if want == second {
+				sig = sigSecond
+			}
+
+			_, ok := testutil.RequireReceive(t, sig, testTimeout)
+			require.True(t, ok)
+		}
+	})
+
+	t.Run("failover", func(t *testing.T) {
+		// Get an address with nothing listening on it.
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+
+		closed := ln.Addr().String()
+		require.NoError(t, ln.Close())
+
+		dialContext := bootstrap.NewRotatingDialContext(testTimeout, l, closed, first)
+
+		for range 2 {
+			conn, dialErr := dialContext(context.Background(), bootstrap.NetworkTCP, "")
+			require.NoError(t, dialErr)
+
+			assert.Equal(t, first, conn.RemoteAddr().String())
+
+			_, ok := testutil.RequireReceive(t, sigFirst, testTimeout)
+			require.True(t, ok)
+		}
+	})
+}
@@ -70,6 +70,84 @@ const (
 	dohRoutesIdx
 	dohInsecureEnabledIdx
 	dnssecEnabledIdx
+	quicKeepAliveIdx
+	upstreamBootstrapIdx
+	logQNameModeIdx
+	logClientIPModeIdx
+	logSampleRateIdx
+	ratelimitAllowlistDomainsIdx
+	maxUpstreamQueriesIdx
+	maxQueriesPerUpstreamIdx
+	upstreamQueueTimeoutIdx
+	safeSearchIdx
+	blockedServicesIdx
+	rebindingProtectionIdx
+	rebindingAllowedDomainsIdx
+	dgaActionIdx
+	dgaThresholdIdx
+	dgaQuarantineUpstreamsIdx
+	dhcpLeasesIdx
+	dhcpLeasesDomainIdx
+	minimizeAnswersIdx
+	malformedQueryActionsIdx
+	queryTypeActionsIdx
+	queryClassActionsIdx
+	aaaaSuppressionIdx
+	aaaaSuppressionDomainsIdx
+	aaaaSuppressionClientsIdx
+	selfTestIdx
+	selfTestDomainIdx
+	blockCanaryDomainsIdx
+	udpRetransmitAttemptsIdx
+	udpRetransmitIntervalIdx
+	udpRetransmitSwitchServerIdx
+	compressionIdx
+	httpsRequiredHeadersIdx
+	httpsRejectedHeadersIdx
+	httpsResponseHeadersIdx
+	httpsCORSOriginsIdx
+	http3ProbeCacheTTLIdx
+	http3ProbeCacheFileIdx
+	httpErrorBudgetIdx
+	httpDowngradePeriodIdx
+	httpsMaxRequestSizeIdx
+	paddingIdx
+	tlsFingerprintingIdx
+	tlsSessionTicketLifetimeIdx
+	tlsSessionTicketsDisabledIdx
+	connIdleTimeoutIdx
+	maxConnsIdx
+	maxConnsPerClientIdx
+	maxQueriesPerConnIdx
+	cacheAggressiveNSECIdx
+	answerOrderIdx
+	cacheFixedTTLIdx
+	upstreamLazyInitIdx
+	listenDSCPIdx
+	upstreamDSCPIdx
+	upstreamFaultsIdx
+	clientFaultsIdx
+	udpPacingRateIdx
+	udpPacingBurstIdx
+	udpPacingMaxDelayIdx
+	upstreamEDNSBufSizeIdx
+	udpRandomizeCaseIdx
+	torSOCKSIdx
+	logErrorSummaryIntervalIdx
+	logQuietSuccessIdx
+	svcbNameIdx
+	svcbHintsIdx
+	quicDisableOffloadIdx
+	quicFlowLabelIdx
+	logRejectedIdx
+	upstreamQuestionMismatchIdx
+	upstreamWarmStandbyIdx
+	cacheDomainTTLIdx
+	memoryLimitIdx
+	profileIdx
+	allowedDomainsIdx
+	consensusUpstreamsIdx
+	consensusQuorumIdx
 )
 
 // commandLineOption contains information about a command-line option: its long
@@ -137,16 +215,17 @@ var commandLineOptions = []*commandLineOption{
 	},
 	upstreamModeIdx: {
 		description: "Defines the upstreams logic mode, possible values: load_balance, parallel, " +
-			"fastest_addr (default: load_balance).",
+			"fastest_addr, best_p95, consensus (default: load_balance).",
 		long:      "upstream-mode",
 		short:     "",
 		valueType: "mode",
 	},
 	listenAddrsIdx: {
-		description: "Listening addresses.",
-		long:        "listen",
-		short:       "l",
-		valueType:   "address",
+		description: "Listening addresses: IP addresses, network interface names, or hostnames.  " +
+			"Interfaces and hostnames are expanded to all their current addresses.",
+		long:      "listen",
+		short:     "l",
+		valueType: "address",
 	},
 	listenPortsIdx: {
 		description: "Listening ports. Zero value disables TCP and UDP listeners.",
@@ -327,10 +406,11 @@ var commandLineOptions = []*commandLineOption{
 		valueType:   "",
 	},
 	pprofIdx: {
-		description: "If present, exposes pprof information on localhost:6060.",
-		long:        "pprof",
-		short:       "",
-		valueType:   "",
+		description: "If present, exposes pprof information, upstream connection and " +
+			"response statistics, and listener controls on localhost:6060.",
+		long:      "pprof",
+		short:     "",
+		valueType: "",
 	},
 	versionIdx: {
 		description: "Prints the program version.",
@@ -426,6 +506,532 @@ var commandLineOptions = []*commandLineOption{
 		short:       "",
 		valueType:   "",
 	},
+	quicKeepAliveIdx: {
+		description: "Period of QUIC keep-alive PINGs on idle DoQ and DoH3 upstream connections.  " +
+			"Default: 20s.",
+		long:      "quic-keepalive",
+		short:     "",
+		valueType: "duration",
+	},
+	upstreamBootstrapIdx: {
+		description: "Bootstrap DNS for the upstreams with the specified hostnames in the form of " +
+			"[/host/]bootstrap, overrides --bootstrap for them.  Use # for the system " +
+			"resolver.  Can be specified multiple times.",
+		long:      "upstream-bootstrap",
+		short:     "",
+		valueType: "address",
+	},
+	logQNameModeIdx: {
+		description: "How queried domain names are logged: \"full\", \"hash\" with a random " +
+			"per-process key, or \"none\".  DNS message dumps are only logged when both this and --log-client-ip-mode are " +
+			"\"full\".  Default: full.",
+		long:      "log-qname-mode",
+		short:     "",
+		valueType: "mode",
+	},
+	logClientIPModeIdx: {
+		description: "How client addresses and ECS subnets are logged: \"full\", \"truncate\" " +
+			"to /24 for IPv4 and /56 for IPv6, or \"none\".  Default: full.",
+		long:      "log-client-ip-mode",
+		short:     "",
+		valueType: "mode",
+	},
+	logSampleRateIdx: {
+		description: "Log the contents of only 1 in N DNS messages in verbose mode.  Zero and one " +
+			"mean logging every message.",
+		long:      "log-sample-rate",
+		short:     "",
+		valueType: "uint",
+	},
+	ratelimitAllowlistDomainsIdx: {
+		description: "Domain name, requests for which and for its subdomains are not rate limited.  " +
+			"Can be specified multiple times.",
+		long:      "ratelimit-allowlist-domain",
+		short:     "",
+		valueType: "domain",
+	},
+	maxUpstreamQueriesIdx: {
+		description: "Maximum number of simultaneous queries to all upstreams.  Zero means no limit.",
+		long:        "max-upstream-queries",
+		short:       "",
+		valueType:   "uint",
+	},
+	maxQueriesPerUpstreamIdx: {
+		description: "Maximum number of simultaneous queries to a single upstream.  Zero means no " +
+			"limit.",
+		long:      "max-queries-per-upstream",
+		short:     "",
+		valueType: "uint",
+	},
+	upstreamQueueTimeoutIdx: {
+		description: "Maximum time a query waits for the upstream query limits.  Default: 1s.",
+		long:        "upstream-queue-timeout",
+		short:       "",
+		valueType:   "duration",
+	},
+	safeSearchIdx: {
+		description: "Service to enforce the safe search for, e.g. google or youtube.  Can be " +
+			"specified multiple times.",
+		long:      "safe-search",
+		short:     "",
+		valueType: "service",
+	},
+	blockedServicesIdx: {
+		description: "Service to block, e.g. tiktok.  Can be specified multiple times.",
+		long:        "blocked-service",
+		short:       "",
+		valueType:   "service",
+	},
+	rebindingProtectionIdx: {
+		description: "DNS rebinding protection mode for answers with internal addresses, possible " +
+			"values: strip, nxdomain.",
+		long:      "rebinding-protection",
+		short:     "",
+		valueType: "mode",
+	},
+	rebindingAllowedDomainsIdx: {
+		description: "Domain allowed to resolve to internal addresses along with its subdomains.  " +
+			"Can be specified multiple times.",
+		long:      "rebinding-allowed-domain",
+		short:     "",
+		valueType: "domain",
+	},
+	dgaActionIdx: {
+		description: "Action on the requests for domains likely generated by DGAs, possible values: " +
+			"log, block, quarantine.  Disabled by default.",
+		long:      "dga-action",
+		short:     "",
+		valueType: "action",
+	},
+	dgaThresholdIdx: {
+		description: "Score from 0 to 1, at and above which a domain is considered generated by a " +
+			"DGA.  Default: 0.6.",
+		long:      "dga-threshold",
+		short:     "",
+		valueType: "float",
+	},
+	dgaQuarantineUpstreamsIdx: {
+		description: "Upstream to resolve the domains likely generated by DGAs with when the action " +
+			"is quarantine.  Can be specified multiple times.",
+		long:      "dga-quarantine-upstream",
+		short:     "",
+		valueType: "address",
+	},
+	dhcpLeasesIdx: {
+		description: "Path to the dnsmasq or ISC DHCP server lease file to resolve the clients' " +
+			"hostnames from.",
+		long:      "dhcp-leases",
+		short:     "",
+		valueType: "path",
+	},
+	dhcpLeasesDomainIdx: {
+		description: "Domain name of the local network for the hostnames from the DHCP leases, " +
+			"e.g. lan.",
+		long:      "dhcp-leases-domain",
+		short:     "",
+		valueType: "name",
+	},
+	minimizeAnswersIdx: {
+		description: "If specified, removes the authority and additional sections from the " +
+			"responses, except for the SOA records of negative responses.",
+		long:      "minimize-answers",
+		short:     "",
+		valueType: "",
+	},
+	malformedQueryActionsIdx: {
+		description: "Action on the malformed queries: drop, log_drop, or formerr, optionally " +
+			"prefixed with one of the protocols: udp, tcp, tls, https, quic.  Can be specified " +
+			"multiple times.",
+		long:      "malformed-query-action",
+		short:     "",
+		valueType: "[proto:]action",
+	},
+	queryTypeActionsIdx: {
+		description: "Action on the requests of the query type, e.g. HTTPS:nodata.  Actions: refuse, " +
+			"drop, nodata, nxdomain.  Can be specified multiple times.",
+		long:      "qtype-action",
+		short:     "",
+		valueType: "type:action",
+	},
+	queryClassActionsIdx: {
+		description: "Action on the requests of the query class, e.g. CH:refuse.  Actions: " +
+			"refuse, drop, nodata, nxdomain.  Can be specified multiple times.",
+		long:      "qclass-action",
+		short:     "",
+		valueType: "class:action",
+	},
+	aaaaSuppressionIdx: {
+		description: "Mode of answering AAAA queries with NODATA for networks with broken IPv6, possible values: " +
+			"always, if_a_exists.  The latter only suppresses AAAA answers for names having A answers.  " +
+			"The answers from the hosts files are never suppressed.",
+		long:      "aaaa-suppression",
+		short:     "",
+		valueType: "mode",
+	},
+	aaaaSuppressionDomainsIdx: {
+		description: "Domain to suppress AAAA answers for along with its subdomains.  " +
+			"Can be specified multiple times.  If not specified, all domains are affected.",
+		long:      "aaaa-suppression-domain",
+		short:     "",
+		valueType: "domain",
+	},
+	aaaaSuppressionClientsIdx: {
+		description: "Subnet of clients to suppress AAAA answers for.  " +
+			"Can be specified multiple times.  If not specified, all clients are affected.",
+		long:      "aaaa-suppression-client",
+		short:     "",
+		valueType: "subnet",
+	},
+	selfTestIdx: {
+		description: "Exercise each upstream with A, AAAA, EDNS, and DNSSEC probe queries on startup, possible values: " +
+			"warn, strict.  In the strict mode, dnsproxy refuses to start if any upstream misbehaves.",
+		long:      "self-test",
+		short:     "",
+		valueType: "mode",
+	},
+	selfTestDomainIdx: {
+		description: "Signed domain name resolved by the self-test probes.  Default: " + defaultSelfTestDomain + ".",
+		long:        "self-test-domain",
+		short:       "",
+		valueType:   "domain",
+	},
+	blockCanaryDomainsIdx: {
+		description: "If specified, requests for the canary domains of browsers and operating " +
+			"systems, e.g. use-application-dns.net, are replied with NXDOMAIN to keep clients " +
+			"from switching to their own encrypted resolvers.",
+		long:      "block-canary-domains",
+		short:     "",
+		valueType: "",
+	},
+	udpRetransmitAttemptsIdx: {
+		description: "Maximum number of times a query is sent to a plain UDP upstream.  " +
+			"Values less than 2 disable the retransmission.",
+		long:      "udp-retransmit-attempts",
+		short:     "",
+		valueType: "uint",
+	},
+	udpRetransmitIntervalIdx: {
+		description: "Time to wait for the response from a plain UDP upstream before sending the query again " +
+			"in a human-readable form.",
+		long:      "udp-retransmit-interval",
+		short:     "",
+		valueType: "duration",
+	},
+	udpRetransmitSwitchServerIdx: {
+		description: "If specified, retransmitted queries to plain UDP upstreams are sent through new sockets " +
+			"and to the next of the upstream addresses, if several are specified.",
+		long:      "udp-retransmit-switch-server",
+		short:     "",
+		valueType: "",
+	},
+	compressionIdx: {
+		description: "Mode of the name compression in responses, possible values: auto, never.  " +
+			"By default, the names are always compressed.  Responses are truncated according to their packed size.",
+		long:      "compression",
+		short:     "",
+		valueType: "mode",
+	},
+	httpsRequiredHeadersIdx: {
+		description: "Header each DoH request must contain, optionally with one of the accepted values, " +
+			"e.g. Accept:application/dns-message.  Can be specified multiple times.",
+		long:      "https-require-header",
+		short:     "",
+		valueType: "name[:value]",
+	},
+	httpsRejectedHeadersIdx: {
+		description: "Header making the DoH requests containing it rejected, e.g. Cookie.  " +
+			"Can be specified multiple times.",
+		long:      "https-reject-header",
+		short:     "",
+		valueType: "name",
+	},
+	httpsResponseHeadersIdx: {
+		description: "Header to add to every response of the DoH server, " +
+			"e.g. \"Strict-Transport-Security:max-age=63072000\".  Can be specified multiple times.",
+		long:      "https-response-header",
+		short:     "",
+		valueType: "name:value",
+	},
+	httpsCORSOriginsIdx: {
+		description: "Origin of browser-based DoH clients allowed to access the DoH server, \"*\" allows any origin.  " +
+			"Can be specified multiple times.",
+		long:      "https-cors-origin",
+		short:     "",
+		valueType: "origin",
+	},
+	http3ProbeCacheTTLIdx: {
+		description: "Duration for which the outcome of racing HTTP/3 against HTTP/2 for a DoH upstream " + "is reused when its connections are re-created.  Default: 0, probe each time.",
+		long:        "http3-probe-cache-ttl",
+		short:       "",
+		valueType:   "duration",
+	},
+	http3ProbeCacheFileIdx: {
+		description: "Path to the file to keep the outcomes of racing HTTP/3 against HTTP/2 in between " + "restarts.  Requires --http3-probe-cache-ttl.",
+		long:        "http3-probe-cache-file",
+		short:       "",
+		valueType:   "path",
+	},
+	httpErrorBudgetIdx: {
+		description: "Maximum share of failed exchanges with a DoH upstream using a single HTTP version, " + "from 0 to 1.  Once exceeded, the upstream is downgraded from HTTP/3 to HTTP/2 and " + "from HTTP/2 to HTTP/1.1.  Default: 0, never downgrade.",
+		long:        "http-error-budget",
+		short:       "",
+		valueType:   "float",
+	},
+	httpDowngradePeriodIdx: {
+		description: "Time a downgraded DoH upstream keeps using the lower HTTP version.  Default: 1m.",
+		long:        "http-downgrade-period",
+		short:       "",
+		valueType:   "duration",
+	},
+	httpsMaxRequestSizeIdx: {
+		description: "Maximum size of the DNS message in a DoH request, in bytes.  Larger requests are " + "rejected before being read in full.  Default: 65535.",
+		long:        "https-max-request-size",
+		short:       "",
+		valueType:   "bytes",
+	},
+	paddingIdx: {
+		description: "Mode of padding responses sent over DoT, DoH, and DoQ to multiples of 468 bytes, possible " + "values: requested, always.  By default, the responses aren't padded.",
+		long:        "padding",
+		short:       "",
+		valueType:   "mode",
+	},
+	tlsFingerprintingIdx: {
+		description: "If specified, log the JA3 and JA4 fingerprints of the TLS clients.",
+		long:        "tls-fingerprinting",
+		short:       "",
+		valueType:   "",
+	},
+	tlsSessionTicketLifetimeIdx: {
+		description: "Maximum age of the TLS session tickets accepted by the DNS-over-TLS " + "listeners to resume the sessions.  Default: 168h.",
+		long:        "tls-session-ticket-lifetime",
+		short:       "",
+		valueType:   "duration",
+	},
+	tlsSessionTicketsDisabledIdx: {
+		description: "If specified, disable the TLS session tickets for DNS-over-TLS.",
+		long:        "tls-session-tickets-disabled",
+		short:       "",
+		valueType:   "",
+	},
+	connIdleTimeoutIdx: {
+		description: "Time a DNS-over-TLS or DNS-over-QUIC client connection may stay without " + "queries before it is closed.  Default: 10s for DoT and 30s for DoQ.",
+		long:        "conn-idle-timeout",
+		short:       "",
+		valueType:   "duration",
+	},
+	maxConnsIdx: {
+		description: "Maximum number of concurrent client connections per DNS-over-TLS and " + "DNS-over-QUIC listener.  Default: 0, no limit.",
+		long:        "max-conns",
+		short:       "",
+		valueType:   "uint",
+	},
+	maxConnsPerClientIdx: {
+		description: "Maximum number of concurrent connections from a single IP address per " + "DNS-over-TLS and DNS-over-QUIC listener.  Default: 0, no limit.",
+		long:        "max-conns-per-client",
+		short:       "",
+		valueType:   "uint",
+	},
+	maxQueriesPerConnIdx: {
+		description: "Maximum number of queries handled within a single DNS-over-TLS or " + "DNS-over-QUIC connection before it is closed.  Default: 0, no limit.",
+		long:        "max-queries-per-conn",
+		short:       "",
+		valueType:   "uint",
+	},
+	cacheAggressiveNSECIdx: {
+		description: "If specified, NXDOMAIN responses are synthesized from the cached NSEC and NSEC3 " +
+			"records proving the non-existence of names, see RFC 8198.  Requires --cache and --dnssec.",
+		long:      "cache-aggressive-nsec",
+		short:     "",
+		valueType: "",
+	},
+	answerOrderIdx: {
+		description: "Mode of ordering A and AAAA records within answers served from cache, possible values: " +
+			"round_robin, random.  By default, the order of the upstream response is kept.",
+		long:      "answer-order",
+		short:     "",
+		valueType: "mode",
+	},
+	cacheFixedTTLIdx: {
+		description: "If specified, cached responses are served with the TTLs received from the upstream " +
+			"instead of the ones decreased by the time spent in cache.",
+		long:      "cache-fixed-ttl",
+		short:     "",
+		valueType: "",
+	},
+	upstreamLazyInitIdx: {
+		description: "Construct the upstreams on their first use instead of at startup, useful for the " + "configurations with hundreds of domain-specific upstreams.",
+		long:        "upstream-lazy-init",
+		short:       "",
+		valueType:   "",
+	},
+	listenDSCPIdx: {
+		description: "DSCP value to mark the packets sent to the clients with, in the [proto:]value form, where proto is one of udp, tcp, tls, https, or quic.  Can be specified multiple times.",
+		long:        "listen-dscp",
+		short:       "",
+		valueType:   "dscp",
+	},
+	upstreamDSCPIdx: {
+		description: "DSCP value to mark the packets sent to the plain, DNS-over-TLS, and DNS-over-HTTPS upstreams with.",
+		long:        "upstream-dscp",
+		short:       "",
+		valueType:   "uint",
+	},
+	upstreamFaultsIdx: {
+		description: "Faults to inject into the upstream responses for testing, e.g. drop=0.1,delay=0.2:500ms,corrupt=0.05,truncate=0.05.  The values are the probabilities from 0 to 1.  Must not be used in production.",
+		long:        "upstream-faults",
+		short:       "",
+		valueType:   "faults",
+	},
+	clientFaultsIdx: {
+		description: "Faults to inject into the DNS messages received from the clients for " +
+			"testing, in the same form as --upstream-faults.  Must not be used in production.",
+		long:      "client-faults",
+		short:     "",
+		valueType: "faults",
+	},
+	udpPacingRateIdx: {
+		description: "Maximum number of responses per second sent over UDP to a single client subnet, " + "the bursts above it are smoothed.  The subnets are set by the ratelimit subnet " + "lengths.  Default: 0, no pacing.",
+		long:        "udp-pacing-rate",
+		short:       "",
+		valueType:   "uint",
+	},
+	udpPacingBurstIdx: {
+		description: "Number of responses sent over UDP to a single client subnet at once before " + "pacing starts.  Default: 1.",
+		long:        "udp-pacing-burst",
+		short:       "",
+		valueType:   "uint",
+	},
+	udpPacingMaxDelayIdx: {
+		description: "Maximum time a paced UDP response is held for, the ones held longer are " + "dropped.  Default: 200ms.",
+		long:        "udp-pacing-max-delay",
+		short:       "",
+		valueType:   "duration",
+	},
+	upstreamEDNSBufSizeIdx: {
+		description: "EDNS0 UDP payload size advertised to the plain DNS upstreams in the form of " + "[/host/]size, e.g. 1232 to avoid IP fragmentation.  Larger responses are " + "retried over TCP.  Can be specified multiple times.  Default: the size " + "requested by the client.",
+		long:        "upstream-edns-bufsize",
+		short:       "",
+		valueType:   "size",
+	},
+	udpRandomizeCaseIdx: {
+		description: "If specified, the case of the letters of the question names sent to plain UDP upstreams is randomized " +
+			"and the responses repeating it differently are discarded, see the 0x20 encoding.",
+		long:      "udp-randomize-case",
+		short:     "",
+		valueType: "",
+	},
+	torSOCKSIdx: {
+		description: "Address of the SOCKS5 port of a Tor client to dial the DNS-over-TLS and DNS-over-HTTPS upstreams " +
+			"with the .onion hostnames through, e.g. 127.0.0.1:9050.  Such upstreams don't use HTTP/3 and have longer timeouts.",
+		long:      "tor-socks",
+		short:     "",
+		valueType: "addr",
+	},
+	logErrorSummaryIntervalIdx: {
+		description: "Interval of the summary log lines of the repeated identical upstream errors, " +
+			"only the first error of a kind is logged right away.  Default: 0, every error is logged.",
+		long:      "log-error-summary-interval",
+		short:     "",
+		valueType: "duration",
+	},
+	logQuietSuccessIdx: {
+		description: "If specified, the successful exchanges with the upstreams aren't logged in verbose mode.",
+		long:        "log-quiet-success",
+		short:       "",
+		valueType:   "",
+	},
+	svcbNameIdx: {
+		description: "Publish the SVCB and HTTPS records advertising the encrypted endpoints for this name of the proxy " +
+			"and for _dns.resolver.arpa.",
+		long:      "svcb-name",
+		short:     "",
+		valueType: "name",
+	},
+	svcbHintsIdx: {
+		description: "IP address of the proxy advertised within the SVCB and HTTPS records.  " +
+			"Can be specified multiple times.",
+		long:      "svcb-hint",
+		short:     "",
+		valueType: "ip",
+	},
+	quicDisableOffloadIdx: {
+		description: "If specified, the UDP segmentation offload, ECN, and batched reads aren't used for the QUIC connections " +
+			"of DoQ and DoH3 upstreams on Linux.",
+		long:      "quic-disable-offload",
+		short:     "",
+		valueType: "",
+	},
+	quicFlowLabelIdx: {
+		description: "If specified, the IPv6 packets of DoQ and DoH3 upstream connections carry stable flow labels, " +
+			"Linux only.",
+		long:      "quic-flow-label",
+		short:     "",
+		valueType: "",
+	},
+	logRejectedIdx: {
+		description: "If specified, each query refused or dropped by the proxy is logged with the machine-readable reason.",
+		long:        "log-rejected",
+		short:       "",
+		valueType:   "",
+	},
+	upstreamQuestionMismatchIdx: {
+		description: "How upstream responses with a question section not matching the query are handled: " +
+			"reject, fix, or log.  Default: reject.",
+		long:      "upstream-question-mismatch",
+		short:     "",
+		valueType: "mode",
+	},
+	upstreamWarmStandbyIdx: {
+		description: "If specified, DNS-over-TLS and DNS-over-QUIC upstreams keep an additional established connection " +
+			"used right away once the active one fails.",
+		long:      "upstream-warm-standby",
+		short:     "",
+		valueType: "",
+	},
+	cacheDomainTTLIdx: {
+		description: "TTL range of the responses for a domain and its subdomains in the [/domain/]min:max form, " +
+			"e.g. [/internal.example/]:30.  Either limit may be omitted.  Overrides the cache min and max TTLs.  " +
+			"Can be specified multiple times.",
+		long:      "cache-domain-ttl",
+		short:     "",
+		valueType: "range",
+	},
+	memoryLimitIdx: {
+		description: "Memory budget of the process in bytes.  Once it is exceeded, the cache is " +
+			"cleared and new DoH connections are rejected until the usage falls below 90% of it.",
+		long:      "memory-limit",
+		short:     "",
+		valueType: "bytes",
+	},
+	profileIdx: {
+		description: "Resource profile, default or small.  The small profile for routers disables HTTP/3 " +
+			"and QUIC, and lowers the default cache size, buffers, and goroutine limit.",
+		long:      "profile",
+		short:     "",
+		valueType: "profile",
+	},
+	allowedDomainsIdx: {
+		description: "Domain pattern resolved in the default-deny mode, either example.com for the domain and its " +
+			"subdomains or *.example.com for the subdomains only.  Other domains are answered with NXDOMAIN.  " +
+			"Can be specified multiple times.",
+		long:      "allowed-domain",
+		short:     "",
+		valueType: "pattern",
+	},
+	consensusUpstreamsIdx: {
+		description: "Number of upstreams queried for each request in the consensus upstream mode.  " +
+			"Default: all the upstreams for the domain.",
+		long:      "consensus-upstreams",
+		short:     "",
+		valueType: "uint",
+	},
+	consensusQuorumIdx: {
+		description: "Number of the queried upstreams, which must agree on the response in the " +
+			"consensus upstream mode.  Default: the majority.",
+		long:      "consensus-quorum",
+		short:     "",
+		valueType: "uint",
+	},
 }
 
 // parseCmdLineOptions parses the command-line options.  conf must not be nil.
@@ -434,60 +1040,138 @@ func parseCmdLineOptions(conf *configuration) (err error) {
 
 	flags := flag.NewFlagSet(cmdName, flag.ContinueOnError)
 	for i, fieldPtr := range []any{
-		configPathIdx:               &conf.ConfigPath,
-		logOutputIdx:                &conf.LogOutput,
-		tlsCertPathIdx:              &conf.TLSCertPath,
-		tlsKeyPathIdx:               &conf.TLSKeyPath,
-		httpsServerNameIdx:          &conf.HTTPSServerName,
-		httpsUserinfoIdx:            &conf.HTTPSUserinfo,
-		dnsCryptConfigPathIdx:       &conf.DNSCryptConfigPath,
-		ednsAddrIdx:                 &conf.EDNSAddr,
-		upstreamModeIdx:             &conf.UpstreamMode,
-		listenAddrsIdx:              &conf.ListenAddrs,
-		listenPortsIdx:              &conf.ListenPorts,
-		httpsListenPortsIdx:         &conf.HTTPSListenPorts,
-		tlsListenPortsIdx:           &conf.TLSListenPorts,
-		quicListenPortsIdx:          &conf.QUICListenPorts,
-		dnsCryptListenPortsIdx:      &conf.DNSCryptListenPorts,
-		upstreamsIdx:                &conf.Upstreams,
-		bootstrapDNSIdx:             &conf.BootstrapDNS,
-		fallbacksIdx:                &conf.Fallbacks,
-		privateRDNSUpstreamsIdx:     &conf.PrivateRDNSUpstreams,
-		dns64PrefixIdx:              &conf.DNS64Prefix,
-		privateSubnetsIdx:           &conf.PrivateSubnets,
-		bogusNXDomainIdx:            &conf.BogusNXDomain,
-		hostsFilesIdx:               &conf.HostsFiles,
-		timeoutIdx:                  &conf.Timeout,
-		cacheMinTTLIdx:              &conf.CacheMinTTL,
-		cacheMaxTTLIdx:              &conf.CacheMaxTTL,
-		cacheOptimisticAnswerTTLIdx: &conf.OptimisticAnswerTTL,
-		cacheOptimisticMaxAgeIdx:    &conf.OptimisticMaxAge,
-		cacheSizeBytesIdx:           &conf.CacheSizeBytes,
-		ratelimitIdx:                &conf.Ratelimit,
-		ratelimitSubnetLenIPv4Idx:   &conf.RatelimitSubnetLenIPv4,
-		ratelimitSubnetLenIPv6Idx:   &conf.RatelimitSubnetLenIPv6,
-		udpBufferSizeIdx:            &conf.UDPBufferSize,
-		maxGoRoutinesIdx:            &conf.MaxGoRoutines,
-		tlsMinVersionIdx:            &conf.TLSMinVersion,
-		tlsMaxVersionIdx:            &conf.TLSMaxVersion,
-		helpIdx:                     &conf.help,
-		hostsFileEnabledIdx:         &conf.HostsFileEnabled,
-		pprofIdx:                    &conf.Pprof,
-		versionIdx:                  &conf.Version,
-		verboseIdx:                  &conf.Verbose,
-		insecureIdx:                 &conf.Insecure,
-		ipv6DisabledIdx:             &conf.IPv6Disabled,
-		http3Idx:                    &conf.HTTP3,
-		cacheOptimisticIdx:          &conf.CacheOptimistic,
-		cacheIdx:                    &conf.Cache,
-		refuseAnyIdx:                &conf.RefuseAny,
-		enableEDNSSubnetIdx:         &conf.EnableEDNSSubnet,
-		pendingRequestsEnabledIdx:   &conf.PendingRequestsEnabled,
-		dns64Idx:                    &conf.DNS64,
-		usePrivateRDNSIdx:           &conf.UsePrivateRDNS,
-		dohRoutesIdx:                &conf.DoHRoutes,
-		dohInsecureEnabledIdx:       &conf.DoHInsecureEnabled,
-		dnssecEnabledIdx:            &conf.DNSSECEnabled,
+		configPathIdx:                &conf.ConfigPath,
+		logOutputIdx:                 &conf.LogOutput,
+		tlsCertPathIdx:               &conf.TLSCertPath,
+		tlsKeyPathIdx:                &conf.TLSKeyPath,
+		httpsServerNameIdx:           &conf.HTTPSServerName,
+		httpsUserinfoIdx:             &conf.HTTPSUserinfo,
+		dnsCryptConfigPathIdx:        &conf.DNSCryptConfigPath,
+		ednsAddrIdx:                  &conf.EDNSAddr,
+		upstreamModeIdx:              &conf.UpstreamMode,
+		listenAddrsIdx:               &conf.ListenAddrs,
+		listenPortsIdx:               &conf.ListenPorts,
+		httpsListenPortsIdx:          &conf.HTTPSListenPorts,
+		tlsListenPortsIdx:            &conf.TLSListenPorts,
+		quicListenPortsIdx:           &conf.QUICListenPorts,
+		dnsCryptListenPortsIdx:       &conf.DNSCryptListenPorts,
+		upstreamsIdx:                 &conf.Upstreams,
+		bootstrapDNSIdx:              &conf.BootstrapDNS,
+		fallbacksIdx:                 &conf.Fallbacks,
+		privateRDNSUpstreamsIdx:      &conf.PrivateRDNSUpstreams,
+		dns64PrefixIdx:               &conf.DNS64Prefix,
+		privateSubnetsIdx:            &conf.PrivateSubnets,
+		bogusNXDomainIdx:             &conf.BogusNXDomain,
+		hostsFilesIdx:                &conf.HostsFiles,
+		timeoutIdx:                   &conf.Timeout,
+		cacheMinTTLIdx:               &conf.CacheMinTTL,
+		cacheMaxTTLIdx:               &conf.CacheMaxTTL,
+		cacheOptimisticAnswerTTLIdx:  &conf.OptimisticAnswerTTL,
+		cacheOptimisticMaxAgeIdx:     &conf.OptimisticMaxAge,
+		cacheSizeBytesIdx:            &conf.CacheSizeBytes,
+		ratelimitIdx:                 &conf.Ratelimit,
+		ratelimitSubnetLenIPv4Idx:    &conf.RatelimitSubnetLenIPv4,
+		ratelimitSubnetLenIPv6Idx:    &conf.RatelimitSubnetLenIPv6,
+		udpBufferSizeIdx:             &conf.UDPBufferSize,
+		maxGoRoutinesIdx:             &conf.MaxGoRoutines,
+		tlsMinVersionIdx:             &conf.TLSMinVersion,
+		tlsMaxVersionIdx:             &conf.TLSMaxVersion,
+		helpIdx:                      &conf.help,
+		hostsFileEnabledIdx:          &conf.HostsFileEnabled,
+		pprofIdx:                     &conf.Pprof,
+		versionIdx:                   &conf.Version,
+		verboseIdx:                   &conf.Verbose,
+		insecureIdx:                  &conf.Insecure,
+		ipv6DisabledIdx:              &conf.IPv6Disabled,
+		http3Idx:                     &conf.HTTP3,
+		cacheOptimisticIdx:           &conf.CacheOptimistic,
+		cacheIdx:                     &conf.Cache,
+		refuseAnyIdx:                 &conf.RefuseAny,
+		enableEDNSSubnetIdx:          &conf.EnableEDNSSubnet,
+		pendingRequestsEnabledIdx:    &conf.PendingRequestsEnabled,
+		dns64Idx:                     &conf.DNS64,
+		usePrivateRDNSIdx:            &conf.UsePrivateRDNS,
+		dohRoutesIdx:                 &conf.DoHRoutes,
+		dohInsecureEnabledIdx:        &conf.DoHInsecureEnabled,
+		dnssecEnabledIdx:             &conf.DNSSECEnabled,
+		quicKeepAliveIdx:             &conf.QUICKeepAlive,
+		upstreamBootstrapIdx:         &conf.UpstreamBootstraps,
+		logQNameModeIdx:              &conf.LogQNameMode,
+		logClientIPModeIdx:           &conf.LogClientIPMode,
+		logSampleRateIdx:             &conf.LogSampleRate,
+		ratelimitAllowlistDomainsIdx: &conf.RatelimitAllowlistDomains,
+		maxUpstreamQueriesIdx:        &conf.MaxUpstreamQueries,
+		maxQueriesPerUpstreamIdx:     &conf.MaxQueriesPerUpstream,
+		upstreamQueueTimeoutIdx:      &conf.UpstreamQueueTimeout,
+		safeSearchIdx:                &conf.SafeSearch,
+		blockedServicesIdx:           &conf.BlockedServices,
+		rebindingProtectionIdx:       &conf.RebindingProtection,
+		rebindingAllowedDomainsIdx:   &conf.RebindingAllowedDomains,
+		dgaActionIdx:                 &conf.DGAAction,
+		dgaThresholdIdx:              &conf.DGAThreshold,
+		dgaQuarantineUpstreamsIdx:    &conf.DGAQuarantineUpstreams,
+		dhcpLeasesIdx:                &conf.DHCPLeases,
+		dhcpLeasesDomainIdx:          &conf.DHCPLeasesDomain,
+		minimizeAnswersIdx:           &conf.MinimizeAnswers,
+		malformedQueryActionsIdx:     &conf.MalformedQueryActions,
+		queryTypeActionsIdx:          &conf.QueryTypeActions,
+		queryClassActionsIdx:         &conf.QueryClassActions,
+		aaaaSuppressionIdx:           &conf.AAAASuppression,
+		aaaaSuppressionDomainsIdx:    &conf.AAAASuppressionDomains,
+		aaaaSuppressionClientsIdx:    &conf.AAAASuppressionClients,
+		selfTestIdx:                  &conf.SelfTest,
+		selfTestDomainIdx:            &conf.SelfTestDomain,
+		blockCanaryDomainsIdx:        &conf.BlockCanaryDomains,
+		udpRetransmitAttemptsIdx:     &conf.UDPRetransmitAttempts,
+		udpRetransmitIntervalIdx:     &conf.UDPRetransmitInterval,
+		udpRetransmitSwitchServerIdx: &conf.UDPRetransmitSwitchServer,
+		compressionIdx:               &conf.Compression,
+		httpsRequiredHeadersIdx:      &conf.HTTPSRequiredHeaders,
+		httpsRejectedHeadersIdx:      &conf.HTTPSRejectedHeaders,
+		httpsResponseHeadersIdx:      &conf.HTTPSResponseHeaders,
+		httpsCORSOriginsIdx:          &conf.HTTPSCORSOrigins,
+		http3ProbeCacheTTLIdx:        &conf.HTTP3ProbeCacheTTL,
+		http3ProbeCacheFileIdx:       &conf.HTTP3ProbeCacheFile,
+		httpErrorBudgetIdx:           &conf.HTTPErrorBudget,
+		httpDowngradePeriodIdx:       &conf.HTTPDowngradePeriod,
+		httpsMaxRequestSizeIdx:       &conf.HTTPSMaxRequestSize,
+		paddingIdx:                   &conf.Padding,
+		tlsFingerprintingIdx:         &conf.TLSFingerprinting,
+		tlsSessionTicketLifetimeIdx:  &conf.TLSSessionTicketLifetime,
+		tlsSessionTicketsDisabledIdx: &conf.TLSSessionTicketsDisabled,
+		connIdleTimeoutIdx:           &conf.ConnIdleTimeout,
+		maxConnsIdx:                  &conf.MaxConns,
+		maxConnsPerClientIdx:         &conf.MaxConnsPerClient,
+		maxQueriesPerConnIdx:         &conf.MaxQueriesPerConn,
+		cacheAggressiveNSECIdx:       &conf.CacheAggressiveNSEC,
+		answerOrderIdx:               &conf.AnswerOrder,
+		cacheFixedTTLIdx:             &conf.CacheFixedTTL,
+		upstreamLazyInitIdx:          &conf.UpstreamLazyInit,
+		listenDSCPIdx:                &conf.ListenDSCP,
+		upstreamDSCPIdx:              &conf.UpstreamDSCP,
+		upstreamFaultsIdx:            &conf.UpstreamFaults,
+		clientFaultsIdx:              &conf.ClientFaults,
+		udpPacingRateIdx:             &conf.UDPPacingRate,
+		udpPacingBurstIdx:            &conf.UDPPacingBurst,
+		udpPacingMaxDelayIdx:         &conf.UDPPacingMaxDelay,
+		upstreamEDNSBufSizeIdx:       &conf.UpstreamEDNSBufSizes,
+		udpRandomizeCaseIdx:          &conf.UDPRandomizeCase,
+		torSOCKSIdx:                  &conf.TorSOCKSAddr,
+		logErrorSummaryIntervalIdx:   &conf.LogErrorSummaryInterval,
+		logQuietSuccessIdx:           &conf.LogQuietSuccess,
+		svcbNameIdx:                  &conf.SVCBName,
+		svcbHintsIdx:                 &conf.SVCBHints,
+		quicDisableOffloadIdx:        &conf.QUICDisableOffload,
+		quicFlowLabelIdx:             &conf.QUICFlowLabel,
+		logRejectedIdx:               &conf.LogRejected,
+		upstreamQuestionMismatchIdx:  &conf.UpstreamQuestionMismatch,
+		upstreamWarmStandbyIdx:       &conf.UpstreamWarmStandby,
+		cacheDomainTTLIdx:            &conf.CacheDomainTTLs,
+		memoryLimitIdx:               &conf.MemoryLimit,
+		profileIdx:                   &conf.Profile,
+		allowedDomainsIdx:            &conf.AllowedDomains,
+		consensusUpstreamsIdx:        &conf.ConsensusUpstreams,
+		consensusQuorumIdx:           &conf.ConsensusQuorum,
 	} {
 		addOption(flags, fieldPtr, commandLineOptions[i])
 	}
@@ -3,17 +3,24 @@ package cmd
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"log/slog"
+	"maps"
+	"math"
 	"net/http"
 	"net/http/pprof"
 	"os"
 	"os/signal"
+	"slices"
 	"syscall"
 	"time"
 
 	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/redact"
+	"github.com/AdguardTeam/dnsproxy/upstream"
 	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/httphdr"
 	"github.com/AdguardTeam/golibs/logutil/slogutil"
 	"github.com/AdguardTeam/golibs/osutil"
 	"github.com/AdguardTeam/golibs/version"
@@ -22,6 +29,10 @@ import (
 // Main is the entrypoint of dnsproxy CLI.  Main may accept arguments, such as
 // embedded assets and command-line arguments.
 func Main() {
+	if len(os.Args) > 1 && os.Args[1] == conformanceCommand {
+		os.Exit(runConformance(context.Background(), os.Args[2:], os.Stdout))
+	}
+
 	conf, exitCode, err := parseConfig()
 	if err != nil {
 		_, _ = fmt.Fprintln(os.Stderr, fmt.Errorf("parsing options: %w", err))
@@ -57,13 +68,17 @@ func Main() {
 		// TODO(d.kolyshev): Consider making configurable.
 		AddTimestamp: true,
 	})
+	l = slog.New(proxy.NewCorrelationHandler(l.Handler()))
 
-	ctx := context.Background()
+	l, err = withRedaction(l, conf)
+	if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, fmt.Errorf("configuring log redaction: %w", err))
 
-	if conf.Pprof {
-		runPprof(ctx, l)
+		os.Exit(osutil.ExitCodeArgumentError)
 	}
 
+	ctx := context.Background()
+
 	err = runProxy(ctx, l, conf)
 	if err != nil {
 		l.ErrorContext(ctx, "running dnsproxy", slogutil.KeyError, err)
@@ -79,6 +94,44 @@ func Main() {
 	}
 }
 
+// Default subnet lengths for truncating the client addresses in logs.
+const (
+	defaultRedactSubnetLenIPv4 = 24
+	defaultRedactSubnetLenIPv6 = 56
+)
+
+// withRedaction returns a logger that redacts the domain names and the client
+// addresses according to conf.  It returns l as is if no redaction is
+// configured.  l must not be nil.
+func withRedaction(l *slog.Logger, conf *configuration) (res *slog.Logger, err error) {
+	if conf.LogQNameMode == "" && conf.LogClientIPMode == "" {
+		return l, nil
+	}
+
+	c := &redact.Config{
+		QNameMode:     redact.QNameModeFull,
+		ClientIPMode:  redact.ClientIPModeFull,
+		SubnetLenIPv4: defaultRedactSubnetLenIPv4,
+		SubnetLenIPv6: defaultRedactSubnetLenIPv6,
+	}
+
+	if conf.LogQNameMode != "" {
+		c.QNameMode = redact.QNameMode(conf.LogQNameMode)
+	}
+
+	if conf.LogClientIPMode != "" {
+		c.ClientIPMode = redact.ClientIPMode(conf.LogClientIPMode)
+	}
+
+	err = c.Validate()
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return nil, err
+	}
+
+	return slog.New(redact.NewHandler(l.Handler(), c)), nil
+}
+
 // runProxy starts and runs the proxy.  l must not be nil.
 //
 // TODO(e.burkov):  Move into separate dnssvc package.
@@ -99,30 +152,62 @@ func runProxy(ctx context.Context, l *slog.Logger, conf *configuration) (err err
 		"commit_time", commitTime,
 	)
 
-	// Prepare the proxy server and its configuration.
-	proxyConf, err := createProxyConfig(ctx, l, conf)
+	insts, err := conf.instances(l)
 	if err != nil {
-		return fmt.Errorf("configuring proxy: %w", err)
+		return fmt.Errorf("configuring instances: %w", err)
 	}
 
-	dnsProxy, err := proxy.New(proxyConf)
-	if err != nil {
-		return fmt.Errorf("creating proxy: %w", err)
+	// Prepare the proxy servers and their configurations.
+	for _, inst := range insts {
+		err = inst.init(ctx, inst.logger(l))
+		if err != nil {
+			return inst.wrapErr(err)
+		}
 	}
 
-	// Start the proxy server.
-	err = dnsProxy.Start(ctx)
-	if err != nil {
-		return fmt.Errorf("starting dnsproxy: %w", err)
+	if conf.Pprof {
+		runPprof(ctx, l, insts)
+	}
+
+	// Start the proxy servers.
+	for i, inst := range insts {
+		err = inst.proxy.Start(ctx)
+		if err != nil {
+			shutdownErr := shutdownInstances(ctx, insts[:i])
+
+			err = inst.wrapErr(errors.WithDeferred(err, shutdownErr))
+
+			return fmt.Errorf("starting dnsproxy: %w", err)
+		}
+	}
+
+	// Update the listen addresses of all the instances, since those may become
+	// dynamic after reloading the configuration.
+	updateCtx, cancelUpdates := context.WithCancel(ctx)
+	for _, inst := range insts {
+		go inst.updateListenAddrs(updateCtx, inst.logger(l))
 	}
 
 	// TODO(e.burkov):  Use [service.SignalHandler].
 	signalChannel := make(chan os.Signal, 1)
-	signal.Notify(signalChannel, syscall.SIGINT, syscall.SIGTERM)
-	<-signalChannel
+	signal.Notify(signalChannel, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	for sig := range signalChannel {
+		if sig != syscall.SIGHUP {
+			break
+		}
 
-	// Stopping the proxy.
-	err = dnsProxy.Shutdown(ctx)
+		l.InfoContext(ctx, "reloading configuration")
+
+		err = reloadInstances(ctx, l, insts)
+		if err != nil {
+			l.ErrorContext(ctx, "reloading configuration", slogutil.KeyError, err)
+		}
+	}
+
+	cancelUpdates()
+
+	// Stopping the proxy servers.
+	err = shutdownInstances(ctx, insts)
 	if err != nil {
 		return fmt.Errorf("stopping dnsproxy: %w", err)
 	}
@@ -130,11 +215,33 @@ func runProxy(ctx context.Context, l *slog.Logger, conf *configuration) (err err
 	return nil
 }
 
-// runPprof runs pprof server on localhost:6060.
+// shutdownInstances shuts down the proxies of insts and returns the joined
+// errors.
+func shutdownInstances(ctx context.Context, insts []*instance) (err error) {
+	var errs []error
+	for _, inst := range insts {
+		err = inst.proxy.Shutdown(ctx)
+		if err != nil {
+			errs = append(errs, inst.wrapErr(err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// runPprof runs pprof server on localhost:6060.  It also serves the connection
+// and latency statistics of the upstreams of insts, the statistics of their
+// responses and memory usage, and allows stopping and starting their listeners.
 //
 // TODO(e.burkov):  Add debugsvc.
-func runPprof(ctx context.Context, l *slog.Logger) {
+func runPprof(ctx context.Context, l *slog.Logger, insts []*instance) {
 	mux := http.NewServeMux()
+	mux.Handle("/debug/upstreams", &upstreamsHandler{logger: l, insts: insts})
+	mux.Handle("/debug/responses", &responsesHandler{logger: l, insts: insts})
+	mux.Handle("/debug/rejected", &rejectedHandler{logger: l, insts: insts})
+	mux.Handle("/debug/memory", &memoryHandler{logger: l, insts: insts})
+	mux.Handle("/debug/latencies", &latenciesHandler{logger: l, insts: insts})
+	mux.Handle("POST /debug/listeners/{proto}/{action}", &listenersHandler{logger: l, insts: insts})
 	mux.HandleFunc("/debug/pprof/", pprof.Index)
 	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
 	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
@@ -164,3 +271,438 @@ func runPprof(ctx context.Context, l *slog.Logger) {
 		}
 	}()
 }
+
+// upstreamConnStats is the JSON representation of [upstream.ConnStats].
+type upstreamConnStats struct {
+	// Established is the time when the latest connection has been established,
+	// if any.
+	Established *time.Time `json:"established,omitempty"`
+
+	// Instance is the name of the proxy instance using the upstream, if the
+	// process runs several ones.
+	Instance string `json:"instance,omitempty"`
+
+	// Address is the address of the upstream.
+	Address string `json:"address"`
+
+	// Protocol is the protocol negotiated for the latest connection.
+	Protocol string `json:"protocol,omitempty"`
+
+	// Age is the age of the latest connection.
+	Age string `json:"age,omitempty"`
+
+	// LastError is the error of the latest failed exchange, if any.
+	LastError string `json:"last_error,omitempty"`
+
+	// Exchanges is the number of exchanges served by the upstream.
+	Exchanges uint64 `json:"exchanges"`
+
+	// TCPFallbacks is the number of exchanges retried over TCP.
+	TCPFallbacks uint64 `json:"tcp_fallbacks,omitempty"`
+
+	// QuestionMismatches is the number of responses with mismatched questions.
+	QuestionMismatches uint64 `json:"question_mismatches,omitempty"`
+
+	// Resumed is true if the TLS session of the latest connection has been
+	// resumed.
+	Resumed bool `json:"resumed"`
+}
+
+// newUpstreamConnStats returns the JSON representation of s for the upstream
+// with addr of the instance with the given name.  s must not be nil.
+func newUpstreamConnStats(
+	instName string,
+	addr string,
+	s *upstream.ConnStats,
+	now time.Time,
+) (c *upstreamConnStats) {
+	c = &upstreamConnStats{
+		Instance:           instName,
+		Address:            addr,
+		Protocol:           s.Protocol,
+		Exchanges:          s.Exchanges,
+		TCPFallbacks:       s.TCPFallbacks,
+		QuestionMismatches: s.QuestionMismatches,
+		Resumed:            s.Resumed,
+	}
+
+	if !s.Established.IsZero() {
+		c.Established = &s.Established
+		c.Age = now.Sub(s.Established).Truncate(time.Second).String()
+	}
+
+	if s.LastError != nil {
+		c.LastError = s.LastError.Error()
+	}
+
+	return c
+}
+
+// upstreamsHandler serves the connection statistics of the upstreams in JSON.
+type upstreamsHandler struct {
+	logger *slog.Logger
+	insts  []*instance
+}
+
+// type check
+var _ http.Handler = (*upstreamsHandler)(nil)
+
+// ServeHTTP implements the [http.Handler] interface for *upstreamsHandler.
+func (h *upstreamsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+
+	resp := []*upstreamConnStats{}
+	for _, inst := range h.insts {
+		stats := inst.currentProxy().UpstreamConnStats()
+		for _, addr := range slices.Sorted(maps.Keys(stats)) {
+			resp = append(resp, newUpstreamConnStats(inst.name, addr, stats[addr], now))
+		}
+	}
+
+	w.Header().Set(httphdr.ContentType, "application/json")
+
+	err := json.NewEncoder(w).Encode(resp)
+	if err != nil {
+		h.logger.DebugContext(r.Context(), "writing upstream stats", slogutil.KeyError, err)
+	}
+}
+
+// responseStats is the JSON representation of [proxy.ResponseStats].
+type responseStats struct {
+	// Sizes is the histogram of the response sizes.
+	Sizes []*responseSizeBucket `json:"sizes"`
+
+	// Instance is the name of the proxy instance, if the process runs several
+	// ones.
+	Instance string `json:"instance,omitempty"`
+
+	// Protocol is the protocol the responses have been sent over.
+	Protocol proxy.Proto `json:"protocol"`
+
+	// Count is the number of the responses sent.
+	Count uint64 `json:"count"`
+
+	// TotalSize is the total size of the responses sent in bytes.
+	TotalSize uint64 `json:"total_size"`
+
+	// Truncated is the number of the truncated responses sent.
+	Truncated uint64 `json:"truncated"`
+}
+
+// responseSizeBucket is the JSON representation of
+// [proxy.ResponseSizeBucket].
+type responseSizeBucket struct {
+	// UpperBound is the maximum size of the responses in the bucket in bytes.
+	UpperBound int `json:"upper_bound"`
+
+	// Count is the number of the responses in the bucket.
+	Count uint64 `json:"count"`
+}
+
+// responsesHandler serves the statistics of the responses in JSON.
+type responsesHandler struct {
+	logger *slog.Logger
+	insts  []*instance
+}
+
+// type check
+var _ http.Handler = (*responsesHandler)(nil)
+
+// ServeHTTP implements the [http.Handler] interface for *responsesHandler.
+func (h *responsesHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	resp := []*responseStats{}
+	for _, inst := range h.insts {
+		stats := inst.currentProxy().ResponseStats()
+		for _, proto := range slices.Sorted(maps.Keys(stats)) {
+			s := stats[proto]
+			rs := &responseStats{
+				Sizes:     make([]*responseSizeBucket, 0, len(s.Sizes)),
+				Instance:  inst.name,
+				Protocol:  proto,
+				Count:     s.Count,
+				TotalSize: s.TotalSize,
+				Truncated: s.Truncated,
+			}
+
+			for _, b := range s.Sizes {
+				rs.Sizes = append(rs.Sizes, &responseSizeBucket{
+					UpperBound: b.UpperBound,
+					Count:      b.Count,
+				})
+			}
+
+			resp = append(resp, rs)
+		}
+	}
+
+	w.Header().Set(httphdr.ContentType, "application/json")
+
+	err := json.NewEncoder(w).Encode(resp)
+	if err != nil {
+		h.logger.DebugContext(r.Context(), "writing response stats", slogutil.KeyError, err)
+	}
+}
+
+// rejectStats is the JSON representation of [proxy.RejectStats].
+type rejectStats struct {
+	// Instance is the name of the proxy instance, if the process runs several
+	// ones.
+	Instance string `json:"instance,omitempty"`
+
+	// Reason is the reason the queries have been rejected for.
+	Reason proxy.RejectReason `json:"reason"`
+
+	// Dropped is the number of the queries left without response.
+	Dropped uint64 `json:"dropped"`
+
+	// Refused is the number of the queries replied with an error response.
+	Refused uint64 `json:"refused"`
+}
+
+// rejectedHandler serves the statistics of the rejected queries in JSON.
+type rejectedHandler struct {
+	logger *slog.Logger
+	insts  []*instance
+}
+
+// type check
+var _ http.Handler = (*rejectedHandler)(nil)
+
+// ServeHTTP implements the [http.Handler] interface for *rejectedHandler.
+func (h *rejectedHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	resp := []*rejectStats{}
+	for _, inst := range h.insts {
+		stats := inst.currentProxy().RejectStats()
+		for _, reason := range slices.Sorted(maps.Keys(stats)) {
+			s := stats[reason]
+			resp = append(resp, &rejectStats{
+				Instance: inst.name,
+				Reason:   reason,
+				Dropped:  s.Dropped,
+				Refused:  s.Refused,
+			})
+		}
+	}
+
+	w.Header().Set(httphdr.ContentType, "application/json")
+
+	err := json.NewEncoder(w).Encode(resp)
+	if err != nil {
+		h.logger.DebugContext(r.Context(), "writing reject stats", slogutil.KeyError, err)
+	}
+}
+
+// memoryStats is the JSON representation of [proxy.MemoryStats].
+type memoryStats struct {
+	// Instance is the name of the proxy instance, if the process runs several
+	// ones.
+	Instance string `json:"instance,omitempty"`
+
+	// Usage is the latest measured memory usage of the process in bytes.
+	Usage uint64 `json:"usage"`
+
+	// Limit is the memory budget in bytes, if any.
+	Limit uint64 `json:"limit,omitempty"`
+
+	// Sheds is the number of times the budget has been exceeded.
+	Sheds uint64 `json:"sheds"`
+
+	// RejectedConns is the number of the DoH connections rejected over budget.
+	RejectedConns uint64 `json:"rejected_conns"`
+
+	// OverLimit is true if the proxy is shedding load at the moment.
+	OverLimit bool `json:"over_limit"`
+}
+
+// memoryHandler serves the memory usage and the statistics of the memory
+// budget in JSON.
+type memoryHandler struct {
+	logger *slog.Logger
+	insts  []*instance
+}
+
+// type check
+var _ http.Handler = (*memoryHandler)(nil)
+
+// ServeHTTP implements the [http.Handler] interface for *memoryHandler.
+func (h *memoryHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	resp := make([]*memoryStats, 0, len(h.insts))
+	for _, inst := range h.insts {
+		s := inst.currentProxy().MemoryStats()
+		resp = append(resp, &memoryStats{
+			Instance:      inst.name,
+			Usage:         s.Usage,
+			Limit:         s.Limit,
+			Sheds:         s.Sheds,
+			RejectedConns: s.RejectedConns,
+			OverLimit:     s.OverLimit,
+		})
+	}
+
+	w.Header().Set(httphdr.ContentType, "application/json")
+
+	err := json.NewEncoder(w).Encode(resp)
+	if err != nil {
+		h.logger.DebugContext(r.Context(), "writing memory stats", slogutil.KeyError, err)
+	}
+}
+
+// upstreamLatencyStats is the JSON representation of [proxy.LatencyStats].
+type upstreamLatencyStats struct {
+	// Buckets is the histogram of the latencies.
+	Buckets []*latencyBucket `json:"buckets"`
+
+	// Instance is the name of the proxy instance using the upstream, if the
+	// process runs several ones.
+	Instance string `json:"instance,omitempty"`
+
+	// Address is the address of the upstream.
+	Address string `json:"address"`
+
+	// Mean is the mean latency.
+	Mean string `json:"mean"`
+
+	// P50 is the median latency.
+	P50 string `json:"p50"`
+
+	// P95 is the 95th percentile of latency.
+	P95 string `json:"p95"`
+
+	// P99 is the 99th percentile of latency.
+	P99 string `json:"p99"`
+
+	// Count is the number of the exchanges.
+	Count uint64 `json:"count"`
+}
+
+// latencyBucket is the JSON representation of [proxy.LatencyBucket].
+type latencyBucket struct {
+	// UpperBound is the maximum latency of the exchanges in the bucket.
+	UpperBound string `json:"upper_bound"`
+
+	// Count is the number of the exchanges in the bucket.
+	Count uint64 `json:"count"`
+}
+
+// formatLatency returns the string representation of the latency bound d,
+// where zero and the maximum duration mean the unbounded one.
+func formatLatency(d time.Duration) (s string) {
+	if d == 0 || d == math.MaxInt64 {
+		return "+Inf"
+	}
+
+	return d.String()
+}
+
+// latenciesHandler serves the latency statistics of the upstreams in JSON.
+type latenciesHandler struct {
+	logger *slog.Logger
+	insts  []*instance
+}
+
+// type check
+var _ http.Handler = (*latenciesHandler)(nil)
+
+// ServeHTTP implements the [http.Handler] interface for *latenciesHandler.
+func (h *latenciesHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	resp := []*upstreamLatencyStats{}
+	for _, inst := range h.insts {
+		stats := inst.currentProxy().UpstreamLatencyStats()
+		for _, addr := range slices.Sorted(maps.Keys(stats)) {
+			s := stats[addr]
+			ls := &upstreamLatencyStats{
+				Buckets:  make([]*latencyBucket, 0, len(s.Buckets)),
+				Instance: inst.name,
+				Address:  addr,
+				Mean:     s.Mean.String(),
+				P50:      formatLatency(s.P50),
+				P95:      formatLatency(s.P95),
+				P99:      formatLatency(s.P99),
+				Count:    s.Count,
+			}
+
+			for _, b := range s.Buckets {
+				ls.Buckets = append(ls.Buckets, &latencyBucket{
+					UpperBound: formatLatency(b.UpperBound),
+					Count:      b.Count,
+				})
+			}
+
+			resp = append(resp, ls)
+		}
+	}
+
+	w.Header().Set(httphdr.ContentType, "application/json")
+
+	err := json.NewEncoder(w).Encode(resp)
+	if err != nil {
+		h.logger.DebugContext(r.Context(), "writing latency stats", slogutil.KeyError, err)
+	}
+}
+
+// Listener actions of [listenersHandler].
+const (
+	listenersActionStart = "start"
+	listenersActionStop  = "stop"
+)
+
+// listenersHandler stops and starts the listeners of a particular protocol.
+// The instance is chosen by the "instance" query parameter, which may be
+// omitted if the process runs a single proxy.
+type listenersHandler struct {
+	logger *slog.Logger
+	insts  []*instance
+}
+
+// type check
+var _ http.Handler = (*listenersHandler)(nil)
+
+// ServeHTTP implements the [http.Handler] interface for *listenersHandler.
+func (h *listenersHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	proto := proxy.Proto(r.PathValue("proto"))
+
+	inst := h.instance(r.URL.Query().Get("instance"))
+	if inst == nil {
+		http.NotFound(w, r)
+
+		return
+	}
+
+	var err error
+	switch action := r.PathValue("action"); action {
+	case listenersActionStart:
+		err = inst.currentProxy().StartListeners(ctx, proto)
+	case listenersActionStop:
+		err = inst.currentProxy().StopListeners(ctx, proto)
+	default:
+		http.NotFound(w, r)
+
+		return
+	}
+
+	if err != nil {
+		h.logger.WarnContext(ctx, "managing listeners", "proto", proto, slogutil.KeyError, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// instance returns the instance with the given name, or nil if there is no
+// such one.  An empty name refers to the only instance, if there is one.
+func (h *listenersHandler) instance(name string) (inst *instance) {
+	if name == "" && len(h.insts) == 1 {
+		return h.insts[0]
+	}
+
+	for _, inst = range h.insts {
+		if inst.name == name {
+			return inst
+		}
+	}
+
+	return nil
+}
@@ -2,6 +2,7 @@ package cmd
 
 import (
 	"fmt"
+	"net/netip"
 	"os"
 	"time"
 
@@ -33,6 +34,23 @@ type configuration struct {
 	// basic authentication information.
 	HTTPSUserinfo string `yaml:"https-userinfo"`
 
+	// HTTPSRequiredHeaders are the headers each DoH request must contain in
+	// the form of name[:value].  The same name may be specified multiple
+	// times to accept several values.
+	HTTPSRequiredHeaders []string `yaml:"https-require-headers"`
+
+	// HTTPSRejectedHeaders are the names of the headers, the DoH requests
+	// containing any of which are rejected.
+	HTTPSRejectedHeaders []string `yaml:"https-reject-headers"`
+
+	// HTTPSResponseHeaders are the headers to add to every response of the DoH
+	// server in the form of name:value.
+	HTTPSResponseHeaders []string `yaml:"https-response-headers"`
+
+	// HTTPSCORSOrigins are the origins of the browser-based DoH clients
+	// allowed to access the DoH server, "*" allows any origin.
+	HTTPSCORSOrigins []string `yaml:"https-cors-origins"`
+
 	// DNSCryptConfigPath is the path to the DNSCrypt configuration file.
 	DNSCryptConfigPath string `yaml:"dnscrypt-config"`
 
@@ -43,7 +61,86 @@ type configuration struct {
 	// If not specified the [proxy.UpstreamModeLoadBalance] is used.
 	UpstreamMode string `yaml:"upstream-mode"`
 
-	// ListenAddrs is the list of server's listen addresses.
+	// ConsensusUpstreams is the number of upstreams queried for each request
+	// in the consensus upstream mode.  If zero, all the upstreams are queried.
+	ConsensusUpstreams uint `yaml:"consensus-upstreams"`
+
+	// ConsensusQuorum is the number of the queried upstreams, which must agree
+	// on the response in the consensus upstream mode.  If zero, the majority is
+	// required.
+	ConsensusQuorum uint `yaml:"consensus-quorum"`
+
+	// RebindingProtection is the mode of the DNS rebinding protection, see
+	// [proxy.RebindingMode].  If empty, the protection is disabled.
+	RebindingProtection string `yaml:"rebinding-protection"`
+
+	// Compression is the mode of the name compression in the responses, see
+	// [proxy.CompressionMode].  If empty, the names are always compressed.
+	Compression string `yaml:"compression"`
+
+	// Padding is the mode of padding the responses sent over the encrypted
+	// protocols, see [proxy.PaddingMode].  If empty, the responses aren't
+	// padded.
+	Padding string `yaml:"padding"`
+
+	// AnswerOrder is the mode of ordering the A and AAAA records within the
+	// answers served from the cache, see [proxy.AnswerOrderMode].  If empty,
+	// the order is kept.
+	AnswerOrder string `yaml:"answer-order"`
+
+	// DGAAction is the action taken on the requests for the domain names likely
+	// generated by DGAs, see [dga.Action].  If empty, the detection is
+	// disabled.
+	DGAAction string `yaml:"dga-action"`
+
+	// AAAASuppression is the mode of the suppression of the AAAA answers, either
+	// "always" or "if_a_exists".  If empty, the AAAA answers aren't suppressed.
+	AAAASuppression string `yaml:"aaaa-suppression"`
+
+	// SelfTest is the mode of the startup self-test of the upstreams, either
+	// "warn" or "strict".  If empty, the self-test is disabled.
+	SelfTest string `yaml:"self-test"`
+
+	// SelfTestDomain is the domain name resolved by the self-test probes.  If
+	// empty, "example.com" is used.
+	SelfTestDomain string `yaml:"self-test-domain"`
+
+	// DHCPLeases is the path to the dnsmasq or ISC DHCP server lease file to
+	// resolve the hostnames of the clients from.  If empty, the leases aren't
+	// used.
+	DHCPLeases string `yaml:"dhcp-leases"`
+
+	// DHCPLeasesDomain is the domain name of the local network appended to
+	// the hostnames from DHCPLeases.
+	DHCPLeasesDomain string `yaml:"dhcp-leases-domain"`
+
+	// HTTP3ProbeCacheFile is the path to the file to keep the outcomes of
+	// racing HTTP/3 against HTTP/2 for the DoH upstreams in between restarts.
+	// If empty, the outcomes are only kept in memory.
+	HTTP3ProbeCacheFile string `yaml:"http3-probe-cache-file"`
+
+	// LogQNameMode defines how the queried domain names are written to the
+	// log, see [redact.QNameMode].  If empty, the names are logged in full.
+	LogQNameMode string `yaml:"log-qname-mode"`
+
+	// LogClientIPMode defines how the client addresses are written to the log,
+	// see [redact.ClientIPMode].  If empty, the addresses are logged in full.
+	LogClientIPMode string `yaml:"log-client-ip-mode"`
+
+	// UpstreamFaults are the faults injected into the upstream responses for
+	// testing, see [parseFaults].  If empty, no faults are injected.
+	UpstreamFaults string `yaml:"upstream-faults"`
+
+	// TorSOCKSAddr is the address of the SOCKS5 port of a Tor client to dial
+	// the upstreams with the .onion hostnames through.
+	TorSOCKSAddr string `yaml:"tor-socks"`
+
+	// ClientFaults are the faults injected into the client packets for testing,
+	// see [parseFaults].  If empty, no faults are injected.
+	ClientFaults string `yaml:"client-faults"`
+
+	// ListenAddrs is the list of server's listen addresses.  Each of them is
+	// either an IP address, a network interface name, or a hostname.
 	ListenAddrs []string `yaml:"listen-addrs"`
 
 	// DoHRoutes is the list of routes for DNS-over-HTTPS.  It must be a slice
@@ -66,12 +163,28 @@ type configuration struct {
 	// DNSCryptListenPorts are the ports server listens on for DNSCrypt.
 	DNSCryptListenPorts []uint16 `yaml:"dnscrypt-port"`
 
+	// ListenDSCP are the DSCP values to mark the packets sent to the clients
+	// with in the [proto:]value form.  The values without a protocol are used
+	// for all the listeners.
+	ListenDSCP []string `yaml:"listen-dscp"`
+
 	// Upstreams is the list of DNS upstream servers.
 	Upstreams []string `yaml:"upstream"`
 
 	// BootstrapDNS is the list of bootstrap DNS upstream servers.
 	BootstrapDNS []string `yaml:"bootstrap"`
 
+	// UpstreamBootstraps is the list of bootstrap DNS servers for particular
+	// upstream hostnames in the form of "[/host/]bootstrap".  "#" as the
+	// bootstrap means the system resolver.  Upstreams which hostnames aren't
+	// listed are resolved with BootstrapDNS.
+	UpstreamBootstraps []string `yaml:"upstream-bootstrap"`
+
+	// UpstreamEDNSBufSizes are the EDNS0 UDP payload sizes advertised to the
+	// plain DNS upstreams in the form of "[/host/]size".  The size without
+	// hosts applies to all the other plain upstreams.
+	UpstreamEDNSBufSizes []string `yaml:"upstream-edns-bufsize"`
+
 	// Fallbacks is the list of fallback DNS upstream servers.
 	Fallbacks []string `yaml:"fallback"`
 
@@ -96,6 +209,73 @@ type configuration struct {
 	// go-flags doesn't support text unmarshalers.
 	BogusNXDomain []string `yaml:"bogus-nxdomain"`
 
+	// RatelimitAllowlistDomains is the list of domain names, requests for which
+	// and for their subdomains aren't rate limited.
+	RatelimitAllowlistDomains []string `yaml:"ratelimit-allowlist-domains"`
+
+	// SafeSearch is the list of services to enforce the safe search for all
+	// clients not matched by any of Policies.
+	SafeSearch []string `yaml:"safe-search"`
+
+	// BlockedServices is the list of services to block for all clients not
+	// matched by any of Policies.
+	BlockedServices []string `yaml:"blocked-services"`
+
+	// AllowedDomains is the list of domain patterns resolved in the
+	// default-deny mode for all clients not matched by any of Policies.  If
+	// empty, the mode is disabled.
+	AllowedDomains []string `yaml:"allowed-domains"`
+
+	// QueryTypeActions is the list of actions on the requests by query type
+	// for all clients not matched by any of Policies in the form of
+	// type:action, e.g. "HTTPS:nodata".
+	QueryTypeActions []string `yaml:"qtype-actions"`
+
+	// QueryClassActions is the list of actions on the requests by query class
+	// for all clients not matched by any of Policies in the form of
+	// class:action, e.g. "CH:refuse".
+	QueryClassActions []string `yaml:"qclass-actions"`
+
+	// Policies are the safe search and service blocking policies for
+	// particular clients.  These can only be set in the configuration file.
+	Policies []*policyConfig `yaml:"policies"`
+
+	// Instances are the configurations of independent proxy instances to run
+	// within the process instead of a single one.  Each of them has the
+	// settings of the top-level configuration overridden by its own ones.
+	// These can only be set in the configuration file.
+	Instances []yaml.Node `yaml:"instances"`
+
+	// bootstraps, if not nil, are the bootstrap resolvers shared between the
+	// proxy instances.
+	bootstraps *bootstrapCache
+
+	// listenIPs are the IP addresses ListenAddrs have been resolved to the last
+	// time.
+	listenIPs []netip.Addr
+
+	// AAAASuppressionDomains are the domain names, which along with their
+	// subdomains AAAASuppression applies to.  If empty, it applies to all
+	// domain names.
+	AAAASuppressionDomains []string `yaml:"aaaa-suppression-domains"`
+
+	// AAAASuppressionClients are the subnets of clients AAAASuppression applies
+	// to.  If empty, it applies to all clients.
+	AAAASuppressionClients []string `yaml:"aaaa-suppression-clients"`
+
+	// RebindingAllowedDomains is the list of domain names, which along with
+	// their subdomains are allowed to resolve to internal addresses.
+	RebindingAllowedDomains []string `yaml:"rebinding-allowed-domains"`
+
+	// DGAQuarantineUpstreams is the list of upstreams resolving the domain
+	// names likely generated by DGAs when DGAAction is "quarantine".
+	DGAQuarantineUpstreams []string `yaml:"dga-quarantine-upstreams"`
+
+	// MalformedQueryActions is the list of actions on the malformed queries in
+	// the form of [proto:]action, see [proxy.MalformedAction].  The action
+	// without the protocol applies to all the protocols.
+	MalformedQueryActions []string `yaml:"malformed-query-actions"`
+
 	// HostsFiles is the list of paths to the hosts files to resolve from.
 	HostsFiles []string `yaml:"hosts-files"`
 
@@ -103,6 +283,50 @@ type configuration struct {
 	// human-readable form.  Default is 10s.
 	Timeout timeutil.Duration `yaml:"timeout"`
 
+	// TLSSessionTicketLifetime is the maximum age of the TLS session tickets
+	// accepted by the DNS-over-TLS listeners.  If zero, the default of
+	// crypto/tls is used.
+	TLSSessionTicketLifetime timeutil.Duration `yaml:"tls-session-ticket-lifetime"`
+
+	// ConnIdleTimeout is the time a DNS-over-TLS or DNS-over-QUIC client
+	// connection may stay without queries.  If zero, the defaults are used.
+	ConnIdleTimeout timeutil.Duration `yaml:"conn-idle-timeout"`
+
+	// UDPPacingMaxDelay is the maximum time a paced UDP response is held for.
+	// If zero, the default is used.
+	UDPPacingMaxDelay timeutil.Duration `yaml:"udp-pacing-max-delay"`
+
+	// UDPRetransmitInterval is the time to wait for the response from a plain
+	// UDP upstream before sending the query again.
+	UDPRetransmitInterval timeutil.Duration `yaml:"udp-retransmit-interval"`
+
+	// UpstreamQueueTimeout is the maximum time a query waits for the upstream
+	// query limits.  Default is 1s.
+	UpstreamQueueTimeout timeutil.Duration `yaml:"upstream-queue-timeout"`
+
+	// QUICKeepAlive is the period of QUIC keep-alive PINGs sent on idle
+	// DNS-over-QUIC and DNS-over-HTTP/3 upstream connections.  If zero, the
+	// default value of [upstream.QUICKeepAlivePeriod] is used.
+	QUICKeepAlive timeutil.Duration `yaml:"quic-keepalive"`
+
+	// QUICDisableOffload disables the UDP segmentation offload, ECN, and
+	// batched reads for the QUIC connections of the upstreams on Linux.
+	QUICDisableOffload bool `yaml:"quic-disable-offload"`
+
+	// QUICFlowLabel makes the IPv6 packets of the QUIC connections of the
+	// upstreams carry stable flow labels on Linux.
+	QUICFlowLabel bool `yaml:"quic-flow-label"`
+
+	// HTTP3ProbeCacheTTL is the duration for which the outcome of racing
+	// HTTP/3 against HTTP/2 for a DoH upstream is reused.  If zero, the
+	// upstreams are probed each time their connections are re-created.
+	HTTP3ProbeCacheTTL timeutil.Duration `yaml:"http3-probe-cache-ttl"`
+
+	// HTTPDowngradePeriod is the time a DoH upstream downgraded because of
+	// HTTPErrorBudget keeps using the lower HTTP version.  If zero, the
+	// default value of [upstream.DefaultHTTPDowngradePeriod] is used.
+	HTTPDowngradePeriod timeutil.Duration `yaml:"http-downgrade-period"`
+
 	// CacheMinTTL is the minimum TTL value for caching DNS entries, in seconds.
 	// It overrides the TTL value from the upstream server, if the one is less.
 	CacheMinTTL uint32 `yaml:"cache-min-ttl"`
@@ -112,6 +336,11 @@ type configuration struct {
 	// greater.
 	CacheMaxTTL uint32 `yaml:"cache-max-ttl"`
 
+	// CacheDomainTTLs are the TTL ranges of the responses for the domains and
+	// their subdomains in the form of "[/domain/]min:max", which override
+	// CacheMinTTL and CacheMaxTTL.
+	CacheDomainTTLs []string `yaml:"cache-domain-ttl"`
+
 	// OptimisticAnswerTTL is the default TTL for expired cached responses
 	// in seconds.
 	OptimisticAnswerTTL timeutil.Duration `yaml:"optimistic-answer-ttl"`
@@ -123,6 +352,18 @@ type configuration struct {
 	// CacheSizeBytes is the cache size in bytes.  Default is 64k.
 	CacheSizeBytes int `yaml:"cache-size"`
 
+	// Profile is the resource profile, either "default" or "small".  Empty
+	// string means "default".
+	Profile string `yaml:"profile"`
+
+	// MemoryLimit is the memory budget of the process in bytes.  Zero means no
+	// limit.
+	MemoryLimit uint `yaml:"memory-limit"`
+
+	// HTTPSMaxRequestSize is the maximum size of the DNS message in a DoH
+	// request, in bytes.  If zero, the maximum size of a DNS message is used.
+	HTTPSMaxRequestSize uint `yaml:"https-max-request-size"`
+
 	// Ratelimit is the maximum number of requests per second.
 	Ratelimit uint `yaml:"ratelimit"`
 
@@ -141,6 +382,64 @@ type configuration struct {
 	// MaxGoRoutines is the maximum number of goroutines.
 	MaxGoRoutines uint `yaml:"max-go-routines"`
 
+	// MaxConns is the maximum number of concurrent client connections per
+	// DNS-over-TLS and DNS-over-QUIC listener.  Zero means no limit.
+	MaxConns uint `yaml:"max-conns"`
+
+	// MaxConnsPerClient is the maximum number of concurrent connections from a
+	// single IP address per DNS-over-TLS and DNS-over-QUIC listener.  Zero
+	// means no limit.
+	MaxConnsPerClient uint `yaml:"max-conns-per-client"`
+
+	// MaxQueriesPerConn is the maximum number of queries handled within a
+	// single DNS-over-TLS or DNS-over-QUIC connection.  Zero means no limit.
+	MaxQueriesPerConn uint `yaml:"max-queries-per-conn"`
+
+	// UDPPacingRate is the maximum number of responses per second sent over
+	// UDP to a single client subnet.  Zero disables the pacing.
+	UDPPacingRate uint `yaml:"udp-pacing-rate"`
+
+	// UDPPacingBurst is the number of responses sent over UDP to a single
+	// client subnet at once before the pacing starts.
+	UDPPacingBurst uint `yaml:"udp-pacing-burst"`
+
+	// MaxUpstreamQueries is the maximum number of simultaneous queries to all
+	// upstreams.  Zero means no limit.
+	MaxUpstreamQueries uint `yaml:"max-upstream-queries"`
+
+	// UDPRetransmitAttempts is the maximum number of times a query is sent to
+	// a plain UDP upstream.  Values less than 2 disable the retransmission.
+	UDPRetransmitAttempts uint `yaml:"udp-retransmit-attempts"`
+
+	// MaxQueriesPerUpstream is the maximum number of simultaneous queries to a
+	// single upstream.  Zero means no limit.
+	MaxQueriesPerUpstream uint `yaml:"max-queries-per-upstream"`
+
+	// LogSampleRate is N in logging the contents of only 1 in N DNS messages
+	// in verbose mode.  Zero and one mean logging every message.
+	LogSampleRate uint `yaml:"log-sample-rate"`
+
+	// LogErrorSummaryInterval is the interval of the summary log lines of the
+	// repeated identical upstream errors.  Zero means logging every error.
+	LogErrorSummaryInterval timeutil.Duration `yaml:"log-error-summary-interval"`
+
+	// LogQuietSuccess disables logging the successful exchanges with the
+	// upstreams in verbose mode.
+	LogQuietSuccess bool `yaml:"log-quiet-success"`
+
+	// LogRejected makes the proxy log each query it refuses or drops along
+	// with the reason.
+	LogRejected bool `yaml:"log-rejected"`
+
+	// DGAThreshold is the score, at and above which a domain name is
+	// considered generated by a DGA.  If zero, [dga.DefaultThreshold] is used.
+	DGAThreshold float32 `yaml:"dga-threshold"`
+
+	// HTTPErrorBudget is the maximum share of failed exchanges with a DoH
+	// upstream using a single HTTP version before it's downgraded.  If zero,
+	// the upstreams are never downgraded.
+	HTTPErrorBudget float32 `yaml:"http-error-budget"`
+
 	// TLSMinVersion is the minimum allowed version of TLS.
 	//
 	// TODO(d.kolyshev): Use more suitable type.
@@ -176,6 +475,46 @@ type configuration struct {
 	// Insecure disables upstream servers TLS certificate verification.
 	Insecure bool `yaml:"insecure"`
 
+	// UDPRetransmitSwitchServer makes the retransmitted queries to plain UDP
+	// upstreams go through new sockets and to the next addresses of those, if
+	// several are specified.
+	UDPRetransmitSwitchServer bool `yaml:"udp-retransmit-switch-server"`
+
+	// UDPRandomizeCase makes the question names sent to plain UDP upstreams
+	// use the randomized case of letters, which the responses must repeat.
+	UDPRandomizeCase bool `yaml:"udp-randomize-case"`
+
+	// UpstreamDSCP is the DSCP value to mark the packets sent to the upstreams
+	// with.  Zero keeps the default marking.
+	UpstreamDSCP uint `yaml:"upstream-dscp"`
+
+	// UpstreamQuestionMismatch is the way the upstream responses with the
+	// question section not matching the query are handled, see
+	// [upstream.QuestionMismatchMode].  If empty, those are rejected.
+	UpstreamQuestionMismatch string `yaml:"upstream-question-mismatch"`
+
+	// UpstreamWarmStandby makes the DNS-over-TLS and DNS-over-QUIC upstreams
+	// keep an additional established connection to fail over to.
+	UpstreamWarmStandby bool `yaml:"upstream-warm-standby"`
+
+	// UpstreamLazyInit makes the upstreams, fallbacks, and quarantine
+	// upstreams constructed on their first use.
+	UpstreamLazyInit bool `yaml:"upstream-lazy-init"`
+
+	// BlockCanaryDomains makes the server respond with NXDOMAIN to the requests
+	// for the canary domains, which browsers and operating systems check
+	// before switching to their own encrypted resolvers.
+	BlockCanaryDomains bool `yaml:"block-canary-domains"`
+
+	// SVCBName is the domain name of the proxy to publish the SVCB and HTTPS
+	// records advertising its encrypted endpoints for.  If empty, the records
+	// aren't published.
+	SVCBName string `yaml:"svcb-name"`
+
+	// SVCBHints are the IP addresses of the proxy advertised within the SVCB
+	// and HTTPS records.
+	SVCBHints []string `yaml:"svcb-hints"`
+
 	// IPv6Disabled makes the server to respond with NODATA to all AAAA queries.
 	IPv6Disabled bool `yaml:"ipv6-disabled"`
 
@@ -188,12 +527,33 @@ type configuration struct {
 	// already expired.
 	CacheOptimistic bool `yaml:"cache-optimistic"`
 
+	// CacheFixedTTL, if set to true, makes the server serve the cached
+	// responses with the TTLs received from the upstream.
+	CacheFixedTTL bool `yaml:"cache-fixed-ttl"`
+
+	// CacheAggressiveNSEC, if set to true, makes the server answer the
+	// queries for provably non-existent names from the cached NSEC and NSEC3
+	// records.  It requires both Cache and DNSSEC.
+	CacheAggressiveNSEC bool `yaml:"cache-aggressive-nsec"`
+
 	// Cache controls whether DNS responses are cached or not.
 	Cache bool `yaml:"cache"`
 
+	// MinimizeAnswers makes the server remove the authority and additional
+	// sections from the responses.
+	MinimizeAnswers bool `yaml:"minimize-answers"`
+
 	// RefuseAny makes the server to refuse requests of type ANY.
 	RefuseAny bool `yaml:"refuse-any"`
 
+	// TLSFingerprinting makes the server compute the fingerprints of the TLS
+	// clients.  It's also enabled if any policy matches the fingerprints.
+	TLSFingerprinting bool `yaml:"tls-fingerprinting"`
+
+	// TLSSessionTicketsDisabled makes the DNS-over-TLS listeners neither issue
+	// nor accept the TLS session tickets.
+	TLSSessionTicketsDisabled bool `yaml:"tls-session-tickets-disabled"`
+
 	// DNSSECEnabled defines whether the proxy should set the DO bits in the
 	// upstream requests.
 	DNSSECEnabled bool `yaml:"dnssec"`
@@ -203,7 +563,9 @@ type configuration struct {
 
 	// PendingRequestsEnabled controls whether the server should track duplicate
 	// queries and only send the first of them to the upstream server.  It is
-	// used to mitigate the cache poisoning attacks.
+	// used to mitigate the cache poisoning attacks.  If disabled, the
+	// DNS-over-HTTPS and DNS-over-QUIC upstreams reuse the packed forms of the
+	// identical queries for a second instead.
 	PendingRequestsEnabled bool `yaml:"pending-requests-enabled"`
 
 	// DNS64 defines whether DNS64 functionality is enabled or not.
@@ -218,19 +580,7 @@ type configuration struct {
 // parseConfig returns options parsed from the command args or config file.  If
 // no options have been parsed, it returns a suitable exit code and an error.
 func parseConfig() (conf *configuration, exitCode int, err error) {
-	conf = &configuration{
-		HTTPSServerName:        "dnsproxy",
-		UpstreamMode:           string(proxy.UpstreamModeLoadBalance),
-		CacheSizeBytes:         64 * 1024,
-		Timeout:                timeutil.Duration(10 * time.Second),
-		OptimisticAnswerTTL:    timeutil.Duration(proxy.DefaultOptimisticAnswerTTL),
-		OptimisticMaxAge:       timeutil.Duration(proxy.DefaultOptimisticMaxAge),
-		RatelimitSubnetLenIPv4: 24,
-		RatelimitSubnetLenIPv6: 56,
-		DNSSECEnabled:          true,
-		HostsFileEnabled:       true,
-		PendingRequestsEnabled: true,
-	}
+	conf = newConfiguration()
 
 	err = parseCmdLineOptions(conf)
 	exitCode, needExit := processCmdLineOptions(conf, err)
@@ -265,6 +615,22 @@ func parseConfig() (conf *configuration, exitCode int, err error) {
 	return conf, exitCode, nil
 }
 
+// newConfiguration returns the configuration with the default values.
+func newConfiguration() (conf *configuration) {
+	return &configuration{
+		HTTPSServerName:        "dnsproxy",
+		UpstreamMode:           string(proxy.UpstreamModeLoadBalance),
+		Timeout:                timeutil.Duration(10 * time.Second),
+		OptimisticAnswerTTL:    timeutil.Duration(proxy.DefaultOptimisticAnswerTTL),
+		OptimisticMaxAge:       timeutil.Duration(proxy.DefaultOptimisticMaxAge),
+		RatelimitSubnetLenIPv4: 24,
+		RatelimitSubnetLenIPv6: 56,
+		DNSSECEnabled:          true,
+		HostsFileEnabled:       true,
+		PendingRequestsEnabled: true,
+	}
+}
+
 // parseConfigFile fills options with the settings from file read by the given
 // path.
 func parseConfigFile(conf *configuration, confPath string) (err error) {
@@ -281,3 +647,57 @@ func parseConfigFile(conf *configuration, confPath string) (err error) {
 
 	return nil
 }
+
+// policyConfig is the configuration of the safe search and service blocking
+// policy for particular clients.
+type policyConfig struct {
+	// Clients is the list of client addresses and subnets the policy applies
+	// to.  If empty, the policy applies to all clients.
+	Clients []string `yaml:"clients"`
+
+	// TLSFingerprints is the list of JA3 or JA4 fingerprints of the TLS
+	// clients the policy applies to.  If empty, the policy applies to all
+	// clients.
+	TLSFingerprints []string `yaml:"tls-fingerprints"`
+
+	// SafeSearch is the list of services to enforce the safe search for.
+	SafeSearch []string `yaml:"safe-search"`
+
+	// BlockedServices is the list of services to block.
+	BlockedServices []string `yaml:"blocked-services"`
+
+	// AllowedDomains is the list of domain patterns resolved in the
+	// default-deny mode.  If empty, the mode is disabled.
+	AllowedDomains []string `yaml:"allowed-domains"`
+
+	// QueryTypes maps the query types, e.g. "HTTPS", to the actions on the
+	// requests of these types, see [middleware.QueryAction].
+	QueryTypes map[string]string `yaml:"query-types"`
+
+	// QueryClasses maps the query classes, e.g. "CH", to the actions on the
+	// requests of these classes, see [middleware.QueryAction].
+	QueryClasses map[string]string `yaml:"query-classes"`
+
+	// Schedule, if set, is the schedule of the time windows, during which the
+	// policy is active.
+	Schedule *scheduleConfig `yaml:"schedule"`
+}
+
+// scheduleConfig is the configuration of the weekly schedule of a policy.
+type scheduleConfig struct {
+	// TimeZone is the name of the time zone of the schedule, e.g.
+	// "Europe/Berlin".  If empty, the local time zone is used.
+	TimeZone string `yaml:"time-zone"`
+
+	// Start is the beginning of the time window in the "15:04" format.
+	Start string `yaml:"start"`
+
+	// End is the end of the time window in the "15:04" format.  "24:00" means
+	// the end of the day.  If End isn't after Start, the window ends on the
+	// next day.
+	End string `yaml:"end"`
+
+	// Days are the days of week the time window starts on, e.g. "mon".  If
+	// empty, the window starts on every day.
+	Days []string `yaml:"days"`
+}
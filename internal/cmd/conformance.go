@@ -0,0 +1,266 @@
+package cmd
+
+import (
+	"context"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/AdguardTeam/golibs/osutil"
+	"github.com/miekg/dns"
+)
+
+// conformanceCommand is the name of the command checking a DNS server against
+// the protocol specifications.
+const conformanceCommand = "conformance"
+
+// defaultConformanceTimeout is the default timeout of a single conformance
+// check.
+const defaultConformanceTimeout = 5 * time.Second
+
+// Conformance check results.
+const (
+	conformancePass = "PASS"
+	conformanceFail = "FAIL"
+	conformanceWarn = "WARN"
+	conformanceSkip = "SKIP"
+)
+
+// conformanceCheck is a single check of the conformance command.
+type conformanceCheck struct {
+	// run performs the check against t and returns an error if the server
+	// doesn't conform.  detail is an optional human-readable note about a
+	// successful check.
+	run func(ctx context.Context, t *conformanceTarget) (detail string, err error)
+
+	// name is the human-readable name of the check.
+	name string
+
+	// ref is the reference to the specification the check is based on.
+	ref string
+
+	// schemes are the URL schemes of the servers the check applies to.  If
+	// empty, the check applies to servers of any scheme.
+	schemes []string
+
+	// optional means that the server may not support the checked behavior, so
+	// that the failure of the check is reported as a warning and doesn't affect
+	// the exit code.
+	optional bool
+}
+
+// conformanceTarget is the DNS server checked by the conformance command.
+type conformanceTarget struct {
+	// ups is the upstream used by the checks which don't depend on the wire
+	// details of the protocol.
+	ups upstream.Upstream
+
+	// url is the address of the server.
+	url *url.URL
+
+	// tlsConf is the base TLS configuration of the raw connections to the
+	// server.  It must be cloned before use.
+	tlsConf *tls.Config
+
+	// domain is the FQDN resolved by the checks.
+	domain string
+
+	// hostPort is the address of the server with the port set.
+	hostPort string
+}
+
+// defaultPorts are the default ports of the supported URL schemes.
+var defaultPorts = map[string]string{
+	"udp":   "53",
+	"tcp":   "53",
+	"tls":   "853",
+	"quic":  "853",
+	"https": "443",
+	"h3":    "443",
+}
+
+// runConformance runs the conformance command with the command-line arguments
+// args, which don't include the command name, and writes the report to out.
+func runConformance(ctx context.Context, args []string, out io.Writer) (exitCode osutil.ExitCode) {
+	flags := flag.NewFlagSet(conformanceCommand, flag.ContinueOnError)
+	domain := flags.String(
+		"domain",
+		defaultSelfTestDomain,
+		"Signed domain name resolved by the checks.",
+	)
+	timeout := flags.Duration(
+		"timeout",
+		defaultConformanceTimeout,
+		"Timeout of each check.",
+	)
+	insecure := flags.Bool(
+		"insecure",
+		false,
+		"If specified, the certificate of the server isn't verified.",
+	)
+	flags.Usage = func() {
+		_, _ = fmt.Fprintf(
+			flags.Output(),
+			"Usage:\n\n  dnsproxy %s [options] <upstream>\n\nOptions:\n",
+			conformanceCommand,
+		)
+		flags.PrintDefaults()
+	}
+
+	err := flags.Parse(args)
+	if errors.Is(err, flag.ErrHelp) {
+		return osutil.ExitCodeSuccess
+	} else if err != nil {
+		return osutil.ExitCodeArgumentError
+	}
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+
+		return osutil.ExitCodeArgumentError
+	}
+
+	t, err := newConformanceTarget(flags.Arg(0), *domain, *timeout, *insecure)
+	if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, fmt.Errorf("%s: %w", conformanceCommand, err))
+
+		return osutil.ExitCodeArgumentError
+	}
+	defer func() { _ = t.ups.Close() }()
+
+	if !t.check(ctx, out, conformanceChecks, *timeout) {
+		return osutil.ExitCodeFailure
+	}
+
+	return osutil.ExitCodeSuccess
+}
+
+// newConformanceTarget returns a new properly initialized conformance target
+// for the upstream address addr.  Addresses without scheme are considered
+// plain DNS ones.
+func newConformanceTarget(
+	addr string,
+	domain string,
+	timeout time.Duration,
+	insecure bool,
+) (t *conformanceTarget, err error) {
+	if !strings.Contains(addr, "://") {
+		addr = "udp://" + addr
+	}
+
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, fmt.Errorf("parsing upstream address: %w", err)
+	}
+
+	ups, err := upstream.AddressToUpstream(addr, &upstream.Options{
+		Logger:             slogutil.NewDiscardLogger(),
+		Timeout:            timeout,
+		InsecureSkipVerify: insecure,
+		// Let the checks see the questions of the responses as is.
+		QuestionMismatch: upstream.QuestionMismatchLog,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("creating upstream: %w", err)
+	}
+
+	hostPort := u.Host
+	if port, ok := defaultPorts[u.Scheme]; ok && u.Port() == "" {
+		hostPort = net.JoinHostPort(u.Hostname(), port)
+	}
+
+	return &conformanceTarget{
+		ups: ups,
+		url: u,
+		// #nosec G402 -- Certificate verification is disabled only on
+		// explicit user request.
+		tlsConf: &tls.Config{
+			ServerName:         u.Hostname(),
+			InsecureSkipVerify: insecure,
+			MinVersion:         tls.VersionTLS12,
+		},
+		domain:   dns.Fqdn(domain),
+		hostPort: hostPort,
+	}, nil
+}
+
+// check runs checks against t and writes the report to out.  ok is false if
+// any of the non-optional checks has failed.
+func (t *conformanceTarget) check(
+	ctx context.Context,
+	out io.Writer,
+	checks []*conformanceCheck,
+	timeout time.Duration,
+) (ok bool) {
+	_, _ = fmt.Fprintf(out, "Conformance of %s:\n\n", t.ups.Address())
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+
+	ok = true
+	passed, total := 0, 0
+	for _, c := range checks {
+		res, detail := t.runCheck(ctx, c, timeout)
+		switch res {
+		case conformanceSkip:
+			continue
+		case conformancePass:
+			passed++
+		case conformanceFail:
+			ok = false
+		}
+
+		total++
+		_, _ = fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", res, c.name, c.ref, detail)
+	}
+
+	_ = w.Flush()
+
+	_, _ = fmt.Fprintf(out, "\nScore: %d/%d\n", passed, total)
+
+	return ok
+}
+
+// runCheck runs c against t and returns its result with a human-readable
+// detail.
+func (t *conformanceTarget) runCheck(
+	ctx context.Context,
+	c *conformanceCheck,
+	timeout time.Duration,
+) (res, detail string) {
+	if len(c.schemes) > 0 && !slices.Contains(c.schemes, t.url.Scheme) {
+		return conformanceSkip, ""
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	detail, err := c.run(ctx, t)
+	switch {
+	case err == nil:
+		return conformancePass, detail
+	case c.optional:
+		return conformanceWarn, err.Error()
+	default:
+		return conformanceFail, err.Error()
+	}
+}
+
+// newTLSConf returns a copy of the base TLS configuration of t with the ALPN
+// set to protos.
+func (t *conformanceTarget) newTLSConf(protos ...string) (conf *tls.Config) {
+	conf = t.tlsConf.Clone()
+	conf.NextProtos = protos
+
+	return conf
+}
@@ -0,0 +1,320 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/AdguardTeam/golibs/timeutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestCheck returns a conformance check named name returning detail and
+// err for the servers of schemes.
+func newTestCheck(
+	name string,
+	detail string,
+	err error,
+	optional bool,
+	schemes ...string,
+) (c *conformanceCheck) {
+	return &conformanceCheck{
+		run: func(_ context.Context, _ *conformanceTarget) (string, error) {
+			return detail, err
+		},
+		name:     name,
+		ref:      "RFC " + name,
+		schemes:  schemes,
+		optional: optional,
+	}
+}
+
+// newTestConformanceTarget returns a conformance target for addr, which is
+// never dialed unless the checks do so.
+func newTestConformanceTarget(t *testing.T, addr string) (target *conformanceTarget) {
+	t.Helper()
+
+	target, err := newConformanceTarget(addr, "example.org", testTimeout, true)
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, target.ups.Close)
+
+	return target
+}
+
+func TestConformanceTarget_runCheck(t *testing.T) {
+	t.Parallel()
+
+	const testErr errors.Error = "test error"
+
+	target := newTestConformanceTarget(t, "127.0.0.1:53")
+
+	testCases := []struct {
+		check      *conformanceCheck
+		name       string
+		wantRes    string
+		wantDetail string
+	}{{
+		check:      newTestCheck("pass", "note", nil, false),
+		name:       "pass",
+		wantRes:    conformancePass,
+		wantDetail: "note",
+	}, {
+		check:      newTestCheck("fail", "", testErr, false),
+		name:       "fail",
+		wantRes:    conformanceFail,
+		wantDetail: string(testErr),
+	}, {
+		check:      newTestCheck("warn", "", testErr, true),
+		name:       "optional_fail",
+		wantRes:    conformanceWarn,
+		wantDetail: string(testErr),
+	}, {
+		check:      newTestCheck("pass", "", nil, true),
+		name:       "optional_pass",
+		wantRes:    conformancePass,
+		wantDetail: "",
+	}, {
+		check:      newTestCheck("skip", "", testErr, false, "tls", "https"),
+		name:       "other_scheme",
+		wantRes:    conformanceSkip,
+		wantDetail: "",
+	}, {
+		check:      newTestCheck("udp", "", nil, false, "udp"),
+		name:       "same_scheme",
+		wantRes:    conformancePass,
+		wantDetail: "",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			ctx := testutil.ContextWithTimeout(t, testTimeout)
+			res, detail := target.runCheck(ctx, tc.check, testTimeout)
+			assert.Equal(t, tc.wantRes, res)
+			assert.Equal(t, tc.wantDetail, detail)
+		})
+	}
+}
+
+func TestConformanceTarget_check(t *testing.T) {
+	t.Parallel()
+
+	const testErr errors.Error = "test error"
+
+	target := newTestConformanceTarget(t, "127.0.0.1:53")
+
+	testCases := []struct {
+		name   string
+		want   string
+		checks []*conformanceCheck
+		wantOK bool
+	}{{
+		name:   "empty",
+		want:   "Conformance of 127.0.0.1:53:\n\n\nScore: 0/0\n",
+		checks: nil,
+		wantOK: true,
+	}, {
+		name: "pass_and_warn",
+		want: "Conformance of 127.0.0.1:53:\n\n" +
+			"PASS  a       RFC a       note\n" +
+			"WARN  dnssec  RFC dnssec  test error\n" +
+			"\nScore: 1/2\n",
+		checks: []*conformanceCheck{
+			newTestCheck("a", "note", nil, false),
+			newTestCheck("dnssec", "", testErr, true),
+			newTestCheck("doh_get", "", testErr, false, "https"),
+		},
+		wantOK: true,
+	}, {
+		name: "fail",
+		want: "Conformance of 127.0.0.1:53:\n\n" +
+			"PASS  a     RFC a     \n" +
+			"FAIL  edns  RFC edns  test error\n" +
+			"\nScore: 1/2\n",
+		checks: []*conformanceCheck{
+			newTestCheck("a", "", nil, false),
+			newTestCheck("edns", "", testErr, false),
+		},
+		wantOK: false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			out := &bytes.Buffer{}
+			ctx := testutil.ContextWithTimeout(t, testTimeout)
+
+			ok := target.check(ctx, out, tc.checks, testTimeout)
+			assert.Equal(t, tc.wantOK, ok)
+			assert.Equal(t, tc.want, out.String())
+		})
+	}
+}
+
+// newTestCertFiles writes a self-signed certificate and its private key into
+// the temporary directory and returns the paths to them.
+func newTestCertFiles(t *testing.T) (certPath, keyPath string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	notBefore := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{Organization: []string{"AdGuard Tests"}},
+		NotBefore:    notBefore,
+		NotAfter:     notBefore.Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	certPath, keyPath = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	err = os.WriteFile(certPath, certPEM, 0o600)
+	require.NoError(t, err)
+
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	err = os.WriteFile(keyPath, keyPEM, 0o600)
+	require.NoError(t, err)
+
+	return certPath, keyPath
+}
+
+// newTestPlainPort returns a port of localhost which is free for both UDP and
+// TCP at the moment.
+func newTestPlainPort(t *testing.T) (port uint16) {
+	t.Helper()
+
+	for {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+
+		addr := testutil.RequireTypeAssert[*net.TCPAddr](t, l.Addr())
+		pc, udpErr := net.ListenPacket("udp", addr.String())
+
+		require.NoError(t, l.Close())
+		if udpErr == nil {
+			require.NoError(t, pc.Close())
+
+			return uint16(addr.Port)
+		}
+	}
+}
+
+// newTestConformanceProxy starts a proxy serving plain DNS, DNS-over-TLS,
+// DNS-over-HTTPS, and DNS-over-QUIC on localhost and resolving through the
+// upstream with the given address.
+func newTestConformanceProxy(t *testing.T, upsAddr string) (p *proxy.Proxy) {
+	t.Helper()
+
+	certPath, keyPath := newTestCertFiles(t)
+
+	conf := newConfiguration()
+	conf.ListenAddrs = []string{"127.0.0.1"}
+	// Use the same port for UDP and TCP, since the TCP fallback check expects
+	// it.
+	conf.ListenPorts = []uint16{newTestPlainPort(t)}
+	conf.TLSListenPorts = []uint16{0}
+	conf.HTTPSListenPorts = []uint16{0}
+	conf.QUICListenPorts = []uint16{0}
+	conf.TLSCertPath = certPath
+	conf.TLSKeyPath = keyPath
+	conf.Upstreams = []string{upsAddr}
+	conf.Timeout = timeutil.Duration(testTimeout)
+
+	ctx := testutil.ContextWithTimeout(t, testTimeout)
+	p, err := newProxy(ctx, testLogger, conf)
+	require.NoError(t, err)
+
+	err = p.Start(ctx)
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, func() (err error) {
+		return p.Shutdown(testutil.ContextWithTimeout(t, testTimeout))
+	})
+
+	return p
+}
+
+func TestConformanceChecks_protocols(t *testing.T) {
+	t.Parallel()
+
+	upsAddr := newTestUpstreamServer(t, netip.MustParseAddr("192.0.2.1"))
+	p := newTestConformanceProxy(t, upsAddr)
+
+	checks := map[string]*conformanceCheck{}
+	for _, c := range conformanceChecks {
+		checks[c.name] = c
+	}
+
+	testCases := []struct {
+		name   string
+		addr   string
+		checks []string
+	}{{
+		name:   "udp",
+		addr:   "udp://" + p.Addr(proxy.ProtoUDP).String(),
+		checks: []string{"a", "tcp_fallback"},
+	}, {
+		name:   "tcp",
+		addr:   "tcp://" + p.Addr(proxy.ProtoTCP).String(),
+		checks: []string{"a", "tcp_fallback"},
+	}, {
+		name:   "tls",
+		addr:   "tls://" + p.Addr(proxy.ProtoTLS).String(),
+		checks: []string{"a", "dot_pipelining", "dot_resumption"},
+	}, {
+		name:   "https",
+		addr:   fmt.Sprintf("https://%s/dns-query", p.Addr(proxy.ProtoHTTPS)),
+		checks: []string{"a", "doh_get", "doh_post"},
+	}, {
+		name:   "quic",
+		addr:   "quic://" + p.Addr(proxy.ProtoQUIC).String(),
+		checks: []string{"a", "doq_exchange"},
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			target := newTestConformanceTarget(t, tc.addr)
+
+			for _, name := range tc.checks {
+				c := checks[name]
+				require.NotNil(t, c, name)
+
+				ctx := testutil.ContextWithTimeout(t, testTimeout)
+				res, detail := target.runCheck(ctx, c, testTimeout)
+				assert.Equalf(t, conformancePass, res, "%s: %s", name, detail)
+			}
+		})
+	}
+}
@@ -0,0 +1,642 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/httphdr"
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+// mimeDNSMessage is the media type of the DNS messages sent over HTTPS.
+const mimeDNSMessage = "application/dns-message"
+
+// paddingBlockSize is the block size the queries are padded to, as recommended
+// by RFC 8467.
+const paddingBlockSize = 128
+
+// unknownEDNSOptionCode is the code of the EDNS option sent to check that the
+// unknown options are ignored.  It's from the range reserved for local and
+// experimental use.
+const unknownEDNSOptionCode = 65001
+
+// conformanceChecks are the checks run by the conformance command in the order
+// of the report.
+var conformanceChecks = []*conformanceCheck{{
+	run: probeCheck(&selfTestProbe{
+		check: checkAnswerOf[*dns.A],
+		name:  "a",
+		qtype: dns.TypeA,
+	}),
+	name:     "a",
+	ref:      "RFC 1035",
+	schemes:  nil,
+	optional: false,
+}, {
+	run: probeCheck(&selfTestProbe{
+		check: checkAnswerOf[*dns.AAAA],
+		name:  "aaaa",
+		qtype: dns.TypeAAAA,
+	}),
+	name:     "aaaa",
+	ref:      "RFC 3596",
+	schemes:  nil,
+	optional: false,
+}, {
+	run:      checkQuestionCase,
+	name:     "question_case",
+	ref:      "RFC 1035 §7.3",
+	schemes:  nil,
+	optional: true,
+}, {
+	run: probeCheck(&selfTestProbe{
+		check: checkEDNS,
+		name:  "edns",
+		qtype: dns.TypeA,
+		edns:  true,
+	}),
+	name:     "edns",
+	ref:      "RFC 6891 §7",
+	schemes:  nil,
+	optional: false,
+}, {
+	run:      checkEDNSVersion,
+	name:     "edns_version",
+	ref:      "RFC 6891 §6.1.3",
+	schemes:  nil,
+	optional: false,
+}, {
+	run:      checkEDNSUnknownOption,
+	name:     "edns_unknown_option",
+	ref:      "RFC 6891 §6.1.2",
+	schemes:  nil,
+	optional: false,
+}, {
+	run: probeCheck(&selfTestProbe{
+		check:  checkAnswerOf[*dns.RRSIG],
+		name:   "dnssec",
+		qtype:  dns.TypeA,
+		edns:   true,
+		dnssec: true,
+	}),
+	name:     "dnssec",
+	ref:      "RFC 4035 §3.2.1",
+	schemes:  nil,
+	optional: true,
+}, {
+	run:      checkTCPFallback,
+	name:     "tcp_fallback",
+	ref:      "RFC 7766 §5",
+	schemes:  []string{"udp", "tcp"},
+	optional: false,
+}, {
+	run:      checkPadding,
+	name:     "padding",
+	ref:      "RFC 8467 §4.1",
+	schemes:  []string{"tls", "https", "h3", "quic"},
+	optional: true,
+}, {
+	run:      checkDoTPipelining,
+	name:     "dot_pipelining",
+	ref:      "RFC 7858 §3.3",
+	schemes:  []string{"tls"},
+	optional: false,
+}, {
+	run:      checkDoTResumption,
+	name:     "dot_resumption",
+	ref:      "RFC 7858 §3.4",
+	schemes:  []string{"tls"},
+	optional: true,
+}, {
+	run:      checkDoHGet,
+	name:     "doh_get",
+	ref:      "RFC 8484 §4.1",
+	schemes:  []string{"https"},
+	optional: false,
+}, {
+	run:      checkDoHPost,
+	name:     "doh_post",
+	ref:      "RFC 8484 §4.1",
+	schemes:  []string{"https"},
+	optional: false,
+}, {
+	run:      checkDoQExchange,
+	name:     "doq_exchange",
+	ref:      "RFC 9250 §4.2",
+	schemes:  []string{"quic"},
+	optional: false,
+}, {
+	run:      checkDoQ0RTT,
+	name:     "doq_0rtt",
+	ref:      "RFC 9250 §4.5",
+	schemes:  []string{"quic"},
+	optional: true,
+}}
+
+// probeCheck returns a conformance check function sending the query of p.
+func probeCheck(
+	p *selfTestProbe,
+) (run func(ctx context.Context, t *conformanceTarget) (detail string, err error)) {
+	return func(_ context.Context, t *conformanceTarget) (detail string, err error) {
+		return "", p.exchange(t.ups, t.domain)
+	}
+}
+
+// checkRcode returns an error if resp has an rcode other than want.
+func checkRcode(resp *dns.Msg, want int) (err error) {
+	if resp.Rcode != want {
+		return fmt.Errorf(
+			"unexpected rcode %s, want %s",
+			dns.RcodeToString[resp.Rcode],
+			dns.RcodeToString[want],
+		)
+	}
+
+	return nil
+}
+
+// checkQuestionCase checks that the server copies the question with the mixed
+// case name into the response as is.
+func checkQuestionCase(_ context.Context, t *conformanceTarget) (detail string, err error) {
+	name := []byte(t.domain)
+	for i := 0; i < len(name); i += 2 {
+		if c := name[i]; c >= 'a' && c <= 'z' {
+			name[i] = c - 'a' + 'A'
+		}
+	}
+
+	req := (&dns.Msg{}).SetQuestion(string(name), dns.TypeA)
+	resp, err := t.ups.Exchange(req)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return "", err
+	}
+
+	if len(resp.Question) != 1 || resp.Question[0].Name != req.Question[0].Name {
+		return "", fmt.Errorf("question %v, want %v", resp.Question, req.Question)
+	}
+
+	return "", nil
+}
+
+// checkEDNSVersion checks that the server responds with BADVERS to the query
+// of the unsupported EDNS version.
+func checkEDNSVersion(_ context.Context, t *conformanceTarget) (detail string, err error) {
+	req := (&dns.Msg{}).SetQuestion(t.domain, dns.TypeA)
+	req.SetEdns0(dns.DefaultMsgSize, false)
+	req.IsEdns0().SetVersion(1)
+
+	resp, err := t.ups.Exchange(req)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return "", err
+	}
+
+	err = checkRcode(resp, dns.RcodeBadVers)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return "", err
+	}
+
+	if resp.IsEdns0() == nil {
+		return "", errors.Error("no opt record in response")
+	}
+
+	return "", nil
+}
+
+// checkEDNSUnknownOption checks that the server ignores the unknown EDNS
+// options.
+func checkEDNSUnknownOption(_ context.Context, t *conformanceTarget) (detail string, err error) {
+	req := (&dns.Msg{}).SetQuestion(t.domain, dns.TypeA)
+	req.SetEdns0(dns.DefaultMsgSize, false)
+
+	opt := req.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{
+		Code: unknownEDNSOptionCode,
+		Data: []byte{1, 2, 3, 4},
+	})
+
+	resp, err := t.ups.Exchange(req)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return "", err
+	}
+
+	err = checkRcode(resp, dns.RcodeSuccess)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return "", err
+	}
+
+	respOpt := resp.IsEdns0()
+	if respOpt == nil {
+		return "", errors.Error("no opt record in response")
+	}
+
+	for _, o := range respOpt.Option {
+		if o.Option() == unknownEDNSOptionCode {
+			return "", errors.Error("unknown option echoed in response")
+		}
+	}
+
+	return "", nil
+}
+
+// checkTCPFallback checks that the server truncates the large responses over
+// UDP and serves them over TCP.
+func checkTCPFallback(ctx context.Context, t *conformanceTarget) (detail string, err error) {
+	req := (&dns.Msg{}).SetQuestion(t.domain, dns.TypeDNSKEY)
+	req.SetEdns0(dns.MinMsgSize, true)
+
+	resp, _, err := (&dns.Client{Net: "udp"}).ExchangeContext(ctx, req, t.hostPort)
+	if err != nil {
+		return "", fmt.Errorf("udp: %w", err)
+	}
+
+	if !resp.Truncated {
+		detail = "udp response isn't truncated"
+	}
+
+	resp, _, err = (&dns.Client{Net: "tcp"}).ExchangeContext(ctx, req, t.hostPort)
+	if err != nil {
+		return "", fmt.Errorf("tcp: %w", err)
+	}
+
+	if resp.Truncated {
+		return "", errors.Error("tcp: response is truncated")
+	}
+
+	err = checkRcode(resp, dns.RcodeSuccess)
+	if err != nil {
+		return "", fmt.Errorf("tcp: %w", err)
+	}
+
+	return detail, nil
+}
+
+// checkPadding checks that the server pads the responses to the padded
+// queries.
+func checkPadding(_ context.Context, t *conformanceTarget) (detail string, err error) {
+	req := (&dns.Msg{}).SetQuestion(t.domain, dns.TypeA)
+	req.SetEdns0(dns.DefaultMsgSize, false)
+
+	// The padding option itself takes 4 bytes.
+	padLen := paddingBlockSize - (req.Len()+4)%paddingBlockSize
+	opt := req.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_PADDING{
+		Padding: make([]byte, padLen%paddingBlockSize),
+	})
+
+	resp, err := t.ups.Exchange(req)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return "", err
+	}
+
+	respOpt := resp.IsEdns0()
+	if respOpt == nil {
+		return "", errors.Error("no opt record in response")
+	}
+
+	for _, o := range respOpt.Option {
+		if o.Option() == dns.EDNS0PADDING {
+			return fmt.Sprintf("response length %d", resp.Len()), nil
+		}
+	}
+
+	return "", errors.Error("response isn't padded")
+}
+
+// checkDoTPipelining checks that the server responds to several queries sent
+// over a single connection without waiting for the responses.
+func checkDoTPipelining(ctx context.Context, t *conformanceTarget) (detail string, err error) {
+	tlsConn, err := dialDoT(ctx, t, t.newTLSConf())
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return "", err
+	}
+	defer func() { err = errors.WithDeferred(err, tlsConn.Close()) }()
+
+	conn := &dns.Conn{Conn: tlsConn}
+
+	const queriesNum = 3
+
+	ids := map[uint16]struct{}{}
+	for range queriesNum {
+		req := (&dns.Msg{}).SetQuestion(t.domain, dns.TypeA)
+		ids[req.Id] = struct{}{}
+
+		err = conn.WriteMsg(req)
+		if err != nil {
+			return "", fmt.Errorf("writing query: %w", err)
+		}
+	}
+
+	for range queriesNum {
+		var resp *dns.Msg
+		resp, err = conn.ReadMsg()
+		if err != nil {
+			return "", fmt.Errorf("reading response: %w", err)
+		}
+
+		if _, ok := ids[resp.Id]; !ok {
+			return "", fmt.Errorf("unexpected id in response: %d", resp.Id)
+		}
+
+		delete(ids, resp.Id)
+	}
+
+	return "", nil
+}
+
+// checkDoTResumption checks that the server supports the TLS session
+// resumption.
+func checkDoTResumption(ctx context.Context, t *conformanceTarget) (detail string, err error) {
+	conf := t.newTLSConf()
+	conf.ClientSessionCache = tls.NewLRUClientSessionCache(1)
+
+	var state tls.ConnectionState
+	for range 2 {
+		state, err = exchangeDoT(ctx, t, conf)
+		if err != nil {
+			// Don't wrap the error since it's informative enough as is.
+			return "", err
+		}
+	}
+
+	if !state.DidResume {
+		return "", errors.Error("session isn't resumed")
+	}
+
+	return "", nil
+}
+
+// dialDoT establishes a new TLS connection to the server of t using conf.
+func dialDoT(ctx context.Context, t *conformanceTarget, conf *tls.Config) (conn *tls.Conn, err error) {
+	dialer := &tls.Dialer{Config: conf}
+	c, err := dialer.DialContext(ctx, "tcp", t.hostPort)
+	if err != nil {
+		return nil, fmt.Errorf("dialing: %w", err)
+	}
+
+	// [tls.Dialer.DialContext] always returns a *tls.Conn.
+	conn = c.(*tls.Conn)
+
+	deadline, _ := ctx.Deadline()
+	err = conn.SetDeadline(deadline)
+	if err != nil {
+		return nil, errors.WithDeferred(fmt.Errorf("setting deadline: %w", err), conn.Close())
+	}
+
+	return conn, nil
+}
+
+// exchangeDoT sends a single query over a new TLS connection to the server of
+// t and returns the state of the connection.
+func exchangeDoT(
+	ctx context.Context,
+	t *conformanceTarget,
+	conf *tls.Config,
+) (state tls.ConnectionState, err error) {
+	tlsConn, err := dialDoT(ctx, t, conf)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return state, err
+	}
+	defer func() { err = errors.WithDeferred(err, tlsConn.Close()) }()
+
+	conn := &dns.Conn{Conn: tlsConn}
+	err = conn.WriteMsg((&dns.Msg{}).SetQuestion(t.domain, dns.TypeA))
+	if err != nil {
+		return state, fmt.Errorf("writing query: %w", err)
+	}
+
+	// Read the response to make sure the session ticket, which is sent after
+	// the handshake in TLS 1.3, is received.
+	_, err = conn.ReadMsg()
+	if err != nil {
+		return state, fmt.Errorf("reading response: %w", err)
+	}
+
+	return tlsConn.ConnectionState(), nil
+}
+
+// checkDoHGet checks the DoH exchange using the GET method.
+func checkDoHGet(ctx context.Context, t *conformanceTarget) (detail string, err error) {
+	return "", exchangeDoH(ctx, t, http.MethodGet)
+}
+
+// checkDoHPost checks the DoH exchange using the POST method.
+func checkDoHPost(ctx context.Context, t *conformanceTarget) (detail string, err error) {
+	return "", exchangeDoH(ctx, t, http.MethodPost)
+}
+
+// exchangeDoH sends a query with the ID of 0 to the DoH server of t using the
+// HTTP method and validates the response.
+func exchangeDoH(ctx context.Context, t *conformanceTarget, method string) (err error) {
+	req := (&dns.Msg{}).SetQuestion(t.domain, dns.TypeA)
+	req.Id = 0
+
+	packed, err := req.Pack()
+	if err != nil {
+		return fmt.Errorf("packing query: %w", err)
+	}
+
+	u := *t.url
+	u.Fragment = ""
+
+	var body io.Reader
+	if method == http.MethodGet {
+		u.RawQuery = "dns=" + base64.RawURLEncoding.EncodeToString(packed)
+	} else {
+		body = bytes.NewReader(packed)
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return fmt.Errorf("creating request: %w", err)
+	}
+
+	httpReq.Header.Set(httphdr.Accept, mimeDNSMessage)
+	if body != nil {
+		httpReq.Header.Set(httphdr.ContentType, mimeDNSMessage)
+	}
+
+	transport := &http.Transport{
+		TLSClientConfig:   t.newTLSConf(),
+		ForceAttemptHTTP2: true,
+	}
+	defer transport.CloseIdleConnections()
+
+	httpResp, err := (&http.Client{Transport: transport}).Do(httpReq)
+	if err != nil {
+		return fmt.Errorf("requesting: %w", err)
+	}
+	defer func() { err = errors.WithDeferred(err, httpResp.Body.Close()) }()
+
+	if httpResp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", httpResp.Status)
+	}
+
+	if ct := httpResp.Header.Get(httphdr.ContentType); ct != mimeDNSMessage {
+		return fmt.Errorf("unexpected content type %q", ct)
+	}
+
+	respBody, err := io.ReadAll(io.LimitReader(httpResp.Body, dns.MaxMsgSize))
+	if err != nil {
+		return fmt.Errorf("reading response: %w", err)
+	}
+
+	resp := &dns.Msg{}
+	err = resp.Unpack(respBody)
+	if err != nil {
+		return fmt.Errorf("unpacking response: %w", err)
+	}
+
+	if resp.Id != 0 {
+		return fmt.Errorf("unexpected non-zero id in response: %d", resp.Id)
+	}
+
+	return checkRcode(resp, dns.RcodeSuccess)
+}
+
+// checkDoQExchange checks the DoQ exchange over a new connection negotiating
+// the standard ALPN token.
+func checkDoQExchange(ctx context.Context, t *conformanceTarget) (detail string, err error) {
+	conn, err := quic.DialAddrEarly(ctx, t.hostPort, t.newTLSConf(upstream.NextProtoDQ), nil)
+	if err != nil {
+		return "", fmt.Errorf("dialing: %w", err)
+	}
+	defer func() { err = errors.WithDeferred(err, conn.CloseWithError(0, "")) }()
+
+	err = exchangeDoQ(ctx, t, conn)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return "", err
+	}
+
+	if proto := conn.ConnectionState().TLS.NegotiatedProtocol; proto != upstream.NextProtoDQ {
+		return "", fmt.Errorf("unexpected alpn %q", proto)
+	}
+
+	return "", nil
+}
+
+// checkDoQ0RTT checks that the server accepts the queries sent in the 0-RTT
+// data of the resumed connection.
+func checkDoQ0RTT(ctx context.Context, t *conformanceTarget) (detail string, err error) {
+	conf := t.newTLSConf(upstream.NextProtoDQ)
+	conf.ClientSessionCache = tls.NewLRUClientSessionCache(1)
+
+	var state quic.ConnectionState
+	for range 2 {
+		state, err = exchangeDoQOnce(ctx, t, conf)
+		if err != nil {
+			// Don't wrap the error since it's informative enough as is.
+			return "", err
+		}
+	}
+
+	if !state.TLS.DidResume {
+		return "", errors.Error("session isn't resumed")
+	} else if !state.Used0RTT {
+		return "", errors.Error("0-rtt data isn't accepted")
+	}
+
+	return "", nil
+}
+
+// exchangeDoQOnce sends a single query over a new QUIC connection to the
+// server of t and returns the state of the connection after the handshake.
+func exchangeDoQOnce(
+	ctx context.Context,
+	t *conformanceTarget,
+	conf *tls.Config,
+) (state quic.ConnectionState, err error) {
+	conn, err := quic.DialAddrEarly(ctx, t.hostPort, conf, nil)
+	if err != nil {
+		return state, fmt.Errorf("dialing: %w", err)
+	}
+	defer func() { err = errors.WithDeferred(err, conn.CloseWithError(0, "")) }()
+
+	err = exchangeDoQ(ctx, t, conn)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return state, err
+	}
+
+	select {
+	case <-conn.HandshakeComplete():
+		return conn.ConnectionState(), nil
+	case <-ctx.Done():
+		return state, fmt.Errorf("waiting for handshake: %w", ctx.Err())
+	}
+}
+
+// exchangeDoQ sends a query with the ID of 0 over a new stream of conn and
+// validates the response.
+func exchangeDoQ(ctx context.Context, t *conformanceTarget, conn *quic.Conn) (err error) {
+	req := (&dns.Msg{}).SetQuestion(t.domain, dns.TypeA)
+	req.Id = 0
+
+	packed, err := req.Pack()
+	if err != nil {
+		return fmt.Errorf("packing query: %w", err)
+	}
+
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return fmt.Errorf("opening stream: %w", err)
+	}
+
+	deadline, _ := ctx.Deadline()
+	err = stream.SetDeadline(deadline)
+	if err != nil {
+		return fmt.Errorf("setting deadline: %w", err)
+	}
+
+	// RFC 9250 requires the 2-octet length prefix of the messages, see
+	// https://www.rfc-editor.org/rfc/rfc9250.html#section-4.2.
+	buf := binary.BigEndian.AppendUint16(nil, uint16(len(packed)))
+	_, err = stream.Write(append(buf, packed...))
+	if err != nil {
+		return fmt.Errorf("writing query: %w", err)
+	}
+
+	// The client must indicate that no more data is sent on the stream.
+	err = stream.Close()
+	if err != nil {
+		return fmt.Errorf("closing stream: %w", err)
+	}
+
+	respBuf, err := io.ReadAll(io.LimitReader(stream, dns.MaxMsgSize+2))
+	if err != nil {
+		return fmt.Errorf("reading response: %w", err)
+	}
+
+	if len(respBuf) < 2 || int(binary.BigEndian.Uint16(respBuf)) != len(respBuf)-2 {
+		return fmt.Errorf("bad length prefix of response of %d bytes", len(respBuf))
+	}
+
+	resp := &dns.Msg{}
+	err = resp.Unpack(respBuf[2:])
+	if err != nil {
+		return fmt.Errorf("unpacking response: %w", err)
+	}
+
+	if resp.Id != 0 {
+		return fmt.Errorf("unexpected non-zero id in response: %d", resp.Id)
+	}
+
+	return checkRcode(resp, dns.RcodeSuccess)
+}
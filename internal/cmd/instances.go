@@ -0,0 +1,196 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/container"
+	"github.com/AdguardTeam/golibs/errors"
+)
+
+// instance is a single proxy instance run by the process.
+type instance struct {
+	// mu protects conf and proxy once the instance is started, since those are
+	// replaced on reloading the configuration.
+	mu *sync.Mutex
+
+	// conf is the configuration of the instance.
+	conf *configuration
+
+	// proxy is the proxy of the instance.  It's nil until the instance is
+	// created.
+	proxy *proxy.Proxy
+
+	// name is the name of the instance.  It's empty if the process runs a
+	// single proxy.
+	name string
+}
+
+// instanceName is the part of the instance configuration, which isn't a part
+// of [configuration].
+type instanceName struct {
+	// Name is the unique name of the instance.
+	Name string `yaml:"name"`
+}
+
+// instances returns the configurations of the proxy instances to run.  If
+// conf.Instances is empty, the only instance is conf itself.  Otherwise, each
+// of the instances inherits the settings of conf and overrides them with its
+// own ones.  l is used by the bootstrap resolvers shared between the instances
+// and must not be nil.
+func (conf *configuration) instances(l *slog.Logger) (insts []*instance, err error) {
+	if len(conf.Instances) == 0 {
+		return []*instance{{mu: &sync.Mutex{}, conf: conf}}, nil
+	}
+
+	boots := newBootstrapCache(l)
+
+	names := container.NewMapSet[string]()
+	for i, node := range conf.Instances {
+		var n instanceName
+		err = node.Decode(&n)
+		if err != nil {
+			return nil, fmt.Errorf("instance at index %d: %w", i, err)
+		}
+
+		if n.Name == "" {
+			return nil, fmt.Errorf("instance at index %d: name: %w", i, errors.ErrEmptyValue)
+		} else if names.Has(n.Name) {
+			return nil, fmt.Errorf("instance at index %d: name %q: %w", i, n.Name, errors.ErrDuplicated)
+		}
+
+		names.Add(n.Name)
+
+		instConf := *conf
+		instConf.Instances = nil
+		instConf.bootstraps = boots
+
+		err = node.Decode(&instConf)
+		if err != nil {
+			return nil, fmt.Errorf("instance %q: %w", n.Name, err)
+		}
+
+		insts = append(insts, &instance{
+			mu:   &sync.Mutex{},
+			conf: &instConf,
+			name: n.Name,
+		})
+	}
+
+	return insts, nil
+}
+
+// logger returns the logger for the instance.  l must not be nil.
+func (inst *instance) logger(l *slog.Logger) (res *slog.Logger) {
+	if inst.name == "" {
+		return l
+	}
+
+	return l.With("instance", inst.name)
+}
+
+// wrapErr adds the name of the instance to err, if there is one.
+func (inst *instance) wrapErr(err error) (wrapped error) {
+	if inst.name == "" {
+		return err
+	}
+
+	return fmt.Errorf("instance %q: %w", inst.name, err)
+}
+
+// currentProxy returns the proxy of the started instance.  It's safe for
+// concurrent use.
+func (inst *instance) currentProxy() (p *proxy.Proxy) {
+	inst.mu.Lock()
+	defer inst.mu.Unlock()
+
+	return inst.proxy
+}
+
+// init creates the proxy of the instance.  l must not be nil.
+func (inst *instance) init(ctx context.Context, l *slog.Logger) (err error) {
+	inst.proxy, err = newProxy(ctx, l, inst.conf)
+
+	return err
+}
+
+// newProxy creates a proxy configured by conf.  l and conf must not be nil.
+func newProxy(ctx context.Context, l *slog.Logger, conf *configuration) (p *proxy.Proxy, err error) {
+	proxyConf, err := createProxyConfig(ctx, l, conf)
+	if err != nil {
+		return nil, fmt.Errorf("configuring proxy: %w", err)
+	}
+
+	err = conf.selfTest(ctx, l, proxyConf)
+	if err != nil {
+		return nil, fmt.Errorf("self-test: %w", err)
+	}
+
+	p, err = proxy.New(proxyConf)
+	if err != nil {
+		return nil, fmt.Errorf("creating proxy: %w", err)
+	}
+
+	return p, nil
+}
+
+// bootstrapCache contains the bootstrap resolvers shared between the proxy
+// instances having the same bootstrap settings.
+type bootstrapCache struct {
+	// logger is used by the shared resolvers instead of the loggers of the
+	// instances, since those aren't owned by any single instance.
+	logger *slog.Logger
+
+	// resolvers maps the keys of the bootstrap settings to the resolvers.
+	resolvers map[string]upstream.Resolver
+}
+
+// newBootstrapCache returns a new empty *bootstrapCache.  l must not be nil.
+func newBootstrapCache(l *slog.Logger) (c *bootstrapCache) {
+	return &bootstrapCache{
+		logger:    l,
+		resolvers: map[string]upstream.Resolver{},
+	}
+}
+
+// resolver returns the bootstrap resolver for the given settings, see
+// [initBootstrap].  It creates a new one if there is no such resolver yet.  c
+// may be nil, in which case a new resolver is always created with l and
+// opts.Logger.  Otherwise, the resolver uses the logger of c.
+func (c *bootstrapCache) resolver(
+	ctx context.Context,
+	l *slog.Logger,
+	bootstraps []string,
+	opts *upstream.Options,
+) (r upstream.Resolver, err error) {
+	if c == nil {
+		return initBootstrap(ctx, l, bootstraps, opts)
+	}
+
+	shared := *opts
+	shared.Logger = nil
+
+	// Use all the options except the logger as the key, so that the
+	// resolvers are only shared between the instances with the same settings.
+	key := fmt.Sprintf("%q|%+v", bootstraps, shared)
+
+	r, ok := c.resolvers[key]
+	if ok {
+		return r, nil
+	}
+
+	shared.Logger = c.logger.With(upstream.KeyGroup, "bootstrap")
+	r, err = initBootstrap(ctx, c.logger, bootstraps, &shared)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return nil, err
+	}
+
+	c.resolvers[key] = r
+
+	return r, nil
+}
@@ -0,0 +1,228 @@
+package cmd
+
+import (
+	"crypto/tls"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/AdguardTeam/golibs/timeutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+func TestConfiguration_instances(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name       string
+		yaml       string
+		wantErrIs  error
+		wantErrMsg string
+		wantNames  []string
+	}{{
+		name:       "no_instances",
+		yaml:       "upstream: [\"1.1.1.1\"]\n",
+		wantErrIs:  nil,
+		wantErrMsg: "",
+		wantNames:  []string{""},
+	}, {
+		name: "valid",
+		yaml: "upstream: [\"1.1.1.1\"]\n" +
+			"timeout: 5s\n" +
+			"refuse-any: true\n" +
+			"instances:\n" +
+			"- name: first\n" +
+			"  listen-ports: [5353]\n" +
+			"- name: second\n" +
+			"  upstream: [\"8.8.8.8\"]\n" +
+			"  refuse-any: false\n",
+		wantErrIs:  nil,
+		wantErrMsg: "",
+		wantNames:  []string{"first", "second"},
+	}, {
+		name: "empty_name",
+		yaml: "instances:\n" +
+			"- name: first\n" +
+			"- upstream: [\"8.8.8.8\"]\n",
+		wantErrIs:  errors.ErrEmptyValue,
+		wantErrMsg: "instance at index 1: name: empty value",
+		wantNames:  nil,
+	}, {
+		name: "duplicate_name",
+		yaml: "instances:\n" +
+			"- name: first\n" +
+			"- name: first\n",
+		wantErrIs:  errors.ErrDuplicated,
+		wantErrMsg: `instance at index 1: name "first": duplicated value`,
+		wantNames:  nil,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			conf := newConfiguration()
+			err := yaml.Unmarshal([]byte(tc.yaml), conf)
+			require.NoError(t, err)
+
+			insts, err := conf.instances(testLogger)
+			if tc.wantErrIs != nil {
+				assert.ErrorIs(t, err, tc.wantErrIs)
+				testutil.AssertErrorMsg(t, tc.wantErrMsg, err)
+
+				return
+			}
+
+			require.NoError(t, err)
+			require.Len(t, insts, len(tc.wantNames))
+
+			for i, inst := range insts {
+				assert.Equal(t, tc.wantNames[i], inst.name)
+				assert.Empty(t, inst.conf.Instances)
+			}
+		})
+	}
+}
+
+func TestConfiguration_instances_inheritance(t *testing.T) {
+	t.Parallel()
+
+	const confYAML = "upstream: [\"1.1.1.1\"]\n" +
+		"bootstrap: [\"9.9.9.9\"]\n" +
+		"timeout: 5s\n" +
+		"refuse-any: true\n" +
+		"listen-ports: [53]\n" +
+		"instances:\n" +
+		"- name: first\n" +
+		"  listen-ports: [5353]\n" +
+		"- name: second\n" +
+		"  upstream: [\"8.8.8.8\"]\n" +
+		"  refuse-any: false\n"
+
+	conf := newConfiguration()
+	err := yaml.Unmarshal([]byte(confYAML), conf)
+	require.NoError(t, err)
+
+	insts, err := conf.instances(testLogger)
+	require.NoError(t, err)
+	require.Len(t, insts, 2)
+
+	first, second := insts[0].conf, insts[1].conf
+
+	// Overridden.
+	assert.Equal(t, []uint16{5353}, first.ListenPorts)
+	assert.Equal(t, []string{"8.8.8.8"}, second.Upstreams)
+	assert.False(t, second.RefuseAny)
+
+	// Inherited.
+	assert.Equal(t, []string{"1.1.1.1"}, first.Upstreams)
+	assert.True(t, first.RefuseAny)
+	assert.Equal(t, []uint16{53}, second.ListenPorts)
+	for _, c := range []*configuration{first, second} {
+		assert.Equal(t, []string{"9.9.9.9"}, c.BootstrapDNS)
+		assert.Equal(t, timeutil.Duration(5*time.Second), c.Timeout)
+	}
+
+	// The parent configuration is left intact.
+	assert.Equal(t, []uint16{53}, conf.ListenPorts)
+	assert.Equal(t, []string{"1.1.1.1"}, conf.Upstreams)
+	assert.True(t, conf.RefuseAny)
+
+	require.NotNil(t, first.bootstraps)
+	assert.Same(t, first.bootstraps, second.bootstraps)
+}
+
+func TestBootstrapCache_resolver(t *testing.T) {
+	t.Parallel()
+
+	newOpts := func(timeout time.Duration, insecure bool) (opts *upstream.Options) {
+		return &upstream.Options{
+			Logger:             testLogger,
+			Timeout:            timeout,
+			InsecureSkipVerify: insecure,
+		}
+	}
+
+	c := newBootstrapCache(testLogger)
+
+	ctx := testutil.ContextWithTimeout(t, testTimeout)
+	boots := []string{"9.9.9.9"}
+
+	r, err := c.resolver(ctx, testLogger, boots, newOpts(testTimeout, false))
+	require.NoError(t, err)
+
+	testCases := []struct {
+		opts     *upstream.Options
+		name     string
+		boots    []string
+		wantSame bool
+	}{{
+		opts:     newOpts(testTimeout, false),
+		name:     "equal",
+		boots:    []string{"9.9.9.9"},
+		wantSame: true,
+	}, {
+		opts:     newOpts(2*testTimeout, false),
+		name:     "other_timeout",
+		boots:    boots,
+		wantSame: false,
+	}, {
+		opts:     newOpts(testTimeout, true),
+		name:     "other_insecure",
+		boots:    boots,
+		wantSame: false,
+	}, {
+		opts:     newOpts(testTimeout, false),
+		name:     "other_bootstraps",
+		boots:    []string{"1.1.1.1"},
+		wantSame: false,
+	}, {
+		opts: &upstream.Options{
+			Logger:       testLogger.With("instance", "other"),
+			Timeout:      testTimeout,
+			CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+		},
+		name:     "other_cipher_suites",
+		boots:    boots,
+		wantSame: false,
+	}, {
+		// The shared resolvers don't use the loggers of the instances.
+		opts: &upstream.Options{
+			Logger:  testLogger.With("instance", "other"),
+			Timeout: testTimeout,
+		},
+		name:     "other_logger",
+		boots:    boots,
+		wantSame: true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, resErr := c.resolver(ctx, testLogger, tc.boots, tc.opts)
+			require.NoError(t, resErr)
+
+			if tc.wantSame {
+				assert.Same(t, r, got)
+			} else {
+				assert.NotSame(t, r, got)
+			}
+		})
+	}
+
+	t.Run("nil_cache", func(t *testing.T) {
+		var nilCache *bootstrapCache
+
+		opts := newOpts(testTimeout, false)
+		r1, resErr := nilCache.resolver(ctx, testLogger, boots, opts)
+		require.NoError(t, resErr)
+
+		r2, resErr := nilCache.resolver(ctx, testLogger, boots, opts)
+		require.NoError(t, resErr)
+
+		assert.NotSame(t, r1, r2)
+	})
+}
@@ -0,0 +1,203 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"slices"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+)
+
+// listenAddrsUpdateIvl is the interval of re-evaluating the listen addresses
+// specified as network interface names or hostnames.
+const listenAddrsUpdateIvl = 30 * time.Second
+
+// parseListenAddrs returns a sorted slice of listen IP addresses from the
+// given options.  Each option is either an IP address, a name of a network
+// interface, which is expanded to all its current addresses, or a hostname,
+// which is resolved.  In case no addresses are specified by options returns a
+// slice with the IPv4 unspecified address "0.0.0.0".
+//
+// TODO(d.kolyshev): Join errors.
+func parseListenAddrs(ctx context.Context, addrStrs []string) (addrs []netip.Addr, err error) {
+	if len(addrStrs) == 0 {
+		// If ListenAddrs has not been parsed through config file nor command
+		// line we set it to "0.0.0.0".
+		//
+		// TODO(a.garipov): Consider using localhost.
+		return []netip.Addr{netip.IPv4Unspecified()}, nil
+	}
+
+	for i, a := range addrStrs {
+		var resolved []netip.Addr
+		resolved, err = resolveListenAddr(ctx, a)
+		if err != nil {
+			return nil, fmt.Errorf("listen address at index %d: %q: %w", i, a, err)
+		}
+
+		addrs = append(addrs, resolved...)
+	}
+
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no addresses found for %q", addrStrs)
+	}
+
+	slices.SortFunc(addrs, netip.Addr.Compare)
+
+	return slices.Compact(addrs), nil
+}
+
+// resolveListenAddr returns the IP addresses of the listen address option s,
+// which is either an IP address, a name of a network interface, or a hostname.
+func resolveListenAddr(ctx context.Context, s string) (addrs []netip.Addr, err error) {
+	ip, err := netip.ParseAddr(s)
+	if err == nil {
+		return []netip.Addr{ip}, nil
+	}
+
+	iface, err := net.InterfaceByName(s)
+	if err == nil {
+		return interfaceAddrs(iface)
+	}
+
+	addrs, err = net.DefaultResolver.LookupNetIP(ctx, "ip", s)
+	if err != nil {
+		return nil, fmt.Errorf("not an ip address, interface, or resolvable hostname: %w", err)
+	}
+
+	for i, a := range addrs {
+		addrs[i] = a.Unmap()
+	}
+
+	return addrs, nil
+}
+
+// interfaceAddrs returns the current IP addresses of iface.  The IPv6
+// link-local addresses get the zone of the interface, so that those could be
+// bound to.
+func interfaceAddrs(iface *net.Interface) (addrs []netip.Addr, err error) {
+	ifaceAddrs, err := iface.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("getting addresses of interface %q: %w", iface.Name, err)
+	}
+
+	for _, a := range ifaceAddrs {
+		ipNet, ok := a.(*net.IPNet)
+		if !ok {
+			continue
+		}
+
+		ip, ok := netip.AddrFromSlice(ipNet.IP)
+		if !ok {
+			continue
+		}
+
+		ip = ip.Unmap()
+		if ip.Is6() && ip.IsLinkLocalUnicast() {
+			ip = ip.WithZone(iface.Name)
+		}
+
+		addrs = append(addrs, ip)
+	}
+
+	return addrs, nil
+}
+
+// hasDynamicListenAddrs returns true if any of the listen addresses is
+// specified as a network interface name or a hostname.
+func (conf *configuration) hasDynamicListenAddrs() (ok bool) {
+	return slices.ContainsFunc(conf.ListenAddrs, func(s string) (isDynamic bool) {
+		_, err := netip.ParseAddr(s)
+
+		return err != nil
+	})
+}
+
+// updateListenAddrs re-evaluates the listen addresses of the instance
+// specified as network interface names or hostnames each
+// [listenAddrsUpdateIvl] and rebinds the listeners once those change.  It
+// returns when ctx is canceled.  l must not be nil.
+func (inst *instance) updateListenAddrs(ctx context.Context, l *slog.Logger) {
+	defer slogutil.RecoverAndLog(ctx, l)
+
+	ticker := time.NewTicker(listenAddrsUpdateIvl)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := inst.reloadListenAddrs(ctx, l)
+			if err != nil {
+				l.ErrorContext(ctx, "updating listen addresses", slogutil.KeyError, err)
+			}
+		}
+	}
+}
+
+// reloadListenAddrs resolves the listen addresses of the instance again and
+// sets them to the proxy if those have changed.  It does nothing if none of
+// the listen addresses is dynamic, since the configuration may be reloaded
+// meanwhile.  l must not be nil.
+func (inst *instance) reloadListenAddrs(ctx context.Context, l *slog.Logger) (err error) {
+	inst.mu.Lock()
+	defer inst.mu.Unlock()
+
+	conf := inst.conf
+	if !conf.hasDynamicListenAddrs() {
+		return nil
+	}
+
+	addrs, err := parseListenAddrs(ctx, conf.ListenAddrs)
+	if err != nil {
+		// Keep the current listeners.
+		return fmt.Errorf("parsing listen addresses: %w", err)
+	}
+
+	if slices.Equal(addrs, conf.listenIPs) {
+		return nil
+	}
+
+	l.InfoContext(ctx, "listen addresses changed", "old", conf.listenIPs, "new", addrs)
+
+	return inst.setListenIPs(ctx, conf, addrs)
+}
+
+// setListenIPs sets the listen addresses combined from addrs and the ports of
+// conf to the proxy of the instance.  addrs are only stored in conf once all
+// the listeners are bound, so that the failed ones are retried by
+// [instance.updateListenAddrs].  inst.mu must be locked.
+func (inst *instance) setListenIPs(
+	ctx context.Context,
+	conf *configuration,
+	addrs []netip.Addr,
+) (err error) {
+	p := inst.proxy
+	c := &proxy.Config{
+		TLSConfig:            p.TLSConfig,
+		DNSCryptResolverCert: p.DNSCryptResolverCert,
+		DNSCryptProviderName: p.DNSCryptProviderName,
+	}
+
+	if p.HTTPConfig != nil {
+		c.HTTPConfig = &proxy.HTTPConfig{}
+	}
+
+	conf.setListenAddrs(c, addrs)
+
+	err = p.SetListenAddrs(ctx, c)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return err
+	}
+
+	conf.listenIPs = addrs
+
+	return nil
+}
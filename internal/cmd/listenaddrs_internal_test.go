@@ -0,0 +1,178 @@
+package cmd
+
+import (
+	"net"
+	"net/netip"
+	"slices"
+	"testing"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// loopbackInterface returns the loopback network interface of the system.
+func loopbackInterface(t *testing.T) (iface *net.Interface) {
+	t.Helper()
+
+	ifaces, err := net.Interfaces()
+	require.NoError(t, err)
+
+	i := slices.IndexFunc(ifaces, func(iface net.Interface) (ok bool) {
+		return iface.Flags&net.FlagLoopback != 0
+	})
+	if i < 0 {
+		t.Skip("no loopback interface")
+	}
+
+	return &ifaces[i]
+}
+
+func TestResolveListenAddr(t *testing.T) {
+	t.Parallel()
+
+	lo := loopbackInterface(t)
+	loAddrs, err := interfaceAddrs(lo)
+	require.NoError(t, err)
+	require.NotEmpty(t, loAddrs)
+
+	testCases := []struct {
+		name         string
+		in           string
+		wantContains netip.Addr
+		wantErr      bool
+	}{{
+		name:         "ip",
+		in:           "192.0.2.1",
+		wantContains: netip.MustParseAddr("192.0.2.1"),
+		wantErr:      false,
+	}, {
+		name:         "interface",
+		in:           lo.Name,
+		wantContains: loAddrs[0],
+		wantErr:      false,
+	}, {
+		name:         "hostname",
+		in:           "localhost",
+		wantContains: netip.MustParseAddr("127.0.0.1"),
+		wantErr:      false,
+	}, {
+		name:         "bad",
+		in:           "bad.invalid",
+		wantContains: netip.Addr{},
+		wantErr:      true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			ctx := testutil.ContextWithTimeout(t, testTimeout)
+			addrs, resErr := resolveListenAddr(ctx, tc.in)
+			if tc.wantErr {
+				assert.Error(t, resErr)
+
+				return
+			}
+
+			require.NoError(t, resErr)
+			assert.Contains(t, addrs, tc.wantContains)
+			for _, a := range addrs {
+				assert.False(t, a.Is4In6(), a)
+			}
+		})
+	}
+}
+
+func TestParseListenAddrs(t *testing.T) {
+	t.Parallel()
+
+	lo := loopbackInterface(t)
+	loAddrs, err := interfaceAddrs(lo)
+	require.NoError(t, err)
+
+	ip := netip.MustParseAddr("127.0.0.1")
+
+	testCases := []struct {
+		name    string
+		in      []string
+		want    []netip.Addr
+		wantErr bool
+	}{{
+		name:    "empty",
+		in:      nil,
+		want:    []netip.Addr{netip.IPv4Unspecified()},
+		wantErr: false,
+	}, {
+		name:    "sorted_compacted",
+		in:      []string{"192.0.2.2", "127.0.0.1", "192.0.2.2"},
+		want:    []netip.Addr{ip, netip.MustParseAddr("192.0.2.2")},
+		wantErr: false,
+	}, {
+		name:    "interface_and_ip",
+		in:      []string{lo.Name, "127.0.0.1"},
+		want:    sortedAddrs(append(slices.Clone(loAddrs), ip)),
+		wantErr: false,
+	}, {
+		name:    "bad",
+		in:      []string{"127.0.0.1", "bad.invalid"},
+		want:    nil,
+		wantErr: true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			ctx := testutil.ContextWithTimeout(t, testTimeout)
+			addrs, parseErr := parseListenAddrs(ctx, tc.in)
+			if tc.wantErr {
+				assert.Error(t, parseErr)
+
+				return
+			}
+
+			require.NoError(t, parseErr)
+			assert.Equal(t, tc.want, addrs)
+		})
+	}
+}
+
+// sortedAddrs returns addrs sorted and without duplicates.
+func sortedAddrs(addrs []netip.Addr) (sorted []netip.Addr) {
+	slices.SortFunc(addrs, netip.Addr.Compare)
+
+	return slices.Compact(addrs)
+}
+
+func TestInstance_setListenIPs(t *testing.T) {
+	t.Parallel()
+
+	ip := netip.MustParseAddr("192.0.2.1")
+	inst, conf := newTestInstance(t, newTestUpstreamServer(t, ip))
+
+	busy, err := net.ListenPacket("udp", "127.0.0.2:0")
+	require.NoError(t, err)
+
+	busyAddr := testutil.RequireTypeAssert[*net.UDPAddr](t, busy.LocalAddr())
+	conf.ListenPorts = []uint16{uint16(busyAddr.Port)}
+
+	prevIPs := conf.listenIPs
+	addrs := []netip.Addr{netip.MustParseAddr("127.0.0.2")}
+	require.NotEqual(t, addrs, prevIPs)
+
+	ctx := testutil.ContextWithTimeout(t, testTimeout)
+	err = inst.setListenIPs(ctx, conf, addrs)
+	require.Error(t, err)
+
+	// The addresses aren't stored, so that the next update retries.
+	assert.Equal(t, prevIPs, conf.listenIPs)
+
+	require.NoError(t, busy.Close())
+
+	err = inst.setListenIPs(ctx, conf, addrs)
+	require.NoError(t, err)
+
+	assert.Equal(t, addrs, conf.listenIPs)
+	requireResolves(t, inst.proxy, ip)
+}
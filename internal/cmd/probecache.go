@@ -0,0 +1,116 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+)
+
+// probeRecord is the outcome of racing HTTP/3 against HTTP/2 for a single DoH
+// upstream as stored in the file.
+type probeRecord struct {
+	// Expire is the time the outcome expires at.
+	Expire time.Time `json:"expire"`
+
+	// Version is the chosen HTTP version.
+	Version upstream.HTTPVersion `json:"version"`
+}
+
+// probeFileStorage is the [upstream.HTTPProbeStorage] keeping the outcomes in
+// a JSON file.
+type probeFileStorage struct {
+	// logger is used to log the errors of writing the file.
+	logger *slog.Logger
+
+	// mu protects records and the file.
+	mu *sync.Mutex
+
+	// records maps the addresses of the upstreams to their outcomes.
+	records map[string]*probeRecord
+
+	// path is the path to the file.
+	path string
+}
+
+// newProbeFileStorage returns a new storage keeping the outcomes in the file
+// at path, if it's not empty.  The file is created on the first write.
+func newProbeFileStorage(l *slog.Logger, path string) (s upstream.HTTPProbeStorage, err error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	records := map[string]*probeRecord{}
+
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		// Don't wrap the error since it's informative enough as is.
+		return nil, err
+	} else if len(data) > 0 {
+		err = json.Unmarshal(data, &records)
+		if err != nil {
+			return nil, fmt.Errorf("decoding %q: %w", path, err)
+		}
+	}
+
+	return &probeFileStorage{
+		logger:  l.With("path", path),
+		mu:      &sync.Mutex{},
+		records: records,
+		path:    path,
+	}, nil
+}
+
+// type check
+var _ upstream.HTTPProbeStorage = (*probeFileStorage)(nil)
+
+// Load implements the [upstream.HTTPProbeStorage] interface for
+// *probeFileStorage.
+func (s *probeFileStorage) Load(addr string) (v upstream.HTTPVersion, expire time.Time, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rec, ok := s.records[addr]
+	if !ok {
+		return "", time.Time{}, false
+	}
+
+	return rec.Version, rec.Expire, true
+}
+
+// Store implements the [upstream.HTTPProbeStorage] interface for
+// *probeFileStorage.
+func (s *probeFileStorage) Store(addr string, v upstream.HTTPVersion, expire time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for a, rec := range s.records {
+		if !now.Before(rec.Expire) {
+			delete(s.records, a)
+		}
+	}
+
+	s.records[addr] = &probeRecord{
+		Expire:  expire,
+		Version: v,
+	}
+
+	data, err := json.Marshal(s.records)
+	if err != nil {
+		// Must not happen in normal circumstances.
+		panic(fmt.Errorf("encoding probe records: %w", err))
+	}
+
+	err = os.WriteFile(s.path, data, 0o600)
+	if err != nil {
+		s.logger.Warn("writing http3 probe cache", slogutil.KeyError, err)
+	}
+}
@@ -0,0 +1,144 @@
+package cmd
+
+import (
+	"cmp"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/AdguardTeam/golibs/errors"
+)
+
+// Resource profiles.
+const (
+	// profileDefault is the profile with the defaults suitable for servers and
+	// desktops.
+	profileDefault = "default"
+
+	// profileSmall is the profile for the devices with little memory and slow
+	// CPUs, such as OpenWrt-class routers.  It disables HTTP/3 and QUIC, and
+	// uses smaller cache and buffers by default.
+	profileSmall = "small"
+)
+
+// Defaults of [profileSmall].
+const (
+	// smallCacheSize is the default cache size in bytes.
+	smallCacheSize = 16 * 1024
+
+	// smallMaxGoroutines is the default maximum number of goroutines
+	// processing the requests.
+	smallMaxGoroutines = 64
+
+	// smallHTTP2FrameSize is the maximum size of the HTTP/2 frame read from the
+	// DoH clients in bytes.  It's the minimum allowed by RFC 9113.
+	smallHTTP2FrameSize = 16 * 1024
+
+	// smallHTTP2StreamBuffer is the size of the receive buffer of a single
+	// HTTP/2 stream of the DoH clients in bytes.  It fits a DNS message of the
+	// maximum size.
+	smallHTTP2StreamBuffer = 64 * 1024
+
+	// smallHTTP2ConnBuffer is the size of the receive buffer of a single HTTP/2
+	// connection of the DoH clients in bytes.
+	smallHTTP2ConnBuffer = 4 * smallHTTP2StreamBuffer
+
+	// smallHTTP2MaxStreams is the maximum number of concurrent HTTP/2 streams
+	// of a single DoH client connection.
+	smallHTTP2MaxStreams = 32
+)
+
+// isSmall returns true if conf uses [profileSmall].
+func (conf *configuration) isSmall() (ok bool) {
+	return conf.Profile == profileSmall
+}
+
+// validateProfile returns an error if the profile of conf is unknown or the
+// options of conf aren't supported by it.
+func (conf *configuration) validateProfile() (err error) {
+	switch conf.Profile {
+	case "", profileDefault:
+		return nil
+	case profileSmall:
+		// Go on.
+	default:
+		return fmt.Errorf(
+			"invalid profile %q, supported: %q, %q",
+			conf.Profile,
+			profileDefault,
+			profileSmall,
+		)
+	}
+
+	var errs []error
+	if conf.HTTP3 {
+		errs = append(errs, errors.Error("http3 is not supported"))
+	}
+
+	if len(conf.QUICListenPorts) > 0 {
+		errs = append(errs, errors.Error("quic listeners are not supported"))
+	}
+
+	for _, addrs := range [][]string{
+		conf.Upstreams,
+		conf.Fallbacks,
+		conf.PrivateRDNSUpstreams,
+		conf.BootstrapDNS,
+	} {
+		for _, addr := range addrs {
+			if usesQUIC(addr) {
+				errs = append(errs, fmt.Errorf("quic upstream %q is not supported", addr))
+			}
+		}
+	}
+
+	err = errors.Join(errs...)
+	if err != nil {
+		return fmt.Errorf("profile %q: %w", conf.Profile, err)
+	}
+
+	return nil
+}
+
+// usesQUIC returns true if the upstream address addr, possibly with domain
+// specification, uses QUIC either for DNS-over-QUIC or HTTP/3.
+func usesQUIC(addr string) (ok bool) {
+	addr = strings.ToLower(addr)
+
+	return strings.Contains(addr, "quic://") || strings.Contains(addr, "h3://")
+}
+
+// cacheSize returns the configured cache size in bytes or the default of the
+// profile of conf.  Zero means the default of the proxy.
+func (conf *configuration) cacheSize() (size int) {
+	if conf.isSmall() {
+		return cmp.Or(conf.CacheSizeBytes, smallCacheSize)
+	}
+
+	return conf.CacheSizeBytes
+}
+
+// maxGoroutines returns the configured maximum number of goroutines processing
+// the requests or the default of the profile of conf.  Zero means no limit.
+func (conf *configuration) maxGoroutines() (n uint) {
+	if conf.isSmall() {
+		return cmp.Or(conf.MaxGoRoutines, smallMaxGoroutines)
+	}
+
+	return conf.MaxGoRoutines
+}
+
+// http2Config returns the configuration of the HTTP/2 server of the DoH
+// listeners for the profile of conf.  nil means the defaults of net/http.
+func (conf *configuration) http2Config() (c *http.HTTP2Config) {
+	if !conf.isSmall() {
+		return nil
+	}
+
+	return &http.HTTP2Config{
+		MaxConcurrentStreams:          smallHTTP2MaxStreams,
+		MaxReadFrameSize:              smallHTTP2FrameSize,
+		MaxReceiveBufferPerConnection: smallHTTP2ConnBuffer,
+		MaxReceiveBufferPerStream:     smallHTTP2StreamBuffer,
+	}
+}
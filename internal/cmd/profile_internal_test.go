@@ -0,0 +1,155 @@
+package cmd
+
+import (
+	"testing"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfiguration_profileDefaults(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name              string
+		profile           string
+		cacheSize         int
+		maxGoroutines     uint
+		wantCacheSize     int
+		wantMaxGoroutines uint
+		wantHTTP2         bool
+	}{{
+		name:              "empty_implicit",
+		profile:           "",
+		cacheSize:         0,
+		maxGoroutines:     0,
+		wantCacheSize:     0,
+		wantMaxGoroutines: 0,
+		wantHTTP2:         false,
+	}, {
+		name:              "default_implicit",
+		profile:           profileDefault,
+		cacheSize:         0,
+		maxGoroutines:     0,
+		wantCacheSize:     0,
+		wantMaxGoroutines: 0,
+		wantHTTP2:         false,
+	}, {
+		name:              "default_explicit",
+		profile:           profileDefault,
+		cacheSize:         1024,
+		maxGoroutines:     10,
+		wantCacheSize:     1024,
+		wantMaxGoroutines: 10,
+		wantHTTP2:         false,
+	}, {
+		name:              "small_implicit",
+		profile:           profileSmall,
+		cacheSize:         0,
+		maxGoroutines:     0,
+		wantCacheSize:     smallCacheSize,
+		wantMaxGoroutines: smallMaxGoroutines,
+		wantHTTP2:         true,
+	}, {
+		name:              "small_explicit",
+		profile:           profileSmall,
+		cacheSize:         1024 * 1024,
+		maxGoroutines:     300,
+		wantCacheSize:     1024 * 1024,
+		wantMaxGoroutines: 300,
+		wantHTTP2:         true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			conf := newConfiguration()
+			conf.Profile = tc.profile
+			conf.CacheSizeBytes = tc.cacheSize
+			conf.MaxGoRoutines = tc.maxGoroutines
+
+			assert.Equal(t, tc.wantCacheSize, conf.cacheSize())
+			assert.Equal(t, tc.wantMaxGoroutines, conf.maxGoroutines())
+
+			h2Conf := conf.http2Config()
+			if !tc.wantHTTP2 {
+				assert.Nil(t, h2Conf)
+
+				return
+			}
+
+			if assert.NotNil(t, h2Conf) {
+				assert.Equal(t, smallHTTP2MaxStreams, h2Conf.MaxConcurrentStreams)
+				assert.Equal(t, smallHTTP2FrameSize, h2Conf.MaxReadFrameSize)
+			}
+		})
+	}
+}
+
+func TestConfiguration_validateProfile(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		modify     func(conf *configuration)
+		name       string
+		profile    string
+		wantErrMsg string
+	}{{
+		modify:     func(_ *configuration) {},
+		name:       "empty",
+		profile:    "",
+		wantErrMsg: "",
+	}, {
+		modify: func(conf *configuration) {
+			conf.HTTP3 = true
+			conf.QUICListenPorts = []uint16{853}
+		},
+		name:       "default_quic",
+		profile:    profileDefault,
+		wantErrMsg: "",
+	}, {
+		modify: func(conf *configuration) {
+			conf.Upstreams = []string{"tls://dns.example", "https://dns.example/dns-query"}
+		},
+		name:       "small",
+		profile:    profileSmall,
+		wantErrMsg: "",
+	}, {
+		modify:     func(_ *configuration) {},
+		name:       "unknown",
+		profile:    "tiny",
+		wantErrMsg: `invalid profile "tiny", supported: "default", "small"`,
+	}, {
+		modify: func(conf *configuration) {
+			conf.HTTP3 = true
+			conf.QUICListenPorts = []uint16{853}
+		},
+		name:    "small_http3_listeners",
+		profile: profileSmall,
+		wantErrMsg: `profile "small": http3 is not supported` + "\n" +
+			"quic listeners are not supported",
+	}, {
+		modify: func(conf *configuration) {
+			conf.Upstreams = []string{"[/example.org/]QUIC://dns.example"}
+			conf.BootstrapDNS = []string{"h3://dns.example/dns-query"}
+		},
+		name:    "small_quic_upstreams",
+		profile: profileSmall,
+		wantErrMsg: `profile "small": quic upstream "[/example.org/]QUIC://dns.example" ` +
+			"is not supported\n" +
+			`quic upstream "h3://dns.example/dns-query" is not supported`,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			conf := newConfiguration()
+			conf.Profile = tc.profile
+			tc.modify(conf)
+
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, conf.validateProfile())
+		})
+	}
+}
@@ -1,18 +1,25 @@
 package cmd
 
 import (
+	"cmp"
 	"context"
 	"crypto/tls"
 	"fmt"
+	"iter"
 	"log/slog"
+	"maps"
 	"net"
+	"net/http"
 	"net/netip"
 	"net/url"
 	"os"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/AdguardTeam/dnscrypt"
+	"github.com/AdguardTeam/dnsproxy/dga"
 	"github.com/AdguardTeam/dnsproxy/internal/dnsmsg"
 	"github.com/AdguardTeam/dnsproxy/internal/middleware"
 	proxynetutil "github.com/AdguardTeam/dnsproxy/internal/netutil"
@@ -20,9 +27,11 @@ import (
 	"github.com/AdguardTeam/dnsproxy/ratelimit"
 	"github.com/AdguardTeam/dnsproxy/upstream"
 	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/hostsfile"
 	"github.com/AdguardTeam/golibs/logutil/slogutil"
 	"github.com/AdguardTeam/golibs/netutil"
 	"github.com/AdguardTeam/golibs/osutil"
+	"github.com/miekg/dns"
 	"gopkg.in/yaml.v3"
 )
 
@@ -39,6 +48,12 @@ func createProxyConfig(
 	l *slog.Logger,
 	conf *configuration,
 ) (proxyConf *proxy.Config, err error) {
+	err = conf.validateProfile()
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return nil, err
+	}
+
 	hostsFiles, err := conf.hostsFiles(ctx, l)
 	if err != nil {
 		// Don't wrap the error since it's informative enough as is.
@@ -50,10 +65,35 @@ func createProxyConfig(
 		return nil, fmt.Errorf("reading hosts files: %w", err)
 	}
 
+	leases, err := conf.leases(l)
+	if err != nil {
+		return nil, fmt.Errorf("dhcp leases: %w", err)
+	}
+
+	policies, err := conf.policies()
+	if err != nil {
+		return nil, fmt.Errorf("policies: %w", err)
+	}
+
+	aaaaSuppression, err := conf.aaaaSuppression()
+	if err != nil {
+		return nil, fmt.Errorf("aaaa suppression: %w", err)
+	}
+
+	serviceBinding, err := conf.serviceBinding()
+	if err != nil {
+		return nil, fmt.Errorf("service binding: %w", err)
+	}
+
 	preMw := middleware.New(&middleware.Config{
 		Logger: l.With(slogutil.KeyPrefix, "pre_handler_mw"),
 		// TODO(e.burkov):  Use the configured message constructor.
 		MessageConstructor: dnsmsg.DefaultMessageConstructor{},
+		Leases:             leases,
+		Policies:           policies,
+		AAAASuppression:    aaaaSuppression,
+		ServiceBinding:     serviceBinding,
+		BlockCanaryDomains: conf.BlockCanaryDomains,
 		HaltIPv6:           conf.IPv6Disabled,
 		HostsFiles:         hosts,
 	})
@@ -64,14 +104,26 @@ func createProxyConfig(
 	}
 
 	httpConf := &proxy.HTTPConfig{
-		ServerHeader:    conf.HTTPSServerName,
-		Routes:          conf.DoHRoutes,
-		ReadTimeout:     defaultHTTPTimeout,
-		WriteTimeout:    defaultHTTPTimeout,
-		HTTP3Enabled:    conf.HTTP3,
-		InsecureEnabled: conf.DoHInsecureEnabled,
+		ServerHeader:       conf.HTTPSServerName,
+		Routes:             conf.DoHRoutes,
+		CORSAllowedOrigins: conf.HTTPSCORSOrigins,
+		ReadTimeout:        defaultHTTPTimeout,
+		WriteTimeout:       defaultHTTPTimeout,
+		HTTP2:              conf.http2Config(),
+		HTTP3Enabled:       conf.HTTP3,
+		InsecureEnabled:    conf.DoHInsecureEnabled,
+	}
+
+	if conf.HTTPSMaxRequestSize > dns.MaxMsgSize {
+		return nil, fmt.Errorf(
+			"https max request size: %w: %d",
+			errors.ErrOutOfRange,
+			conf.HTTPSMaxRequestSize,
+		)
 	}
 
+	httpConf.MaxRequestSize = uint16(conf.HTTPSMaxRequestSize)
+
 	if uiStr := conf.HTTPSUserinfo; uiStr != "" {
 		user, pass, ok := strings.Cut(uiStr, ":")
 		if ok {
@@ -81,16 +133,30 @@ func createProxyConfig(
 		}
 	}
 
+	err = conf.initHTTPHeaders(httpConf)
+	if err != nil {
+		return nil, fmt.Errorf("https headers: %w", err)
+	}
+
 	proxyConf = &proxy.Config{
-		Logger:                   l.With(slogutil.KeyPrefix, proxy.LogPrefix),
-		CacheEnabled:             conf.Cache,
-		CacheSizeBytes:           conf.CacheSizeBytes,
-		CacheMinTTL:              conf.CacheMinTTL,
-		CacheMaxTTL:              conf.CacheMaxTTL,
-		CacheOptimisticAnswerTTL: time.Duration(conf.OptimisticAnswerTTL),
-		CacheOptimisticMaxAge:    time.Duration(conf.OptimisticMaxAge),
-		CacheOptimistic:          conf.CacheOptimistic,
-		RefuseAny:                conf.RefuseAny,
+		Logger:                    l.With(slogutil.KeyPrefix, proxy.LogPrefix),
+		CacheEnabled:              conf.Cache,
+		CacheSizeBytes:            conf.cacheSize(),
+		MemoryLimit:               uint64(conf.MemoryLimit),
+		CacheMinTTL:               conf.CacheMinTTL,
+		CacheMaxTTL:               conf.CacheMaxTTL,
+		CacheOptimisticAnswerTTL:  time.Duration(conf.OptimisticAnswerTTL),
+		CacheOptimisticMaxAge:     time.Duration(conf.OptimisticMaxAge),
+		CacheOptimistic:           conf.CacheOptimistic,
+		CacheFixedTTL:             conf.CacheFixedTTL,
+		CacheAggressiveNSEC:       conf.CacheAggressiveNSEC,
+		RefuseAny:                 conf.RefuseAny,
+		LogRejectedQueries:        conf.LogRejected,
+		TLSFingerprinting:         conf.TLSFingerprinting || hasFingerprintPolicies(policies),
+		TLSSessionTicketLifetime:  time.Duration(conf.TLSSessionTicketLifetime),
+		TLSSessionTicketsDisabled: conf.TLSSessionTicketsDisabled,
+		MinimizeAnswers:           conf.MinimizeAnswers,
+		RebindingAllowedDomains:   conf.RebindingAllowedDomains,
 		// TODO(e.burkov):  The following CIDRs are aimed to match any address.
 		// This is not quite proper approach to be used by default so think
 		// about configuring it.
@@ -101,10 +167,19 @@ func createProxyConfig(
 		DNSSECEnabled:          conf.DNSSECEnabled,
 		EnableEDNSClientSubnet: conf.EnableEDNSSubnet,
 		UDPBufferSize:          conf.UDPBufferSize,
-		MaxGoroutines:          conf.MaxGoRoutines,
+		MaxGoroutines:          conf.maxGoroutines(),
+		ConnLimits:             conf.connLimits(),
+		UDPPacing:              conf.udpPacing(),
+		ExchangeLog:            conf.exchangeLog(),
+		LogSampleRate:          conf.LogSampleRate,
+		ConsensusUpstreams:     conf.ConsensusUpstreams,
+		ConsensusQuorum:        conf.ConsensusQuorum,
+		MaxUpstreamQueries:     conf.MaxUpstreamQueries,
+		MaxQueriesPerUpstream:  conf.MaxQueriesPerUpstream,
+		UpstreamQueueTimeout:   time.Duration(conf.UpstreamQueueTimeout),
 		UsePrivateRDNS:         conf.UsePrivateRDNS,
 		PrivateSubnets:         netutil.SubnetSetFunc(netutil.IsLocallyServed),
-		RequestHandler:         ratelimitMw.Wrap(preMw.Wrap(proxy.DefaultHandler{})),
+		RequestHandler:         preMw.Wrap(proxy.DefaultHandler{}),
 		PendingRequests: &proxy.PendingRequestsConfig{
 			Enabled: conf.PendingRequestsEnabled,
 		},
@@ -116,14 +191,81 @@ func createProxyConfig(
 	var errs []error
 	errs = append(errs, conf.initUpstreams(ctx, l, proxyConf))
 	errs = append(errs, conf.initEDNS(ctx, l, proxyConf))
+	errs = append(errs, conf.initRebindingProtection(proxyConf))
+	errs = append(errs, conf.initCacheDomainTTLs(proxyConf))
+	errs = append(errs, conf.initCompression(proxyConf))
+	errs = append(errs, conf.initPadding(proxyConf))
+	errs = append(errs, conf.initAnswerOrder(proxyConf))
+	errs = append(errs, conf.initMalformedQueryActions(proxyConf))
+	errs = append(errs, conf.initListenDSCP(proxyConf))
+	errs = append(errs, conf.initFaults(proxyConf))
 	errs = append(errs, conf.initTLSConfig(proxyConf))
 	errs = append(errs, conf.initDNSCryptConfig(proxyConf))
-	errs = append(errs, conf.initListenAddrs(proxyConf))
+	errs = append(errs, conf.initListenAddrs(ctx, proxyConf))
 	errs = append(errs, conf.initSubnets(proxyConf))
 
+	proxyConf.RequestHandler = ratelimitMw.Wrap(proxyConf.RequestHandler)
+
 	return proxyConf, errors.Join(errs...)
 }
 
+// initHTTPHeaders initializes the header policy of the DoH server.  httpConf
+// must not be nil.
+func (conf *configuration) initHTTPHeaders(httpConf *proxy.HTTPConfig) (err error) {
+	httpConf.RequiredHeaders, err = parseHeaders(conf.HTTPSRequiredHeaders, false)
+	if err != nil {
+		return fmt.Errorf("required: %w", err)
+	}
+
+	httpConf.ResponseHeaders, err = parseHeaders(conf.HTTPSResponseHeaders, true)
+	if err != nil {
+		return fmt.Errorf("response: %w", err)
+	}
+
+	for i, name := range conf.HTTPSRejectedHeaders {
+		if name = strings.TrimSpace(name); name == "" {
+			return fmt.Errorf("rejected: at index %d: %w", i, errors.ErrEmptyValue)
+		}
+
+		httpConf.RejectedHeaders = append(httpConf.RejectedHeaders, name)
+	}
+
+	return nil
+}
+
+// parseHeaders parses strs in the form of name[:value] into headers.  If
+// needValue is true, the value is required.
+func parseHeaders(strs []string, needValue bool) (h http.Header, err error) {
+	if len(strs) == 0 {
+		return nil, nil
+	}
+
+	h = http.Header{}
+	for i, s := range strs {
+		name, val, ok := strings.Cut(s, ":")
+		name, val = strings.TrimSpace(name), strings.TrimSpace(val)
+		if name == "" {
+			return nil, fmt.Errorf("at index %d: name: %w", i, errors.ErrEmptyValue)
+		} else if needValue && (!ok || val == "") {
+			return nil, fmt.Errorf("at index %d: value: %w", i, errors.ErrEmptyValue)
+		}
+
+		canonName := http.CanonicalHeaderKey(name)
+		if val == "" {
+			// Only require the presence of the header.
+			if _, ok = h[canonName]; !ok {
+				h[canonName] = nil
+			}
+
+			continue
+		}
+
+		h.Add(canonName, val)
+	}
+
+	return h, nil
+}
+
 // isEmpty returns false if uc contains at least a single upstream.  uc must not
 // be nil.
 //
@@ -135,6 +277,339 @@ func isEmpty(uc *proxy.UpstreamConfig) (ok bool) {
 		len(uc.SpecifiedDomainUpstreams) == 0
 }
 
+// leases returns the storage of the hostnames from the DHCP lease file, if
+// configured.
+func (conf *configuration) leases(l *slog.Logger) (strg hostsfile.Storage, err error) {
+	if conf.DHCPLeases == "" {
+		return nil, nil
+	}
+
+	strg, err = middleware.NewLeaseStorage(&middleware.LeaseStorageConfig{
+		Logger: l.With(slogutil.KeyPrefix, "dhcp_leases"),
+		Path:   conf.DHCPLeases,
+		Domain: conf.DHCPLeasesDomain,
+	})
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return nil, err
+	}
+
+	return strg, nil
+}
+
+// aaaaSuppression returns the configuration of the AAAA answers suppression,
+// or nil if it's disabled.
+func (conf *configuration) aaaaSuppression() (c *middleware.AAAASuppressionConfig, err error) {
+	c = &middleware.AAAASuppressionConfig{
+		Domains: conf.AAAASuppressionDomains,
+	}
+
+	switch conf.AAAASuppression {
+	case "":
+		return nil, nil
+	case "always":
+		// Go on.
+	case "if_a_exists":
+		c.OnlyWithA = true
+	default:
+		return nil, fmt.Errorf(
+			"invalid mode %q, supported: %q, %q",
+			conf.AAAASuppression,
+			"always",
+			"if_a_exists",
+		)
+	}
+
+	for _, s := range conf.AAAASuppressionClients {
+		pref, pErr := proxynetutil.ParseSubnet(s)
+		if pErr != nil {
+			return nil, fmt.Errorf("client: %w", pErr)
+		}
+
+		c.Clients = append(c.Clients, pref)
+	}
+
+	for _, d := range c.Domains {
+		err = netutil.ValidateDomainName(strings.TrimSuffix(d, "."))
+		if err != nil {
+			return nil, fmt.Errorf("domain: %w", err)
+		}
+	}
+
+	return c, nil
+}
+
+// serviceBinding returns the configuration of publishing the SVCB and HTTPS
+// records of the proxy, or nil if it's disabled.  The first port of each
+// encrypted protocol is advertised.
+func (conf *configuration) serviceBinding() (c *middleware.ServiceBindingConfig, err error) {
+	if conf.SVCBName == "" {
+		return nil, nil
+	}
+
+	err = netutil.ValidateDomainName(strings.TrimSuffix(conf.SVCBName, "."))
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return nil, err
+	}
+
+	c = &middleware.ServiceBindingConfig{
+		Name:    conf.SVCBName,
+		DoHPath: dohPath(conf.DoHRoutes),
+		HTTP3:   conf.HTTP3,
+	}
+
+	for _, s := range conf.SVCBHints {
+		var ip netip.Addr
+		ip, err = netip.ParseAddr(s)
+		if err != nil {
+			return nil, fmt.Errorf("hint: %w", err)
+		}
+
+		c.Hints = append(c.Hints, ip)
+	}
+
+	if len(conf.HTTPSListenPorts) > 0 {
+		c.HTTPSPort = conf.HTTPSListenPorts[0]
+	}
+
+	if len(conf.TLSListenPorts) > 0 {
+		c.TLSPort = conf.TLSListenPorts[0]
+	}
+
+	if len(conf.QUICListenPorts) > 0 {
+		c.QUICPort = conf.QUICListenPorts[0]
+	}
+
+	return c, nil
+}
+
+// dohPath returns the path of the first DNS-over-HTTPS route among routes, or
+// an empty string if there are none, which means the default one.  The routes
+// are the patterns of [http.ServeMux], optionally prefixed with a method.
+func dohPath(routes []string) (path string) {
+	if len(routes) == 0 {
+		return ""
+	}
+
+	route := routes[0]
+	if i := strings.IndexByte(route, ' '); i >= 0 {
+		route = strings.TrimSpace(route[i+1:])
+	}
+
+	return strings.TrimSuffix(route, "/")
+}
+
+// policies returns the validated client policies from the configuration.  The
+// policy from the command-line options, if any, applies to all the clients not
+// matched by the policies from the configuration file.
+func (conf *configuration) policies() (pols []*middleware.Policy, err error) {
+	var errs []error
+	for i, pc := range conf.Policies {
+		p := &middleware.Policy{
+			TLSFingerprints: pc.TLSFingerprints,
+			SafeSearch:      pc.SafeSearch,
+			BlockedServices: pc.BlockedServices,
+			AllowedDomains:  pc.AllowedDomains,
+		}
+
+		p.QueryTypes, p.QueryClasses, err = parseQueryActions(
+			sortedActions(pc.QueryTypes),
+			sortedActions(pc.QueryClasses),
+		)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("policy at index %d: %w", i, err))
+
+			continue
+		}
+
+		for _, c := range pc.Clients {
+			pref, pErr := proxynetutil.ParseSubnet(c)
+			if pErr != nil {
+				errs = append(errs, fmt.Errorf("policy at index %d: client: %w", i, pErr))
+
+				continue
+			}
+
+			p.Clients = append(p.Clients, pref)
+		}
+
+		if pc.Schedule != nil {
+			p.Schedule, err = pc.Schedule.toInternal()
+			if err != nil {
+				errs = append(errs, fmt.Errorf("policy at index %d: schedule: %w", i, err))
+
+				continue
+			}
+		}
+
+		err = p.Validate()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("policy at index %d: %w", i, err))
+
+			continue
+		}
+
+		pols = append(pols, p)
+	}
+
+	qtypes, qclasses, err := parseQueryActions(
+		splitActions(conf.QueryTypeActions),
+		splitActions(conf.QueryClassActions),
+	)
+	if err != nil {
+		errs = append(errs, err)
+	}
+
+	if len(conf.SafeSearch) > 0 ||
+		len(conf.BlockedServices) > 0 ||
+		len(conf.AllowedDomains) > 0 ||
+		len(qtypes) > 0 ||
+		len(qclasses) > 0 {
+		p := &middleware.Policy{
+			SafeSearch:      conf.SafeSearch,
+			BlockedServices: conf.BlockedServices,
+			AllowedDomains:  conf.AllowedDomains,
+			QueryTypes:      qtypes,
+			QueryClasses:    qclasses,
+		}
+
+		err = p.Validate()
+		if err != nil {
+			errs = append(errs, err)
+		} else {
+			pols = append(pols, p)
+		}
+	}
+
+	return pols, errors.Join(errs...)
+}
+
+// splitActions returns the iterator over the type and action pairs from the
+// strings in the form of type:action.  The strings without a colon are yielded
+// with an empty action to be reported as invalid.
+func splitActions(strs []string) (seq iter.Seq2[string, string]) {
+	return func(yield func(k, v string) bool) {
+		for _, s := range strs {
+			k, v, _ := strings.Cut(s, ":")
+			if !yield(k, v) {
+				return
+			}
+		}
+	}
+}
+
+// sortedActions returns the iterator over the type and action pairs from m
+// sorted by type, so that the errors are reported in a stable order.
+func sortedActions(m map[string]string) (seq iter.Seq2[string, string]) {
+	return func(yield func(k, v string) bool) {
+		for _, k := range slices.Sorted(maps.Keys(m)) {
+			if !yield(k, m[k]) {
+				return
+			}
+		}
+	}
+}
+
+// parseQueryActions parses the actions on the requests by query types and
+// classes.  The actions are case-insensitive.
+func parseQueryActions(
+	qtypeActs iter.Seq2[string, string],
+	qclassActs iter.Seq2[string, string],
+) (qtypes, qclasses map[uint16]middleware.QueryAction, err error) {
+	var errs []error
+	for k, v := range qtypeActs {
+		qt, pErr := middleware.ParseQueryType(k)
+		if pErr != nil {
+			errs = append(errs, fmt.Errorf("query type: %w", pErr))
+
+			continue
+		}
+
+		if qtypes == nil {
+			qtypes = map[uint16]middleware.QueryAction{}
+		}
+
+		qtypes[qt] = middleware.QueryAction(strings.ToLower(v))
+	}
+
+	for k, v := range qclassActs {
+		qc, pErr := middleware.ParseQueryClass(k)
+		if pErr != nil {
+			errs = append(errs, fmt.Errorf("query class: %w", pErr))
+
+			continue
+		}
+
+		if qclasses == nil {
+			qclasses = map[uint16]middleware.QueryAction{}
+		}
+
+		qclasses[qc] = middleware.QueryAction(strings.ToLower(v))
+	}
+
+	return qtypes, qclasses, errors.Join(errs...)
+}
+
+// weekdays maps the short names of the days of week to their values.
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// toInternal converts sc into a *middleware.Schedule.  sc must not be nil.
+func (sc *scheduleConfig) toInternal() (s *middleware.Schedule, err error) {
+	s = &middleware.Schedule{}
+	if sc.TimeZone != "" {
+		s.Location, err = time.LoadLocation(sc.TimeZone)
+		if err != nil {
+			return nil, fmt.Errorf("time zone: %w", err)
+		}
+	}
+
+	s.Start, err = parseClock(sc.Start)
+	if err != nil {
+		return nil, fmt.Errorf("start: %w", err)
+	}
+
+	s.End, err = parseClock(sc.End)
+	if err != nil {
+		return nil, fmt.Errorf("end: %w", err)
+	}
+
+	for _, d := range sc.Days {
+		wd, ok := weekdays[strings.ToLower(d)]
+		if !ok {
+			return nil, fmt.Errorf("days: bad weekday %q", d)
+		}
+
+		s.Days = append(s.Days, wd)
+	}
+
+	return s, nil
+}
+
+// parseClock parses the wall-clock time in the "15:04" format into the offset
+// from midnight.  "24:00" is parsed as the end of the day.
+func parseClock(str string) (offset time.Duration, err error) {
+	if str == "24:00" {
+		return 24 * time.Hour, nil
+	}
+
+	t, err := time.Parse("15:04", str)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return 0, err
+	}
+
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
 // newRatelimitMw returns the ratelimit middleware.  In case of invalid
 // ratelimit configuration returns an error. l must not be nil.
 func (conf *configuration) newRatelimitMw(l *slog.Logger) (mw proxy.Middleware, err error) {
@@ -143,10 +618,11 @@ func (conf *configuration) newRatelimitMw(l *slog.Logger) (mw proxy.Middleware,
 	}
 
 	rlConf := &ratelimit.Config{
-		Logger:        l.With(slogutil.KeyPrefix, "ratelimit"),
-		Ratelimit:     conf.Ratelimit,
-		SubnetLenIPv4: conf.RatelimitSubnetLenIPv4,
-		SubnetLenIPv6: conf.RatelimitSubnetLenIPv6,
+		Logger:           l.With(slogutil.KeyPrefix, "ratelimit"),
+		AllowlistDomains: conf.RatelimitAllowlistDomains,
+		Ratelimit:        conf.Ratelimit,
+		SubnetLenIPv4:    conf.RatelimitSubnetLenIPv4,
+		SubnetLenIPv6:    conf.RatelimitSubnetLenIPv6,
 	}
 	if err = rlConf.Validate(); err != nil {
 		return nil, fmt.Errorf("invalid configuration: %w", err)
@@ -177,23 +653,85 @@ func (conf *configuration) initUpstreams(
 
 	timeout := time.Duration(conf.Timeout)
 	bootOpts := &upstream.Options{
-		Logger:             l,
+		Logger:             l.With(upstream.KeyGroup, "bootstrap"),
 		HTTPVersions:       httpVersions,
 		InsecureSkipVerify: conf.Insecure,
 		Timeout:            timeout,
 	}
-	boot, err := initBootstrap(ctx, l, conf.BootstrapDNS, bootOpts)
+	boot, err := conf.bootstraps.resolver(ctx, l, conf.BootstrapDNS, bootOpts)
 	if err != nil {
 		return fmt.Errorf("initializing bootstrap: %w", err)
 	}
 
+	hostBoots, err := initHostBootstraps(ctx, l, conf.UpstreamBootstraps, bootOpts)
+	if err != nil {
+		return fmt.Errorf("initializing upstream bootstraps: %w", err)
+	}
+
+	probeStorage, err := newProbeFileStorage(l, conf.HTTP3ProbeCacheFile)
+	if err != nil {
+		return fmt.Errorf("initializing http3 probe cache: %w", err)
+	}
+
+	if conf.UpstreamDSCP > uint(proxynetutil.MaxDSCP) {
+		return fmt.Errorf("upstream dscp: %w: %d", errors.ErrOutOfRange, conf.UpstreamDSCP)
+	}
+
+	ednsBufSize, hostEDNSBufSizes, err := parseEDNSBufSizes(conf.UpstreamEDNSBufSizes)
+	if err != nil {
+		return fmt.Errorf("parsing upstream edns buffer sizes: %w", err)
+	}
+
+	var torSOCKSAddr netip.AddrPort
+	if conf.TorSOCKSAddr != "" {
+		torSOCKSAddr, err = netip.ParseAddrPort(conf.TorSOCKSAddr)
+		if err != nil {
+			return fmt.Errorf("parsing tor socks address: %w", err)
+		}
+	}
+
+	var qMismatch upstream.QuestionMismatchMode
+	err = qMismatch.UnmarshalText([]byte(conf.UpstreamQuestionMismatch))
+	if err != nil {
+		return fmt.Errorf("upstream question mismatch: %w", err)
+	}
+
 	upsOpts := &upstream.Options{
-		Logger:             l,
-		HTTPVersions:       httpVersions,
-		InsecureSkipVerify: conf.Insecure,
-		Bootstrap:          boot,
-		Timeout:            timeout,
+		Logger:              l.With(upstream.KeyGroup, "main"),
+		HTTPVersions:        httpVersions,
+		InsecureSkipVerify:  conf.Insecure,
+		Bootstrap:           boot,
+		HostBootstraps:      hostBoots,
+		Timeout:             timeout,
+		QUICKeepAlivePeriod: time.Duration(conf.QUICKeepAlive),
+		QUICDisableOffload:  conf.QUICDisableOffload,
+		QUICFlowLabel:       conf.QUICFlowLabel,
+		HTTPProbeCacheTTL:   time.Duration(conf.HTTP3ProbeCacheTTL),
+		HTTPProbeStorage:    probeStorage,
+		HTTPErrorBudget:     float64(conf.HTTPErrorBudget),
+		HTTPDowngradePeriod: time.Duration(conf.HTTPDowngradePeriod),
+
+		UDPRetransmitInterval:     time.Duration(conf.UDPRetransmitInterval),
+		UDPRetransmitAttempts:     conf.UDPRetransmitAttempts,
+		UDPRetransmitSwitchServer: conf.UDPRetransmitSwitchServer,
+		UDPRandomizeCase:          conf.UDPRandomizeCase,
+		QuestionMismatch:          qMismatch,
+
+		HostEDNSBufferSizes: hostEDNSBufSizes,
+		EDNSBufferSize:      ednsBufSize,
+
+		TorSOCKSAddr: torSOCKSAddr,
+
+		LazyInit:    conf.UpstreamLazyInit,
+		WarmStandby: conf.UpstreamWarmStandby,
+		DSCP:        uint8(conf.UpstreamDSCP),
+	}
+	if !conf.PendingRequestsEnabled {
+		// The identical queries reach the upstreams, so don't pack each of
+		// those.
+		upsOpts.PackedQueryTTL = upstream.DefaultPackedQueryTTL
 	}
+
 	upstreams := loadServersList(conf.Upstreams)
 
 	config.UpstreamConfig, err = proxy.ParseUpstreamsConfig(upstreams, upsOpts)
@@ -202,7 +740,7 @@ func (conf *configuration) initUpstreams(
 	}
 
 	privateUpsOpts := &upstream.Options{
-		Logger:       l,
+		Logger:       l.With(upstream.KeyGroup, "private_rdns"),
 		HTTPVersions: httpVersions,
 		Bootstrap:    boot,
 		Timeout:      min(defaultLocalTimeout, timeout),
@@ -219,7 +757,10 @@ func (conf *configuration) initUpstreams(
 	}
 
 	fallbackUpstreams := loadServersList(conf.Fallbacks)
-	fallbacks, err := proxy.ParseUpstreamsConfig(fallbackUpstreams, upsOpts)
+	fallbacks, err := proxy.ParseUpstreamsConfig(
+		fallbackUpstreams,
+		withUpstreamGroup(l, upsOpts, "fallback"),
+	)
 	if err != nil {
 		return fmt.Errorf("parsing fallback upstreams configuration: %w", err)
 	}
@@ -228,6 +769,11 @@ func (conf *configuration) initUpstreams(
 		config.Fallbacks = fallbacks
 	}
 
+	err = conf.initDGA(l, config, withUpstreamGroup(l, upsOpts, "dga_quarantine"))
+	if err != nil {
+		return fmt.Errorf("dga: %w", err)
+	}
+
 	if conf.UpstreamMode != "" {
 		err = config.UpstreamMode.UnmarshalText([]byte(conf.UpstreamMode))
 		if err != nil {
@@ -242,6 +788,59 @@ func (conf *configuration) initUpstreams(
 	return nil
 }
 
+// withUpstreamGroup returns a copy of opts with the logger derived from l and
+// having the name of the group of upstreams attached.
+func withUpstreamGroup(
+	l *slog.Logger,
+	opts *upstream.Options,
+	group string,
+) (grouped *upstream.Options) {
+	grouped = opts.Clone()
+	grouped.Logger = l.With(upstream.KeyGroup, group)
+
+	return grouped
+}
+
+// initDGA wraps the request handler of config with the middleware detecting
+// the domain names likely generated by DGAs, if enabled.  upsOpts are used to
+// initialize the quarantine upstreams.
+func (conf *configuration) initDGA(
+	l *slog.Logger,
+	config *proxy.Config,
+	upsOpts *upstream.Options,
+) (err error) {
+	if conf.DGAAction == "" {
+		return nil
+	}
+
+	c := &dga.Config{
+		Logger:             l.With(slogutil.KeyPrefix, "dga"),
+		MessageConstructor: dnsmsg.DefaultMessageConstructor{},
+		Action:             dga.Action(conf.DGAAction),
+		Threshold:          cmp.Or(float64(conf.DGAThreshold), dga.DefaultThreshold),
+	}
+
+	if len(conf.DGAQuarantineUpstreams) > 0 {
+		var uc *proxy.UpstreamConfig
+		uc, err = proxy.ParseUpstreamsConfig(conf.DGAQuarantineUpstreams, upsOpts)
+		if err != nil {
+			return fmt.Errorf("parsing quarantine upstreams: %w", err)
+		}
+
+		c.Quarantine = proxy.NewCustomUpstreamConfig(uc, false, 0, conf.EnableEDNSSubnet)
+	}
+
+	err = c.Validate()
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return err
+	}
+
+	config.RequestHandler = dga.NewMiddleware(c).Wrap(config.RequestHandler)
+
+	return nil
+}
+
 // initBootstrap initializes the [upstream.Resolver] for bootstrapping upstream
 // servers.  It returns the default resolver if no bootstraps were specified.
 // The returned resolver will also use system hosts files first.
@@ -280,6 +879,173 @@ func initBootstrap(
 	}
 }
 
+// initHostBootstraps initializes the per-upstream bootstrap resolvers.  Each
+// line should have the form of "[/host1/host2/]bootstrap", where bootstrap is
+// either the address of a bootstrap resolver, or "#" for the system one.  Lines
+// specifying the same host are joined.
+func initHostBootstraps(
+	ctx context.Context,
+	l *slog.Logger,
+	lines []string,
+	opts *upstream.Options,
+) (boots map[string]upstream.Resolver, err error) {
+	if len(lines) == 0 {
+		return nil, nil
+	}
+
+	addrs := map[string][]string{}
+	for i, line := range lines {
+		var hosts []string
+		var addr string
+		hosts, addr, err = splitHostValue(line)
+		if err != nil {
+			return nil, fmt.Errorf("at index %d: %w", i, err)
+		}
+
+		for _, host := range hosts {
+			addrs[host] = append(addrs[host], addr)
+		}
+	}
+
+	boots = make(map[string]upstream.Resolver, len(addrs))
+	for host, hostAddrs := range addrs {
+		var r upstream.Resolver
+		if slices.Contains(hostAddrs, "#") {
+			r = net.DefaultResolver
+		} else {
+			r, err = initBootstrap(ctx, l, hostAddrs, opts)
+			if err != nil {
+				return nil, fmt.Errorf("host %q: %w", host, err)
+			}
+		}
+
+		boots[host] = r
+	}
+
+	return boots, nil
+}
+
+// splitHostValue splits line of the form "[/host1/host2/]value" into the
+// lowercased hosts and the value.
+func splitHostValue(line string) (hosts []string, val string, err error) {
+	hostsStr, val, ok := strings.Cut(strings.TrimPrefix(line, "[/"), "/]")
+	if !ok || !strings.HasPrefix(line, "[/") {
+		return nil, "", fmt.Errorf("bad value %q: want [/host/]value", line)
+	}
+
+	for host := range strings.SplitSeq(hostsStr, "/") {
+		if host == "" {
+			return nil, "", fmt.Errorf("bad value %q: empty host", line)
+		}
+
+		hosts = append(hosts, strings.ToLower(host))
+	}
+
+	if val == "" {
+		return nil, "", fmt.Errorf("bad value %q: empty value", line)
+	}
+
+	return hosts, val, nil
+}
+
+// parseCacheDomainTTLs parses the TTL ranges of the domains in the form of
+// "[/domain/]min:max", where either limit may be omitted.
+func parseCacheDomainTTLs(lines []string) (ranges map[string]proxy.TTLRange, err error) {
+	for i, line := range lines {
+		var domains []string
+		var rangeStr string
+		domains, rangeStr, err = splitHostValue(line)
+		if err != nil {
+			return nil, fmt.Errorf("at index %d: %w", i, err)
+		}
+
+		var r proxy.TTLRange
+		r, err = parseTTLRange(rangeStr)
+		if err != nil {
+			return nil, fmt.Errorf("at index %d: %w", i, err)
+		}
+
+		if ranges == nil {
+			ranges = map[string]proxy.TTLRange{}
+		}
+
+		for _, d := range domains {
+			ranges[d] = r
+		}
+	}
+
+	return ranges, nil
+}
+
+// parseTTLRange parses the TTL range in the form of "min:max", where either
+// limit may be omitted.
+func parseTTLRange(s string) (r proxy.TTLRange, err error) {
+	minStr, maxStr, ok := strings.Cut(s, ":")
+	if !ok {
+		return r, fmt.Errorf("bad ttl range %q: want min:max", s)
+	}
+
+	r.Min, err = parseOptionalTTL(minStr)
+	if err != nil {
+		return r, fmt.Errorf("bad ttl range %q: min: %w", s, err)
+	}
+
+	r.Max, err = parseOptionalTTL(maxStr)
+	if err != nil {
+		return r, fmt.Errorf("bad ttl range %q: max: %w", s, err)
+	}
+
+	return r, nil
+}
+
+// parseOptionalTTL parses the TTL in seconds.  The empty string is parsed as
+// zero.
+func parseOptionalTTL(s string) (ttl uint32, err error) {
+	if s == "" {
+		return 0, nil
+	}
+
+	v, err := strconv.ParseUint(s, 10, 32)
+
+	return uint32(v), err
+}
+
+// parseEDNSBufSizes parses the EDNS0 UDP payload sizes of the upstreams in the
+// form of "[/host/]size".  size is the one specified without hosts, if any.
+func parseEDNSBufSizes(lines []string) (size uint16, hostSizes map[string]uint16, err error) {
+	for i, line := range lines {
+		hosts, sizeStr := []string(nil), line
+		if strings.HasPrefix(line, "[/") {
+			hosts, sizeStr, err = splitHostValue(line)
+			if err != nil {
+				return 0, nil, fmt.Errorf("at index %d: %w", i, err)
+			}
+		}
+
+		var s uint64
+		s, err = strconv.ParseUint(sizeStr, 10, 16)
+		if err != nil {
+			return 0, nil, fmt.Errorf("at index %d: %w", i, err)
+		}
+
+		if len(hosts) == 0 {
+			size = uint16(s)
+
+			continue
+		}
+
+		if hostSizes == nil {
+			hostSizes = map[string]uint16{}
+		}
+
+		for _, host := range hosts {
+			hostSizes[host] = uint16(s)
+		}
+	}
+
+	return size, hostSizes, nil
+}
+
 // initEDNS inits EDNS-related config fields.
 func (conf *configuration) initEDNS(
 	ctx context.Context,
@@ -304,6 +1070,247 @@ func (conf *configuration) initEDNS(
 	return nil
 }
 
+// initCacheDomainTTLs inits the TTL ranges of the responses for the domains.
+func (conf *configuration) initCacheDomainTTLs(config *proxy.Config) (err error) {
+	config.CacheDomainTTLs, err = parseCacheDomainTTLs(conf.CacheDomainTTLs)
+	if err != nil {
+		return fmt.Errorf("cache domain ttls: %w", err)
+	}
+
+	return nil
+}
+
+// initRebindingProtection inits the DNS rebinding protection mode.
+func (conf *configuration) initRebindingProtection(config *proxy.Config) (err error) {
+	err = config.RebindingProtection.UnmarshalText([]byte(conf.RebindingProtection))
+	if err != nil {
+		return fmt.Errorf("parsing rebinding protection: %w", err)
+	}
+
+	return nil
+}
+
+// initCompression inits the mode of the name compression in the responses.
+func (conf *configuration) initCompression(config *proxy.Config) (err error) {
+	err = config.Compression.UnmarshalText([]byte(conf.Compression))
+	if err != nil {
+		return fmt.Errorf("parsing compression: %w", err)
+	}
+
+	return nil
+}
+
+// connLimits returns the limits on the client connections of the encrypted
+// listeners, or nil if none are set.
+func (conf *configuration) connLimits() (c *proxy.ConnLimitsConfig) {
+	c = &proxy.ConnLimitsConfig{
+		IdleTimeout:       time.Duration(conf.ConnIdleTimeout),
+		MaxConns:          conf.MaxConns,
+		MaxConnsPerClient: conf.MaxConnsPerClient,
+		MaxQueriesPerConn: conf.MaxQueriesPerConn,
+	}
+
+	if *c == (proxy.ConnLimitsConfig{}) {
+		return nil
+	}
+
+	return c
+}
+
+// udpPacing returns the configuration of pacing the UDP responses, or nil if
+// the pacing is disabled.  The client subnets are the same as the ones of the
+// rate limiting.
+func (conf *configuration) udpPacing() (c *proxy.UDPPacingConfig) {
+	if conf.UDPPacingRate == 0 {
+		return nil
+	}
+
+	return &proxy.UDPPacingConfig{
+		MaxDelay:      time.Duration(conf.UDPPacingMaxDelay),
+		Rate:          conf.UDPPacingRate,
+		Burst:         conf.UDPPacingBurst,
+		SubnetLenIPv4: conf.RatelimitSubnetLenIPv4,
+		SubnetLenIPv6: conf.RatelimitSubnetLenIPv6,
+	}
+}
+
+// exchangeLog returns the configuration of reducing the volume of the upstream
+// exchange logs, or nil if every exchange is logged.
+func (conf *configuration) exchangeLog() (c *proxy.ExchangeLogConfig) {
+	if conf.LogErrorSummaryInterval == 0 && !conf.LogQuietSuccess {
+		return nil
+	}
+
+	return &proxy.ExchangeLogConfig{
+		ErrorSummaryInterval: time.Duration(conf.LogErrorSummaryInterval),
+		QuietSuccess:         conf.LogQuietSuccess,
+	}
+}
+
+// hasFingerprintPolicies returns true if any of pols matches the clients by
+// their TLS fingerprints.
+func hasFingerprintPolicies(pols []*middleware.Policy) (ok bool) {
+	return slices.ContainsFunc(pols, func(p *middleware.Policy) (has bool) {
+		return len(p.TLSFingerprints) > 0
+	})
+}
+
+// initPadding inits the mode of padding the responses.
+func (conf *configuration) initPadding(config *proxy.Config) (err error) {
+	err = config.Padding.UnmarshalText([]byte(conf.Padding))
+	if err != nil {
+		return fmt.Errorf("parsing padding: %w", err)
+	}
+
+	return nil
+}
+
+// initAnswerOrder inits the mode of ordering the cached answers.
+func (conf *configuration) initAnswerOrder(config *proxy.Config) (err error) {
+	err = config.AnswerOrder.UnmarshalText([]byte(conf.AnswerOrder))
+	if err != nil {
+		return fmt.Errorf("parsing answer order: %w", err)
+	}
+
+	return nil
+}
+
+// malformedProtos are the protocols supporting the malformed query actions.
+var malformedProtos = []proxy.Proto{
+	proxy.ProtoUDP,
+	proxy.ProtoTCP,
+	proxy.ProtoTLS,
+	proxy.ProtoHTTPS,
+	proxy.ProtoQUIC,
+}
+
+// initMalformedQueryActions inits the actions on the malformed queries.
+func (conf *configuration) initMalformedQueryActions(config *proxy.Config) (err error) {
+	if len(conf.MalformedQueryActions) == 0 {
+		return nil
+	}
+
+	config.MalformedQueryActions = map[proxy.Proto]proxy.MalformedAction{}
+	for i, s := range conf.MalformedQueryActions {
+		protos := malformedProtos
+		protoStr, actStr, ok := strings.Cut(s, ":")
+		if !ok {
+			actStr = protoStr
+		} else if proto := proxy.Proto(protoStr); slices.Contains(malformedProtos, proto) {
+			protos = []proxy.Proto{proto}
+		} else {
+			return fmt.Errorf("malformed query action at index %d: bad protocol %q", i, protoStr)
+		}
+
+		var act proxy.MalformedAction
+		err = act.UnmarshalText([]byte(actStr))
+		if err != nil {
+			return fmt.Errorf("malformed query action at index %d: %w", i, err)
+		}
+
+		for _, proto := range protos {
+			config.MalformedQueryActions[proto] = act
+		}
+	}
+
+	return nil
+}
+
+// initListenDSCP inits the DSCP values of the listeners.  The same protocols
+// as for the malformed query actions are supported.
+func (conf *configuration) initListenDSCP(config *proxy.Config) (err error) {
+	if len(conf.ListenDSCP) == 0 {
+		return nil
+	}
+
+	config.ListenDSCP = map[proxy.Proto]uint8{}
+	for i, s := range conf.ListenDSCP {
+		protos := malformedProtos
+		protoStr, valStr, ok := strings.Cut(s, ":")
+		if !ok {
+			valStr = protoStr
+		} else if proto := proxy.Proto(protoStr); slices.Contains(malformedProtos, proto) {
+			protos = []proxy.Proto{proto}
+		} else {
+			return fmt.Errorf("listen dscp at index %d: bad protocol %q", i, protoStr)
+		}
+
+		var dscp uint64
+		dscp, err = strconv.ParseUint(valStr, 10, 8)
+		if err != nil {
+			return fmt.Errorf("listen dscp at index %d: %w", i, err)
+		}
+
+		for _, proto := range protos {
+			config.ListenDSCP[proto] = uint8(dscp)
+		}
+	}
+
+	return nil
+}
+
+// initFaults inits the faults injected for testing.
+func (conf *configuration) initFaults(config *proxy.Config) (err error) {
+	config.UpstreamFaults, err = parseFaults(conf.UpstreamFaults)
+	if err != nil {
+		return fmt.Errorf("parsing upstream faults: %w", err)
+	}
+
+	config.ClientFaults, err = parseFaults(conf.ClientFaults)
+	if err != nil {
+		return fmt.Errorf("parsing client faults: %w", err)
+	}
+
+	return nil
+}
+
+// parseFaults parses the faults from s, which is a comma-separated list of
+// kind=rate pairs, where kind is one of drop, delay, corrupt, or truncate, and
+// rate is the probability of the fault.  The rate of delay is followed by
+// a colon and the duration, e.g. "drop=0.1,delay=0.2:500ms".  f is nil if s is
+// empty.
+func parseFaults(s string) (f *proxy.Faults, err error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	f = &proxy.Faults{}
+	for i, pair := range strings.Split(s, ",") {
+		kind, val, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok {
+			return nil, fmt.Errorf("at index %d: bad fault %q", i, pair)
+		}
+
+		var rate *float64
+		switch kind {
+		case "drop":
+			rate = &f.DropRate
+		case "delay":
+			rate = &f.DelayRate
+
+			var durStr string
+			val, durStr, _ = strings.Cut(val, ":")
+			f.Delay, err = time.ParseDuration(durStr)
+			if err != nil {
+				return nil, fmt.Errorf("at index %d: parsing delay: %w", i, err)
+			}
+		case "corrupt":
+			rate = &f.CorruptRate
+		case "truncate":
+			rate = &f.TruncateRate
+		default:
+			return nil, fmt.Errorf("at index %d: %w: %q", i, errors.ErrBadEnumValue, kind)
+		}
+
+		*rate, err = strconv.ParseFloat(val, 64)
+		if err != nil {
+			return nil, fmt.Errorf("at index %d: parsing %s rate: %w", i, kind, err)
+		}
+	}
+
+	return f, nil
+}
+
 // initBogusNXDomain inits BogusNXDomain structure.
 func (conf *configuration) initBogusNXDomain(
 	ctx context.Context,
@@ -378,47 +1385,31 @@ func (conf *configuration) initDNSCryptConfig(config *proxy.Config) (err error)
 	return nil
 }
 
-// parseListenAddrs returns a slice of listen IP addresses from the given
-// options.  In case no addresses are specified by options returns a slice with
-// the IPv4 unspecified address "0.0.0.0".
-//
-// TODO(d.kolyshev): Join errors.
-func parseListenAddrs(addrStrs []string) (addrs []netip.Addr, err error) {
-	for i, a := range addrStrs {
-		var ip netip.Addr
-		ip, err = netip.ParseAddr(a)
-		if err != nil {
-			return addrs, fmt.Errorf("parsing listen address at index %d: %s", i, a)
-		}
-
-		addrs = append(addrs, ip)
-	}
-
-	if len(addrs) == 0 {
-		// If ListenAddrs has not been parsed through config file nor command
-		// line we set it to "0.0.0.0".
-		//
-		// TODO(a.garipov): Consider using localhost.
-		addrs = append(addrs, netip.IPv4Unspecified())
-	}
-
-	return addrs, nil
-}
-
 // initListenAddrs sets up proxy configuration listen IP addresses.
-func (conf *configuration) initListenAddrs(config *proxy.Config) (err error) {
-	addrs, err := parseListenAddrs(conf.ListenAddrs)
+func (conf *configuration) initListenAddrs(ctx context.Context, config *proxy.Config) (err error) {
+	addrs, err := parseListenAddrs(ctx, conf.ListenAddrs)
 	if err != nil {
 		return fmt.Errorf("parsing listen addresses: %w", err)
 	}
 
-	if len(conf.ListenPorts) == 0 {
+	conf.listenIPs = addrs
+	conf.setListenAddrs(config, addrs)
+
+	return nil
+}
+
+// setListenAddrs sets the listen addresses of config to the ones combined from
+// addrs and the configured ports.
+func (conf *configuration) setListenAddrs(config *proxy.Config, addrs []netip.Addr) {
+	ports := conf.ListenPorts
+	if len(ports) == 0 {
 		// If ListenPorts has not been parsed through config file nor command
-		// line we set it to 53.
-		conf.ListenPorts = []uint16{53}
+		// line we use 53.  Don't change conf to keep it comparable with the
+		// reloaded one.
+		ports = []uint16{53}
 	}
 
-	for _, port := range conf.ListenPorts {
+	for _, port := range ports {
 		for _, ip := range addrs {
 			addrPort := netip.AddrPortFrom(ip, port)
 
@@ -434,8 +1425,6 @@ func (conf *configuration) initListenAddrs(config *proxy.Config) (err error) {
 	if config.DNSCryptResolverCert != nil && config.DNSCryptProviderName != "" {
 		initDNSCryptListenAddrs(config, conf, addrs)
 	}
-
-	return nil
 }
 
 // initTLSListenAddrs sets up proxy configuration TLS listen addresses.  conf,
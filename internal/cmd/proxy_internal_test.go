@@ -0,0 +1,42 @@
+package cmd
+
+import (
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/internal/middleware"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseQueryActions(t *testing.T) {
+	t.Parallel()
+
+	qtypes, qclasses, err := parseQueryActions(
+		sortedActions(map[string]string{"HTTPS": "NODATA", "any": "Refuse"}),
+		sortedActions(map[string]string{"CH": "Drop"}),
+	)
+	require.NoError(t, err)
+
+	assert.Equal(t, map[uint16]middleware.QueryAction{
+		dns.TypeHTTPS: middleware.QueryActionNODATA,
+		dns.TypeANY:   middleware.QueryActionRefuse,
+	}, qtypes)
+	assert.Equal(t, map[uint16]middleware.QueryAction{
+		dns.ClassCHAOS: middleware.QueryActionDrop,
+	}, qclasses)
+
+	_, _, err = parseQueryActions(
+		sortedActions(map[string]string{"ZZZ": "drop", "BAD": "drop", "A": "drop"}),
+		sortedActions(map[string]string{"YY": "drop", "XX": "drop"}),
+	)
+	testutil.AssertErrorMsg(
+		t,
+		"query type: unknown value \"BAD\"\n"+
+			"query type: unknown value \"ZZZ\"\n"+
+			"query class: unknown value \"XX\"\n"+
+			"query class: unknown value \"YY\"",
+		err,
+	)
+}
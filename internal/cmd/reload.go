@@ -0,0 +1,418 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"reflect"
+	"slices"
+	"strings"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/container"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+)
+
+// restartOptions are the names of the options, which configure the process
+// itself rather than the proxies, so changing those requires a restart.
+var restartOptions = container.NewMapSet(
+	"log-client-ip-mode",
+	"log-qname-mode",
+	"output",
+	"pprof",
+	"verbose",
+	"version",
+)
+
+// listenOptions are the names of the options, changes of which are applied to
+// the running proxy by rebinding its listeners.
+var listenOptions = container.NewMapSet(
+	"dnscrypt-port",
+	"listen-addrs",
+	"listen-ports",
+	"quic-port",
+	"tls-port",
+)
+
+// cacheOptions are the names of the options, changes of which flush the cache
+// of the proxy.
+var cacheOptions = container.NewMapSet(
+	"cache",
+	"cache-aggressive-nsec",
+	"cache-fixed-ttl",
+	"cache-max-ttl",
+	"cache-min-ttl",
+	"cache-optimistic",
+	"cache-size",
+	"edns",
+	"optimistic-answer-ttl",
+	"optimistic-max-age",
+	"profile",
+)
+
+// listDiff is the difference between two lists of upstreams.
+type listDiff struct {
+	// added are the upstreams missing from the previous list.
+	added []string
+
+	// removed are the upstreams missing from the next list.
+	removed []string
+}
+
+// newListDiff returns the difference between prev and next.
+func newListDiff(prev, next []string) (d listDiff) {
+	for _, s := range next {
+		if !slices.Contains(prev, s) {
+			d.added = append(d.added, s)
+		}
+	}
+
+	for _, s := range prev {
+		if !slices.Contains(next, s) {
+			d.removed = append(d.removed, s)
+		}
+	}
+
+	return d
+}
+
+// appendAttrs appends the non-empty parts of d to attrs as the slog attributes
+// with the keys prefixed by name.
+func (d listDiff) appendAttrs(attrs []any, name string) (res []any) {
+	if len(d.added) > 0 {
+		attrs = append(attrs, name+"_added", d.added)
+	}
+
+	if len(d.removed) > 0 {
+		attrs = append(attrs, name+"_removed", d.removed)
+	}
+
+	return attrs
+}
+
+// configDiff is the difference between two configurations of an instance.
+type configDiff struct {
+	// upstreams is the difference between the upstream lists.
+	upstreams listDiff
+
+	// fallbacks is the difference between the fallback upstream lists.
+	fallbacks listDiff
+
+	// privateRDNS is the difference between the private rDNS upstream lists.
+	privateRDNS listDiff
+
+	// changed are the names of the changed options in the order of the fields
+	// of [configuration].
+	changed []string
+}
+
+// newConfigDiff returns the difference between prev and next.  Only the
+// options settable in the configuration file are compared, except for the
+// instances, which are compared by the caller.  prev and next must not be nil.
+func newConfigDiff(prev, next *configuration) (d *configDiff) {
+	d = &configDiff{
+		upstreams:   newListDiff(prev.Upstreams, next.Upstreams),
+		fallbacks:   newListDiff(prev.Fallbacks, next.Fallbacks),
+		privateRDNS: newListDiff(prev.PrivateRDNSUpstreams, next.PrivateRDNSUpstreams),
+	}
+
+	prevVal, nextVal := reflect.ValueOf(prev).Elem(), reflect.ValueOf(next).Elem()
+	for i := range prevVal.NumField() {
+		name := optionName(prevVal.Type().Field(i))
+		if name == "" || name == "instances" {
+			continue
+		}
+
+		if !reflect.DeepEqual(prevVal.Field(i).Interface(), nextVal.Field(i).Interface()) {
+			d.changed = append(d.changed, name)
+		}
+	}
+
+	return d
+}
+
+// optionName returns the name of the configuration file option set into f, if
+// any.
+func optionName(f reflect.StructField) (name string) {
+	name, _, _ = strings.Cut(f.Tag.Get("yaml"), ",")
+	if name == "-" {
+		return ""
+	}
+
+	return name
+}
+
+// keepOptions sets the options of next with the given names to the values of
+// prev.  prev and next must not be nil.
+func keepOptions(prev, next *configuration, names *container.MapSet[string]) {
+	prevVal, nextVal := reflect.ValueOf(prev).Elem(), reflect.ValueOf(next).Elem()
+	for i := range prevVal.NumField() {
+		if names.Has(optionName(prevVal.Type().Field(i))) {
+			nextVal.Field(i).Set(prevVal.Field(i))
+		}
+	}
+}
+
+// filter returns the names of the changed options contained in names.
+func (d *configDiff) filter(names *container.MapSet[string]) (res []string) {
+	for _, name := range d.changed {
+		if names.Has(name) {
+			res = append(res, name)
+		}
+	}
+
+	return res
+}
+
+// only returns true if all the changed options are contained in names.
+func (d *configDiff) only(names *container.MapSet[string]) (ok bool) {
+	return len(d.filter(names)) == len(d.changed)
+}
+
+// reloadKind is the way the changes of the configuration are applied to an
+// instance.
+type reloadKind uint8
+
+// reloadKind values.
+const (
+	// reloadKindNone means that nothing has to be done.
+	reloadKindNone reloadKind = iota
+
+	// reloadKindListeners means that the listeners of the running proxy are
+	// rebound.
+	reloadKindListeners
+
+	// reloadKindRebuild means that the proxy is recreated keeping the cache.
+	reloadKindRebuild
+
+	// reloadKindFlush means that the proxy is recreated with an empty cache.
+	reloadKindFlush
+)
+
+// kind returns the way d is applied.  d must not contain [restartOptions].
+func (d *configDiff) kind() (k reloadKind) {
+	switch {
+	case len(d.changed) == 0:
+		return reloadKindNone
+	case d.only(listenOptions):
+		return reloadKindListeners
+	case len(d.filter(cacheOptions)) == 0:
+		return reloadKindRebuild
+	default:
+		return reloadKindFlush
+	}
+}
+
+// attrs returns the slog attributes describing d.
+func (d *configDiff) attrs() (attrs []any) {
+	attrs = []any{"changed", d.changed}
+	attrs = d.upstreams.appendAttrs(attrs, "upstreams")
+	attrs = d.fallbacks.appendAttrs(attrs, "fallbacks")
+	attrs = d.privateRDNS.appendAttrs(attrs, "private_rdns_upstreams")
+
+	return attrs
+}
+
+// reparseConfig parses the command-line options and the configuration file
+// again the same way [parseConfig] does.
+func reparseConfig() (conf *configuration, err error) {
+	conf = newConfiguration()
+
+	err = parseCmdLineOptions(conf)
+	if err != nil {
+		// Don't wrap the error, because it's informative enough as is.
+		return nil, err
+	}
+
+	if conf.ConfigPath == "" {
+		return conf, nil
+	}
+
+	err = parseConfigFile(conf, conf.ConfigPath)
+	if err != nil {
+		return nil, fmt.Errorf("parsing config file %s: %w", conf.ConfigPath, err)
+	}
+
+	// Parse command-line args again as it has priority over YAML config.
+	err = parseCmdLineOptions(conf)
+	if err != nil {
+		// Don't wrap the error, because it's informative enough as is.
+		return nil, err
+	}
+
+	return conf, nil
+}
+
+// reloadInstances parses the configuration again and applies the changes to
+// the matching insts.  The instances are matched by name, the added and the
+// removed ones are only reported, since those require a restart.  l must not
+// be nil.
+func reloadInstances(ctx context.Context, l *slog.Logger, insts []*instance) (err error) {
+	conf, err := reparseConfig()
+	if err != nil {
+		return fmt.Errorf("parsing configuration: %w", err)
+	}
+
+	nextInsts, err := conf.instances(l)
+	if err != nil {
+		return fmt.Errorf("configuring instances: %w", err)
+	}
+
+	var errs []error
+	for _, inst := range insts {
+		i := slices.IndexFunc(nextInsts, func(next *instance) (ok bool) {
+			return next.name == inst.name
+		})
+		if i < 0 {
+			l.WarnContext(ctx, "instance removed; restart required", "instance", inst.name)
+
+			continue
+		}
+
+		err = inst.reload(ctx, inst.logger(l), nextInsts[i].conf)
+		if err != nil {
+			errs = append(errs, inst.wrapErr(err))
+		}
+	}
+
+	for _, next := range nextInsts {
+		if !slices.ContainsFunc(insts, func(inst *instance) (ok bool) {
+			return inst.name == next.name
+		}) {
+			l.WarnContext(ctx, "instance added; restart required", "instance", next.name)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// reload applies the changes of conf to the instance.  Only the affected parts
+// are rebuilt: the changes of the listen addresses are applied to the running
+// proxy, while the other ones recreate it, keeping the cache unless its
+// settings have changed.  l and conf must not be nil.
+func (inst *instance) reload(ctx context.Context, l *slog.Logger, conf *configuration) (err error) {
+	inst.mu.Lock()
+	defer inst.mu.Unlock()
+
+	d := newConfigDiff(inst.conf, conf)
+	if len(d.changed) == 0 {
+		l.InfoContext(ctx, "configuration unchanged")
+
+		return nil
+	}
+
+	l.InfoContext(ctx, "configuration changed", d.attrs()...)
+
+	if restart := d.filter(restartOptions); len(restart) > 0 {
+		l.WarnContext(ctx, "options ignored; restart required", "options", restart)
+
+		keepOptions(inst.conf, conf, restartOptions)
+		d = newConfigDiff(inst.conf, conf)
+	}
+
+	switch d.kind() {
+	case reloadKindNone:
+		return nil
+	case reloadKindListeners:
+		return inst.reloadListeners(ctx, l, conf)
+	case reloadKindRebuild:
+		return inst.rebuild(ctx, l, conf, true)
+	default:
+		return inst.rebuild(ctx, l, conf, false)
+	}
+}
+
+// reloadListeners rebinds the listeners of the running proxy to the addresses
+// of conf.  inst.mu must be locked.
+func (inst *instance) reloadListeners(
+	ctx context.Context,
+	l *slog.Logger,
+	conf *configuration,
+) (err error) {
+	addrs, err := parseListenAddrs(ctx, conf.ListenAddrs)
+	if err != nil {
+		// Keep the current listeners.
+		return fmt.Errorf("parsing listen addresses: %w", err)
+	}
+
+	l.InfoContext(ctx, "rebinding listeners")
+
+	inst.conf = conf
+
+	return inst.setListenIPs(ctx, conf, addrs)
+}
+
+// rebuild replaces the proxy of the instance with the one configured by conf.
+// If keepCache is true, the new proxy takes over the cache of the current one.
+// The listeners of the current proxy are only released for the new one, so
+// that the current proxy resumes serving with its upstreams intact if the new
+// one can't be created or started.  inst.mu must be locked.
+func (inst *instance) rebuild(
+	ctx context.Context,
+	l *slog.Logger,
+	conf *configuration,
+	keepCache bool,
+) (err error) {
+	p, err := newProxy(ctx, l, conf)
+	if err != nil {
+		// Keep the current proxy.
+		return fmt.Errorf("recreating proxy: %w", err)
+	}
+
+	if keepCache {
+		p.TakeCache(inst.proxy)
+	}
+
+	l.InfoContext(ctx, "restarting proxy", "keep_cache", keepCache)
+
+	err = setListeners(ctx, inst.proxy, (*proxy.Proxy).StopListeners)
+	if err != nil {
+		l.WarnContext(ctx, "stopping previous listeners", slogutil.KeyError, err)
+	}
+
+	err = p.Start(ctx)
+	if err != nil {
+		err = fmt.Errorf("starting proxy: %w", err)
+		resumeErr := setListeners(ctx, inst.proxy, (*proxy.Proxy).StartListeners)
+		if resumeErr != nil {
+			resumeErr = fmt.Errorf("resuming previous proxy: %w", resumeErr)
+		}
+
+		return errors.WithDeferred(err, resumeErr)
+	}
+
+	err = inst.proxy.Shutdown(ctx)
+	if err != nil {
+		l.WarnContext(ctx, "stopping previous proxy", slogutil.KeyError, err)
+	}
+
+	inst.conf, inst.proxy = conf, p
+
+	return nil
+}
+
+// listenerProtos are the protocols of all the listeners of a proxy.
+var listenerProtos = []proxy.Proto{
+	proxy.ProtoUDP,
+	proxy.ProtoTCP,
+	proxy.ProtoTLS,
+	proxy.ProtoHTTPS,
+	proxy.ProtoQUIC,
+	proxy.ProtoDNSCrypt,
+}
+
+// setListeners calls f, which is either [proxy.Proxy.StopListeners] or
+// [proxy.Proxy.StartListeners], for each of [listenerProtos] of p.
+func setListeners(
+	ctx context.Context,
+	p *proxy.Proxy,
+	f func(p *proxy.Proxy, ctx context.Context, proto proxy.Proto) (err error),
+) (err error) {
+	var errs []error
+	for _, proto := range listenerProtos {
+		errs = append(errs, f(p, ctx, proto))
+	}
+
+	return errors.Join(errs...)
+}
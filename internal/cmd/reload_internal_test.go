@@ -0,0 +1,330 @@
+package cmd
+
+import (
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/container"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/AdguardTeam/golibs/timeutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testLogger is the common logger for tests.
+var testLogger = slogutil.NewDiscardLogger()
+
+// testTimeout is the common timeout for tests.
+const testTimeout = 1 * time.Second
+
+func TestNewConfigDiff(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		modify      func(conf *configuration)
+		name        string
+		wantChanged []string
+		wantKind    reloadKind
+	}{{
+		modify:      func(_ *configuration) {},
+		name:        "unchanged",
+		wantChanged: nil,
+		wantKind:    reloadKindNone,
+	}, {
+		modify: func(conf *configuration) {
+			conf.ListenAddrs = []string{"127.0.0.2"}
+			conf.ListenPorts = []uint16{5353}
+		},
+		name:        "listeners",
+		wantChanged: []string{"listen-addrs", "listen-ports"},
+		wantKind:    reloadKindListeners,
+	}, {
+		modify: func(conf *configuration) {
+			conf.ListenPorts = []uint16{5353}
+			conf.Upstreams = []string{"1.1.1.1"}
+		},
+		name:        "listeners_and_upstreams",
+		wantChanged: []string{"upstream", "listen-ports"},
+		wantKind:    reloadKindRebuild,
+	}, {
+		modify: func(conf *configuration) {
+			conf.RefuseAny = true
+		},
+		name:        "rebuild",
+		wantChanged: []string{"refuse-any"},
+		wantKind:    reloadKindRebuild,
+	}, {
+		modify: func(conf *configuration) {
+			conf.CacheMinTTL = 60
+			conf.RefuseAny = true
+		},
+		name:        "flush",
+		wantChanged: []string{"cache-min-ttl", "refuse-any"},
+		wantKind:    reloadKindFlush,
+	}, {
+		modify: func(conf *configuration) {
+			conf.Profile = profileSmall
+		},
+		name:        "profile",
+		wantChanged: []string{"profile"},
+		wantKind:    reloadKindFlush,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			prev, next := newConfiguration(), newConfiguration()
+			prev.Upstreams = []string{"8.8.8.8"}
+			next.Upstreams = []string{"8.8.8.8"}
+			tc.modify(next)
+
+			d := newConfigDiff(prev, next)
+			assert.ElementsMatch(t, tc.wantChanged, d.changed)
+			assert.Equal(t, tc.wantKind, d.kind())
+		})
+	}
+}
+
+func TestNewConfigDiff_upstreams(t *testing.T) {
+	t.Parallel()
+
+	prev, next := newConfiguration(), newConfiguration()
+	prev.Upstreams = []string{"1.1.1.1", "8.8.8.8"}
+	next.Upstreams = []string{"8.8.8.8", "9.9.9.9"}
+	next.Fallbacks = []string{"1.0.0.1"}
+
+	d := newConfigDiff(prev, next)
+	assert.Equal(t, []string{"9.9.9.9"}, d.upstreams.added)
+	assert.Equal(t, []string{"1.1.1.1"}, d.upstreams.removed)
+	assert.Equal(t, []string{"1.0.0.1"}, d.fallbacks.added)
+	assert.Empty(t, d.fallbacks.removed)
+	assert.Equal(t, listDiff{}, d.privateRDNS)
+
+	// Reordering isn't a change of the list, but it's a change of the option.
+	next.Upstreams = []string{"8.8.8.8", "1.1.1.1"}
+	next.Fallbacks = nil
+
+	d = newConfigDiff(prev, next)
+	assert.Equal(t, listDiff{}, d.upstreams)
+	assert.Equal(t, []string{"upstream"}, d.changed)
+}
+
+func TestConfigDiff_filter(t *testing.T) {
+	t.Parallel()
+
+	names := container.NewMapSet("a", "b")
+
+	testCases := []struct {
+		name       string
+		changed    []string
+		wantFilter []string
+		wantOnly   bool
+	}{{
+		name:       "empty",
+		changed:    nil,
+		wantFilter: nil,
+		wantOnly:   true,
+	}, {
+		name:       "only",
+		changed:    []string{"a", "b"},
+		wantFilter: []string{"a", "b"},
+		wantOnly:   true,
+	}, {
+		name:       "mixed",
+		changed:    []string{"a", "c"},
+		wantFilter: []string{"a"},
+		wantOnly:   false,
+	}, {
+		name:       "none",
+		changed:    []string{"c"},
+		wantFilter: nil,
+		wantOnly:   false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			d := &configDiff{
+				changed: tc.changed,
+			}
+
+			assert.Equal(t, tc.wantFilter, d.filter(names))
+			assert.Equal(t, tc.wantOnly, d.only(names))
+		})
+	}
+}
+
+func TestKeepOptions(t *testing.T) {
+	t.Parallel()
+
+	prev, next := newConfiguration(), newConfiguration()
+	prev.Verbose = false
+	prev.LogOutput = "prev.log"
+
+	next.Verbose = true
+	next.LogOutput = "next.log"
+	next.RefuseAny = true
+
+	keepOptions(prev, next, restartOptions)
+
+	assert.False(t, next.Verbose)
+	assert.Equal(t, "prev.log", next.LogOutput)
+	assert.True(t, next.RefuseAny)
+
+	d := newConfigDiff(prev, next)
+	assert.Empty(t, d.filter(restartOptions))
+	assert.Equal(t, []string{"refuse-any"}, d.changed)
+}
+
+// newTestUpstreamServer starts a plain DNS server answering the A queries with
+// the given IP address and returns its address.
+func newTestUpstreamServer(t *testing.T, ip netip.Addr) (addr string) {
+	t.Helper()
+
+	return newTestDNSServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		resp := (&dns.Msg{}).SetReply(req)
+		resp.Answer = append(resp.Answer, &dns.A{
+			Hdr: dns.RR_Header{
+				Name:   req.Question[0].Name,
+				Rrtype: dns.TypeA,
+				Class:  dns.ClassINET,
+				Ttl:    60,
+			},
+			A: ip.AsSlice(),
+		})
+
+		_ = w.WriteMsg(resp)
+	})
+}
+
+// newTestDNSServer starts a plain DNS server over UDP handling the queries with
+// h and returns its address.
+func newTestDNSServer(t *testing.T, h dns.HandlerFunc) (addr string) {
+	t.Helper()
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	srv := &dns.Server{
+		PacketConn: pc,
+		Handler:    h,
+	}
+
+	started := make(chan struct{})
+	srv.NotifyStartedFunc = func() { close(started) }
+
+	go func() { _ = srv.ActivateAndServe() }()
+	testutil.CleanupAndRequireSuccess(t, srv.Shutdown)
+
+	<-started
+
+	return pc.LocalAddr().String()
+}
+
+// newTestInstance returns a started instance resolving through the upstream
+// with the given address and listening on a random port of localhost.
+func newTestInstance(t *testing.T, upsAddr string) (inst *instance, conf *configuration) {
+	t.Helper()
+
+	conf = newConfiguration()
+	conf.ListenAddrs = []string{"127.0.0.1"}
+	conf.ListenPorts = []uint16{0}
+	conf.Upstreams = []string{upsAddr}
+	conf.Timeout = timeutil.Duration(testTimeout)
+
+	ctx := testutil.ContextWithTimeout(t, testTimeout)
+	p, err := newProxy(ctx, testLogger, conf)
+	require.NoError(t, err)
+
+	err = p.Start(ctx)
+	require.NoError(t, err)
+
+	inst = &instance{
+		mu:    &sync.Mutex{},
+		conf:  conf,
+		proxy: p,
+	}
+	testutil.CleanupAndRequireSuccess(t, func() (err error) {
+		return inst.proxy.Shutdown(testutil.ContextWithTimeout(t, testTimeout))
+	})
+
+	return inst, conf
+}
+
+// requireResolves checks that p resolves the test domain to ip.
+func requireResolves(t *testing.T, p *proxy.Proxy, ip netip.Addr) {
+	t.Helper()
+
+	addr := p.Addr(proxy.ProtoUDP)
+	require.NotNil(t, addr)
+
+	req := (&dns.Msg{}).SetQuestion("example.org.", dns.TypeA)
+	resp, err := dns.Exchange(req, addr.String())
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeSuccess, resp.Rcode)
+	require.Len(t, resp.Answer, 1)
+
+	a := testutil.RequireTypeAssert[*dns.A](t, resp.Answer[0])
+	assert.Equal(t, ip.AsSlice(), []byte(a.A.To4()))
+}
+
+func TestInstance_rebuild(t *testing.T) {
+	t.Parallel()
+
+	prevIP := netip.MustParseAddr("192.0.2.1")
+	nextIP := netip.MustParseAddr("192.0.2.2")
+
+	prevUps := newTestUpstreamServer(t, prevIP)
+	nextUps := newTestUpstreamServer(t, nextIP)
+
+	t.Run("success", func(t *testing.T) {
+		t.Parallel()
+
+		inst, conf := newTestInstance(t, prevUps)
+		requireResolves(t, inst.proxy, prevIP)
+
+		next := *conf
+		next.Upstreams = []string{nextUps}
+
+		ctx := testutil.ContextWithTimeout(t, testTimeout)
+		err := inst.rebuild(ctx, testLogger, &next, true)
+		require.NoError(t, err)
+
+		assert.Same(t, &next, inst.conf)
+		requireResolves(t, inst.proxy, nextIP)
+	})
+
+	t.Run("start_failed", func(t *testing.T) {
+		t.Parallel()
+
+		inst, conf := newTestInstance(t, prevUps)
+		prevProxy := inst.proxy
+
+		busy, err := net.ListenPacket("udp", "127.0.0.1:0")
+		require.NoError(t, err)
+		testutil.CleanupAndRequireSuccess(t, busy.Close)
+
+		busyAddr := testutil.RequireTypeAssert[*net.UDPAddr](t, busy.LocalAddr())
+
+		next := *conf
+		next.Upstreams = []string{nextUps}
+		next.ListenPorts = []uint16{uint16(busyAddr.Port)}
+
+		ctx := testutil.ContextWithTimeout(t, testTimeout)
+		err = inst.rebuild(ctx, testLogger, &next, true)
+		require.Error(t, err)
+
+		// The previous proxy keeps serving with its upstreams.
+		assert.Same(t, conf, inst.conf)
+		assert.Same(t, prevProxy, inst.proxy)
+		requireResolves(t, inst.proxy, prevIP)
+	})
+}
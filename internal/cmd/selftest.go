@@ -0,0 +1,224 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/miekg/dns"
+)
+
+// Self-test modes.
+const (
+	// selfTestModeWarn logs the warnings about the misbehaving upstreams.
+	selfTestModeWarn = "warn"
+
+	// selfTestModeStrict refuses to start when any upstream misbehaves.
+	selfTestModeStrict = "strict"
+)
+
+// defaultSelfTestDomain is the domain name resolved by the self-test probes
+// unless configured otherwise.  It's signed, so that the DNSSEC probe works.
+const defaultSelfTestDomain = "example.com"
+
+// selfTestProbe is a single query of the startup self-test.
+type selfTestProbe struct {
+	// check returns an error if resp is unexpected.  resp is never nil.
+	check func(resp *dns.Msg) (err error)
+
+	// name is the human-readable name of the probe.
+	name string
+
+	// qtype is the type of the probe query.
+	qtype uint16
+
+	// edns makes the probe query contain the OPT record.
+	edns bool
+
+	// dnssec sets the DO bit in the probe query.
+	dnssec bool
+}
+
+// selfTestProbes are the probes sent to each upstream during the self-test.
+var selfTestProbes = []*selfTestProbe{{
+	check:  checkAnswerOf[*dns.A],
+	name:   "a",
+	qtype:  dns.TypeA,
+	edns:   false,
+	dnssec: false,
+}, {
+	check:  checkAnswerOf[*dns.AAAA],
+	name:   "aaaa",
+	qtype:  dns.TypeAAAA,
+	edns:   false,
+	dnssec: false,
+}, {
+	check:  checkEDNS,
+	name:   "edns",
+	qtype:  dns.TypeA,
+	edns:   true,
+	dnssec: false,
+}, {
+	check:  checkAnswerOf[*dns.RRSIG],
+	name:   "dnssec",
+	qtype:  dns.TypeA,
+	edns:   true,
+	dnssec: true,
+}}
+
+// checkAnswerOf returns an error if resp isn't successful or doesn't contain an
+// answer of type T.
+func checkAnswerOf[T dns.RR](resp *dns.Msg) (err error) {
+	if resp.Rcode != dns.RcodeSuccess {
+		return fmt.Errorf("unexpected rcode %s", dns.RcodeToString[resp.Rcode])
+	}
+
+	if !slices.ContainsFunc(resp.Answer, func(rr dns.RR) (ok bool) {
+		_, ok = rr.(T)
+
+		return ok
+	}) {
+		var rr T
+
+		return fmt.Errorf("no %T in answer", rr)
+	}
+
+	return nil
+}
+
+// checkEDNS returns an error if resp isn't successful or doesn't contain the
+// OPT record.
+func checkEDNS(resp *dns.Msg) (err error) {
+	if resp.Rcode != dns.RcodeSuccess {
+		return fmt.Errorf("unexpected rcode %s", dns.RcodeToString[resp.Rcode])
+	}
+
+	if resp.IsEdns0() == nil {
+		return errors.Error("no opt record in response")
+	}
+
+	return nil
+}
+
+// selfTest exercises each upstream of proxyConf with the probe queries.  The
+// failures are logged, and in the strict mode also returned as an error.
+func (conf *configuration) selfTest(
+	ctx context.Context,
+	l *slog.Logger,
+	proxyConf *proxy.Config,
+) (err error) {
+	switch conf.SelfTest {
+	case "":
+		return nil
+	case selfTestModeWarn, selfTestModeStrict:
+		// Go on.
+	default:
+		return fmt.Errorf(
+			"invalid mode %q, supported: %q, %q",
+			conf.SelfTest,
+			selfTestModeWarn,
+			selfTestModeStrict,
+		)
+	}
+
+	domain := dns.Fqdn(conf.SelfTestDomain)
+	if conf.SelfTestDomain == "" {
+		domain = dns.Fqdn(defaultSelfTestDomain)
+	}
+
+	ups := selfTestUpstreams(proxyConf)
+	l.InfoContext(ctx, "running self-test", "upstreams", len(ups), "domain", domain)
+
+	errs := make([][]error, len(ups))
+	wg := &sync.WaitGroup{}
+	for i, u := range ups {
+		wg.Go(func() {
+			defer slogutil.RecoverAndLog(ctx, l)
+
+			errs[i] = selfTestUpstream(u, domain)
+		})
+	}
+
+	wg.Wait()
+
+	var failed []error
+	for i, upsErrs := range errs {
+		for _, e := range upsErrs {
+			l.WarnContext(ctx, "self-test failed", "upstream", ups[i].Address(), slogutil.KeyError, e)
+		}
+
+		if len(upsErrs) > 0 {
+			failed = append(failed, fmt.Errorf("%s: %w", ups[i].Address(), errors.Join(upsErrs...)))
+		}
+	}
+
+	if len(failed) == 0 {
+		l.InfoContext(ctx, "self-test passed")
+
+		return nil
+	} else if conf.SelfTest != selfTestModeStrict {
+		return nil
+	}
+
+	return errors.Join(failed...)
+}
+
+// selfTestUpstreams returns the unique upstreams of proxyConf to self-test.
+// The private reverse DNS upstreams are skipped, since those aren't expected to
+// resolve public domain names.
+func selfTestUpstreams(proxyConf *proxy.Config) (ups []upstream.Upstream) {
+	seen := map[string]struct{}{}
+	for _, uc := range []*proxy.UpstreamConfig{
+		proxyConf.UpstreamConfig,
+		proxyConf.Fallbacks,
+	} {
+		if uc == nil {
+			continue
+		}
+
+		for _, u := range uc.Upstreams {
+			addr := u.Address()
+			if _, ok := seen[addr]; !ok {
+				seen[addr] = struct{}{}
+				ups = append(ups, u)
+			}
+		}
+	}
+
+	return ups
+}
+
+// selfTestUpstream sends each of [selfTestProbes] for domain to u and returns
+// the errors of the failed ones.
+func selfTestUpstream(u upstream.Upstream, domain string) (errs []error) {
+	for _, p := range selfTestProbes {
+		err := p.exchange(u, domain)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("probe %s: %w", p.name, err))
+		}
+	}
+
+	return errs
+}
+
+// exchange sends the query of p for domain to u and checks the response.
+func (p *selfTestProbe) exchange(u upstream.Upstream, domain string) (err error) {
+	req := (&dns.Msg{}).SetQuestion(domain, p.qtype)
+	if p.edns {
+		req.SetEdns0(dns.DefaultMsgSize, p.dnssec)
+	}
+
+	resp, err := u.Exchange(req)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return err
+	}
+
+	return p.check(resp)
+}
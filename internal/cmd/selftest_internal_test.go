@@ -0,0 +1,139 @@
+package cmd
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/AdguardTeam/golibs/timeutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestConformingServer starts a plain DNS server passing all the self-test
+// probes and returns its address.
+func newTestConformingServer(t *testing.T) (addr string) {
+	t.Helper()
+
+	return newTestDNSServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		q := req.Question[0]
+		hdr := dns.RR_Header{
+			Name:   q.Name,
+			Rrtype: q.Qtype,
+			Class:  dns.ClassINET,
+			Ttl:    60,
+		}
+
+		resp := (&dns.Msg{}).SetReply(req)
+		switch q.Qtype {
+		case dns.TypeA:
+			resp.Answer = append(resp.Answer, &dns.A{Hdr: hdr, A: net.IP{192, 0, 2, 1}})
+		case dns.TypeAAAA:
+			resp.Answer = append(resp.Answer, &dns.AAAA{Hdr: hdr, AAAA: net.ParseIP("2001:db8::1")})
+		}
+
+		if opt := req.IsEdns0(); opt != nil {
+			resp.SetEdns0(opt.UDPSize(), opt.Do())
+			if opt.Do() {
+				hdr.Rrtype = dns.TypeRRSIG
+				resp.Answer = append(resp.Answer, &dns.RRSIG{
+					Hdr:         hdr,
+					TypeCovered: q.Qtype,
+					Algorithm:   dns.ECDSAP256SHA256,
+					SignerName:  q.Name,
+				})
+			}
+		}
+
+		_ = w.WriteMsg(resp)
+	})
+}
+
+func TestNewProxy_selfTest(t *testing.T) {
+	t.Parallel()
+
+	conforming := newTestConformingServer(t)
+
+	// The upstream doesn't answer the AAAA queries and doesn't support EDNS.
+	failing := newTestUpstreamServer(t, netip.MustParseAddr("192.0.2.1"))
+
+	testCases := []struct {
+		name       string
+		mode       string
+		upstream   string
+		wantErrMsg string
+	}{{
+		name:       "disabled",
+		mode:       "",
+		upstream:   failing,
+		wantErrMsg: "",
+	}, {
+		name:       "warn_failing",
+		mode:       selfTestModeWarn,
+		upstream:   failing,
+		wantErrMsg: "",
+	}, {
+		name:       "strict_conforming",
+		mode:       selfTestModeStrict,
+		upstream:   conforming,
+		wantErrMsg: "",
+	}, {
+		name:     "strict_failing",
+		mode:     selfTestModeStrict,
+		upstream: failing,
+		wantErrMsg: "self-test: " + failing + ": probe aaaa: no *dns.AAAA in answer\n" +
+			"probe edns: no opt record in response\n" +
+			"probe dnssec: no *dns.RRSIG in answer",
+	}, {
+		name:     "invalid",
+		mode:     "bad",
+		upstream: conforming,
+		wantErrMsg: `self-test: invalid mode "bad", supported: ` +
+			`"warn", "strict"`,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			conf := newConfiguration()
+			conf.Upstreams = []string{tc.upstream}
+			conf.Timeout = timeutil.Duration(testTimeout)
+			conf.SelfTest = tc.mode
+
+			ctx := testutil.ContextWithTimeout(t, testTimeout)
+			p, err := newProxy(ctx, testLogger, conf)
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, err)
+			if tc.wantErrMsg != "" {
+				assert.Nil(t, p)
+			}
+		})
+	}
+}
+
+func TestInstance_rebuild_selfTest(t *testing.T) {
+	t.Parallel()
+
+	prevIP := netip.MustParseAddr("192.0.2.1")
+	prevUps := newTestUpstreamServer(t, prevIP)
+	failing := newTestUpstreamServer(t, netip.MustParseAddr("192.0.2.2"))
+
+	inst, conf := newTestInstance(t, prevUps)
+	prevProxy := inst.proxy
+
+	next := *conf
+	next.Upstreams = []string{failing}
+	next.SelfTest = selfTestModeStrict
+
+	ctx := testutil.ContextWithTimeout(t, testTimeout)
+	err := inst.rebuild(ctx, testLogger, &next, true)
+	require.Error(t, err)
+
+	// The failed self-test keeps the previous proxy serving.
+	assert.ErrorContains(t, err, "self-test")
+	assert.Same(t, conf, inst.conf)
+	assert.Same(t, prevProxy, inst.proxy)
+	requireResolves(t, inst.proxy, prevIP)
+}
@@ -0,0 +1,143 @@
+package middleware
+
+import (
+	"context"
+	"net/netip"
+	"slices"
+	"strings"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/container"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/miekg/dns"
+)
+
+// AAAASuppressionConfig is the configuration of the suppression of the AAAA
+// answers for the networks with broken IPv6 connectivity.
+type AAAASuppressionConfig struct {
+	// Clients are the subnets of clients to suppress the AAAA answers for.  If
+	// empty, the answers are suppressed for all clients.
+	Clients []netip.Prefix
+
+	// Domains are the domain names, for which along with their subdomains the
+	// AAAA answers are suppressed.  If empty, the answers are suppressed for
+	// all domain names.
+	Domains []string
+
+	// OnlyWithA makes the middleware suppress the AAAA answer only if the A
+	// answer for the same name exists, so that IPv6-only names are still
+	// resolved.
+	OnlyWithA bool
+}
+
+// aaaaSuppression is the compiled [AAAASuppressionConfig].
+type aaaaSuppression struct {
+	domains   *container.MapSet[string]
+	clients   []netip.Prefix
+	onlyWithA bool
+}
+
+// newAAAASuppression compiles c into an *aaaaSuppression.  It returns nil if c
+// is nil.
+func newAAAASuppression(c *AAAASuppressionConfig) (s *aaaaSuppression) {
+	if c == nil {
+		return nil
+	}
+
+	domains := container.NewMapSet[string]()
+	for _, d := range c.Domains {
+		domains.Add(dns.Fqdn(strings.ToLower(d)))
+	}
+
+	return &aaaaSuppression{
+		domains:   domains,
+		clients:   slices.Clone(c.Clients),
+		onlyWithA: c.OnlyWithA,
+	}
+}
+
+// matches returns true if the AAAA answers for fqdn requested by the client
+// with addr should be suppressed.
+func (s *aaaaSuppression) matches(addr netip.Addr, fqdn string) (ok bool) {
+	if len(s.clients) > 0 && !slices.ContainsFunc(s.clients, func(p netip.Prefix) (ok bool) {
+		return p.Contains(addr)
+	}) {
+		return false
+	}
+
+	if s.domains.Len() == 0 {
+		return true
+	}
+
+	for d := strings.ToLower(fqdn); d != "" && d != "."; {
+		if s.domains.Has(d) {
+			return true
+		}
+
+		_, d, _ = strings.Cut(d, ".")
+	}
+
+	return false
+}
+
+// suppressAAAA replies with NODATA to the AAAA request within proxyCtx if it
+// matches the suppression configuration.  If the suppression only applies
+// when the A answer exists, it resolves the A request with h first.  ok is
+// true if the request has been handled.
+func (mw *Default) suppressAAAA(
+	ctx context.Context,
+	h proxy.Handler,
+	p *proxy.Proxy,
+	proxyCtx *proxy.DNSContext,
+) (ok bool, err error) {
+	s := mw.aaaaSuppression
+	req := proxyCtx.Req
+	if s == nil ||
+		req.Question[0].Qtype != dns.TypeAAAA ||
+		!s.matches(proxyCtx.Addr.Addr(), req.Question[0].Name) {
+		return false, nil
+	}
+
+	if s.onlyWithA && !mw.hasA(ctx, h, p, proxyCtx) {
+		return false, nil
+	}
+
+	mw.logger.DebugContext(ctx, "suppressing aaaa answer", "qname", req.Question[0].Name)
+	proxyCtx.Res = mw.messages.NewMsgNODATA(req)
+
+	return true, nil
+}
+
+// hasA returns true if the A answer exists for the name requested within
+// proxyCtx.
+func (mw *Default) hasA(
+	ctx context.Context,
+	h proxy.Handler,
+	p *proxy.Proxy,
+	proxyCtx *proxy.DNSContext,
+) (ok bool) {
+	aReq := proxyCtx.Req.Copy()
+	aReq.Question[0].Qtype = dns.TypeA
+
+	aCtx := &proxy.DNSContext{
+		Proto:                proxyCtx.Proto,
+		Req:                  aReq,
+		Addr:                 proxyCtx.Addr,
+		CustomUpstreamConfig: proxyCtx.CustomUpstreamConfig,
+		RequestID:            proxyCtx.RequestID,
+		IsPrivateClient:      proxyCtx.IsPrivateClient,
+	}
+
+	err := h.ServeDNS(ctx, p, aCtx)
+	if err != nil || aCtx.Res == nil {
+		mw.logger.DebugContext(ctx, "resolving a for aaaa suppression", slogutil.KeyError, err)
+
+		return false
+	}
+
+	return slices.ContainsFunc(aCtx.Res.Answer, func(rr dns.RR) (isA bool) {
+		_, isA = rr.(*dns.A)
+
+		return isA
+	})
+}
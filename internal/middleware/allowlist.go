@@ -0,0 +1,79 @@
+package middleware
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/AdguardTeam/golibs/container"
+	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/miekg/dns"
+)
+
+// wildcardPrefix is the prefix of the allowed domain patterns matching only the
+// subdomains of the domain.
+const wildcardPrefix = "*."
+
+// allowlist matches the domain names against the patterns of
+// [Policy.AllowedDomains].  Matching takes a single lookup per label of the
+// name, regardless of the number of patterns.
+type allowlist struct {
+	// domains are the FQDNs allowed along with their subdomains.
+	domains *container.MapSet[string]
+
+	// wildcards are the FQDNs, only the subdomains of which are allowed.
+	wildcards *container.MapSet[string]
+}
+
+// newAllowlist compiles patterns into an *allowlist.  It returns nil if
+// patterns is empty.  patterns must be valid.
+func newAllowlist(patterns []string) (a *allowlist) {
+	if len(patterns) == 0 {
+		return nil
+	}
+
+	a = &allowlist{
+		domains:   container.NewMapSet[string](),
+		wildcards: container.NewMapSet[string](),
+	}
+
+	for _, p := range patterns {
+		p = strings.ToLower(p)
+		if d, ok := strings.CutPrefix(p, wildcardPrefix); ok {
+			a.wildcards.Add(dns.Fqdn(d))
+		} else {
+			a.domains.Add(dns.Fqdn(p))
+		}
+	}
+
+	return a
+}
+
+// validateDomainPattern returns an error if p is neither a valid domain name
+// nor a valid domain name prefixed with [wildcardPrefix].
+func validateDomainPattern(p string) (err error) {
+	d := strings.TrimPrefix(p, wildcardPrefix)
+	err = netutil.ValidateDomainName(strings.TrimSuffix(d, "."))
+	if err != nil {
+		return fmt.Errorf("pattern %q: %w", p, err)
+	}
+
+	return nil
+}
+
+// allows returns true if fqdn matches any of the patterns of a.  fqdn must be
+// lowercased.  a may be nil, in which case all names are allowed.
+func (a *allowlist) allows(fqdn string) (ok bool) {
+	if a == nil {
+		return true
+	}
+
+	for d, isSub := fqdn, false; d != "" && d != "."; isSub = true {
+		if a.domains.Has(d) || isSub && a.wildcards.Has(d) {
+			return true
+		}
+
+		_, d, _ = strings.Cut(d, ".")
+	}
+
+	return false
+}
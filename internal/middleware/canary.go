@@ -0,0 +1,41 @@
+package middleware
+
+import (
+	"context"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// canaryDomains are the FQDNs the browsers and operating systems check before
+// switching to their own encrypted resolvers automatically.
+var canaryDomains = map[string]string{
+	// See https://support.mozilla.org/kb/canary-domain-use-application-dnsnet.
+	"use-application-dns.net.": "firefox",
+
+	// See https://developer.apple.com/support/prepare-your-network-for-icloud-private-relay.
+	"mask.icloud.com.":    "icloud private relay",
+	"mask-h2.icloud.com.": "icloud private relay",
+
+	// The designated resolvers discovery is used by Windows and Chrome, see
+	// RFC 9462.
+	"_dns.resolver.arpa.": "designated resolvers discovery",
+}
+
+// blockCanary replies with NXDOMAIN to the requests for the canary domains, if
+// enabled, to keep the clients using the proxy.  req must not be nil.
+func (mw *Default) blockCanary(ctx context.Context, req *dns.Msg) (resp *dns.Msg) {
+	if !mw.blockCanaryDomains {
+		return nil
+	}
+
+	fqdn := strings.ToLower(req.Question[0].Name)
+	client, ok := canaryDomains[fqdn]
+	if !ok {
+		return nil
+	}
+
+	mw.logger.DebugContext(ctx, "blocking canary domain", "qname", fqdn, "client", client)
+
+	return mw.messages.NewMsgNXDOMAIN(req)
+}
@@ -94,6 +94,25 @@ func readHostsFile(ctx context.Context, strg *hostsfile.DefaultStorage, path str
 func (mw *Default) resolveFromHosts(
 	ctx context.Context,
 	req *dns.Msg,
+) (resp *dns.Msg) {
+	return mw.resolveFromStorage(ctx, mw.hosts, req)
+}
+
+// resolveFromLeases resolves the DNS query from the DHCP leases.  It fills the
+// response with the A, AAAA, and PTR records of the clients' hostnames.
+func (mw *Default) resolveFromLeases(
+	ctx context.Context,
+	req *dns.Msg,
+) (resp *dns.Msg) {
+	return mw.resolveFromStorage(ctx, mw.leases, req)
+}
+
+// resolveFromStorage resolves the DNS query from strg.  It fills the response
+// with the A, AAAA, and PTR records from strg.
+func (mw *Default) resolveFromStorage(
+	ctx context.Context,
+	strg hostsfile.Storage,
+	req *dns.Msg,
 ) (resp *dns.Msg) {
 	var addrs []netip.Addr
 	var ptrs []string
@@ -102,10 +121,10 @@ func (mw *Default) resolveFromHosts(
 	name := strings.TrimSuffix(q.Name, ".")
 	switch q.Qtype {
 	case dns.TypeA:
-		addrs = slices.Clone(mw.hosts.ByName(name))
+		addrs = slices.Clone(strg.ByName(name))
 		addrs = slices.DeleteFunc(addrs, netip.Addr.Is6)
 	case dns.TypeAAAA:
-		addrs = slices.Clone(mw.hosts.ByName(name))
+		addrs = slices.Clone(strg.ByName(name))
 		addrs = slices.DeleteFunc(addrs, netip.Addr.Is4)
 	case dns.TypePTR:
 		addr, err := netutil.IPFromReversedAddr(name)
@@ -115,7 +134,7 @@ func (mw *Default) resolveFromHosts(
 			return nil
 		}
 
-		ptrs = mw.hosts.ByAddr(addr)
+		ptrs = strg.ByAddr(addr)
 	default:
 		return nil
 	}
@@ -0,0 +1,316 @@
+package middleware
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/netip"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/hostsfile"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/AdguardTeam/golibs/timeutil"
+)
+
+// leasesCheckInterval is the minimum interval between the checks of the lease
+// file for changes.
+const leasesCheckInterval = 5 * time.Second
+
+// LeaseStorageConfig is the configuration for [LeaseStorage].
+type LeaseStorageConfig struct {
+	// Logger is used to log the errors of reading the lease file.  It must not
+	// be nil.
+	Logger *slog.Logger
+
+	// Clock is used to check the lease expiration and the time of the last
+	// check.  If nil, [timeutil.SystemClock] is used.
+	Clock timeutil.Clock
+
+	// Path is the path to the dnsmasq or ISC DHCP server lease file.  The
+	// format is detected automatically.
+	Path string
+
+	// Domain, if not empty, is the domain name of the local network.  The
+	// hostnames from the leases are resolved both with and without it.
+	Domain string
+}
+
+// LeaseStorage is a [hostsfile.Storage] with the hostnames of the clients from
+// a DHCP lease file.  The file is read again when it changes.
+type LeaseStorage struct {
+	logger *slog.Logger
+	clock  timeutil.Clock
+
+	// mu protects the fields below.
+	mu        *sync.Mutex
+	byName    map[string][]netip.Addr
+	byAddr    map[netip.Addr][]string
+	modTime   time.Time
+	lastCheck time.Time
+	size      int64
+
+	path   string
+	domain string
+}
+
+// NewLeaseStorage returns a new properly initialized *LeaseStorage.  It reads
+// the lease file for the first time.  c must not be nil.
+func NewLeaseStorage(c *LeaseStorageConfig) (s *LeaseStorage, err error) {
+	s = &LeaseStorage{
+		logger: c.Logger,
+		clock:  cmp.Or[timeutil.Clock](c.Clock, timeutil.SystemClock{}),
+		mu:     &sync.Mutex{},
+		byName: map[string][]netip.Addr{},
+		byAddr: map[netip.Addr][]string{},
+		path:   c.Path,
+		domain: strings.ToLower(strings.Trim(c.Domain, ".")),
+	}
+
+	s.lastCheck = s.clock.Now()
+	err = s.reload()
+	if err != nil {
+		return nil, fmt.Errorf("reading lease file: %w", err)
+	}
+
+	return s, nil
+}
+
+// type check
+var _ hostsfile.Storage = (*LeaseStorage)(nil)
+
+// ByAddr implements the [hostsfile.Storage] interface for *LeaseStorage.
+func (s *LeaseStorage) ByAddr(addr netip.Addr) (names []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.refresh()
+
+	return slices.Clone(s.byAddr[addr])
+}
+
+// ByName implements the [hostsfile.Storage] interface for *LeaseStorage.
+func (s *LeaseStorage) ByName(name string) (addrs []netip.Addr) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.refresh()
+
+	return slices.Clone(s.byName[strings.ToLower(name)])
+}
+
+// refresh reads the lease file again if it has changed since the last read.
+// s.mu must be locked.
+func (s *LeaseStorage) refresh() {
+	now := s.clock.Now()
+	if now.Sub(s.lastCheck) < leasesCheckInterval {
+		return
+	}
+
+	s.lastCheck = now
+
+	fi, err := os.Stat(s.path)
+	if err != nil {
+		s.logger.Warn("checking lease file", "path", s.path, slogutil.KeyError, err)
+
+		return
+	}
+
+	if fi.ModTime().Equal(s.modTime) && fi.Size() == s.size {
+		return
+	}
+
+	err = s.reload()
+	if err != nil {
+		s.logger.Warn("reading lease file", "path", s.path, slogutil.KeyError, err)
+	}
+}
+
+// reload reads and parses the lease file.  The previous records are kept in
+// case of an error.  s.mu must be locked, unless s is being initialized.
+func (s *LeaseStorage) reload() (err error) {
+	// #nosec G304 -- Trust the file path from the configuration file.
+	f, err := os.Open(s.path)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return err
+	}
+
+	defer func() { err = errors.WithDeferred(err, f.Close()) }()
+
+	fi, err := f.Stat()
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return err
+	}
+
+	data, err := io.ReadAll(f)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return err
+	}
+
+	var leases []*lease
+	if isISCLeases(data) {
+		leases, err = parseISCLeases(data)
+	} else {
+		leases, err = parseDnsmasqLeases(data, s.clock.Now())
+	}
+	if err != nil {
+		return fmt.Errorf("parsing %q: %w", s.path, err)
+	}
+
+	byName := map[string][]netip.Addr{}
+	byAddr := map[netip.Addr][]string{}
+	for _, l := range leases {
+		names := []string{l.hostname}
+		if s.domain != "" {
+			names = append(names, l.hostname+"."+s.domain)
+		}
+
+		for _, name := range names {
+			byName[name] = append(byName[name], l.addr)
+		}
+
+		// Prefer the qualified name for PTR.
+		byAddr[l.addr] = []string{names[len(names)-1]}
+	}
+
+	s.byName, s.byAddr = byName, byAddr
+	s.modTime, s.size = fi.ModTime(), fi.Size()
+
+	return nil
+}
+
+// lease is a single DHCP lease with a hostname.
+type lease struct {
+	hostname string
+	addr     netip.Addr
+}
+
+// parseDnsmasqLeases parses the dnsmasq lease file.  Each line has the format
+// of "<expiry> <mac|iaid> <ip> <hostname|*> <client-id|*>".  Expired leases
+// and leases without hostnames are skipped.
+func parseDnsmasqLeases(data []byte, now time.Time) (leases []*lease, err error) {
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for lineNum := 1; s.Scan(); lineNum++ {
+		fields := strings.Fields(s.Text())
+		if len(fields) == 0 || fields[0] == "duid" {
+			continue
+		} else if len(fields) < 4 {
+			return nil, fmt.Errorf("line %d: want at least 4 fields, got %d", lineNum, len(fields))
+		}
+
+		exp, pErr := strconv.ParseInt(fields[0], 10, 64)
+		if pErr != nil {
+			return nil, fmt.Errorf("line %d: expiry: %w", lineNum, pErr)
+		}
+
+		if exp != 0 && time.Unix(exp, 0).Before(now) {
+			continue
+		}
+
+		addr, pErr := netip.ParseAddr(fields[2])
+		if pErr != nil {
+			return nil, fmt.Errorf("line %d: address: %w", lineNum, pErr)
+		}
+
+		if l := newLease(fields[3], addr); l != nil {
+			leases = append(leases, l)
+		}
+	}
+
+	return leases, s.Err()
+}
+
+// isISCLeases returns true if data looks like the ISC DHCP server lease file.
+func isISCLeases(data []byte) (ok bool) {
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if strings.HasPrefix(line, "lease ") && strings.HasSuffix(line, "{") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseISCLeases parses the ISC DHCP server lease file.  Only active leases
+// with the client hostnames are returned.  As the file is a log, the latest
+// lease for an address takes precedence.
+func parseISCLeases(data []byte) (leases []*lease, err error) {
+	byAddr := map[netip.Addr]*lease{}
+	var order []netip.Addr
+
+	var (
+		cur    netip.Addr
+		name   string
+		active bool
+	)
+
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for lineNum := 1; s.Scan(); lineNum++ {
+		line := strings.TrimSpace(s.Text())
+		switch {
+		case strings.HasPrefix(line, "lease ") && strings.HasSuffix(line, "{"):
+			addrStr := strings.TrimSpace(strings.TrimSuffix(strings.TrimPrefix(line, "lease "), "{"))
+			cur, err = netip.ParseAddr(addrStr)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: address: %w", lineNum, err)
+			}
+
+			name, active = "", false
+		case !cur.IsValid():
+			// Skip the statements outside of the lease declarations.
+		case strings.HasPrefix(line, "binding state "):
+			active = strings.TrimSuffix(strings.TrimPrefix(line, "binding state "), ";") == "active"
+		case strings.HasPrefix(line, "client-hostname "):
+			name = strings.Trim(strings.TrimPrefix(line, "client-hostname "), `";`)
+		case line == "}":
+			if _, ok := byAddr[cur]; !ok {
+				order = append(order, cur)
+			}
+
+			byAddr[cur] = nil
+			if active {
+				byAddr[cur] = newLease(name, cur)
+			}
+
+			cur = netip.Addr{}
+		}
+	}
+
+	for _, addr := range order {
+		if l := byAddr[addr]; l != nil {
+			leases = append(leases, l)
+		}
+	}
+
+	return leases, s.Err()
+}
+
+// newLease returns a new *lease with the normalized hostname, or nil if
+// hostname is empty, isn't known, or isn't a single valid hostname label.  The
+// hostnames are chosen by the clients, so the ones with several labels are
+// dropped to prevent them from spoofing the names outside of the local domain.
+func newLease(hostname string, addr netip.Addr) (l *lease) {
+	hostname = strings.ToLower(strings.TrimSuffix(hostname, "."))
+	if hostname == "" || hostname == "*" || netutil.ValidateHostnameLabel(hostname) != nil {
+		return nil
+	}
+
+	return &lease{
+		hostname: hostname,
+		addr:     addr,
+	}
+}
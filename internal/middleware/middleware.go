@@ -3,11 +3,13 @@
 package middleware
 
 import (
+	"cmp"
 	"context"
 	"log/slog"
 
 	"github.com/AdguardTeam/dnsproxy/proxy"
 	"github.com/AdguardTeam/golibs/hostsfile"
+	"github.com/AdguardTeam/golibs/timeutil"
 )
 
 // Config is the configuration for [Default].
@@ -16,12 +18,40 @@ type Config struct {
 	// must not be nil.
 	HostsFiles hostsfile.Storage
 
+	// Leases contains the hostnames of the clients from the DHCP leases, see
+	// [LeaseStorage].  If nil, the queries aren't resolved from the leases.
+	Leases hostsfile.Storage
+
 	// Logger is the logger.  It must not be nil.
 	Logger *slog.Logger
 
 	// MessageConstructor constructs DNS messages.  It must not be nil.
 	MessageConstructor proxy.MessageConstructor
 
+	// Clock is used to check the schedules of Policies.  If nil,
+	// [timeutil.SystemClock] is used.
+	Clock timeutil.Clock
+
+	// Policies are the client policies with built-in safe search and service
+	// blocking rules.  The first policy matching the client's address is
+	// applied.  All policies must be valid, see [Policy.Validate].
+	Policies []*Policy
+
+	// AAAASuppression, if not nil, is the configuration of the suppression of
+	// the AAAA answers for some clients or domain names.  Only the answers of
+	// the wrapped handler are suppressed.
+	AAAASuppression *AAAASuppressionConfig
+
+	// ServiceBinding, if not nil, is the configuration of publishing the SVCB
+	// and HTTPS records advertising the encrypted endpoints of the proxy.  Its
+	// Name must be a valid domain name.
+	ServiceBinding *ServiceBindingConfig
+
+	// BlockCanaryDomains makes the handler reply with NXDOMAIN to the requests
+	// for the canary domains of browsers and operating systems, so that those
+	// don't switch to their own encrypted resolvers.
+	BlockCanaryDomains bool
+
 	// HaltIPv6 halts the processing of AAAA requests and makes the handler
 	// reply with NODATA to them, if true.
 	HaltIPv6 bool
@@ -30,10 +60,18 @@ type Config struct {
 // Default implements [proxy.Middleware] with default DNS request handling
 // logic.
 type Default struct {
+	clock    timeutil.Clock
 	hosts    hostsfile.Storage
+	leases   hostsfile.Storage
 	logger   *slog.Logger
 	messages messageConstructor
-	haltIPv6 bool
+	policies []*policy
+
+	aaaaSuppression *aaaaSuppression
+	serviceBinding  *serviceBinding
+
+	blockCanaryDomains bool
+	haltIPv6           bool
 }
 
 // New creates a new [*Default].
@@ -45,11 +83,24 @@ func New(conf *Config) (mw *Default) {
 		}
 	}
 
+	policies := make([]*policy, 0, len(conf.Policies))
+	for _, p := range conf.Policies {
+		policies = append(policies, newPolicy(p))
+	}
+
 	return &Default{
+		clock:    cmp.Or[timeutil.Clock](conf.Clock, timeutil.SystemClock{}),
 		hosts:    conf.HostsFiles,
+		leases:   cmp.Or[hostsfile.Storage](conf.Leases, emptyStorage{}),
 		logger:   conf.Logger,
 		messages: mc,
-		haltIPv6: conf.HaltIPv6,
+		policies: policies,
+
+		aaaaSuppression: newAAAASuppression(conf.AAAASuppression),
+		serviceBinding:  newServiceBinding(conf.ServiceBinding),
+
+		blockCanaryDomains: conf.BlockCanaryDomains,
+		haltIPv6:           conf.HaltIPv6,
 	}
 }
 
@@ -63,14 +114,50 @@ func (mw *Default) Wrap(h proxy.Handler) (wrapped proxy.Handler) {
 	f := func(ctx context.Context, p *proxy.Proxy, proxyCtx *proxy.DNSContext) (err error) {
 		mw.logger.DebugContext(ctx, "handling request", "req", &proxyCtx.Req.Question[0])
 
+		if proxyCtx.Res = mw.answerServiceBinding(ctx, proxyCtx.Req); proxyCtx.Res != nil {
+			proxyCtx.Trace.AddStep("service_binding", mw.clock.Now())
+
+			return nil
+		}
+
+		if proxyCtx.Res = mw.blockCanary(ctx, proxyCtx.Req); proxyCtx.Res != nil {
+			proxyCtx.Trace.AddStep("canary", mw.clock.Now())
+
+			return nil
+		}
+
 		if proxyCtx.Res = mw.haltAAAA(ctx, proxyCtx.Req); proxyCtx.Res != nil {
+			proxyCtx.Trace.AddStep("halt_aaaa", mw.clock.Now())
+
 			return nil
 		}
 
 		if proxyCtx.Res = mw.resolveFromHosts(ctx, proxyCtx.Req); proxyCtx.Res != nil {
+			proxyCtx.Trace.AddStep("hosts", mw.clock.Now())
+
 			return nil
 		}
 
+		if proxyCtx.Res = mw.resolveFromLeases(ctx, proxyCtx.Req); proxyCtx.Res != nil {
+			proxyCtx.Trace.AddStep("leases", mw.clock.Now())
+
+			return nil
+		}
+
+		handled, err := mw.applyPolicy(ctx, h, p, proxyCtx)
+		if handled {
+			// Don't wrap the error since it's informative enough as is.
+			return err
+		}
+
+		// Only suppress the answers of the upstreams and the cache, since the
+		// local records are configured explicitly.
+		handled, err = mw.suppressAAAA(ctx, h, p, proxyCtx)
+		if handled {
+			// Don't wrap the error since it's informative enough as is.
+			return err
+		}
+
 		return h.ServeDNS(ctx, p, proxyCtx)
 	}
 
@@ -1,20 +1,26 @@
 package middleware
 
 import (
+	"context"
+	"io"
 	"net"
 	"net/netip"
 	"os"
 	"path"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/AdguardTeam/dnsproxy/internal/dnsmsg"
 	"github.com/AdguardTeam/dnsproxy/internal/dnsproxytest"
+	"github.com/AdguardTeam/dnsproxy/proxy"
 	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/hostsfile"
 	"github.com/AdguardTeam/golibs/logutil/slogutil"
 	"github.com/AdguardTeam/golibs/netutil"
 	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/AdguardTeam/golibs/testutil/faketime"
 	"github.com/miekg/dns"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -80,6 +86,240 @@ func TestDefault_haltAAAA(t *testing.T) {
 	})
 }
 
+func TestDefault_blockCanary(t *testing.T) {
+	t.Parallel()
+
+	mw := New(&Config{
+		Logger:             testLogger,
+		MessageConstructor: dnsmsg.DefaultMessageConstructor{},
+		BlockCanaryDomains: true,
+	})
+
+	testCases := []struct {
+		name      string
+		qname     string
+		wantBlock bool
+	}{{
+		name:      "firefox",
+		qname:     "use-application-dns.net.",
+		wantBlock: true,
+	}, {
+		name:      "icloud",
+		qname:     "Mask.iCloud.com.",
+		wantBlock: true,
+	}, {
+		name:      "ddr",
+		qname:     "_dns.resolver.arpa.",
+		wantBlock: true,
+	}, {
+		name:      "subdomain",
+		qname:     "sub.use-application-dns.net.",
+		wantBlock: false,
+	}, {
+		name:      "other",
+		qname:     "domain.example.",
+		wantBlock: false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			req := (&dns.Msg{}).SetQuestion(tc.qname, dns.TypeA)
+			ctx := testutil.ContextWithTimeout(t, defaultTimeout)
+
+			resp := mw.blockCanary(ctx, req)
+			if !tc.wantBlock {
+				assert.Nil(t, resp)
+
+				return
+			}
+
+			require.NotNil(t, resp)
+			assert.Equal(t, dns.RcodeNameError, resp.Rcode)
+		})
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		t.Parallel()
+
+		disabled := New(&Config{
+			Logger:             testLogger,
+			MessageConstructor: dnsmsg.DefaultMessageConstructor{},
+		})
+
+		req := (&dns.Msg{}).SetQuestion("use-application-dns.net.", dns.TypeA)
+		ctx := testutil.ContextWithTimeout(t, defaultTimeout)
+
+		assert.Nil(t, disabled.blockCanary(ctx, req))
+	})
+}
+
+func TestDefault_answerServiceBinding(t *testing.T) {
+	t.Parallel()
+
+	mw := New(&Config{
+		Logger:             testLogger,
+		MessageConstructor: dnsmsg.DefaultMessageConstructor{},
+		ServiceBinding: &ServiceBindingConfig{
+			Name:      "DNS.Example",
+			Hints:     []netip.Addr{netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("2001:db8::1")},
+			HTTPSPort: 443,
+			TLSPort:   853,
+			QUICPort:  8853,
+			HTTP3:     true,
+		},
+		BlockCanaryDomains: true,
+	})
+
+	testCases := []struct {
+		name      string
+		qname     string
+		wantTypes []uint16
+		qtype     uint16
+		wantNil   bool
+	}{{
+		name:      "ddr",
+		qname:     "_dns.resolver.arpa.",
+		wantTypes: []uint16{dns.TypeSVCB, dns.TypeSVCB, dns.TypeSVCB},
+		qtype:     dns.TypeSVCB,
+		wantNil:   false,
+	}, {
+		name:      "ddr_a",
+		qname:     "_dns.resolver.arpa.",
+		wantTypes: nil,
+		qtype:     dns.TypeA,
+		wantNil:   false,
+	}, {
+		name:      "service",
+		qname:     "_dns.dns.example.",
+		wantTypes: []uint16{dns.TypeSVCB, dns.TypeSVCB, dns.TypeSVCB},
+		qtype:     dns.TypeSVCB,
+		wantNil:   false,
+	}, {
+		name:      "https",
+		qname:     "dns.example.",
+		wantTypes: []uint16{dns.TypeHTTPS},
+		qtype:     dns.TypeHTTPS,
+		wantNil:   false,
+	}, {
+		name:      "hints",
+		qname:     "dns.example.",
+		wantTypes: []uint16{dns.TypeAAAA},
+		qtype:     dns.TypeAAAA,
+		wantNil:   false,
+	}, {
+		name:      "name_other_type",
+		qname:     "dns.example.",
+		wantTypes: nil,
+		qtype:     dns.TypeTXT,
+		wantNil:   true,
+	}, {
+		name:      "other",
+		qname:     "domain.example.",
+		wantTypes: nil,
+		qtype:     dns.TypeSVCB,
+		wantNil:   true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			req := (&dns.Msg{}).SetQuestion(tc.qname, tc.qtype)
+			ctx := testutil.ContextWithTimeout(t, defaultTimeout)
+
+			resp := mw.answerServiceBinding(ctx, req)
+			if tc.wantNil {
+				assert.Nil(t, resp)
+
+				return
+			}
+
+			require.NotNil(t, resp)
+			assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+
+			var types []uint16
+			for _, rr := range resp.Answer {
+				assert.Equal(t, tc.qname, rr.Header().Name)
+				types = append(types, rr.Header().Rrtype)
+			}
+
+			assert.Equal(t, tc.wantTypes, types)
+		})
+	}
+
+	t.Run("endpoints", func(t *testing.T) {
+		t.Parallel()
+
+		req := (&dns.Msg{}).SetQuestion("_dns.resolver.arpa.", dns.TypeSVCB)
+		ctx := testutil.ContextWithTimeout(t, defaultTimeout)
+
+		resp := mw.answerServiceBinding(ctx, req)
+		require.NotNil(t, resp)
+		require.Len(t, resp.Answer, 3)
+
+		doh := testutil.RequireTypeAssert[*dns.SVCB](t, resp.Answer[0])
+		assert.Equal(t, uint16(1), doh.Priority)
+		assert.Equal(t, "dns.example.", doh.Target)
+		assert.Equal(
+			t,
+			`alpn="h2,h3" ipv4hint="192.0.2.1" ipv6hint="2001:db8::1" dohpath="/dns-query{?dns}"`,
+			svcbValues(doh),
+		)
+
+		dot := testutil.RequireTypeAssert[*dns.SVCB](t, resp.Answer[1])
+		assert.Equal(t, uint16(2), dot.Priority)
+		assert.Equal(t, `alpn="dot" ipv4hint="192.0.2.1" ipv6hint="2001:db8::1"`, svcbValues(dot))
+
+		doq := testutil.RequireTypeAssert[*dns.SVCB](t, resp.Answer[2])
+		assert.Equal(t, uint16(3), doq.Priority)
+		assert.Equal(
+			t,
+			`alpn="doq" port="8853" ipv4hint="192.0.2.1" ipv6hint="2001:db8::1"`,
+			svcbValues(doq),
+		)
+	})
+
+	t.Run("wrap", func(t *testing.T) {
+		t.Parallel()
+
+		req := (&dns.Msg{}).SetQuestion("_dns.resolver.arpa.", dns.TypeSVCB)
+		dctx := &proxy.DNSContext{Req: req}
+		ctx := testutil.ContextWithTimeout(t, defaultTimeout)
+
+		h := proxy.HandlerFunc(func(
+			_ context.Context,
+			_ *proxy.Proxy,
+			_ *proxy.DNSContext,
+		) (err error) {
+			panic("must not be called")
+		})
+
+		// The service binding takes precedence over the blocking of canary
+		// domains.
+		err := mw.Wrap(h).ServeDNS(ctx, nil, dctx)
+		require.NoError(t, err)
+		require.NotNil(t, dctx.Res)
+
+		assert.Equal(t, dns.RcodeSuccess, dctx.Res.Rcode)
+		assert.Len(t, dctx.Res.Answer, 3)
+	})
+}
+
+// svcbValues returns the presentation format of the parameters of rr.
+func svcbValues(rr *dns.SVCB) (s string) {
+	for i, kv := range rr.Value {
+		if i > 0 {
+			s += " "
+		}
+
+		s += kv.Key().String() + `="` + kv.String() + `"`
+	}
+
+	return s
+}
+
 func TestDefault_resolveFromHosts(t *testing.T) {
 	t.Parallel()
 
@@ -202,3 +442,798 @@ func TestDefault_resolveFromHosts(t *testing.T) {
 		})
 	}
 }
+
+func TestDefault_Wrap_policies(t *testing.T) {
+	t.Parallel()
+
+	const (
+		fqdnGoogle = "www.google.com."
+		fqdnSafe   = "forcesafesearch.google.com."
+		fqdnTikTok = "www.tiktok.com."
+		fqdnOther  = "www.example.com."
+	)
+
+	var (
+		addrRestricted = netip.MustParseAddr("192.0.2.1")
+		addrOther      = netip.MustParseAddr("198.51.100.1")
+		addrSafe       = netip.MustParseAddr("203.0.113.1")
+	)
+
+	pols := []*Policy{{
+		Clients:         []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")},
+		SafeSearch:      []string{"google"},
+		BlockedServices: []string{"tiktok"},
+	}}
+	for _, p := range pols {
+		require.NoError(t, p.Validate())
+	}
+
+	mw := New(&Config{
+		HostsFiles:         emptyStorage{},
+		Logger:             testLogger,
+		MessageConstructor: dnsmsg.DefaultMessageConstructor{},
+		Policies:           pols,
+	})
+
+	var gotName string
+	h := mw.Wrap(proxy.HandlerFunc(func(
+		_ context.Context,
+		_ *proxy.Proxy,
+		dctx *proxy.DNSContext,
+	) (err error) {
+		gotName = dctx.Req.Question[0].Name
+		dctx.Res = (&dns.Msg{}).SetReply(dctx.Req)
+		dctx.Res.Answer = []dns.RR{&dns.A{
+			Hdr: dns.RR_Header{
+				Name:   gotName,
+				Rrtype: dns.TypeA,
+				Class:  dns.ClassINET,
+			},
+			A: addrSafe.AsSlice(),
+		}}
+
+		return nil
+	}))
+
+	testCases := []struct {
+		addr       netip.Addr
+		name       string
+		fqdn       string
+		wantName   string
+		wantRR     []uint16
+		wantReason proxy.RejectReason
+		wantCode   int
+	}{{
+		addr:       addrRestricted,
+		name:       "safe_search",
+		fqdn:       fqdnGoogle,
+		wantName:   fqdnSafe,
+		wantRR:     []uint16{dns.TypeCNAME, dns.TypeA},
+		wantCode:   dns.RcodeSuccess,
+		wantReason: "",
+	}, {
+		addr:       addrRestricted,
+		name:       "blocked",
+		fqdn:       fqdnTikTok,
+		wantName:   "",
+		wantRR:     nil,
+		wantCode:   dns.RcodeNameError,
+		wantReason: proxy.RejectReasonFilter,
+	}, {
+		addr:       addrRestricted,
+		name:       "not_matched_domain",
+		fqdn:       fqdnOther,
+		wantName:   fqdnOther,
+		wantRR:     []uint16{dns.TypeA},
+		wantCode:   dns.RcodeSuccess,
+		wantReason: "",
+	}, {
+		addr:       addrOther,
+		name:       "not_matched_client",
+		fqdn:       fqdnGoogle,
+		wantName:   fqdnGoogle,
+		wantRR:     []uint16{dns.TypeA},
+		wantCode:   dns.RcodeSuccess,
+		wantReason: "",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			gotName = ""
+
+			req := (&dns.Msg{}).SetQuestion(tc.fqdn, dns.TypeA)
+			dctx := &proxy.DNSContext{
+				Req:  req,
+				Addr: netip.AddrPortFrom(tc.addr, 53),
+			}
+
+			ctx := testutil.ContextWithTimeout(t, defaultTimeout)
+			require.NoError(t, h.ServeDNS(ctx, nil, dctx))
+			require.NotNil(t, dctx.Res)
+
+			assert.Equal(t, tc.wantName, gotName)
+			assert.Equal(t, tc.wantCode, dctx.Res.Rcode)
+			assert.Equal(t, tc.wantReason, dctx.RejectReason)
+			assert.Same(t, req, dctx.Req)
+			assert.Equal(t, tc.fqdn, dctx.Res.Question[0].Name)
+
+			var gotRR []uint16
+			for _, rr := range dctx.Res.Answer {
+				gotRR = append(gotRR, rr.Header().Rrtype)
+			}
+
+			assert.Equal(t, tc.wantRR, gotRR)
+		})
+	}
+}
+
+func TestDefault_Wrap_allowedDomains(t *testing.T) {
+	t.Parallel()
+
+	var (
+		addrIoT   = netip.MustParseAddr("192.0.2.1")
+		addrOther = netip.MustParseAddr("198.51.100.1")
+	)
+
+	pol := &Policy{
+		Clients:        []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")},
+		AllowedDomains: []string{"Example.com", "*.iot.example."},
+	}
+	require.NoError(t, pol.Validate())
+
+	mw := New(&Config{
+		HostsFiles:         emptyStorage{},
+		Logger:             testLogger,
+		MessageConstructor: dnsmsg.DefaultMessageConstructor{},
+		Policies:           []*Policy{pol},
+	})
+
+	h := mw.Wrap(proxy.HandlerFunc(func(
+		_ context.Context,
+		_ *proxy.Proxy,
+		dctx *proxy.DNSContext,
+	) (err error) {
+		dctx.Res = (&dns.Msg{}).SetReply(dctx.Req)
+
+		return nil
+	}))
+
+	testCases := []struct {
+		addr       netip.Addr
+		name       string
+		fqdn       string
+		wantReason proxy.RejectReason
+		wantCode   int
+	}{{
+		addr:       addrIoT,
+		name:       "domain",
+		fqdn:       "EXAMPLE.com.",
+		wantCode:   dns.RcodeSuccess,
+		wantReason: "",
+	}, {
+		addr:       addrIoT,
+		name:       "subdomain",
+		fqdn:       "api.example.com.",
+		wantCode:   dns.RcodeSuccess,
+		wantReason: "",
+	}, {
+		addr:       addrIoT,
+		name:       "wildcard_subdomain",
+		fqdn:       "cloud.iot.example.",
+		wantCode:   dns.RcodeSuccess,
+		wantReason: "",
+	}, {
+		addr:       addrIoT,
+		name:       "wildcard_domain",
+		fqdn:       "iot.example.",
+		wantCode:   dns.RcodeNameError,
+		wantReason: proxy.RejectReasonFilter,
+	}, {
+		addr:       addrIoT,
+		name:       "not_allowed",
+		fqdn:       "www.example.org.",
+		wantCode:   dns.RcodeNameError,
+		wantReason: proxy.RejectReasonFilter,
+	}, {
+		addr:       addrIoT,
+		name:       "suffix",
+		fqdn:       "notexample.com.",
+		wantCode:   dns.RcodeNameError,
+		wantReason: proxy.RejectReasonFilter,
+	}, {
+		addr:       addrOther,
+		name:       "other_client",
+		fqdn:       "www.example.org.",
+		wantCode:   dns.RcodeSuccess,
+		wantReason: "",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			dctx := &proxy.DNSContext{
+				Req:  (&dns.Msg{}).SetQuestion(tc.fqdn, dns.TypeA),
+				Addr: netip.AddrPortFrom(tc.addr, 53),
+			}
+
+			ctx := testutil.ContextWithTimeout(t, defaultTimeout)
+			require.NoError(t, h.ServeDNS(ctx, nil, dctx))
+			require.NotNil(t, dctx.Res)
+
+			assert.Equal(t, tc.wantCode, dctx.Res.Rcode)
+			assert.Equal(t, tc.wantReason, dctx.RejectReason)
+		})
+	}
+}
+
+func TestPolicy_Validate(t *testing.T) {
+	t.Parallel()
+
+	assert.NoError(t, (&Policy{
+		SafeSearch:      SafeSearchServices(),
+		BlockedServices: BlockedServices(),
+	}).Validate())
+
+	err := (&Policy{
+		SafeSearch:      []string{"unknown"},
+		BlockedServices: []string{"unknown"},
+		AllowedDomains:  []string{"*.example.com", "*.", "bad domain"},
+	}).Validate()
+	testutil.AssertErrorMsg(
+		t,
+		"safe search: unknown service \"unknown\"\n"+
+			"blocked services: unknown service \"unknown\"\n"+
+			"allowed domains: pattern \"*.\": bad domain name \"\": domain name is empty\n"+
+			"allowed domains: pattern \"bad domain\": bad domain name \"bad domain\": "+
+			"bad top-level domain name label \"bad domain\": "+
+			"bad top-level domain name label rune ' '",
+		err,
+	)
+
+	err = (&Policy{
+		QueryTypes: map[uint16]QueryAction{
+			dns.TypeTXT:   "bad",
+			dns.TypeA:     "bad",
+			dns.TypeHTTPS: QueryActionDrop,
+			dns.TypeMX:    "bad",
+		},
+		QueryClasses: map[uint16]QueryAction{
+			dns.ClassCHAOS: "bad",
+			dns.ClassANY:   "bad",
+		},
+	}).Validate()
+	testutil.AssertErrorMsg(
+		t,
+		"query types: A: bad enum value: \"bad\"\n"+
+			"query types: MX: bad enum value: \"bad\"\n"+
+			"query types: TXT: bad enum value: \"bad\"\n"+
+			"query classes: CH: bad enum value: \"bad\"\n"+
+			"query classes: CLASS255: bad enum value: \"bad\"",
+		err,
+	)
+}
+
+func TestPolicy_tlsFingerprints(t *testing.T) {
+	t.Parallel()
+
+	const (
+		ja3 = "e7d705a3286e19ea42f587b344ee6865"
+		ja4 = "t13d1516h2_8daaf6152771_02713d6af862"
+	)
+
+	p := &Policy{
+		TLSFingerprints: []string{ja3, "q13d0310h3_55b375c5d22e_cd85d2d88918"},
+	}
+	require.NoError(t, p.Validate())
+
+	err := (&Policy{TLSFingerprints: []string{"", "t13d1516h2"}}).Validate()
+	testutil.AssertErrorMsg(
+		t,
+		"tls fingerprints: \"\": empty value\n"+
+			"tls fingerprints: \"t13d1516h2\": not a ja3 or ja4 fingerprint",
+		err,
+	)
+
+	pol := newPolicy(p)
+	addr := netip.MustParseAddr("192.0.2.1")
+	now := time.Now()
+
+	testCases := []struct {
+		fp   *proxy.TLSFingerprint
+		want assert.BoolAssertionFunc
+		name string
+	}{{
+		fp:   &proxy.TLSFingerprint{JA3: ja3, JA4: ja4},
+		want: assert.True,
+		name: "ja3",
+	}, {
+		fp:   &proxy.TLSFingerprint{JA3: "00000000000000000000000000000000", JA4: ja4},
+		want: assert.False,
+		name: "other",
+	}, {
+		fp:   nil,
+		want: assert.False,
+		name: "plain",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			tc.want(t, pol.matches(addr, tc.fp, now))
+		})
+	}
+}
+
+func TestSchedule_Contains(t *testing.T) {
+	t.Parallel()
+
+	workHours := &Schedule{
+		Location: time.UTC,
+		Days: []time.Weekday{
+			time.Monday,
+			time.Tuesday,
+			time.Wednesday,
+			time.Thursday,
+			time.Friday,
+		},
+		Start: 9 * time.Hour,
+		End:   17 * time.Hour,
+	}
+	require.NoError(t, workHours.Validate())
+
+	nights := &Schedule{
+		Location: time.UTC,
+		Days:     []time.Weekday{time.Friday},
+		Start:    22 * time.Hour,
+		End:      6 * time.Hour,
+	}
+	require.NoError(t, nights.Validate())
+
+	// 2024-01-05 is a Friday.
+	at := func(d, h, m int) (t time.Time) {
+		return time.Date(2024, time.January, d, h, m, 0, 0, time.UTC)
+	}
+
+	testCases := []struct {
+		sched *Schedule
+		now   time.Time
+		name  string
+		want  assert.BoolAssertionFunc
+	}{{
+		sched: workHours,
+		now:   at(5, 9, 0),
+		name:  "work_start",
+		want:  assert.True,
+	}, {
+		sched: workHours,
+		now:   at(5, 16, 59),
+		name:  "work_end",
+		want:  assert.True,
+	}, {
+		sched: workHours,
+		now:   at(5, 17, 0),
+		name:  "work_after",
+		want:  assert.False,
+	}, {
+		sched: workHours,
+		now:   at(6, 12, 0),
+		name:  "work_weekend",
+		want:  assert.False,
+	}, {
+		sched: nights,
+		now:   at(5, 23, 0),
+		name:  "night_start_day",
+		want:  assert.True,
+	}, {
+		sched: nights,
+		now:   at(6, 5, 59),
+		name:  "night_next_day",
+		want:  assert.True,
+	}, {
+		sched: nights,
+		now:   at(6, 23, 0),
+		name:  "night_other_day",
+		want:  assert.False,
+	}, {
+		sched: nights,
+		now:   at(5, 5, 0),
+		name:  "night_before",
+		want:  assert.False,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			tc.want(t, tc.sched.Contains(tc.now))
+		})
+	}
+}
+
+func TestLeaseStorage(t *testing.T) {
+	t.Parallel()
+
+	var (
+		addrLaptop = netip.MustParseAddr("192.168.1.10")
+		addrPhone  = netip.MustParseAddr("192.168.1.11")
+		addrGone   = netip.MustParseAddr("192.168.1.12")
+	)
+
+	for _, file := range []string{"dnsmasq.leases", "dhcpd.leases"} {
+		t.Run(file, func(t *testing.T) {
+			t.Parallel()
+
+			strg, err := NewLeaseStorage(&LeaseStorageConfig{
+				Logger: testLogger,
+				Path:   filepath.Join("testdata", "TestLeaseStorage", file),
+				Domain: "lan",
+			})
+			require.NoError(t, err)
+
+			assert.Contains(t, strg.ByName("laptop"), addrLaptop)
+			assert.Contains(t, strg.ByName("laptop.lan"), addrLaptop)
+			assert.Equal(t, []netip.Addr{addrPhone}, strg.ByName("PHONE"))
+			assert.Empty(t, strg.ByName("expired"))
+
+			assert.Equal(t, []string{"laptop.lan"}, strg.ByAddr(addrLaptop))
+			assert.Empty(t, strg.ByAddr(addrGone))
+		})
+	}
+}
+
+func TestLeaseStorage_invalidHostnames(t *testing.T) {
+	t.Parallel()
+
+	addr := netip.MustParseAddr("192.168.1.10")
+
+	testCases := []struct {
+		name     string
+		data     string
+		wantName string
+	}{{
+		name:     "dnsmasq_fqdn",
+		data:     "0 00:11:22:33:44:55 192.168.1.10 www.bank.com *\n",
+		wantName: "www.bank.com",
+	}, {
+		name:     "dnsmasq_bad_label",
+		data:     "0 00:11:22:33:44:55 192.168.1.10 bad_name *\n",
+		wantName: "bad_name",
+	}, {
+		name: "isc_fqdn",
+		data: "lease 192.168.1.10 {\n" +
+			"  binding state active;\n" +
+			"  client-hostname \"www.bank.com\";\n" +
+			"}\n",
+		wantName: "www.bank.com",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			leasesPath := filepath.Join(t.TempDir(), "leases")
+			err := os.WriteFile(leasesPath, []byte(tc.data), 0o600)
+			require.NoError(t, err)
+
+			strg, err := NewLeaseStorage(&LeaseStorageConfig{
+				Logger: testLogger,
+				Path:   leasesPath,
+				Domain: "lan",
+			})
+			require.NoError(t, err)
+
+			assert.Empty(t, strg.ByName(tc.wantName))
+			assert.Empty(t, strg.ByName(tc.wantName+".lan"))
+			assert.Empty(t, strg.ByAddr(addr))
+		})
+	}
+}
+
+func TestLeaseStorage_refresh(t *testing.T) {
+	t.Parallel()
+
+	leasesPath := filepath.Join(t.TempDir(), "dnsmasq.leases")
+	err := os.WriteFile(leasesPath, []byte("0 00:11:22:33:44:55 192.168.1.10 laptop *\n"), 0o600)
+	require.NoError(t, err)
+
+	now := time.Now()
+	clock := &faketime.Clock{
+		OnNow: func() (n time.Time) { return now },
+	}
+
+	strg, err := NewLeaseStorage(&LeaseStorageConfig{
+		Logger: testLogger,
+		Clock:  clock,
+		Path:   leasesPath,
+	})
+	require.NoError(t, err)
+
+	addr := netip.MustParseAddr("192.168.1.10")
+	require.Equal(t, []netip.Addr{addr}, strg.ByName("laptop"))
+
+	err = os.WriteFile(leasesPath, []byte("0 00:11:22:33:44:55 192.168.1.10 desktop *\n"), 0o600)
+	require.NoError(t, err)
+
+	assert.Equal(t, []netip.Addr{addr}, strg.ByName("laptop"))
+
+	now = now.Add(leasesCheckInterval)
+
+	assert.Empty(t, strg.ByName("laptop"))
+	assert.Equal(t, []netip.Addr{addr}, strg.ByName("desktop"))
+}
+
+func TestDefault_Wrap_queryActions(t *testing.T) {
+	t.Parallel()
+
+	pols := []*Policy{{
+		QueryTypes: map[uint16]QueryAction{
+			dns.TypeANY:   QueryActionRefuse,
+			dns.TypeHTTPS: QueryActionNODATA,
+			65535:         QueryActionDrop,
+		},
+		QueryClasses: map[uint16]QueryAction{
+			dns.ClassCHAOS: QueryActionNXDOMAIN,
+		},
+	}}
+	require.NoError(t, pols[0].Validate())
+
+	mw := New(&Config{
+		HostsFiles:         emptyStorage{},
+		Logger:             testLogger,
+		MessageConstructor: dnsmsg.DefaultMessageConstructor{},
+		Policies:           pols,
+	})
+
+	h := mw.Wrap(proxy.HandlerFunc(func(
+		_ context.Context,
+		_ *proxy.Proxy,
+		dctx *proxy.DNSContext,
+	) (err error) {
+		dctx.Res = (&dns.Msg{}).SetReply(dctx.Req)
+
+		return nil
+	}))
+
+	testCases := []struct {
+		wantErr    error
+		name       string
+		wantReason proxy.RejectReason
+		qtype      uint16
+		qclass     uint16
+		wantRcode  int
+	}{{
+		wantErr:    nil,
+		wantReason: "",
+		name:       "pass",
+		qtype:      dns.TypeA,
+		qclass:     dns.ClassINET,
+		wantRcode:  dns.RcodeSuccess,
+	}, {
+		wantErr:    nil,
+		wantReason: proxy.RejectReasonFilter,
+		name:       "refuse",
+		qtype:      dns.TypeANY,
+		qclass:     dns.ClassINET,
+		wantRcode:  dns.RcodeRefused,
+	}, {
+		wantErr:    nil,
+		wantReason: "",
+		name:       "nodata",
+		qtype:      dns.TypeHTTPS,
+		qclass:     dns.ClassINET,
+		wantRcode:  dns.RcodeSuccess,
+	}, {
+		wantErr:    proxy.ErrDrop,
+		wantReason: proxy.RejectReasonFilter,
+		name:       "drop",
+		qtype:      65535,
+		qclass:     dns.ClassINET,
+		wantRcode:  0,
+	}, {
+		wantErr:    nil,
+		wantReason: "",
+		name:       "qclass",
+		qtype:      dns.TypeTXT,
+		qclass:     dns.ClassCHAOS,
+		wantRcode:  dns.RcodeNameError,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			req := (&dns.Msg{}).SetQuestion("example.com.", tc.qtype)
+			req.Question[0].Qclass = tc.qclass
+
+			dctx := &proxy.DNSContext{Req: req}
+			ctx := testutil.ContextWithTimeout(t, defaultTimeout)
+
+			err := h.ServeDNS(ctx, nil, dctx)
+			assert.Equal(t, tc.wantReason, dctx.RejectReason)
+
+			if tc.wantErr != nil {
+				assert.ErrorIs(t, err, tc.wantErr)
+
+				return
+			}
+
+			require.NoError(t, err)
+			require.NotNil(t, dctx.Res)
+
+			assert.Equal(t, tc.wantRcode, dctx.Res.Rcode)
+		})
+	}
+}
+
+func TestDefault_Wrap_aaaaSuppression(t *testing.T) {
+	t.Parallel()
+
+	// upstream answers with an A record only for a.example and with AAAA
+	// records for all names.
+	upstream := proxy.HandlerFunc(func(
+		_ context.Context,
+		_ *proxy.Proxy,
+		dctx *proxy.DNSContext,
+	) (err error) {
+		resp := (&dns.Msg{}).SetReply(dctx.Req)
+		q := dctx.Req.Question[0]
+		switch {
+		case q.Qtype == dns.TypeAAAA:
+			resp.Answer = append(resp.Answer, &dns.AAAA{
+				Hdr:  hdr(q.Name, dns.TypeAAAA),
+				AAAA: net.IPv6loopback,
+			})
+		case q.Qtype == dns.TypeA && q.Name == "a.example.":
+			resp.Answer = append(resp.Answer, &dns.A{
+				Hdr: hdr(q.Name, dns.TypeA),
+				A:   net.IPv4(1, 2, 3, 4),
+			})
+		}
+
+		dctx.Res = resp
+
+		return nil
+	})
+
+	testCases := []struct {
+		conf       *AAAASuppressionConfig
+		name       string
+		qname      string
+		addr       netip.AddrPort
+		wantAnswer bool
+	}{{
+		conf:       nil,
+		name:       "disabled",
+		qname:      "a.example.",
+		addr:       netip.MustParseAddrPort("192.0.2.1:53"),
+		wantAnswer: true,
+	}, {
+		conf:       &AAAASuppressionConfig{},
+		name:       "always",
+		qname:      "aaaa.example.",
+		addr:       netip.MustParseAddrPort("192.0.2.1:53"),
+		wantAnswer: false,
+	}, {
+		conf:       &AAAASuppressionConfig{OnlyWithA: true},
+		name:       "with_a",
+		qname:      "a.example.",
+		addr:       netip.MustParseAddrPort("192.0.2.1:53"),
+		wantAnswer: false,
+	}, {
+		conf:       &AAAASuppressionConfig{OnlyWithA: true},
+		name:       "without_a",
+		qname:      "aaaa.example.",
+		addr:       netip.MustParseAddrPort("192.0.2.1:53"),
+		wantAnswer: true,
+	}, {
+		conf:       &AAAASuppressionConfig{Domains: []string{"example"}},
+		name:       "domain_match",
+		qname:      "sub.a.example.",
+		addr:       netip.MustParseAddrPort("192.0.2.1:53"),
+		wantAnswer: false,
+	}, {
+		conf:       &AAAASuppressionConfig{Domains: []string{"example.org"}},
+		name:       "domain_mismatch",
+		qname:      "a.example.",
+		addr:       netip.MustParseAddrPort("192.0.2.1:53"),
+		wantAnswer: true,
+	}, {
+		conf: &AAAASuppressionConfig{
+			Clients: []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")},
+		},
+		name:       "client_match",
+		qname:      "a.example.",
+		addr:       netip.MustParseAddrPort("192.0.2.1:53"),
+		wantAnswer: false,
+	}, {
+		conf: &AAAASuppressionConfig{
+			Clients: []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")},
+		},
+		name:       "client_mismatch",
+		qname:      "a.example.",
+		addr:       netip.MustParseAddrPort("198.51.100.1:53"),
+		wantAnswer: true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			mw := New(&Config{
+				HostsFiles:         emptyStorage{},
+				Logger:             testLogger,
+				MessageConstructor: dnsmsg.DefaultMessageConstructor{},
+				AAAASuppression:    tc.conf,
+			})
+
+			dctx := &proxy.DNSContext{
+				Req:  (&dns.Msg{}).SetQuestion(tc.qname, dns.TypeAAAA),
+				Addr: tc.addr,
+			}
+			ctx := testutil.ContextWithTimeout(t, defaultTimeout)
+
+			err := mw.Wrap(upstream).ServeDNS(ctx, nil, dctx)
+			require.NoError(t, err)
+			require.NotNil(t, dctx.Res)
+
+			assert.Equal(t, dns.RcodeSuccess, dctx.Res.Rcode)
+			assert.Equal(t, tc.wantAnswer, len(dctx.Res.Answer) > 0)
+			assert.Equal(t, dns.TypeAAAA, dctx.Res.Question[0].Qtype)
+		})
+	}
+
+	t.Run("hosts", func(t *testing.T) {
+		t.Parallel()
+
+		ctx := testutil.ContextWithTimeout(t, defaultTimeout)
+		strg, err := hostsfile.NewDefaultStorage(ctx, &hostsfile.DefaultStorageConfig{
+			Logger:  testLogger,
+			Readers: []io.Reader{strings.NewReader("2001:db8::1 hosts.example\n")},
+		})
+		require.NoError(t, err)
+
+		mw := New(&Config{
+			HostsFiles:         strg,
+			Logger:             testLogger,
+			MessageConstructor: dnsmsg.DefaultMessageConstructor{},
+			AAAASuppression:    &AAAASuppressionConfig{},
+		})
+
+		dctx := &proxy.DNSContext{
+			Req:  (&dns.Msg{}).SetQuestion("hosts.example.", dns.TypeAAAA),
+			Addr: netip.MustParseAddrPort("192.0.2.1:53"),
+		}
+
+		err = mw.Wrap(upstream).ServeDNS(ctx, nil, dctx)
+		require.NoError(t, err)
+		require.NotNil(t, dctx.Res)
+		require.Len(t, dctx.Res.Answer, 1)
+
+		aaaa := testutil.RequireTypeAssert[*dns.AAAA](t, dctx.Res.Answer[0])
+		assert.Equal(t, net.ParseIP("2001:db8::1"), aaaa.AAAA)
+	})
+}
+
+func TestParseQueryType(t *testing.T) {
+	t.Parallel()
+
+	qt, err := ParseQueryType("https")
+	require.NoError(t, err)
+	assert.Equal(t, dns.TypeHTTPS, qt)
+
+	qt, err = ParseQueryType("TYPE65535")
+	require.NoError(t, err)
+	assert.Equal(t, uint16(65535), qt)
+
+	_, err = ParseQueryType("TYPE65536")
+	assert.Error(t, err)
+
+	_, err = ParseQueryType("BAD")
+	assert.Error(t, err)
+
+	qc, err := ParseQueryClass("CH")
+	require.NoError(t, err)
+	assert.Equal(t, uint16(dns.ClassCHAOS), qc)
+}
@@ -0,0 +1,351 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"net/netip"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/container"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/miekg/dns"
+)
+
+// Policy is the set of built-in rewriting and blocking rules applied to the
+// requests of some clients.
+type Policy struct {
+	// Clients are the subnets of clients the policy applies to.  If empty, the
+	// policy applies to all clients.
+	Clients []netip.Prefix
+
+	// TLSFingerprints are the JA3 or JA4 fingerprints of the TLS clients the
+	// policy applies to, see [proxy.TLSFingerprint].  If empty, the policy
+	// applies to the clients regardless of their fingerprints.  Otherwise, the
+	// policy never applies to the clients of the unencrypted protocols.
+	TLSFingerprints []string
+
+	// SafeSearch are the names of the services to enforce the safe search for,
+	// e.g. "google" or "youtube".
+	SafeSearch []string
+
+	// BlockedServices are the names of the services to block, e.g. "tiktok".
+	BlockedServices []string
+
+	// AllowedDomains, if not empty, puts the policy into the default-deny
+	// mode: only the requests for the domains matching these patterns are
+	// resolved, and the rest are answered with NXDOMAIN.  A pattern is either
+	// a domain name, e.g. "example.com", matching the domain and its
+	// subdomains, or a domain name prefixed with "*.", e.g. "*.example.com",
+	// matching only the subdomains.
+	AllowedDomains []string
+
+	// QueryTypes are the actions on the requests by their query types.
+	QueryTypes map[uint16]QueryAction
+
+	// QueryClasses are the actions on the requests by their query classes.
+	// The actions of QueryTypes take precedence.
+	QueryClasses map[uint16]QueryAction
+
+	// Schedule, if not nil, is the schedule of the time windows, during which
+	// the policy is active.  If nil, the policy is always active.
+	Schedule *Schedule
+}
+
+// Validate returns an error if p contains unknown service names, invalid domain
+// patterns, unknown query actions, or an invalid schedule.  p must not be nil.
+func (p *Policy) Validate() (err error) {
+	var errs []error
+	for _, name := range p.SafeSearch {
+		if _, ok := safeSearchRules[name]; !ok {
+			errs = append(errs, fmt.Errorf("safe search: unknown service %q", name))
+		}
+	}
+
+	for _, name := range p.BlockedServices {
+		if _, ok := blockedServiceRules[name]; !ok {
+			errs = append(errs, fmt.Errorf("blocked services: unknown service %q", name))
+		}
+	}
+
+	for _, pat := range p.AllowedDomains {
+		if err = validateDomainPattern(pat); err != nil {
+			errs = append(errs, fmt.Errorf("allowed domains: %w", err))
+		}
+	}
+
+	for _, qt := range slices.Sorted(maps.Keys(p.QueryTypes)) {
+		if err = p.QueryTypes[qt].validate(); err != nil {
+			errs = append(errs, fmt.Errorf("query types: %s: %w", dns.Type(qt), err))
+		}
+	}
+
+	for _, qc := range slices.Sorted(maps.Keys(p.QueryClasses)) {
+		if err = p.QueryClasses[qc].validate(); err != nil {
+			errs = append(errs, fmt.Errorf("query classes: %s: %w", dns.Class(qc), err))
+		}
+	}
+
+	for _, fp := range p.TLSFingerprints {
+		if err = validateTLSFingerprint(fp); err != nil {
+			errs = append(errs, fmt.Errorf("tls fingerprints: %q: %w", fp, err))
+		}
+	}
+
+	if p.Schedule != nil {
+		err = p.Schedule.Validate()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("schedule: %w", err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// SafeSearchServices returns the sorted names of services supported by
+// [Policy.SafeSearch].
+func SafeSearchServices() (names []string) {
+	return sortedKeys(safeSearchRules)
+}
+
+// BlockedServices returns the sorted names of services supported by
+// [Policy.BlockedServices].
+func BlockedServices() (names []string) {
+	return sortedKeys(blockedServiceRules)
+}
+
+// sortedKeys returns the sorted keys of m.
+func sortedKeys[V any](m map[string]V) (keys []string) {
+	keys = make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+
+	slices.Sort(keys)
+
+	return keys
+}
+
+// policy is the compiled [Policy].
+type policy struct {
+	// blocked contains the FQDNs of blocked domains.  Subdomains of those are
+	// blocked as well.
+	blocked *container.MapSet[string]
+
+	// allowed matches the domains allowed in the default-deny mode.  It's nil
+	// if the mode is disabled.
+	allowed *allowlist
+
+	// rewrites maps the FQDNs of search engines to their safe search
+	// endpoints.
+	rewrites map[string]string
+
+	// qtypes are the actions on the requests by their query types.
+	qtypes map[uint16]QueryAction
+
+	// qclasses are the actions on the requests by their query classes.
+	qclasses map[uint16]QueryAction
+
+	// schedule is the schedule of the policy, if any.
+	schedule *Schedule
+
+	// clients are the subnets of clients the policy applies to.
+	clients []netip.Prefix
+
+	// fingerprints are the TLS fingerprints of clients the policy applies to.
+	fingerprints []string
+}
+
+// newPolicy compiles p into a *policy.  p must be valid.
+func newPolicy(p *Policy) (pol *policy) {
+	pol = &policy{
+		blocked:      container.NewMapSet[string](),
+		allowed:      newAllowlist(p.AllowedDomains),
+		rewrites:     map[string]string{},
+		qtypes:       maps.Clone(p.QueryTypes),
+		qclasses:     maps.Clone(p.QueryClasses),
+		schedule:     p.Schedule,
+		clients:      slices.Clone(p.Clients),
+		fingerprints: slices.Clone(p.TLSFingerprints),
+	}
+
+	for _, name := range p.SafeSearch {
+		rule := safeSearchRules[name]
+		for _, d := range rule.domains {
+			pol.rewrites[d] = rule.target
+		}
+	}
+
+	for _, name := range p.BlockedServices {
+		for _, d := range blockedServiceRules[name] {
+			pol.blocked.Add(d)
+		}
+	}
+
+	return pol
+}
+
+// matches returns true if pol applies to the client with addr and TLS
+// fingerprint fp at the moment now.  fp may be nil.
+func (pol *policy) matches(addr netip.Addr, fp *proxy.TLSFingerprint, now time.Time) (ok bool) {
+	if pol.schedule != nil && !pol.schedule.Contains(now) {
+		return false
+	}
+
+	if len(pol.fingerprints) > 0 && !slices.ContainsFunc(pol.fingerprints, fp.Matches) {
+		return false
+	}
+
+	if len(pol.clients) == 0 {
+		return true
+	}
+
+	return slices.ContainsFunc(pol.clients, func(p netip.Prefix) (ok bool) {
+		return p.Contains(addr)
+	})
+}
+
+// validateTLSFingerprint returns an error if fp is neither a JA3 nor a JA4
+// fingerprint.
+func validateTLSFingerprint(fp string) (err error) {
+	switch {
+	case fp == "":
+		return errors.ErrEmptyValue
+	case len(fp) == ja3Len && isHex(fp):
+		return nil
+	case len(fp) == ja4Len && fp[ja4ALen] == '_' && fp[ja4ALen+ja4HashLen+1] == '_':
+		if isHex(fp[ja4ALen+1:ja4ALen+1+ja4HashLen]) && isHex(fp[ja4Len-ja4HashLen:]) {
+			return nil
+		}
+	}
+
+	return errors.Error("not a ja3 or ja4 fingerprint")
+}
+
+// Lengths of the fingerprints and their parts.
+const (
+	ja3Len     = 32
+	ja4ALen    = 10
+	ja4HashLen = 12
+	ja4Len     = ja4ALen + 1 + ja4HashLen + 1 + ja4HashLen
+)
+
+// isHex returns true if s only contains hexadecimal digits.
+func isHex(s string) (ok bool) {
+	return strings.Trim(s, "0123456789abcdefABCDEF") == ""
+}
+
+// isBlocked returns true if fqdn or any of its parent domains is blocked.
+func (pol *policy) isBlocked(fqdn string) (ok bool) {
+	if pol.blocked.Len() == 0 {
+		return false
+	}
+
+	for d := fqdn; d != "" && d != "."; {
+		if pol.blocked.Has(d) {
+			return true
+		}
+
+		_, d, _ = strings.Cut(d, ".")
+	}
+
+	return false
+}
+
+// policyFor returns the first policy currently applying to the client with
+// addr and TLS fingerprint fp, or nil if there is none.  fp may be nil.
+func (mw *Default) policyFor(addr netip.Addr, fp *proxy.TLSFingerprint) (pol *policy) {
+	if len(mw.policies) == 0 {
+		return nil
+	}
+
+	now := mw.clock.Now()
+	for _, pol = range mw.policies {
+		if pol.matches(addr, fp, now) {
+			return pol
+		}
+	}
+
+	return nil
+}
+
+// applyPolicy applies the policy of the client to the request within proxyCtx.
+// ok is true if the request has been handled.
+func (mw *Default) applyPolicy(
+	ctx context.Context,
+	h proxy.Handler,
+	p *proxy.Proxy,
+	proxyCtx *proxy.DNSContext,
+) (ok bool, err error) {
+	pol := mw.policyFor(proxyCtx.Addr.Addr(), proxyCtx.TLSFingerprint)
+	if pol == nil {
+		return false, nil
+	}
+
+	req := proxyCtx.Req
+	if act, ok := pol.queryAction(req); ok {
+		return true, mw.applyQueryAction(ctx, proxyCtx, act)
+	}
+
+	fqdn := strings.ToLower(req.Question[0].Name)
+	if !pol.allowed.allows(fqdn) {
+		mw.logger.DebugContext(ctx, "domain is not allowed", "qname", fqdn)
+		proxyCtx.RejectReason = proxy.RejectReasonFilter
+		proxyCtx.Res = mw.messages.NewMsgNXDOMAIN(req)
+
+		return true, nil
+	}
+
+	if pol.isBlocked(fqdn) {
+		mw.logger.DebugContext(ctx, "service is blocked", "qname", fqdn)
+		proxyCtx.RejectReason = proxy.RejectReasonFilter
+		proxyCtx.Res = mw.messages.NewMsgNXDOMAIN(req)
+
+		return true, nil
+	}
+
+	target, ok := pol.rewrites[fqdn]
+	if !ok {
+		return false, nil
+	}
+
+	mw.logger.DebugContext(ctx, "enforcing safe search", "qname", fqdn, "target", target)
+
+	return true, mw.rewrite(ctx, h, p, proxyCtx, target)
+}
+
+// rewrite resolves target with h instead of the requested name and replies
+// with a CNAME-style response.
+func (mw *Default) rewrite(
+	ctx context.Context,
+	h proxy.Handler,
+	p *proxy.Proxy,
+	proxyCtx *proxy.DNSContext,
+	target string,
+) (err error) {
+	req := proxyCtx.Req
+	defer func() { proxyCtx.Req = req }()
+
+	proxyCtx.Req = req.Copy()
+	proxyCtx.Req.Question[0].Name = target
+
+	err = h.ServeDNS(ctx, p, proxyCtx)
+	if err != nil || proxyCtx.Res == nil {
+		// Don't wrap the error since it's informative enough as is.
+		return err
+	}
+
+	resp := proxyCtx.Res
+	resp.Id = req.Id
+	resp.Question = slices.Clone(req.Question)
+	cname := &dns.CNAME{
+		Hdr:    hdr(req.Question[0].Name, dns.TypeCNAME),
+		Target: target,
+	}
+	resp.Answer = append([]dns.RR{cname}, resp.Answer...)
+
+	return nil
+}
@@ -0,0 +1,123 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/miekg/dns"
+)
+
+// QueryAction is an enumeration of the actions taken on the requests by their
+// query type or class.
+type QueryAction string
+
+const (
+	// QueryActionRefuse makes the middleware reply with REFUSED.
+	QueryActionRefuse QueryAction = "refuse"
+
+	// QueryActionDrop makes the middleware drop the request.
+	QueryActionDrop QueryAction = "drop"
+
+	// QueryActionNODATA makes the middleware reply with an empty NOERROR
+	// response.
+	QueryActionNODATA QueryAction = "nodata"
+
+	// QueryActionNXDOMAIN makes the middleware reply with NXDOMAIN.
+	QueryActionNXDOMAIN QueryAction = "nxdomain"
+)
+
+// validate returns an error if a isn't a known action.
+func (a QueryAction) validate() (err error) {
+	switch a {
+	case
+		QueryActionRefuse,
+		QueryActionDrop,
+		QueryActionNODATA,
+		QueryActionNXDOMAIN:
+		return nil
+	default:
+		return fmt.Errorf("%w: %q", errors.ErrBadEnumValue, a)
+	}
+}
+
+// ParseQueryType parses the query type from its mnemonic, e.g. "HTTPS", or
+// its generic RFC 3597 form, e.g. "TYPE65535".
+func ParseQueryType(s string) (qtype uint16, err error) {
+	return parseRRValue(s, "TYPE", dns.StringToType)
+}
+
+// ParseQueryClass parses the query class from its mnemonic, e.g. "CH", or its
+// generic RFC 3597 form, e.g. "CLASS254".
+func ParseQueryClass(s string) (qclass uint16, err error) {
+	return parseRRValue(s, "CLASS", dns.StringToClass)
+}
+
+// parseRRValue parses either a mnemonic from known or a generic representation
+// with prefix.
+func parseRRValue(s, prefix string, known map[string]uint16) (v uint16, err error) {
+	s = strings.ToUpper(s)
+	if v, ok := known[s]; ok {
+		return v, nil
+	}
+
+	numStr, ok := strings.CutPrefix(s, prefix)
+	if !ok {
+		return 0, fmt.Errorf("unknown value %q", s)
+	}
+
+	n, err := strconv.ParseUint(numStr, 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("parsing %q: %w", s, err)
+	}
+
+	return uint16(n), nil
+}
+
+// queryAction returns the action on req according to pol, if any.  req must
+// have a single question.
+func (pol *policy) queryAction(req *dns.Msg) (act QueryAction, ok bool) {
+	q := req.Question[0]
+	if act, ok = pol.qtypes[q.Qtype]; ok {
+		return act, true
+	}
+
+	act, ok = pol.qclasses[q.Qclass]
+
+	return act, ok
+}
+
+// applyQueryAction applies act to the request within proxyCtx.
+func (mw *Default) applyQueryAction(
+	ctx context.Context,
+	proxyCtx *proxy.DNSContext,
+	act QueryAction,
+) (err error) {
+	req := proxyCtx.Req
+	mw.logger.DebugContext(
+		ctx,
+		"applying query type action",
+		"qname", req.Question[0].Name,
+		"qtype", req.Question[0].Qtype,
+		"action", act,
+	)
+
+	switch act {
+	case QueryActionDrop:
+		proxyCtx.RejectReason = proxy.RejectReasonFilter
+
+		return proxy.ErrDrop
+	case QueryActionNODATA:
+		proxyCtx.Res = mw.messages.NewMsgNODATA(req)
+	case QueryActionNXDOMAIN:
+		proxyCtx.Res = mw.messages.NewMsgNXDOMAIN(req)
+	default:
+		proxyCtx.RejectReason = proxy.RejectReasonFilter
+		proxyCtx.Res = reply(req, dns.RcodeRefused)
+	}
+
+	return nil
+}
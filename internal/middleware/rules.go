@@ -0,0 +1,197 @@
+package middleware
+
+// safeSearchRule is a built-in rule rewriting the search engine domains to the
+// endpoint enforcing the safe search.
+type safeSearchRule struct {
+	// target is the FQDN of the endpoint enforcing the safe search.
+	target string
+
+	// domains are the FQDNs of the search engine to rewrite to target.
+	domains []string
+}
+
+// safeSearchRules are the built-in safe search rules by service name.
+//
+// TODO:  Consider moving these into data files and updating them
+// independently from the code.
+var safeSearchRules = map[string]safeSearchRule{
+	"bing": {
+		target: "strict.bing.com.",
+		domains: []string{
+			"bing.com.",
+			"www.bing.com.",
+		},
+	},
+	"duckduckgo": {
+		target: "safe.duckduckgo.com.",
+		domains: []string{
+			"duckduckgo.com.",
+			"start.duckduckgo.com.",
+			"www.duckduckgo.com.",
+		},
+	},
+	"google": {
+		target:  "forcesafesearch.google.com.",
+		domains: googleDomains(),
+	},
+	"pixabay": {
+		target: "safesearch.pixabay.com.",
+		domains: []string{
+			"pixabay.com.",
+			"www.pixabay.com.",
+		},
+	},
+	"yandex": {
+		target: "familysearch.yandex.ru.",
+		domains: []string{
+			"ya.ru.",
+			"www.ya.ru.",
+			"yandex.by.",
+			"yandex.com.",
+			"yandex.com.tr.",
+			"yandex.kz.",
+			"yandex.ru.",
+			"yandex.ua.",
+			"www.yandex.by.",
+			"www.yandex.com.",
+			"www.yandex.com.tr.",
+			"www.yandex.kz.",
+			"www.yandex.ru.",
+			"www.yandex.ua.",
+		},
+	},
+	"youtube": {
+		target: "restrictmoderate.youtube.com.",
+		domains: []string{
+			"m.youtube.com.",
+			"www.youtube-nocookie.com.",
+			"www.youtube.com.",
+			"youtube.googleapis.com.",
+			"youtubei.googleapis.com.",
+		},
+	},
+}
+
+// googleTLDs are the top-level domains of the most used Google search
+// endpoints.
+var googleTLDs = []string{
+	"ae",
+	"at",
+	"be",
+	"bg",
+	"ca",
+	"ch",
+	"cl",
+	"co.id",
+	"co.il",
+	"co.in",
+	"co.jp",
+	"co.kr",
+	"co.nz",
+	"co.th",
+	"co.uk",
+	"co.za",
+	"com",
+	"com.ar",
+	"com.au",
+	"com.br",
+	"com.co",
+	"com.eg",
+	"com.hk",
+	"com.mx",
+	"com.my",
+	"com.pe",
+	"com.ph",
+	"com.pk",
+	"com.sa",
+	"com.sg",
+	"com.tr",
+	"com.tw",
+	"com.ua",
+	"com.vn",
+	"cz",
+	"de",
+	"dk",
+	"es",
+	"fi",
+	"fr",
+	"gr",
+	"hu",
+	"ie",
+	"it",
+	"kz",
+	"nl",
+	"no",
+	"pl",
+	"pt",
+	"ro",
+	"rs",
+	"ru",
+	"se",
+	"sk",
+}
+
+// googleDomains returns the FQDNs of Google search for all of [googleTLDs].
+func googleDomains() (domains []string) {
+	domains = make([]string, 0, len(googleTLDs)*2)
+	for _, tld := range googleTLDs {
+		domains = append(domains, "google."+tld+".", "www.google."+tld+".")
+	}
+
+	return domains
+}
+
+// blockedServiceRules are the built-in lists of domains by service name.  The
+// subdomains of the listed domains are blocked as well.
+var blockedServiceRules = map[string][]string{
+	"discord": {
+		"discord.com.",
+		"discord.gg.",
+		"discordapp.com.",
+		"discordapp.net.",
+	},
+	"facebook": {
+		"facebook.com.",
+		"facebook.net.",
+		"fb.com.",
+		"fbcdn.net.",
+		"fbsbx.com.",
+	},
+	"instagram": {
+		"cdninstagram.com.",
+		"instagram.com.",
+	},
+	"reddit": {
+		"redd.it.",
+		"reddit.com.",
+		"redditmedia.com.",
+		"redditstatic.com.",
+	},
+	"snapchat": {
+		"sc-cdn.net.",
+		"snap-dev.net.",
+		"snapchat.com.",
+		"snapkit.co.",
+	},
+	"tiktok": {
+		"byteoversea.com.",
+		"ibytedtos.com.",
+		"musical.ly.",
+		"tiktok.com.",
+		"tiktokcdn.com.",
+		"tiktokv.com.",
+	},
+	"twitter": {
+		"t.co.",
+		"twimg.com.",
+		"twitter.com.",
+		"x.com.",
+	},
+	"youtube": {
+		"googlevideo.com.",
+		"youtu.be.",
+		"youtube-nocookie.com.",
+		"youtube.com.",
+		"ytimg.com.",
+	},
+}
@@ -0,0 +1,83 @@
+package middleware
+
+import (
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+)
+
+// day is the length of a day on a wall clock.
+const day = 24 * time.Hour
+
+// Schedule is a weekly schedule of the time windows, during which a [Policy]
+// is active.
+type Schedule struct {
+	// Location is the time zone of the schedule.  If nil, [time.Local] is
+	// used.
+	Location *time.Location
+
+	// Days are the days of week the time window starts on.  If empty, the
+	// window starts on every day.
+	Days []time.Weekday
+
+	// Start is the beginning of the time window as the wall-clock offset from
+	// midnight.  It must be in the range of [0, 24h).
+	Start time.Duration
+
+	// End is the exclusive end of the time window as the wall-clock offset
+	// from midnight.  It must be in the range of (0, 24h].  If End isn't
+	// greater than Start, the window ends on the next day.
+	End time.Duration
+}
+
+// Validate returns an error if s is invalid.  s must not be nil.
+func (s *Schedule) Validate() (err error) {
+	var errs []error
+	if s.Start < 0 || s.Start >= day {
+		errs = append(errs, fmt.Errorf("start: %s out of range [0, 24h)", s.Start))
+	}
+
+	if s.End <= 0 || s.End > day {
+		errs = append(errs, fmt.Errorf("end: %s out of range (0, 24h]", s.End))
+	}
+
+	for _, d := range s.Days {
+		if d < time.Sunday || d > time.Saturday {
+			errs = append(errs, fmt.Errorf("days: bad weekday %d", d))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Contains returns true if t is within the time window of s.  s must be valid.
+func (s *Schedule) Contains(t time.Time) (ok bool) {
+	if s.Location != nil {
+		t = t.In(s.Location)
+	} else {
+		t = t.Local()
+	}
+
+	h, m, sec := t.Clock()
+	offset := time.Duration(h)*time.Hour +
+		time.Duration(m)*time.Minute +
+		time.Duration(sec)*time.Second +
+		time.Duration(t.Nanosecond())
+
+	wd := t.Weekday()
+	if s.Start < s.End {
+		return s.hasDay(wd) && offset >= s.Start && offset < s.End
+	}
+
+	// The window wraps past midnight, so it either started today or yesterday.
+	prev := (wd + 6) % 7
+
+	return (s.hasDay(wd) && offset >= s.Start) || (s.hasDay(prev) && offset < s.End)
+}
+
+// hasDay returns true if the time window starts on wd.
+func (s *Schedule) hasDay(wd time.Weekday) (ok bool) {
+	return len(s.Days) == 0 || slices.Contains(s.Days, wd)
+}
@@ -0,0 +1,241 @@
+package middleware
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Default values of [ServiceBindingConfig].
+const (
+	defaultDoHPath  = "/dns-query"
+	defaultPortDoH  = 443
+	defaultPortDoT  = 853
+	defaultPortDoQ  = 853
+	ddrResolverFQDN = "_dns.resolver.arpa."
+)
+
+// ServiceBindingConfig is the configuration of publishing the SVCB and HTTPS
+// records advertising the encrypted endpoints of the proxy, so that the clients
+// discover those automatically, see RFC 9460, RFC 9461, and RFC 9462.
+type ServiceBindingConfig struct {
+	// Name is the domain name of the proxy, which its TLS certificate is
+	// valid for.  The HTTPS record advertising the DNS-over-HTTPS endpoint is
+	// published for it, and the SVCB records advertising all the encrypted
+	// endpoints are published for _dns.<Name> and for _dns.resolver.arpa, the
+	// latter being used by the designated resolvers discovery.  It must be a
+	// valid domain name.
+	Name string
+
+	// DoHPath is the path of the DNS-over-HTTPS endpoint.  If empty,
+	// "/dns-query" is used.
+	DoHPath string
+
+	// Hints are the IP addresses of the proxy advertised within the records.
+	// Those are also used to answer the A and AAAA queries for Name.
+	Hints []netip.Addr
+
+	// HTTPSPort is the port of the DNS-over-HTTPS endpoint.  Zero means that
+	// the endpoint isn't advertised.
+	HTTPSPort uint16
+
+	// TLSPort is the port of the DNS-over-TLS endpoint.  Zero means that the
+	// endpoint isn't advertised.
+	TLSPort uint16
+
+	// QUICPort is the port of the DNS-over-QUIC endpoint.  Zero means that
+	// the endpoint isn't advertised.
+	QUICPort uint16
+
+	// HTTP3 makes the DNS-over-HTTPS endpoint advertise HTTP/3 along with
+	// HTTP/2.
+	HTTP3 bool
+}
+
+// serviceBinding is the compiled [ServiceBindingConfig].
+type serviceBinding struct {
+	// https is the HTTPS record of the proxy's name, if DNS-over-HTTPS is
+	// advertised.
+	https *dns.HTTPS
+
+	// name is the lowercased FQDN of the proxy.
+	name string
+
+	// dnsName is the lowercased FQDN of the DNS service of the proxy, i.e.
+	// name prefixed with "_dns".
+	dnsName string
+
+	// svcbs are the SVCB records of the endpoints in the order of priority.
+	svcbs []*dns.SVCB
+
+	// hints are the addresses of the proxy.
+	hints []netip.Addr
+}
+
+// newServiceBinding compiles c into a *serviceBinding.  It returns nil if c is
+// nil.
+func newServiceBinding(c *ServiceBindingConfig) (sb *serviceBinding) {
+	if c == nil {
+		return nil
+	}
+
+	name := dns.Fqdn(strings.ToLower(c.Name))
+	sb = &serviceBinding{
+		name:    name,
+		dnsName: "_dns." + name,
+		hints:   c.Hints,
+	}
+
+	hints := hintValues(c.Hints)
+
+	if c.HTTPSPort != 0 {
+		alpn := []string{"h2"}
+		if c.HTTP3 {
+			alpn = append(alpn, "h3")
+		}
+
+		params := endpointValues(alpn, c.HTTPSPort, defaultPortDoH, hints)
+		sb.https = &dns.HTTPS{
+			SVCB: dns.SVCB{
+				Hdr:      hdr(name, dns.TypeHTTPS),
+				Priority: 1,
+				Target:   ".",
+				Value:    params,
+			},
+		}
+
+		path := c.DoHPath
+		if path == "" {
+			path = defaultDoHPath
+		}
+
+		params = append(params, &dns.SVCBDoHPath{Template: path + "{?dns}"})
+		sb.addEndpoint(params)
+	}
+
+	if c.TLSPort != 0 {
+		sb.addEndpoint(endpointValues([]string{"dot"}, c.TLSPort, defaultPortDoT, hints))
+	}
+
+	if c.QUICPort != 0 {
+		sb.addEndpoint(endpointValues([]string{"doq"}, c.QUICPort, defaultPortDoQ, hints))
+	}
+
+	return sb
+}
+
+// addEndpoint appends the SVCB record with params to sb.svcbs with the next
+// priority.  The owner name is set when answering.
+func (sb *serviceBinding) addEndpoint(params []dns.SVCBKeyValue) {
+	sb.svcbs = append(sb.svcbs, &dns.SVCB{
+		Hdr:      hdr("", dns.TypeSVCB),
+		Priority: uint16(len(sb.svcbs) + 1),
+		Target:   sb.name,
+		Value:    params,
+	})
+}
+
+// endpointValues returns the SVCB parameters of the endpoint supporting alpn
+// at port.  The port is omitted if it's the default one for the protocol.
+func endpointValues(
+	alpn []string,
+	port uint16,
+	defaultPort uint16,
+	hints []dns.SVCBKeyValue,
+) (params []dns.SVCBKeyValue) {
+	params = []dns.SVCBKeyValue{&dns.SVCBAlpn{Alpn: alpn}}
+	if port != defaultPort {
+		params = append(params, &dns.SVCBPort{Port: port})
+	}
+
+	return append(params, hints...)
+}
+
+// hintValues returns the SVCB parameters with the IPv4 and IPv6 hints, if any.
+func hintValues(addrs []netip.Addr) (params []dns.SVCBKeyValue) {
+	var ipv4, ipv6 []net.IP
+	for _, addr := range addrs {
+		if addr.Unmap().Is4() {
+			ipv4 = append(ipv4, addr.Unmap().AsSlice())
+		} else {
+			ipv6 = append(ipv6, addr.AsSlice())
+		}
+	}
+
+	if len(ipv4) > 0 {
+		params = append(params, &dns.SVCBIPv4Hint{Hint: ipv4})
+	}
+
+	if len(ipv6) > 0 {
+		params = append(params, &dns.SVCBIPv6Hint{Hint: ipv6})
+	}
+
+	return params
+}
+
+// answerServiceBinding replies to the requests for the records published
+// according to the service binding configuration, if any.  The other requests
+// for the service names are replied with NODATA.  req must not be nil.
+func (mw *Default) answerServiceBinding(ctx context.Context, req *dns.Msg) (resp *dns.Msg) {
+	sb := mw.serviceBinding
+	if sb == nil {
+		return nil
+	}
+
+	q := req.Question[0]
+	fqdn := strings.ToLower(q.Name)
+	switch fqdn {
+	case ddrResolverFQDN, sb.dnsName:
+		resp = mw.messages.NewCompressedResponse(req, dns.RcodeSuccess)
+		if q.Qtype != dns.TypeSVCB {
+			return resp
+		}
+
+		for _, rr := range sb.svcbs {
+			ans := dns.Copy(rr)
+			ans.Header().Name = q.Name
+			resp.Answer = append(resp.Answer, ans)
+		}
+	case sb.name:
+		resp = mw.answerProxyName(req, q.Qtype)
+	default:
+		return nil
+	}
+
+	if resp != nil {
+		mw.logger.DebugContext(ctx, "answering service binding", "qname", fqdn, "qtype", q.Qtype)
+	}
+
+	return resp
+}
+
+// answerProxyName replies to the request for the proxy's name with the
+// records of qtype, if published.  Otherwise, it returns nil so that the
+// request is resolved as usual.
+func (mw *Default) answerProxyName(req *dns.Msg, qtype uint16) (resp *dns.Msg) {
+	sb := mw.serviceBinding
+	switch qtype {
+	case dns.TypeHTTPS:
+		if sb.https == nil {
+			return nil
+		}
+
+		resp = mw.messages.NewCompressedResponse(req, dns.RcodeSuccess)
+		ans := dns.Copy(sb.https)
+		ans.Header().Name = req.Question[0].Name
+		resp.Answer = append(resp.Answer, ans)
+
+		return resp
+	case dns.TypeA, dns.TypeAAAA:
+		if len(sb.hints) == 0 {
+			return nil
+		}
+
+		return mw.messages.NewIPResponse(req, sb.hints)
+	default:
+		return nil
+	}
+}
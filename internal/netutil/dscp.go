@@ -0,0 +1,37 @@
+package netutil
+
+import (
+	"fmt"
+	"syscall"
+
+	"github.com/AdguardTeam/golibs/errors"
+)
+
+// MaxDSCP is the maximum value of the Differentiated Services Code Point, which
+// occupies the six most significant bits of the IPv4 TOS and the IPv6 Traffic
+// Class fields.
+//
+// See https://www.rfc-editor.org/rfc/rfc2474.html#section-3.
+const MaxDSCP uint8 = 63
+
+// ValidateDSCP returns an error if dscp isn't a valid DSCP value.
+func ValidateDSCP(dscp uint8) (err error) {
+	if dscp > MaxDSCP {
+		return fmt.Errorf("dscp: %w: %d", errors.ErrOutOfRange, dscp)
+	}
+
+	return nil
+}
+
+// SetDSCP marks the packets sent through c with dscp by setting the IPv4 TOS
+// and, for IPv6 sockets, the Traffic Class fields.  Setting it on a listening
+// TCP socket also marks the accepted connections on most platforms.  dscp
+// must be valid, see [ValidateDSCP].
+func SetDSCP(c syscall.Conn, dscp uint8) (err error) {
+	rc, err := c.SyscallConn()
+	if err != nil {
+		return fmt.Errorf("getting raw conn: %w", err)
+	}
+
+	return setDSCP(rc, dscp)
+}
@@ -0,0 +1,29 @@
+//go:build unix
+
+package netutil
+
+import (
+	"fmt"
+	"syscall"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"golang.org/x/sys/unix"
+)
+
+// setDSCP sets the IP_TOS and IPV6_TCLASS socket options of rc to dscp.  Only
+// one of those is required to succeed, since the socket may be of either
+// address family.
+func setDSCP(rc syscall.RawConn, dscp uint8) (err error) {
+	tos := int(dscp) << 2
+
+	var opErr error
+	err = rc.Control(func(fd uintptr) {
+		errV4 := unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_TOS, tos)
+		errV6 := unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_TCLASS, tos)
+		if errV4 != nil && errV6 != nil {
+			opErr = fmt.Errorf("setting IP_TOS: %w; setting IPV6_TCLASS: %w", errV4, errV6)
+		}
+	})
+
+	return errors.WithDeferred(opErr, err)
+}
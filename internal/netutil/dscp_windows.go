@@ -0,0 +1,16 @@
+//go:build windows
+
+package netutil
+
+import (
+	"fmt"
+	"syscall"
+
+	"github.com/AdguardTeam/golibs/errors"
+)
+
+// setDSCP returns an error, because Windows ignores the IP_TOS socket option
+// and requires the QoS policies to mark the packets instead.
+func setDSCP(_ syscall.RawConn, _ uint8) (err error) {
+	return fmt.Errorf("setting dscp: %w", errors.ErrUnsupported)
+}
@@ -0,0 +1,19 @@
+package netutil
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// SetAutoFlowLabel makes the kernel set the IPv6 flow label of the packets sent
+// through c, which is stable for each destination, so that the routers with
+// ECMP keep the packets of a connection on the same path.  It's only supported
+// on Linux and only for IPv6 sockets.
+func SetAutoFlowLabel(c syscall.Conn) (err error) {
+	rc, err := c.SyscallConn()
+	if err != nil {
+		return fmt.Errorf("getting raw conn: %w", err)
+	}
+
+	return setAutoFlowLabel(rc)
+}
@@ -0,0 +1,24 @@
+//go:build linux
+
+package netutil
+
+import (
+	"fmt"
+	"syscall"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"golang.org/x/sys/unix"
+)
+
+// setAutoFlowLabel sets the IPV6_AUTOFLOWLABEL socket option of rc.
+func setAutoFlowLabel(rc syscall.RawConn) (err error) {
+	var opErr error
+	err = rc.Control(func(fd uintptr) {
+		opErr = unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_AUTOFLOWLABEL, 1)
+		if opErr != nil {
+			opErr = fmt.Errorf("setting IPV6_AUTOFLOWLABEL: %w", opErr)
+		}
+	})
+
+	return errors.WithDeferred(opErr, err)
+}
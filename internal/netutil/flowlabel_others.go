@@ -0,0 +1,16 @@
+//go:build !linux
+
+package netutil
+
+import (
+	"fmt"
+	"syscall"
+
+	"github.com/AdguardTeam/golibs/errors"
+)
+
+// setAutoFlowLabel returns an error, because only Linux allows the kernel to
+// set the flow labels of a socket.
+func setAutoFlowLabel(_ syscall.RawConn) (err error) {
+	return fmt.Errorf("setting flow label: %w", errors.ErrUnsupported)
+}
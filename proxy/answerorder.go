@@ -0,0 +1,114 @@
+package proxy
+
+import (
+	"encoding"
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// AnswerOrderMode is an enumeration of the modes of ordering the A and AAAA
+// records within the answers served from the cache.
+type AnswerOrderMode string
+
+const (
+	// AnswerOrderModeDefault makes the proxy keep the order of the records
+	// received from the upstream.
+	AnswerOrderModeDefault AnswerOrderMode = ""
+
+	// AnswerOrderModeRoundRobin makes the proxy rotate the records by one
+	// position with each response served from the cache.
+	AnswerOrderModeRoundRobin AnswerOrderMode = "round_robin"
+
+	// AnswerOrderModeRandom makes the proxy shuffle the records randomly.
+	AnswerOrderModeRandom AnswerOrderMode = "random"
+)
+
+// type check
+var _ encoding.TextUnmarshaler = (*AnswerOrderMode)(nil)
+
+// UnmarshalText implements [encoding.TextUnmarshaler] interface for
+// *AnswerOrderMode.
+func (m *AnswerOrderMode) UnmarshalText(b []byte) (err error) {
+	switch am := AnswerOrderMode(b); am {
+	case
+		AnswerOrderModeDefault,
+		AnswerOrderModeRoundRobin,
+		AnswerOrderModeRandom:
+		*m = am
+	default:
+		return fmt.Errorf(
+			"invalid answer order mode %q, supported: %q, %q",
+			b,
+			AnswerOrderModeRoundRobin,
+			AnswerOrderModeRandom,
+		)
+	}
+
+	return nil
+}
+
+// reorderAnswer changes the order of the A and AAAA records within the answer
+// section of the cached response m according to the answer order mode.  Only
+// the records of the same RRset are reordered, so that CNAME chains stay
+// intact.
+func (p *Proxy) reorderAnswer(m *dns.Msg) {
+	if p.AnswerOrder == AnswerOrderModeDefault || m == nil {
+		return
+	}
+
+	// Use a single counter for all the responses, since the exact sequence
+	// isn't important for the load distribution.
+	shift := int(p.answerRotation.Add(1))
+
+	ans := m.Answer
+	for start := 0; start < len(ans); {
+		end := start + 1
+		for end < len(ans) && sameAddrRRset(ans[start], ans[end]) {
+			end++
+		}
+
+		if rrs := ans[start:end]; len(rrs) > 1 && isAddrRR(rrs[0]) {
+			switch p.AnswerOrder {
+			case AnswerOrderModeRoundRobin:
+				rotateRRs(rrs, shift%len(rrs))
+			case AnswerOrderModeRandom:
+				rand.Shuffle(len(rrs), func(i, j int) { rrs[i], rrs[j] = rrs[j], rrs[i] })
+			}
+		}
+
+		start = end
+	}
+}
+
+// isAddrRR returns true if rr is an A or AAAA record.
+func isAddrRR(rr dns.RR) (ok bool) {
+	switch rr.Header().Rrtype {
+	case dns.TypeA, dns.TypeAAAA:
+		return true
+	default:
+		return false
+	}
+}
+
+// sameAddrRRset returns true if a and b are address records of the same
+// RRset.
+func sameAddrRRset(a, b dns.RR) (ok bool) {
+	ah, bh := a.Header(), b.Header()
+
+	return isAddrRR(a) &&
+		ah.Rrtype == bh.Rrtype &&
+		ah.Class == bh.Class &&
+		strings.EqualFold(ah.Name, bh.Name)
+}
+
+// rotateRRs rotates rrs to the left by n positions.  n must be less than
+// len(rrs).
+func rotateRRs(rrs []dns.RR, n int) {
+	slices.Reverse(rrs[:n])
+	slices.Reverse(rrs[n:])
+	slices.Reverse(rrs)
+}
@@ -0,0 +1,80 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxy_reorderAnswer(t *testing.T) {
+	t.Parallel()
+
+	const (
+		host   = "example.com."
+		target = "target.example.com."
+	)
+
+	newMsg := func(t *testing.T) (m *dns.Msg) {
+		t.Helper()
+
+		return &dns.Msg{
+			Answer: []dns.RR{
+				newRR(t, host, dns.TypeCNAME, 60, target),
+				newRR(t, target, dns.TypeA, 60, net.IP{1, 1, 1, 1}),
+				newRR(t, target, dns.TypeA, 60, net.IP{2, 2, 2, 2}),
+				newRR(t, target, dns.TypeA, 60, net.IP{3, 3, 3, 3}),
+			},
+		}
+	}
+
+	// addrs returns the first octets of the addresses in m.
+	addrs := func(m *dns.Msg) (octets []byte) {
+		for _, rr := range m.Answer {
+			if a, ok := rr.(*dns.A); ok {
+				octets = append(octets, a.A.To4()[0])
+			}
+		}
+
+		return octets
+	}
+
+	t.Run("default", func(t *testing.T) {
+		t.Parallel()
+
+		p := &Proxy{Config: Config{AnswerOrder: AnswerOrderModeDefault}}
+
+		m := newMsg(t)
+		p.reorderAnswer(m)
+		assert.Equal(t, []byte{1, 2, 3}, addrs(m))
+	})
+
+	t.Run("round_robin", func(t *testing.T) {
+		t.Parallel()
+
+		p := &Proxy{Config: Config{AnswerOrder: AnswerOrderModeRoundRobin}}
+
+		want := [][]byte{{2, 3, 1}, {3, 1, 2}, {1, 2, 3}}
+		for _, w := range want {
+			m := newMsg(t)
+			p.reorderAnswer(m)
+
+			require.IsType(t, &dns.CNAME{}, m.Answer[0])
+			assert.Equal(t, w, addrs(m))
+		}
+	})
+
+	t.Run("random", func(t *testing.T) {
+		t.Parallel()
+
+		p := &Proxy{Config: Config{AnswerOrder: AnswerOrderModeRandom}}
+
+		m := newMsg(t)
+		p.reorderAnswer(m)
+
+		require.IsType(t, &dns.CNAME{}, m.Answer[0])
+		assert.ElementsMatch(t, []byte{1, 2, 3}, addrs(m))
+	})
+}
@@ -14,6 +14,7 @@ import (
 	"github.com/AdguardTeam/dnsproxy/upstream"
 	glcache "github.com/AdguardTeam/golibs/cache"
 	"github.com/AdguardTeam/golibs/mathutil"
+	"github.com/AdguardTeam/golibs/timeutil"
 	"github.com/miekg/dns"
 )
 
@@ -21,9 +22,11 @@ import (
 const defaultCacheSize = 64 * 1024
 
 // cache is used to cache requests and used upstreams.
-//
-// TODO(a.garipov):  Add [timeutil.Clock] and make tests less flaky.
 type cache struct {
+	// clock is used to calculate the expiration time and the TTLs of the
+	// cached responses.
+	clock timeutil.Clock
+
 	// itemsLock protects requests cache.
 	itemsLock *sync.RWMutex
 
@@ -46,6 +49,10 @@ type cache struct {
 	// optimisticMaxAge is the maximum time entries remain in the cache when
 	// cache is optimistic.
 	optimisticMaxAge time.Duration
+
+	// fixedTTL defines if the cached responses should be served with the TTLs
+	// received from the upstream instead of the decayed ones.
+	fixedTTL bool
 }
 
 // cacheItem is a single cache entry.  It's a helper type to aggregate the
@@ -88,14 +95,14 @@ const (
 	minPackedLen = expTimeSz + packedMsgLenSz
 )
 
-// pack converts the ci into bytes slice.
-func (ci *cacheItem) pack() (packed []byte) {
+// pack converts the ci stored at now into bytes slice.
+func (ci *cacheItem) pack(now time.Time) (packed []byte) {
 	pm, _ := ci.m.Pack()
 	pmLen := len(pm)
 	packed = make([]byte, minPackedLen, minPackedLen+pmLen+len(ci.u))
 
 	// Put expiration time.
-	binary.BigEndian.PutUint32(packed, uint32(time.Now().Unix())+ci.ttl)
+	binary.BigEndian.PutUint32(packed, uint32(now.Unix())+ci.ttl)
 
 	// Put the length of the packed message.
 	binary.BigEndian.PutUint16(packed[expTimeSz:], uint16(pmLen))
@@ -111,8 +118,13 @@ func (ci *cacheItem) pack() (packed []byte) {
 
 // unpackItem converts the data into cacheItem using req as a request message.
 // expired is true if the item exists but expired.  The expired cached items are
-// only returned if c is optimistic and optimistic max age is not exceeded.  req
-// must not be nil.
+// only returned if c is optimistic and optimistic max age is not exceeded.  The
+// TTLs of the records are decreased by the time spent in the cache, unless c
+// serves fixed TTLs.  req must not be nil.
+//
+// An item is considered expired as soon as its remaining TTL reaches zero,
+// since a zero TTL means that the response must not be cached by the client.
+// Note also that zero passed to [filterMsg] keeps the original TTLs.
 func (c *cache) unpackItem(data []byte, req *dns.Msg) (ci *cacheItem, expired bool) {
 	if len(data) < minPackedLen {
 		return nil, false
@@ -120,16 +132,16 @@ func (c *cache) unpackItem(data []byte, req *dns.Msg) (ci *cacheItem, expired bo
 
 	b := bytes.NewBuffer(data)
 	expire := time.Unix(int64(binary.BigEndian.Uint32(b.Next(expTimeSz))), 0)
-	now := time.Now()
+	now := c.clock.Now()
 	var ttl uint32
-	if expired = now.After(expire); expired {
+	if expired = !now.Before(expire); expired {
 		optimisticExpire := expire.Add(c.optimisticMaxAge)
 		if !c.optimistic || now.After(optimisticExpire) {
 			return nil, expired
 		}
 
 		ttl = uint32(c.optimisticTTL.Seconds())
-	} else {
+	} else if !c.fixedTTL {
 		ttl = uint32(expire.Unix() - now.Unix())
 	}
 
@@ -177,14 +189,20 @@ func (p *Proxy) initCache() {
 		size:             size,
 		optimisticTTL:    p.CacheOptimisticAnswerTTL,
 		optimisticMaxAge: p.CacheOptimisticMaxAge,
+		clock:            p.time,
 		withECS:          p.EnableEDNSClientSubnet,
 		optimistic:       p.CacheOptimistic,
+		fixedTTL:         p.CacheFixedTTL,
 	})
 	p.shortFlighter = newOptimisticResolver(p)
 }
 
 // cacheConfig is the configuration structure for [cache].
 type cacheConfig struct {
+	// clock is used to calculate the expiration time and the TTLs of the
+	// cached responses.  If nil, [timeutil.SystemClock] is used.
+	clock timeutil.Clock
+
 	// size is the cache size in bytes.
 	size int
 
@@ -202,17 +220,27 @@ type cacheConfig struct {
 	// optimistic defines if the cache should return expired items and resolve
 	// those again.
 	optimistic bool
+
+	// fixedTTL defines if the cached responses should be served with the TTLs
+	// received from the upstream.
+	fixedTTL bool
 }
 
 // newCache returns a properly initialized cache.  logger must not be nil.
 func newCache(conf *cacheConfig) (c *cache) {
 	c = &cache{
+		clock:               conf.clock,
 		itemsLock:           &sync.RWMutex{},
 		itemsWithSubnetLock: &sync.RWMutex{},
 		items:               createCache(conf.size),
 		optimistic:          conf.optimistic,
 		optimisticTTL:       conf.optimisticTTL,
 		optimisticMaxAge:    conf.optimisticMaxAge,
+		fixedTTL:            conf.fixedTTL,
+	}
+
+	if c.clock == nil {
+		c.clock = timeutil.SystemClock{}
 	}
 
 	if conf.withECS {
@@ -265,6 +293,16 @@ func (c *cache) getWithSubnet(req *dns.Msg, n *net.IPNet) (ci *cacheItem, expire
 	m, _ := n.Mask.Size()
 
 	k = msgToKeyWithSubnet(req, ecsIP, m)
+
+	// Responses with the scope longer than the source prefix are only valid
+	// for the same source prefix.
+	if m > 0 {
+		ek := exactSourceKey(k)
+		if data := c.itemsWithSubnet.Get(ek); data != nil {
+			return c.unpackWithSubnet(data, req, ek)
+		}
+	}
+
 	data := c.itemsWithSubnet.Get(k)
 
 	// In order to reduce allocations we apply mask on bits level.  As the key
@@ -274,8 +312,9 @@ func (c *cache) getWithSubnet(req *dns.Msg, n *net.IPNet) (ci *cacheItem, expire
 		// Set mask identification byte in the key.
 		k[keyMaskIndex] = byte(m)
 
-		// In case mask is zero, the key doesn't have IP in it.
+		// In case mask is zero, the key doesn't have IP and family in it.
 		if m == 0 {
+			k[keyFamilyIndex] = 0
 			k = slices.Delete(k, keyIPIndex, keyIPIndex+ipLen)
 			data = c.itemsWithSubnet.Get(k)
 
@@ -299,6 +338,13 @@ func (c *cache) getWithSubnet(req *dns.Msg, n *net.IPNet) (ci *cacheItem, expire
 		return nil, false, k
 	}
 
+	return c.unpackWithSubnet(data, req, k)
+}
+
+// unpackWithSubnet unpacks the cached item for req from data stored by k in
+// the subnet cache and removes it from there if it's not valid anymore.
+// c.itemsWithSubnetLock is expected to be locked.
+func (c *cache) unpackWithSubnet(data []byte, req *dns.Msg, k []byte) (ci *cacheItem, expired bool, key []byte) {
 	if ci, expired = c.unpackItem(data, req); ci == nil {
 		c.itemsWithSubnet.Del(k)
 	}
@@ -335,7 +381,7 @@ func (c *cache) set(req, m *dns.Msg, u upstream.Upstream, l *slog.Logger) {
 	}
 
 	key := msgToKey(req)
-	packed := item.pack()
+	packed := item.pack(c.clock.Now())
 
 	c.itemsLock.Lock()
 	defer c.itemsLock.Unlock()
@@ -347,14 +393,36 @@ func (c *cache) set(req, m *dns.Msg, u upstream.Upstream, l *slog.Logger) {
 // given subnet mask and IP address are used to calculate the cache key.  u, n,
 // and l must not be nil.
 func (c *cache) setWithSubnet(req, m *dns.Msg, u upstream.Upstream, n *net.IPNet, l *slog.Logger) {
+	pref, _ := n.Mask.Size()
+	c.setWithKey(msgToKeyWithSubnet(req, n.IP.Mask(n.Mask), pref), m, u, l)
+}
+
+// setWithExactSubnet stores response and upstream with subnet in the cache so
+// that it's only used for the requests with exactly the same source prefix.
+// It's used for the responses having the scope prefix longer than the source
+// one.  u, n, and l must not be nil.
+//
+// See RFC 7871 Section 7.3.1.
+func (c *cache) setWithExactSubnet(req, m *dns.Msg, u upstream.Upstream, n *net.IPNet, l *slog.Logger) {
+	pref, _ := n.Mask.Size()
+	if pref == 0 {
+		c.setWithSubnet(req, m, u, n, l)
+
+		return
+	}
+
+	c.setWithKey(exactSourceKey(msgToKeyWithSubnet(req, n.IP.Mask(n.Mask), pref)), m, u, l)
+}
+
+// setWithKey stores response and upstream in the subnet cache by key.  u and l
+// must not be nil.
+func (c *cache) setWithKey(key []byte, m *dns.Msg, u upstream.Upstream, l *slog.Logger) {
 	item := c.respToItem(m, u, l)
 	if item == nil {
 		return
 	}
 
-	pref, _ := n.Mask.Size()
-	key := msgToKeyWithSubnet(req, n.IP.Mask(n.Mask), pref)
-	packed := item.pack()
+	packed := item.pack(c.clock.Now())
 
 	c.itemsWithSubnetLock.Lock()
 	defer c.itemsWithSubnetLock.Unlock()
@@ -552,16 +620,40 @@ func msgToKey(m *dns.Msg) (b []byte) {
 }
 
 const (
+	// keyFamilyIndex is the index of the byte with the address family.
+	keyFamilyIndex = 1 + 2*packedMsgLenSz
+
 	// keyMaskIndex is the index of the byte with mask ones value.
-	keyMaskIndex = 1 + 2*packedMsgLenSz
+	keyMaskIndex = keyFamilyIndex + 1
 
 	// keyIPIndex is the start index of the IP address in the key.
 	keyIPIndex = keyMaskIndex + 1
 )
 
-// msgToKeyWithSubnet constructs the cache key from DO bit, type, class, subnet
-// mask, client's IP address and question's name of m.  ecsIP is expected to be
-// masked already.
+// Address family values of the subnet cache keys.  Those are the same as the
+// FAMILY values of the ECS option, so that IPv4 and IPv6 entries never collide.
+const (
+	keyFamilyAny  byte = 0
+	keyFamilyIPv4 byte = 1
+	keyFamilyIPv6 byte = 2
+
+	// keyFamilyExactSource is set within the address family of the keys of
+	// the responses valid only for the same source prefix.
+	keyFamilyExactSource byte = 1 << 7
+)
+
+// exactSourceKey returns a copy of the subnet cache key k for the responses
+// valid only for the requests with the same source prefix.
+func exactSourceKey(k []byte) (ek []byte) {
+	ek = slices.Clone(k)
+	ek[keyFamilyIndex] |= keyFamilyExactSource
+
+	return ek
+}
+
+// msgToKeyWithSubnet constructs the cache key from DO bit, type, class, address
+// family, subnet mask, client's IP address and question's name of m.  ecsIP is
+// expected to be masked already.
 func msgToKeyWithSubnet(m *dns.Msg, ecsIP net.IP, mask int) (key []byte) {
 	q := m.Question[0]
 	keyLen := keyIPIndex + len(q.Name)
@@ -583,10 +675,16 @@ func msgToKeyWithSubnet(m *dns.Msg, ecsIP net.IP, mask int) (key []byte) {
 	// Put Qclass.
 	binary.BigEndian.PutUint16(key[1+packedMsgLenSz:], q.Qclass)
 
-	// Add mask.
+	// Add family and mask.
+	key[keyFamilyIndex] = keyFamilyAny
 	key[keyMaskIndex] = uint8(mask)
 	k := keyIPIndex
 	if masked {
+		key[keyFamilyIndex] = keyFamilyIPv6
+		if len(ecsIP) == net.IPv4len {
+			key[keyFamilyIndex] = keyFamilyIPv4
+		}
+
 		k += copy(key[keyIPIndex:], ecsIP)
 	}
 
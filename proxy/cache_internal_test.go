@@ -13,6 +13,7 @@ import (
 	"github.com/AdguardTeam/dnsproxy/upstream"
 	"github.com/AdguardTeam/golibs/netutil"
 	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/AdguardTeam/golibs/testutil/faketime"
 	"github.com/AdguardTeam/golibs/testutil/servicetest"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -45,8 +46,10 @@ func newTestCache(tb testing.TB, conf *cacheConfig) (c *cache) {
 		size:             cmp.Or(conf.size, testCacheSize),
 		optimisticTTL:    cmp.Or(conf.optimisticTTL, testOptimisticTTL),
 		optimisticMaxAge: cmp.Or(conf.optimisticMaxAge, testOptimisticMaxAge),
+		clock:            conf.clock,
 		withECS:          conf.withECS,
 		optimistic:       conf.optimistic,
+		fixedTTL:         conf.fixedTTL,
 	})
 }
 
@@ -89,6 +92,49 @@ func TestServeCached(t *testing.T) {
 	requireEqualMsgs(t, r, reply)
 }
 
+func TestProxy_TakeCache(t *testing.T) {
+	t.Parallel()
+
+	newProxy := func(t *testing.T, cacheEnabled bool) (p *Proxy) {
+		t.Helper()
+
+		return mustNew(t, &Config{
+			Logger:         testLogger,
+			UpstreamConfig: newTestUpstreamConfig(t, defaultTimeout, testDefaultUpstreamAddr),
+			CacheEnabled:   cacheEnabled,
+		})
+	}
+
+	req := (&dns.Msg{}).SetQuestion("example.org.", dns.TypeA)
+	resp := (&dns.Msg{
+		Answer: []dns.RR{newRR(t, "example.org.", dns.TypeA, 3600, net.IP{192, 0, 2, 1})},
+	}).SetReply(req)
+
+	prev := newProxy(t, true)
+	prev.cache.set(req, resp, upstreamWithAddr, testLogger)
+
+	t.Run("enabled", func(t *testing.T) {
+		t.Parallel()
+
+		p := newProxy(t, true)
+		p.TakeCache(prev)
+
+		ci, _, _ := p.cache.get(req)
+		require.NotNil(t, ci)
+
+		requireEqualMsgs(t, ci.m, resp)
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		t.Parallel()
+
+		p := newProxy(t, false)
+		p.TakeCache(prev)
+
+		assert.Nil(t, p.cache)
+	})
+}
+
 func TestCache_expired(t *testing.T) {
 	const host = "google.com."
 
@@ -161,7 +207,7 @@ func TestCache_expired(t *testing.T) {
 				m:   reply,
 				u:   testUpsAddr,
 				ttl: tc.ttl,
-			}).pack()
+			}).pack(time.Now())
 			testCache.items.Set(key, data)
 			t.Cleanup(testCache.items.Clear)
 
@@ -219,6 +265,104 @@ func TestCacheDO(t *testing.T) {
 	})
 }
 
+func TestCache_ttlDecay(t *testing.T) {
+	t.Parallel()
+
+	const (
+		host = "example.com."
+
+		shortTTL = 10
+		longTTL  = 20
+	)
+
+	// Use a whole second to make the boundaries exact, since the expiration
+	// time is stored with the precision of seconds.
+	start := time.Unix(1_000_000, 0)
+
+	req := (&dns.Msg{}).SetQuestion(host, dns.TypeA)
+	reply := (&dns.Msg{
+		Answer: []dns.RR{
+			newRR(t, host, dns.TypeA, shortTTL, net.IP{1, 1, 1, 1}),
+			newRR(t, host, dns.TypeA, longTTL, net.IP{2, 2, 2, 2}),
+		},
+	}).SetReply(req)
+
+	testCases := []struct {
+		name       string
+		wantTTLs   []uint32
+		elapsed    time.Duration
+		fixedTTL   bool
+		optimistic bool
+	}{{
+		name:     "fresh",
+		wantTTLs: []uint32{shortTTL, shortTTL},
+		elapsed:  0,
+	}, {
+		name:     "decayed",
+		wantTTLs: []uint32{shortTTL - 4, shortTTL - 4},
+		elapsed:  4 * time.Second,
+	}, {
+		name:     "decayed_partial_second",
+		wantTTLs: []uint32{shortTTL - 4, shortTTL - 4},
+		elapsed:  4*time.Second + 500*time.Millisecond,
+	}, {
+		name:     "last_second",
+		wantTTLs: []uint32{1, 1},
+		elapsed:  (shortTTL - 1) * time.Second,
+	}, {
+		name:     "expired",
+		wantTTLs: nil,
+		elapsed:  shortTTL * time.Second,
+	}, {
+		name:       "expired_optimistic",
+		wantTTLs:   []uint32{uint32(testOptimisticTTL.Seconds()), uint32(testOptimisticTTL.Seconds())},
+		elapsed:    shortTTL * time.Second,
+		optimistic: true,
+	}, {
+		name:     "fixed",
+		wantTTLs: []uint32{shortTTL, longTTL},
+		elapsed:  4 * time.Second,
+		fixedTTL: true,
+	}, {
+		name:     "fixed_expired",
+		wantTTLs: nil,
+		elapsed:  shortTTL * time.Second,
+		fixedTTL: true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			now := start
+			c := newTestCache(t, &cacheConfig{
+				clock: &faketime.Clock{
+					OnNow: func() (n time.Time) { return now },
+				},
+				fixedTTL:   tc.fixedTTL,
+				optimistic: tc.optimistic,
+			})
+
+			c.set(req, reply, upstreamWithAddr, testLogger)
+
+			now = start.Add(tc.elapsed)
+			ci, _, _ := c.get(req)
+			if tc.wantTTLs == nil {
+				assert.Nil(t, ci)
+
+				return
+			}
+
+			require.NotNil(t, ci)
+			require.Len(t, ci.m.Answer, len(tc.wantTTLs))
+
+			for i, rr := range ci.m.Answer {
+				assert.Equal(t, tc.wantTTLs[i], rr.Header().Ttl)
+			}
+		})
+	}
+}
+
 func TestCacheCNAME(t *testing.T) {
 	testCache := newTestCache(t, nil)
 
@@ -790,6 +934,70 @@ func TestCache_getWithSubnet_mask(t *testing.T) {
 	})
 }
 
+func TestCache_getWithSubnet_exactSource(t *testing.T) {
+	const testFQDN = "example.com."
+
+	ip1234 := net.IP{1, 2, 3, 4}
+	mask24 := net.CIDRMask(24, netutil.IPv4BitLen)
+	ansIP := net.IP{4, 4, 4, 4}
+
+	c := newTestCache(t, &cacheConfig{withECS: true})
+
+	req := (&dns.Msg{}).SetQuestion(testFQDN, dns.TypeA)
+	resp := (&dns.Msg{
+		Answer: []dns.RR{newRR(t, testFQDN, dns.TypeA, 300, ansIP)},
+	}).SetReply(req)
+
+	c.setWithExactSubnet(req, resp, upstreamWithAddr, &net.IPNet{IP: ip1234, Mask: mask24}, testLogger)
+
+	testCases := []struct {
+		name    string
+		ip      net.IP
+		ones    int
+		wantHit bool
+	}{{
+		name:    "same_source",
+		ip:      ip1234,
+		ones:    24,
+		wantHit: true,
+	}, {
+		name:    "same_source_other_host",
+		ip:      net.IP{1, 2, 3, 5},
+		ones:    24,
+		wantHit: true,
+	}, {
+		name:    "longer_source",
+		ip:      ip1234,
+		ones:    32,
+		wantHit: false,
+	}, {
+		name:    "shorter_source",
+		ip:      ip1234,
+		ones:    16,
+		wantHit: false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ci, _, _ := c.getWithSubnet(req, &net.IPNet{
+				IP:   tc.ip,
+				Mask: net.CIDRMask(tc.ones, netutil.IPv4BitLen),
+			})
+			if !tc.wantHit {
+				assert.Nil(t, ci)
+
+				return
+			}
+
+			require.NotNil(t, ci)
+			require.NotEmpty(t, ci.m.Answer)
+
+			a := testutil.RequireTypeAssert[*dns.A](t, ci.m.Answer[0])
+			assert.True(t, a.A.Equal(ansIP))
+		})
+	}
+}
+
 func TestCache_IsCacheable_negative(t *testing.T) {
 	const someTTL = 3600
 
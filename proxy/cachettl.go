@@ -0,0 +1,71 @@
+package proxy
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/netutil"
+)
+
+// TTLRange is the range the TTLs of the records of the responses are kept
+// within.  Zero values mean no limit.
+type TTLRange struct {
+	// Min is the minimum TTL in seconds.
+	Min uint32
+
+	// Max is the maximum TTL in seconds.
+	Max uint32
+}
+
+// newDomainTTLs returns the copy of ranges with the normalized domain names.
+// It returns an error if any of the domain names or the ranges is invalid.
+func newDomainTTLs(ranges map[string]TTLRange) (normalized map[string]TTLRange, err error) {
+	if len(ranges) == 0 {
+		return nil, nil
+	}
+
+	normalized = make(map[string]TTLRange, len(ranges))
+	for d, r := range ranges {
+		name := strings.ToLower(strings.TrimSuffix(d, "."))
+		err = netutil.ValidateDomainName(name)
+		if err != nil {
+			return nil, fmt.Errorf("domain %q: %w", d, err)
+		}
+
+		if r.Max != 0 && r.Min > r.Max {
+			return nil, fmt.Errorf(
+				"domain %q: min ttl %d: %w: must not be greater than max ttl %d",
+				d,
+				r.Min,
+				errors.ErrOutOfRange,
+				r.Max,
+			)
+		}
+
+		normalized[name] = r
+	}
+
+	return normalized, nil
+}
+
+// ttlRange returns the TTL range for the responses to the questions for fqdn.
+// The range of the most specific domain from [Config.CacheDomainTTLs] is used,
+// if any.  Otherwise, the range is set by [Config.CacheMinTTL] and
+// [Config.CacheMaxTTL].
+func (p *Proxy) ttlRange(fqdn string) (r TTLRange) {
+	if len(p.domainTTLs) > 0 {
+		for name := strings.ToLower(strings.TrimSuffix(fqdn, ".")); name != ""; {
+			if r, ok := p.domainTTLs[name]; ok {
+				return r
+			}
+
+			_, name, _ = strings.Cut(name, ".")
+		}
+	}
+
+	return TTLRange{
+		Min: p.CacheMinTTL,
+		Max: p.CacheMaxTTL,
+	}
+}
@@ -0,0 +1,142 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxy_setMinMaxTTL_domains(t *testing.T) {
+	t.Parallel()
+
+	p := mustNew(t, &Config{
+		Logger:         testLogger,
+		UpstreamConfig: newTestUpstreamConfig(t, defaultTimeout, testDefaultUpstreamAddr),
+		CacheMinTTL:    10,
+		CacheMaxTTL:    3600,
+		CacheDomainTTLs: map[string]TTLRange{
+			"Internal.Example.": {Max: 30},
+			"cdn.example":       {Min: 300},
+			"host.cdn.example":  {Min: 60, Max: 120},
+		},
+	})
+
+	testCases := []struct {
+		name    string
+		host    string
+		ttl     uint32
+		wantTTL uint32
+	}{{
+		name:    "global_min",
+		host:    "other.example",
+		ttl:     5,
+		wantTTL: 10,
+	}, {
+		name:    "global_max",
+		host:    "other.example",
+		ttl:     7200,
+		wantTTL: 3600,
+	}, {
+		name:    "domain_max",
+		host:    "internal.example",
+		ttl:     600,
+		wantTTL: 30,
+	}, {
+		name:    "domain_no_min",
+		host:    "www.internal.example",
+		ttl:     5,
+		wantTTL: 5,
+	}, {
+		name:    "subdomain_min",
+		host:    "img.cdn.example",
+		ttl:     20,
+		wantTTL: 300,
+	}, {
+		name:    "domain_no_max",
+		host:    "cdn.example",
+		ttl:     7200,
+		wantTTL: 7200,
+	}, {
+		name:    "most_specific",
+		host:    "a.host.cdn.example",
+		ttl:     600,
+		wantTTL: 120,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			fqdn := dns.Fqdn(tc.host)
+			resp := (&dns.Msg{}).SetQuestion(fqdn, dns.TypeA)
+			resp.Answer = []dns.RR{&dns.A{
+				Hdr: dns.RR_Header{
+					Name:   fqdn,
+					Rrtype: dns.TypeA,
+					Class:  dns.ClassINET,
+					Ttl:    tc.ttl,
+				},
+				A: net.IP{192, 0, 2, 1},
+			}}
+
+			p.setMinMaxTTL(testutil.ContextWithTimeout(t, defaultTimeout), resp)
+			assert.Equal(t, tc.wantTTL, resp.Answer[0].Header().Ttl)
+		})
+	}
+}
+
+func TestNewDomainTTLs(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		ranges     map[string]TTLRange
+		want       map[string]TTLRange
+		name       string
+		wantErrMsg string
+	}{{
+		ranges:     nil,
+		want:       nil,
+		name:       "empty",
+		wantErrMsg: "",
+	}, {
+		ranges: map[string]TTLRange{
+			"Domain.Example.": {Min: 30, Max: 30},
+		},
+		want: map[string]TTLRange{
+			"domain.example": {Min: 30, Max: 30},
+		},
+		name:       "normalized",
+		wantErrMsg: "",
+	}, {
+		ranges: map[string]TTLRange{
+			"domain.example": {Min: 60, Max: 30},
+		},
+		want: nil,
+		name: "bad_range",
+		wantErrMsg: `domain "domain.example": min ttl 60: out of range: ` +
+			`must not be greater than max ttl 30`,
+	}, {
+		ranges: map[string]TTLRange{
+			"bad domain": {Max: 30},
+		},
+		want: nil,
+		name: "bad_domain",
+		wantErrMsg: `domain "bad domain": bad domain name "bad domain": ` +
+			`bad top-level domain name label "bad domain": ` +
+			`bad top-level domain name label rune ' '`,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			got, err := newDomainTTLs(tc.ranges)
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, err)
+			require.Equal(t, tc.want, got)
+		})
+	}
+}
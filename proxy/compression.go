@@ -0,0 +1,123 @@
+package proxy
+
+import (
+	"encoding"
+	"fmt"
+
+	"github.com/miekg/dns"
+)
+
+// CompressionMode is an enumeration of the modes of the name compression in
+// the responses.
+type CompressionMode string
+
+const (
+	// CompressionModeDefault makes the proxy always compress the names in the
+	// responses, since some devices require that.
+	CompressionModeDefault CompressionMode = ""
+
+	// CompressionModeAuto makes the proxy only compress the names in the
+	// responses, which wouldn't fit into the client's buffer otherwise.
+	CompressionModeAuto CompressionMode = "auto"
+
+	// CompressionModeNever makes the proxy never compress the names in the
+	// responses.  The responses are truncated according to their uncompressed
+	// size.
+	CompressionModeNever CompressionMode = "never"
+)
+
+// type check
+var _ encoding.TextUnmarshaler = (*CompressionMode)(nil)
+
+// UnmarshalText implements [encoding.TextUnmarshaler] interface for
+// *CompressionMode.
+func (m *CompressionMode) UnmarshalText(b []byte) (err error) {
+	switch cm := CompressionMode(b); cm {
+	case
+		CompressionModeDefault,
+		CompressionModeAuto,
+		CompressionModeNever:
+		*m = cm
+	default:
+		return fmt.Errorf(
+			"invalid compression mode %q, supported: %q, %q",
+			b,
+			CompressionModeAuto,
+			CompressionModeNever,
+		)
+	}
+
+	return nil
+}
+
+// fitResponse truncates resp, so that it fits into size bytes being packed
+// with the name compression allowed by mode, and sets the compression flag
+// accordingly.  The OPT record, if any, is kept and accounted.  resp must not be
+// nil.
+func fitResponse(resp *dns.Msg, size int, mode CompressionMode) {
+	switch mode {
+	case CompressionModeNever:
+		truncateUncompressed(resp, size)
+	case CompressionModeAuto:
+		// Truncate only enables the compression if the message doesn't fit
+		// without it.
+		resp.Truncate(size)
+	default:
+		resp.Truncate(size)
+		resp.Compress = true
+	}
+}
+
+// truncateUncompressed is like [dns.Msg.Truncate], but it never enables the
+// compression, and accounts the records by their uncompressed length.  resp
+// must not be nil.
+func truncateUncompressed(resp *dns.Msg, size int) {
+	resp.Compress = false
+
+	size = max(size, dns.MinMsgSize)
+	if resp.Len() <= size {
+		return
+	}
+
+	var opt *dns.OPT
+	extra := make([]dns.RR, 0, len(resp.Extra))
+	for _, rr := range resp.Extra {
+		if o, ok := rr.(*dns.OPT); ok && opt == nil {
+			opt = o
+			size -= dns.Len(o)
+
+			continue
+		}
+
+		extra = append(extra, rr)
+	}
+
+	l := (&dns.Msg{Question: resp.Question}).Len()
+
+	var truncated bool
+	for _, sec := range []*[]dns.RR{&resp.Answer, &resp.Ns, &extra} {
+		var n int
+		for _, rr := range *sec {
+			if l+dns.Len(rr) > size {
+				break
+			}
+
+			l += dns.Len(rr)
+			n++
+		}
+
+		truncated = truncated || n < len(*sec)
+		*sec = (*sec)[:n]
+		if truncated {
+			// Don't let the records of the following sections take the space
+			// of the omitted ones.
+			size = l
+		}
+	}
+
+	resp.Truncated = resp.Truncated || truncated
+	resp.Extra = extra
+	if opt != nil {
+		resp.Extra = append(resp.Extra, opt)
+	}
+}
@@ -0,0 +1,147 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newAliasChain returns a response for fqdn with a chain of n CNAME records
+// having long names ending with an A record.
+func newAliasChain(fqdn string, n int) (resp *dns.Msg) {
+	req := (&dns.Msg{}).SetQuestion(fqdn, dns.TypeA)
+	resp = (&dns.Msg{}).SetReply(req)
+
+	label := strings.Repeat("a", 60)
+	name := fqdn
+	for i := range n {
+		target := fmt.Sprintf("%s%d.%s.%s", label, i, label, fqdn)
+		resp.Answer = append(resp.Answer, &dns.CNAME{
+			Hdr:    dns.RR_Header{Name: name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET},
+			Target: target,
+		})
+		name = target
+	}
+
+	resp.Answer = append(resp.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET},
+		A:   net.IP{192, 0, 2, 1},
+	})
+
+	return resp
+}
+
+func TestFitResponse(t *testing.T) {
+	t.Parallel()
+
+	const fqdn = "alias.example."
+
+	testCases := []struct {
+		name         string
+		mode         CompressionMode
+		size         int
+		chainLen     int
+		edns         bool
+		wantCompress bool
+		wantTrunc    bool
+	}{{
+		name:         "default_small",
+		mode:         CompressionModeDefault,
+		size:         dns.MinMsgSize,
+		chainLen:     1,
+		edns:         false,
+		wantCompress: true,
+		wantTrunc:    false,
+	}, {
+		name:         "default_long_chain",
+		mode:         CompressionModeDefault,
+		size:         dns.MinMsgSize,
+		chainLen:     50,
+		edns:         false,
+		wantCompress: true,
+		wantTrunc:    true,
+	}, {
+		name:         "auto_small",
+		mode:         CompressionModeAuto,
+		size:         dns.MinMsgSize,
+		chainLen:     1,
+		edns:         false,
+		wantCompress: false,
+		wantTrunc:    false,
+	}, {
+		name:         "auto_compressible",
+		mode:         CompressionModeAuto,
+		size:         1232,
+		chainLen:     8,
+		edns:         true,
+		wantCompress: true,
+		wantTrunc:    false,
+	}, {
+		name:         "never_compressible",
+		mode:         CompressionModeNever,
+		size:         1232,
+		chainLen:     8,
+		edns:         true,
+		wantCompress: false,
+		wantTrunc:    true,
+	}, {
+		name:         "never_long_chain",
+		mode:         CompressionModeNever,
+		size:         dns.MinMsgSize,
+		chainLen:     50,
+		edns:         false,
+		wantCompress: false,
+		wantTrunc:    true,
+	}, {
+		name:         "never_tcp",
+		mode:         CompressionModeNever,
+		size:         dns.MaxMsgSize,
+		chainLen:     50,
+		edns:         false,
+		wantCompress: false,
+		wantTrunc:    false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			resp := newAliasChain(fqdn, tc.chainLen)
+			if tc.edns {
+				resp.SetEdns0(uint16(tc.size), false)
+			}
+
+			fitResponse(resp, tc.size, tc.mode)
+
+			assert.Equal(t, tc.wantCompress, resp.Compress)
+			assert.Equal(t, tc.wantTrunc, resp.Truncated)
+
+			b, err := resp.Pack()
+			require.NoError(t, err)
+
+			assert.LessOrEqual(t, len(b), tc.size)
+
+			if tc.edns {
+				assert.NotNil(t, resp.IsEdns0())
+			}
+		})
+	}
+}
+
+func TestCompressionMode_UnmarshalText(t *testing.T) {
+	t.Parallel()
+
+	var m CompressionMode
+	require.NoError(t, m.UnmarshalText([]byte("never")))
+	assert.Equal(t, CompressionModeNever, m)
+
+	require.NoError(t, m.UnmarshalText(nil))
+	assert.Equal(t, CompressionModeDefault, m)
+
+	assert.Error(t, m.UnmarshalText([]byte("bad")))
+}
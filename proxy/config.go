@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"log/slog"
 	"net"
+	"net/http"
 	"net/netip"
 	"net/url"
 	"time"
@@ -65,6 +66,11 @@ type Config struct {
 	// from this handler, the proxy will not send any response to the client.
 	RequestHandler Handler
 
+	// ResponseFilter is an optional post-processor of the responses received
+	// from the upstreams, which is called before those are cached and sent to
+	// the clients.  The responses served from the cache aren't filtered again.
+	ResponseFilter ResponseFilter
+
 	// UpstreamConfig is a general set of DNS servers to forward requests to.
 	UpstreamConfig *UpstreamConfig
 
@@ -93,6 +99,18 @@ type Config struct {
 	// retries are disabled.
 	BindRetryConfig *BindRetryConfig
 
+	// ConnLimits limits the client connections of the DNS-over-TLS and
+	// DNS-over-QUIC listeners.  If nil, only the default idle timeouts apply.
+	ConnLimits *ConnLimitsConfig
+
+	// UDPPacing smooths the bursts of the responses sent over UDP to the same
+	// client subnet.  If nil, the responses are sent right away.
+	UDPPacing *UDPPacingConfig
+
+	// ExchangeLog reduces the volume of the logs of the exchanges with the
+	// upstreams.  If nil, every exchange is logged.
+	ExchangeLog *ExchangeLogConfig
+
 	// HTTPConfig is the configuration for HTTP requests proxying.  Required for
 	// DoH server.  If nil, the DoH server is disabled.
 	HTTPConfig *HTTPConfig
@@ -105,6 +123,16 @@ type Config struct {
 	// If not specified the [proxy.UpstreamModeLoadBalance] is used.
 	UpstreamMode UpstreamMode
 
+	// ConsensusUpstreams is the number of upstreams queried for each request
+	// in [UpstreamModeConsensus].  If zero, all the upstreams for the domain
+	// are queried.
+	ConsensusUpstreams uint
+
+	// ConsensusQuorum is the number of the queried upstreams, which must agree
+	// on the response in [UpstreamModeConsensus].  If zero, the majority of
+	// the queried upstreams is required.
+	ConsensusQuorum uint
+
 	// UDPListenAddr is the set of UDP addresses to listen for plain
 	// DNS-over-UDP requests.
 	UDPListenAddr []*net.UDPAddr
@@ -129,16 +157,46 @@ type Config struct {
 	// requests.
 	DNSCryptTCPListenAddr []*net.TCPAddr
 
+	// ListenDSCP maps the protocols of the listeners to the Differentiated
+	// Services Code Points to mark the packets sent to the clients with, so
+	// that those could be prioritized by the network QoS policies.  The keys
+	// must be one of [ProtoUDP], [ProtoTCP], [ProtoTLS], [ProtoHTTPS], or
+	// [ProtoQUIC], the values must not be greater than 63.  The packets of
+	// HTTP/3 aren't marked.  Zero values and the missing protocols keep the
+	// default marking.
+	ListenDSCP map[Proto]uint8
+
 	// BogusNXDomain is the set of networks used to transform responses into
 	// NXDOMAIN ones if they contain at least a single IP address within these
 	// networks.  It's similar to dnsmasq's "bogus-nxdomain".
 	BogusNXDomain []netip.Prefix
 
+	// RebindingAllowedDomains are the domains, which along with their
+	// subdomains are allowed to resolve to internal addresses when
+	// RebindingProtection is enabled.
+	RebindingAllowedDomains []string
+
 	// DNS64Prefs is the set of NAT64 prefixes used for DNS64 handling.  nil
 	// value disables the feature.  An empty value will be interpreted as the
 	// default Well-Known Prefix.
 	DNS64Prefs []netip.Prefix
 
+	// RebindingProtection is the mode of the DNS rebinding protection, which
+	// filters the private, loopback, link-local, and unspecified addresses
+	// from the answers for the domains not in RebindingAllowedDomains.
+	RebindingProtection RebindingMode
+
+	// Compression is the mode of the name compression in the responses.
+	Compression CompressionMode
+
+	// Padding is the mode of padding the responses sent over DNS-over-TLS,
+	// DNS-over-HTTPS, and DNS-over-QUIC.
+	Padding PaddingMode
+
+	// AnswerOrder is the mode of ordering the A and AAAA records within the
+	// answers served from the cache.
+	AnswerOrder AnswerOrderMode
+
 	// EDNSAddr is the ECS IP used in request.
 	EDNSAddr net.IP
 
@@ -151,6 +209,13 @@ type Config struct {
 	// CacheMaxTTL is the maximum TTL for cached DNS responses in seconds.
 	CacheMaxTTL uint32
 
+	// CacheDomainTTLs maps the domain names to the TTL ranges of the responses
+	// for those and their subdomains.  The range of the most specific domain
+	// replaces both CacheMinTTL and CacheMaxTTL, e.g. to cache the answers for
+	// an internal zone for at most 30 seconds.  The ranges are applied before
+	// the responses are cached.
+	CacheDomainTTLs map[string]TTLRange
+
 	// CacheOptimisticAnswerTTL is the default TTL for expired cached responses.
 	// Default value is [DefaultOptimisticAnswerTTL].
 	CacheOptimisticAnswerTTL time.Duration
@@ -159,6 +224,12 @@ type Config struct {
 	// when cache is optimistic.  Default value is [DefaultOptimisticMaxAge].
 	CacheOptimisticMaxAge time.Duration
 
+	// MemoryLimit is the memory budget of the process in bytes.  Once the
+	// memory usage exceeds it, the cache is cleared, the responses aren't
+	// cached, and the new DNS-over-HTTPS connections are rejected until the
+	// usage falls below 90% of the budget.  Zero means no limit.
+	MemoryLimit uint64
+
 	// MaxGoroutines is the maximum number of goroutines processing DNS
 	// requests.  Important for mobile users.
 	//
@@ -166,6 +237,29 @@ type Config struct {
 	// in a later major version, as it doesn't actually limit all goroutines.
 	MaxGoroutines uint
 
+	// MaxUpstreamQueries is the maximum number of queries being sent to all
+	// the upstreams simultaneously.  Zero means no limit.
+	MaxUpstreamQueries uint
+
+	// MaxQueriesPerUpstream is the maximum number of queries being sent to a
+	// single upstream simultaneously.  Zero means no limit.
+	MaxQueriesPerUpstream uint
+
+	// UpstreamQueueTimeout is the maximum time a query waits for the limits
+	// set by MaxUpstreamQueries and MaxQueriesPerUpstream before failing with
+	// [ErrUpstreamBusy].  If zero, the default value of 1 second is used.
+	UpstreamQueueTimeout time.Duration
+
+	// TLSSessionTicketLifetime is the maximum age of the TLS session tickets
+	// accepted by the DNS-over-TLS listeners to resume the sessions.  Zero
+	// means the default of crypto/tls, which is 7 days.
+	TLSSessionTicketLifetime time.Duration
+
+	// LogSampleRate is N in logging the detailed contents of only 1 in N DNS
+	// messages at debug level.  It allows deep logging at high rates of queries
+	// without excessive output.  Zero and one mean logging every message.
+	LogSampleRate uint
+
 	// The size of the read buffer on the underlying socket.  Larger read
 	// buffers can handle larger bursts of requests before packets get dropped.
 	UDPBufferSize int
@@ -175,9 +269,47 @@ type Config struct {
 	// Non-positive value will be replaced with the default one.
 	FastestPingTimeout time.Duration
 
+	// MalformedQueryActions are the actions taken on the malformed queries by
+	// protocol of the listener.  The protocols not present in the map use
+	// [MalformedActionDefault].
+	MalformedQueryActions map[Proto]MalformedAction
+
+	// UpstreamFaults are the faults injected into the responses of the
+	// upstreams and fallbacks.  The dropped responses are reported as errors
+	// wrapping [ErrFaultInjected].  If nil, no faults are injected.  It must
+	// only be used for testing.
+	UpstreamFaults *Faults
+
+	// ClientFaults are the faults injected into the DNS messages received from
+	// the clients.  Dropping a message received over TCP or TLS skips it
+	// without closing the connection, and dropping a DoH request aborts its
+	// response.  If nil, no faults are injected.  It must only be used for
+	// testing.
+	ClientFaults *Faults
+
+	// MinimizeAnswers makes proxy remove the authority and additional sections
+	// from the responses to clients, except for the OPT pseudo-record and the
+	// SOA records of the negative responses.
+	MinimizeAnswers bool
+
 	// RefuseAny makes proxy refuse the requests of type ANY.
 	RefuseAny bool
 
+	// LogRejectedQueries makes the proxy log each query it refuses or drops
+	// along with the reason, see [RejectReason].  The rejected queries are
+	// counted regardless, see [Proxy.RejectStats].
+	LogRejectedQueries bool
+
+	// TLSSessionTicketsDisabled makes the DNS-over-TLS listeners neither issue
+	// nor accept the TLS session tickets, so that each connection requires a
+	// full handshake.
+	TLSSessionTicketsDisabled bool
+
+	// TLSFingerprinting makes proxy compute the fingerprints of the TLS
+	// ClientHello messages of DNS-over-TLS, DNS-over-HTTPS, and DNS-over-QUIC
+	// clients, see [DNSContext.TLSFingerprint].
+	TLSFingerprinting bool
+
 	// DNSSECEnabled specifies if the proxy should set the DO bits in the
 	// upstream requests.
 	DNSSECEnabled bool
@@ -210,6 +342,18 @@ type Config struct {
 	// CacheOptimistic defines if the optimistic cache mechanism should be used.
 	CacheOptimistic bool
 
+	// CacheFixedTTL makes the proxy serve the cached responses with the TTLs
+	// received from the upstream instead of decreasing those by the time spent
+	// in the cache.  It's only useful for the setups where the clients don't
+	// cache the responses themselves.
+	CacheFixedTTL bool
+
+	// CacheAggressiveNSEC makes the proxy synthesize NXDOMAIN responses from
+	// the NSEC and NSEC3 records of the cached NXDOMAIN responses validated by
+	// the upstreams, see RFC 8198.  It requires both CacheEnabled and
+	// DNSSECEnabled.
+	CacheAggressiveNSEC bool
+
 	// UseDNS64 enables DNS64 handling.  If true, proxy will translate IPv4
 	// answers into IPv6 answers using first of DNS64Prefs.  Note also that PTR
 	// requests for addresses within the specified networks are considered
@@ -241,10 +385,36 @@ type HTTPConfig struct {
 	// authentication information.
 	Userinfo *url.Userinfo
 
+	// HTTP2 configures the HTTP/2 server, e.g. its buffers.  If nil, the
+	// defaults of net/http are used.  It is ignored if ListenAddresses is
+	// empty.
+	HTTP2 *http.HTTP2Config
+
 	// ServerHeader sets the Server header of the HTTPS server responses, if not
 	// empty.
 	ServerHeader string
 
+	// RequiredHeaders are the headers each DoH request must contain.  If the
+	// list of values for a header isn't empty, one of the comma-separated
+	// values of the request header must be equal to one of them, ignoring the
+	// case and the parameters, e.g. "Accept: application/dns-message".  The
+	// requests failing the check are answered with [http.StatusBadRequest].
+	RequiredHeaders http.Header
+
+	// RejectedHeaders are the names of the headers, the DoH requests containing
+	// any of which are answered with [http.StatusBadRequest], e.g. "Cookie".
+	RejectedHeaders []string
+
+	// ResponseHeaders are added to every response of the DoH server, including
+	// the error ones, e.g. "Strict-Transport-Security".  The Server and
+	// Content-Type headers set by the server itself take precedence.
+	ResponseHeaders http.Header
+
+	// CORSAllowedOrigins are the origins of the browser-based DoH clients
+	// allowed to access the server, "*" allows any origin.  If empty, CORS
+	// isn't handled.
+	CORSAllowedOrigins []string
+
 	// ListenAddresses is the set of addresses to listen for DNS-over-HTTPS
 	// requests.  If it is empty the proxy doesn't start the HTTPS server, but
 	// still can be used as an http.Handler with [Proxy.ServeHTTP].
@@ -265,6 +435,13 @@ type HTTPConfig struct {
 	// is ignored if ListenAddresses is empty.
 	WriteTimeout time.Duration
 
+	// MaxRequestSize is the maximum size of the DNS message in a DoH request,
+	// in bytes.  The GET requests with longer dns parameters are answered with
+	// [http.StatusRequestURITooLong], and the POST requests with larger bodies
+	// are answered with [http.StatusRequestEntityTooLarge].  If zero,
+	// [dns.MaxMsgSize] is used.
+	MaxRequestSize uint16
+
 	// HTTP3Enabled specifies if HTTP/3 support for HTTPS server.  It is ignored
 	// if ListenAddresses is empty.
 	HTTP3Enabled bool
@@ -300,6 +477,8 @@ func (p *Proxy) validateConfig() (err error) {
 	switch p.UpstreamMode {
 	case
 		"",
+		UpstreamModeBestP95,
+		UpstreamModeConsensus,
 		UpstreamModeFastestAddr,
 		UpstreamModeLoadBalance,
 		UpstreamModeParallel:
@@ -308,6 +487,115 @@ func (p *Proxy) validateConfig() (err error) {
 		return fmt.Errorf("upstream mode: %w: %q", errors.ErrBadEnumValue, p.UpstreamMode)
 	}
 
+	if n := p.ConsensusUpstreams; n > 0 && p.ConsensusQuorum > n {
+		return fmt.Errorf(
+			"consensus quorum: %w: %d is greater than consensus upstreams %d",
+			errors.ErrOutOfRange,
+			p.ConsensusQuorum,
+			n,
+		)
+	}
+
+	switch p.RebindingProtection {
+	case
+		RebindingModeDisabled,
+		RebindingModeStrip,
+		RebindingModeNXDOMAIN:
+		// Go on.
+	default:
+		return fmt.Errorf(
+			"rebinding protection: %w: %q",
+			errors.ErrBadEnumValue,
+			p.RebindingProtection,
+		)
+	}
+
+	switch p.Compression {
+	case
+		CompressionModeDefault,
+		CompressionModeAuto,
+		CompressionModeNever:
+		// Go on.
+	default:
+		return fmt.Errorf("compression: %w: %q", errors.ErrBadEnumValue, p.Compression)
+	}
+
+	switch p.Padding {
+	case
+		PaddingModeDisabled,
+		PaddingModeRequested,
+		PaddingModeAlways:
+		// Go on.
+	default:
+		return fmt.Errorf("padding: %w: %q", errors.ErrBadEnumValue, p.Padding)
+	}
+
+	switch p.AnswerOrder {
+	case
+		AnswerOrderModeDefault,
+		AnswerOrderModeRoundRobin,
+		AnswerOrderModeRandom:
+		// Go on.
+	default:
+		return fmt.Errorf("answer order: %w: %q", errors.ErrBadEnumValue, p.AnswerOrder)
+	}
+
+	err = validateListenDSCP(p.ListenDSCP)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return err
+	}
+
+	err = p.UpstreamFaults.validate()
+	if err != nil {
+		return fmt.Errorf("upstream faults: %w", err)
+	}
+
+	err = p.ClientFaults.validate()
+	if err != nil {
+		return fmt.Errorf("client faults: %w", err)
+	}
+
+	err = p.UDPPacing.validate()
+	if err != nil {
+		return fmt.Errorf("udp pacing: %w", err)
+	}
+
+	err = p.ExchangeLog.validate()
+	if err != nil {
+		return fmt.Errorf("exchange log: %w", err)
+	}
+
+	if p.ConnLimits != nil && p.ConnLimits.IdleTimeout < 0 {
+		return fmt.Errorf(
+			"connection idle timeout: %w: %s",
+			errors.ErrNegative,
+			p.ConnLimits.IdleTimeout,
+		)
+	}
+
+	if p.TLSSessionTicketLifetime < 0 {
+		return fmt.Errorf(
+			"tls session ticket lifetime: %w: %s",
+			errors.ErrNegative,
+			p.TLSSessionTicketLifetime,
+		)
+	}
+
+	if p.CacheAggressiveNSEC && !(p.CacheEnabled && p.DNSSECEnabled) {
+		return errors.Error("aggressive nsec caching requires both cache and dnssec enabled")
+	}
+
+	p.rebindingAllowlist, err = newRebindingAllowlist(p.RebindingAllowedDomains)
+	if err != nil {
+		return fmt.Errorf("rebinding allowed domains: %w", err)
+	}
+
+	p.domainTTLs, err = newDomainTTLs(p.CacheDomainTTLs)
+	if err != nil {
+		return fmt.Errorf("cache domain ttls: %w", err)
+	}
+
 	err = p.validateBasicAuth()
 	if err != nil {
 		return fmt.Errorf("basic auth: %w", err)
@@ -324,17 +612,94 @@ func (p *Proxy) logConfigInfo() {
 		p.logger.Info("cache ttl override is enabled", "min", p.CacheMinTTL, "max", p.CacheMaxTTL)
 	}
 
+	if len(p.domainTTLs) > 0 {
+		p.logger.Info("cache ttl overrides for domains are enabled", "domains", len(p.domainTTLs))
+	}
+
+	if p.CacheFixedTTL {
+		p.logger.Info("cached responses are served with fixed ttls")
+	}
+
 	if p.RefuseAny {
 		p.logger.Info("server will refuse requests of type any")
 	}
 
+	if p.UpstreamFaults != nil {
+		p.logger.Warn("fault injection into upstream responses is enabled")
+	}
+
+	if p.ClientFaults != nil {
+		p.logger.Warn("fault injection into client packets is enabled")
+	}
+
 	if len(p.BogusNXDomain) > 0 {
 		p.logger.Info("bogus-nxdomain ip specified", "prefix_len", len(p.BogusNXDomain))
 	}
 
+	if p.RebindingProtection != RebindingModeDisabled {
+		p.logger.Info("dns rebinding protection is enabled", "mode", p.RebindingProtection)
+	}
+
 	if p.UpstreamMode != "" {
 		p.logger.Info("upstream mode is set", "mode", p.UpstreamMode)
 	}
+
+	if p.Compression != CompressionModeDefault {
+		p.logger.Info("name compression mode is set", "mode", p.Compression)
+	}
+
+	if p.Padding != PaddingModeDisabled {
+		p.logger.Info("response padding is enabled", "mode", p.Padding)
+	}
+
+	if p.AnswerOrder != AnswerOrderModeDefault {
+		p.logger.Info("cached answers are reordered", "mode", p.AnswerOrder)
+	}
+
+	if c := p.ConnLimits; c != nil {
+		p.logger.Info(
+			"connection limits are set",
+			"max_conns", c.MaxConns,
+			"max_conns_per_client", c.MaxConnsPerClient,
+			"max_queries_per_conn", c.MaxQueriesPerConn,
+			"idle_timeout", c.IdleTimeout,
+		)
+	}
+
+	if c := p.UDPPacing; c != nil {
+		p.logger.Info(
+			"udp response pacing is enabled",
+			"rate", c.Rate,
+			"burst", c.Burst,
+			"max_delay", c.MaxDelay,
+		)
+	}
+
+	if p.LogRejectedQueries {
+		p.logger.Info("rejected queries are logged")
+	}
+
+	if c := p.ExchangeLog; c != nil {
+		p.logger.Info(
+			"exchange log volume is reduced",
+			"error_summary_interval", c.ErrorSummaryInterval,
+			"quiet_success", c.QuietSuccess,
+		)
+	}
+
+	if p.TLSSessionTicketsDisabled {
+		p.logger.Info("tls session tickets are disabled")
+	} else if p.TLSSessionTicketLifetime > 0 {
+		p.logger.Info("tls session ticket lifetime is set", "lifetime", p.TLSSessionTicketLifetime)
+	}
+
+	if p.TLSFingerprinting {
+		p.logger.Info("tls client fingerprinting is enabled")
+	}
+
+	if p.CacheAggressiveNSEC {
+		p.logger.Info("aggressive nsec caching is enabled")
+	}
 }
 
 // validateListenAddrs returns an error if the addresses are not configured
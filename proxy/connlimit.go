@@ -0,0 +1,131 @@
+package proxy
+
+import (
+	"cmp"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// ConnLimitsConfig is the configuration of the limits on the client
+// connections of the DNS-over-TLS and DNS-over-QUIC listeners.  The limits
+// apply to each listener separately.
+type ConnLimitsConfig struct {
+	// IdleTimeout is the time a client connection may stay without queries
+	// before it's closed.  If zero, the default of 10 seconds is used for
+	// DNS-over-TLS and 30 seconds for DNS-over-QUIC.  DNS-over-QUIC
+	// connections are closed after 30 seconds of inactivity anyway.
+	IdleTimeout time.Duration
+
+	// MaxConns is the maximum number of the concurrent client connections.
+	// Zero means no limit.
+	MaxConns uint
+
+	// MaxConnsPerClient is the maximum number of the concurrent connections
+	// from a single IP address.  Zero means no limit.
+	MaxConnsPerClient uint
+
+	// MaxQueriesPerConn is the maximum number of queries handled within a
+	// single connection, after which the connection is closed.  Zero means no
+	// limit.
+	MaxQueriesPerConn uint
+}
+
+// connLimiter counts the client connections of a single listener.  A nil
+// *connLimiter allows all connections.
+type connLimiter struct {
+	// mu protects total and perClient.
+	mu *sync.Mutex
+
+	// perClient is the number of connections by the client address.
+	perClient map[netip.Addr]uint
+
+	// total is the number of connections.
+	total uint
+
+	// max is the maximum number of connections.  Zero means no limit.
+	max uint
+
+	// maxPerClient is the maximum number of connections from a single
+	// address.  Zero means no limit.
+	maxPerClient uint
+}
+
+// newConnLimiter returns a new limiter of the listener's connections, or nil
+// if the connections aren't limited.
+func (p *Proxy) newConnLimiter() (l *connLimiter) {
+	c := p.ConnLimits
+	if c == nil || (c.MaxConns == 0 && c.MaxConnsPerClient == 0) {
+		return nil
+	}
+
+	return &connLimiter{
+		mu:           &sync.Mutex{},
+		perClient:    map[netip.Addr]uint{},
+		max:          c.MaxConns,
+		maxPerClient: c.MaxConnsPerClient,
+	}
+}
+
+// acquire returns true and accounts the connection from addr, if it doesn't
+// exceed the limits.  l may be nil.
+func (l *connLimiter) acquire(addr netip.Addr) (ok bool) {
+	if l == nil {
+		return true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.max > 0 && l.total >= l.max {
+		return false
+	}
+
+	n := l.perClient[addr]
+	if l.maxPerClient > 0 && n >= l.maxPerClient {
+		return false
+	}
+
+	l.total++
+	l.perClient[addr] = n + 1
+
+	return true
+}
+
+// release removes the connection from addr previously accounted by
+// [connLimiter.acquire].  l may be nil.
+func (l *connLimiter) release(addr netip.Addr) {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.total--
+	if n := l.perClient[addr]; n > 1 {
+		l.perClient[addr] = n - 1
+	} else {
+		delete(l.perClient, addr)
+	}
+}
+
+// connIdleTimeout returns the idle timeout of the client connections, def is
+// the default one for the protocol.
+func (p *Proxy) connIdleTimeout(def time.Duration) (timeout time.Duration) {
+	if p.ConnLimits == nil {
+		return def
+	}
+
+	return cmp.Or(p.ConnLimits.IdleTimeout, def)
+}
+
+// maxQueriesPerConn returns the maximum number of queries within a single
+// client connection.  Zero means no limit.
+func (p *Proxy) maxQueriesPerConn() (n uint) {
+	if p.ConnLimits == nil {
+		return 0
+	}
+
+	return p.ConnLimits.MaxQueriesPerConn
+}
@@ -0,0 +1,113 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/AdguardTeam/golibs/testutil/servicetest"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnLimiter(t *testing.T) {
+	t.Parallel()
+
+	p := &Proxy{Config: Config{ConnLimits: &ConnLimitsConfig{
+		MaxConns:          3,
+		MaxConnsPerClient: 2,
+	}}}
+	lim := p.newConnLimiter()
+	require.NotNil(t, lim)
+
+	var (
+		addr1 = netip.MustParseAddr("192.0.2.1")
+		addr2 = netip.MustParseAddr("192.0.2.2")
+		addr3 = netip.MustParseAddr("192.0.2.3")
+	)
+
+	assert.True(t, lim.acquire(addr1))
+	assert.True(t, lim.acquire(addr1))
+	assert.False(t, lim.acquire(addr1))
+
+	assert.True(t, lim.acquire(addr2))
+	assert.False(t, lim.acquire(addr3))
+
+	lim.release(addr1)
+	assert.True(t, lim.acquire(addr3))
+	assert.False(t, lim.acquire(addr2))
+
+	lim.release(addr1)
+	lim.release(addr2)
+	lim.release(addr3)
+	assert.Zero(t, lim.total)
+	assert.Empty(t, lim.perClient)
+
+	t.Run("disabled", func(t *testing.T) {
+		t.Parallel()
+
+		noLim := (&Proxy{}).newConnLimiter()
+		require.Nil(t, noLim)
+
+		assert.True(t, noLim.acquire(addr1))
+		noLim.release(addr1)
+	})
+}
+
+func TestProxy_tlsConnLimits(t *testing.T) {
+	serverConfig, caPem := newTLSConfig(t)
+	p := mustNew(t, &Config{
+		Logger:         testLogger,
+		TLSListenAddr:  []*net.TCPAddr{net.TCPAddrFromAddrPort(localhostAnyPort)},
+		TLSConfig:      serverConfig,
+		UpstreamConfig: newTestUpstreamConfig(t, defaultTimeout, testDefaultUpstreamAddr),
+		TrustedProxies: defaultTrustedProxies,
+		RequestHandler: newReplyingHandler(),
+		ConnLimits: &ConnLimitsConfig{
+			MaxConnsPerClient: 1,
+			MaxQueriesPerConn: 2,
+		},
+	})
+
+	servicetest.RequireRun(t, p, testTimeout)
+
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(caPem)
+	tlsConfig := &tls.Config{ServerName: tlsServerName, RootCAs: roots}
+
+	addr := p.Addr(ProtoTLS).String()
+	conn, err := dns.DialWithTLS("tcp-tls", addr, tlsConfig)
+	require.NoError(t, err)
+
+	// The server closes the connection itself, so the error is expected.
+	t.Cleanup(func() { _ = conn.Close() })
+
+	require.NoError(t, conn.WriteMsg(newTestMessage()))
+
+	_, err = conn.ReadMsg()
+	require.NoError(t, err)
+
+	other, err := dns.DialWithTLS("tcp-tls", addr, tlsConfig)
+	if err == nil {
+		// The TLS 1.3 handshake may finish on the client before the server
+		// closes the connection.
+		_, err = other.ReadMsg()
+		_ = other.Close()
+	}
+
+	assert.Error(t, err)
+
+	require.NoError(t, conn.WriteMsg(newTestMessage()))
+
+	_, err = conn.ReadMsg()
+	require.NoError(t, err)
+
+	// The connection is closed after MaxQueriesPerConn queries.
+	_ = conn.WriteMsg(newTestMessage())
+
+	_, err = conn.ReadMsg()
+	assert.Error(t, err)
+}
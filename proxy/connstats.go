@@ -0,0 +1,57 @@
+package proxy
+
+import (
+	"iter"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+)
+
+// UpstreamConnStats returns the connection statistics of the configured
+// upstreams, fallbacks, and private reverse DNS upstreams by their addresses.
+// Only the upstreams implementing [upstream.ConnStatsReporter] are included.
+func (p *Proxy) UpstreamConnStats() (stats map[string]*upstream.ConnStats) {
+	stats = map[string]*upstream.ConnStats{}
+	for _, uc := range []*UpstreamConfig{
+		p.UpstreamConfig,
+		p.PrivateRDNSUpstreamConfig,
+		p.Fallbacks,
+	} {
+		if uc == nil {
+			continue
+		}
+
+		for u := range uc.all() {
+			r, ok := u.(upstream.ConnStatsReporter)
+			if ok {
+				stats[u.Address()] = r.ConnStats()
+			}
+		}
+	}
+
+	return stats
+}
+
+// all returns an iterator over all the upstreams of uc, including the
+// domain-specific ones.  The same upstream may be yielded several times.
+func (uc *UpstreamConfig) all() (seq iter.Seq[upstream.Upstream]) {
+	return func(yield func(u upstream.Upstream) (cont bool)) {
+		for _, u := range uc.Upstreams {
+			if !yield(u) {
+				return
+			}
+		}
+
+		for _, specUps := range []map[string][]upstream.Upstream{
+			uc.DomainReservedUpstreams,
+			uc.SpecifiedDomainUpstreams,
+		} {
+			for _, ups := range specUps {
+				for _, u := range ups {
+					if !yield(u) {
+						return
+					}
+				}
+			}
+		}
+	}
+}
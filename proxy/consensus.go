@@ -0,0 +1,142 @@
+package proxy
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/miekg/dns"
+	"gonum.org/v1/gonum/stat/sampleuv"
+)
+
+// errNoConsensus is returned in [UpstreamModeConsensus] when not enough
+// upstreams agree on the response.
+const errNoConsensus errors.Error = "no consensus among upstreams"
+
+// exchangeConsensus resolves req using [Config.ConsensusUpstreams] of ups and
+// returns the response only if at least [Config.ConsensusQuorum] of them agree
+// on it.  Otherwise, it returns an error wrapping [errNoConsensus].
+func (p *Proxy) exchangeConsensus(
+	req *dns.Msg,
+	ups []upstream.Upstream,
+) (resp *dns.Msg, u upstream.Upstream, err error) {
+	selected := p.selectConsensusUpstreams(ups)
+	quorum := int(p.ConsensusQuorum)
+	if quorum == 0 {
+		quorum = len(selected)/2 + 1
+	}
+
+	if quorum > len(selected) {
+		return nil, nil, fmt.Errorf(
+			"%w: quorum %d is greater than the number of upstreams %d",
+			errNoConsensus,
+			quorum,
+			len(selected),
+		)
+	}
+
+	results, err := upstream.ExchangeAll(selected, req)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %w", errNoConsensus, err)
+	}
+
+	// firstIdx is the index of the first result having the key, so that the
+	// earliest response is returned.
+	firstIdx := map[string]int{}
+	votes := map[string]int{}
+	best := ""
+	for i, r := range results {
+		key := consensusKey(r.Resp)
+		if _, ok := firstIdx[key]; !ok {
+			firstIdx[key] = i
+		}
+
+		votes[key]++
+		if votes[key] > votes[best] {
+			best = key
+		}
+	}
+
+	if votes[best] < quorum {
+		return nil, nil, fmt.Errorf(
+			"%w: %d of %d upstreams agree, need %d",
+			errNoConsensus,
+			votes[best],
+			len(selected),
+			quorum,
+		)
+	}
+
+	r := results[firstIdx[best]]
+
+	return r.Resp, r.Upstream, nil
+}
+
+// selectConsensusUpstreams returns [Config.ConsensusUpstreams] of ups chosen
+// the same way [UpstreamModeLoadBalance] does, or all of ups if it's zero.
+func (p *Proxy) selectConsensusUpstreams(ups []upstream.Upstream) (selected []upstream.Upstream) {
+	k := int(p.ConsensusUpstreams)
+	if k == 0 || k >= len(ups) {
+		return ups
+	}
+
+	selected = make([]upstream.Upstream, 0, k)
+	next := sampleuv.NewWeighted(p.calcWeights(ups), p.randSrc).Take
+	for i, ok := next(); ok && len(selected) < k; i, ok = next() {
+		selected = append(selected, ups[i])
+	}
+
+	return selected
+}
+
+// consensusKey returns the normalized form of resp, which is the same for all
+// the responses agreeing on the answer.  It consists of the response code and
+// the answer RRset, ignoring the order of the records, the TTLs, and the case
+// of the owner names.  The signatures are ignored as well, since those may
+// legitimately differ between the servers of a zone.
+func consensusKey(resp *dns.Msg) (key string) {
+	rrs := make([]string, 0, len(resp.Answer))
+	for _, rr := range resp.Answer {
+		if rr.Header().Rrtype == dns.TypeRRSIG {
+			continue
+		}
+
+		rr = dns.Copy(rr)
+		hdr := rr.Header()
+		hdr.Name = strings.ToLower(hdr.Name)
+		hdr.Ttl = 0
+
+		rrs = append(rrs, rr.String())
+	}
+
+	slices.Sort(rrs)
+	rrs = slices.Compact(rrs)
+
+	return dns.RcodeToString[resp.Rcode] + "\n" + strings.Join(rrs, "\n")
+}
+
+// addConsensusEDE adds the Extended DNS Error explaining the server failure
+// response to d.Res when the upstreams fail to agree on the response.  It only
+// does that if the request has an OPT record.
+//
+// See https://datatracker.ietf.org/doc/html/rfc8914.
+func (d *DNSContext) addConsensusEDE() {
+	if d.Req == nil || d.Res == nil || d.Req.IsEdns0() == nil {
+		return
+	}
+
+	d.calcFlagsAndSize()
+
+	opt := d.Res.IsEdns0()
+	if opt == nil {
+		d.Res.SetEdns0(d.udpSize, d.doBit)
+		opt = d.Res.IsEdns0()
+	}
+
+	opt.Option = append(opt.Option, &dns.EDNS0_EDE{
+		InfoCode:  dns.ExtendedErrorCodeOther,
+		ExtraText: string(errNoConsensus),
+	})
+}
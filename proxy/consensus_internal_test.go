@@ -0,0 +1,206 @@
+package proxy
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/internal/dnsproxytest"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newConsensusUpstream returns an upstream responding with the A records of
+// the given IPs, or with an error if ips is nil.  name is used as the owner
+// name of the records and ttl as their TTL.
+func newConsensusUpstream(addr, name string, ttl uint32, ips ...string) (u upstream.Upstream) {
+	return &dnsproxytest.Upstream{
+		OnExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+			if ips == nil {
+				return nil, assert.AnError
+			}
+
+			resp = (&dns.Msg{}).SetReply(req)
+			for _, ip := range ips {
+				resp.Answer = append(resp.Answer, &dns.A{
+					Hdr: dns.RR_Header{
+						Name:   name,
+						Rrtype: dns.TypeA,
+						Class:  dns.ClassINET,
+						Ttl:    ttl,
+					},
+					A: net.ParseIP(ip),
+				})
+			}
+
+			return resp, nil
+		},
+		OnAddress: func() (a string) { return addr },
+		OnClose:   func() (_ error) { panic(testutil.UnexpectedCall()) },
+	}
+}
+
+func TestProxy_Resolve_consensus(t *testing.T) {
+	t.Parallel()
+
+	const (
+		ip1 = "192.0.2.1"
+		ip2 = "192.0.2.2"
+		ip3 = "192.0.2.3"
+	)
+
+	var (
+		honest     = newConsensusUpstream("honest", "example.org.", 60, ip1, ip2)
+		reordered  = newConsensusUpstream("reordered", "EXAMPLE.org.", 30, ip2, ip1)
+		liar       = newConsensusUpstream("liar", "example.org.", 60, ip3)
+		failing    = newConsensusUpstream("failing", "example.org.", 60)
+		otherLiar  = newConsensusUpstream("other_liar", "example.org.", 60, ip2)
+		allHonest  = []upstream.Upstream{honest, reordered}
+		oneLiar    = []upstream.Upstream{honest, reordered, liar}
+		allDiffer  = []upstream.Upstream{honest, liar, otherLiar}
+		withFailed = []upstream.Upstream{honest, failing}
+	)
+
+	testCases := []struct {
+		name      string
+		ups       []upstream.Upstream
+		quorum    uint
+		wantRcode int
+	}{{
+		name:      "agree",
+		ups:       allHonest,
+		quorum:    0,
+		wantRcode: dns.RcodeSuccess,
+	}, {
+		name:      "majority",
+		ups:       oneLiar,
+		quorum:    0,
+		wantRcode: dns.RcodeSuccess,
+	}, {
+		name:      "unanimity",
+		ups:       oneLiar,
+		quorum:    3,
+		wantRcode: dns.RcodeServerFailure,
+	}, {
+		name:      "disagree",
+		ups:       allDiffer,
+		quorum:    0,
+		wantRcode: dns.RcodeServerFailure,
+	}, {
+		name:      "failed",
+		ups:       withFailed,
+		quorum:    0,
+		wantRcode: dns.RcodeServerFailure,
+	}, {
+		name:      "quorum_too_big",
+		ups:       allHonest,
+		quorum:    3,
+		wantRcode: dns.RcodeServerFailure,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			p := mustNew(t, &Config{
+				Logger: testLogger,
+				UpstreamConfig: &UpstreamConfig{
+					Upstreams: tc.ups,
+				},
+				Fallbacks: &UpstreamConfig{
+					Upstreams: []upstream.Upstream{liar},
+				},
+				TrustedProxies:  defaultTrustedProxies,
+				UpstreamMode:    UpstreamModeConsensus,
+				ConsensusQuorum: tc.quorum,
+			})
+
+			req := (&dns.Msg{}).SetQuestion("example.org.", dns.TypeA)
+			req.SetEdns0(dns.DefaultMsgSize, false)
+
+			d := &DNSContext{
+				Req: req,
+			}
+
+			err := p.Resolve(testutil.ContextWithTimeout(t, defaultTimeout), d)
+			require.NotNil(t, d.Res)
+			require.Equal(t, tc.wantRcode, d.Res.Rcode)
+
+			if tc.wantRcode == dns.RcodeSuccess {
+				require.NoError(t, err)
+
+				assert.Len(t, d.Res.Answer, 2)
+
+				return
+			}
+
+			assert.ErrorIs(t, err, errNoConsensus)
+
+			opt := d.Res.IsEdns0()
+			require.NotNil(t, opt)
+			require.Len(t, opt.Option, 1)
+
+			ede := testutil.RequireTypeAssert[*dns.EDNS0_EDE](t, opt.Option[0])
+			assert.Equal(t, dns.ExtendedErrorCodeOther, ede.InfoCode)
+			assert.Equal(t, string(errNoConsensus), ede.ExtraText)
+		})
+	}
+}
+
+func TestProxy_selectConsensusUpstreams(t *testing.T) {
+	t.Parallel()
+
+	ups := []upstream.Upstream{
+		newConsensusUpstream("a", "example.org.", 60),
+		newConsensusUpstream("b", "example.org.", 60),
+		newConsensusUpstream("c", "example.org.", 60),
+	}
+
+	p := &Proxy{}
+	assert.Equal(t, ups, p.selectConsensusUpstreams(ups))
+
+	p.ConsensusUpstreams = 2
+	selected := p.selectConsensusUpstreams(ups)
+	require.Len(t, selected, 2)
+	assert.NotSame(t, selected[0], selected[1])
+	assert.Subset(t, ups, selected)
+}
+
+func TestConsensusKey(t *testing.T) {
+	t.Parallel()
+
+	req := (&dns.Msg{}).SetQuestion("example.org.", dns.TypeA)
+	exchange := func(u upstream.Upstream) (resp *dns.Msg) {
+		resp, err := u.Exchange(req)
+		require.NoError(t, err)
+
+		return resp
+	}
+
+	a := exchange(newConsensusUpstream("a", "example.org.", 60, "192.0.2.1", "192.0.2.2"))
+	b := exchange(newConsensusUpstream("b", "Example.ORG.", 10, "192.0.2.2", "192.0.2.1"))
+	c := exchange(newConsensusUpstream("c", "example.org.", 60, "192.0.2.1"))
+
+	b.Answer = append(b.Answer, &dns.RRSIG{
+		Hdr: dns.RR_Header{
+			Name:   "example.org.",
+			Rrtype: dns.TypeRRSIG,
+			Class:  dns.ClassINET,
+		},
+		TypeCovered: dns.TypeA,
+	})
+
+	assert.Equal(t, consensusKey(a), consensusKey(b))
+	assert.NotEqual(t, consensusKey(a), consensusKey(c))
+
+	// The original records must be kept intact.
+	assert.Equal(t, "Example.ORG.", b.Answer[0].Header().Name)
+	assert.True(t, strings.HasPrefix(consensusKey(a), "NOERROR\n"))
+
+	c.Rcode = dns.RcodeNameError
+	c.Answer = nil
+	assert.NotEqual(t, consensusKey(a), consensusKey(c))
+}
@@ -0,0 +1,127 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"strconv"
+
+	"github.com/miekg/dns"
+)
+
+// KeyCorrelationID is the logging attribute key for the correlation IDs of the
+// requests, see [DNSContext.CorrelationID].
+const KeyCorrelationID = "cid"
+
+// correlationIDKey is the context key for the correlation ID of a request.
+type correlationIDKey struct{}
+
+// ContextWithCorrelationID returns a copy of parent carrying the correlation ID
+// of a request.
+func ContextWithCorrelationID(parent context.Context, id string) (ctx context.Context) {
+	return context.WithValue(parent, correlationIDKey{}, id)
+}
+
+// CorrelationIDFromContext returns the correlation ID of a request carried by
+// ctx, if any.
+func CorrelationIDFromContext(ctx context.Context) (id string, ok bool) {
+	id, ok = ctx.Value(correlationIDKey{}).(string)
+
+	return id, ok
+}
+
+// newCorrelationPrefix returns a random prefix for the correlation IDs of the
+// requests, which makes those unique across the restarts and the instances of
+// the proxy.
+func newCorrelationPrefix() (prefix string) {
+	return fmt.Sprintf("%08x", rand.Uint32())
+}
+
+// newCorrelationID returns the correlation ID for the request with the given
+// opaque identifier.
+func (p *Proxy) newCorrelationID(reqID uint64) (id string) {
+	return p.correlationPrefix + "-" + strconv.FormatUint(reqID, 16)
+}
+
+// addCorrelationEDE adds the correlation ID of the request to the extra text of
+// the Extended DNS Error within the server failure response, so that the
+// clients are able to report it.  It only does that if the request has an OPT
+// record.
+//
+// See https://datatracker.ietf.org/doc/html/rfc8914.
+func (d *DNSContext) addCorrelationEDE() {
+	if d.CorrelationID == "" || d.Req == nil || d.Res == nil {
+		return
+	} else if d.Res.Rcode != dns.RcodeServerFailure || d.Req.IsEdns0() == nil {
+		return
+	}
+
+	d.calcFlagsAndSize()
+
+	opt := d.Res.IsEdns0()
+	if opt == nil {
+		d.Res.SetEdns0(d.udpSize, d.doBit)
+		opt = d.Res.IsEdns0()
+	}
+
+	text := "correlation id " + d.CorrelationID
+	for _, o := range opt.Option {
+		if ede, ok := o.(*dns.EDNS0_EDE); ok && ede.ExtraText == "" {
+			ede.ExtraText = text
+
+			return
+		}
+	}
+
+	opt.Option = append(opt.Option, &dns.EDNS0_EDE{
+		InfoCode:  dns.ExtendedErrorCodeOther,
+		ExtraText: text,
+	})
+}
+
+// CorrelationHandler is a [slog.Handler] adding the correlation ID of the
+// request carried by the context, if any, to the records.
+type CorrelationHandler struct {
+	handler slog.Handler
+}
+
+// NewCorrelationHandler returns a new properly initialized *CorrelationHandler
+// wrapping h.
+func NewCorrelationHandler(h slog.Handler) (ch *CorrelationHandler) {
+	return &CorrelationHandler{
+		handler: h,
+	}
+}
+
+// type check
+var _ slog.Handler = (*CorrelationHandler)(nil)
+
+// Enabled implements the [slog.Handler] interface for *CorrelationHandler.
+func (h *CorrelationHandler) Enabled(ctx context.Context, lvl slog.Level) (ok bool) {
+	return h.handler.Enabled(ctx, lvl)
+}
+
+// Handle implements the [slog.Handler] interface for *CorrelationHandler.
+func (h *CorrelationHandler) Handle(ctx context.Context, r slog.Record) (err error) {
+	if id, ok := CorrelationIDFromContext(ctx); ok {
+		r = r.Clone()
+		r.AddAttrs(slog.String(KeyCorrelationID, id))
+	}
+
+	return h.handler.Handle(ctx, r)
+}
+
+// WithAttrs implements the [slog.Handler] interface for *CorrelationHandler.
+func (h *CorrelationHandler) WithAttrs(attrs []slog.Attr) (res slog.Handler) {
+	return &CorrelationHandler{
+		handler: h.handler.WithAttrs(attrs),
+	}
+}
+
+// WithGroup implements the [slog.Handler] interface for *CorrelationHandler.
+func (h *CorrelationHandler) WithGroup(name string) (res slog.Handler) {
+	return &CorrelationHandler{
+		handler: h.handler.WithGroup(name),
+	}
+}
@@ -0,0 +1,192 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/internal/dnsproxytest"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxy_newDNSContext_correlationID(t *testing.T) {
+	t.Parallel()
+
+	p := mustNew(t, &Config{
+		Logger:         testLogger,
+		UpstreamConfig: newTestUpstreamConfig(t, defaultTimeout, testDefaultUpstreamAddr),
+		TrustedProxies: defaultTrustedProxies,
+	})
+
+	d1 := p.newDNSContext(ProtoUDP, newTestMessage(), netip.AddrPort{})
+	d2 := p.newDNSContext(ProtoUDP, newTestMessage(), netip.AddrPort{})
+
+	assert.NotEqual(t, d1.CorrelationID, d2.CorrelationID)
+	assert.Equal(t, d1.CorrelationID, d1.Trace.CorrelationID)
+
+	prefix1, _, _ := strings.Cut(d1.CorrelationID, "-")
+	prefix2, _, _ := strings.Cut(d2.CorrelationID, "-")
+	assert.Equal(t, prefix1, prefix2)
+}
+
+func TestDNSContext_addCorrelationEDE(t *testing.T) {
+	t.Parallel()
+
+	const cid = "0123abcd-1"
+
+	newCtx := func(edns bool, rcode int) (d *DNSContext) {
+		req := newTestMessage()
+		if edns {
+			req.SetEdns0(dns.DefaultMsgSize, false)
+		}
+
+		return &DNSContext{
+			Req:           req,
+			Res:           (&dns.Msg{}).SetRcode(req, rcode),
+			CorrelationID: cid,
+		}
+	}
+
+	testCases := []struct {
+		name    string
+		rcode   int
+		edns    bool
+		wantEDE bool
+	}{{
+		name:    "servfail",
+		rcode:   dns.RcodeServerFailure,
+		edns:    true,
+		wantEDE: true,
+	}, {
+		name:    "servfail_no_edns",
+		rcode:   dns.RcodeServerFailure,
+		edns:    false,
+		wantEDE: false,
+	}, {
+		name:    "success",
+		rcode:   dns.RcodeSuccess,
+		edns:    true,
+		wantEDE: false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			d := newCtx(tc.edns, tc.rcode)
+			d.addCorrelationEDE()
+
+			opt := d.Res.IsEdns0()
+			if !tc.wantEDE {
+				if opt != nil {
+					assert.Empty(t, opt.Option)
+				}
+
+				return
+			}
+
+			require.NotNil(t, opt)
+			require.Len(t, opt.Option, 1)
+
+			ede, ok := opt.Option[0].(*dns.EDNS0_EDE)
+			require.True(t, ok)
+
+			assert.Equal(t, dns.ExtendedErrorCodeOther, ede.InfoCode)
+			assert.Contains(t, ede.ExtraText, cid)
+		})
+	}
+}
+
+func TestCorrelationHandler(t *testing.T) {
+	t.Parallel()
+
+	buf := &bytes.Buffer{}
+	l := slog.New(NewCorrelationHandler(slog.NewTextHandler(buf, nil)))
+
+	ctx := ContextWithCorrelationID(context.Background(), "0123abcd-2a")
+	l.InfoContext(ctx, "with id")
+	assert.Contains(t, buf.String(), KeyCorrelationID+"=0123abcd-2a")
+
+	buf.Reset()
+	l.With("key", "value").InfoContext(context.Background(), "without id")
+	assert.NotContains(t, buf.String(), KeyCorrelationID+"=")
+}
+
+// testCtxKey is the type of the context key used to check that the context of
+// the request reaches the logs.
+type testCtxKey struct{}
+
+// testCtxHandler is a [slog.Handler] recording the values of [testCtxKey] from
+// the contexts of the records with the given message.
+type testCtxHandler struct {
+	slog.Handler
+
+	// values receives the recorded values.
+	values chan any
+
+	// msg is the message of the records to check.
+	msg string
+}
+
+// Handle implements the [slog.Handler] interface for *testCtxHandler.
+func (h *testCtxHandler) Handle(ctx context.Context, r slog.Record) (err error) {
+	if r.Message != h.msg {
+		return nil
+	}
+
+	select {
+	case h.values <- ctx.Value(testCtxKey{}):
+	default:
+	}
+
+	return nil
+}
+
+// Enabled implements the [slog.Handler] interface for *testCtxHandler.
+func (h *testCtxHandler) Enabled(_ context.Context, _ slog.Level) (ok bool) { return true }
+
+// WithAttrs implements the [slog.Handler] interface for *testCtxHandler.
+func (h *testCtxHandler) WithAttrs(_ []slog.Attr) (res slog.Handler) { return h }
+
+// WithGroup implements the [slog.Handler] interface for *testCtxHandler.
+func (h *testCtxHandler) WithGroup(_ string) (res slog.Handler) { return h }
+
+func TestProxy_Resolve_requestContext(t *testing.T) {
+	t.Parallel()
+
+	h := &testCtxHandler{
+		Handler: slog.DiscardHandler,
+		values:  make(chan any, 1),
+		msg:     "exchange successfully finished",
+	}
+
+	ups := &dnsproxytest.Upstream{
+		OnExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+			return (&dns.Msg{}).SetReply(req), nil
+		},
+		OnAddress: func() (addr string) { return testUpsAddr },
+		OnClose:   func() (err error) { return nil },
+	}
+
+	p := mustNew(t, &Config{
+		Logger:         slog.New(h),
+		UpstreamConfig: &UpstreamConfig{Upstreams: []upstream.Upstream{ups}},
+		TrustedProxies: defaultTrustedProxies,
+	})
+
+	d := p.newDNSContext(ProtoUDP, newTestMessage(), netip.AddrPort{})
+	ctx := context.WithValue(testutil.ContextWithTimeout(t, defaultTimeout), testCtxKey{}, "req")
+
+	err := p.Resolve(ctx, d)
+	require.NoError(t, err)
+
+	v, _ := testutil.RequireReceive(t, h.values, defaultTimeout)
+	assert.Equal(t, "req", v)
+}
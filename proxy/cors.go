@@ -0,0 +1,119 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/AdguardTeam/golibs/httphdr"
+)
+
+// CORS header names missing from [httphdr].
+const (
+	hdrAccessControlAllowHeaders   = "Access-Control-Allow-Headers"
+	hdrAccessControlAllowMethods   = "Access-Control-Allow-Methods"
+	hdrAccessControlMaxAge         = "Access-Control-Max-Age"
+	hdrAccessControlRequestMethod  = "Access-Control-Request-Method"
+	hdrAccessControlRequestHeaders = "Access-Control-Request-Headers"
+)
+
+// CORS header values.
+const (
+	// corsAllowedMethods are the methods of the DoH requests.
+	corsAllowedMethods = http.MethodGet + ", " + http.MethodPost
+
+	// corsAllowedHeaders are the request headers a browser-based client may
+	// need to send.  Content-Type isn't a CORS-safelisted request header for
+	// the value of "application/dns-message".
+	corsAllowedHeaders = httphdr.ContentType + ", " + httphdr.Authorization
+
+	// corsMaxAge is the number of seconds the preflight response may be cached
+	// by browsers.
+	corsMaxAge = "86400"
+
+	// corsAnyOrigin allows requests from any origin.
+	corsAnyOrigin = "*"
+)
+
+// handleCORS adds the CORS headers to the response if the request comes from
+// an allowed origin and answers the preflight requests.  isPreflight is true if
+// the request is a preflight one and has already been answered.
+// p.HTTPConfig must not be nil.
+func (p *Proxy) handleCORS(
+	ctx context.Context,
+	w http.ResponseWriter,
+	r *http.Request,
+) (isPreflight bool) {
+	allowed := p.HTTPConfig.CORSAllowedOrigins
+	if len(allowed) == 0 {
+		return false
+	}
+
+	origin := r.Header.Get(httphdr.Origin)
+	isPreflight = r.Method == http.MethodOptions && r.Header.Get(hdrAccessControlRequestMethod) != ""
+	if origin == "" {
+		return false
+	}
+
+	h := w.Header()
+	h.Add(httphdr.Vary, httphdr.Origin)
+
+	allowOrigin, ok := matchOrigin(allowed, origin)
+	if !ok {
+		p.logger.DebugContext(ctx, "cors origin not allowed", "origin", origin)
+
+		if isPreflight {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		}
+
+		return isPreflight
+	}
+
+	h.Set(httphdr.AccessControlAllowOrigin, allowOrigin)
+	if !isPreflight {
+		return false
+	}
+
+	h.Add(httphdr.Vary, hdrAccessControlRequestMethod)
+	h.Add(httphdr.Vary, hdrAccessControlRequestHeaders)
+	h.Set(hdrAccessControlAllowMethods, corsAllowedMethods)
+	h.Set(hdrAccessControlAllowHeaders, corsAllowedHeaders)
+	h.Set(hdrAccessControlMaxAge, corsMaxAge)
+	w.WriteHeader(http.StatusNoContent)
+
+	return true
+}
+
+// matchOrigin returns the value of the Access-Control-Allow-Origin header for
+// origin, if it's allowed.
+func matchOrigin(allowed []string, origin string) (allowOrigin string, ok bool) {
+	if slices.Contains(allowed, corsAnyOrigin) {
+		return corsAnyOrigin, true
+	}
+
+	ok = slices.ContainsFunc(allowed, func(a string) (eq bool) {
+		return strings.EqualFold(a, origin)
+	})
+
+	return origin, ok
+}
+
+// corsRoutes returns the route patterns for the preflight requests to the
+// paths of routes.
+func corsRoutes(routes []string) (preflight []string) {
+	for _, route := range routes {
+		method, path, ok := strings.Cut(route, " ")
+		if !ok || method == http.MethodOptions {
+			// Patterns without methods match the preflight requests as well.
+			continue
+		}
+
+		route = http.MethodOptions + " " + strings.TrimSpace(path)
+		if !slices.Contains(preflight, route) {
+			preflight = append(preflight, route)
+		}
+	}
+
+	return preflight
+}
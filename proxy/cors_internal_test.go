@@ -0,0 +1,122 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/AdguardTeam/golibs/httphdr"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxy_ServeHTTP_cors(t *testing.T) {
+	t.Parallel()
+
+	const (
+		allowedOrigin = "https://app.example"
+		otherOrigin   = "https://other.example"
+	)
+
+	reqHandler := &TestHandler{
+		OnHandle: func(_ context.Context, _ *Proxy, d *DNSContext) (err error) {
+			d.Res = (&dns.Msg{}).SetReply(d.Req)
+
+			return nil
+		},
+	}
+
+	p := mustNew(t, &Config{
+		Logger:         testLogger,
+		UpstreamConfig: newTestUpstreamConfig(t, defaultTimeout, testDefaultUpstreamAddr),
+		TrustedProxies: defaultTrustedProxies,
+		RequestHandler: reqHandler,
+		HTTPConfig: &HTTPConfig{
+			CORSAllowedOrigins: []string{allowedOrigin},
+			InsecureEnabled:    true,
+		},
+	})
+
+	packed, err := newTestMessage().Pack()
+	require.NoError(t, err)
+
+	newPreflight := func(origin string) (r *http.Request) {
+		r = httptest.NewRequest(http.MethodOptions, "/dns-query", nil)
+		r.Header.Set(httphdr.Origin, origin)
+		r.Header.Set(hdrAccessControlRequestMethod, http.MethodPost)
+		r.Header.Set(hdrAccessControlRequestHeaders, httphdr.ContentType)
+
+		return r
+	}
+
+	newPost := func(origin string) (r *http.Request) {
+		r = httptest.NewRequest(http.MethodPost, "/dns-query", bytes.NewReader(packed))
+		r.Header.Set(httphdr.ContentType, "application/dns-message")
+		r.Header.Set(httphdr.Origin, origin)
+
+		return r
+	}
+
+	testCases := []struct {
+		req             *http.Request
+		name            string
+		wantAllowOrigin string
+		wantMethods     string
+		wantStatus      int
+	}{{
+		req:             newPreflight(allowedOrigin),
+		name:            "preflight_allowed",
+		wantAllowOrigin: allowedOrigin,
+		wantMethods:     corsAllowedMethods,
+		wantStatus:      http.StatusNoContent,
+	}, {
+		req:             newPreflight(otherOrigin),
+		name:            "preflight_forbidden",
+		wantAllowOrigin: "",
+		wantMethods:     "",
+		wantStatus:      http.StatusForbidden,
+	}, {
+		req:             newPost(allowedOrigin),
+		name:            "request_allowed",
+		wantAllowOrigin: allowedOrigin,
+		wantMethods:     "",
+		wantStatus:      http.StatusOK,
+	}, {
+		req:             newPost(otherOrigin),
+		name:            "request_other",
+		wantAllowOrigin: "",
+		wantMethods:     "",
+		wantStatus:      http.StatusOK,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			w := httptest.NewRecorder()
+			p.ServeHTTP(w, tc.req)
+
+			h := w.Header()
+			assert.Equal(t, tc.wantStatus, w.Code)
+			assert.Equal(t, tc.wantAllowOrigin, h.Get(httphdr.AccessControlAllowOrigin))
+			assert.Equal(t, tc.wantMethods, h.Get(hdrAccessControlAllowMethods))
+		})
+	}
+}
+
+func TestCorsRoutes(t *testing.T) {
+	t.Parallel()
+
+	got := corsRoutes([]string{
+		routePatternRootGet,
+		routePatternRootPost,
+		routePatternDNSQueryGet,
+		"/any-method",
+		"OPTIONS /custom",
+	})
+
+	assert.Equal(t, []string{"OPTIONS /", "OPTIONS /dns-query"}, got)
+}
@@ -46,6 +46,15 @@ type DNSContext struct {
 	// servers if it's not nil.
 	CustomUpstreamConfig *CustomUpstreamConfig
 
+	// TLSFingerprint is the fingerprint of the ClientHello message of the
+	// client's connection.  It's only set for [ProtoTLS], [ProtoHTTPS], and
+	// [ProtoQUIC], if [Config.TLSFingerprinting] is true.
+	TLSFingerprint *TLSFingerprint
+
+	// Trace is the record of processing the request.  It's set by the proxy
+	// for the requests it receives and by [Proxy.Resolve] if it's nil.
+	Trace *Trace
+
 	// queryStatistics contains the DNS query statistics for both the upstream
 	// and fallback DNS servers.
 	queryStatistics *QueryStatistics
@@ -80,6 +89,19 @@ type DNSContext struct {
 	// instance.
 	RequestID uint64
 
+	// CorrelationID is the identifier of this request, which is unique across
+	// the restarts and the instances of the proxy.  It's added to the logs of
+	// the request, to its [Trace], and to the Extended DNS Errors of the
+	// server failure responses, so that the client's complaints can be joined
+	// to the logs of the server and the upstream exchanges.
+	CorrelationID string
+
+	// RejectReason is the reason the request has been refused or dropped for,
+	// if any.  A [Handler] should set it along with returning [ErrDrop] or
+	// setting the error response, so that the request is counted in
+	// [Proxy.RejectStats].
+	RejectReason RejectReason
+
 	// udpSize is the UDP buffer size from request's EDNS0 RR if presented,
 	// or default otherwise.
 	udpSize uint16
@@ -103,13 +125,19 @@ type DNSContext struct {
 // TODO(e.burkov):  Consider creating DNSContext with this everywhere, to
 // actually respect the contract of DNSContext.RequestID field.
 func (p *Proxy) newDNSContext(proto Proto, req *dns.Msg, addr netip.AddrPort) (d *DNSContext) {
-	return &DNSContext{
+	reqID := p.counter.Add(1)
+	d = &DNSContext{
 		Proto: proto,
 		Req:   req,
 		Addr:  addr,
 
-		RequestID: p.counter.Add(1),
+		RequestID:     reqID,
+		CorrelationID: p.newCorrelationID(reqID),
+		Trace:         NewTrace(p.time.Now(), proto, addr),
 	}
+	d.Trace.CorrelationID = d.CorrelationID
+
+	return d
 }
 
 // QueryStatistics returns the DNS query statistics for both the upstream and
@@ -126,9 +154,10 @@ func (p *Proxy) newDNSContext(proto Proto, req *dns.Msg, addr netip.AddrPort) (d
 //     single entry of [UpstreamStatistics] where the property IsCached is set
 //     to true.
 //
-//   - If the upstream mode is [UpstreamModeFastestAddr] and the query was
-//     successfully resolved, the statistics contain the DNS lookup durations or
-//     errors for each main upstream.
+//   - If the upstream mode is [UpstreamModeFastestAddr] or
+//     [UpstreamModeConsensus] and the query was successfully resolved, the
+//     statistics contain the DNS lookup durations or errors for each main
+//     upstream.
 //
 //   - If the query was resolved by the fallback resolver, the statistics
 //     contain the DNS lookup errors for each main upstream and the query
@@ -158,8 +187,8 @@ func (dctx *DNSContext) calcFlagsAndSize() {
 }
 
 // scrub prepares the d.Res to be written.  Truncation is applied as well if
-// necessary.
-func (dctx *DNSContext) scrub() {
+// necessary, and the names are compressed according to mode.
+func (dctx *DNSContext) scrub(mode CompressionMode) {
 	if dctx.Res == nil || dctx.Req == nil {
 		return
 	}
@@ -178,9 +207,7 @@ func (dctx *DNSContext) scrub() {
 		dctx.Res.SetEdns0(dctx.udpSize, dctx.doBit)
 	}
 
-	dctx.Res.Truncate(int(dnsSize(dctx.Proto == ProtoUDP, dctx.Req)))
-	// Some devices require DNS message compression.
-	dctx.Res.Compress = true
+	fitResponse(dctx.Res, int(dnsSize(dctx.Proto == ProtoUDP, dctx.Req)), mode)
 }
 
 // dnsSize returns the buffer size advertised in the requests OPT record.  When
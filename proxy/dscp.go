@@ -0,0 +1,57 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"syscall"
+
+	proxynetutil "github.com/AdguardTeam/dnsproxy/internal/netutil"
+	"github.com/AdguardTeam/golibs/errors"
+)
+
+// validateListenDSCP returns an error if m isn't a valid value of
+// [Config.ListenDSCP].
+func validateListenDSCP(m map[Proto]uint8) (err error) {
+	for proto, dscp := range m {
+		switch proto {
+		case ProtoUDP, ProtoTCP, ProtoTLS, ProtoHTTPS, ProtoQUIC:
+			// Go on.
+		default:
+			return fmt.Errorf("listen dscp: proto: %w: %q", errors.ErrBadEnumValue, proto)
+		}
+
+		err = proxynetutil.ValidateDSCP(dscp)
+		if err != nil {
+			return fmt.Errorf("listen dscp: %s: %w", proto, err)
+		}
+	}
+
+	return nil
+}
+
+// setListenDSCP marks the packets sent through c, which is a listener of
+// proto, with the DSCP configured for proto, if any.  c is closed on error.
+func (p *Proxy) setListenDSCP(
+	ctx context.Context,
+	c interface {
+		syscall.Conn
+		io.Closer
+	},
+	proto Proto,
+) (err error) {
+	dscp := p.ListenDSCP[proto]
+	if dscp == 0 {
+		return nil
+	}
+
+	err = proxynetutil.SetDSCP(c, dscp)
+	if err != nil {
+		p.logClose(ctx, slog.LevelDebug, c, "closing after failed dscp setting")
+
+		return fmt.Errorf("setting dscp: %w", err)
+	}
+
+	return nil
+}
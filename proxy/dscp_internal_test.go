@@ -0,0 +1,97 @@
+//go:build unix
+
+package proxy
+
+import (
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/AdguardTeam/golibs/testutil/servicetest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+// requireTOS checks that the IPv4 TOS of c is set to dscp.
+func requireTOS(tb testing.TB, c syscall.Conn, dscp uint8) {
+	tb.Helper()
+
+	rc, err := c.SyscallConn()
+	require.NoError(tb, err)
+
+	var tos int
+	var opErr error
+	err = rc.Control(func(fd uintptr) {
+		tos, opErr = unix.GetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_TOS)
+	})
+	require.NoError(tb, err)
+	require.NoError(tb, opErr)
+
+	assert.Equal(tb, int(dscp)<<2, tos)
+}
+
+func TestProxy_ListenDSCP(t *testing.T) {
+	const (
+		dscpUDP = 46
+		dscpTCP = 10
+	)
+
+	p := mustNew(t, &Config{
+		Logger:         testLogger,
+		UDPListenAddr:  []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		TCPListenAddr:  []*net.TCPAddr{net.TCPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig: newTestUpstreamConfig(t, defaultTimeout, testDefaultUpstreamAddr),
+		TrustedProxies: defaultTrustedProxies,
+		ListenDSCP: map[Proto]uint8{
+			ProtoUDP: dscpUDP,
+			ProtoTCP: dscpTCP,
+		},
+	})
+	servicetest.RequireRun(t, p, testTimeout)
+
+	require.Len(t, p.udpListen, 1)
+	require.Len(t, p.tcpListen, 1)
+
+	requireTOS(t, p.udpListen[0], dscpUDP)
+
+	tcpListen := testutil.RequireTypeAssert[*net.TCPListener](t, p.tcpListen[0])
+	requireTOS(t, tcpListen, dscpTCP)
+}
+
+func TestValidateListenDSCP(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		m       map[Proto]uint8
+		wantErr error
+		name    string
+	}{{
+		m:       nil,
+		wantErr: nil,
+		name:    "nil",
+	}, {
+		m:       map[Proto]uint8{ProtoUDP: 46, ProtoQUIC: 0},
+		wantErr: nil,
+		name:    "valid",
+	}, {
+		m:       map[Proto]uint8{ProtoDNSCrypt: 46},
+		wantErr: errors.ErrBadEnumValue,
+		name:    "bad_proto",
+	}, {
+		m:       map[Proto]uint8{ProtoTCP: 64},
+		wantErr: errors.ErrOutOfRange,
+		name:    "out_of_range",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			err := validateListenDSCP(tc.m)
+			assert.ErrorIs(t, err, tc.wantErr)
+		})
+	}
+}
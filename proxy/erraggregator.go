@@ -0,0 +1,199 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+)
+
+// ExchangeLogConfig is the configuration of reducing the volume of the logs of
+// the exchanges with the upstreams, e.g. to prevent the log floods during the
+// upstream outages.
+type ExchangeLogConfig struct {
+	// ErrorSummaryInterval is the interval of the summary lines of the
+	// repeated identical upstream errors.  The first error of a kind is logged
+	// right away, while the following ones are counted and reported once per
+	// interval along with the times of the first and the last one.  The errors
+	// are identical if those are returned by the same upstream and have the
+	// same root cause.  If zero, every error is logged.  It must not be
+	// negative.
+	ErrorSummaryInterval time.Duration
+
+	// QuietSuccess disables the debug log lines of the successful exchanges,
+	// which dominate the debug output of busy proxies.
+	QuietSuccess bool
+}
+
+// validate returns an error if c is invalid.  c may be nil.
+func (c *ExchangeLogConfig) validate() (err error) {
+	if c != nil && c.ErrorSummaryInterval < 0 {
+		return fmt.Errorf(
+			"error summary interval: %w: %s",
+			errors.ErrNegative,
+			c.ErrorSummaryInterval,
+		)
+	}
+
+	return nil
+}
+
+// errorKey identifies the identical upstream errors.
+type errorKey struct {
+	// upstream is the address of the upstream.
+	upstream string
+
+	// cause is the text of the root cause of the error.
+	cause string
+}
+
+// errorEntry is the state of a kind of errors.
+type errorEntry struct {
+	// lastErr is the latest suppressed error.
+	lastErr error
+
+	// first is the time the first error of the kind has been seen.
+	first time.Time
+
+	// last is the time the latest error of the kind has been seen.
+	last time.Time
+
+	// count is the number of the errors suppressed since the previous summary.
+	count uint64
+}
+
+// errorAggregator collapses the repeated identical upstream errors into the
+// periodic summary log lines.  A nil *errorAggregator doesn't suppress any
+// errors.
+type errorAggregator struct {
+	// logger is used to log the summaries.
+	logger *slog.Logger
+
+	// mu protects entries.
+	mu *sync.Mutex
+
+	// entries are the kinds of errors seen within the current interval.
+	entries map[errorKey]*errorEntry
+
+	// interval is the interval of the summaries.
+	interval time.Duration
+}
+
+// newErrorAggregator returns a new aggregator of the upstream errors or nil if
+// the errors shouldn't be aggregated according to c.  c must be valid, l must
+// not be nil.
+func newErrorAggregator(l *slog.Logger, c *ExchangeLogConfig) (a *errorAggregator) {
+	if c == nil || c.ErrorSummaryInterval == 0 {
+		return nil
+	}
+
+	return &errorAggregator{
+		logger:   l,
+		mu:       &sync.Mutex{},
+		entries:  map[errorKey]*errorEntry{},
+		interval: c.ErrorSummaryInterval,
+	}
+}
+
+// rootCause returns the innermost error of the chain of err, which is
+// independent of the details like the addresses of the connections.
+func rootCause(err error) (cause error) {
+	for {
+		unwrapped := errors.Unwrap(err)
+		if unwrapped == nil {
+			return err
+		}
+
+		err = unwrapped
+	}
+}
+
+// report records err returned by the upstream with addr at now.  It returns
+// true if err should be logged right away, since it's the first of its kind
+// within the interval.  a may be nil.
+func (a *errorAggregator) report(addr string, err error, now time.Time) (shouldLog bool) {
+	if a == nil {
+		return true
+	}
+
+	key := errorKey{
+		upstream: addr,
+		cause:    rootCause(err).Error(),
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if e, ok := a.entries[key]; ok {
+		e.lastErr, e.last = err, now
+		e.count++
+
+		return false
+	}
+
+	a.entries[key] = &errorEntry{
+		first: now,
+		last:  now,
+	}
+	time.AfterFunc(a.interval, func() { a.flush(key) })
+
+	return true
+}
+
+// flush logs the summary of the errors of the kind identified by key
+// suppressed within the interval, if any.  The kind is forgotten once no
+// errors of it are seen within the whole interval.
+func (a *errorAggregator) flush(key errorKey) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	e, ok := a.entries[key]
+	if !ok {
+		return
+	}
+
+	if e.count == 0 {
+		delete(a.entries, key)
+
+		return
+	}
+
+	a.logger.Error(
+		"upstream errors repeated",
+		"upstream", key.upstream,
+		"count", e.count,
+		"first_seen", e.first,
+		"last_seen", e.last,
+		slogutil.KeyError, e.lastErr,
+	)
+
+	e.count = 0
+	time.AfterFunc(a.interval, func() { a.flush(key) })
+}
+
+// logExchangeErr logs the failed exchange of the question q with the upstream
+// with addr, unless it's suppressed by p.errAggregator.
+func (p *Proxy) logExchangeErr(
+	ctx context.Context,
+	addr string,
+	q fmt.Stringer,
+	dur time.Duration,
+	err error,
+) {
+	if !p.errAggregator.report(addr, err, p.time.Now()) {
+		return
+	}
+
+	p.logger.ErrorContext(
+		ctx,
+		"exchange failed",
+		"upstream", addr,
+		"question", q,
+		"duration", dur,
+		slogutil.KeyError, err,
+	)
+}
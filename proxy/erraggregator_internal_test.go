@@ -0,0 +1,69 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExchangeLogConfig_validate(t *testing.T) {
+	t.Parallel()
+
+	assert.NoError(t, (*ExchangeLogConfig)(nil).validate())
+	assert.NoError(t, (&ExchangeLogConfig{QuietSuccess: true}).validate())
+
+	err := (&ExchangeLogConfig{ErrorSummaryInterval: -time.Second}).validate()
+	assert.ErrorIs(t, err, errors.ErrNegative)
+}
+
+func TestErrorAggregator(t *testing.T) {
+	t.Parallel()
+
+	const (
+		addr      = "udp://192.0.2.1:53"
+		otherAddr = "udp://192.0.2.2:53"
+
+		errTimeout errors.Error = "i/o timeout"
+		errRefused errors.Error = "connection refused"
+	)
+
+	buf := &bytes.Buffer{}
+	l := slog.New(slog.NewTextHandler(buf, nil))
+
+	a := newErrorAggregator(l, &ExchangeLogConfig{ErrorSummaryInterval: time.Hour})
+	require.NotNil(t, a)
+
+	now := time.Unix(0, 0)
+	assert.True(t, a.report(addr, fmt.Errorf("read 127.0.0.1:1000: %w", errTimeout), now))
+
+	// The same root cause with different details is suppressed.
+	assert.False(t, a.report(addr, fmt.Errorf("read 127.0.0.1:1001: %w", errTimeout), now))
+	assert.False(t, a.report(addr, fmt.Errorf("read 127.0.0.1:1002: %w", errTimeout), now))
+
+	assert.True(t, a.report(addr, errRefused, now))
+	assert.True(t, a.report(otherAddr, errTimeout, now))
+
+	key := errorKey{upstream: addr, cause: string(errTimeout)}
+	a.flush(key)
+
+	out := buf.String()
+	assert.Contains(t, out, "upstream errors repeated")
+	assert.Contains(t, out, "count=2")
+	assert.Contains(t, out, "127.0.0.1:1002")
+
+	// Nothing has been suppressed since the summary, so the kind is forgotten.
+	buf.Reset()
+	a.flush(key)
+	assert.Empty(t, buf.String())
+	assert.True(t, a.report(addr, errTimeout, now))
+
+	var nilAggregator *errorAggregator
+	assert.True(t, nilAggregator.report(addr, errTimeout, now))
+	assert.Nil(t, newErrorAggregator(l, &ExchangeLogConfig{QuietSuccess: true}))
+}
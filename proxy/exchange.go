@@ -1,12 +1,12 @@
 package proxy
 
 import (
+	"context"
 	"fmt"
 	"time"
 
 	"github.com/AdguardTeam/dnsproxy/upstream"
 	"github.com/AdguardTeam/golibs/errors"
-	"github.com/AdguardTeam/golibs/logutil/slogutil"
 	"github.com/miekg/dns"
 	"gonum.org/v1/gonum/stat/sampleuv"
 )
@@ -15,12 +15,15 @@ import (
 // response, the upstream that successfully resolved the request, and the error
 // if any.
 func (p *Proxy) exchangeUpstreams(
+	ctx context.Context,
 	req *dns.Msg,
 	ups []upstream.Upstream,
 ) (resp *dns.Msg, u upstream.Upstream, err error) {
 	switch p.UpstreamMode {
 	case UpstreamModeParallel:
 		return upstream.ExchangeParallel(ups, req)
+	case UpstreamModeConsensus:
+		return p.exchangeConsensus(req, ups)
 	case UpstreamModeFastestAddr:
 		switch req.Question[0].Qtype {
 		case dns.TypeA, dns.TypeAAAA:
@@ -34,23 +37,35 @@ func (p *Proxy) exchangeUpstreams(
 
 	if len(ups) == 1 {
 		u = ups[0]
-		resp, _, err = p.exchange(u, req)
+
+		var elapsed time.Duration
+		resp, elapsed, err = p.exchange(ctx, u, req)
 		if err != nil {
+			p.updateRTT(u.Address(), defaultTimeout)
+
 			return nil, nil, err
 		}
 
-		// TODO(e.burkov):  Consider updating the RTT of a single upstream.
+		// Keep the latency statistics of a single upstream as well, since
+		// those are reported.
+		p.updateRTT(u.Address(), elapsed)
 
 		return resp, u, err
 	}
 
-	w := sampleuv.NewWeighted(p.calcWeights(ups), p.randSrc)
+	var next func() (i int, ok bool)
+	if p.UpstreamMode == UpstreamModeBestP95 {
+		next = p.orderByP95(ups)
+	} else {
+		next = sampleuv.NewWeighted(p.calcWeights(ups), p.randSrc).Take
+	}
+
 	var errs []error
-	for i, ok := w.Take(); ok; i, ok = w.Take() {
+	for i, ok := next(); ok; i, ok = next() {
 		u = ups[i]
 
 		var elapsed time.Duration
-		resp, elapsed, err = p.exchange(u, req)
+		resp, elapsed, err = p.exchange(ctx, u, req)
 		if err == nil {
 			p.updateRTT(u.Address(), elapsed)
 
@@ -73,6 +88,7 @@ func (p *Proxy) exchangeUpstreams(
 // upstream and the elapsed time in milliseconds.  It uses the given clock to
 // measure the request duration.
 func (p *Proxy) exchange(
+	ctx context.Context,
 	u upstream.Upstream,
 	req *dns.Msg,
 ) (resp *dns.Msg, dur time.Duration, err error) {
@@ -85,15 +101,10 @@ func (p *Proxy) exchange(
 	addr := u.Address()
 	q := &req.Question[0]
 	if err != nil {
-		p.logger.Error(
-			"exchange failed",
-			"upstream", addr,
-			"question", q,
-			"duration", dur,
-			slogutil.KeyError, err,
-		)
-	} else {
-		p.logger.Debug(
+		p.logExchangeErr(ctx, addr, q, dur, err)
+	} else if p.ExchangeLog == nil || !p.ExchangeLog.QuietSuccess {
+		p.logger.DebugContext(
+			ctx,
 			"exchange successfully finished",
 			"upstream", addr,
 			"question", q,
@@ -114,14 +125,21 @@ type upstreamRTTStats struct {
 	// reqNum is the number of requests to the upstream.  The float64 type is
 	// used since to avoid unnecessary type conversions.
 	reqNum float64
+
+	// latencies is the histogram of the round-trip times.
+	latencies latencyHistogram
 }
 
 // update returns updated stats after adding given RTT.
 func (stats upstreamRTTStats) update(rtt time.Duration) (updated upstreamRTTStats) {
-	return upstreamRTTStats{
-		rttSum: stats.rttSum + float64(rtt.Microseconds()),
-		reqNum: stats.reqNum + 1,
+	updated = upstreamRTTStats{
+		rttSum:    stats.rttSum + float64(rtt.Microseconds()),
+		reqNum:    stats.reqNum + 1,
+		latencies: stats.latencies,
 	}
+	updated.latencies.add(rtt)
+
+	return updated
 }
 
 // calcWeights returns the slice of weights, each corresponding to the upstream
@@ -0,0 +1,184 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/miekg/dns"
+)
+
+// ErrFaultInjected is returned by the upstreams when a fault has been injected
+// into their responses, see [Config.UpstreamFaults].
+const ErrFaultInjected errors.Error = "injected fault"
+
+// Faults are the probabilities of the faults injected into the DNS messages to
+// test the retry, fallback, and serve-stale behavior under adverse conditions.
+// The probabilities must be within the range from 0 to 1.  Each fault is
+// injected independently in the order of the fields.  Faults must not be used
+// in production.
+type Faults struct {
+	// Delay is the time the delayed messages are held for.  It must be
+	// positive if DelayRate is positive.
+	Delay time.Duration
+
+	// DropRate is the probability of a message being dropped.
+	DropRate float64
+
+	// DelayRate is the probability of a message being delayed by Delay.
+	DelayRate float64
+
+	// CorruptRate is the probability of a random byte of a message being
+	// changed.
+	CorruptRate float64
+
+	// TruncateRate is the probability of a message being truncated.  The
+	// client packets are cut at a random length, while the upstream responses
+	// get the TC bit set and their sections removed.
+	TruncateRate float64
+}
+
+// validate returns an error if f is invalid.  f may be nil.
+func (f *Faults) validate() (err error) {
+	if f == nil {
+		return nil
+	}
+
+	for _, r := range []struct {
+		name string
+		rate float64
+	}{{
+		name: "drop",
+		rate: f.DropRate,
+	}, {
+		name: "delay",
+		rate: f.DelayRate,
+	}, {
+		name: "corrupt",
+		rate: f.CorruptRate,
+	}, {
+		name: "truncate",
+		rate: f.TruncateRate,
+	}} {
+		if r.rate < 0 || r.rate > 1 {
+			return fmt.Errorf("%s rate: %w: %v", r.name, errors.ErrOutOfRange, r.rate)
+		}
+	}
+
+	if f.DelayRate > 0 && f.Delay <= 0 {
+		return fmt.Errorf("delay: %w: %s", errors.ErrNotPositive, f.Delay)
+	}
+
+	return nil
+}
+
+// happens returns true with the probability of rate.
+func happens(rate float64) (ok bool) {
+	return rate > 0 && rand.Float64() < rate
+}
+
+// delay holds the message for f.Delay with the probability of f.DelayRate.  It
+// returns an error if ctx is canceled meanwhile.
+func (f *Faults) delay(ctx context.Context) (err error) {
+	if !happens(f.DelayRate) {
+		return nil
+	}
+
+	timer := time.NewTimer(f.Delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return context.Cause(ctx)
+	}
+}
+
+// injectIntoPacket injects the faults into the client packet.  drop is true if
+// the packet should be dropped.  f may be nil.
+func (f *Faults) injectIntoPacket(
+	ctx context.Context,
+	packet []byte,
+) (injected []byte, drop bool) {
+	if f == nil || len(packet) == 0 {
+		return packet, false
+	}
+
+	if happens(f.DropRate) || f.delay(ctx) != nil {
+		return nil, true
+	}
+
+	if happens(f.CorruptRate) {
+		packet[rand.IntN(len(packet))] ^= byte(1 + rand.IntN(0xff))
+	}
+
+	if happens(f.TruncateRate) {
+		packet = packet[:rand.IntN(len(packet))]
+	}
+
+	return packet, false
+}
+
+// injectIntoResponse injects the faults into the upstream response.  f, resp,
+// and err may be nil.
+func (f *Faults) injectIntoResponse(
+	ctx context.Context,
+	resp *dns.Msg,
+	err error,
+) (injected *dns.Msg, injectedErr error) {
+	if f == nil || resp == nil || err != nil {
+		return resp, err
+	}
+
+	if happens(f.DropRate) {
+		return nil, fmt.Errorf("%w: response dropped", ErrFaultInjected)
+	}
+
+	err = f.delay(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("%w: delaying response: %w", ErrFaultInjected, err)
+	}
+
+	if happens(f.CorruptRate) {
+		resp, err = corrupt(resp)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrFaultInjected, err)
+		}
+	}
+
+	if happens(f.TruncateRate) {
+		resp = resp.Copy()
+		resp.Truncated = true
+		resp.Answer, resp.Ns = nil, nil
+
+		opt := resp.IsEdns0()
+		resp.Extra = nil
+		if opt != nil {
+			resp.Extra = []dns.RR{opt}
+		}
+	}
+
+	return resp, nil
+}
+
+// corrupt returns a copy of resp with a random byte changed in its wire form.
+// err is not nil if the corrupted message can't be parsed anymore.
+func corrupt(resp *dns.Msg) (corrupted *dns.Msg, err error) {
+	packet, err := resp.Pack()
+	if err != nil {
+		return nil, fmt.Errorf("packing response: %w", err)
+	}
+
+	packet[rand.IntN(len(packet))] ^= byte(1 + rand.IntN(0xff))
+
+	corrupted = &dns.Msg{}
+	err = corrupted.Unpack(packet)
+	if err != nil {
+		return nil, fmt.Errorf("unpacking corrupted response: %w", err)
+	}
+
+	return corrupted, nil
+}
@@ -0,0 +1,213 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFaults_validate(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		faults  *Faults
+		wantErr error
+		name    string
+	}{{
+		faults:  nil,
+		wantErr: nil,
+		name:    "nil",
+	}, {
+		faults: &Faults{
+			Delay:        time.Second,
+			DropRate:     0.1,
+			DelayRate:    1,
+			CorruptRate:  0,
+			TruncateRate: 0.5,
+		},
+		wantErr: nil,
+		name:    "valid",
+	}, {
+		faults:  &Faults{DropRate: 1.5},
+		wantErr: errors.ErrOutOfRange,
+		name:    "drop_rate",
+	}, {
+		faults:  &Faults{CorruptRate: -0.1},
+		wantErr: errors.ErrOutOfRange,
+		name:    "corrupt_rate",
+	}, {
+		faults:  &Faults{DelayRate: 0.5},
+		wantErr: errors.ErrNotPositive,
+		name:    "no_delay",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			err := tc.faults.validate()
+			assert.ErrorIs(t, err, tc.wantErr)
+		})
+	}
+}
+
+func TestFaults_injectIntoResponse(t *testing.T) {
+	t.Parallel()
+
+	req := (&dns.Msg{}).SetQuestion("example.org.", dns.TypeA)
+	req.SetEdns0(dns.DefaultMsgSize, false)
+
+	resp := newTestAResponse(req, 2)
+	resp.SetEdns0(dns.DefaultMsgSize, false)
+
+	t.Run("nil", func(t *testing.T) {
+		t.Parallel()
+
+		var f *Faults
+		got, err := f.injectIntoResponse(context.Background(), resp, nil)
+		require.NoError(t, err)
+
+		assert.Same(t, resp, got)
+	})
+
+	t.Run("drop", func(t *testing.T) {
+		t.Parallel()
+
+		f := &Faults{DropRate: 1}
+		got, err := f.injectIntoResponse(context.Background(), resp, nil)
+		assert.ErrorIs(t, err, ErrFaultInjected)
+
+		assert.Nil(t, got)
+	})
+
+	t.Run("delay", func(t *testing.T) {
+		t.Parallel()
+
+		f := &Faults{Delay: time.Hour, DelayRate: 1}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		got, err := f.injectIntoResponse(ctx, resp, nil)
+		assert.ErrorIs(t, err, ErrFaultInjected)
+		assert.ErrorIs(t, err, context.Canceled)
+
+		assert.Nil(t, got)
+	})
+
+	t.Run("corrupt", func(t *testing.T) {
+		t.Parallel()
+
+		packed, err := resp.Pack()
+		require.NoError(t, err)
+
+		// A single changed byte may be lost when the message is repacked, e.g.
+		// within a compression pointer, so try several times.
+		const attempts = 100
+
+		f := &Faults{CorruptRate: 1}
+		changed := false
+		for range attempts {
+			got, injErr := f.injectIntoResponse(context.Background(), resp, nil)
+			if injErr != nil {
+				require.ErrorIs(t, injErr, ErrFaultInjected)
+
+				changed = true
+
+				break
+			}
+
+			gotPacked, packErr := got.Pack()
+			require.NoError(t, packErr)
+
+			if !bytes.Equal(packed, gotPacked) {
+				changed = true
+
+				break
+			}
+		}
+
+		assert.True(t, changed)
+	})
+
+	t.Run("truncate", func(t *testing.T) {
+		t.Parallel()
+
+		f := &Faults{TruncateRate: 1}
+		got, err := f.injectIntoResponse(context.Background(), resp, nil)
+		require.NoError(t, err)
+
+		assert.True(t, got.Truncated)
+		assert.Empty(t, got.Answer)
+		assert.NotNil(t, got.IsEdns0())
+
+		assert.Len(t, resp.Answer, 2)
+	})
+
+	t.Run("error", func(t *testing.T) {
+		t.Parallel()
+
+		const testErr errors.Error = "test error"
+
+		f := &Faults{DropRate: 1}
+		got, err := f.injectIntoResponse(context.Background(), nil, testErr)
+		assert.ErrorIs(t, err, testErr)
+		assert.NotErrorIs(t, err, ErrFaultInjected)
+
+		assert.Nil(t, got)
+	})
+}
+
+func TestFaults_injectIntoPacket(t *testing.T) {
+	t.Parallel()
+
+	req := (&dns.Msg{}).SetQuestion("example.org.", dns.TypeA)
+	packet, err := req.Pack()
+	require.NoError(t, err)
+
+	t.Run("drop", func(t *testing.T) {
+		t.Parallel()
+
+		f := &Faults{DropRate: 1}
+		_, drop := f.injectIntoPacket(context.Background(), bytes.Clone(packet))
+
+		assert.True(t, drop)
+	})
+
+	t.Run("corrupt", func(t *testing.T) {
+		t.Parallel()
+
+		f := &Faults{CorruptRate: 1}
+		got, drop := f.injectIntoPacket(context.Background(), bytes.Clone(packet))
+		require.False(t, drop)
+
+		assert.Len(t, got, len(packet))
+		assert.NotEqual(t, packet, got)
+	})
+
+	t.Run("truncate", func(t *testing.T) {
+		t.Parallel()
+
+		f := &Faults{TruncateRate: 1}
+		got, drop := f.injectIntoPacket(context.Background(), bytes.Clone(packet))
+		require.False(t, drop)
+
+		assert.Less(t, len(got), len(packet))
+	})
+
+	t.Run("none", func(t *testing.T) {
+		t.Parallel()
+
+		f := &Faults{}
+		got, drop := f.injectIntoPacket(context.Background(), bytes.Clone(packet))
+		require.False(t, drop)
+
+		assert.Equal(t, packet, got)
+	})
+}
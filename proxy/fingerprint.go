@@ -0,0 +1,358 @@
+package proxy
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/bluele/gcache"
+)
+
+// TLSFingerprint is the set of fingerprints of the ClientHello message sent by
+// a client of DNS-over-TLS, DNS-over-HTTPS, or DNS-over-QUIC.  These identify
+// the TLS library and its configuration rather than a particular client, so
+// they are useful to tell the classes of devices and automated clients apart.
+type TLSFingerprint struct {
+	// JA3 is the JA3 fingerprint, the hex-encoded MD5 hash of the version,
+	// cipher suites, extensions, curves, and point formats.
+	//
+	// See https://github.com/salesforce/ja3.
+	JA3 string
+
+	// JA4 is the JA4 fingerprint in the "a_b_c" form.
+	//
+	// See https://github.com/FoxIO-LLC/ja4.
+	JA4 string
+}
+
+// String implements the [fmt.Stringer] interface for *TLSFingerprint.
+func (fp *TLSFingerprint) String() (s string) {
+	if fp == nil {
+		return ""
+	}
+
+	return fp.JA4
+}
+
+// Matches returns true if s is either the JA3 or JA4 fingerprint of fp.  The
+// comparison is case-insensitive.
+func (fp *TLSFingerprint) Matches(s string) (ok bool) {
+	if fp == nil {
+		return false
+	}
+
+	return strings.EqualFold(fp.JA3, s) || strings.EqualFold(fp.JA4, s)
+}
+
+// Known values of the ClientHello fields used for fingerprinting.
+const (
+	// tlsExtServerName is the server_name extension.
+	tlsExtServerName uint16 = 0x0000
+
+	// tlsExtALPN is the application_layer_protocol_negotiation extension.
+	tlsExtALPN uint16 = 0x0010
+
+	// ja3MaxVersion is the highest legacy version a TLS 1.3 client sends
+	// within the ClientHello itself.
+	ja3MaxVersion uint16 = tls.VersionTLS12
+
+	// ja4EmptyHash is the placeholder for the hashes of the empty lists.
+	ja4EmptyHash = "000000000000"
+)
+
+// isGREASE returns true if v is one of the reserved GREASE values, which are
+// ignored by fingerprinting.
+//
+// See https://datatracker.ietf.org/doc/html/rfc8701.
+func isGREASE(v uint16) (ok bool) {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+// withoutGREASE returns the values from vals, which aren't GREASE values.
+func withoutGREASE[T ~uint16](vals []T) (res []T) {
+	return slices.DeleteFunc(slices.Clone(vals), func(v T) (ok bool) {
+		return isGREASE(uint16(v))
+	})
+}
+
+// newTLSFingerprint computes the fingerprints of hello.  isQUIC is true if the
+// ClientHello has been received over QUIC.  hello must not be nil.
+func newTLSFingerprint(hello *tls.ClientHelloInfo, isQUIC bool) (fp *TLSFingerprint) {
+	ciphers := withoutGREASE(hello.CipherSuites)
+	exts := withoutGREASE(hello.Extensions)
+	curves := withoutGREASE(hello.SupportedCurves)
+	sigAlgs := withoutGREASE(hello.SignatureSchemes)
+
+	var maxVer uint16
+	for _, v := range withoutGREASE(hello.SupportedVersions) {
+		maxVer = max(maxVer, v)
+	}
+
+	return &TLSFingerprint{
+		JA3: ja3(min(maxVer, ja3MaxVersion), ciphers, exts, curves, hello.SupportedPoints),
+		JA4: ja4(&ja4Params{
+			ciphers: ciphers,
+			exts:    exts,
+			sigAlgs: sigAlgs,
+			alpn:    hello.SupportedProtos,
+			version: maxVer,
+			hasSNI:  hello.ServerName != "",
+			isQUIC:  isQUIC,
+		}),
+	}
+}
+
+// ja3 returns the JA3 fingerprint of the ClientHello with the given fields.
+func ja3(ver uint16, ciphers, exts []uint16, curves []tls.CurveID, points []uint8) (fp string) {
+	b := &strings.Builder{}
+	b.WriteString(strconv.FormatUint(uint64(ver), 10))
+	b.WriteByte(',')
+	writeJoined(b, ciphers, 10, "-")
+	b.WriteByte(',')
+	writeJoined(b, exts, 10, "-")
+	b.WriteByte(',')
+	writeJoined(b, curves, 10, "-")
+	b.WriteByte(',')
+	writeJoined(b, points, 10, "-")
+
+	sum := md5.Sum([]byte(b.String()))
+
+	return hex.EncodeToString(sum[:])
+}
+
+// ja4Params are the fields of the ClientHello used to compute the JA4
+// fingerprint.
+type ja4Params struct {
+	ciphers []uint16
+	exts    []uint16
+	sigAlgs []tls.SignatureScheme
+	alpn    []string
+	version uint16
+	hasSNI  bool
+	isQUIC  bool
+}
+
+// ja4 returns the JA4 fingerprint of the ClientHello with the given fields.
+func ja4(p *ja4Params) (fp string) {
+	proto := "t"
+	if p.isQUIC {
+		proto = "q"
+	}
+
+	sni := "i"
+	if p.hasSNI {
+		sni = "d"
+	}
+
+	a := fmt.Sprintf(
+		"%s%s%s%02d%02d%s",
+		proto,
+		ja4Version(p.version),
+		sni,
+		min(len(p.ciphers), 99),
+		min(len(p.exts), 99),
+		ja4ALPN(p.alpn),
+	)
+
+	ciphers := slices.Sorted(slices.Values(p.ciphers))
+
+	exts := slices.DeleteFunc(slices.Clone(p.exts), func(e uint16) (ok bool) {
+		return e == tlsExtServerName || e == tlsExtALPN
+	})
+	slices.Sort(exts)
+
+	c := &strings.Builder{}
+	writeJoined(c, exts, 16, ",")
+	if len(p.sigAlgs) > 0 {
+		c.WriteByte('_')
+		writeJoined(c, p.sigAlgs, 16, ",")
+	}
+
+	return a + "_" + ja4Hash(ciphers, "") + "_" + ja4Hash(exts, c.String())
+}
+
+// ja4Version returns the two-character representation of the TLS version v.
+func ja4Version(v uint16) (s string) {
+	switch v {
+	case tls.VersionTLS13:
+		return "13"
+	case tls.VersionTLS12:
+		return "12"
+	case tls.VersionTLS11:
+		return "11"
+	case tls.VersionTLS10:
+		return "10"
+	case tls.VersionSSL30: //nolint:staticcheck // Only used for the fingerprint.
+		return "s3"
+	default:
+		return "00"
+	}
+}
+
+// ja4ALPN returns the first and the last characters of the first ALPN value,
+// or "00" if there are none.  Non-alphanumeric characters are replaced with
+// the first and the last characters of their hex representation accordingly.
+func ja4ALPN(protos []string) (s string) {
+	if len(protos) == 0 || protos[0] == "" {
+		return "00"
+	}
+
+	first, last := protos[0][0], protos[0][len(protos[0])-1]
+	if isAlnum(first) && isAlnum(last) {
+		return string([]byte{first, last})
+	}
+
+	h := hex.EncodeToString([]byte{first, last})
+
+	return string([]byte{h[0], h[3]})
+}
+
+// isAlnum returns true if c is an ASCII letter or digit.
+func isAlnum(c byte) (ok bool) {
+	return ('0' <= c && c <= '9') || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z')
+}
+
+// ja4Hash returns the truncated hex-encoded SHA-256 hash of the
+// comma-separated 4-digit hex representations of vals, or of data if it's not
+// empty.  It returns [ja4EmptyHash] if vals is empty.
+func ja4Hash(vals []uint16, data string) (h string) {
+	if len(vals) == 0 {
+		return ja4EmptyHash
+	}
+
+	if data == "" {
+		b := &strings.Builder{}
+		writeJoined(b, vals, 16, ",")
+		data = b.String()
+	}
+
+	sum := sha256.Sum256([]byte(data))
+
+	return hex.EncodeToString(sum[:])[:len(ja4EmptyHash)]
+}
+
+// writeJoined writes vals to b separated by sep.  The values are written in
+// decimal, if base is 10, or as 4-digit lowercase hex, if base is 16.
+func writeJoined[T ~uint8 | ~uint16](b *strings.Builder, vals []T, base int, sep string) {
+	for i, v := range vals {
+		if i > 0 {
+			b.WriteString(sep)
+		}
+
+		if base == 16 {
+			_, _ = fmt.Fprintf(b, "%04x", uint16(v))
+		} else {
+			b.WriteString(strconv.FormatUint(uint64(v), base))
+		}
+	}
+}
+
+// tlsFingerprintCacheSize is the maximum number of the client connections the
+// fingerprints are kept for.
+const tlsFingerprintCacheSize = 10_000
+
+// fingerprintKey is the key of the fingerprint storage.
+type fingerprintKey struct {
+	addr  netip.AddrPort
+	isUDP bool
+}
+
+// fingerprintStorage keeps the fingerprints of the ClientHello messages until
+// the requests of the connections are handled.
+type fingerprintStorage struct {
+	cache gcache.Cache
+}
+
+// newFingerprintStorage returns a new storage keeping at most size
+// fingerprints.
+func newFingerprintStorage(size int) (s *fingerprintStorage) {
+	return &fingerprintStorage{
+		cache: gcache.New(size).LRU().Build(),
+	}
+}
+
+// store saves fp for the connection from addr.
+func (s *fingerprintStorage) store(addr netip.AddrPort, isUDP bool, fp *TLSFingerprint) {
+	err := s.cache.Set(fingerprintKey{addr: addr, isUDP: isUDP}, fp)
+	if err != nil {
+		// Shouldn't happen, since we don't set a serialization function.
+		panic(fmt.Errorf("tls fingerprints: setting cache item: %w", err))
+	}
+}
+
+// load returns the fingerprint for the connection from addr, if any.
+func (s *fingerprintStorage) load(addr netip.AddrPort, isUDP bool) (fp *TLSFingerprint) {
+	v, err := s.cache.Get(fingerprintKey{addr: addr, isUDP: isUDP})
+	if err != nil {
+		return nil
+	}
+
+	fp, _ = v.(*TLSFingerprint)
+
+	return fp
+}
+
+// withFingerprinting returns conf, if the fingerprinting is disabled, or a
+// copy of it computing the fingerprints of the ClientHello messages otherwise.
+// isQUIC is true if conf is used by a QUIC listener.  conf must not be nil.
+func (p *Proxy) withFingerprinting(conf *tls.Config, isQUIC bool) (res *tls.Config) {
+	if p.tlsFingerprints == nil {
+		return conf
+	}
+
+	res = conf.Clone()
+	next := conf.GetConfigForClient
+	res.GetConfigForClient = func(hello *tls.ClientHelloInfo) (c *tls.Config, err error) {
+		if hello.Conn != nil {
+			addr := netutil.NetAddrToAddrPort(hello.Conn.RemoteAddr())
+			p.tlsFingerprints.store(addr, isQUIC, newTLSFingerprint(hello, isQUIC))
+		}
+
+		if next == nil {
+			return nil, nil
+		}
+
+		return next(hello)
+	}
+
+	return res
+}
+
+// setTLSFingerprint sets the fingerprint of the client connection from raddr
+// to d, if any.  isUDP is true if the connection is a QUIC one.
+func (p *Proxy) setTLSFingerprint(d *DNSContext, raddr netip.AddrPort, isUDP bool) {
+	if p.tlsFingerprints == nil {
+		return
+	}
+
+	fp := p.tlsFingerprints.load(raddr, isUDP)
+	d.TLSFingerprint = fp
+	if d.Trace != nil {
+		d.Trace.TLSFingerprint = fp
+	}
+}
+
+// setHTTPTLSFingerprint sets the fingerprint of the connection r has been
+// received over to d, if any.  The address of the connection is used instead
+// of the one in d, since the latter may be taken from the headers.
+func (p *Proxy) setHTTPTLSFingerprint(d *DNSContext, r *http.Request) {
+	if p.tlsFingerprints == nil || r.TLS == nil {
+		return
+	}
+
+	raddr, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil {
+		// Shouldn't happen, since the address is set by the server.
+		return
+	}
+
+	p.setTLSFingerprint(d, raddr, r.ProtoMajor >= 3)
+}
@@ -0,0 +1,119 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"regexp"
+	"testing"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/AdguardTeam/golibs/testutil/servicetest"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// ja4RE matches the JA4 fingerprints.
+var ja4RE = regexp.MustCompile(`^[tq](1[0-3]|s3|00)[di]\d{4}[0-9a-z]{2}_[0-9a-f]{12}_[0-9a-f]{12}$`)
+
+func TestNewTLSFingerprint(t *testing.T) {
+	t.Parallel()
+
+	newHello := func(grease bool) (hello *tls.ClientHelloInfo) {
+		hello = &tls.ClientHelloInfo{
+			CipherSuites:      []uint16{tls.TLS_AES_128_GCM_SHA256, tls.TLS_AES_256_GCM_SHA384},
+			Extensions:        []uint16{0x0000, 0x000a, 0x000d, 0x0010, 0x002b},
+			SupportedCurves:   []tls.CurveID{tls.X25519, tls.CurveP256},
+			SupportedPoints:   []uint8{0},
+			SignatureSchemes:  []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256},
+			SupportedProtos:   []string{"doq"},
+			SupportedVersions: []uint16{tls.VersionTLS13, tls.VersionTLS12},
+			ServerName:        "dns.example",
+		}
+
+		if grease {
+			hello.CipherSuites = append([]uint16{0x0a0a}, hello.CipherSuites...)
+			hello.Extensions = append([]uint16{0x1a1a}, hello.Extensions...)
+			hello.SupportedCurves = append([]tls.CurveID{0x2a2a}, hello.SupportedCurves...)
+			hello.SupportedVersions = append([]uint16{0x3a3a}, hello.SupportedVersions...)
+		}
+
+		return hello
+	}
+
+	fp := newTLSFingerprint(newHello(false), true)
+	require.NotNil(t, fp)
+
+	assert.Len(t, fp.JA3, 32)
+	assert.Regexp(t, ja4RE, fp.JA4)
+	assert.Equal(t, "q13d0205dq", fp.JA4[:10])
+
+	t.Run("grease", func(t *testing.T) {
+		t.Parallel()
+
+		assert.Equal(t, fp, newTLSFingerprint(newHello(true), true))
+	})
+
+	t.Run("tcp", func(t *testing.T) {
+		t.Parallel()
+
+		tcpFP := newTLSFingerprint(newHello(false), false)
+		assert.Equal(t, fp.JA3, tcpFP.JA3)
+		assert.Equal(t, "t"+fp.JA4[1:], tcpFP.JA4)
+	})
+
+	t.Run("matches", func(t *testing.T) {
+		t.Parallel()
+
+		assert.True(t, fp.Matches(fp.JA3))
+		assert.True(t, fp.Matches(fp.JA4))
+		assert.False(t, fp.Matches("t13d0000"))
+	})
+}
+
+func TestProxy_tlsFingerprint(t *testing.T) {
+	serverConfig, caPem := newTLSConfig(t)
+
+	fpCh := make(chan *TLSFingerprint, 1)
+	dnsProxy := mustNew(t, &Config{
+		Logger:            testLogger,
+		TLSListenAddr:     []*net.TCPAddr{net.TCPAddrFromAddrPort(localhostAnyPort)},
+		TLSConfig:         serverConfig,
+		UpstreamConfig:    newTestUpstreamConfig(t, defaultTimeout, testDefaultUpstreamAddr),
+		TrustedProxies:    defaultTrustedProxies,
+		TLSFingerprinting: true,
+		RequestHandler: &TestHandler{
+			OnHandle: func(_ context.Context, _ *Proxy, d *DNSContext) (err error) {
+				fpCh <- d.TLSFingerprint
+				d.Res = (&dns.Msg{}).SetReply(d.Req)
+
+				return nil
+			},
+		},
+	})
+
+	servicetest.RequireRun(t, dnsProxy, testTimeout)
+
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(caPem)
+	tlsConfig := &tls.Config{ServerName: tlsServerName, RootCAs: roots}
+
+	conn, err := dns.DialWithTLS("tcp-tls", dnsProxy.Addr(ProtoTLS).String(), tlsConfig)
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, conn.Close)
+
+	err = conn.WriteMsg(newTestMessage())
+	require.NoError(t, err)
+
+	_, err = conn.ReadMsg()
+	require.NoError(t, err)
+
+	fp := <-fpCh
+	require.NotNil(t, fp)
+
+	assert.Len(t, fp.JA3, 32)
+	assert.Regexp(t, ja4RE, fp.JA4)
+	assert.Equal(t, byte('t'), fp.JA4[0])
+}
@@ -0,0 +1,199 @@
+package proxy
+
+import (
+	"cmp"
+	"math"
+	"slices"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+)
+
+// latencyBounds are the upper bounds of the buckets of the upstream latency
+// histograms.  The latencies above the last one fall into an additional
+// unbounded bucket.
+var latencyBounds = [...]time.Duration{
+	1 * time.Millisecond,
+	2 * time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	20 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	200 * time.Millisecond,
+	500 * time.Millisecond,
+	1 * time.Second,
+	2 * time.Second,
+	5 * time.Second,
+	10 * time.Second,
+}
+
+// minLatencySamples is the number of exchanges with an upstream, after which
+// its latency percentiles are used by [UpstreamModeBestP95].  The upstreams
+// with fewer exchanges are tried first, so that all of those are measured.
+const minLatencySamples = 10
+
+// latencyHistogram is the histogram of the latencies of an upstream.  The last
+// bucket is unbounded.
+type latencyHistogram [len(latencyBounds) + 1]uint64
+
+// add counts the latency d.
+func (h *latencyHistogram) add(d time.Duration) {
+	i, _ := slices.BinarySearch(latencyBounds[:], d)
+	h[i]++
+}
+
+// total returns the number of the counted latencies.
+func (h *latencyHistogram) total() (n uint64) {
+	for _, c := range h {
+		n += c
+	}
+
+	return n
+}
+
+// quantile returns the upper bound of the bucket containing the q-quantile of
+// the latencies.  It returns the maximum duration if the quantile falls into
+// the unbounded bucket and zero if there are no latencies.
+func (h *latencyHistogram) quantile(q float64) (d time.Duration) {
+	total := h.total()
+	if total == 0 {
+		return 0
+	}
+
+	rank := uint64(math.Ceil(q * float64(total)))
+
+	var cum uint64
+	for i, c := range h[:len(latencyBounds)] {
+		cum += c
+		if cum >= rank {
+			return latencyBounds[i]
+		}
+	}
+
+	return math.MaxInt64
+}
+
+// LatencyBucket is a bucket of the upstream latency histogram.
+type LatencyBucket struct {
+	// UpperBound is the maximum latency of the exchanges in the bucket.  The
+	// exchanges of the previous buckets aren't included.  Zero means that the
+	// bucket is unbounded.
+	UpperBound time.Duration
+
+	// Count is the number of the exchanges in the bucket.
+	Count uint64
+}
+
+// LatencyStats are the statistics of the latencies of an upstream.  The
+// failed exchanges are counted with the default timeout as latency.  The
+// percentiles are the upper bounds of the buckets containing those.
+type LatencyStats struct {
+	// Buckets is the histogram of the latencies sorted by the upper bound.
+	Buckets []LatencyBucket
+
+	// Count is the number of the exchanges.
+	Count uint64
+
+	// Mean is the mean latency.
+	Mean time.Duration
+
+	// P50 is the median latency.
+	P50 time.Duration
+
+	// P95 is the 95th percentile of latency.
+	P95 time.Duration
+
+	// P99 is the 99th percentile of latency.
+	P99 time.Duration
+}
+
+// newLatencyStats returns the latency statistics of s.
+func newLatencyStats(s upstreamRTTStats) (ls *LatencyStats) {
+	ls = &LatencyStats{
+		Buckets: make([]LatencyBucket, 0, len(s.latencies)),
+		Count:   s.latencies.total(),
+		P50:     s.latencies.quantile(0.50),
+		P95:     s.latencies.quantile(0.95),
+		P99:     s.latencies.quantile(0.99),
+	}
+
+	if s.reqNum > 0 {
+		ls.Mean = time.Duration(s.rttSum/s.reqNum) * time.Microsecond
+	}
+
+	for i, c := range s.latencies {
+		var bound time.Duration
+		if i < len(latencyBounds) {
+			bound = latencyBounds[i]
+		}
+
+		ls.Buckets = append(ls.Buckets, LatencyBucket{
+			UpperBound: bound,
+			Count:      c,
+		})
+	}
+
+	return ls
+}
+
+// UpstreamLatencyStats returns the latency statistics of the upstreams, which
+// have been used so far, by their addresses.
+func (p *Proxy) UpstreamLatencyStats() (stats map[string]*LatencyStats) {
+	p.rttLock.Lock()
+	defer p.rttLock.Unlock()
+
+	stats = make(map[string]*LatencyStats, len(p.upstreamRTTStats))
+	for addr, s := range p.upstreamRTTStats {
+		stats[addr] = newLatencyStats(s)
+	}
+
+	return stats
+}
+
+// latencyRank is the position of an upstream in the order of
+// [UpstreamModeBestP95].
+type latencyRank struct {
+	// idx is the index of the upstream.
+	idx int
+
+	// p95 is the 95th percentile of the latency of the upstream.
+	p95 time.Duration
+
+	// mean is the mean latency of the upstream in microseconds, it breaks the
+	// ties between the upstreams within the same bucket.
+	mean float64
+}
+
+// orderByP95 returns the function returning the indexes of ups in the order of
+// increasing 95th percentile of latency.  The upstreams with fewer than
+// [minLatencySamples] exchanges go first.
+func (p *Proxy) orderByP95(ups []upstream.Upstream) (next func() (i int, ok bool)) {
+	ranks := make([]latencyRank, 0, len(ups))
+
+	p.rttLock.Lock()
+	for i, u := range ups {
+		r := latencyRank{idx: i}
+		if s := p.upstreamRTTStats[u.Address()]; s.reqNum >= minLatencySamples {
+			r.p95 = s.latencies.quantile(0.95)
+			r.mean = s.rttSum / s.reqNum
+		}
+
+		ranks = append(ranks, r)
+	}
+	p.rttLock.Unlock()
+
+	slices.SortStableFunc(ranks, func(a, b latencyRank) (res int) {
+		return cmp.Or(cmp.Compare(a.p95, b.p95), cmp.Compare(a.mean, b.mean))
+	})
+
+	return func() (i int, ok bool) {
+		if len(ranks) == 0 {
+			return 0, false
+		}
+
+		i, ranks = ranks[0].idx, ranks[1:]
+
+		return i, true
+	}
+}
@@ -0,0 +1,97 @@
+package proxy
+
+import (
+	"math"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/internal/dnsproxytest"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLatencyHistogram_quantile(t *testing.T) {
+	t.Parallel()
+
+	h := &latencyHistogram{}
+	assert.Zero(t, h.quantile(0.95))
+
+	for range 90 {
+		h.add(3 * time.Millisecond)
+	}
+
+	for range 8 {
+		h.add(200 * time.Millisecond)
+	}
+
+	for range 2 {
+		h.add(time.Minute)
+	}
+
+	assert.Equal(t, uint64(100), h.total())
+	assert.Equal(t, 5*time.Millisecond, h.quantile(0.50))
+	assert.Equal(t, 200*time.Millisecond, h.quantile(0.95))
+	assert.Equal(t, time.Duration(math.MaxInt64), h.quantile(0.99))
+}
+
+func TestProxy_orderByP95(t *testing.T) {
+	t.Parallel()
+
+	newUps := func(addr string) (u upstream.Upstream) {
+		return &dnsproxytest.Upstream{
+			OnAddress: func() (a string) { return addr },
+		}
+	}
+
+	// stable has a higher mean latency, but no slow exchanges.
+	stable := upstreamRTTStats{}
+	for range 20 {
+		stable = stable.update(30 * time.Millisecond)
+	}
+
+	// anycast has a lower mean latency, but a long tail.
+	anycast := upstreamRTTStats{}
+	for range 18 {
+		anycast = anycast.update(2 * time.Millisecond)
+	}
+
+	for range 2 {
+		anycast = anycast.update(200 * time.Millisecond)
+	}
+
+	require.Less(t, anycast.rttSum/anycast.reqNum, stable.rttSum/stable.reqNum)
+
+	// fresh hasn't got enough exchanges yet.
+	fresh := upstreamRTTStats{}.update(time.Second)
+
+	p := &Proxy{
+		upstreamRTTStats: map[string]upstreamRTTStats{
+			"anycast": anycast,
+			"stable":  stable,
+			"fresh":   fresh,
+		},
+		rttLock: sync.Mutex{},
+	}
+
+	ups := []upstream.Upstream{newUps("anycast"), newUps("stable"), newUps("fresh")}
+
+	var got []string
+	next := p.orderByP95(ups)
+	for i, ok := next(); ok; i, ok = next() {
+		got = append(got, ups[i].Address())
+	}
+
+	assert.Equal(t, []string{"fresh", "stable", "anycast"}, got)
+
+	stats := p.UpstreamLatencyStats()
+	require.Contains(t, stats, "anycast")
+
+	s := stats["anycast"]
+	assert.Equal(t, uint64(20), s.Count)
+	assert.Equal(t, 2*time.Millisecond, s.P50)
+	assert.Equal(t, 200*time.Millisecond, s.P95)
+	assert.Len(t, s.Buckets, len(latencyBounds)+1)
+	assert.Zero(t, s.Buckets[len(latencyBounds)].UpperBound)
+}
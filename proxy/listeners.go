@@ -0,0 +1,402 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// listenerProtos are the protocols of the listeners managed by the proxy
+// itself, in the order of their initialization.  The DNSCrypt servers manage
+// their listeners on their own.
+var listenerProtos = []Proto{
+	ProtoUDP,
+	ProtoTCP,
+	ProtoTLS,
+	ProtoHTTPS,
+	ProtoQUIC,
+}
+
+// StopListeners closes all the listeners of proto, so that the proxy stops
+// serving the requests over it until [Proxy.StartListeners] is called.  The
+// listeners of other protocols keep serving.  proto must be one of [Proto]:
+// [ProtoTCP], [ProtoUDP], [ProtoTLS], [ProtoHTTPS], [ProtoQUIC], or
+// [ProtoDNSCrypt].
+func (p *Proxy) StopListeners(ctx context.Context, proto Proto) (err error) {
+	p.Lock()
+	defer p.Unlock()
+
+	if !p.started {
+		return errors.Error("server is not started")
+	}
+
+	p.logger.InfoContext(ctx, "stopping listeners", "proto", proto)
+
+	var errs []error
+	switch proto {
+	case ProtoUDP, ProtoTCP, ProtoTLS, ProtoHTTPS, ProtoQUIC:
+		errs = p.closeProtoListeners(errs, proto)
+	case ProtoDNSCrypt:
+		errs = append(errs, shutdownDNSCryptServers(ctx, p.dnsCryptServers))
+		p.dnsCryptServers = nil
+	default:
+		return fmt.Errorf("proto: %w: %q", errors.ErrBadEnumValue, proto)
+	}
+
+	err = errors.Join(errs...)
+	if err != nil {
+		return fmt.Errorf("closing %s listeners: %w", proto, err)
+	}
+
+	return nil
+}
+
+// StartListeners binds the configured addresses of proto again and starts
+// serving them after those have been stopped with [Proxy.StopListeners].  Note
+// that the listeners configured with zero ports get new ones.  proto must be
+// one of [Proto]: [ProtoTCP], [ProtoUDP], [ProtoTLS], [ProtoHTTPS],
+// [ProtoQUIC], or [ProtoDNSCrypt].
+func (p *Proxy) StartListeners(ctx context.Context, proto Proto) (err error) {
+	p.Lock()
+	defer p.Unlock()
+
+	if !p.started {
+		return errors.Error("server is not started")
+	}
+
+	if p.hasProtoListeners(proto) {
+		return fmt.Errorf("%s listeners are already started", proto)
+	}
+
+	p.logger.InfoContext(ctx, "starting listeners", "proto", proto)
+
+	// Use context without cancel to prevent listeners' context from being
+	// canceled.
+	serveCtx := context.WithoutCancel(ctx)
+
+	switch proto {
+	case ProtoUDP, ProtoTCP, ProtoTLS, ProtoHTTPS, ProtoQUIC:
+		err = p.initProtoListeners(ctx, proto)
+		if err != nil {
+			closeErr := errors.Join(p.closeProtoListeners(nil, proto)...)
+
+			return fmt.Errorf("configuring listeners: %w", errors.WithDeferred(err, closeErr))
+		}
+
+		p.serveProtoListeners(serveCtx, proto)
+	case ProtoDNSCrypt:
+		err = p.initDNSCryptServers(ctx)
+		if err == nil {
+			err = p.startDNSCryptServers(serveCtx)
+		}
+
+		if err != nil {
+			p.dnsCryptServers = nil
+
+			// Don't wrap the error since it's informative enough as is.
+			return err
+		}
+	default:
+		return fmt.Errorf("proto: %w: %q", errors.ErrBadEnumValue, proto)
+	}
+
+	return nil
+}
+
+// hasProtoListeners returns true if there are any active listeners of proto.
+// p must be locked.
+func (p *Proxy) hasProtoListeners(proto Proto) (ok bool) {
+	switch proto {
+	case ProtoUDP:
+		return len(p.udpListen) > 0
+	case ProtoTCP:
+		return len(p.tcpListen) > 0
+	case ProtoTLS:
+		return len(p.tlsListen) > 0
+	case ProtoHTTPS:
+		return len(p.httpsListen) > 0 || len(p.h3Listen) > 0
+	case ProtoQUIC:
+		return len(p.quicListen) > 0
+	case ProtoDNSCrypt:
+		return len(p.dnsCryptServers) > 0
+	default:
+		return false
+	}
+}
+
+// initProtoListeners creates the listeners of proto, which must be one of
+// [listenerProtos].  If it returns an error, the listeners of proto should be
+// closed manually.
+func (p *Proxy) initProtoListeners(ctx context.Context, proto Proto) (err error) {
+	switch proto {
+	case ProtoUDP:
+		return p.initUDPListeners(ctx)
+	case ProtoTCP:
+		return p.initTCPListeners(ctx)
+	case ProtoTLS:
+		return p.initTLSListeners(ctx)
+	case ProtoHTTPS:
+		return p.initHTTPSListeners(ctx)
+	case ProtoQUIC:
+		return p.initQUICListeners(ctx)
+	default:
+		panic(fmt.Errorf("proto: %w: %q", errors.ErrBadEnumValue, proto))
+	}
+}
+
+// serveProtoListeners starts serving the listeners of proto, which must be one
+// of [listenerProtos].
+func (p *Proxy) serveProtoListeners(ctx context.Context, proto Proto) {
+	switch proto {
+	case ProtoUDP:
+		for _, l := range p.udpListen {
+			go p.udpPacketLoop(ctx, l, p.requestsSema)
+		}
+	case ProtoTCP:
+		for _, l := range p.tcpListen {
+			go p.tcpPacketLoop(ctx, l, ProtoTCP, p.requestsSema)
+		}
+	case ProtoTLS:
+		for _, l := range p.tlsListen {
+			go p.tcpPacketLoop(ctx, l, ProtoTLS, p.requestsSema)
+		}
+	case ProtoHTTPS:
+		srv := p.httpsServer
+		for _, l := range p.httpsListen {
+			go func(l net.Listener) { _ = srv.Serve(l) }(p.memGuard.wrapListener(l))
+		}
+
+		h3Srv := p.h3Server
+		for _, l := range p.h3Listen {
+			go func(l http3.QUICListener) { _ = h3Srv.ServeListener(l) }(p.memGuard.wrapQUICListener(l))
+		}
+	case ProtoQUIC:
+		for _, l := range p.quicListen {
+			go p.quicPacketLoop(ctx, l, p.requestsSema)
+		}
+	default:
+		panic(fmt.Errorf("proto: %w: %q", errors.ErrBadEnumValue, proto))
+	}
+}
+
+// closeProtoListeners closes the listeners of proto, which must be one of
+// [listenerProtos], and appends the occurred errors to errs.
+func (p *Proxy) closeProtoListeners(errs []error, proto Proto) (res []error) {
+	res = errs
+
+	switch proto {
+	case ProtoUDP:
+		res = closeAll(res, p.udpListen...)
+		p.udpListen = nil
+	case ProtoTCP:
+		res = closeAll(res, p.tcpListen...)
+		p.tcpListen = nil
+	case ProtoTLS:
+		res = closeAll(res, p.tlsListen...)
+		p.tlsListen = nil
+	case ProtoHTTPS:
+		res = p.closeHTTPSListeners(res)
+	case ProtoQUIC:
+		res = closeAll(res, p.quicListen...)
+		p.quicListen = nil
+
+		res = closeAll(res, p.quicTransports...)
+		p.quicTransports = nil
+
+		res = closeAll(res, p.quicConns...)
+		p.quicConns = nil
+	default:
+		panic(fmt.Errorf("proto: %w: %q", errors.ErrBadEnumValue, proto))
+	}
+
+	return res
+}
+
+// closeHTTPSListeners closes the HTTPS and HTTP/3 servers along with their
+// listeners and appends the occurred errors to errs.
+func (p *Proxy) closeHTTPSListeners(errs []error) (res []error) {
+	res = errs
+
+	if p.httpsServer != nil {
+		res = closeAll(res, p.httpsServer)
+		p.httpsServer = nil
+
+		// No need to close these since they're closed by httpsServer.Close().
+		p.httpsListen = nil
+	}
+
+	if p.h3Server != nil {
+		res = closeAll(res, p.h3Server)
+		p.h3Server = nil
+	}
+
+	res = closeAll(res, p.h3Listen...)
+	p.h3Listen = nil
+
+	return res
+}
+
+// SetListenAddrs replaces the listen addresses of the proxy with the ones of c
+// and, if the proxy is started, rebinds the listeners of the protocols which
+// addresses have changed.  Only the listen addresses of c are used, i.e.
+// UDPListenAddr, TCPListenAddr, TLSListenAddr, QUICListenAddr,
+// HTTPConfig.ListenAddresses, DNSCryptUDPListenAddr, and DNSCryptTCPListenAddr.
+// The addresses of DNS-over-HTTPS are only replaced if the proxy has been
+// configured with HTTPConfig.  c must not be nil.
+func (p *Proxy) SetListenAddrs(ctx context.Context, c *Config) (err error) {
+	p.Lock()
+	defer p.Unlock()
+
+	var errs []error
+	for _, proto := range listenerProtos {
+		changed := p.setProtoListenAddrs(proto, c)
+		if !p.shouldRestart(proto, changed) {
+			continue
+		}
+
+		p.logger.InfoContext(ctx, "listen addresses changed", "proto", proto)
+
+		err = p.restartProtoListeners(ctx, proto)
+		p.setListenersFailed(proto, err != nil)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("restarting %s listeners: %w", proto, err))
+		}
+	}
+
+	if p.shouldRestart(ProtoDNSCrypt, p.setDNSCryptListenAddrs(c)) {
+		p.logger.InfoContext(ctx, "listen addresses changed", "proto", ProtoDNSCrypt)
+
+		err = p.restartDNSCryptServers(ctx)
+		p.setListenersFailed(ProtoDNSCrypt, err != nil)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("restarting %s listeners: %w", ProtoDNSCrypt, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// shouldRestart returns true if the listeners of the started proxy for proto
+// should be bound again, i.e. their addresses have changed or the previous
+// binding has failed.  p must be locked.
+func (p *Proxy) shouldRestart(proto Proto, changed bool) (ok bool) {
+	if !p.started {
+		return false
+	}
+
+	_, failed := p.failedListeners[proto]
+
+	return changed || failed
+}
+
+// setListenersFailed records whether the listeners for proto have failed to
+// bind.  p must be locked.
+func (p *Proxy) setListenersFailed(proto Proto, failed bool) {
+	if !failed {
+		delete(p.failedListeners, proto)
+
+		return
+	}
+
+	if p.failedListeners == nil {
+		p.failedListeners = map[Proto]struct{}{}
+	}
+
+	p.failedListeners[proto] = struct{}{}
+}
+
+// setProtoListenAddrs sets the listen addresses of proto, which must be one of
+// [listenerProtos], from c and returns true if those have changed.  p must be
+// locked.
+func (p *Proxy) setProtoListenAddrs(proto Proto, c *Config) (changed bool) {
+	switch proto {
+	case ProtoUDP:
+		changed = !addrsEqual(p.UDPListenAddr, c.UDPListenAddr)
+		p.UDPListenAddr = c.UDPListenAddr
+	case ProtoTCP:
+		changed = !addrsEqual(p.TCPListenAddr, c.TCPListenAddr)
+		p.TCPListenAddr = c.TCPListenAddr
+	case ProtoTLS:
+		changed = !addrsEqual(p.TLSListenAddr, c.TLSListenAddr)
+		p.TLSListenAddr = c.TLSListenAddr
+	case ProtoHTTPS:
+		if p.HTTPConfig == nil || c.HTTPConfig == nil {
+			return false
+		}
+
+		changed = !slices.Equal(p.HTTPConfig.ListenAddresses, c.HTTPConfig.ListenAddresses)
+		p.HTTPConfig.ListenAddresses = c.HTTPConfig.ListenAddresses
+	case ProtoQUIC:
+		changed = !addrsEqual(p.QUICListenAddr, c.QUICListenAddr)
+		p.QUICListenAddr = c.QUICListenAddr
+	default:
+		panic(fmt.Errorf("proto: %w: %q", errors.ErrBadEnumValue, proto))
+	}
+
+	return changed
+}
+
+// setDNSCryptListenAddrs sets the DNSCrypt listen addresses from c and returns
+// true if those have changed.  p must be locked.
+func (p *Proxy) setDNSCryptListenAddrs(c *Config) (changed bool) {
+	changed = !addrsEqual(p.DNSCryptUDPListenAddr, c.DNSCryptUDPListenAddr) ||
+		!addrsEqual(p.DNSCryptTCPListenAddr, c.DNSCryptTCPListenAddr)
+
+	p.DNSCryptUDPListenAddr = c.DNSCryptUDPListenAddr
+	p.DNSCryptTCPListenAddr = c.DNSCryptTCPListenAddr
+
+	return changed
+}
+
+// restartProtoListeners closes the listeners of proto, which must be one of
+// [listenerProtos], and binds the configured addresses again.  p must be
+// locked.
+func (p *Proxy) restartProtoListeners(ctx context.Context, proto Proto) (err error) {
+	closeErr := errors.Join(p.closeProtoListeners(nil, proto)...)
+
+	err = p.initProtoListeners(ctx, proto)
+	if err != nil {
+		closeErr = errors.Join(closeErr, errors.Join(p.closeProtoListeners(nil, proto)...))
+
+		return errors.WithDeferred(err, closeErr)
+	}
+
+	// Use context without cancel to prevent listeners' context from being
+	// canceled.
+	p.serveProtoListeners(context.WithoutCancel(ctx), proto)
+
+	return closeErr
+}
+
+// restartDNSCryptServers shuts down the DNSCrypt servers and starts them
+// again on the configured addresses.  p must be locked.
+func (p *Proxy) restartDNSCryptServers(ctx context.Context) (err error) {
+	closeErr := shutdownDNSCryptServers(ctx, p.dnsCryptServers)
+	p.dnsCryptServers = nil
+
+	err = p.initDNSCryptServers(ctx)
+	if err == nil {
+		err = p.startDNSCryptServers(context.WithoutCancel(ctx))
+	}
+
+	if err != nil {
+		p.dnsCryptServers = nil
+
+		return errors.WithDeferred(err, closeErr)
+	}
+
+	return closeErr
+}
+
+// addrsEqual returns true if a and b contain the same addresses in the same
+// order.
+func addrsEqual[T interface{ AddrPort() netip.AddrPort }](a, b []T) (ok bool) {
+	return slices.EqualFunc(a, b, func(x, y T) (eq bool) {
+		return x.AddrPort() == y.AddrPort()
+	})
+}
@@ -0,0 +1,118 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxy_StopListeners(t *testing.T) {
+	p := mustStartDefaultProxy(t)
+	ctx := testutil.ContextWithTimeout(t, testTimeout)
+
+	udpAddr := p.Addr(ProtoUDP)
+	require.NotNil(t, udpAddr)
+	require.NotNil(t, p.Addr(ProtoTCP))
+
+	err := p.StopListeners(ctx, ProtoUDP)
+	require.NoError(t, err)
+
+	assert.Nil(t, p.Addr(ProtoUDP))
+	assert.NotNil(t, p.Addr(ProtoTCP))
+
+	// Make sure the UDP socket is actually closed.
+	conn, err := net.ListenUDP("udp", udpAddr.(*net.UDPAddr))
+	require.NoError(t, err)
+	require.NoError(t, conn.Close())
+
+	err = p.StartListeners(ctx, ProtoUDP)
+	require.NoError(t, err)
+
+	assert.NotNil(t, p.Addr(ProtoUDP))
+
+	err = p.StartListeners(ctx, ProtoUDP)
+	assert.Error(t, err)
+
+	err = p.StopListeners(ctx, "bad")
+	assert.ErrorIs(t, err, errors.ErrBadEnumValue)
+
+	t.Run("serves", func(t *testing.T) {
+		err = p.StopListeners(ctx, ProtoTCP)
+		require.NoError(t, err)
+
+		err = p.StartListeners(ctx, ProtoTCP)
+		require.NoError(t, err)
+
+		c := &dns.Client{Net: string(ProtoTCP), Timeout: testTimeout}
+		tcpConn, dialErr := c.Dial(p.Addr(ProtoTCP).String())
+		require.NoError(t, dialErr)
+
+		assert.NoError(t, tcpConn.Close())
+	})
+}
+
+func TestProxy_SetListenAddrs(t *testing.T) {
+	p := mustStartDefaultProxy(t)
+	ctx := testutil.ContextWithTimeout(t, testTimeout)
+
+	tcpAddr := p.Addr(ProtoTCP)
+	require.NotNil(t, tcpAddr)
+
+	// Find a free port to move the UDP listener to.
+	conn, err := net.ListenUDP("udp", net.UDPAddrFromAddrPort(localhostAnyPort))
+	require.NoError(t, err)
+
+	newUDPAddr := conn.LocalAddr().(*net.UDPAddr)
+	require.NoError(t, conn.Close())
+
+	err = p.SetListenAddrs(ctx, &Config{
+		UDPListenAddr: []*net.UDPAddr{newUDPAddr},
+		TCPListenAddr: []*net.TCPAddr{net.TCPAddrFromAddrPort(localhostAnyPort)},
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, newUDPAddr.String(), p.Addr(ProtoUDP).String())
+
+	// The TCP listener with unchanged address is kept as is.
+	assert.Equal(t, tcpAddr, p.Addr(ProtoTCP))
+
+	// Make sure the new UDP address is actually bound.
+	_, err = net.ListenUDP("udp", newUDPAddr)
+	assert.Error(t, err)
+}
+
+func TestProxy_SetListenAddrs_retry(t *testing.T) {
+	p := mustStartDefaultProxy(t)
+	ctx := testutil.ContextWithTimeout(t, testTimeout)
+
+	busy, err := net.ListenUDP("udp", net.UDPAddrFromAddrPort(localhostAnyPort))
+	require.NoError(t, err)
+
+	busyAddr := busy.LocalAddr().(*net.UDPAddr)
+	conf := &Config{
+		UDPListenAddr: []*net.UDPAddr{busyAddr},
+		TCPListenAddr: p.TCPListenAddr,
+	}
+
+	err = p.SetListenAddrs(ctx, conf)
+	require.Error(t, err)
+
+	assert.Nil(t, p.Addr(ProtoUDP))
+
+	require.NoError(t, busy.Close())
+
+	// The addresses are the same, but the failed listeners are bound again.
+	err = p.SetListenAddrs(ctx, conf)
+	require.NoError(t, err)
+
+	assert.Equal(t, busyAddr.String(), p.Addr(ProtoUDP).String())
+
+	// The listeners aren't restarted once bound.
+	err = p.SetListenAddrs(ctx, conf)
+	require.NoError(t, err)
+}
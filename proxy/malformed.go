@@ -0,0 +1,186 @@
+package proxy
+
+import (
+	"context"
+	"encoding"
+	"encoding/binary"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/miekg/dns"
+)
+
+// MalformedAction is an enumeration of the actions taken on malformed client
+// queries, i.e. the ones that can't be parsed or have a number of questions
+// other than one.
+type MalformedAction string
+
+const (
+	// MalformedActionDefault keeps the historical behavior: unparseable
+	// queries are logged and dropped, queries with a wrong number of questions
+	// are replied with SERVFAIL.
+	MalformedActionDefault MalformedAction = ""
+
+	// MalformedActionDrop silently drops malformed queries.
+	MalformedActionDrop MalformedAction = "drop"
+
+	// MalformedActionLogDrop logs and drops malformed queries.
+	MalformedActionLogDrop MalformedAction = "log_drop"
+
+	// MalformedActionFormErr replies to malformed queries with FORMERR, if the
+	// message header is readable.  Otherwise, the query is dropped.
+	MalformedActionFormErr MalformedAction = "formerr"
+)
+
+// type check
+var _ encoding.TextUnmarshaler = (*MalformedAction)(nil)
+
+// UnmarshalText implements [encoding.TextUnmarshaler] interface for
+// *MalformedAction.
+func (a *MalformedAction) UnmarshalText(b []byte) (err error) {
+	switch ma := MalformedAction(b); ma {
+	case
+		MalformedActionDefault,
+		MalformedActionDrop,
+		MalformedActionLogDrop,
+		MalformedActionFormErr:
+		*a = ma
+	default:
+		return fmt.Errorf(
+			"invalid malformed query action %q, supported: %q, %q, %q",
+			b,
+			MalformedActionDrop,
+			MalformedActionLogDrop,
+			MalformedActionFormErr,
+		)
+	}
+
+	return nil
+}
+
+// errUnparseable is returned for queries that can't be parsed.
+const errUnparseable errors.Error = "unparseable dns message"
+
+// errBadQuestionsNum is returned for queries having a number of questions other
+// than one.
+const errBadQuestionsNum errors.Error = "bad number of questions"
+
+// servedProtos are the protocols the queries are served over.
+var servedProtos = []Proto{
+	ProtoUDP,
+	ProtoTCP,
+	ProtoTLS,
+	ProtoHTTPS,
+	ProtoQUIC,
+	ProtoDNSCrypt,
+}
+
+// newMalformedCounters returns the counters of malformed queries for each
+// supported protocol.
+func newMalformedCounters() (counters map[Proto]*atomic.Uint64) {
+	counters = make(map[Proto]*atomic.Uint64, len(servedProtos))
+	for _, proto := range servedProtos {
+		counters[proto] = &atomic.Uint64{}
+	}
+
+	return counters
+}
+
+// MalformedQueries returns the number of malformed queries received so far for
+// each protocol.
+func (p *Proxy) MalformedQueries() (counts map[Proto]uint64) {
+	counts = make(map[Proto]uint64, len(p.malformedCounters))
+	for proto, c := range p.malformedCounters {
+		counts[proto] = c.Load()
+	}
+
+	return counts
+}
+
+// malformedResponse counts the malformed query received with proto and returns
+// the response according to the configured action, or nil if the query should
+// be dropped.  formErr is the FORMERR response, if the header of the query is
+// readable, and def is the response for [MalformedActionDefault], if any.
+func (p *Proxy) malformedResponse(
+	ctx context.Context,
+	proto Proto,
+	formErr *dns.Msg,
+	def *dns.Msg,
+	err error,
+) (resp *dns.Msg) {
+	if c, ok := p.malformedCounters[proto]; ok {
+		c.Add(1)
+	}
+
+	defer func() { p.countRejected(ctx, proto, nil, RejectReasonMalformed, resp == nil) }()
+
+	switch p.MalformedQueryActions[proto] {
+	case MalformedActionDrop:
+		return nil
+	case MalformedActionFormErr:
+		p.logger.DebugContext(ctx, "malformed query", "proto", proto, slogutil.KeyError, err)
+
+		return formErr
+	case MalformedActionLogDrop:
+		p.logger.ErrorContext(ctx, "malformed query", "proto", proto, slogutil.KeyError, err)
+
+		return nil
+	default:
+		if def == nil {
+			p.logger.ErrorContext(ctx, "malformed query", "proto", proto, slogutil.KeyError, err)
+		} else {
+			p.logger.DebugContext(ctx, "malformed query", "proto", proto, slogutil.KeyError, err)
+		}
+
+		return def
+	}
+}
+
+// formErrFromPacket returns the FORMERR response to the unparseable query
+// packet, or nil if the header of the packet isn't readable or the packet isn't
+// a query.
+func formErrFromPacket(packet []byte) (resp *dns.Msg) {
+	const (
+		hdrLen       = 12
+		flagResponse = 1 << 15
+		opcodeShift  = 11
+		opcodeMask   = 0xF
+	)
+
+	if len(packet) < hdrLen {
+		return nil
+	}
+
+	flags := binary.BigEndian.Uint16(packet[2:4])
+	if flags&flagResponse != 0 {
+		// Never reply to responses to avoid loops.
+		return nil
+	}
+
+	return &dns.Msg{
+		MsgHdr: dns.MsgHdr{
+			Id:       binary.BigEndian.Uint16(packet[:2]),
+			Response: true,
+			Opcode:   int(flags>>opcodeShift) & opcodeMask,
+			Rcode:    dns.RcodeFormatError,
+		},
+	}
+}
+
+// checkQuestions checks the number of questions in the request of d.  resp is
+// the response to the malformed request, if any, and drop is true if the
+// request should be dropped.  d must not be nil.
+func (p *Proxy) checkQuestions(ctx context.Context, d *DNSContext) (resp *dns.Msg, drop bool) {
+	n := len(d.Req.Question)
+	if n == 1 {
+		return nil, false
+	}
+
+	formErr := (&dns.Msg{}).SetRcodeFormatError(d.Req)
+	err := fmt.Errorf("%w: %d", errBadQuestionsNum, n)
+	resp = p.malformedResponse(ctx, d.Proto, formErr, p.messages.NewMsgSERVFAIL(d.Req), err)
+
+	return resp, resp == nil
+}
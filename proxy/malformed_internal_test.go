@@ -0,0 +1,118 @@
+package proxy
+
+import (
+	"testing"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFormErrFromPacket(t *testing.T) {
+	t.Parallel()
+
+	req := (&dns.Msg{}).SetQuestion("example.com.", dns.TypeA)
+	req.Id = 1234
+
+	packet, err := req.Pack()
+	require.NoError(t, err)
+
+	// Truncate the question to make the message unparseable.
+	packet = packet[:len(packet)-2]
+
+	resp := formErrFromPacket(packet)
+	require.NotNil(t, resp)
+
+	assert.Equal(t, req.Id, resp.Id)
+	assert.Equal(t, dns.RcodeFormatError, resp.Rcode)
+	assert.Equal(t, dns.OpcodeQuery, resp.Opcode)
+	assert.True(t, resp.Response)
+
+	assert.Nil(t, formErrFromPacket(packet[:11]))
+
+	req.Response = true
+	packet, err = req.Pack()
+	require.NoError(t, err)
+
+	assert.Nil(t, formErrFromPacket(packet))
+}
+
+func TestProxy_checkQuestions(t *testing.T) {
+	t.Parallel()
+
+	req := &dns.Msg{
+		MsgHdr: dns.MsgHdr{Id: dns.Id()},
+	}
+
+	testCases := []struct {
+		action    MalformedAction
+		name      string
+		wantRcode int
+		wantDrop  bool
+	}{{
+		action:    MalformedActionDefault,
+		name:      "default",
+		wantRcode: dns.RcodeServerFailure,
+		wantDrop:  false,
+	}, {
+		action:    MalformedActionFormErr,
+		name:      "formerr",
+		wantRcode: dns.RcodeFormatError,
+		wantDrop:  false,
+	}, {
+		action:   MalformedActionDrop,
+		name:     "drop",
+		wantDrop: true,
+	}, {
+		action:   MalformedActionLogDrop,
+		name:     "log_drop",
+		wantDrop: true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			p := mustNew(t, &Config{
+				Logger:         testLogger,
+				UpstreamConfig: newTestUpstreamConfig(t, defaultTimeout, testDefaultUpstreamAddr),
+				MalformedQueryActions: map[Proto]MalformedAction{
+					ProtoUDP: tc.action,
+				},
+			})
+
+			d := p.newDNSContext(ProtoUDP, req, localhostAnyPort)
+			ctx := testutil.ContextWithTimeout(t, defaultTimeout)
+
+			resp, drop := p.checkQuestions(ctx, d)
+			assert.Equal(t, tc.wantDrop, drop)
+			assert.Equal(t, map[Proto]uint64{
+				ProtoUDP:      1,
+				ProtoTCP:      0,
+				ProtoTLS:      0,
+				ProtoHTTPS:    0,
+				ProtoQUIC:     0,
+				ProtoDNSCrypt: 0,
+			}, p.MalformedQueries())
+
+			stats := p.RejectStats()
+			require.Contains(t, stats, RejectReasonMalformed)
+
+			if tc.wantDrop {
+				assert.Equal(t, &RejectStats{Dropped: 1}, stats[RejectReasonMalformed])
+			} else {
+				assert.Equal(t, &RejectStats{Refused: 1}, stats[RejectReasonMalformed])
+			}
+
+			if tc.wantDrop {
+				assert.Nil(t, resp)
+
+				return
+			}
+
+			require.NotNil(t, resp)
+			assert.Equal(t, tc.wantRcode, resp.Rcode)
+		})
+	}
+}
@@ -0,0 +1,253 @@
+package proxy
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"runtime/debug"
+	"runtime/metrics"
+	"sync/atomic"
+	"time"
+
+	"github.com/AdguardTeam/golibs/timeutil"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// memoryCheckInterval is the minimum interval between the measurements of the
+// memory usage of the process, see [Config.MemoryLimit].
+const memoryCheckInterval = 1 * time.Second
+
+// MemoryStats are the statistics of the memory budget of the proxy, see
+// [Config.MemoryLimit].
+type MemoryStats struct {
+	// Usage is the latest measured memory usage of the process in bytes.
+	Usage uint64
+
+	// Limit is the memory budget in bytes.
+	Limit uint64
+
+	// Sheds is the number of times the budget has been exceeded.
+	Sheds uint64
+
+	// RejectedConns is the number of the DNS-over-HTTPS connections rejected
+	// while the budget has been exceeded.
+	RejectedConns uint64
+
+	// OverLimit is true if the proxy is shedding load at the moment.
+	OverLimit bool
+}
+
+// memGuard keeps the memory usage of the process within the budget by shedding
+// load once it's exceeded.  The usage is measured lazily, at most once per
+// [memoryCheckInterval], by the operations which can be skipped to save memory.
+// A nil *memGuard never sheds load.
+type memGuard struct {
+	// logger is used to log the changes of the state.  It is never nil.
+	logger *slog.Logger
+
+	// clock is used to schedule the measurements.  It is never nil.
+	clock timeutil.Clock
+
+	// usage returns the current memory usage of the process in bytes.  It is
+	// never nil.
+	usage func() (n uint64)
+
+	// shed releases the memory once the budget is exceeded.  It is never nil.
+	shed func()
+
+	// nextCheck is the Unix time in nanoseconds of the next measurement.
+	nextCheck atomic.Int64
+
+	// lastUsage is the latest measured memory usage in bytes.
+	lastUsage atomic.Uint64
+
+	// sheds is the number of times the budget has been exceeded.
+	sheds atomic.Uint64
+
+	// rejectedConns is the number of connections rejected over budget.
+	rejectedConns atomic.Uint64
+
+	// overLimit is true while the load is shed.
+	overLimit atomic.Bool
+
+	// limit is the memory budget in bytes.  It's always positive.
+	limit uint64
+}
+
+// newMemGuard returns a new guard of the memory budget of p, or nil if the
+// budget isn't set.  p.cache should be initialized.
+func (p *Proxy) newMemGuard() (g *memGuard) {
+	if p.MemoryLimit == 0 {
+		return nil
+	}
+
+	p.logger.Info("memory limit is set", "bytes", p.MemoryLimit)
+
+	return &memGuard{
+		logger: p.logger,
+		clock:  p.time,
+		usage:  processMemoryUsage,
+		shed: func() {
+			p.ClearCache()
+			debug.FreeOSMemory()
+		},
+		limit: p.MemoryLimit,
+	}
+}
+
+// processMemoryUsage returns the memory mapped by the Go runtime and not yet
+// released to the operating system, which approximates the resident set size
+// of the process.
+func processMemoryUsage() (n uint64) {
+	samples := []metrics.Sample{{
+		Name: "/memory/classes/total:bytes",
+	}, {
+		Name: "/memory/classes/heap/released:bytes",
+	}}
+	metrics.Read(samples)
+
+	return samples[0].Value.Uint64() - samples[1].Value.Uint64()
+}
+
+// exceeded returns true if the memory budget is exceeded.  Once the budget is
+// exceeded, the cache is cleared and the load is shed until the usage falls
+// below 90% of the budget, so that the state doesn't flap around the limit.  g
+// may be nil.
+func (g *memGuard) exceeded() (ok bool) {
+	if g == nil {
+		return false
+	}
+
+	now := g.clock.Now().UnixNano()
+	next := g.nextCheck.Load()
+	if now < next || !g.nextCheck.CompareAndSwap(next, now+int64(memoryCheckInterval)) {
+		return g.overLimit.Load()
+	}
+
+	usage := g.usage()
+	g.lastUsage.Store(usage)
+
+	if g.overLimit.Load() {
+		if usage > g.limit-g.limit/10 {
+			return true
+		}
+
+		g.overLimit.Store(false)
+		g.logger.Info("memory usage is within limit", "bytes", usage, "limit", g.limit)
+
+		return false
+	}
+
+	if usage <= g.limit {
+		return false
+	}
+
+	g.overLimit.Store(true)
+	g.sheds.Add(1)
+	g.logger.Warn("memory limit exceeded, shedding load", "bytes", usage, "limit", g.limit)
+	g.shed()
+
+	return true
+}
+
+// stats returns the current statistics of g.  g may be nil.
+func (g *memGuard) stats() (s *MemoryStats) {
+	if g == nil {
+		return &MemoryStats{
+			Usage: processMemoryUsage(),
+		}
+	}
+
+	return &MemoryStats{
+		Usage:         g.lastUsage.Load(),
+		Limit:         g.limit,
+		Sheds:         g.sheds.Load(),
+		RejectedConns: g.rejectedConns.Load(),
+		OverLimit:     g.overLimit.Load(),
+	}
+}
+
+// MemoryStats returns the statistics of the memory budget of p.  If
+// [Config.MemoryLimit] isn't set, only the current usage is reported.  It's
+// safe for concurrent use.
+func (p *Proxy) MemoryStats() (s *MemoryStats) {
+	return p.memGuard.stats()
+}
+
+// wrapListener returns l rejecting the new connections while the memory budget
+// is exceeded.  g may be nil, in which case l is returned as is.
+func (g *memGuard) wrapListener(l net.Listener) (wrapped net.Listener) {
+	if g == nil {
+		return l
+	}
+
+	return &memGuardListener{
+		Listener: l,
+		guard:    g,
+	}
+}
+
+// memGuardListener is a [net.Listener] closing the accepted connections while
+// the memory budget is exceeded.
+type memGuardListener struct {
+	net.Listener
+
+	// guard is the memory guard.  It is never nil.
+	guard *memGuard
+}
+
+// type check
+var _ net.Listener = (*memGuardListener)(nil)
+
+// Accept implements the [net.Listener] interface for *memGuardListener.
+func (l *memGuardListener) Accept() (conn net.Conn, err error) {
+	for {
+		conn, err = l.Listener.Accept()
+		if err != nil || !l.guard.exceeded() {
+			return conn, err
+		}
+
+		l.guard.rejectedConns.Add(1)
+		_ = conn.Close()
+	}
+}
+
+// wrapQUICListener returns l rejecting the new connections while the memory
+// budget is exceeded.  g may be nil, in which case l is returned as is.
+func (g *memGuard) wrapQUICListener(l *quic.EarlyListener) (wrapped http3.QUICListener) {
+	if g == nil {
+		return l
+	}
+
+	return &memGuardQUICListener{
+		EarlyListener: l,
+		guard:         g,
+	}
+}
+
+// memGuardQUICListener is an [http3.QUICListener] closing the accepted
+// connections while the memory budget is exceeded.
+type memGuardQUICListener struct {
+	*quic.EarlyListener
+
+	// guard is the memory guard.  It is never nil.
+	guard *memGuard
+}
+
+// type check
+var _ http3.QUICListener = (*memGuardQUICListener)(nil)
+
+// Accept implements the [http3.QUICListener] interface for
+// *memGuardQUICListener.
+func (l *memGuardQUICListener) Accept(ctx context.Context) (conn *quic.Conn, err error) {
+	for {
+		conn, err = l.EarlyListener.Accept(ctx)
+		if err != nil || !l.guard.exceeded() {
+			return conn, err
+		}
+
+		l.guard.rejectedConns.Add(1)
+		_ = conn.CloseWithError(quic.ApplicationErrorCode(http3.ErrCodeExcessiveLoad), "")
+	}
+}
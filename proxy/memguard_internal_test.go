@@ -0,0 +1,159 @@
+package proxy
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/AdguardTeam/golibs/testutil/faketime"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testMemState is the state of the process reported to the memory guard in
+// tests.
+type testMemState struct {
+	// usage is the memory usage in bytes.
+	usage atomic.Uint64
+
+	// now is the current time in nanoseconds since the start of the test.
+	now atomic.Int64
+
+	// sheds is the number of times the load has been shed.
+	sheds atomic.Uint64
+}
+
+// set sets the usage and moves the time forward by d.
+func (s *testMemState) set(usage uint64, d time.Duration) {
+	s.usage.Store(usage)
+	s.now.Add(int64(d))
+}
+
+// newTestMemGuard returns a new *memGuard with the given limit, which reports
+// the state of s.
+func newTestMemGuard(limit uint64, s *testMemState) (g *memGuard) {
+	start := time.Now()
+
+	return &memGuard{
+		logger: testLogger,
+		clock: &faketime.Clock{
+			OnNow: func() (n time.Time) { return start.Add(time.Duration(s.now.Load())) },
+		},
+		usage: s.usage.Load,
+		shed:  func() { s.sheds.Add(1) },
+		limit: limit,
+	}
+}
+
+func TestMemGuard_exceeded(t *testing.T) {
+	t.Parallel()
+
+	const limit = 1000
+
+	state := &testMemState{}
+	g := newTestMemGuard(limit, state)
+
+	// step sets the usage, moves the time forward by d, and checks the guard.
+	step := func(u uint64, d time.Duration) (ok bool) {
+		state.set(u, d)
+
+		return g.exceeded()
+	}
+
+	assert.False(t, step(limit, 0))
+	assert.True(t, step(limit+1, memoryCheckInterval))
+	assert.Equal(t, uint64(1), state.sheds.Load())
+
+	// The usage isn't measured again within the interval.
+	assert.True(t, step(0, memoryCheckInterval/2))
+
+	// Hysteresis keeps shedding load until the usage is below 90%.
+	assert.True(t, step(limit*95/100, memoryCheckInterval))
+	assert.False(t, step(limit*80/100, memoryCheckInterval))
+
+	assert.True(t, step(limit*2, memoryCheckInterval))
+	assert.Equal(t, uint64(2), state.sheds.Load())
+
+	s := g.stats()
+	assert.Equal(t, &MemoryStats{
+		Usage:         limit * 2,
+		Limit:         limit,
+		Sheds:         2,
+		RejectedConns: 0,
+		OverLimit:     true,
+	}, s)
+}
+
+func TestMemGuard_nil(t *testing.T) {
+	t.Parallel()
+
+	var g *memGuard
+	assert.False(t, g.exceeded())
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, l.Close)
+
+	assert.Same(t, l, g.wrapListener(l))
+
+	s := g.stats()
+	assert.Positive(t, s.Usage)
+	assert.Zero(t, s.Limit)
+}
+
+func TestMemGuardListener(t *testing.T) {
+	t.Parallel()
+
+	state := &testMemState{}
+	g := newTestMemGuard(1000, state)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	l := g.wrapListener(ln)
+	testutil.CleanupAndRequireSuccess(t, l.Close)
+
+	accepted := make(chan net.Conn)
+	go func() {
+		for {
+			conn, acceptErr := l.Accept()
+			if acceptErr != nil {
+				close(accepted)
+
+				return
+			}
+
+			accepted <- conn
+		}
+	}()
+
+	// dial connects to l and returns the connection accepted by it, if any.
+	dial := func() (conn net.Conn) {
+		client, dialErr := net.Dial("tcp", ln.Addr().String())
+		require.NoError(t, dialErr)
+		testutil.CleanupAndRequireSuccess(t, client.Close)
+
+		select {
+		case conn = <-accepted:
+			testutil.CleanupAndRequireSuccess(t, conn.Close)
+
+			return conn
+		case <-time.After(100 * time.Millisecond):
+			return nil
+		}
+	}
+
+	assert.NotNil(t, dial())
+
+	state.set(2000, memoryCheckInterval)
+	assert.Nil(t, dial())
+
+	require.Eventually(t, func() (ok bool) {
+		return g.stats().RejectedConns == 1
+	}, time.Second, 10*time.Millisecond)
+
+	state.set(0, memoryCheckInterval)
+	assert.NotNil(t, dial())
+}
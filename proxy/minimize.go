@@ -0,0 +1,47 @@
+package proxy
+
+import (
+	"slices"
+
+	"github.com/miekg/dns"
+)
+
+// minimizeResponse removes the authority and additional sections from resp
+// except for the OPT pseudo-record.  The SOA records and their DNSSEC proofs are
+// kept in the authority section of the negative responses, since they are
+// required for negative caching.  See RFC 2308.  resp must not be nil.
+func minimizeResponse(resp *dns.Msg) {
+	resp.Extra = slices.DeleteFunc(resp.Extra, func(rr dns.RR) (ok bool) {
+		_, ok = rr.(*dns.OPT)
+
+		return !ok
+	})
+
+	if !isNegativeResponse(resp) {
+		resp.Ns = nil
+
+		return
+	}
+
+	resp.Ns = slices.DeleteFunc(resp.Ns, func(rr dns.RR) (ok bool) {
+		switch rr.Header().Rrtype {
+		case dns.TypeSOA, dns.TypeNSEC, dns.TypeNSEC3, dns.TypeRRSIG:
+			return false
+		default:
+			return true
+		}
+	})
+}
+
+// isNegativeResponse returns true if resp is either an NXDOMAIN or a NODATA
+// response.  resp must not be nil.
+func isNegativeResponse(resp *dns.Msg) (ok bool) {
+	switch resp.Rcode {
+	case dns.RcodeNameError:
+		return true
+	case dns.RcodeSuccess:
+		return len(resp.Answer) == 0
+	default:
+		return false
+	}
+}
@@ -0,0 +1,91 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMinimizeResponse(t *testing.T) {
+	t.Parallel()
+
+	const fqdn = "example.com."
+
+	var (
+		ns = &dns.NS{
+			Hdr: dns.RR_Header{Name: fqdn, Rrtype: dns.TypeNS, Class: dns.ClassINET},
+			Ns:  "ns.example.com.",
+		}
+		soa = &dns.SOA{
+			Hdr: dns.RR_Header{Name: fqdn, Rrtype: dns.TypeSOA, Class: dns.ClassINET},
+			Ns:  "ns.example.com.",
+		}
+		glue = &dns.A{
+			Hdr: dns.RR_Header{Name: "ns.example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET},
+			A:   net.IP{192, 0, 2, 53},
+		}
+		ans = &dns.A{
+			Hdr: dns.RR_Header{Name: fqdn, Rrtype: dns.TypeA, Class: dns.ClassINET},
+			A:   net.IP{192, 0, 2, 1},
+		}
+		opt = &dns.OPT{
+			Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT},
+		}
+	)
+
+	testCases := []struct {
+		name      string
+		ans       []dns.RR
+		ns        []dns.RR
+		wantNs    []dns.RR
+		wantExtra []dns.RR
+		rcode     int
+	}{{
+		name:      "positive",
+		ans:       []dns.RR{ans},
+		ns:        []dns.RR{ns},
+		wantNs:    nil,
+		wantExtra: []dns.RR{opt},
+		rcode:     dns.RcodeSuccess,
+	}, {
+		name:      "nodata",
+		ans:       nil,
+		ns:        []dns.RR{soa, ns},
+		wantNs:    []dns.RR{soa},
+		wantExtra: []dns.RR{opt},
+		rcode:     dns.RcodeSuccess,
+	}, {
+		name:      "nxdomain",
+		ans:       nil,
+		ns:        []dns.RR{soa},
+		wantNs:    []dns.RR{soa},
+		wantExtra: []dns.RR{opt},
+		rcode:     dns.RcodeNameError,
+	}, {
+		name:      "servfail",
+		ans:       nil,
+		ns:        []dns.RR{ns},
+		wantNs:    nil,
+		wantExtra: []dns.RR{opt},
+		rcode:     dns.RcodeServerFailure,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			resp := (&dns.Msg{}).SetRcode((&dns.Msg{}).SetQuestion(fqdn, dns.TypeA), tc.rcode)
+			resp.Answer = tc.ans
+			resp.Ns = tc.ns
+			resp.Extra = []dns.RR{glue, opt}
+
+			minimizeResponse(resp)
+
+			assert.Equal(t, tc.ans, resp.Answer)
+			assert.Equal(t, tc.wantNs, resp.Ns)
+			assert.Equal(t, tc.wantExtra, resp.Extra)
+		})
+	}
+}
@@ -0,0 +1,585 @@
+package proxy
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bluele/gcache"
+	"github.com/miekg/dns"
+)
+
+const (
+	// nsecCacheZonesSize is the maximum number of zones kept by the cache of
+	// the NSEC and NSEC3 records.
+	nsecCacheZonesSize = 1_000
+
+	// nsecCacheProofsPerZone is the maximum number of the NSEC or NSEC3
+	// records kept for a single zone.  The oldest ones are evicted first.
+	nsecCacheProofsPerZone = 64
+
+	// nsec3MaxIterations is the maximum number of the additional NSEC3 hash
+	// iterations accepted for synthesizing responses.  The records with any
+	// additional iterations are ignored, since those are expensive to check
+	// for every query and may be treated as insecure by the validating
+	// resolvers anyway.
+	//
+	// See https://datatracker.ietf.org/doc/html/rfc9276#section-3.2.
+	nsec3MaxIterations = 0
+)
+
+// nsecCache is the cache of the NSEC and NSEC3 records from the validated
+// NXDOMAIN responses used to synthesize NXDOMAIN responses for the other names
+// covered by those, also known as aggressive negative caching.
+//
+// See https://datatracker.ietf.org/doc/html/rfc8198.
+type nsecCache struct {
+	// mu protects the contents of the zones.
+	mu *sync.Mutex
+
+	// zones maps the lowercased FQDN of the zone apex to its *nsecZone.
+	zones gcache.Cache
+}
+
+// nsecZone is the cached data of a single signed zone.
+type nsecZone struct {
+	// soa is the SOA record of the zone.
+	soa *dns.SOA
+
+	// upstream is the address of the upstream which the latest records have
+	// been received from.
+	upstream string
+
+	// soaSigs are the RRSIG records covering soa.
+	soaSigs []dns.RR
+
+	// proofs are the NSEC or NSEC3 records of the zone from the oldest to
+	// the newest one.
+	proofs []*nsecProof
+}
+
+// nsecProof is a single NSEC or NSEC3 record with its signatures.
+type nsecProof struct {
+	// expire is the time when the record expires, either by its TTL or by the
+	// expiration of its signatures or the ones of the SOA record.
+	expire time.Time
+
+	// rr is either a *dns.NSEC or a *dns.NSEC3.
+	rr dns.RR
+
+	// sigs are the RRSIG records covering rr.
+	sigs []dns.RR
+}
+
+// newNSECCache returns a new properly initialized *nsecCache.
+func newNSECCache() (c *nsecCache) {
+	return &nsecCache{
+		mu:    &sync.Mutex{},
+		zones: gcache.New(nsecCacheZonesSize).LRU().Build(),
+	}
+}
+
+// set stores the NSEC or NSEC3 records from resp if it's an NXDOMAIN response
+// validated by the upstream, i.e. having the AD bit set.  upsAddr is the
+// address of the upstream resp has been received from at now.
+func (c *nsecCache) set(resp *dns.Msg, upsAddr string, now time.Time) {
+	if resp == nil || resp.Rcode != dns.RcodeNameError || !resp.AuthenticatedData {
+		return
+	}
+
+	soa, soaSigs := nsecSOA(resp.Ns)
+	if soa == nil {
+		return
+	}
+
+	ttl := min(soa.Hdr.Ttl, soa.Minttl)
+	soaExpire := sigsExpire(soaSigs, now)
+
+	var proofs []*nsecProof
+	for _, rr := range resp.Ns {
+		if !isUsableProof(rr, soa.Hdr.Name) {
+			continue
+		}
+
+		sigs := rrsigsFor(resp.Ns, rr.Header().Name, rr.Header().Rrtype)
+		expire := now.Add(time.Duration(min(ttl, rr.Header().Ttl)) * time.Second)
+		for _, e := range []time.Time{soaExpire, sigsExpire(sigs, now)} {
+			if !e.IsZero() && e.Before(expire) {
+				expire = e
+			}
+		}
+
+		proofs = append(proofs, &nsecProof{
+			expire: expire,
+			rr:     dns.Copy(rr),
+			sigs:   sigs,
+		})
+	}
+
+	if len(proofs) == 0 {
+		return
+	}
+
+	key := strings.ToLower(soa.Hdr.Name)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	z := c.zone(key)
+	if z == nil {
+		z = &nsecZone{}
+	}
+
+	z.soa, z.soaSigs, z.upstream = dns.Copy(soa).(*dns.SOA), soaSigs, upsAddr
+	for _, p := range proofs {
+		z.proofs = slices.DeleteFunc(z.proofs, func(old *nsecProof) (ok bool) {
+			return strings.EqualFold(old.rr.Header().Name, p.rr.Header().Name)
+		})
+		z.proofs = append(z.proofs, p)
+	}
+
+	if n := len(z.proofs) - nsecCacheProofsPerZone; n > 0 {
+		z.proofs = slices.Delete(z.proofs, 0, n)
+	}
+
+	err := c.zones.Set(key, z)
+	if err != nil {
+		// Shouldn't happen, since we don't set a serialization function.
+		panic(fmt.Errorf("nsec cache: setting cache item: %w", err))
+	}
+}
+
+// sigsExpire returns the earliest expiration time of the RRSIG records from
+// sigs received at now, or the zero time if there are none.  The expiration
+// times are compared to now using the serial number arithmetic.
+//
+// See https://datatracker.ietf.org/doc/html/rfc4034#section-3.1.5.
+func sigsExpire(sigs []dns.RR, now time.Time) (expire time.Time) {
+	for _, rr := range sigs {
+		sig, ok := rr.(*dns.RRSIG)
+		if !ok {
+			continue
+		}
+
+		left := time.Duration(int32(sig.Expiration-uint32(now.Unix()))) * time.Second
+		if e := now.Add(left); expire.IsZero() || e.Before(expire) {
+			expire = e
+		}
+	}
+
+	return expire
+}
+
+// zone returns the cached zone for the lowercased FQDN key, if any.  c.mu is
+// expected to be locked.
+func (c *nsecCache) zone(key string) (z *nsecZone) {
+	v, err := c.zones.Get(key)
+	if err != nil {
+		return nil
+	}
+
+	z, _ = v.(*nsecZone)
+
+	return z
+}
+
+// get returns the synthesized NXDOMAIN response for req, if the non-existence
+// of its name is proven by the records not expired at now.  upsAddr is the
+// address of the upstream the records have been received from.
+func (c *nsecCache) get(req *dns.Msg, now time.Time) (resp *dns.Msg, upsAddr string) {
+	if len(req.Question) != 1 {
+		return nil, ""
+	}
+
+	name := strings.ToLower(req.Question[0].Name)
+
+	// Check the proofs outside of the lock, since hashing the names for the
+	// NSEC3 records is expensive.
+	z := c.snapshot(name, now)
+	if z == nil {
+		return nil, ""
+	}
+
+	proofs := proveNXDomain(name, z.soa.Hdr.Name, z.proofs)
+	if proofs == nil {
+		return nil, ""
+	}
+
+	return z.synthesize(req, proofs, now), z.upstream
+}
+
+// snapshot returns the copy of the closest cached zone enclosing the
+// lowercased FQDN name with only the proofs not expired at now, or nil if
+// there is no such zone.  The cached records themselves are never modified, so
+// those are shared with the cache.
+func (c *nsecCache) snapshot(name string, now time.Time) (z *nsecZone) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var cached *nsecZone
+	for off, end := 0, false; !end && cached == nil; off, end = dns.NextLabel(name, off) {
+		cached = c.zone(name[off:])
+	}
+
+	if cached == nil {
+		return nil
+	}
+
+	z = &nsecZone{
+		soa:      cached.soa,
+		upstream: cached.upstream,
+		soaSigs:  cached.soaSigs,
+	}
+
+	for _, p := range cached.proofs {
+		if now.Before(p.expire) {
+			z.proofs = append(z.proofs, p)
+		}
+	}
+
+	return z
+}
+
+// synthesize returns the NXDOMAIN response for req with the SOA record of z
+// and proofs in the authority section.
+func (z *nsecZone) synthesize(req *dns.Msg, proofs []*nsecProof, now time.Time) (resp *dns.Msg) {
+	resp = (&dns.Msg{}).SetRcode(req, dns.RcodeNameError)
+	resp.AuthenticatedData = true
+	resp.RecursionAvailable = true
+
+	// The TTLs of the SOA and its signatures shouldn't exceed the ones of the
+	// proofs.
+	ttl := z.soa.Minttl
+	for _, p := range proofs {
+		ttl = min(ttl, uint32(p.expire.Sub(now)/time.Second))
+	}
+
+	resp.Ns = appendWithTTL(resp.Ns, ttl, z.soa)
+	resp.Ns = appendWithTTL(resp.Ns, ttl, z.soaSigs...)
+	for _, p := range proofs {
+		pttl := uint32(p.expire.Sub(now) / time.Second)
+		resp.Ns = appendWithTTL(resp.Ns, pttl, p.rr)
+		resp.Ns = appendWithTTL(resp.Ns, pttl, p.sigs...)
+	}
+
+	return resp
+}
+
+// appendWithTTL appends the copies of rrs with TTL set to ttl to dst.
+func appendWithTTL(dst []dns.RR, ttl uint32, rrs ...dns.RR) (res []dns.RR) {
+	for _, rr := range rrs {
+		rr = dns.Copy(rr)
+		rr.Header().Ttl = ttl
+		dst = append(dst, rr)
+	}
+
+	return dst
+}
+
+// nsecSOA returns the SOA record and its signatures from the authority
+// section.
+func nsecSOA(ns []dns.RR) (soa *dns.SOA, sigs []dns.RR) {
+	for _, rr := range ns {
+		if soa, _ = rr.(*dns.SOA); soa != nil {
+			return soa, rrsigsFor(ns, soa.Hdr.Name, dns.TypeSOA)
+		}
+	}
+
+	return nil, nil
+}
+
+// rrsigsFor returns the copies of the RRSIG records from rrs covering the
+// RRset of type typ owned by name.
+func rrsigsFor(rrs []dns.RR, name string, typ uint16) (sigs []dns.RR) {
+	for _, rr := range rrs {
+		sig, ok := rr.(*dns.RRSIG)
+		if ok && sig.TypeCovered == typ && strings.EqualFold(sig.Hdr.Name, name) {
+			sigs = append(sigs, dns.Copy(sig))
+		}
+	}
+
+	return sigs
+}
+
+// isUsableProof returns true if rr is an NSEC or NSEC3 record of the zone
+// which may be used to prove the non-existence of names.
+func isUsableProof(rr dns.RR, zone string) (ok bool) {
+	if !dns.IsSubDomain(zone, rr.Header().Name) {
+		return false
+	}
+
+	switch rr := rr.(type) {
+	case *dns.NSEC:
+		return true
+	case *dns.NSEC3:
+		// Opt-out records don't prove the non-existence of the insecure
+		// delegations.
+		//
+		// See https://datatracker.ietf.org/doc/html/rfc5155#section-6.
+		return rr.Hash == dns.SHA1 && rr.Flags&0x01 == 0 && rr.Iterations <= nsec3MaxIterations
+	default:
+		return false
+	}
+}
+
+// proveNXDomain returns the records from proofs proving that the lowercased
+// FQDN name doesn't exist within zone, or nil if those don't prove it.
+func proveNXDomain(name, zone string, proofs []*nsecProof) (res []*nsecProof) {
+	var nsecs, nsec3s []*nsecProof
+	for _, p := range proofs {
+		switch p.rr.(type) {
+		case *dns.NSEC:
+			nsecs = append(nsecs, p)
+		case *dns.NSEC3:
+			nsec3s = append(nsec3s, p)
+		}
+	}
+
+	if res = proveNSEC(name, zone, nsecs); res != nil {
+		return res
+	}
+
+	return proveNSEC3(name, zone, nsec3s)
+}
+
+// proveNSEC returns the NSEC records proving that name doesn't exist, i.e. the
+// records covering name and the wildcard at its closest encloser.
+//
+// See https://datatracker.ietf.org/doc/html/rfc4035#section-5.4.
+func proveNSEC(name, zone string, proofs []*nsecProof) (res []*nsecProof) {
+	nameProof := findProof(proofs, func(rr dns.RR) (ok bool) {
+		return nsecCovers(rr.(*dns.NSEC), name)
+	})
+	if nameProof == nil {
+		return nil
+	}
+
+	nsec := nameProof.rr.(*dns.NSEC)
+	ce := longestName(
+		commonAncestor(name, nsec.Hdr.Name),
+		commonAncestor(name, nsec.NextDomain),
+	)
+	if !dns.IsSubDomain(zone, ce) {
+		return nil
+	}
+
+	wildcard := "*." + ce
+	wcProof := findProof(proofs, func(rr dns.RR) (ok bool) {
+		return nsecCovers(rr.(*dns.NSEC), wildcard)
+	})
+	if wcProof == nil {
+		return nil
+	} else if wcProof == nameProof {
+		return []*nsecProof{nameProof}
+	}
+
+	return []*nsecProof{nameProof, wcProof}
+}
+
+// nsecCovers returns true if nsec proves that name doesn't exist.
+func nsecCovers(nsec *dns.NSEC, name string) (ok bool) {
+	owner, next := nsec.Hdr.Name, nsec.NextDomain
+
+	// Names below a delegation or a DNAME aren't covered by the NSEC record
+	// of the parent zone.
+	if dns.IsSubDomain(owner, name) && !strings.EqualFold(owner, name) {
+		hasNS := slices.Contains(nsec.TypeBitMap, dns.TypeNS)
+		hasSOA := slices.Contains(nsec.TypeBitMap, dns.TypeSOA)
+		if (hasNS && !hasSOA) || slices.Contains(nsec.TypeBitMap, dns.TypeDNAME) {
+			return false
+		}
+	}
+
+	if canonicalCompare(owner, next) < 0 {
+		return canonicalCompare(owner, name) < 0 && canonicalCompare(name, next) < 0
+	}
+
+	// The last NSEC record in the zone points back to the apex.
+	return canonicalCompare(owner, name) < 0 || canonicalCompare(name, next) < 0
+}
+
+// proveNSEC3 returns the NSEC3 records proving that name doesn't exist, i.e.
+// the records matching its closest encloser, covering the next closer name,
+// and covering the wildcard at the closest encloser.
+//
+// See https://datatracker.ietf.org/doc/html/rfc5155#section-8.4.
+func proveNSEC3(name, zone string, proofs []*nsecProof) (res []*nsecProof) {
+	if len(proofs) == 0 {
+		return nil
+	}
+
+	hashes := nsec3Hashes{}
+	if findProof(proofs, func(rr dns.RR) (ok bool) { return hashes.match(rr, name) }) != nil {
+		// The name exists.
+		return nil
+	}
+
+	nextCloser := name
+	for off, end := dns.NextLabel(name, 0); !end; off, end = dns.NextLabel(name, off) {
+		ce := name[off:]
+		if !dns.IsSubDomain(zone, ce) {
+			return nil
+		}
+
+		ceProof := findProof(proofs, func(rr dns.RR) (ok bool) {
+			return hashes.match(rr, ce)
+		})
+		if ceProof != nil {
+			return hashes.closure(proofs, ceProof, nextCloser, "*."+ce)
+		}
+
+		nextCloser = ce
+	}
+
+	return nil
+}
+
+// closure returns the NSEC3 records proving the non-existence of the name
+// having the closest encloser matched by ceProof, or nil if there are no
+// records covering nextCloser and wildcard.
+func (h nsec3Hashes) closure(
+	proofs []*nsecProof,
+	ceProof *nsecProof,
+	nextCloser string,
+	wildcard string,
+) (res []*nsecProof) {
+	ncProof := findProof(proofs, func(rr dns.RR) (ok bool) {
+		return h.cover(rr, nextCloser)
+	})
+	wcProof := findProof(proofs, func(rr dns.RR) (ok bool) {
+		return h.cover(rr, wildcard)
+	})
+	if ncProof == nil || wcProof == nil {
+		return nil
+	}
+
+	res = []*nsecProof{ceProof}
+	for _, p := range []*nsecProof{ncProof, wcProof} {
+		if !slices.Contains(res, p) {
+			res = append(res, p)
+		}
+	}
+
+	return res
+}
+
+// nsec3HashKey is the key of [nsec3Hashes].
+type nsec3HashKey struct {
+	// name is the lowercased FQDN being hashed.
+	name string
+
+	// salt is the hex-encoded salt of the NSEC3 record.
+	salt string
+
+	// iterations is the number of the additional hash iterations of the NSEC3
+	// record.
+	iterations uint16
+}
+
+// nsec3Hashes are the NSEC3 hashes of the names computed during a single
+// check, so that each name is only hashed once for the records sharing the
+// same parameters.
+type nsec3Hashes map[nsec3HashKey]string
+
+// hash returns the NSEC3 hash of name using the parameters of nsec3.
+func (h nsec3Hashes) hash(nsec3 *dns.NSEC3, name string) (hash string) {
+	key := nsec3HashKey{
+		name:       name,
+		salt:       strings.ToUpper(nsec3.Salt),
+		iterations: nsec3.Iterations,
+	}
+
+	hash, ok := h[key]
+	if !ok {
+		hash = dns.HashName(name, nsec3.Hash, nsec3.Iterations, nsec3.Salt)
+		h[key] = hash
+	}
+
+	return hash
+}
+
+// nsec3OwnerHash returns the uppercased hash from the owner name of nsec3.  ok
+// is false if name isn't within the zone of nsec3.
+func nsec3OwnerHash(nsec3 *dns.NSEC3, name string) (hash string, ok bool) {
+	owner := strings.ToUpper(nsec3.Hdr.Name)
+	labels := dns.Split(owner)
+	if len(labels) < 2 {
+		return "", false
+	}
+
+	return owner[:labels[1]-1], dns.IsSubDomain(owner[labels[1]:], strings.ToUpper(name))
+}
+
+// match is like [dns.NSEC3.Match] for rr, which must be a *dns.NSEC3, but
+// uses the hashes from h.
+func (h nsec3Hashes) match(rr dns.RR, name string) (ok bool) {
+	nsec3 := rr.(*dns.NSEC3)
+	ownerHash, ok := nsec3OwnerHash(nsec3, name)
+
+	return ok && ownerHash == h.hash(nsec3, name)
+}
+
+// cover is like [dns.NSEC3.Cover] for rr, which must be a *dns.NSEC3, but uses
+// the hashes from h.
+func (h nsec3Hashes) cover(rr dns.RR, name string) (ok bool) {
+	nsec3 := rr.(*dns.NSEC3)
+	ownerHash, ok := nsec3OwnerHash(nsec3, name)
+	if !ok {
+		return false
+	}
+
+	nameHash, nextHash := h.hash(nsec3, name), nsec3.NextDomain
+	switch {
+	case ownerHash == nextHash:
+		// The only record in the zone covers all the other names.
+		return nameHash != ownerHash
+	case ownerHash > nextHash:
+		// The last record in the zone covers the names after it and before
+		// the first one.
+		return nameHash > ownerHash || nameHash < nextHash
+	default:
+		return ownerHash < nameHash && nameHash < nextHash
+	}
+}
+
+// findProof returns the first proof with the record satisfying f, if any.
+func findProof(proofs []*nsecProof, f func(rr dns.RR) (ok bool)) (p *nsecProof) {
+	i := slices.IndexFunc(proofs, func(p *nsecProof) (ok bool) { return f(p.rr) })
+	if i < 0 {
+		return nil
+	}
+
+	return proofs[i]
+}
+
+// canonicalCompare compares the FQDNs a and b in the canonical DNS name order.
+// It ignores the escaped characters within the labels.
+//
+// See https://datatracker.ietf.org/doc/html/rfc4034#section-6.1.
+func canonicalCompare(a, b string) (res int) {
+	al := dns.SplitDomainName(strings.ToLower(a))
+	bl := dns.SplitDomainName(strings.ToLower(b))
+	slices.Reverse(al)
+	slices.Reverse(bl)
+
+	return slices.Compare(al, bl)
+}
+
+// commonAncestor returns the longest common ancestor of the FQDNs a and b.
+func commonAncestor(a, b string) (anc string) {
+	n := dns.CompareDomainName(a, b)
+	labels := dns.SplitDomainName(strings.ToLower(a))
+
+	return dns.Fqdn(strings.Join(labels[len(labels)-n:], "."))
+}
+
+// longestName returns the longest of the FQDNs a and b.
+func longestName(a, b string) (name string) {
+	if dns.CountLabel(a) >= dns.CountLabel(b) {
+		return a
+	}
+
+	return b
+}
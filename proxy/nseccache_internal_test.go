@@ -0,0 +1,290 @@
+package proxy
+
+import (
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/internal/dnsproxytest"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testNSECZone is the signed zone used in the aggressive NSEC caching tests.
+const testNSECZone = "example."
+
+// newTestNSEC returns an NSEC record of [testNSECZone].
+func newTestNSEC(owner, next string) (rr *dns.NSEC) {
+	return &dns.NSEC{
+		Hdr: dns.RR_Header{
+			Name:   owner,
+			Rrtype: dns.TypeNSEC,
+			Class:  dns.ClassINET,
+			Ttl:    defaultTestTTL,
+		},
+		NextDomain: next,
+		TypeBitMap: []uint16{dns.TypeA, dns.TypeRRSIG, dns.TypeNSEC},
+	}
+}
+
+// newTestNXDomain returns a validated NXDOMAIN response to req from
+// [testNSECZone] with proofs in the authority section.
+func newTestNXDomain(req *dns.Msg, proofs ...dns.RR) (resp *dns.Msg) {
+	resp = (&dns.Msg{}).SetRcode(req, dns.RcodeNameError)
+	resp.AuthenticatedData = true
+	resp.Ns = append([]dns.RR{&dns.SOA{
+		Hdr: dns.RR_Header{
+			Name:   testNSECZone,
+			Rrtype: dns.TypeSOA,
+			Class:  dns.ClassINET,
+			Ttl:    defaultTestTTL,
+		},
+		Ns:     "ns." + testNSECZone,
+		Mbox:   "hostmaster." + testNSECZone,
+		Serial: 1,
+		Minttl: defaultTestTTL,
+	}}, proofs...)
+
+	return resp
+}
+
+func TestProxy_Resolve_aggressiveNSEC(t *testing.T) {
+	t.Parallel()
+
+	// The zone contains the apex, a.example., and d.example.
+	nsecApex := newTestNSEC(testNSECZone, "a."+testNSECZone)
+	nsecA := newTestNSEC("a."+testNSECZone, "d."+testNSECZone)
+
+	var exchanges atomic.Int32
+	u := &dnsproxytest.Upstream{
+		OnExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+			exchanges.Add(1)
+
+			return newTestNXDomain(req, nsecA, nsecApex), nil
+		},
+		OnAddress: func() (addr string) { return testUpsAddr },
+		OnClose:   func() (err error) { return nil },
+	}
+
+	p := mustNew(t, &Config{
+		Logger:              testLogger,
+		UpstreamConfig:      &UpstreamConfig{Upstreams: []upstream.Upstream{u}},
+		TrustedProxies:      defaultTrustedProxies,
+		CacheEnabled:        true,
+		CacheSizeBytes:      defaultCacheSize,
+		DNSSECEnabled:       true,
+		CacheAggressiveNSEC: true,
+	})
+
+	resolve := func(t *testing.T, name string) (d *DNSContext) {
+		t.Helper()
+
+		d = newDNSContext(name, dns.TypeA, dns.ClassINET, true, dns.DefaultMsgSize)
+		err := p.Resolve(testutil.ContextWithTimeout(t, defaultTimeout), d)
+		require.NoError(t, err)
+		require.NotNil(t, d.Res)
+
+		assert.Equal(t, dns.RcodeNameError, d.Res.Rcode)
+
+		return d
+	}
+
+	resolve(t, "b."+testNSECZone)
+	require.EqualValues(t, 1, exchanges.Load())
+
+	t.Run("covered", func(t *testing.T) {
+		d := resolve(t, "c."+testNSECZone)
+
+		assert.EqualValues(t, 1, exchanges.Load())
+		assert.Equal(t, CacheDecisionNSEC, d.Trace.Cache)
+		assert.True(t, d.Res.AuthenticatedData)
+
+		i := slices.IndexFunc(d.Res.Ns, func(rr dns.RR) (ok bool) {
+			return rr.Header().Rrtype == dns.TypeNSEC
+		})
+		assert.GreaterOrEqual(t, i, 0)
+	})
+
+	t.Run("not_covered", func(t *testing.T) {
+		before := exchanges.Load()
+		d := resolve(t, "e."+testNSECZone)
+
+		assert.Equal(t, before+1, exchanges.Load())
+		assert.NotEqual(t, CacheDecisionNSEC, d.Trace.Cache)
+	})
+}
+
+func TestNSECCache_nsec3(t *testing.T) {
+	t.Parallel()
+
+	// The zone contains the apex and a.example. only, so the chain of two
+	// NSEC3 records covers all the other names.
+	existing := []string{testNSECZone, "a." + testNSECZone}
+
+	hashes := make([]string, 0, len(existing))
+	for _, name := range existing {
+		hashes = append(hashes, dns.HashName(name, dns.SHA1, 0, ""))
+	}
+	slices.Sort(hashes)
+
+	var proofs []dns.RR
+	for i, h := range hashes {
+		proofs = append(proofs, &dns.NSEC3{
+			Hdr: dns.RR_Header{
+				Name:   strings.ToLower(h) + "." + testNSECZone,
+				Rrtype: dns.TypeNSEC3,
+				Class:  dns.ClassINET,
+				Ttl:    defaultTestTTL,
+			},
+			Hash:       dns.SHA1,
+			NextDomain: hashes[(i+1)%len(hashes)],
+			TypeBitMap: []uint16{dns.TypeA, dns.TypeRRSIG},
+		})
+	}
+
+	now := time.Now()
+	c := newNSECCache()
+	req := (&dns.Msg{}).SetQuestion("b."+testNSECZone, dns.TypeA)
+	c.set(newTestNXDomain(req, proofs...), testUpsAddr, now)
+
+	testCases := []struct {
+		name    string
+		qname   string
+		now     time.Time
+		wantHit bool
+	}{{
+		name:    "covered",
+		qname:   "x." + testNSECZone,
+		now:     now,
+		wantHit: true,
+	}, {
+		name:    "covered_deep",
+		qname:   "x.y." + testNSECZone,
+		now:     now,
+		wantHit: true,
+	}, {
+		name:    "existing",
+		qname:   "a." + testNSECZone,
+		now:     now,
+		wantHit: false,
+	}, {
+		name:    "other_zone",
+		qname:   "x.example.org.",
+		now:     now,
+		wantHit: false,
+	}, {
+		name:    "expired",
+		qname:   "x." + testNSECZone,
+		now:     now.Add(2 * defaultTestTTL * time.Second),
+		wantHit: false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			q := (&dns.Msg{}).SetQuestion(tc.qname, dns.TypeA)
+			resp, upsAddr := c.get(q, tc.now)
+			if !tc.wantHit {
+				assert.Nil(t, resp)
+
+				return
+			}
+
+			require.NotNil(t, resp)
+
+			assert.Equal(t, dns.RcodeNameError, resp.Rcode)
+			assert.Equal(t, testUpsAddr, upsAddr)
+			assert.Equal(t, q.Question, resp.Question)
+		})
+	}
+}
+
+func TestNSECCache_set_unvalidated(t *testing.T) {
+	t.Parallel()
+
+	c := newNSECCache()
+	req := (&dns.Msg{}).SetQuestion("b."+testNSECZone, dns.TypeA)
+	resp := newTestNXDomain(req, newTestNSEC("a."+testNSECZone, "d."+testNSECZone))
+	resp.AuthenticatedData = false
+
+	now := time.Now()
+	c.set(resp, testUpsAddr, now)
+
+	got, _ := c.get((&dns.Msg{}).SetQuestion("c."+testNSECZone, dns.TypeA), now)
+	assert.Nil(t, got)
+}
+
+func TestNSECCache_sigExpiration(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	nsecApex := newTestNSEC(testNSECZone, "a."+testNSECZone)
+	nsec := newTestNSEC("a."+testNSECZone, "d."+testNSECZone)
+
+	const sigLifetime = 10
+	sig := &dns.RRSIG{
+		Hdr: dns.RR_Header{
+			Name:   nsec.Hdr.Name,
+			Rrtype: dns.TypeRRSIG,
+			Class:  dns.ClassINET,
+			Ttl:    defaultTestTTL,
+		},
+		TypeCovered: dns.TypeNSEC,
+		Algorithm:   dns.ECDSAP256SHA256,
+		Expiration:  uint32(now.Unix()) + sigLifetime,
+		Inception:   uint32(now.Unix()) - sigLifetime,
+		SignerName:  testNSECZone,
+	}
+	require.Greater(t, defaultTestTTL, 2*sigLifetime)
+
+	c := newNSECCache()
+	req := (&dns.Msg{}).SetQuestion("b."+testNSECZone, dns.TypeA)
+	c.set(newTestNXDomain(req, nsec, sig, nsecApex), testUpsAddr, now)
+
+	q := (&dns.Msg{}).SetQuestion("c."+testNSECZone, dns.TypeA)
+
+	resp, _ := c.get(q, now.Add(sigLifetime/2*time.Second))
+	require.NotNil(t, resp)
+
+	for _, rr := range resp.Ns {
+		if strings.EqualFold(rr.Header().Name, nsec.Hdr.Name) {
+			assert.LessOrEqual(t, rr.Header().Ttl, uint32(sigLifetime))
+		}
+	}
+
+	// The signature has expired before the TTL.
+	resp, _ = c.get(q, now.Add(2*sigLifetime*time.Second))
+	assert.Nil(t, resp)
+}
+
+func TestNSECCache_nsec3Iterations(t *testing.T) {
+	t.Parallel()
+
+	// The only record covers all the other names.
+	const iterations = 1
+	hash := dns.HashName(testNSECZone, dns.SHA1, iterations, "")
+
+	c := newNSECCache()
+	req := (&dns.Msg{}).SetQuestion("b."+testNSECZone, dns.TypeA)
+	c.set(newTestNXDomain(req, &dns.NSEC3{
+		Hdr: dns.RR_Header{
+			Name:   strings.ToLower(hash) + "." + testNSECZone,
+			Rrtype: dns.TypeNSEC3,
+			Class:  dns.ClassINET,
+			Ttl:    defaultTestTTL,
+		},
+		Hash:       dns.SHA1,
+		Iterations: iterations,
+		NextDomain: hash,
+		TypeBitMap: []uint16{dns.TypeSOA, dns.TypeRRSIG},
+	}), testUpsAddr, time.Now())
+
+	resp, _ := c.get((&dns.Msg{}).SetQuestion("x."+testNSECZone, dns.TypeA), time.Now())
+	assert.Nil(t, resp)
+}
@@ -15,7 +15,7 @@ type cachingResolver interface {
 	// resolved and the response may be cached.
 	//
 	// TODO(e.burkov):  Find out when ok can be false with nil err.
-	replyFromUpstream(dctx *DNSContext) (ok bool, err error)
+	replyFromUpstream(ctx context.Context, dctx *DNSContext) (ok bool, err error)
 
 	// cacheResp caches the response from dctx.
 	cacheResp(dctx *DNSContext)
@@ -49,7 +49,9 @@ func newOptimisticResolver(cr cachingResolver) (s *optimisticResolver) {
 //
 // TODO(e.burkov):  Pass the context.
 func (s *optimisticResolver) resolveOnce(dctx *DNSContext, key []byte, l *slog.Logger) {
-	defer slogutil.RecoverAndLog(context.TODO(), l)
+	// Don't use the context of the request, since the resolution outlives it.
+	ctx := context.Background()
+	defer slogutil.RecoverAndLog(ctx, l)
 
 	keyHexed := hex.EncodeToString(key)
 	if _, ok := s.reqs.LoadOrStore(keyHexed, unit{}); ok {
@@ -57,7 +59,7 @@ func (s *optimisticResolver) resolveOnce(dctx *DNSContext, key []byte, l *slog.L
 	}
 	defer s.reqs.Delete(keyHexed)
 
-	ok, err := s.cr.replyFromUpstream(dctx)
+	ok, err := s.cr.replyFromUpstream(ctx, dctx)
 	if err != nil {
 		l.Debug("resolving request for optimistic cache", slogutil.KeyError, err)
 	}
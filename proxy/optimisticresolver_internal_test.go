@@ -2,6 +2,7 @@ package proxy
 
 import (
 	"bytes"
+	"context"
 	"log/slog"
 	"sync"
 	"testing"
@@ -19,7 +20,10 @@ type testCachingResolver struct {
 
 // replyFromUpstream implements the cachingResolver interface for
 // *testCachingResolver.
-func (tcr *testCachingResolver) replyFromUpstream(dctx *DNSContext) (ok bool, err error) {
+func (tcr *testCachingResolver) replyFromUpstream(
+	_ context.Context,
+	dctx *DNSContext,
+) (ok bool, err error) {
 	return tcr.onReplyFromUpstream(dctx)
 }
 
@@ -0,0 +1,118 @@
+package proxy
+
+import (
+	"encoding"
+	"fmt"
+	"slices"
+
+	"github.com/miekg/dns"
+)
+
+// PaddingMode is an enumeration of the modes of padding the responses sent
+// over the encrypted protocols: DNS-over-TLS, DNS-over-HTTPS, and
+// DNS-over-QUIC.
+//
+// See https://datatracker.ietf.org/doc/html/rfc8467.
+type PaddingMode string
+
+const (
+	// PaddingModeDisabled makes the proxy never pad the responses.
+	PaddingModeDisabled PaddingMode = ""
+
+	// PaddingModeRequested makes the proxy only pad the responses to the
+	// queries, which are padded themselves, as RFC 7830 requires.
+	PaddingModeRequested PaddingMode = "requested"
+
+	// PaddingModeAlways makes the proxy pad the responses to all the queries
+	// with an OPT record.
+	PaddingModeAlways PaddingMode = "always"
+)
+
+// paddingBlockSize is the size the lengths of the padded responses are
+// multiples of.
+//
+// See https://datatracker.ietf.org/doc/html/rfc8467#section-4.1.
+const paddingBlockSize = 468
+
+// type check
+var _ encoding.TextUnmarshaler = (*PaddingMode)(nil)
+
+// UnmarshalText implements [encoding.TextUnmarshaler] interface for
+// *PaddingMode.
+func (m *PaddingMode) UnmarshalText(b []byte) (err error) {
+	switch pm := PaddingMode(b); pm {
+	case
+		PaddingModeDisabled,
+		PaddingModeRequested,
+		PaddingModeAlways:
+		*m = pm
+	default:
+		return fmt.Errorf(
+			"invalid padding mode %q, supported: %q, %q",
+			b,
+			PaddingModeRequested,
+			PaddingModeAlways,
+		)
+	}
+
+	return nil
+}
+
+// padResponse pads d.Res according to the padding mode, if d.Proto is an
+// encrypted one.
+func (p *Proxy) padResponse(d *DNSContext) {
+	if p.Padding == PaddingModeDisabled || d.Res == nil || d.Req == nil {
+		return
+	}
+
+	switch d.Proto {
+	case ProtoTLS, ProtoHTTPS, ProtoQUIC:
+		// Go on.
+	default:
+		return
+	}
+
+	reqOpt := d.Req.IsEdns0()
+	if reqOpt == nil {
+		// The response must not contain the OPT record then.
+		return
+	}
+
+	if p.Padding == PaddingModeRequested && !hasPadding(reqOpt) {
+		return
+	}
+
+	resOpt := d.Res.IsEdns0()
+	if resOpt == nil {
+		return
+	}
+
+	padMsg(d.Res, resOpt)
+}
+
+// hasPadding returns true if opt contains the padding option.
+func hasPadding(opt *dns.OPT) (ok bool) {
+	return slices.ContainsFunc(opt.Option, func(o dns.EDNS0) (isPad bool) {
+		return o.Option() == dns.EDNS0PADDING
+	})
+}
+
+// padMsg replaces the padding option in opt, which must be the OPT record of
+// msg, with the one making the packed length of msg a multiple of
+// [paddingBlockSize].
+func padMsg(msg *dns.Msg, opt *dns.OPT) {
+	opt.Option = slices.DeleteFunc(opt.Option, func(o dns.EDNS0) (isPad bool) {
+		return o.Option() == dns.EDNS0PADDING
+	})
+
+	// The option code and length take 4 bytes.
+	l := msg.Len() + 4
+	padLen := (paddingBlockSize - l%paddingBlockSize) % paddingBlockSize
+	if l+padLen > dns.MaxMsgSize {
+		return
+	}
+
+	opt.Option = append(opt.Option, &dns.EDNS0_PADDING{
+		Padding: make([]byte, padLen),
+	})
+}
@@ -0,0 +1,109 @@
+package proxy
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxy_padResponse(t *testing.T) {
+	t.Parallel()
+
+	newReq := func(edns, padded bool) (req *dns.Msg) {
+		req = newTestMessage()
+		if !edns {
+			return req
+		}
+
+		req.SetEdns0(dns.DefaultMsgSize, false)
+		if padded {
+			opt := req.IsEdns0()
+			opt.Option = append(opt.Option, &dns.EDNS0_PADDING{Padding: make([]byte, 10)})
+		}
+
+		return req
+	}
+
+	testCases := []struct {
+		name    string
+		mode    PaddingMode
+		proto   Proto
+		edns    bool
+		padded  bool
+		wantPad bool
+	}{{
+		name:    "disabled",
+		mode:    PaddingModeDisabled,
+		proto:   ProtoTLS,
+		edns:    true,
+		padded:  true,
+		wantPad: false,
+	}, {
+		name:    "requested_padded",
+		mode:    PaddingModeRequested,
+		proto:   ProtoHTTPS,
+		edns:    true,
+		padded:  true,
+		wantPad: true,
+	}, {
+		name:    "requested_not_padded",
+		mode:    PaddingModeRequested,
+		proto:   ProtoQUIC,
+		edns:    true,
+		padded:  false,
+		wantPad: false,
+	}, {
+		name:    "always",
+		mode:    PaddingModeAlways,
+		proto:   ProtoTLS,
+		edns:    true,
+		padded:  false,
+		wantPad: true,
+	}, {
+		name:    "always_no_edns",
+		mode:    PaddingModeAlways,
+		proto:   ProtoTLS,
+		edns:    false,
+		padded:  false,
+		wantPad: false,
+	}, {
+		name:    "always_plain",
+		mode:    PaddingModeAlways,
+		proto:   ProtoUDP,
+		edns:    true,
+		padded:  true,
+		wantPad: false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			p := &Proxy{Config: Config{Padding: tc.mode}}
+
+			req := newReq(tc.edns, tc.padded)
+			resp := (&dns.Msg{}).SetReply(req)
+			if tc.edns {
+				resp.SetEdns0(dns.DefaultMsgSize, false)
+			}
+
+			d := &DNSContext{
+				Proto: tc.proto,
+				Req:   req,
+				Res:   resp,
+			}
+			p.padResponse(d)
+
+			packed, err := resp.Pack()
+			require.NoError(t, err)
+
+			if tc.wantPad {
+				assert.Zero(t, len(packed)%paddingBlockSize)
+			} else {
+				assert.Less(t, len(packed), paddingBlockSize)
+			}
+		})
+	}
+}
@@ -21,6 +21,7 @@ import (
 	"github.com/AdguardTeam/dnsproxy/internal/dnsmsg"
 	proxynetutil "github.com/AdguardTeam/dnsproxy/internal/netutil"
 	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/container"
 	"github.com/AdguardTeam/golibs/contextutil"
 	"github.com/AdguardTeam/golibs/errors"
 	"github.com/AdguardTeam/golibs/logutil/slogutil"
@@ -97,6 +98,42 @@ type Proxy struct {
 	// logger is used for logging in the proxy service.  It is never nil.
 	logger *slog.Logger
 
+	// correlationPrefix is the random prefix of the correlation IDs of the
+	// requests, see [DNSContext.CorrelationID].
+	correlationPrefix string
+
+	// upstreamLimiter limits the number of simultaneous queries to upstreams.
+	// It's nil if there are no limits.
+	upstreamLimiter *upstreamLimiter
+
+	// udpPacer paces the responses sent over UDP.  It's nil if the responses
+	// aren't paced.
+	udpPacer *udpPacer
+
+	// errAggregator collapses the repeated upstream errors into the summary
+	// log lines.  It's nil if every error is logged.
+	errAggregator *errorAggregator
+
+	// malformedCounters are the counters of malformed queries by protocol.  The
+	// map itself is never modified after creating the proxy.
+	malformedCounters map[Proto]*atomic.Uint64
+
+	// rejectCounters are the counters of the rejected queries by reason.  The
+	// map itself is never modified after creating the proxy.
+	rejectCounters map[RejectReason]*rejectCounters
+
+	// responseCounters are the counters of the responses sent by protocol.  The
+	// map itself is never modified after creating the proxy.
+	responseCounters map[Proto]*responseCounters
+
+	// rebindingAllowlist contains the normalized domain names allowed to
+	// resolve to internal addresses.  It's set when validating the config.
+	rebindingAllowlist *container.MapSet[string]
+
+	// domainTTLs are the TTL ranges by the normalized domain names, see
+	// [Config.CacheDomainTTLs].
+	domainTTLs map[string]TTLRange
+
 	// fastestAddr finds the fastest IP address for the resolved domain.
 	fastestAddr *fastip.FastestAddr
 
@@ -109,6 +146,18 @@ type Proxy struct {
 	// repetitions.
 	shortFlighter *optimisticResolver
 
+	// nsecCache keeps the NSEC and NSEC3 records of the validated NXDOMAIN
+	// responses.  It's nil if [Config.CacheAggressiveNSEC] is false.
+	nsecCache *nsecCache
+
+	// memGuard sheds load once the memory budget is exceeded.  It's nil if
+	// [Config.MemoryLimit] isn't set.
+	memGuard *memGuard
+
+	// tlsFingerprints keeps the fingerprints of the encrypted clients'
+	// ClientHello messages.  It's nil if [Config.TLSFingerprinting] is false.
+	tlsFingerprints *fingerprintStorage
+
 	// recDetector detects recursive requests that may appear when resolving
 	// requests for private addresses.
 	recDetector *recursionDetector
@@ -159,7 +208,8 @@ type Proxy struct {
 
 	// upstreamRTTStats maps the upstream address to its round-trip time
 	// statistics.  It's holds the statistics for all upstreams to perform a
-	// weighted random selection when using the load balancing mode.
+	// weighted random selection when using the load balancing mode and to
+	// order the upstreams when using [UpstreamModeBestP95].
 	upstreamRTTStats map[string]upstreamRTTStats
 
 	// dns64Prefs is a set of NAT64 prefixes that are used to detect and
@@ -186,6 +236,14 @@ type Proxy struct {
 	// counter counts message contexts created with [Proxy.newDNSContext].
 	counter atomic.Uint64
 
+	// logSampleCounter counts the requests to sample the logged DNS messages,
+	// see [Config.LogSampleRate].
+	logSampleCounter atomic.Uint64
+
+	// answerRotation is the number of the rotations of the cached answers, see
+	// [AnswerOrderModeRoundRobin].
+	answerRotation atomic.Uint64
+
 	// RWMutex protects the whole proxy.
 	//
 	// TODO(e.burkov):  Find out what exactly it protects and name it properly.
@@ -197,6 +255,12 @@ type Proxy struct {
 	// TODO(e.burkov):  Make it a pointer.
 	rttLock sync.Mutex
 
+	// failedListeners are the protocols, the listeners of which couldn't be
+	// bound to the addresses set by [Proxy.SetListenAddrs].  Those are bound
+	// again on the next call even if the addresses are the same.  It's
+	// protected by RWMutex.
+	failedListeners map[Proto]struct{}
+
 	// started indicates if the proxy has been started.
 	started bool
 }
@@ -229,9 +293,13 @@ func New(c *Config) (p *Proxy, err error) {
 			c.MessageConstructor,
 			dnsmsg.DefaultMessageConstructor{},
 		),
-		recDetector:     newRecursionDetector(recursionTTL, cachedRecurrentReqNum),
-		pendingRequests: pendingRequestsOrDefault(c.PendingRequests),
-		logger:          loggerOrDefault(c.Logger),
+		recDetector:       newRecursionDetector(recursionTTL, cachedRecurrentReqNum),
+		malformedCounters: newMalformedCounters(),
+		rejectCounters:    newRejectCounters(),
+		responseCounters:  newResponseCounters(),
+		pendingRequests:   pendingRequestsOrDefault(c.PendingRequests),
+		logger:            loggerOrDefault(c.Logger),
+		correlationPrefix: newCorrelationPrefix(),
 	}
 
 	// TODO(e.burkov):  Validate config separately and add the contract to the
@@ -245,6 +313,11 @@ func New(c *Config) (p *Proxy, err error) {
 	p.CacheOptimisticMaxAge = cmp.Or(p.CacheOptimisticMaxAge, DefaultOptimisticMaxAge)
 
 	p.initCache()
+	if p.CacheAggressiveNSEC {
+		p.nsecCache = newNSECCache()
+	}
+
+	p.memGuard = p.newMemGuard()
 
 	if p.MaxGoroutines > 0 {
 		p.logger.Info("max goroutines is set", "count", p.MaxGoroutines)
@@ -254,6 +327,14 @@ func New(c *Config) (p *Proxy, err error) {
 		p.requestsSema = syncutil.EmptySemaphore{}
 	}
 
+	p.upstreamLimiter = newUpstreamLimiter(c)
+	p.udpPacer = newUDPPacer(c.UDPPacing)
+	p.errAggregator = newErrorAggregator(p.logger, c.ExchangeLog)
+
+	if p.TLSFingerprinting {
+		p.tlsFingerprints = newFingerprintStorage(tlsFingerprintCacheSize)
+	}
+
 	p.UpstreamMode = cmp.Or(p.UpstreamMode, UpstreamModeLoadBalance)
 	if p.UpstreamMode == UpstreamModeFastestAddr {
 		p.fastestAddr = fastip.New(&fastip.Config{
@@ -432,40 +513,10 @@ func (p *Proxy) Shutdown(ctx context.Context) (err error) {
 func (p *Proxy) closeListeners(errs []error) (res []error) {
 	res = errs
 
-	res = closeAll(res, p.tcpListen...)
-	p.tcpListen = nil
-
-	res = closeAll(res, p.udpListen...)
-	p.udpListen = nil
-
-	res = closeAll(res, p.tlsListen...)
-	p.tlsListen = nil
-
-	if p.httpsServer != nil {
-		res = closeAll(res, p.httpsServer)
-		p.httpsServer = nil
-
-		// No need to close these since they're closed by httpsServer.Close().
-		p.httpsListen = nil
+	for _, proto := range listenerProtos {
+		res = p.closeProtoListeners(res, proto)
 	}
 
-	if p.h3Server != nil {
-		res = closeAll(res, p.h3Server)
-		p.h3Server = nil
-	}
-
-	res = closeAll(res, p.h3Listen...)
-	p.h3Listen = nil
-
-	res = closeAll(res, p.quicListen...)
-	p.quicListen = nil
-
-	res = closeAll(res, p.quicTransports...)
-	p.quicTransports = nil
-
-	res = closeAll(res, p.quicConns...)
-	p.quicConns = nil
-
 	return res
 }
 
@@ -580,7 +631,9 @@ func (p *Proxy) selectUpstreams(d *DNSContext) (upstreams []upstream.Upstream, i
 
 // replyFromUpstream tries to resolve the request via configured upstream
 // servers.  It returns true if the response actually came from an upstream.
-func (p *Proxy) replyFromUpstream(d *DNSContext) (ok bool, err error) {
+func (p *Proxy) replyFromUpstream(ctx context.Context, d *DNSContext) (ok bool, err error) {
+	// Resolve may be called directly without the correlation ID in ctx.
+	ctx = ContextWithCorrelationID(ctx, d.CorrelationID)
 	req := d.Req
 
 	upstreams, isPrivate := p.selectUpstreams(d)
@@ -594,44 +647,60 @@ func (p *Proxy) replyFromUpstream(d *DNSContext) (ok bool, err error) {
 		p.recDetector.add(d.Req)
 	}
 
-	src := "upstream"
-	wrapped := upstreamsWithStats(upstreams)
+	src := TraceRouteUpstream
+	if isPrivate {
+		src = TraceRoutePrivate
+	}
+
+	wrapped := upstreamsWithStats(
+		upstreams,
+		p.upstreamLimiter,
+		p.UpstreamFaults,
+		d.Trace,
+		false,
+	)
 
 	// Perform the DNS request.
-	resp, u, err := p.exchangeUpstreams(req, wrapped)
-	if dns64Ups := p.performDNS64(req, resp, wrapped); dns64Ups != nil {
+	resp, u, err := p.exchangeUpstreams(ctx, req, wrapped)
+	if dns64Ups := p.performDNS64(ctx, req, resp, wrapped); dns64Ups != nil {
 		u = dns64Ups
 	} else if p.isBogusNXDomain(resp) {
-		p.logger.Debug("response contains bogus-nxdomain ip")
+		p.logger.DebugContext(ctx, "response contains bogus-nxdomain ip")
 		resp = p.messages.NewMsgNXDOMAIN(req)
 	}
 
 	var wrappedFallbacks []upstream.Upstream
-	if err != nil && !isPrivate && p.Fallbacks != nil {
-		p.logger.Debug("using fallback", slogutil.KeyError, err)
+	if err != nil && !isPrivate && p.Fallbacks != nil && !errors.Is(err, errNoConsensus) {
+		p.logger.DebugContext(ctx, "using fallback", slogutil.KeyError, err)
 
-		src = "fallback"
+		src = TraceRouteFallback
 
 		// upstreams mustn't appear empty since they have been validated when
 		// creating proxy.
 		upstreams = p.Fallbacks.getUpstreamsForDomain(req.Question[0].Name)
 
-		wrappedFallbacks = upstreamsWithStats(upstreams)
+		wrappedFallbacks = upstreamsWithStats(
+			upstreams,
+			p.upstreamLimiter,
+			p.UpstreamFaults,
+			d.Trace,
+			true,
+		)
 		resp, u, err = upstream.ExchangeParallel(wrappedFallbacks, req)
 	}
 
 	if err != nil {
-		p.logger.Debug("resolving err", "src", src, slogutil.KeyError, err)
+		p.logger.DebugContext(ctx, "resolving err", "src", src, slogutil.KeyError, err)
 	}
 
 	if resp != nil {
-		p.logger.Debug("resolved", "upstream", u.Address(), "src", src)
+		p.logger.DebugContext(ctx, "resolved", "upstream", u.Address(), "src", src)
+		d.Trace.setRoute(src, u.Address())
 	}
 
 	unwrapped, stats := collectQueryStats(p.UpstreamMode, u, wrapped, wrappedFallbacks)
 	d.queryStatistics = stats
 
-	ctx := context.TODO()
 	p.handleExchangeResult(ctx, d, req, resp, unwrapped)
 
 	return resp != nil, err
@@ -655,7 +724,7 @@ func (p *Proxy) handleExchangeResult(
 	}
 
 	d.Upstream = u
-	d.Res = resp
+	d.Res = p.protectFromRebinding(req, resp)
 
 	p.setMinMaxTTL(ctx, resp)
 }
@@ -685,6 +754,10 @@ const defaultUDPBufSize = 2048
 // Resolve is the default resolving method used by the DNS proxy to query
 // upstream servers.  It expects dctx is filled with the client's request.
 func (p *Proxy) Resolve(ctx context.Context, dctx *DNSContext) (err error) {
+	if dctx.Trace == nil {
+		dctx.Trace = NewTrace(time.Now(), dctx.Proto, dctx.Addr)
+	}
+
 	if p.EnableEDNSClientSubnet {
 		dctx.processECS(p.EDNSAddr, p.logger)
 	}
@@ -692,7 +765,9 @@ func (p *Proxy) Resolve(ctx context.Context, dctx *DNSContext) (err error) {
 	dctx.calcFlagsAndSize()
 
 	cacheWorks := p.cacheWorks(dctx)
-	if cacheWorks {
+	if !cacheWorks {
+		dctx.Trace.setCache(CacheDecisionDisabled)
+	} else {
 		// Request for DNSSEC from the upstream to cache the
 		// DNSSEC resource records as well.  In case of disabled DNSSEC,
 		// requesting and therefore caching of DNSSEC resource records depends
@@ -709,6 +784,8 @@ func (p *Proxy) Resolve(ctx context.Context, dctx *DNSContext) (err error) {
 		var loaded bool
 		loaded, err = p.pendingRequests.queue(ctx, dctx)
 		if loaded {
+			dctx.Trace.setCache(CacheDecisionShared)
+
 			return err
 		}
 		defer func() { p.pendingRequests.done(ctx, dctx, err) }()
@@ -716,14 +793,26 @@ func (p *Proxy) Resolve(ctx context.Context, dctx *DNSContext) (err error) {
 		if p.replyFromCache(dctx) {
 			// Complete the response from cache.
 			filterMsg(dctx.Res, dctx.Res, dctx.adBit, dctx.doBit, 0)
-			dctx.scrub()
+			dctx.scrub(p.Compression)
 
 			return nil
 		}
+
+		if p.replyFromNSECCache(dctx) {
+			filterMsg(dctx.Res, dctx.Res, dctx.adBit, dctx.doBit, 0)
+			dctx.scrub(p.Compression)
+
+			return nil
+		}
+
+		dctx.Trace.setCache(CacheDecisionMiss)
 	}
 
 	var ok bool
-	ok, err = p.replyFromUpstream(dctx)
+	ok, err = p.replyFromUpstream(ctx, dctx)
+	if ok {
+		ok, err = p.filterResponse(ctx, dctx)
+	}
 
 	// Don't cache the responses having CD flag, just like Dnsmasq does.  It
 	// prevents the cache from being poisoned with unvalidated answers which may
@@ -733,6 +822,7 @@ func (p *Proxy) Resolve(ctx context.Context, dctx *DNSContext) (err error) {
 	if cacheWorks && ok && !dctx.Res.CheckingDisabled {
 		// Cache the response with DNSSEC RRs.
 		p.cacheResp(dctx)
+		p.cacheNSEC(dctx)
 	}
 
 	// It is possible that the response is nil if the upstream hasn't been
@@ -742,7 +832,11 @@ func (p *Proxy) Resolve(ctx context.Context, dctx *DNSContext) (err error) {
 	}
 
 	// Complete the response.
-	dctx.scrub()
+	dctx.scrub(p.Compression)
+
+	if errors.Is(err, errNoConsensus) {
+		dctx.addConsensusEDE()
+	}
 
 	return err
 }
@@ -760,17 +854,18 @@ func (p *Proxy) validateRequest(d *DNSContext) (resp *dns.Msg) {
 	case p.RefuseAny && d.Req.Question[0].Qtype == dns.TypeANY:
 		// Refuse requests of type ANY (anti-DDOS measure).
 		p.logger.Debug("refusing dns type any request")
+		d.RejectReason = RejectReasonRefuseAny
 
 		return p.messages.NewMsgNOTIMPLEMENTED(d.Req)
 	case p.recDetector.check(d.Req):
-		p.logger.Debug("recursion detected", "req_question", d.Req.Question[0].Name)
+		p.logger.Debug("recursion detected", "qname", d.Req.Question[0].Name)
 
 		return p.messages.NewMsgNXDOMAIN(d.Req)
 	case d.isForbiddenARPA(p.privateNets, p.logger):
 		p.logger.Debug(
 			"private arpa domain is requested",
-			"addr", d.Addr,
-			"arpa", d.Req.Question[0].Name,
+			"raddr", d.Addr,
+			"qname", d.Req.Question[0].Name,
 		)
 
 		return p.messages.NewMsgNXDOMAIN(d.Req)
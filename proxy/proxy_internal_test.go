@@ -1349,7 +1349,7 @@ func TestProxy_Resolve_withOptimisticResolver(t *testing.T) {
 	data := (&cacheItem{
 		m: buildResp(req, 0),
 		u: testUpsAddr,
-	}).pack()
+	}).pack(time.Now())
 	items := glcache.New(glcache.Config{
 		EnableLRU: true,
 	})
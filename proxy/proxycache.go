@@ -39,6 +39,14 @@ func (p *Proxy) replyFromCache(d *DNSContext) (hit bool) {
 
 	d.Res = ci.m
 	d.queryStatistics = cachedQueryStatistics(ci.u)
+	p.reorderAnswer(d.Res)
+
+	d.Trace.setRoute(TraceRouteCache, ci.u)
+	if expired {
+		d.Trace.setCache(CacheDecisionStale)
+	} else {
+		d.Trace.setCache(CacheDecisionHit)
+	}
 
 	p.logger.Debug(
 		"replying from cache",
@@ -53,6 +61,7 @@ func (p *Proxy) replyFromCache(d *DNSContext) (hit bool) {
 			CustomUpstreamConfig: d.CustomUpstreamConfig,
 			ReqECS:               cloneIPNet(d.ReqECS),
 			IsPrivateClient:      d.IsPrivateClient,
+			CorrelationID:        d.CorrelationID,
 		}
 		if d.Req != nil {
 			minCtxClone.Req = d.Req.Copy()
@@ -77,8 +86,13 @@ func cloneIPNet(n *net.IPNet) (clone *net.IPNet) {
 }
 
 // cacheResp stores the response from d in general or subnet cache.  In case the
-// cache is present in d, it's used first.
+// cache is present in d, it's used first.  Nothing is cached while the memory
+// budget is exceeded.
 func (p *Proxy) cacheResp(d *DNSContext) {
+	if p.memGuard.exceeded() {
+		return
+	}
+
 	dctxCache := p.cacheForContext(d)
 
 	if !p.EnableEDNSClientSubnet {
@@ -118,6 +132,16 @@ func (p *Proxy) cacheResp(d *DNSContext) {
 		if scope < reqOnes {
 			ecs.Mask = net.CIDRMask(scope, bits)
 			ecs.IP = ecs.IP.Mask(ecs.Mask)
+		} else if scope > reqOnes {
+			// If SCOPE PREFIX-LENGTH is longer than SOURCE PREFIX-LENGTH, store
+			// SOURCE PREFIX-LENGTH bits of ADDRESS, and then mark the response
+			// as valid only to answer client queries that specify exactly the
+			// same SOURCE PREFIX-LENGTH in their own ECS option.
+			p.logger.Debug("caching response for exact source", "ecs", ecs, "scope", scope)
+
+			dctxCache.setWithExactSubnet(d.Req, d.Res, d.Upstream, ecs, p.logger)
+
+			return
 		}
 
 		p.logger.Debug("caching response", "ecs", ecs)
@@ -142,3 +166,61 @@ func (p *Proxy) ClearCache() {
 	p.cache.clearItemsWithSubnet()
 	p.logger.Debug("cache cleared")
 }
+
+// replyFromNSECCache tries to synthesize the NXDOMAIN response for d from the
+// cached NSEC and NSEC3 records.  It returns true on success.
+func (p *Proxy) replyFromNSECCache(d *DNSContext) (ok bool) {
+	if p.nsecCache == nil || d.CustomUpstreamConfig != nil {
+		return false
+	}
+
+	res, upsAddr := p.nsecCache.get(d.Req, p.time.Now())
+	if res == nil {
+		return false
+	}
+
+	d.Res = res
+	d.queryStatistics = cachedQueryStatistics(upsAddr)
+
+	d.Trace.setRoute(TraceRouteCache, upsAddr)
+	d.Trace.setCache(CacheDecisionNSEC)
+
+	p.logger.Debug("replying from nsec cache", "qname", d.Req.Question[0].Name)
+
+	return true
+}
+
+// cacheNSEC stores the NSEC and NSEC3 records of the validated NXDOMAIN
+// response from d, if the aggressive negative caching is enabled.  The
+// responses from the custom upstreams aren't used, since those may differ from
+// the general ones.
+func (p *Proxy) cacheNSEC(d *DNSContext) {
+	if p.nsecCache == nil || d.CustomUpstreamConfig != nil {
+		return
+	}
+
+	var upsAddr string
+	if d.Upstream != nil {
+		upsAddr = d.Upstream.Address()
+	}
+
+	p.nsecCache.set(d.Res, upsAddr, p.time.Now())
+}
+
+// TakeCache makes p use the DNS cache of prev, including the cached NSEC and
+// NSEC3 records, so that replacing prev with p doesn't flush the cached
+// responses.  It does nothing for the caches disabled in either of the
+// proxies.  It must be called before p is started and only if the cache
+// settings of both proxies are the same.  prev must not be nil.
+func (p *Proxy) TakeCache(prev *Proxy) {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.cache != nil && prev.cache != nil {
+		p.cache = prev.cache
+	}
+
+	if p.nsecCache != nil && prev.nsecCache != nil {
+		p.nsecCache = prev.nsecCache
+	}
+}
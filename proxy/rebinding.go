@@ -0,0 +1,135 @@
+package proxy
+
+import (
+	"encoding"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+
+	"github.com/AdguardTeam/dnsproxy/proxyutil"
+	"github.com/AdguardTeam/golibs/container"
+	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/miekg/dns"
+)
+
+// RebindingMode is an enumeration of the DNS rebinding protection modes.
+type RebindingMode string
+
+const (
+	// RebindingModeDisabled disables the DNS rebinding protection.
+	RebindingModeDisabled RebindingMode = ""
+
+	// RebindingModeStrip makes the proxy remove the A and AAAA records with
+	// internal addresses from the answers for external domains.
+	RebindingModeStrip RebindingMode = "strip"
+
+	// RebindingModeNXDOMAIN makes the proxy reply with NXDOMAIN to the requests
+	// for external domains resolved to internal addresses.
+	RebindingModeNXDOMAIN RebindingMode = "nxdomain"
+)
+
+// type check
+var _ encoding.TextUnmarshaler = (*RebindingMode)(nil)
+
+// UnmarshalText implements [encoding.TextUnmarshaler] interface for
+// *RebindingMode.
+func (m *RebindingMode) UnmarshalText(b []byte) (err error) {
+	switch rm := RebindingMode(b); rm {
+	case
+		RebindingModeDisabled,
+		RebindingModeStrip,
+		RebindingModeNXDOMAIN:
+		*m = rm
+	default:
+		return fmt.Errorf(
+			"invalid rebinding protection mode %q, supported: %q, %q",
+			b,
+			RebindingModeStrip,
+			RebindingModeNXDOMAIN,
+		)
+	}
+
+	return nil
+}
+
+// newRebindingAllowlist returns the set of normalized domain names from
+// domains.  It returns an error if any of domains is invalid.
+func newRebindingAllowlist(domains []string) (set *container.MapSet[string], err error) {
+	set = container.NewMapSet[string]()
+	for i, d := range domains {
+		d = strings.ToLower(strings.TrimSuffix(d, "."))
+		err = netutil.ValidateDomainName(d)
+		if err != nil {
+			return nil, fmt.Errorf("domain at index %d: %w", i, err)
+		}
+
+		set.Add(d)
+	}
+
+	// Allow the names reserved for the loopback addresses.  See RFC 6761.
+	set.Add("localhost")
+
+	return set, nil
+}
+
+// isRebindingAllowed returns true if fqdn or any of its parent domains is
+// allowed to resolve to internal addresses.
+func (p *Proxy) isRebindingAllowed(fqdn string) (ok bool) {
+	for name := strings.ToLower(strings.TrimSuffix(fqdn, ".")); name != ""; {
+		if p.rebindingAllowlist.Has(name) {
+			return true
+		}
+
+		_, name, _ = strings.Cut(name, ".")
+	}
+
+	return false
+}
+
+// isInternalAddr returns true if ip is a private, loopback, link-local, or
+// unspecified address, which shouldn't normally be returned for external
+// domains.
+func isInternalAddr(ip netip.Addr) (ok bool) {
+	ip = ip.Unmap()
+
+	return ip.IsPrivate() ||
+		ip.IsLoopback() ||
+		ip.IsLinkLocalUnicast() ||
+		ip.IsUnspecified()
+}
+
+// isInternalRR returns true if rr is an A or AAAA record with an internal
+// address.
+func isInternalRR(rr dns.RR) (ok bool) {
+	ip := proxyutil.IPFromRR(rr)
+
+	return ip.IsValid() && isInternalAddr(ip)
+}
+
+// protectFromRebinding filters resp to req according to the DNS rebinding
+// protection mode.  It returns the filtered response.  req must not be nil.
+func (p *Proxy) protectFromRebinding(req, resp *dns.Msg) (filtered *dns.Msg) {
+	if p.RebindingProtection == RebindingModeDisabled || resp == nil || len(resp.Question) == 0 {
+		return resp
+	} else if qt := resp.Question[0].Qtype; qt != dns.TypeA && qt != dns.TypeAAAA {
+		return resp
+	} else if !slices.ContainsFunc(resp.Answer, isInternalRR) {
+		return resp
+	}
+
+	fqdn := resp.Question[0].Name
+	if p.isRebindingAllowed(fqdn) {
+		return resp
+	}
+
+	p.logger.Debug("response contains internal ip", "qname", fqdn)
+
+	if p.RebindingProtection == RebindingModeNXDOMAIN {
+		return p.messages.NewMsgNXDOMAIN(req)
+	}
+
+	resp.Answer = slices.DeleteFunc(resp.Answer, isInternalRR)
+
+	return resp
+}
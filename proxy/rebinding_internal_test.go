@@ -0,0 +1,108 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxy_protectFromRebinding(t *testing.T) {
+	t.Parallel()
+
+	const (
+		fqdnExternal = "external.example."
+		fqdnAllowed  = "host.allowed.example."
+	)
+
+	newResp := func(fqdn string, ips ...net.IP) (resp *dns.Msg) {
+		req := (&dns.Msg{}).SetQuestion(fqdn, dns.TypeA)
+		resp = (&dns.Msg{}).SetReply(req)
+		for _, ip := range ips {
+			resp.Answer = append(resp.Answer, &dns.A{
+				Hdr: dns.RR_Header{Rrtype: dns.TypeA, Name: fqdn, Ttl: 10},
+				A:   ip,
+			})
+		}
+
+		return resp
+	}
+
+	var (
+		ipPublic   = net.IP{1, 2, 3, 4}
+		ipPrivate  = net.IP{192, 168, 0, 1}
+		ipLoopback = net.IP{127, 0, 0, 1}
+	)
+
+	testCases := []struct {
+		resp      *dns.Msg
+		name      string
+		mode      RebindingMode
+		wantIPs   []net.IP
+		wantRcode int
+	}{{
+		resp:      newResp(fqdnExternal, ipPublic, ipPrivate),
+		name:      "disabled",
+		mode:      RebindingModeDisabled,
+		wantIPs:   []net.IP{ipPublic, ipPrivate},
+		wantRcode: dns.RcodeSuccess,
+	}, {
+		resp:      newResp(fqdnExternal, ipPublic, ipPrivate, ipLoopback),
+		name:      "strip",
+		mode:      RebindingModeStrip,
+		wantIPs:   []net.IP{ipPublic},
+		wantRcode: dns.RcodeSuccess,
+	}, {
+		resp:      newResp(fqdnExternal, ipPublic, ipPrivate),
+		name:      "nxdomain",
+		mode:      RebindingModeNXDOMAIN,
+		wantIPs:   nil,
+		wantRcode: dns.RcodeNameError,
+	}, {
+		resp:      newResp(fqdnExternal, ipPublic),
+		name:      "public",
+		mode:      RebindingModeNXDOMAIN,
+		wantIPs:   []net.IP{ipPublic},
+		wantRcode: dns.RcodeSuccess,
+	}, {
+		resp:      newResp(fqdnAllowed, ipPrivate),
+		name:      "allowed",
+		mode:      RebindingModeNXDOMAIN,
+		wantIPs:   []net.IP{ipPrivate},
+		wantRcode: dns.RcodeSuccess,
+	}, {
+		resp:      newResp("localhost.", ipLoopback),
+		name:      "localhost",
+		mode:      RebindingModeStrip,
+		wantIPs:   []net.IP{ipLoopback},
+		wantRcode: dns.RcodeSuccess,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			p := mustNew(t, &Config{
+				Logger:                  testLogger,
+				UpstreamConfig:          newTestUpstreamConfig(t, defaultTimeout, testDefaultUpstreamAddr),
+				RebindingProtection:     tc.mode,
+				RebindingAllowedDomains: []string{"Allowed.Example."},
+			})
+
+			req := (&dns.Msg{}).SetQuestion(tc.resp.Question[0].Name, dns.TypeA)
+			resp := p.protectFromRebinding(req, tc.resp)
+			require.NotNil(t, resp)
+
+			assert.Equal(t, tc.wantRcode, resp.Rcode)
+
+			var ips []net.IP
+			for _, rr := range resp.Answer {
+				ips = append(ips, rr.(*dns.A).A)
+			}
+
+			assert.Equal(t, tc.wantIPs, ips)
+		})
+	}
+}
@@ -0,0 +1,134 @@
+package proxy
+
+import (
+	"context"
+	"sync/atomic"
+)
+
+// RejectReason is the machine-readable reason of a query being refused or
+// dropped by the proxy.
+type RejectReason string
+
+// RejectReason values.
+const (
+	// RejectReasonFilter means that the query matched a filtering rule, e.g.
+	// a query type action or a blocked service.
+	RejectReasonFilter RejectReason = "filter"
+
+	// RejectReasonMalformed means that the query couldn't be parsed or has a
+	// wrong number of questions.
+	RejectReasonMalformed RejectReason = "malformed"
+
+	// RejectReasonRatelimit means that the client has exceeded the rate limit.
+	RejectReasonRatelimit RejectReason = "ratelimit"
+
+	// RejectReasonRefuseAny means that the query of type ANY has been refused
+	// according to [Config.RefuseAny].
+	RejectReasonRefuseAny RejectReason = "refuse_any"
+
+	// RejectReasonOther means that the query has been dropped by a [Handler]
+	// which hasn't reported the reason, see [DNSContext.RejectReason].
+	RejectReasonOther RejectReason = "other"
+)
+
+// rejectReasons are the reasons the rejected queries are counted for.
+var rejectReasons = []RejectReason{
+	RejectReasonFilter,
+	RejectReasonMalformed,
+	RejectReasonRatelimit,
+	RejectReasonRefuseAny,
+	RejectReasonOther,
+}
+
+// RejectStats are the statistics of the queries rejected for a reason.
+type RejectStats struct {
+	// Dropped is the number of the queries left without response.
+	Dropped uint64
+
+	// Refused is the number of the queries replied with an error response,
+	// e.g. REFUSED, FORMERR, or NXDOMAIN.
+	Refused uint64
+}
+
+// rejectCounters are the concurrency-safe counters of the queries rejected for
+// a reason.
+type rejectCounters struct {
+	// dropped is the number of the queries left without response.
+	dropped atomic.Uint64
+
+	// refused is the number of the queries replied with an error response.
+	refused atomic.Uint64
+}
+
+// newRejectCounters returns the counters of rejected queries for each known
+// reason.
+func newRejectCounters() (counters map[RejectReason]*rejectCounters) {
+	counters = make(map[RejectReason]*rejectCounters, len(rejectReasons))
+	for _, r := range rejectReasons {
+		counters[r] = &rejectCounters{}
+	}
+
+	return counters
+}
+
+// RejectStats returns the statistics of the queries refused or dropped so far
+// for each reason.  Those help to distinguish the attack traffic from the
+// misconfigurations.
+func (p *Proxy) RejectStats() (stats map[RejectReason]*RejectStats) {
+	stats = make(map[RejectReason]*RejectStats, len(p.rejectCounters))
+	for r, c := range p.rejectCounters {
+		stats[r] = &RejectStats{
+			Dropped: c.dropped.Load(),
+			Refused: c.refused.Load(),
+		}
+	}
+
+	return stats
+}
+
+// countRejected counts the query received over proto rejected for reason and
+// logs it, if [Config.LogRejectedQueries] is true.  The unknown reasons are
+// counted as [RejectReasonOther].  d is the context of the query, it may be
+// nil if the query couldn't be parsed.
+func (p *Proxy) countRejected(
+	ctx context.Context,
+	proto Proto,
+	d *DNSContext,
+	reason RejectReason,
+	dropped bool,
+) {
+	c, ok := p.rejectCounters[reason]
+	if !ok {
+		c = p.rejectCounters[RejectReasonOther]
+	}
+
+	action := "refuse"
+	if dropped {
+		action = "drop"
+		c.dropped.Add(1)
+	} else {
+		c.refused.Add(1)
+	}
+
+	if !p.LogRejectedQueries {
+		return
+	}
+
+	if d == nil || d.Req == nil || len(d.Req.Question) == 0 {
+		p.logger.InfoContext(ctx, "query rejected", "reason", reason, "action", action, "proto", proto)
+
+		return
+	}
+
+	q := d.Req.Question[0]
+	p.logger.InfoContext(
+		ctx,
+		"query rejected",
+		"reason", reason,
+		"action", action,
+		"proto", proto,
+		"raddr", d.Addr,
+		"qname", q.Name,
+		"qtype", q.Qtype,
+	)
+}
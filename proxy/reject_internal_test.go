@@ -0,0 +1,57 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"testing"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxy_RejectStats(t *testing.T) {
+	t.Parallel()
+
+	buf := &bytes.Buffer{}
+
+	var reason RejectReason
+	p := mustNew(t, &Config{
+		Logger:             slog.New(slog.NewTextHandler(buf, nil)),
+		UpstreamConfig:     newTestUpstreamConfig(t, defaultTimeout, testDefaultUpstreamAddr),
+		LogRejectedQueries: true,
+		RequestHandler: &TestHandler{
+			OnHandle: func(_ context.Context, _ *Proxy, dctx *DNSContext) (err error) {
+				dctx.RejectReason = reason
+
+				return ErrDrop
+			},
+		},
+	})
+
+	req := (&dns.Msg{}).SetQuestion("domain.example.", dns.TypeA)
+	ctx := testutil.ContextWithTimeout(t, defaultTimeout)
+
+	reason = RejectReasonRatelimit
+	require.NoError(t, p.handleDNSRequest(ctx, p.newDNSContext(ProtoUDP, req, localhostAnyPort)))
+
+	reason = ""
+	require.NoError(t, p.handleDNSRequest(ctx, p.newDNSContext(ProtoUDP, req, localhostAnyPort)))
+
+	p.countRejected(ctx, ProtoTCP, nil, RejectReasonMalformed, false)
+	p.countRejected(ctx, ProtoTCP, nil, "unknown", false)
+
+	stats := p.RejectStats()
+	assert.Len(t, stats, len(rejectReasons))
+	assert.Equal(t, &RejectStats{Dropped: 1}, stats[RejectReasonRatelimit])
+	assert.Equal(t, &RejectStats{Refused: 1}, stats[RejectReasonMalformed])
+	assert.Equal(t, &RejectStats{Dropped: 1, Refused: 1}, stats[RejectReasonOther])
+	assert.Equal(t, &RejectStats{}, stats[RejectReasonFilter])
+
+	out := buf.String()
+	assert.Contains(t, out, "reason=ratelimit action=drop proto=udp")
+	assert.Contains(t, out, "qname=domain.example.")
+	assert.Contains(t, out, "reason=malformed action=refuse proto=tcp")
+}
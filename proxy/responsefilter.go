@@ -0,0 +1,62 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/AdguardTeam/golibs/errors"
+)
+
+// ResponseFilter post-processes the responses received from the upstreams
+// before those are cached and sent to the clients.  It complements
+// [Config.RequestHandler], which is called before the resolution.
+type ResponseFilter interface {
+	// FilterResponse is called with dctx.Res set to the response received from
+	// the upstream and dctx.Upstream set to the upstream which has resolved
+	// it.  It may modify dctx.Res or replace it with another non-nil message.
+	// The response may contain DNSSEC records, which are removed later if the
+	// client hasn't requested those.  In case of [ErrDrop] error, no response
+	// is sent to the client.  In case of any other error, the client is
+	// responded with SERVFAIL.  Neither response is cached.
+	FilterResponse(ctx context.Context, dctx *DNSContext) (err error)
+}
+
+// The ResponseFilterFunc type is an adapter to allow the use of ordinary
+// functions as [ResponseFilter].  If f is a function with the appropriate
+// signature, ResponseFilterFunc(f) is a [ResponseFilter] that calls f.
+type ResponseFilterFunc func(ctx context.Context, dctx *DNSContext) (err error)
+
+// type check
+var _ ResponseFilter = ResponseFilterFunc(nil)
+
+// FilterResponse implements the [ResponseFilter] interface for
+// ResponseFilterFunc.
+func (f ResponseFilterFunc) FilterResponse(ctx context.Context, dctx *DNSContext) (err error) {
+	return f(ctx, dctx)
+}
+
+// filterResponse calls the response filter of p, if any, for the response
+// received from the upstream.  ok is false if the response must not be cached.
+// d.Res must not be nil.
+func (p *Proxy) filterResponse(ctx context.Context, d *DNSContext) (ok bool, err error) {
+	if p.ResponseFilter == nil {
+		return true, nil
+	}
+
+	err = p.ResponseFilter.FilterResponse(ctx, d)
+	switch {
+	case errors.Is(err, ErrDrop):
+		// Don't wrap the error, since it's checked by the caller.
+		return false, err
+	case err != nil:
+		d.Res = p.messages.NewMsgSERVFAIL(d.Req)
+
+		return false, fmt.Errorf("filtering response: %w", err)
+	case d.Res == nil:
+		d.Res = p.messages.NewMsgSERVFAIL(d.Req)
+
+		return false, errors.Error("filtering response: response removed")
+	default:
+		return true, nil
+	}
+}
@@ -0,0 +1,140 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxy_Resolve_responseFilter(t *testing.T) {
+	t.Parallel()
+
+	const testErr errors.Error = "test error"
+
+	replaced := net.IP{192, 0, 2, 2}
+
+	testCases := []struct {
+		filter      ResponseFilterFunc
+		wantIP      net.IP
+		wantErr     error
+		name        string
+		wantRcode   int
+		wantCached  bool
+		wantHasResp bool
+	}{{
+		filter: func(_ context.Context, dctx *DNSContext) (err error) {
+			require.NotNil(testutil.PanicT{}, dctx.Upstream)
+
+			a := testutil.RequireTypeAssert[*dns.A](testutil.PanicT{}, dctx.Res.Answer[0])
+			a.A = replaced
+
+			return nil
+		},
+		wantIP:      replaced,
+		wantErr:     nil,
+		name:        "modify",
+		wantRcode:   dns.RcodeSuccess,
+		wantCached:  true,
+		wantHasResp: true,
+	}, {
+		filter: func(_ context.Context, dctx *DNSContext) (err error) {
+			dctx.Res = (&dns.Msg{}).SetReply(dctx.Req)
+			dctx.Res.Answer = []dns.RR{&dns.A{
+				Hdr: dns.RR_Header{
+					Name:   dctx.Req.Question[0].Name,
+					Rrtype: dns.TypeA,
+					Class:  dns.ClassINET,
+					Ttl:    60,
+				},
+				A: replaced,
+			}}
+
+			return nil
+		},
+		wantIP:      replaced,
+		wantErr:     nil,
+		name:        "replace",
+		wantRcode:   dns.RcodeSuccess,
+		wantCached:  true,
+		wantHasResp: true,
+	}, {
+		filter: func(_ context.Context, _ *DNSContext) (err error) {
+			return testErr
+		},
+		wantIP:      nil,
+		wantErr:     testErr,
+		name:        "error",
+		wantRcode:   dns.RcodeServerFailure,
+		wantCached:  false,
+		wantHasResp: true,
+	}, {
+		filter: func(_ context.Context, _ *DNSContext) (err error) {
+			return ErrDrop
+		},
+		wantIP:      nil,
+		wantErr:     ErrDrop,
+		name:        "drop",
+		wantRcode:   dns.RcodeSuccess,
+		wantCached:  false,
+		wantHasResp: false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			u := &testUpstream{
+				ans: []dns.RR{&dns.A{
+					Hdr: dns.RR_Header{
+						Name:   "host.",
+						Rrtype: dns.TypeA,
+						Class:  dns.ClassINET,
+						Ttl:    60,
+					},
+					A: net.IP{192, 0, 2, 1},
+				}},
+			}
+
+			p := mustNew(t, &Config{
+				Logger: testLogger,
+				UpstreamConfig: &UpstreamConfig{
+					Upstreams: []upstream.Upstream{u},
+				},
+				TrustedProxies: defaultTrustedProxies,
+				CacheEnabled:   true,
+				ResponseFilter: tc.filter,
+			})
+
+			d := &DNSContext{
+				Req: newHostTestMessage("host"),
+			}
+
+			err := p.Resolve(testutil.ContextWithTimeout(t, defaultTimeout), d)
+			assert.ErrorIs(t, err, tc.wantErr)
+
+			ci, _, _ := p.cache.get(d.Req)
+			assert.Equal(t, tc.wantCached, ci != nil)
+
+			if !tc.wantHasResp {
+				return
+			}
+
+			require.NotNil(t, d.Res)
+			assert.Equal(t, tc.wantRcode, d.Res.Rcode)
+
+			if tc.wantIP != nil {
+				require.Len(t, d.Res.Answer, 1)
+
+				a := testutil.RequireTypeAssert[*dns.A](t, d.Res.Answer[0])
+				assert.Equal(t, tc.wantIP, a.A)
+			}
+		})
+	}
+}
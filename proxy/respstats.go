@@ -0,0 +1,134 @@
+package proxy
+
+import (
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+)
+
+// responseSizeBounds are the upper bounds of the buckets of the response size
+// histogram in bytes.  Those correspond to the minimum DNS message size, the
+// EDNS buffer sizes recommended by the DNS Flag Day 2020, the size fitting into
+// a typical Ethernet MTU, the common default EDNS buffer size, and the maximum
+// DNS message size.
+var responseSizeBounds = [...]int{
+	dns.MinMsgSize,
+	1232,
+	1452,
+	dns.DefaultMsgSize,
+	dns.MaxMsgSize,
+}
+
+// ResponseSizeBucket is a bucket of the response size histogram.
+type ResponseSizeBucket struct {
+	// UpperBound is the maximum size of the responses in the bucket in bytes.
+	// The responses of the previous buckets aren't included.
+	UpperBound int
+
+	// Count is the number of the responses in the bucket.
+	Count uint64
+}
+
+// ResponseStats are the statistics of the responses sent over a protocol.
+type ResponseStats struct {
+	// Sizes is the histogram of the sizes of the responses sorted by the upper
+	// bound.
+	Sizes []ResponseSizeBucket
+
+	// Count is the number of the responses sent.
+	Count uint64
+
+	// TotalSize is the total size of the responses sent in bytes.
+	TotalSize uint64
+
+	// Truncated is the number of the responses sent with the TC bit set, i.e.
+	// the ones the clients are supposed to retry over TCP.
+	Truncated uint64
+}
+
+// responseCounters are the concurrency-safe counters of the responses sent over
+// a protocol.
+type responseCounters struct {
+	// sizes are the counters of the buckets of the response size histogram,
+	// see [responseSizeBounds].
+	sizes [len(responseSizeBounds)]atomic.Uint64
+
+	// count is the number of the responses sent.
+	count atomic.Uint64
+
+	// totalSize is the total size of the responses sent in bytes.
+	totalSize atomic.Uint64
+
+	// truncated is the number of the truncated responses sent.
+	truncated atomic.Uint64
+}
+
+// newResponseCounters returns the counters of responses for each supported
+// protocol.
+func newResponseCounters() (counters map[Proto]*responseCounters) {
+	counters = make(map[Proto]*responseCounters, len(servedProtos))
+	for _, proto := range servedProtos {
+		counters[proto] = &responseCounters{}
+	}
+
+	return counters
+}
+
+// add counts resp of the given packed size.  resp must not be nil.
+func (c *responseCounters) add(resp *dns.Msg, size int) {
+	c.count.Add(1)
+	c.totalSize.Add(uint64(size))
+
+	if resp.Truncated {
+		c.truncated.Add(1)
+	}
+
+	for i, bound := range responseSizeBounds {
+		if size <= bound {
+			c.sizes[i].Add(1)
+
+			break
+		}
+	}
+}
+
+// stats returns the current values of c.
+func (c *responseCounters) stats() (s *ResponseStats) {
+	s = &ResponseStats{
+		Sizes:     make([]ResponseSizeBucket, 0, len(responseSizeBounds)),
+		Count:     c.count.Load(),
+		TotalSize: c.totalSize.Load(),
+		Truncated: c.truncated.Load(),
+	}
+
+	for i, bound := range responseSizeBounds {
+		s.Sizes = append(s.Sizes, ResponseSizeBucket{
+			UpperBound: bound,
+			Count:      c.sizes[i].Load(),
+		})
+	}
+
+	return s
+}
+
+// ResponseStats returns the statistics of the responses sent so far for each
+// protocol.  Those help to choose the EDNS buffer sizes.
+func (p *Proxy) ResponseStats() (stats map[Proto]*ResponseStats) {
+	stats = make(map[Proto]*ResponseStats, len(p.responseCounters))
+	for proto, c := range p.responseCounters {
+		stats[proto] = c.stats()
+	}
+
+	return stats
+}
+
+// countResponse counts the response of d, if any, after it has been sent.
+func (p *Proxy) countResponse(d *DNSContext) {
+	if d.Res == nil {
+		return
+	}
+
+	if c, ok := p.responseCounters[d.Proto]; ok {
+		c.add(d.Res, d.Res.Len())
+	}
+}
@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestAResponse returns a response to req with n A records.
+func newTestAResponse(req *dns.Msg, n int) (resp *dns.Msg) {
+	resp = (&dns.Msg{}).SetReply(req)
+	for i := range n {
+		resp.Answer = append(resp.Answer, &dns.A{
+			Hdr: dns.RR_Header{
+				Name:   req.Question[0].Name,
+				Rrtype: dns.TypeA,
+				Class:  dns.ClassINET,
+				Ttl:    60,
+			},
+			A: net.IPv4(192, 0, 2, byte(i)),
+		})
+	}
+
+	return resp
+}
+
+func TestProxy_ResponseStats(t *testing.T) {
+	t.Parallel()
+
+	p := mustNew(t, &Config{
+		Logger:         testLogger,
+		UpstreamConfig: newTestUpstreamConfig(t, defaultTimeout, testDefaultUpstreamAddr),
+	})
+
+	req := (&dns.Msg{}).SetQuestion("example.org.", dns.TypeA)
+
+	small := newTestAResponse(req, 1)
+	large := newTestAResponse(req, 100)
+
+	truncated := large.Copy()
+	fitResponse(truncated, dns.MinMsgSize, CompressionModeDefault)
+	require.True(t, truncated.Truncated)
+
+	for _, resp := range []*dns.Msg{small, large, truncated, nil} {
+		d := p.newDNSContext(ProtoUDP, req, localhostAnyPort)
+		d.Res = resp
+		p.countResponse(d)
+	}
+
+	d := p.newDNSContext(ProtoTCP, req, localhostAnyPort)
+	d.Res = large
+	p.countResponse(d)
+
+	stats := p.ResponseStats()
+	require.Len(t, stats, len(servedProtos))
+
+	udp := stats[ProtoUDP]
+	require.NotNil(t, udp)
+
+	assert.Equal(t, uint64(3), udp.Count)
+	assert.Equal(t, uint64(1), udp.Truncated)
+	assert.Equal(t, uint64(small.Len()+large.Len()+truncated.Len()), udp.TotalSize)
+	assert.Equal(t, []ResponseSizeBucket{{
+		UpperBound: dns.MinMsgSize,
+		Count:      2,
+	}, {
+		UpperBound: 1232,
+		Count:      0,
+	}, {
+		UpperBound: 1452,
+		Count:      0,
+	}, {
+		UpperBound: dns.DefaultMsgSize,
+		Count:      1,
+	}, {
+		UpperBound: dns.MaxMsgSize,
+		Count:      0,
+	}}, udp.Sizes)
+
+	tcp := stats[ProtoTCP]
+	require.NotNil(t, tcp)
+
+	assert.Equal(t, uint64(1), tcp.Count)
+	assert.Zero(t, tcp.Truncated)
+
+	assert.Zero(t, stats[ProtoHTTPS].Count)
+}
@@ -1,6 +1,9 @@
 package proxy
 
-import "net/http"
+import (
+	"net/http"
+	"slices"
+)
 
 // Default path pattern constants.
 const (
@@ -19,19 +22,30 @@ const (
 
 // routeDoH registers DoH handlers in mux.  p.HTTPConfig must not be nil.
 // p.HTTPConfig.Routes must be valid, if p.HTTPConfig.Routes is empty, the
-// default routes are registered.
+// default routes are registered.  The routes for the CORS preflight requests
+// are registered as well, if CORS is enabled.
 func (p *Proxy) routeDoH(mux *http.ServeMux) {
 	routes := p.HTTPConfig.Routes
 	if len(routes) == 0 {
-		mux.Handle(routePatternRootGet, p)
-		mux.Handle(routePatternRootPost, p)
-		mux.Handle(routePatternDNSQueryGet, p)
-		mux.Handle(routePatternDNSQueryPost, p)
-
-		return
+		routes = []string{
+			routePatternRootGet,
+			routePatternRootPost,
+			routePatternDNSQueryGet,
+			routePatternDNSQueryPost,
+		}
 	}
 
 	for _, route := range routes {
 		mux.Handle(route, p)
 	}
+
+	if len(p.HTTPConfig.CORSAllowedOrigins) == 0 {
+		return
+	}
+
+	for _, route := range corsRoutes(routes) {
+		if !slices.Contains(routes, route) {
+			mux.Handle(route, p)
+		}
+	}
 }
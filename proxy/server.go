@@ -1,6 +1,7 @@
 package proxy
 
 import (
+	"cmp"
 	"context"
 	"fmt"
 	"io"
@@ -13,35 +14,16 @@ import (
 	"github.com/AdguardTeam/golibs/logutil/slogutil"
 	"github.com/AdguardTeam/golibs/netutil"
 	"github.com/miekg/dns"
-	"github.com/quic-go/quic-go"
 )
 
 // startListeners configures listeners and starts listening each configured
 // address.  If it returns an error, all listeners should be closed manually.
 func (p *Proxy) startListeners(ctx context.Context) (err error) {
-	err = p.initUDPListeners(ctx)
-	if err != nil {
-		return err
-	}
-
-	err = p.initTCPListeners(ctx)
-	if err != nil {
-		return err
-	}
-
-	err = p.initTLSListeners(ctx)
-	if err != nil {
-		return err
-	}
-
-	err = p.initHTTPSListeners(ctx)
-	if err != nil {
-		return err
-	}
-
-	err = p.initQUICListeners(ctx)
-	if err != nil {
-		return err
+	for _, proto := range listenerProtos {
+		err = p.initProtoListeners(ctx, proto)
+		if err != nil {
+			return err
+		}
 	}
 
 	return nil
@@ -49,38 +31,24 @@ func (p *Proxy) startListeners(ctx context.Context) (err error) {
 
 // serveListeners starts serving the configured listeners.
 func (p *Proxy) serveListeners(ctx context.Context) {
-	for _, l := range p.udpListen {
-		go p.udpPacketLoop(ctx, l, p.requestsSema)
-	}
-
-	for _, l := range p.tcpListen {
-		go p.tcpPacketLoop(ctx, l, ProtoTCP, p.requestsSema)
-	}
-
-	for _, l := range p.tlsListen {
-		go p.tcpPacketLoop(ctx, l, ProtoTLS, p.requestsSema)
-	}
-
-	for _, l := range p.httpsListen {
-		go func(l net.Listener) { _ = p.httpsServer.Serve(l) }(l)
-	}
-
-	for _, l := range p.h3Listen {
-		go func(l *quic.EarlyListener) { _ = p.h3Server.ServeListener(l) }(l)
-	}
-
-	for _, l := range p.quicListen {
-		go p.quicPacketLoop(ctx, l, p.requestsSema)
+	for _, proto := range listenerProtos {
+		p.serveProtoListeners(ctx, proto)
 	}
 }
 
 // handleDNSRequest processes the context.  The only error it returns is the one
 // from the [Handler].
 func (p *Proxy) handleDNSRequest(ctx context.Context, d *DNSContext) (err error) {
-	p.logDNSMessage(ctx, d.Req)
+	ctx = ContextWithCorrelationID(ctx, d.CorrelationID)
+
+	logMsgs := p.shouldLogMessages(ctx)
+	if logMsgs {
+		p.logDNSMessage(ctx, d.Req)
+		p.logTLSFingerprint(ctx, d)
+	}
 
 	if d.Req.Response {
-		p.logger.DebugContext(ctx, "dropping incoming response packet", "addr", d.Addr)
+		p.logger.DebugContext(ctx, "dropping incoming response packet", "raddr", d.Addr)
 
 		return nil
 	}
@@ -88,18 +56,49 @@ func (p *Proxy) handleDNSRequest(ctx context.Context, d *DNSContext) (err error)
 	ip := d.Addr.Addr()
 	d.IsPrivateClient = p.privateNets.Contains(ip)
 
+	var drop bool
+	d.Res, drop = p.checkQuestions(ctx, d)
+	if drop {
+		return nil
+	}
+
 	// TODO(d.kolyshev):  Consider moving validation to a new middleware.
-	d.Res = p.validateRequest(d)
+	if d.Res == nil {
+		d.Res = p.validateRequest(d)
+	}
+
 	if d.Res == nil {
 		err = p.requestHandler.ServeDNS(ctx, p, d)
 		if errors.Is(err, ErrDrop) {
+			p.countRejected(ctx, d.Proto, d, cmp.Or(d.RejectReason, RejectReasonOther), true)
+
 			// Don't reply to dropped clients.
 			return nil
 		}
 	}
 
-	p.logDNSMessage(ctx, d.Res)
+	if d.RejectReason != "" && d.Res != nil {
+		p.countRejected(ctx, d.Proto, d, d.RejectReason, false)
+	}
+
+	if d.Res != nil {
+		if p.MinimizeAnswers {
+			minimizeResponse(d.Res)
+		}
+
+		d.addCorrelationEDE()
+
+		// The handler may have modified the response after it has been
+		// scrubbed, e.g. by prepending records, so make sure it still fits.
+		fitResponse(d.Res, int(dnsSize(d.Proto == ProtoUDP, d.Req)), p.Compression)
+	}
+
+	if logMsgs {
+		p.logDNSMessage(ctx, d.Res)
+	}
+
 	p.respond(ctx, d)
+	d.Trace.finish(p.time.Now())
 
 	return err
 }
@@ -143,11 +142,13 @@ func (p *Proxy) respond(ctx context.Context, d *DNSContext) {
 		_ = d.Conn.SetWriteDeadline(p.time.Now().Add(defaultTimeout))
 	}
 
+	p.padResponse(d)
+
 	var err error
 
 	switch d.Proto {
 	case ProtoUDP:
-		err = p.respondUDP(d)
+		err = p.respondUDP(ctx, d)
 	case ProtoTCP:
 		err = p.respondTCP(d)
 	case ProtoTLS:
@@ -162,14 +163,26 @@ func (p *Proxy) respond(ctx context.Context, d *DNSContext) {
 		err = fmt.Errorf("SHOULD NOT HAPPEN - unknown protocol: %s", d.Proto)
 	}
 
-	if err != nil {
+	switch {
+	case err == nil:
+		p.countResponse(d)
+	case errors.Is(err, errUDPPacingDrop):
+		p.logger.DebugContext(ctx, "response dropped", "raddr", d.Addr, slogutil.KeyError, err)
+	default:
 		logWithNonCrit(ctx, err, "responding request", d.Proto, p.logger)
 	}
 }
 
 // setMinMaxTTL sets the TTL values of all records according to the proxy
-// settings.  r must not be nil.
+// settings for the question of r.  r must not be nil.
 func (p *Proxy) setMinMaxTTL(ctx context.Context, r *dns.Msg) {
+	var qname string
+	if len(r.Question) > 0 {
+		qname = r.Question[0].Name
+	}
+
+	ttls := p.ttlRange(qname)
+
 	rrSets := container.KeyValues[string, []dns.RR]{{
 		Key:   "answer",
 		Value: r.Answer,
@@ -184,7 +197,7 @@ func (p *Proxy) setMinMaxTTL(ctx context.Context, r *dns.Msg) {
 	for _, rrSet := range rrSets {
 		for _, rr := range rrSet.Value {
 			original := rr.Header().Ttl
-			overridden := respectTTLOverrides(original, p.CacheMinTTL, p.CacheMaxTTL)
+			overridden := respectTTLOverrides(original, ttls.Min, ttls.Max)
 
 			if original == overridden {
 				continue
@@ -203,6 +216,22 @@ func (p *Proxy) setMinMaxTTL(ctx context.Context, r *dns.Msg) {
 	}
 }
 
+// shouldLogMessages returns true if the DNS messages of the current request
+// should be logged, which depends on the logging level and
+// [Config.LogSampleRate].
+func (p *Proxy) shouldLogMessages(ctx context.Context) (ok bool) {
+	if !p.logger.Enabled(ctx, slog.LevelDebug) {
+		// Don't spend time on formatting the messages that won't be logged.
+		return false
+	}
+
+	if p.LogSampleRate <= 1 {
+		return true
+	}
+
+	return (p.logSampleCounter.Add(1)-1)%uint64(p.LogSampleRate) == 0
+}
+
 // logDNSMessage logs the given DNS message.
 func (p *Proxy) logDNSMessage(ctx context.Context, m *dns.Msg) {
 	if m == nil {
@@ -219,6 +248,17 @@ func (p *Proxy) logDNSMessage(ctx context.Context, m *dns.Msg) {
 	slogutil.PrintLines(ctx, p.logger, slog.LevelDebug, msg, m.String())
 }
 
+// logTLSFingerprint logs the fingerprint of the client's ClientHello message,
+// if any.
+func (p *Proxy) logTLSFingerprint(ctx context.Context, d *DNSContext) {
+	fp := d.TLSFingerprint
+	if fp == nil {
+		return
+	}
+
+	p.logger.DebugContext(ctx, "tls client fingerprint", "raddr", d.Addr, "ja3", fp.JA3, "ja4", fp.JA4)
+}
+
 // logWithNonCrit logs the error on the appropriate level depending on whether
 // err is a critical error or not.
 func logWithNonCrit(ctx context.Context, err error, msg string, proto Proto, l *slog.Logger) {
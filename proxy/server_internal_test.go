@@ -0,0 +1,68 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"testing"
+
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProxy_shouldLogMessages(t *testing.T) {
+	t.Parallel()
+
+	debugLogger := slogutil.New(&slogutil.Config{
+		Output: io.Discard,
+		Format: slogutil.FormatText,
+		Level:  slog.LevelDebug,
+	})
+
+	testCases := []struct {
+		logger *slog.Logger
+		name   string
+		want   []bool
+		rate   uint
+	}{{
+		logger: testLogger,
+		name:   "not_debug",
+		want:   []bool{false, false, false},
+		rate:   0,
+	}, {
+		logger: debugLogger,
+		name:   "no_sampling",
+		want:   []bool{true, true, true},
+		rate:   0,
+	}, {
+		logger: debugLogger,
+		name:   "every_query",
+		want:   []bool{true, true, true},
+		rate:   1,
+	}, {
+		logger: debugLogger,
+		name:   "one_in_three",
+		want:   []bool{true, false, false, true, false, false, true},
+		rate:   3,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			p := &Proxy{
+				logger: tc.logger,
+				Config: Config{
+					LogSampleRate: tc.rate,
+				},
+			}
+
+			got := make([]bool, 0, len(tc.want))
+			for range tc.want {
+				got = append(got, p.shouldLogMessages(context.Background()))
+			}
+
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
@@ -1,6 +1,7 @@
 package proxy
 
 import (
+	"cmp"
 	"context"
 	"crypto/tls"
 	"encoding/base64"
@@ -11,9 +12,11 @@ import (
 	"net/http"
 	"net/netip"
 	"net/url"
+	"slices"
 	"strings"
 
 	"github.com/AdguardTeam/dnsproxy/internal/bootstrap"
+	"github.com/AdguardTeam/golibs/errors"
 	"github.com/AdguardTeam/golibs/httphdr"
 	"github.com/AdguardTeam/golibs/ioutil"
 	"github.com/AdguardTeam/golibs/logutil/slogutil"
@@ -40,6 +43,12 @@ func (p *Proxy) listenHTTP(
 		return nil, nil, fmt.Errorf("tcp listener: %w", err)
 	}
 
+	err = p.setListenDSCP(ctx, tcpListen, ProtoHTTPS)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return nil, nil, err
+	}
+
 	laddr := tcpListen.Addr()
 	tcpAddr, ok := laddr.(*net.TCPAddr)
 	if !ok {
@@ -51,7 +60,7 @@ func (p *Proxy) listenHTTP(
 	tlsConfig := p.TLSConfig.Clone()
 	tlsConfig.NextProtos = []string{http2.NextProtoTLS, "http/1.1"}
 
-	tlsListen := tls.NewListener(tcpListen, tlsConfig)
+	tlsListen := tls.NewListener(tcpListen, p.withFingerprinting(tlsConfig, false))
 
 	return tlsListen, tcpAddr, nil
 }
@@ -64,7 +73,11 @@ func (p *Proxy) listenH3(
 ) (ln *quic.EarlyListener, err error) {
 	tlsConfig := p.TLSConfig.Clone()
 	tlsConfig.NextProtos = []string{"h3"}
-	quicListen, err := quic.ListenAddrEarly(addr.String(), tlsConfig, newServerQUICConfig())
+	quicListen, err := quic.ListenAddrEarly(
+		addr.String(),
+		p.withFingerprinting(tlsConfig, true),
+		newServerQUICConfig(),
+	)
 	if err != nil {
 		return nil, fmt.Errorf("quic listener: %w", err)
 	}
@@ -91,6 +104,7 @@ func (p *Proxy) initHTTPSListeners(ctx context.Context) (err error) {
 		ReadTimeout:       httpConf.ReadTimeout,
 		ReadHeaderTimeout: httpConf.ReadTimeout,
 		WriteTimeout:      httpConf.WriteTimeout,
+		HTTP2:             httpConf.HTTP2,
 	}
 
 	if httpConf.HTTP3Enabled {
@@ -127,21 +141,43 @@ func (p *Proxy) initHTTPSListeners(ctx context.Context) (err error) {
 	return nil
 }
 
+// statusDropped is the pseudo status code returned by [newDoHReq] if the
+// request has been dropped by an injected fault.
+const statusDropped = 0
+
 // newDoHReq returns new DNS request parsed from the given HTTP request.  In
 // case of invalid request returns nil and the suitable status code for an HTTP
-// error response.  l must not be nil.
+// error response.  If the DNS message is unparseable, buf contains it and
+// statusCode is [http.StatusBadRequest].  If the DNS message is dropped by the
+// faults injected with f, statusCode is [statusDropped].  maxSize is the
+// maximum size of the DNS message in bytes.  l must not be nil, f may be nil.
 func newDoHReq(
 	ctx context.Context,
 	r *http.Request,
 	l *slog.Logger,
-) (req *dns.Msg, statusCode int) {
-	var buf []byte
+	f *Faults,
+	maxSize uint16,
+) (req *dns.Msg, buf []byte, statusCode int) {
 	var err error
 
 	switch r.Method {
 	case http.MethodGet:
-		dnsParam := r.URL.Query().Get("dns")
-		buf, err = base64.RawURLEncoding.DecodeString(dnsParam)
+		var dnsParam string
+		dnsParam, statusCode = dohGetParam(ctx, r, l)
+		if statusCode != http.StatusOK {
+			return nil, nil, statusCode
+		}
+
+		if len(dnsParam) > base64.RawURLEncoding.EncodedLen(int(maxSize)) {
+			l.DebugContext(ctx, "dns param too long", "len", len(dnsParam))
+
+			return nil, nil, http.StatusRequestURITooLong
+		}
+
+		// Use the strict decoding, since RFC 8484 requires the padding-less
+		// base64url, and the non-canonical encodings are likely to be
+		// produced by broken clients.
+		buf, err = base64.RawURLEncoding.Strict().DecodeString(dnsParam)
 		if len(buf) == 0 || err != nil {
 			l.DebugContext(
 				ctx,
@@ -150,39 +186,94 @@ func newDoHReq(
 				slogutil.KeyError, err,
 			)
 
-			return nil, http.StatusBadRequest
+			return nil, nil, http.StatusBadRequest
 		}
 	case http.MethodPost:
 		contentType := r.Header.Get(httphdr.ContentType)
 		if contentType != "application/dns-message" {
 			l.DebugContext(ctx, "unsupported media type", "content_type", contentType)
 
-			return nil, http.StatusUnsupportedMediaType
+			return nil, nil, http.StatusUnsupportedMediaType
 		}
 
-		limitBody := ioutil.LimitReader(r.Body, dns.MaxMsgSize)
+		defer slogutil.CloseAndLog(ctx, l, r.Body, slog.LevelDebug)
+
+		if r.ContentLength > int64(maxSize) {
+			l.DebugContext(ctx, "request body too large", "content_length", r.ContentLength)
+
+			return nil, nil, http.StatusRequestEntityTooLarge
+		}
+
+		// Allow one more byte, since the reader fails once the limit is
+		// reached, even if the body ends right there.
+		limitBody := ioutil.LimitReader(r.Body, uint64(maxSize)+1)
 		buf, err = io.ReadAll(limitBody)
 		if err != nil {
 			l.DebugContext(ctx, "reading http request body", slogutil.KeyError, err)
 
-			return nil, http.StatusBadRequest
-		}
+			if errors.As(err, new(*ioutil.LimitError)) {
+				return nil, nil, http.StatusRequestEntityTooLarge
+			}
 
-		defer slogutil.CloseAndLog(ctx, l, r.Body, slog.LevelDebug)
+			return nil, nil, http.StatusBadRequest
+		}
 	default:
 		l.DebugContext(ctx, "bad http method", "method", r.Method)
 
-		return nil, http.StatusMethodNotAllowed
+		return nil, nil, http.StatusNotImplemented
+	}
+
+	buf, drop := f.injectIntoPacket(ctx, buf)
+	if drop {
+		return nil, nil, statusDropped
 	}
 
 	req = &dns.Msg{}
 	if err = req.Unpack(buf); err != nil {
 		l.DebugContext(ctx, "unpacking http msg", slogutil.KeyError, err)
 
-		return nil, http.StatusBadRequest
+		return nil, buf, http.StatusBadRequest
+	}
+
+	return req, nil, http.StatusOK
+}
+
+// dohGetParam returns the value of the "dns" query parameter of the DoH GET
+// request r.  statusCode is [http.StatusBadRequest] if the query is malformed,
+// the parameter is missing, empty, or repeated.  l must not be nil.
+func dohGetParam(
+	ctx context.Context,
+	r *http.Request,
+	l *slog.Logger,
+) (dnsParam string, statusCode int) {
+	query, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		l.DebugContext(ctx, "parsing http get query", slogutil.KeyError, err)
+
+		return "", http.StatusBadRequest
 	}
 
-	return req, http.StatusOK
+	params := query["dns"]
+	switch len(params) {
+	case 0:
+		l.DebugContext(ctx, "no dns param")
+
+		return "", http.StatusBadRequest
+	case 1:
+		dnsParam = params[0]
+	default:
+		l.DebugContext(ctx, "duplicate dns param", "count", len(params))
+
+		return "", http.StatusBadRequest
+	}
+
+	if dnsParam == "" {
+		l.DebugContext(ctx, "empty dns param")
+
+		return "", http.StatusBadRequest
+	}
+
+	return dnsParam, http.StatusOK
 }
 
 // ServeHTTP is the http.Handler implementation that handles DoH queries.
@@ -191,10 +282,21 @@ func newDoHReq(
 //
 //   - http.StatusNotFound if the request is not encrypted and proxy is not
 //     configured to accept unencrypted requests,
-//   - http.StatusBadRequest if there is no DNS request data,
+//   - http.StatusBadRequest if there is no DNS request data, the "dns" query
+//     parameter of the GET request is repeated or isn't a canonical unpadded
+//     base64url string, or the request headers violate [HTTPConfig.RequiredHeaders] or
+//     [HTTPConfig.RejectedHeaders],
 //   - http.StatusUnsupportedMediaType if request content type is not
 //     "application/dns-message",
-//   - http.StatusMethodNotAllowed if request method is not GET or POST.
+//   - http.StatusNoContent if the request is a CORS preflight one from an
+//     origin within [HTTPConfig.CORSAllowedOrigins],
+//   - http.StatusForbidden if the request is a CORS preflight one from any
+//     other origin,
+//   - http.StatusRequestEntityTooLarge if the body of the POST request exceeds
+//     [HTTPConfig.MaxRequestSize],
+//   - http.StatusRequestURITooLong if the DNS message in the GET request
+//     exceeds [HTTPConfig.MaxRequestSize],
+//   - http.StatusNotImplemented if request method is not GET or POST.
 func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	ctx, cancel := p.reqCtx.New(ctx)
@@ -202,6 +304,8 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	p.logger.DebugContext(ctx, "incoming https request", "url", r.URL)
 
+	addHeaders(w.Header(), p.HTTPConfig.ResponseHeaders)
+
 	if !p.HTTPConfig.InsecureEnabled && r.TLS == nil {
 		statusCode := http.StatusNotFound
 		http.Error(w, http.StatusText(statusCode), statusCode)
@@ -209,6 +313,10 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if p.handleCORS(ctx, w, r) {
+		return
+	}
+
 	raddr, prx, err := remoteAddr(r, p.logger)
 	if err != nil {
 		p.logger.DebugContext(ctx, "getting real ip", slogutil.KeyError, err)
@@ -218,15 +326,24 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	req, statusCode := newDoHReq(ctx, r, p.logger)
-	if req == nil {
-		http.Error(w, http.StatusText(statusCode), statusCode)
+	if !p.checkHeaders(ctx, w, r) {
+		return
+	}
+
+	maxSize := cmp.Or(p.HTTPConfig.MaxRequestSize, dns.MaxMsgSize)
+	req, buf, statusCode := newDoHReq(ctx, r, p.logger, p.ClientFaults, maxSize)
+	if statusCode == statusDropped {
+		// Abort the response, since there is no way to leave the request
+		// unanswered.
+		panic(http.ErrAbortHandler)
+	} else if req == nil {
+		p.handleMalformedDoH(ctx, w, r, raddr, buf, statusCode)
 
 		return
 	}
 
 	if prx.IsValid() {
-		l := p.logger.With("addr", prx)
+		l := p.logger.With("raddr", prx)
 
 		l.DebugContext(ctx, "request came from proxy server")
 
@@ -244,6 +361,7 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	d := p.newDNSContext(ProtoHTTPS, req, raddr)
 	d.HTTPRequest = r
 	d.HTTPResponseWriter = w
+	p.setHTTPTLSFingerprint(d, r)
 
 	err = p.handleDNSRequest(ctx, d)
 	if err != nil {
@@ -251,6 +369,37 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// handleMalformedDoH writes the response to the DoH request, which has failed
+// to be parsed.  buf is the unparseable DNS message, if any.
+func (p *Proxy) handleMalformedDoH(
+	ctx context.Context,
+	w http.ResponseWriter,
+	r *http.Request,
+	raddr netip.AddrPort,
+	buf []byte,
+	statusCode int,
+) {
+	if buf == nil {
+		http.Error(w, http.StatusText(statusCode), statusCode)
+
+		return
+	}
+
+	resp := p.malformedResponse(ctx, ProtoHTTPS, formErrFromPacket(buf), nil, errUnparseable)
+	if resp == nil {
+		http.Error(w, http.StatusText(statusCode), statusCode)
+
+		return
+	}
+
+	d := p.newDNSContext(ProtoHTTPS, nil, raddr)
+	d.HTTPRequest = r
+	d.HTTPResponseWriter = w
+	d.Res = resp
+
+	p.respond(ctx, d)
+}
+
 // checkBasicAuth checks the basic authorization data, if necessary, and if the
 // data isn't valid, it writes an error.  shouldHandle is false if the request
 // has been denied.  p.HTTPConfig must not be nil.
@@ -278,6 +427,68 @@ func (p *Proxy) checkBasicAuth(
 	return false
 }
 
+// checkHeaders checks the request headers against the configured policy and, if
+// the request doesn't comply, it writes an error.  shouldHandle is false if the
+// request has been denied.  p.HTTPConfig must not be nil.
+func (p *Proxy) checkHeaders(
+	ctx context.Context,
+	w http.ResponseWriter,
+	r *http.Request,
+) (shouldHandle bool) {
+	for _, name := range p.HTTPConfig.RejectedHeaders {
+		if len(r.Header.Values(name)) > 0 {
+			p.logger.DebugContext(ctx, "rejected header in request", "header", name)
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+
+			return false
+		}
+	}
+
+	for name, vals := range p.HTTPConfig.RequiredHeaders {
+		if !hasHeaderValue(r.Header, name, vals) {
+			p.logger.DebugContext(ctx, "required header missing in request", "header", name)
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+
+			return false
+		}
+	}
+
+	return true
+}
+
+// hasHeaderValue returns true if h contains the header with name and, if
+// wantVals isn't empty, one of its comma-separated values equals to one of
+// wantVals, ignoring the case and the parameters.
+func hasHeaderValue(h http.Header, name string, wantVals []string) (ok bool) {
+	vals := h.Values(name)
+	if len(wantVals) == 0 {
+		return len(vals) > 0
+	}
+
+	for _, v := range vals {
+		for part := range strings.SplitSeq(v, ",") {
+			part, _, _ = strings.Cut(part, ";")
+			part = strings.TrimSpace(part)
+			if slices.ContainsFunc(wantVals, func(want string) (eq bool) {
+				return strings.EqualFold(part, want)
+			}) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// addHeaders adds all the values of src to dst.
+func addHeaders(dst, src http.Header) {
+	for name, vals := range src {
+		for _, v := range vals {
+			dst.Add(name, v)
+		}
+	}
+}
+
 // matchesUserinfo returns false if user and pass don't match userinfo.
 // userinfo must not be nil.
 func matchesUserinfo(userinfo *url.Userinfo, user, pass string) (ok bool) {
@@ -359,7 +570,7 @@ func remoteAddr(r *http.Request, l *slog.Logger) (addr, prx netip.AddrPort, err
 		return host, netip.AddrPort{}, nil
 	}
 
-	l.Debug("using ip address from http request", "addr", realIP)
+	l.Debug("using ip address from http request", "raddr", realIP)
 
 	// TODO(a.garipov): Add port if we can get it from headers like X-Real-Port,
 	// X-Forwarded-Port, etc.
@@ -1,6 +1,7 @@
 package proxy
 
 import (
+	"bytes"
 	"context"
 	"crypto/tls"
 	"crypto/x509"
@@ -9,11 +10,14 @@ import (
 	"io"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"net/netip"
 	"net/url"
+	"slices"
 	"strings"
 	"testing"
 
+	"github.com/AdguardTeam/golibs/httphdr"
 	"github.com/AdguardTeam/golibs/testutil"
 	"github.com/AdguardTeam/golibs/testutil/servicetest"
 	"github.com/miekg/dns"
@@ -465,3 +469,297 @@ func createTestHTTPClient(dnsProxy *Proxy, caPem []byte, http3Enabled bool) (cli
 		Timeout:   defaultTimeout,
 	}
 }
+
+func TestProxy_ServeHTTP_headerPolicy(t *testing.T) {
+	t.Parallel()
+
+	const hstsVal = "max-age=63072000"
+
+	reqHandler := &TestHandler{
+		OnHandle: func(_ context.Context, _ *Proxy, d *DNSContext) (err error) {
+			d.Res = (&dns.Msg{}).SetReply(d.Req)
+
+			return nil
+		},
+	}
+
+	p := mustNew(t, &Config{
+		Logger:         testLogger,
+		UpstreamConfig: newTestUpstreamConfig(t, defaultTimeout, testDefaultUpstreamAddr),
+		TrustedProxies: defaultTrustedProxies,
+		RequestHandler: reqHandler,
+		HTTPConfig: &HTTPConfig{
+			RequiredHeaders: http.Header{
+				httphdr.Accept: {"application/dns-message"},
+			},
+			RejectedHeaders: []string{httphdr.Cookie},
+			ResponseHeaders: http.Header{
+				httphdr.StrictTransportSecurity: {hstsVal},
+			},
+			InsecureEnabled: true,
+		},
+	})
+
+	packed, err := newTestMessage().Pack()
+	require.NoError(t, err)
+
+	testCases := []struct {
+		hdrs       http.Header
+		name       string
+		wantStatus int
+	}{{
+		hdrs: http.Header{
+			httphdr.Accept: {"text/html, application/DNS-message;q=0.9"},
+		},
+		name:       "accepted",
+		wantStatus: http.StatusOK,
+	}, {
+		hdrs:       http.Header{},
+		name:       "no_accept",
+		wantStatus: http.StatusBadRequest,
+	}, {
+		hdrs: http.Header{
+			httphdr.Accept: {"application/json"},
+		},
+		name:       "bad_accept",
+		wantStatus: http.StatusBadRequest,
+	}, {
+		hdrs: http.Header{
+			httphdr.Accept: {"application/dns-message"},
+			httphdr.Cookie: {"session=1"},
+		},
+		name:       "cookie",
+		wantStatus: http.StatusBadRequest,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			r := httptest.NewRequest(http.MethodPost, "/dns-query", bytes.NewReader(packed))
+			r.Header = tc.hdrs.Clone()
+			r.Header.Set(httphdr.ContentType, "application/dns-message")
+
+			w := httptest.NewRecorder()
+			p.ServeHTTP(w, r)
+
+			assert.Equal(t, tc.wantStatus, w.Code)
+			assert.Equal(t, hstsVal, w.Header().Get(httphdr.StrictTransportSecurity))
+		})
+	}
+}
+
+func TestProxy_ServeHTTP_requestSize(t *testing.T) {
+	t.Parallel()
+
+	reqHandler := &TestHandler{
+		OnHandle: func(_ context.Context, _ *Proxy, d *DNSContext) (err error) {
+			d.Res = (&dns.Msg{}).SetReply(d.Req)
+
+			return nil
+		},
+	}
+
+	packed, err := newTestMessage().Pack()
+	require.NoError(t, err)
+
+	p := mustNew(t, &Config{
+		Logger:         testLogger,
+		UpstreamConfig: newTestUpstreamConfig(t, defaultTimeout, testDefaultUpstreamAddr),
+		TrustedProxies: defaultTrustedProxies,
+		RequestHandler: reqHandler,
+		HTTPConfig: &HTTPConfig{
+			MaxRequestSize:  uint16(len(packed)),
+			InsecureEnabled: true,
+		},
+	})
+
+	tooLarge := append(slices.Clone(packed), 0)
+
+	newPost := func(body []byte, unknownLen bool) (r *http.Request) {
+		r = httptest.NewRequest(http.MethodPost, "/dns-query", bytes.NewReader(body))
+		r.Header.Set(httphdr.ContentType, "application/dns-message")
+		if unknownLen {
+			r.ContentLength = -1
+		}
+
+		return r
+	}
+
+	newGet := func(msg []byte) (r *http.Request) {
+		target := "/dns-query?dns=" + base64.RawURLEncoding.EncodeToString(msg)
+
+		return httptest.NewRequest(http.MethodGet, target, nil)
+	}
+
+	testCases := []struct {
+		req        *http.Request
+		name       string
+		wantStatus int
+	}{{
+		req:        newPost(packed, false),
+		name:       "post",
+		wantStatus: http.StatusOK,
+	}, {
+		req:        newPost(packed, true),
+		name:       "post_unknown_length",
+		wantStatus: http.StatusOK,
+	}, {
+		req:        newPost(tooLarge, false),
+		name:       "post_too_large",
+		wantStatus: http.StatusRequestEntityTooLarge,
+	}, {
+		req:        newPost(tooLarge, true),
+		name:       "post_too_large_unknown_length",
+		wantStatus: http.StatusRequestEntityTooLarge,
+	}, {
+		req:        newGet(packed),
+		name:       "get",
+		wantStatus: http.StatusOK,
+	}, {
+		req:        newGet(tooLarge),
+		name:       "get_too_large",
+		wantStatus: http.StatusRequestURITooLong,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			w := httptest.NewRecorder()
+			p.ServeHTTP(w, tc.req)
+
+			assert.Equal(t, tc.wantStatus, w.Code)
+		})
+	}
+}
+
+func TestProxy_ServeHTTP_malformed(t *testing.T) {
+	t.Parallel()
+
+	reqHandler := &TestHandler{
+		OnHandle: func(_ context.Context, _ *Proxy, d *DNSContext) (err error) {
+			d.Res = (&dns.Msg{}).SetReply(d.Req)
+
+			return nil
+		},
+	}
+
+	p := mustNew(t, &Config{
+		Logger:         testLogger,
+		UpstreamConfig: newTestUpstreamConfig(t, defaultTimeout, testDefaultUpstreamAddr),
+		TrustedProxies: defaultTrustedProxies,
+		RequestHandler: reqHandler,
+		HTTPConfig: &HTTPConfig{
+			InsecureEnabled: true,
+		},
+	})
+
+	// Use the message of such length that its encoding has unused bits.
+	packed, err := (&dns.Msg{}).SetQuestion("example.org.", dns.TypeA).Pack()
+	require.NoError(t, err)
+
+	param := base64.RawURLEncoding.EncodeToString(packed)
+
+	// Make the encoding non-canonical by setting the lowest unused bit of the
+	// last character.
+	require.NotZero(t, len(packed)%3)
+
+	const alphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_"
+	last := strings.IndexByte(alphabet, param[len(param)-1])
+	nonCanonical := param[:len(param)-1] + alphabet[last+1:last+2]
+
+	testCases := []struct {
+		name       string
+		method     string
+		target     string
+		wantStatus int
+	}{{
+		name:       "get",
+		method:     http.MethodGet,
+		target:     "/dns-query?dns=" + param,
+		wantStatus: http.StatusOK,
+	}, {
+		name:       "get_no_param",
+		method:     http.MethodGet,
+		target:     "/dns-query",
+		wantStatus: http.StatusBadRequest,
+	}, {
+		name:       "get_empty_param",
+		method:     http.MethodGet,
+		target:     "/dns-query?dns=",
+		wantStatus: http.StatusBadRequest,
+	}, {
+		name:       "get_duplicate_param",
+		method:     http.MethodGet,
+		target:     "/dns-query?dns=" + param + "&dns=" + param,
+		wantStatus: http.StatusBadRequest,
+	}, {
+		name:       "get_padded",
+		method:     http.MethodGet,
+		target:     "/dns-query?dns=" + base64.URLEncoding.EncodeToString(packed),
+		wantStatus: http.StatusBadRequest,
+	}, {
+		name:       "get_non_canonical",
+		method:     http.MethodGet,
+		target:     "/dns-query?dns=" + nonCanonical,
+		wantStatus: http.StatusBadRequest,
+	}, {
+		name:       "get_bad_query",
+		method:     http.MethodGet,
+		target:     "/dns-query?dns=" + param + "&%zz",
+		wantStatus: http.StatusBadRequest,
+	}, {
+		name:       "put",
+		method:     http.MethodPut,
+		target:     "/dns-query",
+		wantStatus: http.StatusNotImplemented,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			w := httptest.NewRecorder()
+			p.ServeHTTP(w, httptest.NewRequest(tc.method, tc.target, nil))
+
+			assert.Equal(t, tc.wantStatus, w.Code)
+		})
+	}
+
+	t.Run("post_bad_content_type", func(t *testing.T) {
+		t.Parallel()
+
+		r := httptest.NewRequest(http.MethodPost, "/dns-query", bytes.NewReader(packed))
+		r.Header.Set(httphdr.ContentType, "application/octet-stream")
+
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, r)
+
+		assert.Equal(t, http.StatusUnsupportedMediaType, w.Code)
+	})
+}
+
+func TestProxy_ServeHTTP_clientFaults(t *testing.T) {
+	t.Parallel()
+
+	p := mustNew(t, &Config{
+		Logger:         testLogger,
+		UpstreamConfig: newTestUpstreamConfig(t, defaultTimeout, testDefaultUpstreamAddr),
+		TrustedProxies: defaultTrustedProxies,
+		HTTPConfig: &HTTPConfig{
+			InsecureEnabled: true,
+		},
+		ClientFaults: &Faults{DropRate: 1},
+	})
+
+	packed, err := (&dns.Msg{}).SetQuestion("example.org.", dns.TypeA).Pack()
+	require.NoError(t, err)
+
+	target := "/dns-query?dns=" + base64.RawURLEncoding.EncodeToString(packed)
+
+	w := httptest.NewRecorder()
+	assert.PanicsWithValue(t, http.ErrAbortHandler, func() {
+		p.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+	})
+}
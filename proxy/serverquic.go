@@ -8,6 +8,7 @@ import (
 	"log/slog"
 	"math"
 	"net"
+	"sync"
 	"time"
 
 	"github.com/AdguardTeam/dnsproxy/internal/bootstrap"
@@ -59,6 +60,9 @@ const (
 	// DoQCodeProtocolError signals that the DoQ implementation encountered
 	// a protocol error and is forcibly aborting the connection.
 	DoQCodeProtocolError quic.ApplicationErrorCode = 2
+	// DoQCodeExcessiveLoad signals that the DoQ implementation is closing the
+	// connection due to excessive load.
+	DoQCodeExcessiveLoad quic.ApplicationErrorCode = 4
 )
 
 // initQUICListeners creates QUIC listeners for the DoQ server.
@@ -97,6 +101,12 @@ func (p *Proxy) listenQUIC(
 		return nil, nil, nil, fmt.Errorf("listening to udp socket: %w", err)
 	}
 
+	err = p.setListenDSCP(ctx, conn, ProtoQUIC)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return nil, nil, nil, err
+	}
+
 	v := newQUICAddrValidator(quicAddrValidatorCacheSize, quicAddrValidatorCacheTTL)
 	tr = &quic.Transport{
 		Conn:                conn,
@@ -106,7 +116,7 @@ func (p *Proxy) listenQUIC(
 	tlsConfig := p.TLSConfig.Clone()
 	tlsConfig.NextProtos = compatProtoDQ
 	l, err = tr.ListenEarly(
-		tlsConfig,
+		p.withFingerprinting(tlsConfig, true),
 		newServerQUICConfig(),
 	)
 	if err != nil {
@@ -129,6 +139,7 @@ func (p *Proxy) quicPacketLoop(
 ) {
 	p.logger.InfoContext(ctx, "entering dns-over-quic listener loop", "addr", l.Addr())
 
+	lim := p.newConnLimiter()
 	for {
 		conn, err := p.acceptQUICConn(ctx, l)
 		if err != nil {
@@ -143,8 +154,17 @@ func (p *Proxy) quicPacketLoop(
 			break
 		}
 
+		raddr := netutil.NetAddrToAddrPort(conn.RemoteAddr()).Addr()
+		if !lim.acquire(raddr) {
+			p.logger.DebugContext(ctx, "connection limit reached", "proto", ProtoQUIC, "raddr", raddr)
+			closeQUICConn(conn, DoQCodeExcessiveLoad, p.logger)
+
+			continue
+		}
+
 		err = reqSema.Acquire(ctx)
 		if err != nil {
+			lim.release(raddr)
 			p.logger.ErrorContext(
 				ctx,
 				"acquiring semaphore",
@@ -156,6 +176,7 @@ func (p *Proxy) quicPacketLoop(
 		}
 		go func() {
 			defer reqSema.Release()
+			defer lim.release(raddr)
 
 			p.handleQUICConnection(ctx, conn, reqSema)
 		}()
@@ -214,7 +235,19 @@ func (p *Proxy) handleQUICConnection(
 	conn *quic.Conn,
 	reqSema syncutil.Semaphore,
 ) {
-	for {
+	maxQueries := p.maxQueriesPerConn()
+	wg := &sync.WaitGroup{}
+	for handled := uint(0); ; handled++ {
+		if maxQueries > 0 && handled >= maxQueries {
+			p.logger.DebugContext(ctx, "max queries per connection reached", "proto", ProtoQUIC)
+
+			// Let the queries being handled finish.
+			wg.Wait()
+			closeQUICConn(conn, DoQCodeNoError, p.logger)
+
+			return
+		}
+
 		// The stub to resolver DNS traffic follows a simple pattern in which
 		// the client sends a query, and the server provides a response.  This
 		// design specifies that for each subsequent query on a QUIC connection
@@ -239,7 +272,7 @@ func (p *Proxy) handleQUICConnection(
 
 			return
 		}
-		go func() {
+		wg.Go(func() {
 			defer reqSema.Release()
 
 			p.handleQUICStream(ctx, stream, conn)
@@ -248,7 +281,7 @@ func (p *Proxy) handleQUICConnection(
 			// indicate, after the last response, through the STREAM FIN
 			// mechanism that no further data will be sent on that stream.
 			_ = stream.Close()
-		}()
+		})
 	}
 }
 
@@ -274,7 +307,8 @@ func (p *Proxy) acceptStream(
 	// client sends a query, and the server provides a response.  This design
 	// specifies that for each subsequent query on a QUIC connection the client
 	// MUST select the next available client-initiated bidirectional stream.
-	ctx, cancel := context.WithDeadline(parent, p.time.Now().Add(maxQUICIdleTimeout))
+	idleTimeout := p.connIdleTimeout(maxQUICIdleTimeout)
+	ctx, cancel := context.WithDeadline(parent, p.time.Now().Add(idleTimeout))
 	defer cancel()
 
 	// For some reason AcceptStream below seems to get stuck even when ctx is
@@ -344,17 +378,21 @@ func (p *Proxy) handleQUICStream(ctx context.Context, stream *quic.Stream, conn
 
 	// Note that we support both the old drafts and the new RFC. In the old
 	// draft DNS messages were not prefixed with the message length.
-	packetLen := binary.BigEndian.Uint16(buf[:2])
-	if packetLen == uint16(n-2) {
-		err = req.Unpack(buf[2:n])
+	packet := buf[:n]
+	if binary.BigEndian.Uint16(buf[:2]) == uint16(n-2) {
+		packet = buf[2:n]
 	} else {
-		err = req.Unpack(buf[:n])
 		doqVersion = DoQv1Draft
 	}
 
+	packet, drop := p.ClientFaults.injectIntoPacket(ctx, packet)
+	if drop {
+		return
+	}
+
+	err = req.Unpack(packet)
 	if err != nil {
-		p.logger.ErrorContext(ctx, "unpacking quic packet", slogutil.KeyError, err)
-		closeQUICConn(conn, DoQCodeProtocolError, p.logger)
+		p.handleMalformedQUIC(ctx, conn, stream, buf[:n], doqVersion, err)
 
 		return
 	}
@@ -373,6 +411,7 @@ func (p *Proxy) handleQUICStream(ctx context.Context, stream *quic.Stream, conn
 	d.QUICStream = stream
 	d.QUICConnection = conn
 	d.DoQVersion = doqVersion
+	p.setTLSFingerprint(d, d.Addr, true)
 
 	err = p.handleDNSRequest(ctx, d)
 	if err != nil {
@@ -385,6 +424,37 @@ func (p *Proxy) handleQUICStream(ctx context.Context, stream *quic.Stream, conn
 	}
 }
 
+// handleMalformedQUIC handles the DoQ query, which has failed to be parsed.
+// packet is the whole query data as read from the stream.
+func (p *Proxy) handleMalformedQUIC(
+	ctx context.Context,
+	conn *quic.Conn,
+	stream *quic.Stream,
+	packet []byte,
+	doqVersion DoQVersion,
+	err error,
+) {
+	if doqVersion == DoQv1 {
+		packet = packet[2:]
+	}
+
+	err = fmt.Errorf("unpacking quic packet: %w", err)
+	resp := p.malformedResponse(ctx, ProtoQUIC, formErrFromPacket(packet), nil, err)
+	if resp == nil {
+		closeQUICConn(conn, DoQCodeProtocolError, p.logger)
+
+		return
+	}
+
+	d := p.newDNSContext(ProtoQUIC, nil, netutil.NetAddrToAddrPort(conn.RemoteAddr()))
+	d.QUICStream = stream
+	d.QUICConnection = conn
+	d.DoQVersion = doqVersion
+	d.Res = resp
+
+	p.respond(ctx, d)
+}
+
 // respondQUIC writes a response to the QUIC stream.  d must not be nil.
 func (p *Proxy) respondQUIC(d *DNSContext) error {
 	resp := d.Res
@@ -550,7 +620,10 @@ func newServerQUICConfig() (conf *quic.Config) {
 		MaxIdleTimeout:        maxQUICIdleTimeout,
 		MaxIncomingStreams:    math.MaxUint16,
 		MaxIncomingUniStreams: math.MaxUint16,
-		// Enable 0-RTT by default for all connections on the server-side.
+		// Enable 0-RTT by default for all connections on the server-side.  The
+		// early data may be replayed by an on-path attacker, which is mostly
+		// harmless for DNS queries, since they don't change the server state.
+		// The rate limiting and the statistics may be skewed though.
 		Allow0RTT: true,
 	}
 }
@@ -57,6 +57,12 @@ func (p *Proxy) listenTCP(ctx context.Context, addr *net.TCPAddr) (ln *net.TCPLi
 		return nil, fmt.Errorf("bad listener type: %T", listener)
 	}
 
+	err = p.setListenDSCP(ctx, ln, ProtoTCP)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return nil, err
+	}
+
 	p.logger.InfoContext(ctx, "listening to tcp", "addr", ln.Addr())
 
 	return ln, nil
@@ -77,7 +83,12 @@ func (p *Proxy) initTLSListeners(ctx context.Context) (err error) {
 			return fmt.Errorf("listening on tls addr %s: %w", addr, err)
 		}
 
-		l := tls.NewListener(tcpListen, p.TLSConfig)
+		err = p.setListenDSCP(ctx, tcpListen, ProtoTLS)
+		if err != nil {
+			return fmt.Errorf("listening on tls addr %s: %w", addr, err)
+		}
+
+		l := tls.NewListener(tcpListen, p.withSessionTickets(p.withFingerprinting(p.TLSConfig, false)))
 		p.tlsListen = append(p.tlsListen, l)
 
 		p.logger.InfoContext(ctx, "listening to tls", "addr", l.Addr())
@@ -98,6 +109,11 @@ func (p *Proxy) tcpPacketLoop(
 ) {
 	p.logger.InfoContext(ctx, "entering listener loop", "proto", proto, "addr", l.Addr())
 
+	var lim *connLimiter
+	if proto == ProtoTLS {
+		lim = p.newConnLimiter()
+	}
+
 	for {
 		clientConn, err := l.Accept()
 		if err != nil {
@@ -110,14 +126,27 @@ func (p *Proxy) tcpPacketLoop(
 			break
 		}
 
+		raddr := netutil.NetAddrToAddrPort(clientConn.RemoteAddr()).Addr()
+		if !lim.acquire(raddr) {
+			p.logger.DebugContext(ctx, "connection limit reached", "proto", proto, "raddr", raddr)
+			_ = clientConn.Close()
+
+			continue
+		}
+
 		err = reqSema.Acquire(ctx)
 		if err != nil {
+			lim.release(raddr)
 			p.logger.ErrorContext(ctx, "acquiring sema", "proto", ProtoTCP, slogutil.KeyError, err)
 
 			break
 		}
 
-		go p.handleTCPConnection(ctx, clientConn, proto, reqSema)
+		go func() {
+			defer lim.release(raddr)
+
+			p.handleTCPConnection(ctx, clientConn, proto, reqSema)
+		}()
 	}
 }
 
@@ -143,20 +172,43 @@ func (p *Proxy) handleTCPConnection(
 	ctx, cancel := p.reqCtx.New(ctx)
 	defer cancel()
 
-	for p.isStarted() {
-		err := conn.SetDeadline(p.time.Now().Add(defaultTimeout))
+	idleTimeout, maxQueries := defaultTimeout, uint(0)
+	if proto == ProtoTLS {
+		idleTimeout, maxQueries = p.connIdleTimeout(defaultTimeout), p.maxQueriesPerConn()
+	}
+
+	for handled := uint(0); p.isStarted(); handled++ {
+		if maxQueries > 0 && handled >= maxQueries {
+			p.logger.DebugContext(ctx, "max queries per connection reached", "proto", proto)
+
+			return
+		}
+
+		err := conn.SetDeadline(p.time.Now().Add(idleTimeout))
 		if err != nil {
 			// Consider deadline errors non-critical.
 			logWithNonCrit(ctx, err, "setting deadline", ProtoTCP, p.logger)
 		}
 
-		req := p.readDNSReq(ctx, conn)
-		if req == nil {
-			return
+		req, resp, drop := p.readDNSReq(ctx, conn, proto)
+		if drop {
+			continue
 		}
 
 		d := p.newDNSContext(proto, req, netutil.NetAddrToAddrPort(conn.RemoteAddr()))
 		d.Conn = conn
+		if proto == ProtoTLS {
+			p.setTLSFingerprint(d, d.Addr, false)
+		}
+
+		if req == nil {
+			if resp != nil {
+				d.Res = resp
+				p.respond(ctx, d)
+			}
+
+			return
+		}
 
 		err = p.handleDNSRequest(ctx, d)
 		if err != nil {
@@ -166,24 +218,36 @@ func (p *Proxy) handleTCPConnection(
 }
 
 // readDNSReq returns DNS request message from the given connection or nil if
-// it failed to read it.  Properly logs the error if it happened.
-func (p *Proxy) readDNSReq(ctx context.Context, conn net.Conn) (req *dns.Msg) {
+// it failed to read it.  Properly logs the error if it happened.  resp is the
+// response to the malformed request, if any.  drop is true if the message has
+// been dropped by an injected fault, so that the next one should be read.
+// proto must be either [ProtoTCP] or [ProtoTLS].
+func (p *Proxy) readDNSReq(
+	ctx context.Context,
+	conn net.Conn,
+	proto Proto,
+) (req, resp *dns.Msg, drop bool) {
 	packet, err := readPrefixed(conn)
 	if err != nil {
 		logWithNonCrit(ctx, err, "reading msg", ProtoTCP, p.logger)
 
-		return nil
+		return nil, nil, false
+	}
+
+	packet, drop = p.ClientFaults.injectIntoPacket(ctx, packet)
+	if drop {
+		return nil, nil, true
 	}
 
 	req = &dns.Msg{}
 	err = req.Unpack(packet)
 	if err != nil {
-		p.logger.ErrorContext(ctx, "handling tcp; unpacking msg", slogutil.KeyError, err)
+		err = fmt.Errorf("handling tcp; unpacking msg: %w", err)
 
-		return nil
+		return nil, p.malformedResponse(ctx, proto, formErrFromPacket(packet), nil, err), false
 	}
 
-	return req
+	return req, nil, false
 }
 
 // errTooLarge means that a DNS message is larger than 64KiB.
@@ -6,8 +6,10 @@ import (
 	"net"
 	"testing"
 
+	"github.com/AdguardTeam/golibs/testutil"
 	"github.com/AdguardTeam/golibs/testutil/servicetest"
 	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
@@ -46,3 +48,47 @@ func TestProxy_tls(t *testing.T) {
 
 	sendTestMessages(t, conn)
 }
+
+func TestProxy_readDNSReq_drop(t *testing.T) {
+	t.Parallel()
+
+	p := mustNew(t, &Config{
+		Logger:         testLogger,
+		UpstreamConfig: newTestUpstreamConfig(t, defaultTimeout, testDefaultUpstreamAddr),
+		ClientFaults:   &Faults{DropRate: 1},
+	})
+
+	clientConn, serverConn := net.Pipe()
+	testutil.CleanupAndRequireSuccess(t, clientConn.Close)
+	testutil.CleanupAndRequireSuccess(t, serverConn.Close)
+
+	dropped := (&dns.Msg{}).SetQuestion("dropped.example.", dns.TypeA)
+	kept := (&dns.Msg{}).SetQuestion("kept.example.", dns.TypeA)
+
+	go func() {
+		c := &dns.Conn{Conn: clientConn}
+		for _, m := range []*dns.Msg{dropped, kept} {
+			if c.WriteMsg(m) != nil {
+				return
+			}
+		}
+	}()
+
+	ctx := testutil.ContextWithTimeout(t, testTimeout)
+
+	req, resp, drop := p.readDNSReq(ctx, serverConn, ProtoTCP)
+	require.True(t, drop)
+
+	assert.Nil(t, req)
+	assert.Nil(t, resp)
+
+	// The connection must still be usable after a dropped message.
+	p.ClientFaults = nil
+
+	req, resp, drop = p.readDNSReq(ctx, serverConn, ProtoTCP)
+	require.False(t, drop)
+	require.Nil(t, resp)
+	require.NotNil(t, req)
+
+	assert.Equal(t, kept.Question, req.Question)
+}
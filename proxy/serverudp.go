@@ -74,6 +74,12 @@ func (p *Proxy) listenUDP(ctx context.Context, addr *net.UDPAddr) (conn *net.UDP
 		return nil, fmt.Errorf("setting udp opts: %w", err)
 	}
 
+	err = p.setListenDSCP(ctx, conn, ProtoUDP)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return nil, err
+	}
+
 	p.logger.InfoContext(ctx, "listening to udp", "addr", conn.LocalAddr())
 
 	return conn, nil
@@ -145,25 +151,33 @@ func (p *Proxy) udpHandlePacket(
 	p.logger.DebugContext(ctx, "handling new udp packet", "raddr", remoteAddr)
 
 	req := &dns.Msg{}
+	d := p.newDNSContext(ProtoUDP, req, netutil.NetAddrToAddrPort(remoteAddr))
+	d.Conn = conn
+	d.localIP = localIP
+
+	packet, drop := p.ClientFaults.injectIntoPacket(ctx, packet)
+	if drop {
+		return
+	}
+
 	err := req.Unpack(packet)
 	if err != nil {
-		p.logger.ErrorContext(ctx, "unpacking udp packet", slogutil.KeyError, err)
+		err = fmt.Errorf("unpacking udp packet: %w", err)
+		d.Res = p.malformedResponse(ctx, ProtoUDP, formErrFromPacket(packet), nil, err)
+		p.respond(ctx, d)
 
 		return
 	}
 
-	d := p.newDNSContext(ProtoUDP, req, netutil.NetAddrToAddrPort(remoteAddr))
-	d.Conn = conn
-	d.localIP = localIP
-
 	err = p.handleDNSRequest(ctx, d)
 	if err != nil {
 		p.logger.DebugContext(ctx, "handling dns request", "proto", d.Proto, slogutil.KeyError, err)
 	}
 }
 
-// respondUDP writes a response to the UDP client.  d must not be nil.
-func (p *Proxy) respondUDP(d *DNSContext) error {
+// respondUDP writes a response to the UDP client, holding it according to
+// [Config.UDPPacing].  d must not be nil.
+func (p *Proxy) respondUDP(ctx context.Context, d *DNSContext) error {
 	resp := d.Res
 
 	if resp == nil {
@@ -176,6 +190,10 @@ func (p *Proxy) respondUDP(d *DNSContext) error {
 		return fmt.Errorf("packing message: %w", err)
 	}
 
+	if !p.udpPacer.wait(ctx, d.Addr.Addr(), p.time.Now()) {
+		return errUDPPacingDrop
+	}
+
 	conn := d.Conn.(*net.UDPConn)
 	rAddr := net.UDPAddrFromAddrPort(d.Addr)
 	n, err := proxynetutil.UDPWrite(bytes, conn, rAddr, d.localIP)
@@ -0,0 +1,94 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"time"
+)
+
+// sessionCreatedPrefix is the prefix of the [tls.SessionState.Extra] item
+// holding the time the session ticket has been issued at.
+const sessionCreatedPrefix = "dnsproxy-created:"
+
+// withSessionTickets returns conf, if neither the session tickets are disabled
+// nor their lifetime is limited for the DNS-over-TLS listeners, or a copy of
+// it with the corresponding settings otherwise.  conf must not be nil.
+//
+// crypto/tls issues a single TLS 1.3 session ticket after each handshake and
+// doesn't allow to change that.  It also doesn't support the 0-RTT early data
+// over TCP, so the resumed sessions still take a full round trip, but skip the
+// certificate exchange and verification, which is what costs the most to the
+// mobile clients.  Lack of early data also means that the DNS-over-TLS queries
+// can't be replayed by an on-path attacker, unlike the DNS-over-QUIC ones, see
+// [newServerQUICConfig].
+func (p *Proxy) withSessionTickets(conf *tls.Config) (res *tls.Config) {
+	switch {
+	case p.TLSSessionTicketsDisabled:
+		res = conf.Clone()
+		res.SessionTicketsDisabled = true
+
+		return res
+	case p.TLSSessionTicketLifetime == 0:
+		return conf
+	}
+
+	res = conf.Clone()
+	lifetime := p.TLSSessionTicketLifetime
+
+	nextWrap, nextUnwrap := conf.WrapSession, conf.UnwrapSession
+	res.WrapSession = func(cs tls.ConnectionState, ss *tls.SessionState) (t []byte, err error) {
+		ss.Extra = append(ss.Extra, encodeSessionCreated(p.time.Now()))
+		if nextWrap != nil {
+			return nextWrap(cs, ss)
+		}
+
+		return res.EncryptTicket(cs, ss)
+	}
+
+	res.UnwrapSession = func(
+		identity []byte,
+		cs tls.ConnectionState,
+	) (ss *tls.SessionState, err error) {
+		if nextUnwrap != nil {
+			ss, err = nextUnwrap(identity, cs)
+		} else {
+			ss, err = res.DecryptTicket(identity, cs)
+		}
+
+		if err != nil || ss == nil {
+			return ss, err
+		}
+
+		created, ok := decodeSessionCreated(ss.Extra)
+		if !ok || p.time.Now().Sub(created) > lifetime {
+			// Make the client perform a full handshake.
+			return nil, nil
+		}
+
+		return ss, nil
+	}
+
+	return res
+}
+
+// encodeSessionCreated returns the [tls.SessionState.Extra] item holding t.
+func encodeSessionCreated(t time.Time) (item []byte) {
+	item = make([]byte, len(sessionCreatedPrefix), len(sessionCreatedPrefix)+8)
+	copy(item, sessionCreatedPrefix)
+
+	return binary.BigEndian.AppendUint64(item, uint64(t.Unix()))
+}
+
+// decodeSessionCreated returns the time the session ticket has been issued at
+// from the [tls.SessionState.Extra] items, if any.
+func decodeSessionCreated(extra [][]byte) (t time.Time, ok bool) {
+	for _, item := range extra {
+		v, found := bytes.CutPrefix(item, []byte(sessionCreatedPrefix))
+		if found && len(v) == 8 {
+			return time.Unix(int64(binary.BigEndian.Uint64(v)), 0), true
+		}
+	}
+
+	return time.Time{}, false
+}
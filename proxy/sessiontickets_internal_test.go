@@ -0,0 +1,120 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/testutil/faketime"
+	"github.com/AdguardTeam/golibs/testutil/servicetest"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxy_withSessionTickets(t *testing.T) {
+	t.Parallel()
+
+	const lifetime = time.Hour
+
+	testCases := []struct {
+		want     assert.BoolAssertionFunc
+		name     string
+		elapsed  time.Duration
+		disabled bool
+	}{{
+		want:     assert.True,
+		name:     "resumed",
+		elapsed:  lifetime / 2,
+		disabled: false,
+	}, {
+		want:     assert.False,
+		name:     "expired",
+		elapsed:  2 * lifetime,
+		disabled: false,
+	}, {
+		want:     assert.False,
+		name:     "disabled",
+		elapsed:  0,
+		disabled: true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			serverConfig, caPem := newTLSConfig(t)
+			p := mustNew(t, &Config{
+				Logger:                    testLogger,
+				TLSListenAddr:             []*net.TCPAddr{net.TCPAddrFromAddrPort(localhostAnyPort)},
+				TLSConfig:                 serverConfig,
+				UpstreamConfig:            newTestUpstreamConfig(t, defaultTimeout, testDefaultUpstreamAddr),
+				TrustedProxies:            defaultTrustedProxies,
+				TLSSessionTicketLifetime:  lifetime,
+				TLSSessionTicketsDisabled: tc.disabled,
+				RequestHandler:            newReplyingHandler(),
+			})
+
+			start := time.Now()
+			elapsed := &atomic.Int64{}
+			p.time = &faketime.Clock{
+				OnNow: func() (now time.Time) {
+					return start.Add(time.Duration(elapsed.Load()))
+				},
+			}
+
+			servicetest.RequireRun(t, p, testTimeout)
+
+			roots := x509.NewCertPool()
+			roots.AppendCertsFromPEM(caPem)
+			clientConf := &tls.Config{
+				ServerName:         tlsServerName,
+				RootCAs:            roots,
+				ClientSessionCache: tls.NewLRUClientSessionCache(1),
+			}
+
+			addr := p.Addr(ProtoTLS).String()
+			assert.False(t, exchangeTLS(t, addr, clientConf))
+
+			elapsed.Store(int64(tc.elapsed))
+			tc.want(t, exchangeTLS(t, addr, clientConf))
+		})
+	}
+}
+
+// newReplyingHandler returns a handler replying to every request with an
+// empty response.
+func newReplyingHandler() (h *TestHandler) {
+	return &TestHandler{
+		OnHandle: func(_ context.Context, _ *Proxy, d *DNSContext) (err error) {
+			d.Res = (&dns.Msg{}).SetReply(d.Req)
+
+			return nil
+		},
+	}
+}
+
+// exchangeTLS performs a DNS-over-TLS exchange with addr and returns true if
+// the TLS session has been resumed.
+func exchangeTLS(tb testing.TB, addr string, conf *tls.Config) (resumed bool) {
+	tb.Helper()
+
+	tlsConn, err := tls.Dial("tcp", addr, conf)
+	require.NoError(tb, err)
+
+	conn := &dns.Conn{Conn: tlsConn}
+	defer func() { require.NoError(tb, conn.Close()) }()
+
+	err = conn.WriteMsg(newTestMessage())
+	require.NoError(tb, err)
+
+	// Reading the response also processes the session ticket.
+	_, err = conn.ReadMsg()
+	require.NoError(tb, err)
+
+	return tlsConn.ConnectionState().DidResume
+}
@@ -1,6 +1,7 @@
 package proxy
 
 import (
+	"context"
 	"fmt"
 	"time"
 
@@ -14,11 +15,24 @@ type upstreamWithStats struct {
 	// upstream is the upstream DNS resolver.
 	upstream upstream.Upstream
 
+	// limiter limits the number of simultaneous queries to upstream.  If nil,
+	// the queries aren't limited.
+	limiter *upstreamLimiter
+
+	// trace records the exchanges, if not nil.
+	trace *Trace
+
+	// faults are injected into the responses, if not nil.
+	faults *Faults
+
 	// err is the DNS lookup error, if any.
 	err error
 
 	// queryDuration is the duration of the successful DNS lookup.
 	queryDuration time.Duration
+
+	// isFallback is true if upstream is a fallback one.
+	isFallback bool
 }
 
 // type check
@@ -26,11 +40,32 @@ var _ upstream.Upstream = (*upstreamWithStats)(nil)
 
 // Exchange implements the [upstream.Upstream] for *upstreamWithStats.
 func (u *upstreamWithStats) Exchange(req *dns.Msg) (resp *dns.Msg, err error) {
+	if u.limiter != nil {
+		var release func()
+		release, err = u.limiter.acquire(u.upstream.Address())
+		if err != nil {
+			u.err = err
+
+			return nil, err
+		}
+
+		defer release()
+	}
+
 	start := time.Now()
 	resp, err = u.upstream.Exchange(req)
+	resp, err = u.faults.injectIntoResponse(context.Background(), resp, err)
 	u.err = err
 	u.queryDuration = time.Since(start)
 
+	u.trace.addExchange(&TraceExchange{
+		Start:    start,
+		Err:      err,
+		Upstream: u.upstream.Address(),
+		Duration: u.queryDuration,
+		Fallback: u.isFallback,
+	})
+
 	return resp, err
 }
 
@@ -46,10 +81,25 @@ func (u *upstreamWithStats) Close() (err error) {
 
 // upstreamsWithStats takes a list of upstreams, wraps each upstream with
 // [upstreamWithStats] to gather statistics, and returns the wrapped upstreams.
-func upstreamsWithStats(upstreams []upstream.Upstream) (wrapped []upstream.Upstream) {
+// limiter is used to limit the queries to the upstreams, it may be nil.  faults
+// are injected into the responses, if not nil.  The exchanges are recorded into
+// trace, if it's not nil.
+func upstreamsWithStats(
+	upstreams []upstream.Upstream,
+	limiter *upstreamLimiter,
+	faults *Faults,
+	trace *Trace,
+	isFallback bool,
+) (wrapped []upstream.Upstream) {
 	wrapped = make([]upstream.Upstream, 0, len(upstreams))
 	for _, u := range upstreams {
-		wrapped = append(wrapped, &upstreamWithStats{upstream: u})
+		wrapped = append(wrapped, &upstreamWithStats{
+			upstream:   u,
+			limiter:    limiter,
+			trace:      trace,
+			faults:     faults,
+			isFallback: isFallback,
+		})
 	}
 
 	return wrapped
@@ -119,8 +169,10 @@ func collectQueryStats(
 	}
 
 	// The DNS query was successfully resolved by main resolver and the upstream
-	// mode is [UpstreamModeFastestAddr].
-	if mode == UpstreamModeFastestAddr && len(fallbacks) == 0 {
+	// mode is [UpstreamModeFastestAddr] or [UpstreamModeConsensus], both
+	// querying all the upstreams.
+	isAll := mode == UpstreamModeFastestAddr || mode == UpstreamModeConsensus
+	if isAll && len(fallbacks) == 0 {
 		return unwrapped, &QueryStatistics{
 			main: collectUpstreamStats(upstreams...),
 		}
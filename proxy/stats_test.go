@@ -205,6 +205,34 @@ func TestCollectQueryStats(t *testing.T) {
 		mode:              proxy.UpstreamModeFastestAddr,
 		wantMainCount:     2,
 		wantFallbackCount: 1,
+	}, {
+		wantErr:         assert.NoError,
+		wantMainErr:     assert.True,
+		wantFallbackErr: assert.False,
+		config: &proxy.UpstreamConfig{
+			Upstreams: []upstream.Upstream{ups, ups, failUps},
+		},
+		fallbackConfig: &proxy.UpstreamConfig{
+			Upstreams: []upstream.Upstream{ups},
+		},
+		name:              "consensus_success",
+		mode:              proxy.UpstreamModeConsensus,
+		wantMainCount:     3,
+		wantFallbackCount: 0,
+	}, {
+		wantErr:         assert.Error,
+		wantMainErr:     assert.True,
+		wantFallbackErr: assert.False,
+		config: &proxy.UpstreamConfig{
+			Upstreams: []upstream.Upstream{ups, failUps},
+		},
+		fallbackConfig: &proxy.UpstreamConfig{
+			Upstreams: []upstream.Upstream{ups},
+		},
+		name:              "consensus_bad_no_fallback",
+		mode:              proxy.UpstreamModeConsensus,
+		wantMainCount:     2,
+		wantFallbackCount: 0,
 	}}
 
 	for _, tc := range testCases {
@@ -0,0 +1,224 @@
+package proxy
+
+import (
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+)
+
+// CacheDecision describes the way the cache has been involved in resolving a
+// request.
+type CacheDecision string
+
+// CacheDecision values.
+const (
+	// CacheDecisionNone means that the request hasn't reached the cache, e.g.
+	// because it has been handled by a middleware.
+	CacheDecisionNone CacheDecision = ""
+
+	// CacheDecisionDisabled means that the cache isn't used for the request.
+	CacheDecisionDisabled CacheDecision = "disabled"
+
+	// CacheDecisionMiss means that the response wasn't found in the cache.
+	CacheDecisionMiss CacheDecision = "miss"
+
+	// CacheDecisionHit means that the response was served from the cache.
+	CacheDecisionHit CacheDecision = "hit"
+
+	// CacheDecisionStale means that an expired response was served from the
+	// optimistic cache and is being refreshed in the background.
+	CacheDecisionStale CacheDecision = "stale"
+
+	// CacheDecisionNSEC means that the NXDOMAIN response was synthesized from
+	// the cached NSEC or NSEC3 records proving the non-existence of the name.
+	CacheDecisionNSEC CacheDecision = "nsec"
+
+	// CacheDecisionShared means that the response was shared with an identical
+	// request being resolved at the same time.
+	CacheDecisionShared CacheDecision = "shared"
+)
+
+// TraceRoute is the source of the response within the proxy.
+type TraceRoute string
+
+// TraceRoute values.
+const (
+	// TraceRouteNone means that the response hasn't been produced by
+	// [Proxy.Resolve], e.g. it has been set by a middleware.
+	TraceRouteNone TraceRoute = ""
+
+	// TraceRouteCache means that the response was served from the cache.
+	TraceRouteCache TraceRoute = "cache"
+
+	// TraceRouteUpstream means that the response was received from the main
+	// upstreams.
+	TraceRouteUpstream TraceRoute = "upstream"
+
+	// TraceRoutePrivate means that the response was received from the private
+	// reverse DNS upstreams.
+	TraceRoutePrivate TraceRoute = "private"
+
+	// TraceRouteFallback means that the response was received from the
+	// fallback upstreams.
+	TraceRouteFallback TraceRoute = "fallback"
+)
+
+// TraceExchange is a single attempt to exchange the request with an upstream.
+type TraceExchange struct {
+	// Start is the time the exchange has been started.
+	Start time.Time
+
+	// Err is the error of the exchange, if any.
+	Err error
+
+	// Upstream is the address of the upstream.
+	Upstream string
+
+	// Duration is the duration of the exchange.
+	Duration time.Duration
+
+	// Fallback is true if the upstream is one of the fallback ones.
+	Fallback bool
+}
+
+// TraceStep is a named point in time during the request processing, e.g. one
+// recorded by a middleware.
+type TraceStep struct {
+	// Time is the time the step has been recorded.
+	Time time.Time
+
+	// Name is the name of the step.
+	Name string
+}
+
+// Trace is the record of processing a single request.  It's attached to the
+// [DNSContext] and may be read by middlewares, query logs, and callers of
+// [Proxy.Resolve] once the request is handled.  The exported fields must not
+// be modified by anything other than the proxy itself.
+type Trace struct {
+	// Start is the time the request processing has been started.
+	Start time.Time
+
+	// Client is the address of the client.
+	Client netip.AddrPort
+
+	// CorrelationID is the correlation ID of the request, see
+	// [DNSContext.CorrelationID].
+	CorrelationID string
+
+	// Proto is the protocol the request has been received over.
+	Proto Proto
+
+	// Cache is the decision of the cache on the request.
+	Cache CacheDecision
+
+	// Route is the source of the response.
+	Route TraceRoute
+
+	// TLSFingerprint is the fingerprint of the ClientHello message of the
+	// client's connection, if any.
+	TLSFingerprint *TLSFingerprint
+
+	// Upstream is the address of the upstream that resolved the request, if
+	// any.  For cached responses it's the address of the upstream the cached
+	// response was originally received from.
+	Upstream string
+
+	// Duration is the total duration of the request processing.  It's only
+	// set once the response has been sent to the client.
+	Duration time.Duration
+
+	// mu protects exchanges and steps, since the exchanges may be performed
+	// in parallel and may still be finishing after the response is chosen.
+	mu        *sync.Mutex
+	exchanges []*TraceExchange
+	steps     []*TraceStep
+}
+
+// NewTrace returns a new properly initialized *Trace for the request of the
+// client with addr over proto, started at start.
+func NewTrace(start time.Time, proto Proto, addr netip.AddrPort) (t *Trace) {
+	return &Trace{
+		Start:  start,
+		Client: addr,
+		Proto:  proto,
+		mu:     &sync.Mutex{},
+	}
+}
+
+// AddStep records the step with the given name at the moment now.  It's safe
+// for concurrent use.  t may be nil, in which case nothing is recorded.
+func (t *Trace) AddStep(name string, now time.Time) {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.steps = append(t.steps, &TraceStep{
+		Time: now,
+		Name: name,
+	})
+}
+
+// Steps returns the steps recorded so far.  The items must not be modified.
+// t may be nil.
+func (t *Trace) Steps() (steps []*TraceStep) {
+	if t == nil {
+		return nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return slices.Clone(t.steps)
+}
+
+// Exchanges returns the upstream exchanges recorded so far in the order of
+// their completion, including the retries and the fallback ones.  The items
+// must not be modified.  t may be nil.
+func (t *Trace) Exchanges() (exchanges []*TraceExchange) {
+	if t == nil {
+		return nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return slices.Clone(t.exchanges)
+}
+
+// addExchange records the finished exchange.  t may be nil.
+func (t *Trace) addExchange(e *TraceExchange) {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.exchanges = append(t.exchanges, e)
+}
+
+// setCache sets the cache decision.  t may be nil.
+func (t *Trace) setCache(c CacheDecision) {
+	if t != nil {
+		t.Cache = c
+	}
+}
+
+// setRoute sets the route and the address of the upstream.  t may be nil.
+func (t *Trace) setRoute(r TraceRoute, upsAddr string) {
+	if t != nil {
+		t.Route, t.Upstream = r, upsAddr
+	}
+}
+
+// finish sets the total duration of the processing.  t may be nil.
+func (t *Trace) finish(now time.Time) {
+	if t != nil {
+		t.Duration = now.Sub(t.Start)
+	}
+}
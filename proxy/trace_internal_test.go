@@ -0,0 +1,128 @@
+package proxy
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/internal/dnsproxytest"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxy_Resolve_trace(t *testing.T) {
+	t.Parallel()
+
+	const (
+		mainAddr     = "main"
+		fallbackAddr = "fallback"
+
+		testErr errors.Error = "test error"
+	)
+
+	failing := &dnsproxytest.Upstream{
+		OnExchange: func(_ *dns.Msg) (_ *dns.Msg, err error) { return nil, testErr },
+		OnAddress:  func() (addr string) { return mainAddr },
+		OnClose:    func() (_ error) { panic(testutil.UnexpectedCall()) },
+	}
+
+	fallback := &dnsproxytest.Upstream{
+		OnExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+			resp = (&dns.Msg{}).SetReply(req)
+			resp.Answer = append(resp.Answer, &dns.A{
+				Hdr: dns.RR_Header{
+					Name:   req.Question[0].Name,
+					Class:  dns.ClassINET,
+					Rrtype: dns.TypeA,
+					Ttl:    defaultTestTTL,
+				},
+				A: net.IP{192, 0, 2, 2},
+			})
+
+			return resp, nil
+		},
+		OnAddress: func() (addr string) { return fallbackAddr },
+		OnClose:   func() (_ error) { panic(testutil.UnexpectedCall()) },
+	}
+
+	p := mustNew(t, &Config{
+		Logger: testLogger,
+		UpstreamConfig: &UpstreamConfig{
+			Upstreams: []upstream.Upstream{failing},
+		},
+		Fallbacks: &UpstreamConfig{
+			Upstreams: []upstream.Upstream{fallback},
+		},
+		TrustedProxies: defaultTrustedProxies,
+		CacheEnabled:   true,
+		CacheSizeBytes: defaultCacheSize,
+	})
+
+	addr := netip.MustParseAddrPort("192.0.2.1:1234")
+	ctx := testutil.ContextWithTimeout(t, testTimeout)
+
+	t.Run("fallback", func(t *testing.T) {
+		d := p.newDNSContext(ProtoUDP, newHostTestMessage("trace"), addr)
+		require.NoError(t, p.Resolve(ctx, d))
+
+		tr := d.Trace
+		require.NotNil(t, tr)
+
+		assert.Equal(t, addr, tr.Client)
+		assert.Equal(t, ProtoUDP, tr.Proto)
+		assert.Equal(t, CacheDecisionMiss, tr.Cache)
+		assert.Equal(t, TraceRouteFallback, tr.Route)
+		assert.Equal(t, fallbackAddr, tr.Upstream)
+
+		exchanges := tr.Exchanges()
+		require.Len(t, exchanges, 2)
+
+		assert.Equal(t, mainAddr, exchanges[0].Upstream)
+		assert.ErrorIs(t, exchanges[0].Err, testErr)
+		assert.False(t, exchanges[0].Fallback)
+
+		assert.Equal(t, fallbackAddr, exchanges[1].Upstream)
+		assert.NoError(t, exchanges[1].Err)
+		assert.True(t, exchanges[1].Fallback)
+	})
+
+	t.Run("cache", func(t *testing.T) {
+		// Resolve the request without the trace to make sure it's created.
+		d := &DNSContext{
+			Req:  newHostTestMessage("trace"),
+			Addr: addr,
+		}
+		require.NoError(t, p.Resolve(ctx, d))
+
+		tr := d.Trace
+		require.NotNil(t, tr)
+
+		assert.Equal(t, CacheDecisionHit, tr.Cache)
+		assert.Equal(t, TraceRouteCache, tr.Route)
+		assert.Equal(t, fallbackAddr, tr.Upstream)
+		assert.Empty(t, tr.Exchanges())
+	})
+}
+
+func TestTrace_nil(t *testing.T) {
+	t.Parallel()
+
+	var tr *Trace
+	now := time.Now()
+
+	assert.NotPanics(t, func() {
+		tr.AddStep("step", now)
+		tr.addExchange(&TraceExchange{})
+		tr.setCache(CacheDecisionHit)
+		tr.setRoute(TraceRouteCache, "")
+		tr.finish(now)
+	})
+
+	assert.Nil(t, tr.Steps())
+	assert.Nil(t, tr.Exchanges())
+}
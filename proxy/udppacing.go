@@ -0,0 +1,202 @@
+package proxy
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/netutil"
+)
+
+// Default values of [UDPPacingConfig].
+const (
+	defaultUDPPacingMaxDelay      = 200 * time.Millisecond
+	defaultUDPPacingSubnetLenIPv4 = 24
+	defaultUDPPacingSubnetLenIPv6 = 56
+)
+
+// errUDPPacingDrop is returned when a UDP response is dropped, since it can't
+// be sent within [UDPPacingConfig.MaxDelay].
+const errUDPPacingDrop errors.Error = "udp pacing: max delay exceeded"
+
+// udpPacingSweepIvl is the interval of removing the idle subnets from
+// [udpPacer].
+const udpPacingSweepIvl = 1 * time.Minute
+
+// UDPPacingConfig is the configuration of pacing the responses sent over UDP.
+// The responses to the clients of the same subnet are spread evenly over time
+// instead of being sent in bursts, which reduces the packet loss on the
+// constrained links.  It complements the rate limiting of the requests.
+type UDPPacingConfig struct {
+	// MaxDelay is the maximum time a response is held for.  The responses,
+	// which should have been held for longer, are dropped, so that the client
+	// retries.  If zero, the default of 200 milliseconds is used.
+	MaxDelay time.Duration
+
+	// Rate is the number of responses per second sent to a single subnet.  It
+	// must be positive.
+	Rate uint
+
+	// Burst is the number of responses sent to a single subnet at once before
+	// the pacing starts.  If zero, 1 is used, i.e. all the responses are
+	// paced.
+	Burst uint
+
+	// SubnetLenIPv4 is the length of the IPv4 subnets the clients are grouped
+	// by.  If zero, the default of 24 is used.
+	SubnetLenIPv4 uint
+
+	// SubnetLenIPv6 is the length of the IPv6 subnets the clients are grouped
+	// by.  If zero, the default of 56 is used.
+	SubnetLenIPv6 uint
+}
+
+// validate returns an error if c is invalid.  c may be nil.
+func (c *UDPPacingConfig) validate() (err error) {
+	switch {
+	case c == nil:
+		return nil
+	case c.Rate == 0:
+		return fmt.Errorf("rate: %w", errors.ErrNotPositive)
+	case c.MaxDelay < 0:
+		return fmt.Errorf("max delay: %w: %s", errors.ErrNegative, c.MaxDelay)
+	case c.SubnetLenIPv4 > netutil.IPv4BitLen:
+		return fmt.Errorf("subnet len ipv4: %w: %d", errors.ErrOutOfRange, c.SubnetLenIPv4)
+	case c.SubnetLenIPv6 > netutil.IPv6BitLen:
+		return fmt.Errorf("subnet len ipv6: %w: %d", errors.ErrOutOfRange, c.SubnetLenIPv6)
+	default:
+		return nil
+	}
+}
+
+// udpPacer paces the UDP responses to the client subnets.  It implements the
+// token bucket in the form of the generic cell rate algorithm, so that only the
+// theoretical time of sending the next response is stored for each subnet.  A
+// nil *udpPacer doesn't pace the responses.
+type udpPacer struct {
+	// mu protects next and lastSweep.
+	mu *sync.Mutex
+
+	// next maps the client subnet to the theoretical time of sending the next
+	// response to it.
+	next map[netip.Prefix]time.Time
+
+	// lastSweep is the time the idle subnets have been removed from next.
+	lastSweep time.Time
+
+	// interval is the time between the paced responses to a subnet.
+	interval time.Duration
+
+	// tolerance is the time the responses may be sent ahead of the schedule,
+	// which allows the bursts.
+	tolerance time.Duration
+
+	// maxDelay is the maximum time a response is held for.
+	maxDelay time.Duration
+
+	// subnetLenIPv4 is the length of the IPv4 subnets.
+	subnetLenIPv4 int
+
+	// subnetLenIPv6 is the length of the IPv6 subnets.
+	subnetLenIPv6 int
+}
+
+// newUDPPacer returns a new pacer of the UDP responses or nil if c is nil.  c
+// must be valid.
+func newUDPPacer(c *UDPPacingConfig) (p *udpPacer) {
+	if c == nil {
+		return nil
+	}
+
+	interval := time.Second / time.Duration(c.Rate)
+
+	return &udpPacer{
+		mu:            &sync.Mutex{},
+		next:          map[netip.Prefix]time.Time{},
+		interval:      interval,
+		tolerance:     interval * time.Duration(max(c.Burst, 1)-1),
+		maxDelay:      cmp.Or(c.MaxDelay, defaultUDPPacingMaxDelay),
+		subnetLenIPv4: int(cmp.Or(c.SubnetLenIPv4, defaultUDPPacingSubnetLenIPv4)),
+		subnetLenIPv6: int(cmp.Or(c.SubnetLenIPv6, defaultUDPPacingSubnetLenIPv6)),
+	}
+}
+
+// subnet returns the subnet of addr the responses are paced for.
+func (p *udpPacer) subnet(addr netip.Addr) (pref netip.Prefix) {
+	addr = addr.Unmap()
+	if addr.Is4() {
+		pref = netip.PrefixFrom(addr, p.subnetLenIPv4)
+	} else {
+		pref = netip.PrefixFrom(addr.WithZone(""), p.subnetLenIPv6)
+	}
+
+	return pref.Masked()
+}
+
+// reserve schedules sending the response to addr at now and returns the time
+// it should be held for.  ok is false if the response should be dropped, since
+// it can't be sent within the maximum delay.
+func (p *udpPacer) reserve(addr netip.Addr, now time.Time) (delay time.Duration, ok bool) {
+	pref := p.subnet(addr)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.sweep(now)
+
+	next := p.next[pref]
+	if next.Before(now) {
+		next = now
+	}
+
+	delay = max(next.Sub(now)-p.tolerance, 0)
+	if delay > p.maxDelay {
+		return 0, false
+	}
+
+	p.next[pref] = next.Add(p.interval)
+
+	return delay, true
+}
+
+// sweep removes the subnets, which have been idle for long enough to send a
+// burst again, each [udpPacingSweepIvl].  p.mu must be locked.
+func (p *udpPacer) sweep(now time.Time) {
+	if now.Sub(p.lastSweep) < udpPacingSweepIvl {
+		return
+	}
+
+	p.lastSweep = now
+	for pref, next := range p.next {
+		if !next.After(now) {
+			delete(p.next, pref)
+		}
+	}
+}
+
+// wait holds the response to addr according to the pacing.  ok is false if the
+// response should be dropped.  p may be nil.
+func (p *udpPacer) wait(ctx context.Context, addr netip.Addr, now time.Time) (ok bool) {
+	if p == nil {
+		return true
+	}
+
+	delay, ok := p.reserve(addr, now)
+	if !ok || delay == 0 {
+		return ok
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,121 @@
+package proxy
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUDPPacingConfig_validate(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		conf    *UDPPacingConfig
+		wantErr error
+		name    string
+	}{{
+		conf:    nil,
+		wantErr: nil,
+		name:    "nil",
+	}, {
+		conf:    &UDPPacingConfig{Rate: 100, Burst: 10},
+		wantErr: nil,
+		name:    "valid",
+	}, {
+		conf:    &UDPPacingConfig{},
+		wantErr: errors.ErrNotPositive,
+		name:    "no_rate",
+	}, {
+		conf:    &UDPPacingConfig{Rate: 100, MaxDelay: -time.Second},
+		wantErr: errors.ErrNegative,
+		name:    "negative_delay",
+	}, {
+		conf:    &UDPPacingConfig{Rate: 100, SubnetLenIPv4: 33},
+		wantErr: errors.ErrOutOfRange,
+		name:    "subnet_len",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			err := tc.conf.validate()
+			assert.ErrorIs(t, err, tc.wantErr)
+		})
+	}
+}
+
+func TestUDPPacer_reserve(t *testing.T) {
+	t.Parallel()
+
+	p := newUDPPacer(&UDPPacingConfig{
+		MaxDelay: 25 * time.Millisecond,
+		Rate:     100,
+		Burst:    2,
+	})
+
+	var (
+		addr      = netip.MustParseAddr("192.0.2.1")
+		sameNet   = netip.MustParseAddr("192.0.2.2")
+		otherNet  = netip.MustParseAddr("198.51.100.1")
+		now       = time.Unix(0, 0)
+		wantDelay = 10 * time.Millisecond
+	)
+
+	// The burst is sent right away.
+	for range 2 {
+		delay, ok := p.reserve(addr, now)
+		assert.True(t, ok)
+		assert.Zero(t, delay)
+	}
+
+	delay, ok := p.reserve(sameNet, now)
+	assert.True(t, ok)
+	assert.Equal(t, wantDelay, delay)
+
+	delay, ok = p.reserve(sameNet, now)
+	assert.True(t, ok)
+	assert.Equal(t, 2*wantDelay, delay)
+
+	_, ok = p.reserve(addr, now)
+	assert.False(t, ok)
+
+	delay, ok = p.reserve(otherNet, now)
+	assert.True(t, ok)
+	assert.Zero(t, delay)
+
+	// The subnet is idle again.
+	delay, ok = p.reserve(addr, now.Add(time.Second))
+	assert.True(t, ok)
+	assert.Zero(t, delay)
+}
+
+func TestUDPPacer_wait(t *testing.T) {
+	t.Parallel()
+
+	addr := netip.MustParseAddr("2001:db8::1")
+
+	t.Run("nil", func(t *testing.T) {
+		t.Parallel()
+
+		var p *udpPacer
+		assert.True(t, p.wait(context.Background(), addr, time.Now()))
+	})
+
+	t.Run("canceled", func(t *testing.T) {
+		t.Parallel()
+
+		p := newUDPPacer(&UDPPacingConfig{Rate: 1, MaxDelay: time.Hour})
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		now := time.Now()
+		assert.True(t, p.wait(ctx, addr, now))
+		assert.False(t, p.wait(ctx, addr, now))
+	})
+}
@@ -0,0 +1,108 @@
+package proxy
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/syncutil"
+)
+
+// defaultUpstreamQueueTimeout is the default time a query waits for the
+// upstream limits, see [Config.UpstreamQueueTimeout].
+const defaultUpstreamQueueTimeout = 1 * time.Second
+
+// ErrUpstreamBusy is returned when a query can't be sent to an upstream since
+// the limit of simultaneous queries has been reached and no query has finished
+// in time.
+const ErrUpstreamBusy errors.Error = "too many simultaneous upstream queries"
+
+// upstreamLimiter limits the number of simultaneous queries to upstreams.
+type upstreamLimiter struct {
+	// global limits the total number of queries to all upstreams.  It's never
+	// nil.
+	global syncutil.Semaphore
+
+	// mu protects perUpstream.
+	mu *sync.Mutex
+
+	// perUpstream maps the upstream address to the semaphore limiting the
+	// queries to it.
+	perUpstream map[string]syncutil.Semaphore
+
+	// perUpstreamMax is the maximum number of simultaneous queries to a single
+	// upstream.  Zero means no limit.
+	perUpstreamMax uint
+
+	// timeout is the maximum time a query waits for both limits.
+	timeout time.Duration
+}
+
+// newUpstreamLimiter returns a new upstream limiter for the configuration or
+// nil, if no limits are configured.  c must not be nil.
+func newUpstreamLimiter(c *Config) (l *upstreamLimiter) {
+	if c.MaxUpstreamQueries == 0 && c.MaxQueriesPerUpstream == 0 {
+		return nil
+	}
+
+	var global syncutil.Semaphore = syncutil.EmptySemaphore{}
+	if c.MaxUpstreamQueries > 0 {
+		global = syncutil.NewChanSemaphore(c.MaxUpstreamQueries)
+	}
+
+	return &upstreamLimiter{
+		global:         global,
+		mu:             &sync.Mutex{},
+		perUpstream:    map[string]syncutil.Semaphore{},
+		perUpstreamMax: c.MaxQueriesPerUpstream,
+		timeout:        cmp.Or(c.UpstreamQueueTimeout, defaultUpstreamQueueTimeout),
+	}
+}
+
+// semaphoreFor returns the semaphore limiting the queries to the upstream with
+// the given address.
+func (l *upstreamLimiter) semaphoreFor(addr string) (sema syncutil.Semaphore) {
+	if l.perUpstreamMax == 0 {
+		return syncutil.EmptySemaphore{}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	sema, ok := l.perUpstream[addr]
+	if !ok {
+		sema = syncutil.NewChanSemaphore(l.perUpstreamMax)
+		l.perUpstream[addr] = sema
+	}
+
+	return sema
+}
+
+// acquire waits for both the global limit and the limit of the upstream with
+// the given address.  If err is nil, release must be called after the query is
+// finished.  Any returned error wraps [ErrUpstreamBusy].
+func (l *upstreamLimiter) acquire(addr string) (release func(), err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), l.timeout)
+	defer cancel()
+
+	sema := l.semaphoreFor(addr)
+	err = sema.Acquire(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("%w: upstream %s: %w", ErrUpstreamBusy, addr, err)
+	}
+
+	err = l.global.Acquire(ctx)
+	if err != nil {
+		sema.Release()
+
+		return nil, fmt.Errorf("%w: %w", ErrUpstreamBusy, err)
+	}
+
+	return func() {
+		l.global.Release()
+		sema.Release()
+	}, nil
+}
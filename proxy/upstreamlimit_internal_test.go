@@ -0,0 +1,103 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewUpstreamLimiter(t *testing.T) {
+	t.Parallel()
+
+	assert.Nil(t, newUpstreamLimiter(&Config{}))
+
+	l := newUpstreamLimiter(&Config{MaxUpstreamQueries: 1})
+	require.NotNil(t, l)
+
+	assert.Equal(t, defaultUpstreamQueueTimeout, l.timeout)
+}
+
+func TestUpstreamLimiter_acquire(t *testing.T) {
+	t.Parallel()
+
+	const (
+		addrFirst  = "udp://192.0.2.1:53"
+		addrSecond = "udp://192.0.2.2:53"
+
+		queueTimeout = 10 * time.Millisecond
+	)
+
+	t.Run("per_upstream", func(t *testing.T) {
+		t.Parallel()
+
+		l := newUpstreamLimiter(&Config{
+			MaxQueriesPerUpstream: 1,
+			UpstreamQueueTimeout:  queueTimeout,
+		})
+
+		release, err := l.acquire(addrFirst)
+		require.NoError(t, err)
+
+		_, err = l.acquire(addrFirst)
+		assert.ErrorIs(t, err, ErrUpstreamBusy)
+
+		releaseSecond, err := l.acquire(addrSecond)
+		require.NoError(t, err)
+
+		releaseSecond()
+		release()
+
+		release, err = l.acquire(addrFirst)
+		require.NoError(t, err)
+
+		release()
+	})
+
+	t.Run("global", func(t *testing.T) {
+		t.Parallel()
+
+		l := newUpstreamLimiter(&Config{
+			MaxUpstreamQueries:    1,
+			MaxQueriesPerUpstream: 2,
+			UpstreamQueueTimeout:  queueTimeout,
+		})
+
+		release, err := l.acquire(addrFirst)
+		require.NoError(t, err)
+
+		_, err = l.acquire(addrSecond)
+		assert.ErrorIs(t, err, ErrUpstreamBusy)
+
+		// The failed global acquisition must not hold the per-upstream slot.
+		_, err = l.acquire(addrFirst)
+		assert.ErrorIs(t, err, ErrUpstreamBusy)
+
+		release()
+
+		release, err = l.acquire(addrSecond)
+		require.NoError(t, err)
+
+		release()
+	})
+
+	t.Run("queue", func(t *testing.T) {
+		t.Parallel()
+
+		l := newUpstreamLimiter(&Config{
+			MaxUpstreamQueries:   1,
+			UpstreamQueueTimeout: time.Second,
+		})
+
+		release, err := l.acquire(addrFirst)
+		require.NoError(t, err)
+
+		time.AfterFunc(queueTimeout, release)
+
+		release, err = l.acquire(addrSecond)
+		require.NoError(t, err)
+
+		release()
+	})
+}
@@ -23,6 +23,20 @@ const (
 	// or AAAA requests only with the fastest IP address detected by ICMP
 	// response time or TCP connection time.
 	UpstreamModeFastestAddr UpstreamMode = "fastest_addr"
+
+	// UpstreamModeBestP95 makes server to send the queries to the upstream
+	// with the lowest 95th percentile of latency, trying the others in the
+	// order of their 95th percentiles on failure.  Unlike the mean latency
+	// used by [UpstreamModeLoadBalance], it isn't skewed by the many fast
+	// responses of the anycast providers hiding the slow ones.
+	UpstreamModeBestP95 UpstreamMode = "best_p95"
+
+	// UpstreamModeConsensus makes server to query several upstreams in
+	// parallel and only respond when enough of them agree on the answer, see
+	// [Config.ConsensusUpstreams] and [Config.ConsensusQuorum].  Otherwise, it
+	// responds with SERVFAIL and an Extended DNS Error.  It's intended for the
+	// users who don't trust any single resolver.
+	UpstreamModeConsensus UpstreamMode = "consensus"
 )
 
 // type check
@@ -35,15 +49,19 @@ func (m *UpstreamMode) UnmarshalText(b []byte) (err error) {
 	case
 		UpstreamModeLoadBalance,
 		UpstreamModeParallel,
-		UpstreamModeFastestAddr:
+		UpstreamModeFastestAddr,
+		UpstreamModeBestP95,
+		UpstreamModeConsensus:
 		*m = um
 	default:
 		return fmt.Errorf(
-			"invalid upstream mode %q, supported: %q, %q, %q",
+			"invalid upstream mode %q, supported: %q, %q, %q, %q, %q",
 			b,
 			UpstreamModeLoadBalance,
 			UpstreamModeParallel,
 			UpstreamModeFastestAddr,
+			UpstreamModeBestP95,
+			UpstreamModeConsensus,
 		)
 	}
 
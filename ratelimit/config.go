@@ -1,7 +1,9 @@
 package ratelimit
 
 import (
+	"fmt"
 	"log/slog"
+	"strings"
 
 	"github.com/AdguardTeam/golibs/errors"
 	"github.com/AdguardTeam/golibs/netutil"
@@ -17,6 +19,11 @@ type Config struct {
 	// AllowlistAddrs is a slice of IP addresses excluded from rate limiting.
 	AllowlistAddrs netutil.SliceSubnetSet
 
+	// AllowlistDomains is a slice of domain names, requests for which and for
+	// their subdomains are excluded from rate limiting and aren't counted.  All
+	// items must be valid domain names.
+	AllowlistDomains []string
+
 	// Ratelimit is a maximum number of requests per second from a given IP.  It
 	// must be positive.
 	Ratelimit uint
@@ -39,10 +46,19 @@ func (c *Config) Validate() (err error) {
 		return errors.ErrNoValue
 	}
 
-	return errors.Join(
+	errs := []error{
 		validate.Positive("Ratelimit", c.Ratelimit),
 		validate.NotNil("Logger", c.Logger),
 		validate.NoGreaterThan("SubnetLenIPv4", c.SubnetLenIPv4, netutil.IPv4BitLen),
 		validate.NoGreaterThan("SubnetLenIPv4", c.SubnetLenIPv6, netutil.IPv6BitLen),
-	)
+	}
+
+	for i, d := range c.AllowlistDomains {
+		err = netutil.ValidateDomainName(strings.TrimSuffix(d, "."))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("AllowlistDomains: at index %d: %w", i, err))
+		}
+	}
+
+	return errors.Join(errs...)
 }
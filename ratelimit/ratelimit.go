@@ -6,12 +6,15 @@ import (
 	"fmt"
 	"log/slog"
 	"net/netip"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/container"
 	"github.com/AdguardTeam/golibs/netutil"
 	rate "github.com/beefsack/go-rate"
+	"github.com/miekg/dns"
 	gocache "github.com/patrickmn/go-cache"
 )
 
@@ -23,25 +26,37 @@ type middleware struct {
 	// mu protects buckets.
 	mu *sync.Mutex
 
-	allowlistAddrs netutil.SliceSubnetSet
-	ratelimit      uint
-	subnetLenIPv4  uint
-	subnetLenIPv6  uint
+	allowlistAddrs   netutil.SliceSubnetSet
+	allowlistDomains *container.MapSet[string]
+	ratelimit        uint
+	subnetLenIPv4    uint
+	subnetLenIPv6    uint
 }
 
 // NewMiddleware returns middleware with rate limiting functionality.  c must be
 // valid.
 func NewMiddleware(c *Config) (m proxy.Middleware) {
+	domains := container.NewMapSet[string]()
+	for _, d := range c.AllowlistDomains {
+		domains.Add(normalizeDomain(d))
+	}
+
 	return &middleware{
-		logger:         c.Logger,
-		mu:             &sync.Mutex{},
-		allowlistAddrs: c.AllowlistAddrs,
-		ratelimit:      c.Ratelimit,
-		subnetLenIPv4:  c.SubnetLenIPv4,
-		subnetLenIPv6:  c.SubnetLenIPv6,
+		logger:           c.Logger,
+		mu:               &sync.Mutex{},
+		allowlistAddrs:   c.AllowlistAddrs,
+		allowlistDomains: domains,
+		ratelimit:        c.Ratelimit,
+		subnetLenIPv4:    c.SubnetLenIPv4,
+		subnetLenIPv6:    c.SubnetLenIPv6,
 	}
 }
 
+// normalizeDomain returns the lowercased domain name without the trailing dot.
+func normalizeDomain(name string) (norm string) {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
 // type check
 var _ proxy.Middleware = (*middleware)(nil)
 
@@ -50,8 +65,11 @@ var _ proxy.Middleware = (*middleware)(nil)
 // should be sent.
 func (m *middleware) Wrap(h proxy.Handler) (wrapped proxy.Handler) {
 	f := func(ctx context.Context, p *proxy.Proxy, dctx *proxy.DNSContext) (err error) {
-		if dctx.Proto == proxy.ProtoUDP && m.isRatelimited(dctx.Addr.Addr()) {
-			m.logger.Debug("ratelimited based on ip only", "addr", dctx.Addr)
+		if dctx.Proto == proxy.ProtoUDP &&
+			!m.isAllowlistedDomain(dctx.Req) &&
+			m.isRatelimited(dctx.Addr.Addr()) {
+			m.logger.Debug("ratelimited based on ip only", "raddr", dctx.Addr)
+			dctx.RejectReason = proxy.RejectReasonRatelimit
 
 			return proxy.ErrDrop
 		}
@@ -62,6 +80,24 @@ func (m *middleware) Wrap(h proxy.Handler) (wrapped proxy.Handler) {
 	return proxy.HandlerFunc(f)
 }
 
+// isAllowlistedDomain returns true if the question of req is an allowlisted
+// domain name or its subdomain.
+func (m *middleware) isAllowlistedDomain(req *dns.Msg) (ok bool) {
+	if m.allowlistDomains.Len() == 0 || req == nil || len(req.Question) == 0 {
+		return false
+	}
+
+	for name := normalizeDomain(req.Question[0].Name); name != ""; {
+		if m.allowlistDomains.Has(name) {
+			return true
+		}
+
+		_, name, _ = strings.Cut(name, ".")
+	}
+
+	return false
+}
+
 // limiterForIP returns a rate limiter for the specified IP address.
 func (m *middleware) limiterForIP(ip string) (rl any) {
 	m.mu.Lock()
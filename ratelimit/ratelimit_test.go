@@ -11,6 +11,7 @@ import (
 	"github.com/AdguardTeam/golibs/logutil/slogutil"
 	"github.com/AdguardTeam/golibs/netutil"
 	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -93,6 +94,10 @@ func TestMiddleware_Wrap(t *testing.T) {
 			assert.Equal(t, tc.wantErr, err)
 
 			assert.Equal(t, tc.want, called)
+
+			if tc.wantErr != nil {
+				assert.Equal(t, proxy.RejectReasonRatelimit, tc.dctx.RejectReason)
+			}
 		})
 	}
 }
@@ -163,6 +168,87 @@ func TestMiddleware_Wrap_allowlist(t *testing.T) {
 	})
 }
 
+func TestMiddleware_Wrap_allowlistDomains(t *testing.T) {
+	t.Parallel()
+
+	conf := &ratelimit.Config{
+		Logger:           testLogger,
+		Ratelimit:        1,
+		SubnetLenIPv4:    testSubnetLenIPv4,
+		SubnetLenIPv6:    testSubnetLenIPv6,
+		AllowlistDomains: []string{"pool.ntp.example", "Example.ORG."},
+	}
+	require.NoError(t, conf.Validate())
+
+	testCases := []struct {
+		name    string
+		qname   string
+		wantErr error
+	}{{
+		name:    "exact",
+		qname:   "pool.ntp.example.",
+		wantErr: nil,
+	}, {
+		name:    "subdomain",
+		qname:   "0.POOL.ntp.example.",
+		wantErr: nil,
+	}, {
+		name:    "case_insensitive",
+		qname:   "www.example.org.",
+		wantErr: nil,
+	}, {
+		name:    "parent",
+		qname:   "ntp.example.",
+		wantErr: proxy.ErrDrop,
+	}, {
+		name:    "not_allowlisted",
+		qname:   "example.com.",
+		wantErr: proxy.ErrDrop,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			mock := &TestHandler{
+				OnHandle: func(_ context.Context, _ *proxy.Proxy, _ *proxy.DNSContext) (err error) {
+					return nil
+				},
+			}
+			handler := ratelimit.NewMiddleware(conf).Wrap(mock)
+
+			req := &dns.Msg{}
+			req.SetQuestion(tc.qname, dns.TypeA)
+
+			dctx := &proxy.DNSContext{
+				Req:   req,
+				Addr:  netip.MustParseAddrPort("192.0.2.1:53"),
+				Proto: proxy.ProtoUDP,
+			}
+
+			ctx := testutil.ContextWithTimeout(t, defaultTimeout)
+
+			err := handler.ServeDNS(ctx, nil, dctx)
+			require.NoError(t, err, "first request should not be ratelimited")
+
+			err = handler.ServeDNS(ctx, nil, dctx)
+			assert.Equal(t, tc.wantErr, err)
+		})
+	}
+
+	t.Run("invalid", func(t *testing.T) {
+		t.Parallel()
+
+		invalid := &ratelimit.Config{
+			Logger:           testLogger,
+			Ratelimit:        1,
+			AllowlistDomains: []string{"bad domain"},
+		}
+
+		assert.ErrorContains(t, invalid.Validate(), "AllowlistDomains: at index 0")
+	})
+}
+
 // TestHandler is a mock request middleware implementation to simplify testing.
 //
 // TODO(d.kolyshev):  Move to internal/dnsproxytest.
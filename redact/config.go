@@ -0,0 +1,141 @@
+package redact
+
+import (
+	"encoding"
+	"fmt"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/AdguardTeam/golibs/validate"
+)
+
+// QNameMode defines how the queried domain names appear in the logs.
+type QNameMode string
+
+const (
+	// QNameModeFull logs the domain names as is.
+	QNameModeFull QNameMode = "full"
+
+	// QNameModeHash replaces the domain names with their keyed hashes, so that
+	// the queries for the same name could still be correlated, see
+	// [Config.HashKey].
+	QNameModeHash QNameMode = "hash"
+
+	// QNameModeNone removes the domain names from the logs.
+	QNameModeNone QNameMode = "none"
+)
+
+// type check
+var _ encoding.TextUnmarshaler = (*QNameMode)(nil)
+
+// UnmarshalText implements the [encoding.TextUnmarshaler] interface for
+// *QNameMode.
+func (m *QNameMode) UnmarshalText(b []byte) (err error) {
+	switch qm := QNameMode(b); qm {
+	case QNameModeFull, QNameModeHash, QNameModeNone:
+		*m = qm
+	default:
+		return fmt.Errorf(
+			"invalid qname mode %q, supported: %q, %q, %q",
+			b,
+			QNameModeFull,
+			QNameModeHash,
+			QNameModeNone,
+		)
+	}
+
+	return nil
+}
+
+// ClientIPMode defines how the client addresses appear in the logs.
+type ClientIPMode string
+
+const (
+	// ClientIPModeFull logs the client addresses as is.
+	ClientIPModeFull ClientIPMode = "full"
+
+	// ClientIPModeTruncate replaces the client addresses with the subnets
+	// those belong to, see [Config.SubnetLenIPv4] and [Config.SubnetLenIPv6].
+	ClientIPModeTruncate ClientIPMode = "truncate"
+
+	// ClientIPModeNone removes the client addresses from the logs.
+	ClientIPModeNone ClientIPMode = "none"
+)
+
+// type check
+var _ encoding.TextUnmarshaler = (*ClientIPMode)(nil)
+
+// UnmarshalText implements the [encoding.TextUnmarshaler] interface for
+// *ClientIPMode.
+func (m *ClientIPMode) UnmarshalText(b []byte) (err error) {
+	switch cm := ClientIPMode(b); cm {
+	case ClientIPModeFull, ClientIPModeTruncate, ClientIPModeNone:
+		*m = cm
+	default:
+		return fmt.Errorf(
+			"invalid client ip mode %q, supported: %q, %q, %q",
+			b,
+			ClientIPModeFull,
+			ClientIPModeTruncate,
+			ClientIPModeNone,
+		)
+	}
+
+	return nil
+}
+
+// Config is the configuration for the redacting [Handler].
+type Config struct {
+	// HashKey is the HMAC key the domain names are hashed with in
+	// [QNameModeHash].  If empty, a random key is generated, so the hashes
+	// can only be correlated within the logs of a single handler.
+	HashKey []byte
+
+	// QNameMode defines how the queried domain names are logged.  It must be
+	// one of the QNameMode constants.
+	QNameMode QNameMode
+
+	// ClientIPMode defines how the client addresses are logged.  It must be
+	// one of the ClientIPMode constants.
+	ClientIPMode ClientIPMode
+
+	// SubnetLenIPv4 is the length of the subnet IPv4 client addresses are
+	// truncated to with [ClientIPModeTruncate], for example 24.
+	SubnetLenIPv4 uint
+
+	// SubnetLenIPv6 is the length of the subnet IPv6 client addresses are
+	// truncated to with [ClientIPModeTruncate], for example 56.
+	SubnetLenIPv6 uint
+}
+
+// type check
+var _ validate.Interface = (*Config)(nil)
+
+// Validate implements the [validate.Interface] interface for *Config.
+func (c *Config) Validate() (err error) {
+	if c == nil {
+		return errors.ErrNoValue
+	}
+
+	var errs []error
+
+	var qm QNameMode
+	err = qm.UnmarshalText([]byte(c.QNameMode))
+	if err != nil {
+		errs = append(errs, fmt.Errorf("QNameMode: %w", err))
+	}
+
+	var cm ClientIPMode
+	err = cm.UnmarshalText([]byte(c.ClientIPMode))
+	if err != nil {
+		errs = append(errs, fmt.Errorf("ClientIPMode: %w", err))
+	}
+
+	errs = append(
+		errs,
+		validate.NoGreaterThan("SubnetLenIPv4", c.SubnetLenIPv4, netutil.IPv4BitLen),
+		validate.NoGreaterThan("SubnetLenIPv6", c.SubnetLenIPv6, netutil.IPv6BitLen),
+	)
+
+	return errors.Join(errs...)
+}
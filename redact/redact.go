@@ -0,0 +1,297 @@
+// Package redact provides a [slog.Handler] that hides the privacy-sensitive
+// data, such as the queried domain names and the client addresses, from logs.
+package redact
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"log/slog"
+	"net/netip"
+	"slices"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// KeyQName is the logging attribute key for the queried domain names.
+	KeyQName = "qname"
+
+	// KeyClientAddr is the logging attribute key for the client addresses.
+	KeyClientAddr = "raddr"
+)
+
+// qnameKeys are the keys of the attributes containing the domain names that
+// are handled according to [Config.QNameMode].
+var qnameKeys = []string{KeyQName, "host", "name"}
+
+// subnetKeys are the keys of the attributes containing the EDNS Client Subnet
+// data, which is handled according to [Config.ClientIPMode].
+var subnetKeys = []string{"ecs", "req_ecs", "subnet"}
+
+// hashKeyLen is the length of the HMAC key generated when [Config.HashKey] is
+// empty.
+const hashKeyLen = 32
+
+// keyLine is the key of the attribute containing a single line of a DNS message
+// dump, see [slogutil.PrintLines].
+const keyLine = "line"
+
+// Handler is a [slog.Handler] that redacts the domain names and the client
+// addresses in the records before passing those to the underlying handler.
+// The records with the lines of DNS message dumps are dropped entirely unless
+// both the names and the addresses are logged in full, since those can't be
+// redacted reliably.
+type Handler struct {
+	handler       slog.Handler
+	hashKey       []byte
+	qnameMode     QNameMode
+	clientIPMode  ClientIPMode
+	subnetLenIPv4 int
+	subnetLenIPv6 int
+}
+
+// NewHandler returns a new properly initialized *Handler wrapping h.  c must be
+// valid.
+func NewHandler(h slog.Handler, c *Config) (rh *Handler) {
+	hashKey := c.HashKey
+	if len(hashKey) == 0 {
+		hashKey = make([]byte, hashKeyLen)
+
+		// Don't check the error since [rand.Read] never returns one.
+		_, _ = rand.Read(hashKey)
+	}
+
+	return &Handler{
+		handler:       h,
+		hashKey:       hashKey,
+		qnameMode:     c.QNameMode,
+		clientIPMode:  c.ClientIPMode,
+		subnetLenIPv4: int(c.SubnetLenIPv4),
+		subnetLenIPv6: int(c.SubnetLenIPv6),
+	}
+}
+
+// type check
+var _ slog.Handler = (*Handler)(nil)
+
+// Enabled implements the [slog.Handler] interface for *Handler.
+func (h *Handler) Enabled(ctx context.Context, lvl slog.Level) (ok bool) {
+	return h.handler.Enabled(ctx, lvl)
+}
+
+// Handle implements the [slog.Handler] interface for *Handler.
+func (h *Handler) Handle(ctx context.Context, r slog.Record) (err error) {
+	redacted := slog.NewRecord(r.Time, r.Level, r.Message, r.PC)
+
+	isDump := false
+	r.Attrs(func(a slog.Attr) (cont bool) {
+		if a.Key == keyLine && !h.isFull() {
+			isDump = true
+
+			return false
+		}
+
+		a, ok := h.redact(a)
+		if ok {
+			redacted.AddAttrs(a)
+		}
+
+		return true
+	})
+
+	if isDump {
+		return nil
+	}
+
+	return h.handler.Handle(ctx, redacted)
+}
+
+// WithAttrs implements the [slog.Handler] interface for *Handler.
+func (h *Handler) WithAttrs(attrs []slog.Attr) (res slog.Handler) {
+	redacted := make([]slog.Attr, 0, len(attrs))
+	for _, a := range attrs {
+		a, ok := h.redact(a)
+		if ok {
+			redacted = append(redacted, a)
+		}
+	}
+
+	clone := *h
+	clone.handler = h.handler.WithAttrs(redacted)
+
+	return &clone
+}
+
+// WithGroup implements the [slog.Handler] interface for *Handler.
+func (h *Handler) WithGroup(name string) (res slog.Handler) {
+	clone := *h
+	clone.handler = h.handler.WithGroup(name)
+
+	return &clone
+}
+
+// isFull returns true if h doesn't redact anything.
+func (h *Handler) isFull() (ok bool) {
+	return h.qnameMode == QNameModeFull && h.clientIPMode == ClientIPModeFull
+}
+
+// redact returns the redacted version of a.  ok is false if a should be
+// removed.
+func (h *Handler) redact(a slog.Attr) (redacted slog.Attr, ok bool) {
+	switch {
+	case slices.Contains(qnameKeys, a.Key):
+		return h.redactQName(a)
+	case a.Key == KeyClientAddr:
+		return h.redactClientAddr(a)
+	case slices.Contains(subnetKeys, a.Key):
+		return h.redactSubnet(a)
+	case isQuestion(a.Value):
+		return h.redactQuestion(a)
+	case a.Value.Kind() == slog.KindGroup:
+		group := a.Value.Group()
+		attrs := make([]any, 0, len(group))
+		for _, ga := range group {
+			if ga, ok = h.redact(ga); ok {
+				attrs = append(attrs, ga)
+			}
+		}
+
+		return slog.Group(a.Key, attrs...), true
+	default:
+		return a, true
+	}
+}
+
+// redactQName returns the redacted version of a containing a domain name.
+func (h *Handler) redactQName(a slog.Attr) (redacted slog.Attr, ok bool) {
+	switch h.qnameMode {
+	case QNameModeHash:
+		mac := hmac.New(sha256.New, h.hashKey)
+
+		// Don't check the error since [hash.Hash.Write] never returns one.
+		_, _ = mac.Write([]byte(strings.ToLower(a.Value.Resolve().String())))
+
+		return slog.String(a.Key, hex.EncodeToString(mac.Sum(nil)[:8])), true
+	case QNameModeNone:
+		return slog.Attr{}, false
+	default:
+		return a, true
+	}
+}
+
+// isQuestion returns true if v contains a [dns.Question] or a *dns.Question.
+func isQuestion(v slog.Value) (ok bool) {
+	if v.Kind() != slog.KindAny {
+		return false
+	}
+
+	switch v.Any().(type) {
+	case dns.Question, *dns.Question:
+		return true
+	default:
+		return false
+	}
+}
+
+// redactQuestion returns the redacted version of a containing a DNS question.
+// Unless the names are logged in full, the question is replaced with a group of
+// its name, type, and class, the name being redacted as the one under
+// [KeyQName].
+func (h *Handler) redactQuestion(a slog.Attr) (redacted slog.Attr, ok bool) {
+	if h.qnameMode == QNameModeFull {
+		return a, true
+	}
+
+	var q dns.Question
+	switch v := a.Value.Any().(type) {
+	case dns.Question:
+		q = v
+	case *dns.Question:
+		if v == nil {
+			return a, true
+		}
+
+		q = *v
+	}
+
+	attrs := make([]any, 0, 3)
+	if name, nameOK := h.redactQName(slog.String(KeyQName, q.Name)); nameOK {
+		attrs = append(attrs, name)
+	}
+
+	attrs = append(
+		attrs,
+		slog.String("qtype", dns.Type(q.Qtype).String()),
+		slog.String("qclass", dns.Class(q.Qclass).String()),
+	)
+
+	return slog.Group(a.Key, attrs...), true
+}
+
+// redactClientAddr returns the redacted version of a containing a client
+// address.
+func (h *Handler) redactClientAddr(a slog.Attr) (redacted slog.Attr, ok bool) {
+	switch h.clientIPMode {
+	case ClientIPModeTruncate:
+		ip, parsed := parseIP(a.Value.Resolve().String())
+		if !parsed {
+			return slog.Attr{}, false
+		}
+
+		bits := h.subnetLenIPv6
+		if ip.Is4() {
+			bits = h.subnetLenIPv4
+		}
+
+		return slog.String(a.Key, netip.PrefixFrom(ip, bits).Masked().String()), true
+	case ClientIPModeNone:
+		return slog.Attr{}, false
+	default:
+		return a, true
+	}
+}
+
+// redactSubnet returns the redacted version of a containing an EDNS Client
+// Subnet.  The subnet is truncated the same way as the client addresses, unless
+// it's already shorter.
+func (h *Handler) redactSubnet(a slog.Attr) (redacted slog.Attr, ok bool) {
+	switch h.clientIPMode {
+	case ClientIPModeTruncate:
+		pref, err := netip.ParsePrefix(a.Value.Resolve().String())
+		if err != nil {
+			return slog.Attr{}, false
+		}
+
+		ip := pref.Addr().Unmap()
+		bits := h.subnetLenIPv6
+		if ip.Is4() {
+			bits = h.subnetLenIPv4
+		}
+
+		pref = netip.PrefixFrom(ip, min(pref.Bits(), bits)).Masked()
+
+		return slog.String(a.Key, pref.String()), true
+	case ClientIPModeNone:
+		return slog.Attr{}, false
+	default:
+		return a, true
+	}
+}
+
+// parseIP parses the IP address from s, which is either an IP address or an
+// IP address with port.
+func parseIP(s string) (ip netip.Addr, ok bool) {
+	if ipp, err := netip.ParseAddrPort(s); err == nil {
+		return ipp.Addr().Unmap(), true
+	}
+
+	if ip, err := netip.ParseAddr(s); err == nil {
+		return ip.Unmap(), true
+	}
+
+	return netip.Addr{}, false
+}
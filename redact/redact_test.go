@@ -0,0 +1,324 @@
+package redact_test
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/internal/dnsproxytest"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/redact"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testHashKey is the HMAC key for the tests hashing the domain names.
+var testHashKey = []byte("test-key")
+
+// newTestLogger returns a logger writing to buf through the redacting handler
+// with the given configuration.
+func newTestLogger(tb testing.TB, buf *bytes.Buffer, c *redact.Config) (l *slog.Logger) {
+	tb.Helper()
+
+	require.NoError(tb, c.Validate())
+
+	h := slog.NewTextHandler(buf, &slog.HandlerOptions{
+		ReplaceAttr: func(_ []string, a slog.Attr) (res slog.Attr) {
+			if a.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+
+			return a
+		},
+	})
+
+	return slog.New(redact.NewHandler(h, c))
+}
+
+func TestHandler(t *testing.T) {
+	t.Parallel()
+
+	const (
+		qname = "www.example.com."
+		msg   = "handling"
+	)
+
+	raddr4 := netip.MustParseAddrPort("192.0.2.123:53")
+	raddr6 := netip.MustParseAddrPort("[2001:db8:1:2:3::4]:53")
+
+	testCases := []struct {
+		conf *redact.Config
+		name string
+		want string
+	}{{
+		conf: &redact.Config{
+			QNameMode:    redact.QNameModeFull,
+			ClientIPMode: redact.ClientIPModeFull,
+		},
+		name: "full",
+		want: `level=INFO msg=handling qname=www.example.com. ` +
+			`raddr=192.0.2.123:53 raddr=[2001:db8:1:2:3::4]:53` + "\n",
+	}, {
+		conf: &redact.Config{
+			HashKey:       testHashKey,
+			QNameMode:     redact.QNameModeHash,
+			ClientIPMode:  redact.ClientIPModeTruncate,
+			SubnetLenIPv4: 24,
+			SubnetLenIPv6: 56,
+		},
+		name: "hash_truncate",
+		want: `level=INFO msg=handling qname=a0db0e1f586fa1b0 ` +
+			`raddr=192.0.2.0/24 raddr=2001:db8:1::/56` + "\n",
+	}, {
+		conf: &redact.Config{
+			QNameMode:    redact.QNameModeNone,
+			ClientIPMode: redact.ClientIPModeNone,
+		},
+		name: "none",
+		want: "level=INFO msg=handling\n",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			buf := &bytes.Buffer{}
+			l := newTestLogger(t, buf, tc.conf)
+
+			l.Info(
+				msg,
+				redact.KeyQName, qname,
+				redact.KeyClientAddr, raddr4,
+				redact.KeyClientAddr, raddr6,
+			)
+
+			assert.Equal(t, tc.want, buf.String())
+		})
+	}
+}
+
+func TestHandler_randomHashKey(t *testing.T) {
+	t.Parallel()
+
+	conf := &redact.Config{
+		QNameMode:    redact.QNameModeHash,
+		ClientIPMode: redact.ClientIPModeFull,
+	}
+
+	buf1, buf2 := &bytes.Buffer{}, &bytes.Buffer{}
+	l1, l2 := newTestLogger(t, buf1, conf), newTestLogger(t, buf2, conf)
+
+	for range 2 {
+		l1.Info("handling", redact.KeyQName, "www.example.com.")
+		l2.Info("handling", redact.KeyQName, "www.example.com.")
+	}
+
+	lines1, lines2 := strings.Split(buf1.String(), "\n"), strings.Split(buf2.String(), "\n")
+
+	// The names are correlated within a single handler only.
+	assert.Equal(t, lines1[0], lines1[1])
+	assert.Equal(t, lines2[0], lines2[1])
+	assert.NotEqual(t, lines1[0], lines2[0])
+	assert.NotContains(t, buf1.String(), "www.example.com.")
+}
+
+func TestHandler_subnet(t *testing.T) {
+	t.Parallel()
+
+	ecs4 := &net.IPNet{IP: net.IP{192, 0, 2, 123}, Mask: net.CIDRMask(32, 32)}
+	ecs6 := &net.IPNet{IP: net.ParseIP("2001:db8:1:2::"), Mask: net.CIDRMask(48, 128)}
+
+	testCases := []struct {
+		conf *redact.Config
+		name string
+		want string
+	}{{
+		conf: &redact.Config{
+			QNameMode:    redact.QNameModeFull,
+			ClientIPMode: redact.ClientIPModeFull,
+		},
+		name: "full",
+		want: "level=INFO msg=caching ecs=192.0.2.123/32 subnet=2001:db8:1:2::/48 " +
+			"scope=24\n",
+	}, {
+		conf: &redact.Config{
+			QNameMode:     redact.QNameModeFull,
+			ClientIPMode:  redact.ClientIPModeTruncate,
+			SubnetLenIPv4: 24,
+			SubnetLenIPv6: 56,
+		},
+		name: "truncate",
+		want: "level=INFO msg=caching ecs=192.0.2.0/24 subnet=2001:db8:1::/48 " +
+			"scope=24\n",
+	}, {
+		conf: &redact.Config{
+			QNameMode:    redact.QNameModeFull,
+			ClientIPMode: redact.ClientIPModeNone,
+		},
+		name: "none",
+		want: "level=INFO msg=caching scope=24\n",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			buf := &bytes.Buffer{}
+			l := newTestLogger(t, buf, tc.conf)
+
+			l.Info("caching", "ecs", ecs4, "subnet", ecs6, "scope", 24)
+
+			assert.Equal(t, tc.want, buf.String())
+		})
+	}
+}
+
+func TestHandler_dump(t *testing.T) {
+	t.Parallel()
+
+	full := &redact.Config{
+		QNameMode:    redact.QNameModeFull,
+		ClientIPMode: redact.ClientIPModeFull,
+	}
+
+	buf := &bytes.Buffer{}
+	l := newTestLogger(t, buf, full)
+
+	slogutil.PrintLines(context.Background(), l, slog.LevelInfo, "in", "line1\nline2")
+	assert.NotEmpty(t, buf.String())
+
+	buf.Reset()
+	l = newTestLogger(t, buf, &redact.Config{
+		QNameMode:    redact.QNameModeHash,
+		ClientIPMode: redact.ClientIPModeFull,
+	})
+
+	slogutil.PrintLines(context.Background(), l, slog.LevelInfo, "in", "line1\nline2")
+	assert.Empty(t, buf.String())
+}
+
+func TestHandler_question(t *testing.T) {
+	t.Parallel()
+
+	q := dns.Question{
+		Name:   "www.example.com.",
+		Qtype:  dns.TypeA,
+		Qclass: dns.ClassINET,
+	}
+
+	testCases := []struct {
+		conf *redact.Config
+		name string
+		want string
+	}{{
+		conf: &redact.Config{
+			QNameMode:    redact.QNameModeFull,
+			ClientIPMode: redact.ClientIPModeFull,
+		},
+		name: "full",
+		want: "level=INFO msg=handling " +
+			"question=\"{Name:www.example.com. Qtype:1 Qclass:1}\" " +
+			"question=\";www.example.com.\\tIN\\t A\"\n",
+	}, {
+		conf: &redact.Config{
+			HashKey:      testHashKey,
+			QNameMode:    redact.QNameModeHash,
+			ClientIPMode: redact.ClientIPModeFull,
+		},
+		name: "hash",
+		want: "level=INFO msg=handling question.qname=a0db0e1f586fa1b0 " +
+			"question.qtype=A question.qclass=IN question.qname=a0db0e1f586fa1b0 " +
+			"question.qtype=A question.qclass=IN\n",
+	}, {
+		conf: &redact.Config{
+			QNameMode:    redact.QNameModeNone,
+			ClientIPMode: redact.ClientIPModeFull,
+		},
+		name: "none",
+		want: "level=INFO msg=handling question.qtype=A question.qclass=IN " +
+			"question.qtype=A question.qclass=IN\n",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			buf := &bytes.Buffer{}
+			l := newTestLogger(t, buf, tc.conf)
+
+			l.Info("handling", "question", q, "question", &q)
+
+			assert.Equal(t, tc.want, buf.String())
+		})
+	}
+}
+
+func TestHandler_proxy(t *testing.T) {
+	t.Parallel()
+
+	const qname = "secret.example."
+
+	buf := &bytes.Buffer{}
+	h := slog.NewTextHandler(buf, &slog.HandlerOptions{
+		Level: slog.LevelDebug,
+	})
+
+	ups := &dnsproxytest.Upstream{
+		OnExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+			return (&dns.Msg{}).SetReply(req), nil
+		},
+		OnAddress: func() (addr string) { return "upstream" },
+		OnClose:   func() (err error) { return nil },
+	}
+
+	p, err := proxy.New(&proxy.Config{
+		Logger: slog.New(redact.NewHandler(h, &redact.Config{
+			QNameMode:    redact.QNameModeHash,
+			ClientIPMode: redact.ClientIPModeTruncate,
+		})),
+		UpstreamConfig: &proxy.UpstreamConfig{
+			Upstreams: []upstream.Upstream{ups},
+		},
+		TrustedProxies: netutil.SliceSubnetSet{netip.MustParsePrefix("0.0.0.0/0")},
+	})
+	require.NoError(t, err)
+
+	d := &proxy.DNSContext{
+		Req: (&dns.Msg{}).SetQuestion(qname, dns.TypeA),
+	}
+
+	err = p.Resolve(testutil.ContextWithTimeout(t, time.Second), d)
+	require.NoError(t, err)
+
+	logs := buf.String()
+	require.Contains(t, logs, "exchange successfully finished")
+
+	assert.Contains(t, logs, "question.qtype=A")
+	assert.NotContains(t, logs, qname)
+}
+
+func TestConfig_Validate(t *testing.T) {
+	t.Parallel()
+
+	c := &redact.Config{
+		QNameMode:     "bad",
+		ClientIPMode:  redact.ClientIPModeTruncate,
+		SubnetLenIPv4: 33,
+	}
+
+	err := c.Validate()
+	require.Error(t, err)
+
+	assert.ErrorContains(t, err, `invalid qname mode "bad"`)
+	assert.ErrorContains(t, err, "SubnetLenIPv4")
+}
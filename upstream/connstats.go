@@ -0,0 +1,144 @@
+package upstream
+
+import (
+	"crypto/tls"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// ConnStats are the statistics of the connection of an upstream to its server.
+type ConnStats struct {
+	// Established is the time when the latest connection has been established.
+	// It's zero if there has been no connection yet.
+	Established time.Time
+
+	// LastError is the error of the latest failed exchange, if any.
+	LastError error
+
+	// Protocol is the protocol negotiated for the latest connection, e.g.
+	// "TLS 1.3", "h2", "h3", or "QUIC v1".
+	Protocol string
+
+	// Exchanges is the number of exchanges served by the upstream, including
+	// the failed ones.
+	Exchanges uint64
+
+	// TCPFallbacks is the number of exchanges retried over TCP, since the
+	// response received over UDP was truncated or malformed.  It's only
+	// counted by the plain DNS and DNSCrypt upstreams.
+	TCPFallbacks uint64
+
+	// QuestionMismatches is the number of responses with the question section
+	// not exactly matching the one of the query, including the case of the
+	// name, see [Options.QuestionMismatch].
+	QuestionMismatches uint64
+
+	// Resumed is true if the TLS session of the latest connection has been
+	// resumed.
+	Resumed bool
+}
+
+// ConnStatsReporter is an [Upstream] that reports the statistics of its
+// connection.  The upstreams for plain DNS, DNSCrypt, DNS-over-TLS,
+// DNS-over-HTTPS, and DNS-over-QUIC implement it.
+type ConnStatsReporter interface {
+	Upstream
+
+	// ConnStats returns the current statistics of the upstream connection.  s
+	// must not be nil and must not be modified by the caller.
+	ConnStats() (s *ConnStats)
+}
+
+// connStats is the concurrency-safe storage of [ConnStats].
+type connStats struct {
+	// mu protects stats.
+	mu    *sync.Mutex
+	stats ConnStats
+}
+
+// newConnStats returns a new properly initialized *connStats.
+func newConnStats() (s *connStats) {
+	return &connStats{
+		mu: &sync.Mutex{},
+	}
+}
+
+// connected records the establishment of a new connection with the given
+// protocol.
+func (s *connStats) connected(proto string, resumed bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.stats.Established = time.Now()
+	s.stats.Protocol = proto
+	s.stats.Resumed = resumed
+}
+
+// connectedTLS records the establishment of a new TLS connection with the
+// given state.  If proto is empty, the TLS version is used.
+func (s *connStats) connectedTLS(proto string, state tls.ConnectionState) {
+	if proto == "" {
+		proto = tls.VersionName(state.Version)
+	}
+
+	s.connected(proto, state.DidResume)
+}
+
+// connectedQUIC waits for the handshake of conn to complete and records the
+// establishment of it.  If proto is empty, the QUIC version is used.  It
+// returns early if conn is closed before the handshake completes.
+func (s *connStats) connectedQUIC(conn *quic.Conn, proto string) {
+	select {
+	case <-conn.HandshakeComplete():
+		// Go on.
+	case <-conn.Context().Done():
+		return
+	}
+
+	state := conn.ConnectionState()
+	if proto == "" {
+		proto = "QUIC " + state.Version.String()
+	}
+
+	s.connected(proto, state.TLS.DidResume)
+}
+
+// fellBackToTCP records the retry of an exchange over TCP.
+func (s *connStats) fellBackToTCP() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.stats.TCPFallbacks++
+}
+
+// mismatchedQuestion records the response with a mismatched question.
+func (s *connStats) mismatchedQuestion() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.stats.QuestionMismatches++
+}
+
+// exchanged records the exchange with the given result.
+func (s *connStats) exchanged(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.stats.Exchanges++
+	if err != nil {
+		s.stats.LastError = err
+	}
+}
+
+// clone returns a copy of the current statistics.
+func (s *connStats) clone() (c *ConnStats) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c = &ConnStats{}
+	*c = s.stats
+
+	return c
+}
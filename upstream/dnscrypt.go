@@ -32,6 +32,13 @@ type dnsCrypt struct {
 	// logger is used for exchange logging.  It is never nil.
 	logger *slog.Logger
 
+	// stats are the statistics of the exchanges.  It is never nil.
+	stats *connStats
+
+	// questions handles the responses with mismatched questions.  It is never
+	// nil.
+	questions *questionChecker
+
 	// verifyCert is a callback that verifies the resolver's certificate.
 	verifyCert func(cert *dnscrypt.Certificate) (err error)
 
@@ -41,23 +48,32 @@ type dnsCrypt struct {
 
 // newDNSCrypt returns a new DNSCrypt Upstream.
 func newDNSCrypt(addr *url.URL, opts *Options) (u *dnsCrypt) {
+	stats := newConnStats()
+
 	return &dnsCrypt{
 		mu:         &sync.RWMutex{},
 		addr:       addr,
 		logger:     opts.Logger,
+		stats:      stats,
+		questions:  newQuestionChecker(opts, stats),
 		verifyCert: opts.VerifyDNSCryptCertificate,
 		timeout:    opts.Timeout,
 	}
 }
 
 // type check
-var _ Upstream = (*dnsCrypt)(nil)
+var _ ConnStatsReporter = (*dnsCrypt)(nil)
 
 // Address implements the [Upstream] interface for *dnsCrypt.
 func (p *dnsCrypt) Address() string { return p.addr.String() }
 
+// ConnStats implements the [ConnStatsReporter] interface for *dnsCrypt.
+func (p *dnsCrypt) ConnStats() (s *ConnStats) { return p.stats.clone() }
+
 // Exchange implements the [Upstream] interface for *dnsCrypt.
 func (p *dnsCrypt) Exchange(req *dns.Msg) (resp *dns.Msg, err error) {
+	defer func() { p.stats.exchanged(err) }()
+
 	ctx := context.Background()
 	if p.timeout > 0 {
 		var cancel context.CancelFunc
@@ -124,6 +140,7 @@ func (p *dnsCrypt) exchangeDNSCrypt(ctx context.Context, req *dns.Msg) (resp *dn
 			"addr", p.addr,
 			"question", q,
 		)
+		p.stats.fellBackToTCP()
 
 		tcpClient := dnscrypt.NewClient(&dnscrypt.ClientConfig{
 			Logger: p.logger,
@@ -132,11 +149,13 @@ func (p *dnsCrypt) exchangeDNSCrypt(ctx context.Context, req *dns.Msg) (resp *dn
 
 		resp, err = tcpClient.ExchangeContext(ctx, req, resolverInfo)
 	}
-	if err == nil && resp != nil && resp.Id != req.Id {
-		err = dns.ErrId
+	if err != nil || resp == nil {
+		return resp, err
+	} else if resp.Id != req.Id {
+		return resp, dns.ErrId
 	}
 
-	return resp, err
+	return resp, p.questions.check(req, resp)
 }
 
 // resetClient renews the DNSCrypt client and server properties and also sets
@@ -1,6 +1,7 @@
 package upstream
 
 import (
+	"cmp"
 	"context"
 	"crypto/tls"
 	"encoding/base64"
@@ -10,6 +11,7 @@ import (
 	"log/slog"
 	"net"
 	"net/http"
+	"net/http/httptrace"
 	"net/url"
 	"runtime"
 	"slices"
@@ -19,12 +21,10 @@ import (
 	"github.com/AdguardTeam/dnsproxy/internal/bootstrap"
 	"github.com/AdguardTeam/golibs/errors"
 	"github.com/AdguardTeam/golibs/httphdr"
-	"github.com/AdguardTeam/golibs/ioutil"
 	"github.com/AdguardTeam/golibs/logutil/slogutil"
 	"github.com/miekg/dns"
 	"github.com/quic-go/quic-go"
 	"github.com/quic-go/quic-go/http3"
-	"golang.org/x/net/http2"
 )
 
 // Values to configure HTTP and HTTP/2 transport.
@@ -71,6 +71,13 @@ type dnsOverHTTPS struct {
 	// logger is used for exchange logging.  It is never nil.
 	logger *slog.Logger
 
+	// stats are the statistics of the connections.  It is never nil.
+	stats *connStats
+
+	// questions handles the responses with mismatched questions.  It is never
+	// nil.
+	questions *questionChecker
+
 	// quicConf is the QUIC configuration that is used if HTTP/3 is enabled
 	// for this upstream.
 	quicConf *quic.Config
@@ -78,8 +85,51 @@ type dnsOverHTTPS struct {
 	// quicConfMu protects quicConf.
 	quicConfMu *sync.Mutex
 
+	// quicSocket is the configuration of the sockets of the HTTP/3
+	// connections.
+	quicSocket quicSocket
+
+	// packedQueries keeps the encoded forms of the identical queries.  It's
+	// nil if those aren't kept.
+	packedQueries *packedQueryCache[string]
+
 	// transportH2 is an HTTP/2 transport if any.
-	transportH2 *http2.Transport
+	transportH2 *h2Transport
+
+	// probeStorage persists the outcomes of the HTTP/3 probes.  It may be nil.
+	probeStorage HTTPProbeStorage
+
+	// probed is the HTTP version chosen by the last HTTP/3 probe, if any.  It's
+	// protected by clientMu.
+	probed HTTPVersion
+
+	// probedUntil is the time until which probed is used instead of probing
+	// the upstream again.  It's protected by clientMu.
+	probedUntil time.Time
+
+	// budgets are the error budgets of the HTTP versions used by the upstream.
+	// It's protected by clientMu.
+	budgets map[HTTPVersion]*errorBudget
+
+	// clientVersion is the HTTP version used by client.  It's protected by
+	// clientMu.
+	clientVersion HTTPVersion
+
+	// maxVersion is the highest HTTP version allowed after the downgrade.  If
+	// empty, the upstream isn't downgraded.  It's protected by clientMu.
+	maxVersion HTTPVersion
+
+	// downgradedUntil is the time until which the upstream keeps using
+	// maxVersion.  It's protected by clientMu.
+	downgradedUntil time.Time
+
+	// retryAfterErr is the error of the latest response which asked the
+	// upstream to wait before retrying.  It's protected by clientMu.
+	retryAfterErr *HTTPStatusError
+
+	// retryAfter is the time until which the exchanges fail with
+	// retryAfterErr right away.  It's protected by clientMu.
+	retryAfter time.Time
 
 	// addrRedacted is the redacted string representation of addr.  It is saved
 	// separately to reduce allocations during logging and error reporting.
@@ -87,10 +137,32 @@ type dnsOverHTTPS struct {
 
 	// timeout is used in HTTP client and for H3 probes.
 	timeout time.Duration
+
+	// probeTTL is the duration for which the outcome of the HTTP/3 probe is
+	// reused.  If zero, the outcomes aren't reused.
+	probeTTL time.Duration
+
+	// downgradePeriod is the time the upstream keeps using the lower HTTP
+	// version after the downgrade.
+	downgradePeriod time.Duration
+
+	// errBudget is the maximum share of failed exchanges using a single HTTP
+	// version.  If zero, the upstream is never downgraded.
+	errBudget float64
 }
 
 // newDoH returns the DNS-over-HTTPS Upstream.
 func newDoH(addr *url.URL, opts *Options) (u Upstream, err error) {
+	err = validateHTTPErrorBudget(opts.HTTPErrorBudget)
+	if err == nil {
+		err = validateQUIC(opts)
+	}
+
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return nil, err
+	}
+
 	addPort(addr, defaultPortDoH)
 
 	var httpVersions []HTTPVersion
@@ -101,20 +173,15 @@ func newDoH(addr *url.URL, opts *Options) (u Upstream, err error) {
 		httpVersions = DefaultHTTPVersions
 	}
 
-	quicConf := &quic.Config{
-		KeepAlivePeriod: QUICKeepAlivePeriod,
-		TokenStore:      newQUICTokenStore(),
-	}
-
-	if opts.QUICTracer != nil {
-		quicConf.Tracer = opts.QUICTracer.TraceForConnection
-	}
-
+	stats := newConnStats()
 	ups := &dnsOverHTTPS{
 		getDialer:  newDialerInitializer(addr, opts),
 		addr:       addr,
-		quicConf:   quicConf,
+		quicConf:   newQUICConfig(opts),
 		quicConfMu: &sync.Mutex{},
+		quicSocket: newQUICSocket(opts),
+
+		packedQueries: newPackedQueryCache[string](opts.PackedQueryTTL),
 		tlsConf: &tls.Config{
 			ServerName:   addr.Hostname(),
 			RootCAs:      opts.RootCAs,
@@ -132,37 +199,77 @@ func newDoH(addr *url.URL, opts *Options) (u Upstream, err error) {
 		},
 		clientMu:     &sync.Mutex{},
 		logger:       opts.Logger,
+		stats:        stats,
+		questions:    newQuestionChecker(opts, stats),
 		addrRedacted: addr.Redacted(),
 		timeout:      opts.Timeout,
+		probeStorage: opts.HTTPProbeStorage,
+		budgets:      map[HTTPVersion]*errorBudget{},
+		probeTTL:     opts.HTTPProbeCacheTTL,
+		downgradePeriod: cmp.Or(
+			opts.HTTPDowngradePeriod,
+			DefaultHTTPDowngradePeriod,
+		),
+		errBudget: opts.HTTPErrorBudget,
 	}
 	for _, v := range httpVersions {
 		ups.tlsConf.NextProtos = append(ups.tlsConf.NextProtos, string(v))
 	}
 
-	runtime.SetFinalizer(ups, (*dnsOverHTTPS).Close)
+	setCloseFinalizer(ups, opts)
 
 	return ups, nil
 }
 
+// validateHTTPErrorBudget returns an error if b isn't a valid value of
+// [Options.HTTPErrorBudget].
+func validateHTTPErrorBudget(b float64) (err error) {
+	if b < 0 || b > 1 {
+		return fmt.Errorf("http error budget: %w: %v", errors.ErrOutOfRange, b)
+	}
+
+	return nil
+}
+
 // type check
-var _ Upstream = (*dnsOverHTTPS)(nil)
+var _ ConnStatsReporter = (*dnsOverHTTPS)(nil)
 
 // Address implements the [Upstream] interface for *dnsOverHTTPS.  The address
 // is redacted: if the original URL of this upstream contains a userinfo with a
 // password, the password is replaced with "xxxxx".
 func (p *dnsOverHTTPS) Address() string { return p.addrRedacted }
 
+// ConnStats implements the [ConnStatsReporter] interface for *dnsOverHTTPS.
+func (p *dnsOverHTTPS) ConnStats() (s *ConnStats) { return p.stats.clone() }
+
 // Exchange implements the [Upstream] interface for *dnsOverHTTPS.
 func (p *dnsOverHTTPS) Exchange(req *dns.Msg) (resp *dns.Msg, err error) {
+	return p.ExchangeContext(context.Background(), req)
+}
+
+// type check
+var _ ContextExchanger = (*dnsOverHTTPS)(nil)
+
+// ExchangeContext implements the [ContextExchanger] interface for
+// *dnsOverHTTPS.
+func (p *dnsOverHTTPS) ExchangeContext(ctx context.Context, req *dns.Msg) (resp *dns.Msg, err error) {
+	defer func() { p.stats.exchanged(err) }()
+
+	err = p.checkRetryAfter(time.Now())
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return nil, err
+	}
+
 	// Check if there was already an active client before sending the request.
 	// We'll only attempt to re-connect if there was one.
-	client, isCached, err := p.getClient()
+	client, isCached, err := p.getClient(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("failed to init http client: %w", err)
 	}
 
 	// Make the first attempt to send the DNS query.
-	resp, err = p.exchangeHTTPS(client, req)
+	resp, err = p.exchangeHTTPS(ctx, client, req)
 
 	// Make up to 2 attempts to re-create the HTTP client and send the request
 	// again.  There are several cases (mostly, with QUIC) where this workaround
@@ -170,17 +277,28 @@ func (p *dnsOverHTTPS) Exchange(req *dns.Msg) (resp *dns.Msg, err error) {
 	// the case when the connection was closed (due to inactivity for example)
 	// AND the server refuses to open a 0-RTT connection.
 	for i := 0; isCached && p.shouldRetry(err) && i < 2; i++ {
-		client, err = p.resetClient(err)
+		client, err = p.resetClient(ctx, err)
 		if err != nil {
 			return nil, fmt.Errorf("failed to reset http client: %w", err)
 		}
 
-		resp, err = p.exchangeHTTPS(client, req)
+		resp, err = p.exchangeHTTPS(ctx, client, req)
 	}
 
+	if isHTTPLevelErr(err) {
+		// The server has responded properly, so there is no need to re-create
+		// the client or to account the failure of the HTTP version.
+		p.recordResult(client, nil)
+		p.setRetryAfter(err, time.Now())
+
+		return nil, err
+	}
+
+	p.recordResult(client, err)
+
 	if err != nil {
 		// If the request failed anyway, make sure we don't use this client.
-		_, resErr := p.resetClient(err)
+		_, resErr := p.resetClient(ctx, err)
 
 		return nil, errors.WithDeferred(err, resErr)
 	}
@@ -209,7 +327,7 @@ func (p *dnsOverHTTPS) closeClient(client *http.Client) (err error) {
 	if isHTTP3(client) {
 		return client.Transport.(io.Closer).Close()
 	} else if p.transportH2 != nil {
-		p.transportH2.CloseIdleConnections()
+		return p.transportH2.Close()
 	}
 
 	return nil
@@ -217,7 +335,11 @@ func (p *dnsOverHTTPS) closeClient(client *http.Client) (err error) {
 
 // exchangeHTTPS logs the request and its result and calls exchangeHTTPSClient.
 // client and req must not be nil.
-func (p *dnsOverHTTPS) exchangeHTTPS(client *http.Client, req *dns.Msg) (resp *dns.Msg, err error) {
+func (p *dnsOverHTTPS) exchangeHTTPS(
+	ctx context.Context,
+	client *http.Client,
+	req *dns.Msg,
+) (resp *dns.Msg, err error) {
 	n := networkTCP
 	if isHTTP3(client) {
 		n = networkUDP
@@ -226,19 +348,12 @@ func (p *dnsOverHTTPS) exchangeHTTPS(client *http.Client, req *dns.Msg) (resp *d
 	logBegin(p.logger, p.addrRedacted, n, req)
 	defer func() { logFinish(p.logger, p.addrRedacted, n, err) }()
 
-	buf, err := req.Pack()
+	query, err := p.packedQueries.pack(req, time.Now(), packDoHQuery)
 	if err != nil {
 		return nil, fmt.Errorf("packing message: %w", err)
 	}
 
-	// In order to maximize HTTP cache friendliness, DoH clients using media
-	// formats that include the ID field from the DNS message header, such as
-	// "application/dns-message", SHOULD use a DNS ID of 0 in every DNS request.
-	//
-	// See https://www.rfc-editor.org/rfc/rfc8484.html.
-	binary.BigEndian.PutUint16(buf, 0)
-
-	resp, err = p.exchangeHTTPSClient(client, buf)
+	resp, err = p.exchangeHTTPSClient(ctx, client, query)
 	if err != nil {
 		return nil, fmt.Errorf("exchanging: %w", err)
 	}
@@ -252,7 +367,7 @@ func (p *dnsOverHTTPS) exchangeHTTPS(client *http.Client, req *dns.Msg) (resp *d
 	// See https://www.rfc-editor.org/rfc/rfc8484.html.
 	resp.Id = req.Id
 
-	err = validateResponse(req, resp)
+	err = p.questions.check(req, resp)
 	if err != nil {
 		return nil, fmt.Errorf("validating response: %w", err)
 	}
@@ -260,12 +375,32 @@ func (p *dnsOverHTTPS) exchangeHTTPS(client *http.Client, req *dns.Msg) (resp *d
 	return resp, nil
 }
 
+// packDoHQuery returns the value of the "dns" parameter of the GET request
+// containing req.
+func packDoHQuery(req *dns.Msg) (query string, err error) {
+	buf, err := req.Pack()
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return "", err
+	}
+
+	// In order to maximize HTTP cache friendliness, DoH clients using media
+	// formats that include the ID field from the DNS message header, such as
+	// "application/dns-message", SHOULD use a DNS ID of 0 in every DNS request.
+	//
+	// See https://www.rfc-editor.org/rfc/rfc8484.html.
+	binary.BigEndian.PutUint16(buf, 0)
+
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
 // exchangeHTTPSClient sends the DNS query to a DoH resolver using the specified
-// http.Client instance.  buf is the packed DNS message that will be sent to the
-// resolver.  client must not be nil.
+// http.Client instance.  query is the base64url-encoded DNS message that will
+// be sent to the resolver.  client must not be nil.
 func (p *dnsOverHTTPS) exchangeHTTPSClient(
+	ctx context.Context,
 	client *http.Client,
-	buf []byte,
+	query string,
 ) (resp *dns.Msg, err error) {
 	// It appears, that GET requests are more memory-efficient with Golang
 	// implementation of HTTP/2.
@@ -276,7 +411,7 @@ func (p *dnsOverHTTPS) exchangeHTTPSClient(
 	}
 
 	q := url.Values{
-		"dns": []string{base64.RawURLEncoding.EncodeToString(buf)},
+		"dns": []string{query},
 	}
 
 	u := url.URL{
@@ -287,7 +422,11 @@ func (p *dnsOverHTTPS) exchangeHTTPSClient(
 		RawQuery: q.Encode(),
 	}
 
-	httpReq, err := http.NewRequest(method, u.String(), nil)
+	ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: p.gotConn,
+	})
+
+	httpReq, err := http.NewRequestWithContext(ctx, method, u.String(), nil)
 	if err != nil {
 		return nil, fmt.Errorf("creating http request to %s: %w", p.addrRedacted, err)
 	}
@@ -295,7 +434,7 @@ func (p *dnsOverHTTPS) exchangeHTTPSClient(
 	// Prevent the client from sending User-Agent header, see
 	// https://github.com/AdguardTeam/dnsproxy/issues/211.
 	httpReq.Header.Set(httphdr.UserAgent, "")
-	httpReq.Header.Set(httphdr.Accept, "application/dns-message")
+	httpReq.Header.Set(httphdr.Accept, mimeDNSMessage)
 
 	httpResp, err := client.Do(httpReq)
 	if err != nil {
@@ -303,19 +442,26 @@ func (p *dnsOverHTTPS) exchangeHTTPSClient(
 	}
 	defer slogutil.CloseAndLog(httpReq.Context(), p.logger, httpResp.Body, slog.LevelDebug)
 
-	limitBody := ioutil.LimitReader(httpResp.Body, dns.MaxMsgSize)
-	body, err := io.ReadAll(limitBody)
+	if httpResp.StatusCode != http.StatusOK {
+		discardBody(httpResp.Body)
+
+		return nil, newHTTPStatusError(p.addrRedacted, httpResp, time.Now())
+	}
+
+	// The body is unpacked before the buffer is returned to the pool, since
+	// the unpacked message doesn't refer to it.
+	pool := bodyPool(httpResp.ContentLength)
+	bufPtr := pool.Get()
+	defer pool.Put(bufPtr)
+
+	body, err := readBody(httpResp.Body, *bufPtr)
 	if err != nil {
 		return nil, fmt.Errorf("reading %s: %w", p.addrRedacted, err)
 	}
 
-	if httpResp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf(
-			"expected status %d, got %d from %s",
-			http.StatusOK,
-			httpResp.StatusCode,
-			p.addrRedacted,
-		)
+	err = validateContentType(httpResp)
+	if err != nil {
+		return nil, fmt.Errorf("response from %s: %w", p.addrRedacted, err)
 	}
 
 	resp = &dns.Msg{}
@@ -332,6 +478,18 @@ func (p *dnsOverHTTPS) exchangeHTTPSClient(
 	return resp, nil
 }
 
+// gotConn records the establishment of a new HTTP/1.1 or HTTP/2 connection.
+// HTTP/3 connections are recorded by [dnsOverHTTPS.watchH3Connection].
+func (p *dnsOverHTTPS) gotConn(info httptrace.GotConnInfo) {
+	tlsConn, ok := info.Conn.(*tls.Conn)
+	if info.Reused || !ok {
+		return
+	}
+
+	state := tlsConn.ConnectionState()
+	p.stats.connectedTLS(cmp.Or(state.NegotiatedProtocol, string(HTTPVersion11)), state)
+}
+
 // shouldRetry checks what error we have received and returns true if we should
 // re-create the HTTP client and retry the request.
 func (p *dnsOverHTTPS) shouldRetry(err error) (ok bool) {
@@ -358,8 +516,12 @@ func (p *dnsOverHTTPS) shouldRetry(err error) (ok bool) {
 
 // resetClient triggers re-creation of the *http.Client that is used by this
 // upstream.  This method accepts the error that caused resetting client as
-// depending on the error we may also reset the QUIC config.
-func (p *dnsOverHTTPS) resetClient(resetErr error) (client *http.Client, err error) {
+// depending on the error we may also reset the QUIC config.  ctx is used to
+// probe the upstream.
+func (p *dnsOverHTTPS) resetClient(
+	ctx context.Context,
+	resetErr error,
+) (client *http.Client, err error) {
 	p.clientMu.Lock()
 	defer p.clientMu.Unlock()
 
@@ -377,7 +539,7 @@ func (p *dnsOverHTTPS) resetClient(resetErr error) (client *http.Client, err err
 	}
 
 	p.logger.Debug("recreating the http client", slogutil.KeyError, resetErr)
-	p.client, err = p.createClient()
+	p.client, err = p.createClient(ctx)
 
 	return p.client, err
 }
@@ -402,15 +564,27 @@ func (p *dnsOverHTTPS) resetQUICConfig() {
 }
 
 // getClient gets or lazily initializes an HTTP client (and transport) that will
-// be used for this DoH resolver.
-func (p *dnsOverHTTPS) getClient() (c *http.Client, isCached bool, err error) {
+// be used for this DoH resolver.  ctx is used to probe the upstream when the
+// client is created.
+func (p *dnsOverHTTPS) getClient(
+	ctx context.Context,
+) (c *http.Client, isCached bool, err error) {
 	startTime := time.Now()
 
 	p.clientMu.Lock()
 	defer p.clientMu.Unlock()
 
 	if p.client != nil {
-		return p.client, true, nil
+		if !p.upgradeDue(time.Now()) {
+			return p.client, true, nil
+		}
+
+		closeErr := p.closeClient(p.client)
+		if closeErr != nil {
+			p.logger.Debug("closing downgraded http client", slogutil.KeyError, closeErr)
+		}
+
+		p.client = nil
 	}
 
 	// Timeout can be exceeded while waiting for the lock. This happens quite
@@ -420,8 +594,13 @@ func (p *dnsOverHTTPS) getClient() (c *http.Client, isCached bool, err error) {
 		return nil, false, fmt.Errorf("timeout exceeded: %s", elapsed)
 	}
 
+	err = context.Cause(ctx)
+	if err != nil {
+		return nil, false, fmt.Errorf("waiting for client: %w", err)
+	}
+
 	p.logger.Debug("creating a new http client")
-	p.client, err = p.createClient()
+	p.client, err = p.createClient(ctx)
 
 	return p.client, false, err
 }
@@ -429,9 +608,10 @@ func (p *dnsOverHTTPS) getClient() (c *http.Client, isCached bool, err error) {
 // createClient creates a new *http.Client instance.  The HTTP protocol version
 // will depend on whether HTTP3 is allowed and provided by this upstream.  Note,
 // that we'll attempt to establish a QUIC connection when creating the client in
-// order to check whether HTTP3 is supported.
-func (p *dnsOverHTTPS) createClient() (*http.Client, error) {
-	transport, err := p.createTransport()
+// order to check whether HTTP3 is supported.  The probe is aborted once ctx is
+// canceled.
+func (p *dnsOverHTTPS) createClient(ctx context.Context) (*http.Client, error) {
+	transport, err := p.createTransport(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("initializing http transport: %w", err)
 	}
@@ -455,7 +635,7 @@ func (p *dnsOverHTTPS) createClient() (*http.Client, error) {
 // that this function will first attempt to establish a QUIC connection (if
 // HTTP3 is enabled in the upstream options).  If this attempt is successful,
 // it returns an HTTP3 transport, otherwise it returns the H1/H2 transport.
-func (p *dnsOverHTTPS) createTransport() (t http.RoundTripper, err error) {
+func (p *dnsOverHTTPS) createTransport(ctx context.Context) (t http.RoundTripper, err error) {
 	dialContext, err := p.getDialer()
 	if err != nil {
 		return nil, fmt.Errorf("bootstrapping %s: %w", p.addrRedacted, err)
@@ -465,44 +645,75 @@ func (p *dnsOverHTTPS) createTransport() (t http.RoundTripper, err error) {
 	// connection is established successfully, we'll be using HTTP3 for this
 	// upstream.
 	tlsConf := p.tlsConf.Clone()
-	transportH3, err := p.createTransportH3(tlsConf, dialContext)
+	transportH3, err := p.createTransportH3(ctx, tlsConf, dialContext)
 	if err == nil {
 		p.logger.Debug("using http/3 for this upstream, quic was faster")
+		p.clientVersion = HTTPVersion3
 
 		return transportH3, nil
 	}
 
+	// Don't fall back to HTTP/2 if the probe has been aborted by the caller,
+	// since its result says nothing about the upstream.
+	ctxErr := context.Cause(ctx)
+	if ctxErr != nil {
+		return nil, fmt.Errorf("probing http/3: %w", ctxErr)
+	}
+
 	p.logger.Debug("got error, switching to http/2 for this upstream", slogutil.KeyError, err)
 
 	if !p.supportsHTTP() {
 		return nil, errors.Error("HTTP1/1 and HTTP2 are not supported by this upstream")
 	}
 
+	// The HTTP/1.1 transport is also used as a fallback for the servers which
+	// don't negotiate HTTP/2.
+	tlsConfH1 := tlsConf.Clone()
+	tlsConfH1.NextProtos = []string{string(HTTPVersion11)}
+
 	transport := &http.Transport{
-		TLSClientConfig:    tlsConf,
+		TLSClientConfig:    tlsConfH1,
 		DisableCompression: true,
 		DialContext:        dialContext,
 		IdleConnTimeout:    transportDefaultIdleConnTimeout,
 		MaxConnsPerHost:    dohMaxConnsPerHost,
 		MaxIdleConns:       dohMaxIdleConns,
-		// Since we have a custom DialContext, we need to use this field to make
-		// golang http.Client attempt to use HTTP/2. Otherwise, it would only be
-		// used when negotiated on the TLS level.
-		ForceAttemptHTTP2: true,
+		// A non-nil empty map disables HTTP/2, see [http.Transport].
+		TLSNextProto: map[string]func(string, *tls.Conn) http.RoundTripper{},
 	}
 
-	// Explicitly configure transport to use HTTP/2.
+	if !p.allowsVersion(HTTPVersion2) {
+		p.transportH2 = nil
+		p.clientVersion = HTTPVersion11
+
+		return transport, nil
+	}
+
+	// Handle HTTP/2 connections explicitly to verify the idle ones before
+	// reuse.
 	//
 	// See https://github.com/AdguardTeam/dnsproxy/issues/11.
-	p.transportH2, err = http2.ConfigureTransports(transport)
+	// Clone the protocols, since the cloned TLS configuration shares them with
+	// p.tlsConf.
+	protos := slices.Clone(tlsConf.NextProtos)
+	tlsConf.NextProtos = slices.DeleteFunc(protos, func(proto string) (ok bool) {
+		return proto == string(HTTPVersion3)
+	})
+
+	// Don't fall back to HTTP/1.1 if it isn't allowed.
+	if !p.allowsVersion(HTTPVersion11) {
+		transport = nil
+	}
+
+	p.transportH2, err = newH2Transport(transport, dialContext, tlsConf, p.logger)
 	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
 		return nil, err
 	}
 
-	// Enable HTTP/2 pings on idle connections.
-	p.transportH2.ReadIdleTimeout = transportDefaultReadIdleTimeout
+	p.clientVersion = HTTPVersion2
 
-	return transport, nil
+	return p.transportH2, nil
 }
 
 // http3Transport is a wrapper over [*http3.Transport] that tries to optimize
@@ -512,8 +723,14 @@ func (p *dnsOverHTTPS) createTransport() (t http.RoundTripper, err error) {
 type http3Transport struct {
 	baseTransport *http3.Transport
 
+	// standby is the connection dialed in advance to replace the closed one.
+	// It's protected by standbyMu.
+	standby *quic.Conn
+
 	closed bool
 	mu     sync.RWMutex
+
+	standbyMu sync.Mutex
 }
 
 // type check
@@ -549,58 +766,183 @@ func (h *http3Transport) Close() (err error) {
 
 	h.closed = true
 
+	h.standbyMu.Lock()
+	defer h.standbyMu.Unlock()
+
+	if h.standby != nil {
+		_ = h.standby.CloseWithError(QUICCodeNoError, "")
+		h.standby = nil
+	}
+
 	return h.baseTransport.Close()
 }
 
+// takeStandby returns the connection dialed in advance, if there is one and
+// it's still alive.
+func (h *http3Transport) takeStandby() (conn *quic.Conn) {
+	h.standbyMu.Lock()
+	defer h.standbyMu.Unlock()
+
+	conn, h.standby = h.standby, nil
+	if conn != nil && conn.Context().Err() != nil {
+		return nil
+	}
+
+	return conn
+}
+
+// setStandby stores conn to be used by the next dial.  ok is false if h is
+// closed or already has a standby connection, in which case the caller must
+// close conn.
+func (h *http3Transport) setStandby(conn *quic.Conn) (ok bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	if h.closed {
+		return false
+	}
+
+	h.standbyMu.Lock()
+	defer h.standbyMu.Unlock()
+
+	if h.standby != nil {
+		return false
+	}
+
+	h.standby = conn
+
+	return true
+}
+
+// isClosed returns true if h has been closed.
+func (h *http3Transport) isClosed() (ok bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	return h.closed
+}
+
 // createTransportH3 tries to create an HTTP/3 transport for this upstream.  We
 // should be able to fall back to H1/H2 in case if HTTP/3 is unavailable or if
 // it is too slow.  In order to do that, this method will run two probes in
 // parallel (one for TLS, the other one for QUIC) and if QUIC is faster it will
 // create the [*http3.Transport] instance.
 func (p *dnsOverHTTPS) createTransportH3(
+	ctx context.Context,
 	tlsConfig *tls.Config,
 	dialContext bootstrap.DialHandler,
 ) (roundTripper http.RoundTripper, err error) {
-	if !p.supportsH3() {
+	if !p.allowsVersion(HTTPVersion3) {
 		return nil, errors.Error("HTTP3 support is not enabled")
 	}
 
-	addr, err := p.probeH3(tlsConfig, dialContext)
+	addr, err := p.probeH3(ctx, tlsConfig, dialContext)
 	if err != nil {
 		return nil, err
 	}
 
 	rt := &http3.Transport{
-		Dial: func(
-			ctx context.Context,
-
-			// Ignore the address and always connect to the one that we got
-			// from the bootstrapper.
-			_ string,
-			tlsCfg *tls.Config,
-			cfg *quic.Config,
-		) (c *quic.Conn, err error) {
-			return quic.DialAddrEarly(ctx, addr, tlsCfg, cfg)
-		},
 		DisableCompression: true,
 		TLSClientConfig:    tlsConfig,
 		QUICConfig:         p.getQUICConfig(),
 	}
+	h3 := &http3Transport{baseTransport: rt}
+	rt.Dial = func(
+		ctx context.Context,
+
+		// Ignore the address and always connect to the one that we got from
+		// the bootstrapper.
+		_ string,
+		tlsCfg *tls.Config,
+		cfg *quic.Config,
+	) (c *quic.Conn, err error) {
+		redial := func(dialCtx context.Context) (c *quic.Conn, err error) {
+			return p.quicSocket.dial(dialCtx, addr, tlsCfg, cfg)
+		}
+
+		c = h3.takeStandby()
+		if c == nil {
+			c, err = redial(ctx)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		go p.watchH3Connection(c, h3, redial)
 
-	return &http3Transport{baseTransport: rt}, nil
+		return c, nil
+	}
+
+	return h3, nil
+}
+
+// watchH3Connection records the establishment of conn in the statistics and
+// waits for it to be closed.  If it was closed because the server stopped
+// responding to keep-alive PINGs, it's removed from h3 so that the next query
+// doesn't try the dead path first.  Only if it was closed because of an error
+// and h3 isn't closed, a new connection is then dialed using redial and kept
+// in h3 for the next query, otherwise the next query dials it.  It's intended
+// to be used as a goroutine.
+func (p *dnsOverHTTPS) watchH3Connection(
+	conn *quic.Conn,
+	h3 *http3Transport,
+	redial func(ctx context.Context) (c *quic.Conn, err error),
+) {
+	defer slogutil.RecoverAndLog(context.Background(), p.logger)
+
+	p.stats.connectedQUIC(conn, string(HTTPVersion3))
+
+	<-conn.Context().Done()
+
+	if h3.isClosed() {
+		return
+	}
+
+	cause := context.Cause(conn.Context())
+	if isQUICIdleTimeout(cause) {
+		p.logger.Debug("http/3 connection timed out, dropping", slogutil.KeyError, cause)
+
+		h3.baseTransport.CloseIdleConnections()
+	}
+
+	if !isQUICErrorClose(cause) {
+		return
+	}
+
+	t := p.timeout
+	if t == 0 {
+		t = dialTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), t)
+	defer cancel()
+
+	// Dial without holding any locks, so that the queries aren't blocked by a
+	// stalled dial.
+	newConn, err := redial(ctx)
+	if err != nil {
+		p.logger.Debug("redialing http/3 connection", slogutil.KeyError, err)
+
+		return
+	}
+
+	if !h3.setStandby(newConn) {
+		_ = newConn.CloseWithError(QUICCodeNoError, "")
+	}
 }
 
 // probeH3 runs a test to check whether QUIC is faster than TLS for this
 // upstream.  If the test is successful it will return the address that we
-// should use to establish the QUIC connections.
+// should use to establish the QUIC connections.  The probes are aborted once
+// ctx is canceled.
 func (p *dnsOverHTTPS) probeH3(
+	ctx context.Context,
 	tlsConfig *tls.Config,
 	dialContext bootstrap.DialHandler,
 ) (addr string, err error) {
 	// We're using bootstrapped address instead of what's passed to the function
 	// it does not create an actual connection, but it helps us determine
 	// what IP is actually reachable (when there are v4/v6 addresses).
-	rawConn, err := dialContext(context.Background(), "udp", "")
+	rawConn, err := dialContext(ctx, "udp", "")
 	if err != nil {
 		return "", fmt.Errorf("failed to dial: %w", err)
 	}
@@ -619,6 +961,17 @@ func (p *dnsOverHTTPS) probeH3(
 		return addr, nil
 	}
 
+	// Also avoid it if the upstream has been probed recently.
+	if v, ok := p.cachedProbe(time.Now()); ok {
+		p.logger.Debug("using cached probe outcome", "proto", v)
+
+		if v == HTTPVersion3 {
+			return addr, nil
+		}
+
+		return "", errors.Error("TLS was faster than QUIC recently, prefer it")
+	}
+
 	// Use a new *tls.Config with empty session cache for probe connections.
 	// Surprisingly, this is really important since otherwise it invalidates
 	// the existing cache.
@@ -635,17 +988,24 @@ func (p *dnsOverHTTPS) probeH3(
 	// Run probeQUIC and probeTLS in parallel and see which one is faster.
 	chQUIC := make(chan error, 1)
 	chTLS := make(chan error, 1)
-	go p.probeQUIC(addr, probeTLSCfg, chQUIC)
-	go p.probeTLS(dialContext, probeTLSCfg, chTLS)
+	go p.probeQUIC(ctx, addr, probeTLSCfg, chQUIC)
+	go p.probeTLS(ctx, dialContext, probeTLSCfg, chTLS)
 
 	select {
 	case quicErr := <-chQUIC:
 		if quicErr != nil {
+			// Don't remember the failure caused by the caller.
+			if context.Cause(ctx) == nil {
+				p.storeProbe(HTTPVersion2, time.Now())
+			}
+
 			// QUIC failed, return error since HTTP3 was not preferred.
 			return "", quicErr
 		}
 
 		// Return immediately, QUIC was faster.
+		p.storeProbe(HTTPVersion3, time.Now())
+
 		return addr, quicErr
 	case tlsErr := <-chTLS:
 		if tlsErr != nil {
@@ -655,23 +1015,30 @@ func (p *dnsOverHTTPS) probeH3(
 			return addr, nil
 		}
 
+		p.storeProbe(HTTPVersion2, time.Now())
+
 		return "", errors.Error("TLS was faster than QUIC, prefer it")
 	}
 }
 
 // probeQUIC attempts to establish a QUIC connection to the specified address.
 // We run probeQUIC and probeTLS in parallel and see which one is faster.
-func (p *dnsOverHTTPS) probeQUIC(addr string, tlsConfig *tls.Config, ch chan error) {
+func (p *dnsOverHTTPS) probeQUIC(
+	ctx context.Context,
+	addr string,
+	tlsConfig *tls.Config,
+	ch chan error,
+) {
 	startTime := time.Now()
 
 	t := p.timeout
 	if t == 0 {
 		t = dialTimeout
 	}
-	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(t))
+	ctx, cancel := context.WithTimeout(ctx, t)
 	defer cancel()
 
-	conn, err := quic.DialAddrEarly(ctx, addr, tlsConfig, p.getQUICConfig())
+	conn, err := p.quicSocket.dial(ctx, addr, tlsConfig, p.getQUICConfig())
 	if err != nil {
 		ch <- fmt.Errorf("opening quic connection to %s: %w", p.addrRedacted, err)
 		return
@@ -688,10 +1055,15 @@ func (p *dnsOverHTTPS) probeQUIC(addr string, tlsConfig *tls.Config, ch chan err
 
 // probeTLS attempts to establish a TLS connection to the specified address. We
 // run probeQUIC and probeTLS in parallel and see which one is faster.
-func (p *dnsOverHTTPS) probeTLS(dialContext bootstrap.DialHandler, tlsConfig *tls.Config, ch chan error) {
+func (p *dnsOverHTTPS) probeTLS(
+	ctx context.Context,
+	dialContext bootstrap.DialHandler,
+	tlsConfig *tls.Config,
+	ch chan error,
+) {
 	startTime := time.Now()
 
-	conn, err := tlsDial(dialContext, tlsConfig)
+	conn, err := tlsDial(ctx, dialContext, tlsConfig, dialTimeout)
 	if err != nil {
 		ch <- fmt.Errorf("opening TLS connection: %w", err)
 		return
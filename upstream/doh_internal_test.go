@@ -11,14 +11,17 @@ import (
 	"net/http"
 	"net/netip"
 	"net/url"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/AdguardTeam/golibs/errors"
 	"github.com/AdguardTeam/golibs/testutil"
 	"github.com/miekg/dns"
 	"github.com/quic-go/quic-go"
 	"github.com/quic-go/quic-go/http3"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
@@ -114,6 +117,217 @@ func TestUpstreamDoH(t *testing.T) {
 	}
 }
 
+func TestUpstreamDoH_ExchangeContext_canceled(t *testing.T) {
+	t.Parallel()
+
+	srv := startDoHServer(t, testDoHServerOptions{
+		http3Enabled:     true,
+		delayHandshakeH2: time.Second,
+	})
+
+	address := fmt.Sprintf("https://%s/dns-query", srv.addr)
+	u, err := AddressToUpstream(address, &Options{
+		Logger:             testLogger,
+		InsecureSkipVerify: true,
+		HTTPVersions:       []HTTPVersion{HTTPVersion3, HTTPVersion2},
+	})
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, u.Close)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err = ExchangeContext(ctx, u, createTestMessage())
+	require.ErrorIs(t, err, context.Canceled)
+
+	// Make sure the aborted probe hasn't made the upstream fall back to
+	// HTTP/2.
+	doh := testutil.RequireTypeAssert[*dnsOverHTTPS](t, u)
+	require.Nil(t, doh.client)
+
+	checkUpstream(t, u, address)
+	require.True(t, isHTTP3(doh.client))
+}
+
+// testProbeStorage is an [HTTPProbeStorage] for tests.
+type testProbeStorage struct {
+	versions map[string]HTTPVersion
+	mu       sync.Mutex
+}
+
+// type check
+var _ HTTPProbeStorage = (*testProbeStorage)(nil)
+
+// Load implements the [HTTPProbeStorage] interface for *testProbeStorage.
+func (s *testProbeStorage) Load(addr string) (v HTTPVersion, expire time.Time, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	v, ok = s.versions[addr]
+
+	return v, time.Now().Add(time.Hour), ok
+}
+
+// Store implements the [HTTPProbeStorage] interface for *testProbeStorage.
+func (s *testProbeStorage) Store(addr string, v HTTPVersion, _ time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.versions[addr] = v
+}
+
+func TestUpstreamDoH_probeCache(t *testing.T) {
+	t.Parallel()
+
+	newUpstream := func(t *testing.T, address string, s HTTPProbeStorage) (doh *dnsOverHTTPS) {
+		t.Helper()
+
+		u, err := AddressToUpstream(address, &Options{
+			Logger:             testLogger,
+			InsecureSkipVerify: true,
+			HTTPVersions:       []HTTPVersion{HTTPVersion3, HTTPVersion2},
+			HTTPProbeStorage:   s,
+			HTTPProbeCacheTTL:  time.Hour,
+		})
+		require.NoError(t, err)
+		testutil.CleanupAndRequireSuccess(t, u.Close)
+
+		return testutil.RequireTypeAssert[*dnsOverHTTPS](t, u)
+	}
+
+	t.Run("store", func(t *testing.T) {
+		t.Parallel()
+
+		srv := startDoHServer(t, testDoHServerOptions{
+			http3Enabled:     true,
+			delayHandshakeH2: time.Second,
+		})
+
+		address := fmt.Sprintf("https://%s/dns-query", srv.addr)
+		s := &testProbeStorage{versions: map[string]HTTPVersion{}}
+		doh := newUpstream(t, address, s)
+
+		checkUpstream(t, doh, address)
+		require.True(t, isHTTP3(doh.client))
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		assert.Equal(t, HTTPVersion3, s.versions[address])
+	})
+
+	t.Run("load", func(t *testing.T) {
+		t.Parallel()
+
+		// Make QUIC slower, so that the probe would choose HTTP/2.
+		srv := startDoHServer(t, testDoHServerOptions{
+			http3Enabled:     true,
+			delayHandshakeH3: time.Second,
+		})
+
+		address := fmt.Sprintf("https://%s/dns-query", srv.addr)
+		s := &testProbeStorage{versions: map[string]HTTPVersion{
+			address: HTTPVersion3,
+		}}
+		doh := newUpstream(t, address, s)
+
+		checkUpstream(t, doh, address)
+		require.True(t, isHTTP3(doh.client))
+
+		// Make sure the cached outcome is used after resetting the client.
+		_, err := doh.resetClient(context.Background(), nil)
+		require.NoError(t, err)
+
+		checkUpstream(t, doh, address)
+		require.True(t, isHTTP3(doh.client))
+	})
+}
+
+func TestUpstreamDoH_errorBudget(t *testing.T) {
+	t.Parallel()
+
+	const testErr errors.Error = "test error"
+
+	srv := startDoHServer(t, testDoHServerOptions{})
+
+	address := fmt.Sprintf("https://%s/dns-query", srv.addr)
+
+	var lastProto atomic.Value
+	u, err := AddressToUpstream(address, &Options{
+		Logger:             testLogger,
+		InsecureSkipVerify: true,
+		HTTPVersions:       []HTTPVersion{HTTPVersion2, HTTPVersion11},
+		HTTPErrorBudget:    0.5,
+		VerifyConnection: func(state tls.ConnectionState) (err error) {
+			lastProto.Store(state.NegotiatedProtocol)
+
+			return nil
+		},
+	})
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, u.Close)
+
+	doh := testutil.RequireTypeAssert[*dnsOverHTTPS](t, u)
+
+	checkUpstream(t, u, address)
+	assert.Equal(t, string(HTTPVersion2), lastProto.Load())
+
+	client := doh.client
+	for i := range httpErrorWindow {
+		// Keep the share of failures just within the budget at first.
+		var recErr error
+		if i%2 == 1 {
+			recErr = testErr
+		}
+
+		doh.recordResult(client, recErr)
+	}
+
+	require.Same(t, client, doh.client)
+
+	doh.recordResult(client, testErr)
+	require.Nil(t, doh.client)
+	assert.Equal(t, HTTPVersion11, doh.maxVersion)
+
+	checkUpstream(t, u, address)
+	assert.Equal(t, HTTPVersion11, doh.clientVersion)
+	assert.Equal(t, string(HTTPVersion11), lastProto.Load())
+
+	// Make the downgrade expire.
+	func() {
+		doh.clientMu.Lock()
+		defer doh.clientMu.Unlock()
+
+		doh.downgradedUntil = time.Time{}
+	}()
+
+	checkUpstream(t, u, address)
+	assert.Empty(t, doh.maxVersion)
+	assert.Equal(t, HTTPVersion2, doh.clientVersion)
+	assert.Equal(t, string(HTTPVersion2), lastProto.Load())
+}
+
+func TestErrorBudget(t *testing.T) {
+	t.Parallel()
+
+	b := &errorBudget{}
+	for range httpErrorWindow - 1 {
+		b.add(true)
+	}
+
+	assert.False(t, b.exceeded(0.5))
+
+	b.add(false)
+	assert.True(t, b.exceeded(0.5))
+
+	for range httpErrorWindow / 2 {
+		b.add(false)
+	}
+
+	assert.False(t, b.exceeded(0.5))
+	assert.Equal(t, httpErrorWindow/2-1, b.failed)
+}
+
 func TestUpstreamDoH_raceReconnect(t *testing.T) {
 	t.Parallel()
 
@@ -322,6 +536,176 @@ func TestUpstreamDoH_0RTT(t *testing.T) {
 	require.True(t, conns[1].is0RTT())
 }
 
+func TestDNSOverHTTPS_watchH3Connection(t *testing.T) {
+	t.Parallel()
+
+	srvTLSConf, _ := createServerTLSConfig(t, "127.0.0.1")
+	srvTLSConf.NextProtos = []string{string(HTTPVersion3)}
+
+	l, err := quic.ListenAddr("127.0.0.1:0", srvTLSConf, nil)
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, l.Close)
+
+	srvConns := make(chan *quic.Conn, 1)
+	go func() {
+		for {
+			c, acceptErr := l.Accept(context.Background())
+			if acceptErr != nil {
+				return
+			}
+
+			srvConns <- c
+		}
+	}()
+
+	addr := l.Addr().String()
+	u, err := AddressToUpstream("h3://"+addr+"/dns-query", &Options{
+		Logger:             testLogger,
+		InsecureSkipVerify: true,
+		Timeout:            testTimeout,
+	})
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, u.Close)
+
+	uh := testutil.RequireTypeAssert[*dnsOverHTTPS](t, u)
+
+	// #nosec G402 -- The test server uses a self-signed certificate.
+	tlsConf := &tls.Config{
+		InsecureSkipVerify: true,
+		NextProtos:         []string{string(HTTPVersion3)},
+	}
+
+	var redials atomic.Int32
+	redial := func(ctx context.Context) (c *quic.Conn, err error) {
+		redials.Add(1)
+
+		return quic.DialAddrEarly(ctx, addr, tlsConf, nil)
+	}
+
+	const errCode = quic.ApplicationErrorCode(http3.ErrCodeInternalError)
+
+	testCases := []struct {
+		name        string
+		code        quic.ApplicationErrorCode
+		remote      bool
+		closed      bool
+		wantRedials int32
+	}{{
+		name:        "local_close",
+		code:        QUICCodeNoError,
+		remote:      false,
+		closed:      false,
+		wantRedials: 0,
+	}, {
+		name:        "remote_graceful_close",
+		code:        quic.ApplicationErrorCode(http3.ErrCodeNoError),
+		remote:      true,
+		closed:      false,
+		wantRedials: 0,
+	}, {
+		name:        "remote_error_close",
+		code:        errCode,
+		remote:      true,
+		closed:      false,
+		wantRedials: 1,
+	}, {
+		name:        "transport_closed",
+		code:        errCode,
+		remote:      true,
+		closed:      true,
+		wantRedials: 0,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			redials.Store(0)
+
+			h3 := &http3Transport{baseTransport: &http3.Transport{}}
+			if tc.closed {
+				require.NoError(t, h3.Close())
+			} else {
+				testutil.CleanupAndRequireSuccess(t, h3.Close)
+			}
+
+			ctx := testutil.ContextWithTimeout(t, testTimeout)
+			conn, dialErr := quic.DialAddrEarly(ctx, addr, tlsConf, nil)
+			require.NoError(t, dialErr)
+
+			// Skip the server sides of the connections redialed before.
+			port := testutil.RequireTypeAssert[*net.UDPAddr](t, conn.LocalAddr()).Port
+			srvConn, _ := testutil.RequireReceive(t, srvConns, testTimeout)
+			for testutil.RequireTypeAssert[*net.UDPAddr](t, srvConn.RemoteAddr()).Port != port {
+				srvConn, _ = testutil.RequireReceive(t, srvConns, testTimeout)
+			}
+
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+
+				uh.watchH3Connection(conn, h3, redial)
+			}()
+
+			closing := conn
+			if tc.remote {
+				closing = srvConn
+			}
+
+			require.NoError(t, closing.CloseWithError(tc.code, ""))
+			testutil.RequireReceive(t, done, testTimeout)
+
+			assert.Equal(t, tc.wantRedials, redials.Load())
+
+			standby := h3.takeStandby()
+			if tc.wantRedials == 0 {
+				assert.Nil(t, standby)
+
+				return
+			}
+
+			require.NotNil(t, standby)
+			assert.NotSame(t, conn, standby)
+			assert.NoError(t, standby.Context().Err())
+			require.NoError(t, standby.CloseWithError(QUICCodeNoError, ""))
+		})
+	}
+}
+
+func BenchmarkDoHUpstream(b *testing.B) {
+	srv := startDoHServer(b, testDoHServerOptions{})
+
+	addr := (&url.URL{
+		Scheme: "https",
+		Host:   srv.addr,
+		Path:   "/dns-query",
+	}).String()
+
+	u, err := AddressToUpstream(addr, &Options{
+		Logger:             testLogger,
+		InsecureSkipVerify: true,
+		HTTPVersions:       []HTTPVersion{HTTPVersion2},
+	})
+	require.NoError(b, err)
+	testutil.CleanupAndRequireSuccess(b, u.Close)
+
+	b.Run("exchange", func(b *testing.B) {
+		b.ReportAllocs()
+
+		b.RunParallel(func(p *testing.PB) {
+			for p.Next() {
+				_, _ = u.Exchange(createTestMessage())
+			}
+		})
+	})
+
+	// Most recent results:
+	//
+	//	goos: linux
+	//	goarch: amd64
+	//	pkg: github.com/AdguardTeam/dnsproxy/upstream
+	//	cpu: Intel(R) Xeon(R) Processor
+	//	BenchmarkDoHUpstream/exchange         	   78783	     46300 ns/op	   10627 B/op	     121 allocs/op
+}
+
 // testDoHServerOptions allows customizing testDoHServer behavior.
 type testDoHServerOptions struct {
 	// handler is an HTTP handler that should be used by the server.  The
@@ -339,6 +723,9 @@ type testDoHServerOptions struct {
 	// http3Enabled is a flag that indicates whether the server should start an
 	// HTTP/3 server.
 	http3Enabled bool
+	// http1Only is a flag that indicates whether the server should only serve
+	// HTTP/1.1 without negotiating the protocol via ALPN.
+	http1Only bool
 }
 
 // testDoHServer is an instance of a test DNS-over-HTTPS server.
@@ -376,12 +763,12 @@ func (s *testDoHServer) Shutdown() {
 
 // startDoHServer starts a new DNS-over-HTTPS server with specified options.  It
 // returns a started server instance with addr set.  Note that it adds its own
-// shutdown to cleanup of t.
+// shutdown to cleanup of tb.
 func startDoHServer(
-	t *testing.T,
+	tb testing.TB,
 	opts testDoHServerOptions,
 ) (s *testDoHServer) {
-	tlsConfig, rootCAs := createServerTLSConfig(t, "127.0.0.1")
+	tlsConfig, rootCAs := createServerTLSConfig(tb, "127.0.0.1")
 	handler := opts.handler
 	if handler == nil {
 		handler = createDoHHandler()
@@ -398,13 +785,16 @@ func startDoHServer(
 	// Listen TCP first.
 	listenAddr := fmt.Sprintf("127.0.0.1:%d", opts.port)
 	tcpAddr, err := net.ResolveTCPAddr("tcp", listenAddr)
-	require.NoError(t, err)
+	require.NoError(tb, err)
 
 	tcpListen, err := net.ListenTCP("tcp", tcpAddr)
-	require.NoError(t, err)
+	require.NoError(tb, err)
 
 	tlsConfigH2 := tlsConfig.Clone()
 	tlsConfigH2.NextProtos = []string{string(HTTPVersion2), string(HTTPVersion11)}
+	if opts.http1Only {
+		tlsConfigH2.NextProtos = nil
+	}
 	tlsConfigH2.GetConfigForClient = func(_ *tls.ClientHelloInfo) (*tls.Config, error) {
 		if opts.delayHandshakeH2 > 0 {
 			time.Sleep(opts.delayHandshakeH2)
@@ -420,7 +810,7 @@ func startDoHServer(
 	}()
 
 	// Get the real address that the listener now listens to.
-	tcpAddr = testutil.RequireTypeAssert[*net.TCPAddr](t, tcpListen.Addr())
+	tcpAddr = testutil.RequireTypeAssert[*net.TCPAddr](tb, tcpListen.Addr())
 
 	var serverH3 *http3.Server
 	var listenerH3 *quic.EarlyListener
@@ -443,12 +833,12 @@ func startDoHServer(
 		// TCP listener.
 		var udpAddr *net.UDPAddr
 		udpAddr, err = net.ResolveUDPAddr("udp", fmt.Sprintf("127.0.0.1:%d", tcpAddr.Port))
-		require.NoError(t, err)
+		require.NoError(tb, err)
 
 		var conn net.PacketConn
 		conn, err = net.ListenUDP("udp", udpAddr)
-		require.NoError(t, err)
-		testutil.CleanupAndRequireSuccess(t, conn.Close)
+		require.NoError(tb, err)
+		testutil.CleanupAndRequireSuccess(tb, conn.Close)
 
 		transport := &quic.Transport{
 			Conn:                conn,
@@ -459,8 +849,8 @@ func startDoHServer(
 		listenerH3, err = transport.ListenEarly(tlsConfigH3, &quic.Config{
 			Allow0RTT: true,
 		})
-		require.NoError(t, err)
-		testutil.CleanupAndRequireSuccess(t, transport.Close)
+		require.NoError(tb, err)
+		testutil.CleanupAndRequireSuccess(tb, transport.Close)
 
 		// Run the H3 server.
 		go func() {
@@ -478,7 +868,7 @@ func startDoHServer(
 		// Save the address that the server listens to.
 		addr: tcpAddr.String(),
 	}
-	t.Cleanup(s.Shutdown)
+	tb.Cleanup(s.Shutdown)
 
 	return s
 }
@@ -0,0 +1,75 @@
+package upstream
+
+import (
+	"io"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/ioutil"
+	"github.com/AdguardTeam/golibs/syncutil"
+	"github.com/miekg/dns"
+)
+
+// Sizes of the buffers for the bodies of the DNS-over-HTTPS responses.
+const (
+	// smallBodySize is the size of the buffers for the responses with known
+	// length.  It fits the vast majority of DNS responses.
+	smallBodySize = 4096
+
+	// largeBodySize is the size of the buffers for the responses of unknown
+	// length or longer than [smallBodySize].
+	largeBodySize = dns.MaxMsgSize
+)
+
+// Pools of the buffers for the bodies of the DNS-over-HTTPS responses.  They're
+// shared between all the upstreams, since the responses are unpacked before
+// the buffers are returned.
+var (
+	smallBodyPool = syncutil.NewSlicePool[byte](smallBodySize)
+	largeBodyPool = syncutil.NewSlicePool[byte](largeBodySize)
+)
+
+// bodyPool returns the pool of the buffers fitting the body of the given
+// length.  contentLength is negative if the length is unknown.
+func bodyPool(contentLength int64) (pool *syncutil.Pool[[]byte]) {
+	if contentLength >= 0 && contentLength <= smallBodySize {
+		return smallBodyPool
+	}
+
+	return largeBodyPool
+}
+
+// readBody reads r into buf until EOF and returns the filled part of it.  It
+// returns an [*ioutil.LimitError] if r contains more data than buf fits.
+func readBody(r io.Reader, buf []byte) (body []byte, err error) {
+	n, err := io.ReadFull(r, buf)
+	switch {
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return buf[:n], nil
+	case err != nil:
+		// Don't wrap the error since it's informative enough as is.
+		return nil, err
+	}
+
+	// The buffer is full, make sure there is nothing left.
+	var extra [1]byte
+	_, err = io.ReadFull(r, extra[:])
+	switch {
+	case errors.Is(err, io.EOF):
+		return buf, nil
+	case err != nil:
+		// Don't wrap the error since it's informative enough as is.
+		return nil, err
+	default:
+		return nil, &ioutil.LimitError{
+			Limit: uint64(len(buf)),
+		}
+	}
+}
+
+// discardBody reads and discards at most [smallBodySize] bytes of the body of
+// an unsuccessful response, so that the connection could be reused unless the
+// body is larger.
+func discardBody(r io.Reader) {
+	// Don't check the error since the body isn't used anyway.
+	_, _ = io.Copy(io.Discard, io.LimitReader(r, smallBodySize))
+}
@@ -0,0 +1,133 @@
+package upstream
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/ioutil"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBodyPool(t *testing.T) {
+	t.Parallel()
+
+	assert.Same(t, smallBodyPool, bodyPool(0))
+	assert.Same(t, smallBodyPool, bodyPool(smallBodySize))
+	assert.Same(t, largeBodyPool, bodyPool(smallBodySize+1))
+	assert.Same(t, largeBodyPool, bodyPool(-1))
+}
+
+func TestReadBody(t *testing.T) {
+	t.Parallel()
+
+	const bufSize = 4
+
+	testCases := []struct {
+		wantErr error
+		name    string
+		in      string
+		want    string
+	}{{
+		wantErr: nil,
+		name:    "empty",
+		in:      "",
+		want:    "",
+	}, {
+		wantErr: nil,
+		name:    "short",
+		in:      "abc",
+		want:    "abc",
+	}, {
+		wantErr: nil,
+		name:    "exact",
+		in:      "abcd",
+		want:    "abcd",
+	}, {
+		wantErr: &ioutil.LimitError{
+			Limit: bufSize,
+		},
+		name: "too_long",
+		in:   "abcde",
+		want: "",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			body, err := readBody(strings.NewReader(tc.in), make([]byte, bufSize))
+			if tc.wantErr != nil {
+				assert.Equal(t, tc.wantErr, err)
+
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, tc.want, string(body))
+		})
+	}
+
+	t.Run("error", func(t *testing.T) {
+		t.Parallel()
+
+		const testErr errors.Error = "test error"
+
+		r := io.MultiReader(strings.NewReader("ab"), iotest.ErrReader(testErr))
+		_, err := readBody(r, make([]byte, bufSize))
+		assert.ErrorIs(t, err, testErr)
+	})
+}
+
+func BenchmarkReadBody(b *testing.B) {
+	msg := respondToTestMessage(createTestMessage())
+	data, err := msg.Pack()
+	require.NoError(b, err)
+
+	r := bytes.NewReader(data)
+
+	b.Run("read_all", func(b *testing.B) {
+		b.ReportAllocs()
+
+		for b.Loop() {
+			r.Reset(data)
+			body, readErr := io.ReadAll(ioutil.LimitReader(r, dns.MaxMsgSize))
+			require.NoError(testutil.PanicT{}, readErr)
+
+			readErr = (&dns.Msg{}).Unpack(body)
+			require.NoError(testutil.PanicT{}, readErr)
+		}
+	})
+
+	b.Run("pool", func(b *testing.B) {
+		b.ReportAllocs()
+
+		for b.Loop() {
+			r.Reset(data)
+			pool := bodyPool(int64(len(data)))
+			bufPtr := pool.Get()
+			body, readErr := readBody(r, *bufPtr)
+			require.NoError(testutil.PanicT{}, readErr)
+
+			readErr = (&dns.Msg{}).Unpack(body)
+			require.NoError(testutil.PanicT{}, readErr)
+
+			pool.Put(bufPtr)
+		}
+	})
+
+	// Most recent results:
+	//
+	//	goos: linux
+	//	goarch: amd64
+	//	pkg: github.com/AdguardTeam/dnsproxy/upstream
+	//	cpu: Intel(R) Xeon(R) Processor
+	//	BenchmarkReadBody/read_all            	 4497585	       777.3 ns/op	     752 B/op	       9 allocs/op
+	//	BenchmarkReadBody/pool                	 5845442	       614.0 ns/op	     208 B/op	       7 allocs/op
+}
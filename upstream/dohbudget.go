@@ -0,0 +1,167 @@
+package upstream
+
+import (
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+)
+
+const (
+	// DefaultHTTPDowngradePeriod is the default time a downgraded
+	// DNS-over-HTTPS upstream keeps using the lower HTTP version, see
+	// [Options.HTTPDowngradePeriod].
+	DefaultHTTPDowngradePeriod = 1 * time.Minute
+
+	// httpErrorWindow is the number of the most recent exchanges the share of
+	// failures is calculated over.
+	httpErrorWindow = 20
+)
+
+// errorBudget tracks the outcomes of the most recent exchanges made using a
+// single HTTP version.
+type errorBudget struct {
+	// failures is the ring buffer of the outcomes, true means a failure.
+	failures [httpErrorWindow]bool
+
+	// next is the index in failures to write the next outcome to.
+	next int
+
+	// total is the number of the outcomes in failures.
+	total int
+
+	// failed is the number of failures in failures.
+	failed int
+}
+
+// add records the outcome of an exchange.
+func (b *errorBudget) add(failed bool) {
+	if b.total == len(b.failures) {
+		if b.failures[b.next] {
+			b.failed--
+		}
+	} else {
+		b.total++
+	}
+
+	b.failures[b.next] = failed
+	if failed {
+		b.failed++
+	}
+
+	b.next = (b.next + 1) % len(b.failures)
+}
+
+// exceeded returns true if the share of failures among the outcomes exceeds
+// budget.  It's always false until the window is full.
+func (b *errorBudget) exceeded(budget float64) (ok bool) {
+	return b.total == len(b.failures) && float64(b.failed)/float64(b.total) > budget
+}
+
+// recordResult accounts the outcome of the exchange made using client into the
+// error budget of its HTTP version and downgrades the upstream, if the budget
+// is exceeded.
+func (p *dnsOverHTTPS) recordResult(client *http.Client, err error) {
+	if p.errBudget <= 0 {
+		return
+	}
+
+	p.clientMu.Lock()
+	defer p.clientMu.Unlock()
+
+	if client != p.client {
+		// The client has already been replaced.
+		return
+	}
+
+	v := p.clientVersion
+	b := p.budgets[v]
+	if b == nil {
+		b = &errorBudget{}
+		p.budgets[v] = b
+	}
+
+	b.add(err != nil)
+	if !b.exceeded(p.errBudget) {
+		return
+	}
+
+	lower, ok := p.lowerVersion(v)
+	if !ok {
+		return
+	}
+
+	p.logger.Warn("error budget exceeded, downgrading", "from", v, "to", lower)
+
+	p.maxVersion = lower
+	p.downgradedUntil = time.Now().Add(p.downgradePeriod)
+	delete(p.budgets, v)
+
+	closeErr := p.closeClient(client)
+	if closeErr != nil {
+		p.logger.Debug("closing downgraded http client", slogutil.KeyError, closeErr)
+	}
+
+	p.client = nil
+}
+
+// upgradeDue returns true if the upstream has been downgraded and the time to
+// try the higher HTTP versions has come.  In that case, it also lifts the
+// downgrade.  p.clientMu must be locked.
+func (p *dnsOverHTTPS) upgradeDue(now time.Time) (ok bool) {
+	if p.maxVersion == "" || now.Before(p.downgradedUntil) {
+		return false
+	}
+
+	p.logger.Info("downgrade period expired, upgrading", "from", p.maxVersion)
+
+	p.maxVersion = ""
+	clear(p.budgets)
+
+	return true
+}
+
+// lowerVersion returns the highest HTTP version supported by the upstream,
+// which is lower than v.
+func (p *dnsOverHTTPS) lowerVersion(v HTTPVersion) (lower HTTPVersion, ok bool) {
+	var candidates []HTTPVersion
+	switch v {
+	case HTTPVersion3:
+		candidates = []HTTPVersion{HTTPVersion2, HTTPVersion11}
+	case HTTPVersion2:
+		candidates = []HTTPVersion{HTTPVersion11}
+	default:
+		return "", false
+	}
+
+	for _, c := range candidates {
+		if p.supportsVersion(c) {
+			return c, true
+		}
+	}
+
+	return "", false
+}
+
+// allowsVersion returns true if v is supported by this upstream and isn't
+// disabled by the downgrade.  p.clientMu must be locked.
+func (p *dnsOverHTTPS) allowsVersion(v HTTPVersion) (ok bool) {
+	if !p.supportsVersion(v) {
+		return false
+	}
+
+	switch p.maxVersion {
+	case HTTPVersion2:
+		return v != HTTPVersion3
+	case HTTPVersion11:
+		return v == HTTPVersion11
+	default:
+		return true
+	}
+}
+
+// supportsVersion returns true if v is supported by this upstream.
+func (p *dnsOverHTTPS) supportsVersion(v HTTPVersion) (ok bool) {
+	return slices.Contains(p.tlsConf.NextProtos, string(v))
+}
@@ -0,0 +1,180 @@
+package upstream
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/httphdr"
+)
+
+const (
+	// ErrHTTPForbidden is wrapped by the [*HTTPStatusError] for the 403
+	// Forbidden responses, which usually mean that the client isn't allowed to
+	// use the server.
+	ErrHTTPForbidden errors.Error = "http forbidden"
+
+	// ErrHTTPTooManyRequests is wrapped by the [*HTTPStatusError] for the 429
+	// Too Many Requests responses.
+	ErrHTTPTooManyRequests errors.Error = "http too many requests"
+
+	// ErrHTTPServerError is wrapped by the [*HTTPStatusError] for the 5xx
+	// responses.
+	ErrHTTPServerError errors.Error = "http server error"
+
+	// ErrHTTPContentType is returned by DNS-over-HTTPS upstreams when the
+	// response has a content type other than "application/dns-message".
+	ErrHTTPContentType errors.Error = "unexpected http content type"
+)
+
+// maxRetryAfter is the maximum time a DNS-over-HTTPS upstream waits before
+// retrying after the server asked it to, so that a misconfigured server can't
+// disable the upstream for too long.
+const maxRetryAfter = 5 * time.Minute
+
+// mimeDNSMessage is the media type of DNS messages used by DNS-over-HTTPS.
+//
+// See https://www.rfc-editor.org/rfc/rfc8484.html#section-6.
+const mimeDNSMessage = "application/dns-message"
+
+// HTTPStatusError is returned by DNS-over-HTTPS upstreams when the server
+// responds with a status other than 200 OK.  It wraps [ErrHTTPForbidden],
+// [ErrHTTPTooManyRequests], or [ErrHTTPServerError] depending on the status.
+type HTTPStatusError struct {
+	// Addr is the redacted address of the upstream.
+	Addr string
+
+	// RetryAfter is the time the server asked to wait before retrying, see
+	// https://www.rfc-editor.org/rfc/rfc9110.html#name-retry-after.  It's only
+	// set for the 429 and 503 responses and never exceeds 5 minutes.
+	RetryAfter time.Duration
+
+	// StatusCode is the HTTP status code of the response.
+	StatusCode int
+}
+
+// type check
+var _ errors.Wrapper = (*HTTPStatusError)(nil)
+
+// Error implements the [error] interface for *HTTPStatusError.
+func (e *HTTPStatusError) Error() (msg string) {
+	msg = fmt.Sprintf("expected status %d, got %d from %s", http.StatusOK, e.StatusCode, e.Addr)
+	if e.RetryAfter > 0 {
+		msg += fmt.Sprintf(", retry after %s", e.RetryAfter)
+	}
+
+	return msg
+}
+
+// Unwrap implements the [errors.Wrapper] interface for *HTTPStatusError.
+func (e *HTTPStatusError) Unwrap() (unwrapped error) {
+	switch c := e.StatusCode; {
+	case c == http.StatusForbidden:
+		return ErrHTTPForbidden
+	case c == http.StatusTooManyRequests:
+		return ErrHTTPTooManyRequests
+	case c >= http.StatusInternalServerError:
+		return ErrHTTPServerError
+	default:
+		return nil
+	}
+}
+
+// newHTTPStatusError returns a new *HTTPStatusError for resp received from the
+// upstream with addr.  now is used to calculate the retry delay from the
+// Retry-After header.
+func newHTTPStatusError(addr string, resp *http.Response, now time.Time) (err *HTTPStatusError) {
+	err = &HTTPStatusError{
+		Addr:       addr,
+		StatusCode: resp.StatusCode,
+	}
+
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		err.RetryAfter = parseRetryAfter(resp.Header.Get(httphdr.RetryAfter), now)
+	default:
+		// Don't honor Retry-After for other statuses.
+	}
+
+	return err
+}
+
+// parseRetryAfter returns the delay specified by the value of the Retry-After
+// header, which is either a number of seconds or an HTTP date.  It returns 0 if
+// v is empty or invalid.  The result is capped by [maxRetryAfter].
+func parseRetryAfter(v string, now time.Time) (d time.Duration) {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return 0
+	}
+
+	if secs, err := strconv.ParseUint(v, 10, 32); err == nil {
+		d = time.Duration(secs) * time.Second
+	} else if t, err := http.ParseTime(v); err == nil {
+		d = t.Sub(now)
+	}
+
+	return max(0, min(d, maxRetryAfter))
+}
+
+// validateContentType returns an error if the content type of the
+// DNS-over-HTTPS response is set to anything but [mimeDNSMessage].  The missing
+// content type is tolerated for compatibility with the older servers.
+func validateContentType(resp *http.Response) (err error) {
+	ct := resp.Header.Get(httphdr.ContentType)
+	if ct == "" {
+		return nil
+	}
+
+	mt, _, err := mime.ParseMediaType(ct)
+	if err != nil {
+		return fmt.Errorf("%w: %q: %w", ErrHTTPContentType, ct, err)
+	} else if mt != mimeDNSMessage {
+		return fmt.Errorf("%w: %q", ErrHTTPContentType, ct)
+	}
+
+	return nil
+}
+
+// isHTTPLevelErr returns true if err means that the DNS-over-HTTPS server has
+// responded, but the response isn't a valid DNS message.
+func isHTTPLevelErr(err error) (ok bool) {
+	var statusErr *HTTPStatusError
+
+	return errors.As(err, &statusErr) || errors.Is(err, ErrHTTPContentType)
+}
+
+// setRetryAfter makes the upstream fail the exchanges right away until the
+// time the server asked to wait for, if err is an [*HTTPStatusError] with such
+// time.
+func (p *dnsOverHTTPS) setRetryAfter(err error, now time.Time) {
+	var statusErr *HTTPStatusError
+	if !errors.As(err, &statusErr) || statusErr.RetryAfter <= 0 {
+		return
+	}
+
+	p.clientMu.Lock()
+	defer p.clientMu.Unlock()
+
+	p.retryAfterErr = statusErr
+	p.retryAfter = now.Add(statusErr.RetryAfter)
+
+	p.logger.Debug("server asked to retry later", "retry_after", statusErr.RetryAfter)
+}
+
+// checkRetryAfter returns an error if the server has asked the upstream to
+// wait before retrying and the time hasn't come yet.
+func (p *dnsOverHTTPS) checkRetryAfter(now time.Time) (err error) {
+	p.clientMu.Lock()
+	defer p.clientMu.Unlock()
+
+	if p.retryAfterErr == nil || !now.Before(p.retryAfter) {
+		return nil
+	}
+
+	return fmt.Errorf("waiting until %s: %w", p.retryAfter.Format(time.RFC3339), p.retryAfterErr)
+}
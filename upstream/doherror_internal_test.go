@@ -0,0 +1,167 @@
+package upstream
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/httphdr"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpstreamDoH_httpErrors(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		wantErr     error
+		handler     http.HandlerFunc
+		name        string
+		wantRetries bool
+	}{{
+		wantErr: ErrHTTPForbidden,
+		handler: func(w http.ResponseWriter, _ *http.Request) {
+			w.WriteHeader(http.StatusForbidden)
+		},
+		name:        "forbidden",
+		wantRetries: true,
+	}, {
+		wantErr: ErrHTTPServerError,
+		handler: func(w http.ResponseWriter, _ *http.Request) {
+			w.WriteHeader(http.StatusBadGateway)
+		},
+		name:        "server_error",
+		wantRetries: true,
+	}, {
+		wantErr: ErrHTTPTooManyRequests,
+		handler: func(w http.ResponseWriter, _ *http.Request) {
+			w.Header().Set(httphdr.RetryAfter, "120")
+			w.WriteHeader(http.StatusTooManyRequests)
+		},
+		name:        "too_many_requests",
+		wantRetries: false,
+	}, {
+		wantErr: ErrHTTPTooManyRequests,
+		handler: func(w http.ResponseWriter, _ *http.Request) {
+			w.Header().Set(httphdr.RetryAfter, "120")
+			w.WriteHeader(http.StatusTooManyRequests)
+			_, _ = w.Write(make([]byte, 2*largeBodySize))
+		},
+		name:        "too_many_requests_large_body",
+		wantRetries: false,
+	}, {
+		wantErr: ErrHTTPContentType,
+		handler: func(w http.ResponseWriter, _ *http.Request) {
+			w.Header().Set(httphdr.ContentType, "text/html")
+			_, _ = w.Write([]byte("<html></html>"))
+		},
+		name:        "content_type",
+		wantRetries: true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			var requests atomic.Int32
+			srv := startDoHServer(t, testDoHServerOptions{
+				handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					requests.Add(1)
+					tc.handler(w, r)
+				}),
+			})
+
+			u, err := AddressToUpstream(fmt.Sprintf("https://%s/dns-query", srv.addr), &Options{
+				Logger:             testLogger,
+				InsecureSkipVerify: true,
+				Timeout:            testTimeout,
+			})
+			require.NoError(t, err)
+			testutil.CleanupAndRequireSuccess(t, u.Close)
+
+			_, err = u.Exchange(createTestMessage())
+			require.ErrorIs(t, err, tc.wantErr)
+			require.EqualValues(t, 1, requests.Load())
+
+			_, err = u.Exchange(createTestMessage())
+			require.ErrorIs(t, err, tc.wantErr)
+
+			wantRequests := int32(1)
+			if tc.wantRetries {
+				wantRequests++
+			}
+
+			assert.Equal(t, wantRequests, requests.Load())
+		})
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2025, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+	testCases := []struct {
+		name string
+		val  string
+		want time.Duration
+	}{{
+		name: "empty",
+		val:  "",
+		want: 0,
+	}, {
+		name: "seconds",
+		val:  "30",
+		want: 30 * time.Second,
+	}, {
+		name: "capped",
+		val:  "86400",
+		want: maxRetryAfter,
+	}, {
+		name: "date",
+		val:  now.Add(time.Minute).Format(http.TimeFormat),
+		want: time.Minute,
+	}, {
+		name: "past_date",
+		val:  now.Add(-time.Minute).Format(http.TimeFormat),
+		want: 0,
+	}, {
+		name: "negative",
+		val:  "-1",
+		want: 0,
+	}, {
+		name: "bad",
+		val:  "soon",
+		want: 0,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			assert.Equal(t, tc.want, parseRetryAfter(tc.val, now))
+		})
+	}
+}
+
+func TestHTTPStatusError(t *testing.T) {
+	t.Parallel()
+
+	err := error(&HTTPStatusError{
+		Addr:       "https://dns.example:443/dns-query",
+		RetryAfter: time.Minute,
+		StatusCode: http.StatusServiceUnavailable,
+	})
+
+	assert.ErrorIs(t, err, ErrHTTPServerError)
+	assert.False(t, errors.Is(err, ErrHTTPTooManyRequests))
+	testutil.AssertErrorMsg(
+		t,
+		"expected status 200, got 503 from https://dns.example:443/dns-query, retry after 1m0s",
+		err,
+	)
+}
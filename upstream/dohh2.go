@@ -0,0 +1,398 @@
+package upstream
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptrace"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/internal/bootstrap"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"golang.org/x/net/http2"
+)
+
+// Values to configure the liveness checks of HTTP/2 connections.
+const (
+	// transportDefaultPingIdleTimeout is the default time an HTTP/2 connection
+	// should be idle for to be checked with a PING frame before reuse.
+	transportDefaultPingIdleTimeout = transportDefaultReadIdleTimeout
+
+	// transportDefaultPingTimeout is the default timeout for the PING frame
+	// sent before reusing an idle HTTP/2 connection.
+	transportDefaultPingTimeout = 2 * time.Second
+
+	// transportDefaultH1Interval is the default time HTTP/1.1 is used for
+	// after the server hasn't negotiated HTTP/2, before HTTP/2 is tried again.
+	transportDefaultH1Interval = 30 * time.Minute
+)
+
+// h2Transport is an [http.RoundTripper] used by DNS-over-HTTPS upstreams for
+// HTTP/2.  Unlike the [http.Transport], it verifies the connections which have
+// been idle for a long time with a PING frame before reusing them and opens a
+// new connection if the server doesn't respond.  This prevents the first query
+// after a long idle period, e.g. after the system has been asleep, from timing
+// out on a connection silently dropped by the server or a middlebox.  It falls
+// back to HTTP/1.1 for a while if the server doesn't negotiate HTTP/2, unless
+// HTTP/1.1 isn't allowed.
+type h2Transport struct {
+	// h2 creates HTTP/2 connections on the dialed TLS connections.
+	h2 *http2.Transport
+
+	// h1 is used for the requests if the server doesn't support HTTP/2.  It's
+	// nil if HTTP/1.1 isn't allowed.
+	h1 *http.Transport
+
+	// dialContext dials the server.
+	dialContext bootstrap.DialHandler
+
+	// tlsConf is the TLS configuration for the connections.  It must offer
+	// HTTP/2 via ALPN.
+	tlsConf *tls.Config
+
+	// logger is used to log the liveness checks.
+	logger *slog.Logger
+
+	// mu protects conns and h1Until.
+	mu *sync.Mutex
+
+	// conns are the open HTTP/2 connections.
+	conns []*h2Conn
+
+	// h1Until is the wall-clock time until which h1 is used for all the
+	// requests, since the server hasn't negotiated HTTP/2.
+	h1Until time.Time
+
+	// pingIdleTimeout is the time a connection should be idle for to be
+	// checked before reuse.
+	pingIdleTimeout time.Duration
+
+	// pingTimeout is the timeout for the liveness check.
+	pingTimeout time.Duration
+
+	// h1Interval is the time h1 is used for after the server hasn't negotiated
+	// HTTP/2.
+	h1Interval time.Duration
+
+	// maxConns is the maximum number of connections to open.
+	maxConns int
+}
+
+// h2Conn is an HTTP/2 connection of [h2Transport].
+type h2Conn struct {
+	// cc is the HTTP/2 client connection.
+	cc *http2.ClientConn
+
+	// tlsConn is the underlying TLS connection.
+	tlsConn *tls.Conn
+
+	// lastUsed is the wall-clock time the connection was last used at.  The
+	// monotonic clock reading is stripped, since the monotonic clock may stop
+	// while the system is asleep.  It's protected by [h2Transport.mu].
+	lastUsed time.Time
+}
+
+// newH2Transport returns a new *h2Transport.  h1 is used when the server
+// doesn't support HTTP/2, it may be nil if HTTP/1.1 isn't allowed.  tlsConf
+// must offer HTTP/2 via ALPN.
+func newH2Transport(
+	h1 *http.Transport,
+	dialContext bootstrap.DialHandler,
+	tlsConf *tls.Config,
+	l *slog.Logger,
+) (t *h2Transport, err error) {
+	// Configure a separate transport, since the HTTP/2 transport needs one to
+	// create the connections.  Clone the TLS configuration, since the transport
+	// modifies it lazily while the connections are dialed using tlsConf.
+	h2, err := http2.ConfigureTransports(&http.Transport{
+		TLSClientConfig:    tlsConf.Clone(),
+		DisableCompression: true,
+		IdleConnTimeout:    transportDefaultIdleConnTimeout,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("configuring http/2: %w", err)
+	}
+
+	// Enable HTTP/2 pings on idle connections.
+	h2.ReadIdleTimeout = transportDefaultReadIdleTimeout
+
+	return &h2Transport{
+		h2:              h2,
+		h1:              h1,
+		dialContext:     dialContext,
+		tlsConf:         tlsConf,
+		logger:          l,
+		mu:              &sync.Mutex{},
+		pingIdleTimeout: transportDefaultPingIdleTimeout,
+		pingTimeout:     transportDefaultPingTimeout,
+		h1Interval:      transportDefaultH1Interval,
+		maxConns:        dohMaxConnsPerHost,
+	}, nil
+}
+
+// type check
+var _ http.RoundTripper = (*h2Transport)(nil)
+
+// RoundTrip implements the [http.RoundTripper] interface for *h2Transport.
+func (t *h2Transport) RoundTrip(req *http.Request) (resp *http.Response, err error) {
+	ctx := req.Context()
+
+	c, reused, err := t.conn(ctx, req.URL.Host)
+	if errors.Is(err, errNoH2) && t.h1 != nil {
+		return t.h1.RoundTrip(req)
+	} else if err != nil {
+		return nil, fmt.Errorf("getting http/2 connection: %w", err)
+	}
+
+	resp, err = t.roundTrip(req, c, reused)
+	if err == nil || !reused || ctx.Err() != nil {
+		return resp, err
+	}
+
+	// The reused connection may have been closed by the server between the
+	// liveness check and the request, so retry once on a new connection.  DNS
+	// queries are idempotent, so it's safe.
+	t.logger.Debug("retrying on new http/2 connection", slogutil.KeyError, err)
+	t.remove(c)
+
+	retryReq, cloneErr := cloneRequest(req)
+	if cloneErr != nil {
+		return nil, errors.WithDeferred(err, cloneErr)
+	}
+
+	c, err = t.dial(ctx, req.URL.Host)
+	if err != nil {
+		return nil, fmt.Errorf("redialing http/2 connection: %w", err)
+	}
+
+	return t.roundTrip(retryReq, c, false)
+}
+
+// roundTrip sends req over c, reports c to the client trace of req, and
+// updates the last use time of c.
+func (t *h2Transport) roundTrip(
+	req *http.Request,
+	c *h2Conn,
+	reused bool,
+) (resp *http.Response, err error) {
+	trace := httptrace.ContextClientTrace(req.Context())
+	if trace != nil && trace.GotConn != nil {
+		trace.GotConn(httptrace.GotConnInfo{Conn: c.tlsConn, Reused: reused})
+	}
+
+	resp, err = c.cc.RoundTrip(req)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	c.lastUsed = time.Now().Round(0)
+
+	return resp, err
+}
+
+// cloneRequest returns a copy of req with a new body for retrying it.
+func cloneRequest(req *http.Request) (clone *http.Request, err error) {
+	clone = req.Clone(req.Context())
+	if req.Body == nil || req.Body == http.NoBody {
+		return clone, nil
+	} else if req.GetBody == nil {
+		return nil, errors.Error("request body can't be reused")
+	}
+
+	clone.Body, err = req.GetBody()
+	if err != nil {
+		return nil, fmt.Errorf("getting request body: %w", err)
+	}
+
+	return clone, nil
+}
+
+// errNoH2 is returned by [h2Transport.conn] when the server doesn't support
+// HTTP/2.
+const errNoH2 errors.Error = "http/2 not negotiated"
+
+// conn returns a connection for a new request to host, verifying the idle ones
+// and dialing a new one if necessary.  reused is true if the connection has
+// already been used.
+func (t *h2Transport) conn(ctx context.Context, host string) (c *h2Conn, reused bool, err error) {
+	for {
+		var idleFor time.Duration
+		c, idleFor, err = t.reserve()
+		if err != nil {
+			// Don't wrap the error since it's informative enough as is.
+			return nil, false, err
+		} else if c == nil {
+			c, err = t.dial(ctx, host)
+
+			return c, false, err
+		} else if idleFor < t.pingIdleTimeout {
+			return c, true, nil
+		}
+
+		pingErr := t.ping(ctx, c)
+		if pingErr == nil {
+			return c, true, nil
+		} else if ctx.Err() != nil {
+			// The check has been aborted by the caller, so it says nothing
+			// about the connection.  Return it anyway, so that the request
+			// fails on it with the context error and releases the reserved
+			// stream.
+			return c, true, nil
+		}
+
+		t.logger.Debug(
+			"idle http/2 connection is dead",
+			"idle_for", idleFor,
+			slogutil.KeyError, pingErr,
+		)
+		t.remove(c)
+	}
+}
+
+// reserve returns an open connection reserved for a new request and the time
+// it has been idle for.  c is nil if a new connection should be dialed.
+func (t *h2Transport) reserve() (c *h2Conn, idleFor time.Duration, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if time.Now().Before(t.h1Until) {
+		return nil, 0, errNoH2
+	}
+
+	t.conns = slices.DeleteFunc(t.conns, func(c *h2Conn) (ok bool) {
+		st := c.cc.State()
+
+		return st.Closed || st.Closing
+	})
+
+	for _, c = range t.conns {
+		if c.cc.ReserveNewRequest() {
+			return c, time.Now().Round(0).Sub(c.lastUsed), nil
+		}
+	}
+
+	if len(t.conns) < t.maxConns || len(t.conns) == 0 {
+		return nil, 0, nil
+	}
+
+	// All the connections are busy, so queue the request on the first one.
+	return t.conns[0], 0, nil
+}
+
+// ping checks if c is alive by sending a PING frame.
+func (t *h2Transport) ping(ctx context.Context, c *h2Conn) (err error) {
+	ctx, cancel := context.WithTimeout(ctx, t.pingTimeout)
+	defer cancel()
+
+	return c.cc.Ping(ctx)
+}
+
+// dial opens a new HTTP/2 connection to host and adds it to the pool.  It
+// returns [errNoH2] if the server doesn't negotiate HTTP/2, and switches to
+// HTTP/1.1 for a while if it's allowed.
+func (t *h2Transport) dial(ctx context.Context, host string) (c *h2Conn, err error) {
+	conn, err := t.dialContext(ctx, networkTCP, host)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return nil, err
+	}
+
+	tlsConn := tls.Client(conn, t.tlsConf)
+	err = tlsConn.HandshakeContext(ctx)
+	if err != nil {
+		err = fmt.Errorf("tls handshake: %w", err)
+
+		return nil, errors.WithDeferred(err, conn.Close())
+	}
+
+	if tlsConn.ConnectionState().NegotiatedProtocol != http2.NextProtoTLS {
+		if t.h1 != nil {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+
+			t.h1Until = time.Now().Round(0).Add(t.h1Interval)
+			t.logger.Debug("server does not support http/2, using http/1.1", "for", t.h1Interval)
+		}
+
+		return nil, errors.WithDeferred(errNoH2, tlsConn.Close())
+	}
+
+	cc, err := t.h2.NewClientConn(tlsConn)
+	if err != nil {
+		err = fmt.Errorf("creating http/2 connection: %w", err)
+
+		return nil, errors.WithDeferred(err, tlsConn.Close())
+	}
+
+	// Reserve the stream for the request the connection is dialed for, so
+	// that concurrent requests don't take it.
+	cc.ReserveNewRequest()
+
+	c = &h2Conn{
+		cc:       cc,
+		tlsConn:  tlsConn,
+		lastUsed: time.Now().Round(0),
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.conns = append(t.conns, c)
+
+	return c, nil
+}
+
+// remove closes c and removes it from the pool.
+func (t *h2Transport) remove(c *h2Conn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.conns = slices.DeleteFunc(t.conns, func(other *h2Conn) (ok bool) { return other == c })
+
+	err := c.cc.Close()
+	if err != nil {
+		t.logger.Debug("closing http/2 connection", slogutil.KeyError, err)
+	}
+}
+
+// type check
+var _ io.Closer = (*h2Transport)(nil)
+
+// Close implements the [io.Closer] interface for *h2Transport.  It closes the
+// idle connections right away and the busy ones once their requests are
+// finished.
+func (t *h2Transport) Close() (err error) {
+	if t.h1 != nil {
+		t.h1.CloseIdleConnections()
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var errs []error
+	for _, c := range t.conns {
+		st := c.cc.State()
+		if st.StreamsActive == 0 && st.StreamsReserved == 0 && st.StreamsPending == 0 {
+			errs = append(errs, c.cc.Close())
+
+			continue
+		}
+
+		go func() {
+			shutdownErr := c.cc.Shutdown(context.Background())
+			if shutdownErr != nil {
+				t.logger.Debug("shutting down http/2 connection", slogutil.KeyError, shutdownErr)
+			}
+		}()
+	}
+
+	t.conns = nil
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,294 @@
+package upstream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testFreezingProxy is a TCP proxy which is able to stop forwarding the data
+// over the established connections without closing them, imitating the
+// connections silently dropped by a middlebox.
+type testFreezingProxy struct {
+	// mu protects frozen.
+	mu *sync.Mutex
+
+	// frozen are the flags of the established connections.
+	frozen []*atomic.Bool
+
+	// addr is the address the proxy listens on.
+	addr string
+}
+
+// startFreezingProxy starts a new *testFreezingProxy forwarding the
+// connections to target.
+func startFreezingProxy(t *testing.T, target string) (p *testFreezingProxy) {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, l.Close)
+
+	p = &testFreezingProxy{
+		mu:   &sync.Mutex{},
+		addr: l.Addr().String(),
+	}
+
+	go func() {
+		for {
+			conn, acceptErr := l.Accept()
+			if acceptErr != nil {
+				return
+			}
+
+			go p.forward(conn, target)
+		}
+	}()
+
+	return p
+}
+
+// forward forwards the data between conn and target until one of them is
+// closed.
+func (p *testFreezingProxy) forward(conn net.Conn, target string) {
+	dst, err := net.Dial("tcp", target)
+	if err != nil {
+		_ = conn.Close()
+
+		return
+	}
+
+	frozen := &atomic.Bool{}
+
+	p.mu.Lock()
+	p.frozen = append(p.frozen, frozen)
+	p.mu.Unlock()
+
+	go pipeUnlessFrozen(conn, dst, frozen)
+	pipeUnlessFrozen(dst, conn, frozen)
+}
+
+// freeze stops forwarding the data over the established connections.
+func (p *testFreezingProxy) freeze() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, f := range p.frozen {
+		f.Store(true)
+	}
+}
+
+// pipeUnlessFrozen copies the data from src to dst, discarding it once frozen
+// is set.  It closes both connections on error.
+func pipeUnlessFrozen(dst, src net.Conn, frozen *atomic.Bool) {
+	defer func() { _ = errors.Join(src.Close(), dst.Close()) }()
+
+	buf := make([]byte, 4096)
+	for {
+		n, err := src.Read(buf)
+		if err != nil {
+			return
+		}
+
+		if frozen.Load() {
+			continue
+		}
+
+		_, err = dst.Write(buf[:n])
+		if err != nil {
+			return
+		}
+	}
+}
+
+func TestH2Transport_ping(t *testing.T) {
+	srv := startDoHServer(t, testDoHServerOptions{})
+	proxy := startFreezingProxy(t, srv.addr)
+
+	addr := (&url.URL{
+		Scheme: "https",
+		Host:   proxy.addr,
+		Path:   "dns-query",
+	}).String()
+
+	u, err := AddressToUpstream(addr, &Options{
+		Logger:             testLogger,
+		InsecureSkipVerify: true,
+		HTTPVersions:       []HTTPVersion{HTTPVersion2},
+		Timeout:            testTimeout,
+	})
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, u.Close)
+
+	checkUpstream(t, u, addr)
+
+	doh := testutil.RequireTypeAssert[*dnsOverHTTPS](t, u)
+	tr := doh.transportH2
+	require.NotNil(t, tr)
+
+	tr.mu.Lock()
+	require.Len(t, tr.conns, 1)
+
+	first := tr.conns[0]
+
+	// Check the connections before each reuse.
+	tr.pingIdleTimeout = 0
+	tr.pingTimeout = 100 * time.Millisecond
+	tr.mu.Unlock()
+
+	t.Run("alive", func(t *testing.T) {
+		checkUpstream(t, u, addr)
+
+		tr.mu.Lock()
+		defer tr.mu.Unlock()
+
+		assert.Equal(t, []*h2Conn{first}, tr.conns)
+	})
+
+	t.Run("dead", func(t *testing.T) {
+		proxy.freeze()
+
+		checkUpstream(t, u, addr)
+
+		tr.mu.Lock()
+		defer tr.mu.Unlock()
+
+		require.Len(t, tr.conns, 1)
+
+		assert.NotSame(t, first, tr.conns[0])
+	})
+}
+
+func TestH2Transport_conn_canceled(t *testing.T) {
+	srv := startDoHServer(t, testDoHServerOptions{})
+	proxy := startFreezingProxy(t, srv.addr)
+
+	addr := (&url.URL{
+		Scheme: "https",
+		Host:   proxy.addr,
+		Path:   "dns-query",
+	}).String()
+
+	u, err := AddressToUpstream(addr, &Options{
+		Logger:             testLogger,
+		InsecureSkipVerify: true,
+		HTTPVersions:       []HTTPVersion{HTTPVersion2},
+		Timeout:            testTimeout,
+	})
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, u.Close)
+
+	checkUpstream(t, u, addr)
+
+	doh := testutil.RequireTypeAssert[*dnsOverHTTPS](t, u)
+	tr := doh.transportH2
+	require.NotNil(t, tr)
+
+	tr.mu.Lock()
+	require.Len(t, tr.conns, 1)
+
+	first := tr.conns[0]
+	tr.pingIdleTimeout = 0
+	tr.mu.Unlock()
+
+	proxy.freeze()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	c, reused, err := tr.conn(ctx, proxy.addr)
+	require.NoError(t, err)
+
+	// The check aborted by the caller doesn't close the connection.
+	assert.Same(t, first, c)
+	assert.True(t, reused)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, addr, nil)
+	require.NoError(t, err)
+
+	_, err = tr.roundTrip(req, c, reused)
+	assert.ErrorIs(t, err, context.Canceled)
+
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+
+	assert.Equal(t, []*h2Conn{first}, tr.conns)
+	assert.Zero(t, first.cc.State().StreamsReserved)
+}
+
+func TestH2Transport_h1(t *testing.T) {
+	t.Parallel()
+
+	srv := startDoHServer(t, testDoHServerOptions{http1Only: true})
+	addr := fmt.Sprintf("https://%s/dns-query", srv.addr)
+
+	testCases := []struct {
+		name     string
+		versions []HTTPVersion
+		wantErr  bool
+	}{{
+		name:     "fallback",
+		versions: []HTTPVersion{HTTPVersion11, HTTPVersion2},
+		wantErr:  false,
+	}, {
+		name:     "h2_only",
+		versions: []HTTPVersion{HTTPVersion2},
+		wantErr:  true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			u, err := AddressToUpstream(addr, &Options{
+				Logger:             testLogger,
+				InsecureSkipVerify: true,
+				HTTPVersions:       tc.versions,
+				Timeout:            testTimeout,
+			})
+			require.NoError(t, err)
+			testutil.CleanupAndRequireSuccess(t, u.Close)
+
+			req := createTestMessage()
+			resp, err := u.Exchange(req)
+			if tc.wantErr {
+				assert.ErrorIs(t, err, errNoH2)
+
+				return
+			}
+
+			require.NoError(t, err)
+			requireResponse(t, req, resp)
+
+			doh := testutil.RequireTypeAssert[*dnsOverHTTPS](t, u)
+			tr := doh.transportH2
+			require.NotNil(t, tr)
+
+			tr.mu.Lock()
+			h1Until := tr.h1Until
+			require.True(t, time.Now().Before(h1Until))
+
+			// Expire the fallback, so that HTTP/2 is tried again.
+			tr.h1Until = time.Time{}
+			tr.mu.Unlock()
+
+			checkUpstream(t, u, addr)
+
+			tr.mu.Lock()
+			defer tr.mu.Unlock()
+
+			assert.True(t, tr.h1Until.After(h1Until))
+		})
+	}
+}
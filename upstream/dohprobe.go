@@ -0,0 +1,47 @@
+package upstream
+
+import "time"
+
+// HTTPProbeStorage stores the outcomes of probing the DNS-over-HTTPS upstreams
+// for HTTP/3, see [Options.HTTPProbeStorage].  All the methods must be safe for
+// concurrent use.
+type HTTPProbeStorage interface {
+	// Load returns the HTTP version chosen for the upstream with addr and the
+	// time the choice expires at.  ok is false if there is no stored choice.
+	Load(addr string) (v HTTPVersion, expire time.Time, ok bool)
+
+	// Store saves v as the HTTP version chosen for the upstream with addr until
+	// expire.
+	Store(addr string, v HTTPVersion, expire time.Time)
+}
+
+// cachedProbe returns the HTTP version chosen by a recent probe of the
+// upstream, if any.  p.clientMu must be locked.
+func (p *dnsOverHTTPS) cachedProbe(now time.Time) (v HTTPVersion, ok bool) {
+	if p.probeTTL <= 0 {
+		return "", false
+	}
+
+	if p.probed == "" && p.probeStorage != nil {
+		p.probed, p.probedUntil, _ = p.probeStorage.Load(p.addrRedacted)
+	}
+
+	if p.probed == "" || !now.Before(p.probedUntil) {
+		return "", false
+	}
+
+	return p.probed, true
+}
+
+// storeProbe remembers v as the HTTP version chosen by the probe of the
+// upstream.  p.clientMu must be locked.
+func (p *dnsOverHTTPS) storeProbe(v HTTPVersion, now time.Time) {
+	if p.probeTTL <= 0 {
+		return
+	}
+
+	p.probed, p.probedUntil = v, now.Add(p.probeTTL)
+	if p.probeStorage != nil {
+		p.probeStorage.Store(p.addrRedacted, v, p.probedUntil)
+	}
+}
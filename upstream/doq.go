@@ -1,6 +1,7 @@
 package upstream
 
 import (
+	"cmp"
 	"context"
 	"crypto/tls"
 	"encoding/binary"
@@ -11,6 +12,7 @@ import (
 	"net/url"
 	"os"
 	"runtime"
+	"slices"
 	"sync"
 	"time"
 
@@ -38,8 +40,7 @@ const (
 	// connection. We set it to 20s as it would be in the quic-go@v0.27.1 with
 	// KeepAlive field set to true This value is specified in
 	// https://pkg.go.dev/github.com/quic-go/quic-go/internal/protocol#MaxKeepAliveInterval.
-	//
-	// TODO(ameshkov):  Consider making it configurable.
+	// It's used by default, see [Options.QUICKeepAlivePeriod].
 	QUICKeepAlivePeriod = time.Second * 20
 
 	// NextProtoDQ is the ALPN token for DoQ. During the connection establishment,
@@ -48,12 +49,52 @@ const (
 	//
 	// See https://datatracker.ietf.org/doc/rfc9250.
 	NextProtoDQ = "doq"
+
+	// NextProtoDQDraft02 is the ALPN token for the draft-02 of DoQ.  Unlike
+	// RFC 9250, the drafts don't prefix the DNS messages with their length.
+	//
+	// See https://datatracker.ietf.org/doc/html/draft-ietf-dprive-dnsoquic-02.
+	NextProtoDQDraft02 = "doq-i02"
+
+	// NextProtoDQDraft00 is the ALPN token for the draft-00 of DoQ.
+	//
+	// See https://datatracker.ietf.org/doc/html/draft-ietf-dprive-dnsoquic-00.
+	NextProtoDQDraft00 = "doq-i00"
+
+	// NextProtoDQLegacy is the ALPN token used by the DoQ implementations
+	// predating the IETF drafts.
+	NextProtoDQLegacy = "dq"
 )
 
-// compatProtoDQ is a list of ALPN tokens used by a QUIC connection.
-// NextProtoDQ is the latest draft version supported by dnsproxy, but it also
-// includes previous drafts.
-var compatProtoDQ = []string{NextProtoDQ, "doq-i00", "dq", "doq-i02"}
+// compatProtoDQ is the default list of ALPN tokens used by a QUIC connection.
+// NextProtoDQ is preferred, but the previous drafts are also included so that
+// the older servers are still supported.
+var compatProtoDQ = []string{
+	NextProtoDQ,
+	NextProtoDQDraft02,
+	NextProtoDQDraft00,
+	NextProtoDQLegacy,
+}
+
+// isDraftProtoDQ returns true if proto is the ALPN token of a DoQ draft, which
+// doesn't prefix the DNS messages with their length.
+func isDraftProtoDQ(proto string) (ok bool) {
+	return proto != NextProtoDQ && slices.Contains(compatProtoDQ, proto)
+}
+
+// validateDoQNextProtos returns an error if protos contains an unsupported or
+// a duplicated ALPN token.
+func validateDoQNextProtos(protos []string) (err error) {
+	for i, proto := range protos {
+		if !slices.Contains(compatProtoDQ, proto) {
+			return fmt.Errorf("doq next protos: at index %d: %w: %q", i, errors.ErrBadEnumValue, proto)
+		} else if slices.Contains(protos[:i], proto) {
+			return fmt.Errorf("doq next protos: at index %d: %w: %q", i, errors.ErrDuplicated, proto)
+		}
+	}
+
+	return nil
+}
 
 // dnsOverQUIC implements the [Upstream] interface for the DNS-over-QUIC
 // protocol (spec: https://www.rfc-editor.org/rfc/rfc9250.html).
@@ -74,10 +115,21 @@ type dnsOverQUIC struct {
 	// re-create the connection.
 	quicConfig *quic.Config
 
+	// quicSocket is the configuration of the sockets of the connections.
+	quicSocket quicSocket
+
+	// packedQueries keeps the packed forms of the identical queries.  It's nil
+	// if those aren't kept.  The kept slices must not be modified.
+	packedQueries *packedQueryCache[[]byte]
+
 	// conn is the current active QUIC connection.  It can be closed and
 	// re-opened when needed.
 	conn *quic.Conn
 
+	// standby is the warm standby connection promoted once conn is closed.
+	// It's nil unless [Options.WarmStandby] is set.
+	standby *connStandby[*quic.Conn]
+
 	// bytesPool is a *sync.Pool we use to store byte buffers in.  These byte
 	// buffers are used to read responses from the upstream.
 	bytesPool *sync.Pool
@@ -91,11 +143,29 @@ type dnsOverQUIC struct {
 	// bytesPoolGuard protects bytesPool.
 	bytesPoolMu *sync.Mutex
 
+	// nextProtoMu protects nextProto.
+	nextProtoMu *sync.Mutex
+
 	// logger is used for exchange logging.  It is never nil.
 	logger *slog.Logger
 
+	// stats are the statistics of the connections.  It is never nil.
+	stats *connStats
+
+	// questions handles the responses with mismatched questions.  It is never
+	// nil.
+	questions *questionChecker
+
+	// nextProto is the ALPN token negotiated for the latest connection.  It
+	// determines the framing of the messages sent as 0-RTT data.
+	nextProto string
+
 	// timeout is the timeout for the upstream connection.
 	timeout time.Duration
+
+	// closed is true when the upstream has been closed.  It's protected by
+	// connMu.
+	closed bool
 }
 
 // quicStream is the interface of QUIC stream used by readMsg to simplify
@@ -117,21 +187,31 @@ var _ quicStream = (*quic.Stream)(nil)
 
 // newDoQ returns the DNS-over-QUIC Upstream.
 func newDoQ(addr *url.URL, opts *Options) (u Upstream, err error) {
-	addPort(addr, defaultPortDoQ)
+	err = validateQUIC(opts)
+	if err == nil {
+		err = validateDoQNextProtos(opts.DoQNextProtos)
+	}
 
-	quicConf := &quic.Config{
-		KeepAlivePeriod: QUICKeepAlivePeriod,
-		TokenStore:      newQUICTokenStore(),
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return nil, err
 	}
 
-	if opts.QUICTracer != nil {
-		quicConf.Tracer = opts.QUICTracer.TraceForConnection
+	addPort(addr, defaultPortDoQ)
+
+	nextProtos := compatProtoDQ
+	if len(opts.DoQNextProtos) > 0 {
+		nextProtos = opts.DoQNextProtos
 	}
 
-	u = &dnsOverQUIC{
+	stats := newConnStats()
+	ups := &dnsOverQUIC{
 		getDialer:  newDialerInitializer(addr, opts),
 		addr:       addr,
-		quicConfig: quicConf,
+		quicConfig: newQUICConfig(opts),
+		quicSocket: newQUICSocket(opts),
+
+		packedQueries: newPackedQueryCache[[]byte](opts.PackedQueryTTL),
 		tlsConf: &tls.Config{
 			ServerName:   addr.Hostname(),
 			RootCAs:      opts.RootCAs,
@@ -146,28 +226,49 @@ func newDoQ(addr *url.URL, opts *Options) (u Upstream, err error) {
 			InsecureSkipVerify:    opts.InsecureSkipVerify,
 			VerifyPeerCertificate: opts.VerifyServerCertificate,
 			VerifyConnection:      opts.VerifyConnection,
-			NextProtos:            compatProtoDQ,
+			NextProtos:            slices.Clone(nextProtos),
 		},
 		quicConfigMu: &sync.Mutex{},
 		connMu:       &sync.Mutex{},
 		bytesPoolMu:  &sync.Mutex{},
+		nextProtoMu:  &sync.Mutex{},
 		logger:       opts.Logger,
+		stats:        stats,
+		questions:    newQuestionChecker(opts, stats),
 		timeout:      opts.Timeout,
 	}
 
-	runtime.SetFinalizer(u, (*dnsOverQUIC).Close)
+	if opts.WarmStandby {
+		ups.standby = newConnStandby(opts.Logger, isQUICConnAlive, closeQUICConn)
+	}
+
+	setCloseFinalizer(ups, opts)
 
-	return u, nil
+	return ups, nil
 }
 
 // type check
-var _ Upstream = (*dnsOverQUIC)(nil)
+var _ ConnStatsReporter = (*dnsOverQUIC)(nil)
 
 // Address implements the [Upstream] interface for *dnsOverQUIC.
 func (p *dnsOverQUIC) Address() string { return p.addr.String() }
 
+// ConnStats implements the [ConnStatsReporter] interface for *dnsOverQUIC.
+func (p *dnsOverQUIC) ConnStats() (s *ConnStats) { return p.stats.clone() }
+
 // Exchange implements the [Upstream] interface for *dnsOverQUIC.
 func (p *dnsOverQUIC) Exchange(req *dns.Msg) (resp *dns.Msg, err error) {
+	return p.ExchangeContext(context.Background(), req)
+}
+
+// type check
+var _ ContextExchanger = (*dnsOverQUIC)(nil)
+
+// ExchangeContext implements the [ContextExchanger] interface for
+// *dnsOverQUIC.
+func (p *dnsOverQUIC) ExchangeContext(ctx context.Context, req *dns.Msg) (resp *dns.Msg, err error) {
+	defer func() { p.stats.exchanged(err) }()
+
 	// When sending queries over a QUIC connection, the DNS Message ID MUST be
 	// set to 0.  The stream mapping for DoQ allows for unambiguous correlation
 	// of queries and responses, so the Message ID field is not required.
@@ -184,13 +285,13 @@ func (p *dnsOverQUIC) Exchange(req *dns.Msg) (resp *dns.Msg, err error) {
 	}()
 
 	// Gets or opens a QUIC connection to use for this query.
-	conn, cached, err := p.getConnection()
+	conn, cached, err := p.getConnection(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("getting conn: %w", err)
 	}
 
 	// Make the first attempt to send the DNS query.
-	resp, err = p.exchangeQUIC(req, conn)
+	resp, err = p.exchangeQUIC(ctx, req, conn)
 
 	// Failure to use a cached connection should be handled gracefully as this
 	// connection could have been closed by the server or simply be broken due
@@ -204,22 +305,33 @@ func (p *dnsOverQUIC) Exchange(req *dns.Msg) (resp *dns.Msg, err error) {
 
 		// Get or re-create the QUIC connection in order to make the second
 		// attempt.
-		conn, _, err = p.getConnection()
+		conn, _, err = p.getConnection(ctx)
 		if err != nil {
 			return nil, fmt.Errorf("getting new conn: %w", err)
 		}
 
 		// Retry sending the request through the new connection.
-		resp, err = p.exchangeQUIC(req, conn)
+		resp, err = p.exchangeQUIC(ctx, req, conn)
 	}
 
 	if err != nil {
 		// If we're unable to exchange messages, make sure the connection is
 		// closed and signal about an internal error.
 		p.closeConnWithError(conn, err)
+
+		return resp, err
+	}
+
+	// Dial the standby connection only after a successful exchange, so that
+	// it resumes the session of the active one.
+	p.standby.refill(p.openConnection)
+
+	err = p.questions.check(req, resp)
+	if err != nil {
+		return nil, fmt.Errorf("validating response: %w", err)
 	}
 
-	return resp, err
+	return resp, nil
 }
 
 // Close implements the [Upstream] interface for *dnsOverQUIC.
@@ -229,6 +341,8 @@ func (p *dnsOverQUIC) Close() (err error) {
 
 	runtime.SetFinalizer(p, nil)
 
+	p.closed = true
+	p.standby.shutdown()
 	if p.conn != nil {
 		err = p.conn.CloseWithError(QUICCodeNoError, "")
 	}
@@ -238,18 +352,33 @@ func (p *dnsOverQUIC) Close() (err error) {
 
 // exchangeQUIC attempts to open a new QUIC stream, send the DNS message
 // through it and return the response it got from the server.
-func (p *dnsOverQUIC) exchangeQUIC(req *dns.Msg, conn *quic.Conn) (resp *dns.Msg, err error) {
+func (p *dnsOverQUIC) exchangeQUIC(
+	ctx context.Context,
+	req *dns.Msg,
+	conn *quic.Conn,
+) (resp *dns.Msg, err error) {
 	addr := p.Address()
 
 	logBegin(p.logger, addr, networkUDP, req)
 	defer func() { logFinish(p.logger, addr, networkUDP, err) }()
 
-	buf, err := req.Pack()
+	buf, err := p.packedQueries.pack(req, time.Now(), (*dns.Msg).Pack)
 	if err != nil {
 		return nil, fmt.Errorf("failed to pack DNS message for DoQ: %w", err)
 	}
 
-	stream, err := p.openStream(conn)
+	proto, err := p.negotiatedProto(ctx, conn)
+	if err != nil {
+		return nil, fmt.Errorf("getting negotiated protocol: %w", err)
+	}
+
+	// The drafts of DoQ don't prefix the messages with their length.
+	draft := isDraftProtoDQ(proto)
+	if !draft {
+		buf = proxyutil.AddPrefix(buf)
+	}
+
+	stream, err := p.openStream(ctx, conn)
 	if err != nil {
 		return nil, fmt.Errorf("opening stream: %w", err)
 	}
@@ -261,7 +390,7 @@ func (p *dnsOverQUIC) exchangeQUIC(req *dns.Msg, conn *quic.Conn) (resp *dns.Msg
 		}
 	}
 
-	_, err = stream.Write(proxyutil.AddPrefix(buf))
+	_, err = stream.Write(buf)
 	if err != nil {
 		return nil, fmt.Errorf("failed to write to a QUIC stream: %w", err)
 	}
@@ -275,7 +404,54 @@ func (p *dnsOverQUIC) exchangeQUIC(req *dns.Msg, conn *quic.Conn) (resp *dns.Msg
 		p.logger.Debug("closing quic stream", slogutil.KeyError, err)
 	}
 
-	return p.readMsg(stream)
+	return p.readMsg(stream, draft)
+}
+
+// negotiatedProto returns the ALPN token negotiated for conn.  If the
+// handshake isn't complete yet, i.e. the query is about to be sent as 0-RTT
+// data, the token negotiated for the latest connection is returned, since
+// 0-RTT is only possible within a session resumed with the same token.
+func (p *dnsOverQUIC) negotiatedProto(
+	ctx context.Context,
+	conn *quic.Conn,
+) (proto string, err error) {
+	proto = conn.ConnectionState().TLS.NegotiatedProtocol
+	if proto == "" {
+		proto = p.latestNextProto()
+	}
+
+	if proto != "" {
+		return proto, nil
+	}
+
+	ctx, cancel := p.withDeadline(ctx)
+	defer cancel()
+
+	select {
+	case <-conn.HandshakeComplete():
+		return conn.ConnectionState().TLS.NegotiatedProtocol, nil
+	case <-ctx.Done():
+		return "", context.Cause(ctx)
+	}
+}
+
+// latestNextProto returns the ALPN token negotiated for the latest connection.
+func (p *dnsOverQUIC) latestNextProto() (proto string) {
+	p.nextProtoMu.Lock()
+	defer p.nextProtoMu.Unlock()
+
+	return p.nextProto
+}
+
+// setNextProto stores the ALPN token negotiated for conn once its handshake is
+// complete.
+func (p *dnsOverQUIC) setNextProto(conn *quic.Conn) {
+	proto := conn.ConnectionState().TLS.NegotiatedProtocol
+
+	p.nextProtoMu.Lock()
+	defer p.nextProtoMu.Unlock()
+
+	p.nextProto = proto
 }
 
 // getBytesPool returns (creates if needed) a pool we store byte buffers in.
@@ -297,8 +473,11 @@ func (p *dnsOverQUIC) getBytesPool() (pool *sync.Pool) {
 }
 
 // getConnection opens or returns an existing *quic.Conn and indicates whether
-// it opened a new connection or used an existing cached one.
-func (p *dnsOverQUIC) getConnection() (conn *quic.Conn, cached bool, err error) {
+// it opened a new connection or used an existing cached one.  ctx is used to
+// dial the new connection.
+func (p *dnsOverQUIC) getConnection(
+	ctx context.Context,
+) (conn *quic.Conn, cached bool, err error) {
 	p.connMu.Lock()
 	defer p.connMu.Unlock()
 
@@ -307,14 +486,108 @@ func (p *dnsOverQUIC) getConnection() (conn *quic.Conn, cached bool, err error)
 		return conn, true, nil
 	}
 
-	conn, err = p.openConnection()
-	if err != nil {
-		return nil, false, err
+	// The standby connection may have been closed by the server meanwhile, so
+	// consider it cached.
+	conn, cached = p.standby.take(p.openConnection)
+	if !cached {
+		conn, err = p.openConnection(ctx)
+		if err != nil {
+			return nil, false, err
+		}
+	}
+
+	p.conn = conn
+	go p.watchConnection(conn)
+
+	return conn, cached, nil
+}
+
+// watchConnection records the establishment of conn in the statistics and
+// waits for it to be closed.  Unless it has already been replaced, conn is then
+// removed from the cache.  If the connection was closed because the server
+// stopped responding to keep-alive PINGs, the standby one is promoted or a new
+// one is opened right away so that the next query doesn't have to discover the
+// dead path.  It's intended to be used as a goroutine.
+func (p *dnsOverQUIC) watchConnection(conn *quic.Conn) {
+	defer slogutil.RecoverAndLog(context.Background(), p.logger)
+
+	p.stats.connectedQUIC(conn, "")
+
+	select {
+	case <-conn.HandshakeComplete():
+		p.setNextProto(conn)
+	default:
+		// The connection has been closed before the handshake.
+	}
+
+	<-conn.Context().Done()
+
+	if !p.dropConnection(conn) {
+		return
+	}
+
+	cause := context.Cause(conn.Context())
+	if !isQUICIdleTimeout(cause) {
+		p.logger.Debug("cached quic connection closed", slogutil.KeyError, cause)
+
+		return
+	}
+
+	p.logger.Debug("quic connection timed out, reconnecting", slogutil.KeyError, cause)
+
+	// Dial without holding connMu, so that the queries aren't blocked by a
+	// stalled dial.
+	newConn, ok := p.standby.take(p.openConnection)
+	if !ok {
+		ctx, cancel := p.withDeadline(context.Background())
+		defer cancel()
+
+		var err error
+		newConn, err = p.openConnection(ctx)
+		if err != nil {
+			p.logger.Debug("reconnecting", slogutil.KeyError, err)
+
+			return
+		}
+	}
+
+	if !p.setConnection(newConn) {
+		_ = newConn.CloseWithError(QUICCodeNoError, "")
+
+		return
+	}
+
+	go p.watchConnection(newConn)
+}
+
+// dropConnection removes conn from the cache.  ok is false if p is closed or
+// conn has already been replaced.
+func (p *dnsOverQUIC) dropConnection(conn *quic.Conn) (ok bool) {
+	p.connMu.Lock()
+	defer p.connMu.Unlock()
+
+	if p.closed || p.conn != conn {
+		return false
+	}
+
+	p.conn = nil
+
+	return true
+}
+
+// setConnection caches conn unless p is closed or another connection has been
+// opened meanwhile, in which case ok is false and the caller must close conn.
+func (p *dnsOverQUIC) setConnection(conn *quic.Conn) (ok bool) {
+	p.connMu.Lock()
+	defer p.connMu.Unlock()
+
+	if p.closed || p.conn != nil {
+		return false
 	}
 
 	p.conn = conn
 
-	return conn, false, nil
+	return true
 }
 
 // getQUICConfig returns the QUIC config in a thread-safe manner.  Note, that
@@ -337,8 +610,8 @@ func (p *dnsOverQUIC) resetQUICConfig() {
 }
 
 // openStream opens a new QUIC stream for the specified connection.
-func (p *dnsOverQUIC) openStream(conn *quic.Conn) (*quic.Stream, error) {
-	ctx, cancel := p.withDeadline(context.Background())
+func (p *dnsOverQUIC) openStream(ctx context.Context, conn *quic.Conn) (*quic.Stream, error) {
+	ctx, cancel := p.withDeadline(ctx)
 	defer cancel()
 
 	stream, err := conn.OpenStreamSync(ctx)
@@ -349,8 +622,9 @@ func (p *dnsOverQUIC) openStream(conn *quic.Conn) (*quic.Stream, error) {
 	return stream, nil
 }
 
-// openConnection dials a new QUIC connection.
-func (p *dnsOverQUIC) openConnection() (conn *quic.Conn, err error) {
+// openConnection dials a new QUIC connection.  The dial is aborted once ctx is
+// canceled.
+func (p *dnsOverQUIC) openConnection(ctx context.Context) (conn *quic.Conn, err error) {
 	dialContext, err := p.getDialer()
 	if err != nil {
 		return nil, fmt.Errorf("bootstrapping %s: %w", p.addr, err)
@@ -359,7 +633,7 @@ func (p *dnsOverQUIC) openConnection() (conn *quic.Conn, err error) {
 	// we're using bootstrapped address instead of what's passed to the function
 	// it does not create an actual connection, but it helps us determine
 	// what IP is actually reachable (when there're v4/v6 addresses).
-	rawConn, err := dialContext(context.Background(), "udp", "")
+	rawConn, err := dialContext(ctx, "udp", "")
 	if err != nil {
 		return nil, fmt.Errorf("dialing raw connection to %s: %w", p.addr, err)
 	}
@@ -377,10 +651,10 @@ func (p *dnsOverQUIC) openConnection() (conn *quic.Conn, err error) {
 
 	addr := udpConn.RemoteAddr().String()
 
-	ctx, cancel := p.withDeadline(context.Background())
+	ctx, cancel := p.withDeadline(ctx)
 	defer cancel()
 
-	conn, err = quic.DialAddrEarly(ctx, addr, p.tlsConf.Clone(), p.getQUICConfig())
+	conn, err = p.quicSocket.dial(ctx, addr, p.tlsConf.Clone(), p.getQUICConfig())
 	if err != nil {
 		return nil, fmt.Errorf("dialing quic connection to %s: %w", p.addr, err)
 	}
@@ -388,6 +662,16 @@ func (p *dnsOverQUIC) openConnection() (conn *quic.Conn, err error) {
 	return conn, nil
 }
 
+// isQUICConnAlive returns true if conn hasn't been closed yet.
+func isQUICConnAlive(conn *quic.Conn) (ok bool) {
+	return conn.Context().Err() == nil
+}
+
+// closeQUICConn closes conn without an error.
+func closeQUICConn(conn *quic.Conn) (err error) {
+	return conn.CloseWithError(QUICCodeNoError, "")
+}
+
 // closeConnWithError closes the active connection with error to make sure that
 // new queries were processed in another connection.  We can do that in the case
 // of a fatal error.
@@ -416,10 +700,15 @@ func (p *dnsOverQUIC) closeConnWithError(conn *quic.Conn, err error) {
 	}
 }
 
-// readMsg reads the incoming DNS message from the QUIC stream.
-func (p *dnsOverQUIC) readMsg(stream quicStream) (m *dns.Msg, err error) {
+// readMsg reads the incoming DNS message from the QUIC stream.  draft is true
+// if the message isn't prefixed with its length, as in the drafts of DoQ.
+func (p *dnsOverQUIC) readMsg(stream quicStream, draft bool) (m *dns.Msg, err error) {
 	defer func() { err = errors.Annotate(err, "from %s: %w", p.addr) }()
 
+	if draft {
+		return p.readDraftMsg(stream)
+	}
+
 	var lenBuf [2]byte
 	_, err = io.ReadFull(stream, lenBuf[:])
 	if err != nil {
@@ -458,6 +747,31 @@ func (p *dnsOverQUIC) readMsg(stream quicStream) (m *dns.Msg, err error) {
 	return m, nil
 }
 
+// readDraftMsg reads the incoming DNS message, which isn't prefixed with its
+// length, from the QUIC stream until the server closes it.
+func (p *dnsOverQUIC) readDraftMsg(stream quicStream) (m *dns.Msg, err error) {
+	pool := p.getBytesPool()
+	bufPtr := pool.Get().(*[]byte)
+	defer pool.Put(bufPtr)
+
+	respBuf := *bufPtr
+
+	n, err := io.ReadFull(stream, respBuf)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil, fmt.Errorf("reading response: %w", err)
+	}
+
+	stream.CancelRead(0)
+
+	m = &dns.Msg{}
+	err = m.Unpack(respBuf[:n])
+	if err != nil {
+		return nil, fmt.Errorf("unpacking response: %w", err)
+	}
+
+	return m, nil
+}
+
 // newQUICTokenStore creates a new quic.TokenStore that is necessary to have
 // in order to benefit from 0-RTT.
 func newQUICTokenStore() (s quic.TokenStore) {
@@ -468,6 +782,101 @@ func newQUICTokenStore() (s quic.TokenStore) {
 	return quic.NewLRUTokenStore(1, 10)
 }
 
+// supportedQUICVersions are the QUIC versions allowed in
+// [Options.QUICVersions].
+var supportedQUICVersions = []quic.Version{quic.Version1, quic.Version2}
+
+// validateQUIC returns an error if the QUIC options of opts are invalid.
+func validateQUIC(opts *Options) (err error) {
+	for i, v := range opts.QUICVersions {
+		if !slices.Contains(supportedQUICVersions, v) {
+			return fmt.Errorf("quic versions: at index %d: %w: %s", i, errors.ErrBadEnumValue, v)
+		}
+	}
+
+	if opts.QUICMaxIdleTimeout < 0 {
+		return fmt.Errorf(
+			"quic max idle timeout: %w: %s",
+			errors.ErrNegative,
+			opts.QUICMaxIdleTimeout,
+		)
+	}
+
+	initStream := opts.QUICInitialStreamReceiveWindow
+	maxStream := opts.QUICMaxStreamReceiveWindow
+	if initStream > 0 && maxStream > 0 && maxStream < initStream {
+		return fmt.Errorf(
+			"quic max stream receive window: %w: %d is less than initial %d",
+			errors.ErrOutOfRange,
+			maxStream,
+			initStream,
+		)
+	}
+
+	initConn := opts.QUICInitialConnectionReceiveWindow
+	maxConn := opts.QUICMaxConnectionReceiveWindow
+	if initConn > 0 && maxConn > 0 && maxConn < initConn {
+		return fmt.Errorf(
+			"quic max connection receive window: %w: %d is less than initial %d",
+			errors.ErrOutOfRange,
+			maxConn,
+			initConn,
+		)
+	}
+
+	return nil
+}
+
+// newQUICConfig returns a new QUIC configuration for the client connections
+// made by DNS-over-QUIC and DNS-over-HTTP/3 upstreams.  opts must not be nil.
+func newQUICConfig(opts *Options) (conf *quic.Config) {
+	conf = &quic.Config{
+		Versions:        slices.Clone(opts.QUICVersions),
+		MaxIdleTimeout:  opts.QUICMaxIdleTimeout,
+		KeepAlivePeriod: cmp.Or(opts.QUICKeepAlivePeriod, QUICKeepAlivePeriod),
+		TokenStore:      newQUICTokenStore(),
+		EnableDatagrams: opts.QUICEnableDatagrams,
+
+		InitialStreamReceiveWindow:     opts.QUICInitialStreamReceiveWindow,
+		MaxStreamReceiveWindow:         opts.QUICMaxStreamReceiveWindow,
+		InitialConnectionReceiveWindow: opts.QUICInitialConnectionReceiveWindow,
+		MaxConnectionReceiveWindow:     opts.QUICMaxConnectionReceiveWindow,
+	}
+
+	if opts.QUICTracer != nil {
+		conf.Tracer = opts.QUICTracer.TraceForConnection
+	}
+
+	return conf
+}
+
+// isQUICIdleTimeout returns true if err means that the QUIC connection has
+// been closed due to the idle timeout, i.e. the peer stopped responding to
+// keep-alive PINGs.
+func isQUICIdleTimeout(err error) (ok bool) {
+	var qIdleErr *quic.IdleTimeoutError
+
+	return errors.As(err, &qIdleErr)
+}
+
+// isQUICErrorClose returns true if the QUIC connection has been closed with
+// cause because of an error, i.e. neither gracefully by either side nor
+// because of the idle timeout.
+func isQUICErrorClose(cause error) (ok bool) {
+	if isQUICIdleTimeout(cause) {
+		return false
+	}
+
+	var qAppErr *quic.ApplicationError
+	if !errors.As(cause, &qAppErr) {
+		return true
+	}
+
+	return qAppErr.Remote &&
+		qAppErr.ErrorCode != QUICCodeNoError &&
+		qAppErr.ErrorCode != quic.ApplicationErrorCode(http3.ErrCodeNoError)
+}
+
 // isQUICRetryError checks the error and determines whether it may signal that
 // we should re-create the QUIC connection.  This requirement is caused by
 // quic-go issues, see the comments inside this function.
@@ -486,8 +895,7 @@ func isQUICRetryError(err error) (ok bool) {
 		}
 	}
 
-	var qIdleErr *quic.IdleTimeoutError
-	if errors.As(err, &qIdleErr) {
+	if isQUICIdleTimeout(err) {
 		// This error means that the connection was closed due to being idle.
 		// In this case we should forcibly re-create the QUIC connection.
 		// Reproducing is rather simple, stop the server and wait for 30 seconds
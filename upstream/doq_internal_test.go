@@ -77,6 +77,249 @@ func TestDNSOverQUIC(t *testing.T) {
 	checkRaceCondition(u)
 }
 
+func TestDNSOverQUIC_quicOptions(t *testing.T) {
+	tlsConf, rootCAs := createServerTLSConfig(t, "127.0.0.1")
+
+	srv := startDoQServer(t, tlsConf, 0)
+
+	address := fmt.Sprintf("quic://%s", srv.addr)
+	u, err := AddressToUpstream(address, &Options{
+		Logger:              testLogger,
+		RootCAs:             rootCAs,
+		QUICVersions:        []quic.Version{quic.Version2},
+		QUICMaxIdleTimeout:  time.Minute,
+		QUICEnableDatagrams: true,
+
+		QUICInitialStreamReceiveWindow: 1 << 10,
+		QUICMaxStreamReceiveWindow:     1 << 16,
+	})
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, u.Close)
+
+	checkUpstream(t, u, address)
+
+	uq := testutil.RequireTypeAssert[*dnsOverQUIC](t, u)
+
+	uq.connMu.Lock()
+	defer uq.connMu.Unlock()
+
+	require.NotNil(t, uq.conn)
+
+	state := uq.conn.ConnectionState()
+	assert.Equal(t, quic.Version2, state.Version)
+	assert.True(t, state.SupportsDatagrams.Local)
+}
+
+func TestDNSOverQUIC_quicSocket(t *testing.T) {
+	tlsConf, rootCAs := createServerTLSConfig(t, "127.0.0.1")
+
+	srv := startDoQServer(t, tlsConf, 0)
+
+	address := fmt.Sprintf("quic://%s", srv.addr)
+	u, err := AddressToUpstream(address, &Options{
+		Logger:             testLogger,
+		RootCAs:            rootCAs,
+		QUICDisableOffload: true,
+		QUICFlowLabel:      true,
+	})
+	require.NoError(t, err)
+
+	checkUpstream(t, u, address)
+
+	uq := testutil.RequireTypeAssert[*dnsOverQUIC](t, u)
+
+	uq.connMu.Lock()
+	conn := uq.conn
+	uq.connMu.Unlock()
+
+	require.NotNil(t, conn)
+
+	require.NoError(t, u.Close())
+	assert.Error(t, conn.Context().Err())
+
+	// The connection mustn't look like capable of the UDP optimizations.
+	_, ok := any(noOffloadConn{}).(interface {
+		ReadMsgUDP(b, oob []byte) (n, oobn, flags int, addr *net.UDPAddr, err error)
+	})
+	assert.False(t, ok)
+}
+
+func TestDNSOverQUIC_nextProtos(t *testing.T) {
+	testCases := []struct {
+		name         string
+		clientProtos []string
+		serverProtos []string
+		wantProto    string
+	}{{
+		name:         "rfc",
+		clientProtos: nil,
+		serverProtos: []string{NextProtoDQ},
+		wantProto:    NextProtoDQ,
+	}, {
+		name:         "draft_fallback",
+		clientProtos: nil,
+		serverProtos: []string{NextProtoDQDraft02, NextProtoDQLegacy},
+		wantProto:    NextProtoDQDraft02,
+	}, {
+		name:         "draft_only",
+		clientProtos: []string{NextProtoDQDraft00},
+		serverProtos: []string{NextProtoDQ, NextProtoDQDraft00},
+		wantProto:    NextProtoDQDraft00,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			tlsConf, rootCAs := createServerTLSConfig(t, "127.0.0.1")
+			tlsConf.NextProtos = tc.serverProtos
+
+			srv := startDoQServer(t, tlsConf, 0)
+
+			address := fmt.Sprintf("quic://%s", srv.addr)
+			u, err := AddressToUpstream(address, &Options{
+				Logger:        testLogger,
+				RootCAs:       rootCAs,
+				DoQNextProtos: tc.clientProtos,
+			})
+			require.NoError(t, err)
+			testutil.CleanupAndRequireSuccess(t, u.Close)
+
+			// Check the resumed connection as well.
+			for range 2 {
+				checkUpstream(t, u, address)
+
+				uq := testutil.RequireTypeAssert[*dnsOverQUIC](t, u)
+				assert.Equal(t, tc.wantProto, uq.latestNextProto())
+
+				uq.connMu.Lock()
+				conn := uq.conn
+				uq.connMu.Unlock()
+
+				require.NotNil(t, conn)
+
+				uq.closeConnWithError(conn, nil)
+			}
+		})
+	}
+}
+
+func TestValidateDoQNextProtos(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		wantErr error
+		name    string
+		protos  []string
+	}{{
+		wantErr: nil,
+		name:    "empty",
+		protos:  nil,
+	}, {
+		wantErr: nil,
+		name:    "valid",
+		protos:  []string{NextProtoDQDraft02, NextProtoDQ},
+	}, {
+		wantErr: errors.ErrBadEnumValue,
+		name:    "unsupported",
+		protos:  []string{NextProtoDQ, "h3"},
+	}, {
+		wantErr: errors.ErrDuplicated,
+		name:    "duplicated",
+		protos:  []string{NextProtoDQ, NextProtoDQDraft00, NextProtoDQ},
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			err := validateDoQNextProtos(tc.protos)
+			assert.ErrorIs(t, err, tc.wantErr)
+		})
+	}
+}
+
+func TestValidateQUIC(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		opts    *Options
+		wantErr error
+		name    string
+	}{{
+		opts:    &Options{},
+		wantErr: nil,
+		name:    "empty",
+	}, {
+		opts: &Options{
+			QUICVersions:                   []quic.Version{quic.Version2, quic.Version1},
+			QUICMaxIdleTimeout:             time.Minute,
+			QUICInitialStreamReceiveWindow: 1 << 10,
+			QUICMaxStreamReceiveWindow:     1 << 10,
+		},
+		wantErr: nil,
+		name:    "valid",
+	}, {
+		opts: &Options{
+			QUICVersions: []quic.Version{quic.Version1, 0xff00001d},
+		},
+		wantErr: errors.ErrBadEnumValue,
+		name:    "bad_version",
+	}, {
+		opts: &Options{
+			QUICMaxIdleTimeout: -time.Second,
+		},
+		wantErr: errors.ErrNegative,
+		name:    "negative_idle_timeout",
+	}, {
+		opts: &Options{
+			QUICInitialStreamReceiveWindow: 1 << 16,
+			QUICMaxStreamReceiveWindow:     1 << 10,
+		},
+		wantErr: errors.ErrOutOfRange,
+		name:    "stream_window",
+	}, {
+		opts: &Options{
+			QUICInitialConnectionReceiveWindow: 1 << 16,
+			QUICMaxConnectionReceiveWindow:     1 << 10,
+		},
+		wantErr: errors.ErrOutOfRange,
+		name:    "connection_window",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			err := validateQUIC(tc.opts)
+			assert.ErrorIs(t, err, tc.wantErr)
+		})
+	}
+}
+
+func TestDNSOverQUIC_ExchangeContext_canceled(t *testing.T) {
+	tlsConf, rootCAs := createServerTLSConfig(t, "127.0.0.1")
+
+	srv := startDoQServer(t, tlsConf, 0)
+
+	address := fmt.Sprintf("quic://%s", srv.addr)
+	u, err := AddressToUpstream(address, &Options{
+		Logger:  testLogger,
+		RootCAs: rootCAs,
+	})
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, u.Close)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err = ExchangeContext(ctx, u, createTestMessage())
+	require.ErrorIs(t, err, context.Canceled)
+
+	uq := testutil.RequireTypeAssert[*dnsOverQUIC](t, u)
+	require.Nil(t, uq.conn)
+
+	checkUpstream(t, u, address)
+}
+
 func TestDNSOverQUIC_Exchange_quicCloseConn(t *testing.T) {
 	// Use the same tlsConf for all servers to preserve the data necessary for
 	// 0-RTT connections.
@@ -232,6 +475,73 @@ func TestDNSOverQUIC_0RTT(t *testing.T) {
 	require.True(t, conns[1].is0RTT())
 }
 
+func TestDNSOverQUIC_watchConnection(t *testing.T) {
+	tlsConf, rootCAs := createServerTLSConfig(t, "127.0.0.1")
+
+	srv := startDoQServer(t, tlsConf, 0)
+
+	address := fmt.Sprintf("quic://%s", srv.addr)
+	u, err := AddressToUpstream(address, &Options{
+		Logger:              testLogger,
+		RootCAs:             rootCAs,
+		QUICKeepAlivePeriod: time.Second,
+	})
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, u.Close)
+
+	uq := testutil.RequireTypeAssert[*dnsOverQUIC](t, u)
+	assert.Equal(t, time.Second, uq.getQUICConfig().KeepAlivePeriod)
+
+	checkUpstream(t, u, address)
+
+	err = srv.closeConns()
+	require.NoError(t, err)
+
+	// The connection closed by the server should be removed from the cache
+	// without any query sent through it.
+	require.Eventually(t, func() (ok bool) {
+		uq.connMu.Lock()
+		defer uq.connMu.Unlock()
+
+		return uq.conn == nil
+	}, testTimeout, testTimeout/10)
+
+	checkUpstream(t, u, address)
+}
+
+func TestDNSOverQUIC_warmStandby(t *testing.T) {
+	tlsConf, rootCAs := createServerTLSConfig(t, "127.0.0.1")
+
+	srv := startDoQServer(t, tlsConf, 0)
+
+	address := fmt.Sprintf("quic://%s", srv.addr)
+	u, err := AddressToUpstream(address, &Options{
+		Logger:      testLogger,
+		RootCAs:     rootCAs,
+		WarmStandby: true,
+	})
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, u.Close)
+
+	uq := testutil.RequireTypeAssert[*dnsOverQUIC](t, u)
+
+	checkUpstream(t, u, address)
+	standby := requireStandby(t, uq.standby)
+	<-standby.HandshakeComplete()
+	assert.True(t, standby.ConnectionState().TLS.DidResume)
+
+	uq.closeConnWithError(uq.conn, errors.Error("test error"))
+
+	checkUpstream(t, u, address)
+
+	uq.connMu.Lock()
+	promoted := uq.conn
+	uq.connMu.Unlock()
+
+	assert.Same(t, standby, promoted)
+	assert.NotSame(t, standby, requireStandby(t, uq.standby))
+}
+
 func TestDNSOverQUIC_ReadMsg_partialRead(t *testing.T) {
 	oldReq := createHostTestMessage("old.example")
 	oldResp := (&dns.Msg{}).SetReply(oldReq)
@@ -307,7 +617,7 @@ func TestDNSOverQUIC_ReadMsg_partialRead(t *testing.T) {
 		},
 	}
 
-	got, err := doq.readMsg(stream)
+	got, err := doq.readMsg(stream, false)
 	require.NoError(t, err)
 	require.Len(t, got.Answer, 1)
 
@@ -402,7 +712,8 @@ func (s *testDoQServer) handleQUICConnection(conn *quic.Conn) {
 		}
 
 		go func() {
-			qErr := s.handleQUICStream(ctx, stream)
+			draft := isDraftProtoDQ(conn.ConnectionState().TLS.NegotiatedProtocol)
+			qErr := s.handleQUICStream(ctx, stream, draft)
 			if qErr != nil {
 				s.logger.Error("handling", "raddr", conn.RemoteAddr(), slogutil.KeyError, qErr)
 
@@ -413,21 +724,27 @@ func (s *testDoQServer) handleQUICConnection(conn *quic.Conn) {
 }
 
 // handleQUICStream handles new QUIC streams, reads DNS messages and responds to
-// them.
-func (s *testDoQServer) handleQUICStream(ctx context.Context, stream *quic.Stream) (err error) {
+// them.  draft is true if the messages aren't prefixed with their length.
+func (s *testDoQServer) handleQUICStream(
+	ctx context.Context,
+	stream *quic.Stream,
+	draft bool,
+) (err error) {
 	defer slogutil.CloseAndLog(ctx, s.logger, stream, slog.LevelDebug)
 
-	buf := make([]byte, dns.MaxMsgSize+2)
-	_, err = stream.Read(buf)
-	if err != nil && err != io.EOF {
+	buf, err := io.ReadAll(io.LimitReader(stream, dns.MaxMsgSize+2))
+	if err != nil {
 		return err
 	}
 
 	stream.CancelRead(0)
 
+	if !draft {
+		buf = buf[2:]
+	}
+
 	req := &dns.Msg{}
-	packetLen := binary.BigEndian.Uint16(buf[:2])
-	err = req.Unpack(buf[2 : packetLen+2])
+	err = req.Unpack(buf)
 	if err != nil {
 		return err
 	}
@@ -439,7 +756,10 @@ func (s *testDoQServer) handleQUICStream(ctx context.Context, stream *quic.Strea
 		return err
 	}
 
-	buf = proxyutil.AddPrefix(buf)
+	if !draft {
+		buf = proxyutil.AddPrefix(buf)
+	}
+
 	_, err = stream.Write(buf)
 
 	return err
@@ -486,9 +806,12 @@ func (s *testDoQServer) closeConns() (err error) {
 }
 
 // startDoQServer starts a test DoQ server.  Note that it adds its own shutdown
-// to cleanup of t.
+// to cleanup of t.  If tlsConf has no NextProtos, only [NextProtoDQ] is
+// supported.
 func startDoQServer(t *testing.T, tlsConf *tls.Config, port int) (s *testDoQServer) {
-	tlsConf.NextProtos = []string{NextProtoDQ}
+	if len(tlsConf.NextProtos) == 0 {
+		tlsConf.NextProtos = []string{NextProtoDQ}
+	}
 
 	udpAddr, err := net.ResolveUDPAddr("udp", fmt.Sprintf("127.0.0.1:%d", port))
 	require.NoError(t, err)
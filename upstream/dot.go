@@ -1,6 +1,7 @@
 package upstream
 
 import (
+	"cmp"
 	"context"
 	"crypto/tls"
 	"fmt"
@@ -19,7 +20,7 @@ import (
 	"github.com/miekg/dns"
 )
 
-// dialTimeout is the global timeout for establishing a TLS connection.
+// dialTimeout is the default timeout for establishing a TLS connection.
 // TODO(ameshkov): use bootstrap timeout instead.
 const dialTimeout = 10 * time.Second
 
@@ -41,6 +42,17 @@ type dnsOverTLS struct {
 	// logger is used for exchange logging.  It is never nil.
 	logger *slog.Logger
 
+	// stats are the statistics of the connections.  It is never nil.
+	stats *connStats
+
+	// questions handles the responses with mismatched questions.  It is never
+	// nil.
+	questions *questionChecker
+
+	// connTimeout is the timeout for establishing a connection, also used as
+	// the deadline of the exchanges over the reused ones.
+	connTimeout time.Duration
+
 	// conns stores the connections ready for reuse.  Don't use [sync.Pool]
 	// here, since there is no need to deallocate these connections.
 	//
@@ -49,15 +61,21 @@ type dnsOverTLS struct {
 	// This leads to weak performance for all exchanges coming across such
 	// connections.
 	conns []net.Conn
+
+	// standby is the warm standby connection used once the pooled ones fail.
+	// It's nil unless [Options.WarmStandby] is set.
+	standby *connStandby[*tls.Conn]
 }
 
 // newDoT returns the DNS-over-TLS Upstream.
 func newDoT(addr *url.URL, opts *Options) (ups Upstream, err error) {
 	addPort(addr, defaultPortDoT)
 
+	stats := newConnStats()
 	tlsUps := &dnsOverTLS{
-		addr:      addr,
-		getDialer: newDialerInitializer(addr, opts),
+		addr:        addr,
+		getDialer:   newDialerInitializer(addr, opts),
+		connTimeout: cmp.Or(opts.connTimeout, dialTimeout),
 		tlsConf: &tls.Config{
 			ServerName:   addr.Hostname(),
 			RootCAs:      opts.RootCAs,
@@ -73,23 +91,34 @@ func newDoT(addr *url.URL, opts *Options) (ups Upstream, err error) {
 			VerifyPeerCertificate: opts.VerifyServerCertificate,
 			VerifyConnection:      opts.VerifyConnection,
 		},
-		connsMu: &sync.Mutex{},
-		logger:  opts.Logger,
+		connsMu:   &sync.Mutex{},
+		logger:    opts.Logger,
+		stats:     stats,
+		questions: newQuestionChecker(opts, stats),
 	}
 
-	runtime.SetFinalizer(tlsUps, (*dnsOverTLS).Close)
+	if opts.WarmStandby {
+		tlsUps.standby = newConnStandby(opts.Logger, nil, (*tls.Conn).Close)
+	}
+
+	setCloseFinalizer(tlsUps, opts)
 
 	return tlsUps, nil
 }
 
 // type check
-var _ Upstream = (*dnsOverTLS)(nil)
+var _ ConnStatsReporter = (*dnsOverTLS)(nil)
 
 // Address implements the [Upstream] interface for *dnsOverTLS.
 func (p *dnsOverTLS) Address() string { return p.addr.String() }
 
+// ConnStats implements the [ConnStatsReporter] interface for *dnsOverTLS.
+func (p *dnsOverTLS) ConnStats() (s *ConnStats) { return p.stats.clone() }
+
 // Exchange implements the [Upstream] interface for *dnsOverTLS.
 func (p *dnsOverTLS) Exchange(req *dns.Msg) (reply *dns.Msg, err error) {
+	defer func() { p.stats.exchanged(err) }()
+
 	h, err := p.getDialer()
 	if err != nil {
 		return nil, fmt.Errorf("getting conn to %s: %w", p.addr, err)
@@ -110,7 +139,7 @@ func (p *dnsOverTLS) Exchange(req *dns.Msg) (reply *dns.Msg, err error) {
 		p.logger.Debug("dot got bad conn from pool", "addr", p.addr, slogutil.KeyError, err)
 
 		// Retry.
-		conn, err = tlsDial(h, p.tlsConf.Clone())
+		conn, err = p.standbyOrDial(h)
 		if err != nil {
 			return nil, fmt.Errorf(
 				"dialing %s: connecting to %s: %w",
@@ -127,6 +156,12 @@ func (p *dnsOverTLS) Exchange(req *dns.Msg) (reply *dns.Msg, err error) {
 	}
 
 	p.putBack(conn)
+	p.standby.refill(p.dialStandby)
+
+	err = p.questions.check(req, reply)
+	if err != nil {
+		return nil, fmt.Errorf("validating response: %w", err)
+	}
 
 	return reply, nil
 }
@@ -135,6 +170,8 @@ func (p *dnsOverTLS) Exchange(req *dns.Msg) (reply *dns.Msg, err error) {
 func (p *dnsOverTLS) Close() (err error) {
 	runtime.SetFinalizer(p, nil)
 
+	p.standby.shutdown()
+
 	p.connsMu.Lock()
 	defer p.connsMu.Unlock()
 
@@ -155,7 +192,7 @@ func (p *dnsOverTLS) conn(h bootstrap.DialHandler) (conn net.Conn, err error) {
 	// Dial a new connection outside the lock, if needed.
 	defer func() {
 		if conn == nil {
-			conn, err = tlsDial(h, p.tlsConf.Clone())
+			conn, err = p.standbyOrDial(h)
 			err = errors.Annotate(err, "connecting to %s: %w", p.tlsConf.ServerName)
 		}
 	}()
@@ -170,7 +207,7 @@ func (p *dnsOverTLS) conn(h bootstrap.DialHandler) (conn net.Conn, err error) {
 
 	p.conns, conn = p.conns[:l-1], p.conns[l-1]
 
-	err = conn.SetDeadline(time.Now().Add(dialTimeout))
+	err = conn.SetDeadline(time.Now().Add(p.connTimeout))
 	if err != nil {
 		p.logger.Debug("dot upstream setting deadline to conn from pool", slogutil.KeyError, err)
 
@@ -184,6 +221,50 @@ func (p *dnsOverTLS) conn(h bootstrap.DialHandler) (conn net.Conn, err error) {
 	return conn, nil
 }
 
+// dial establishes a new TLS connection using h and records it in the
+// statistics.
+func (p *dnsOverTLS) dial(h bootstrap.DialHandler) (conn net.Conn, err error) {
+	tlsConn, err := tlsDial(context.Background(), h, p.tlsConf.Clone(), p.connTimeout)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return nil, err
+	}
+
+	p.stats.connectedTLS("", tlsConn.ConnectionState())
+
+	return tlsConn, nil
+}
+
+// standbyOrDial returns the standby connection, if there is one, and records
+// it in the statistics.  Otherwise, it dials a new connection using h.
+func (p *dnsOverTLS) standbyOrDial(h bootstrap.DialHandler) (conn net.Conn, err error) {
+	tlsConn, ok := p.standby.take(p.dialStandby)
+	if !ok {
+		return p.dial(h)
+	}
+
+	err = tlsConn.SetDeadline(time.Now().Add(p.connTimeout))
+	if err != nil {
+		p.logger.Debug("dot upstream setting deadline to standby conn", slogutil.KeyError, err)
+
+		return p.dial(h)
+	}
+
+	p.stats.connectedTLS("", tlsConn.ConnectionState())
+
+	return tlsConn, nil
+}
+
+// dialStandby establishes a new TLS connection to be kept in p.standby.
+func (p *dnsOverTLS) dialStandby(ctx context.Context) (conn *tls.Conn, err error) {
+	h, err := p.getDialer()
+	if err != nil {
+		return nil, fmt.Errorf("getting dialer: %w", err)
+	}
+
+	return tlsDial(ctx, h, p.tlsConf.Clone(), p.connTimeout)
+}
+
 func (p *dnsOverTLS) putBack(conn net.Conn) {
 	p.connsMu.Lock()
 	defer p.connsMu.Unlock()
@@ -216,25 +297,31 @@ func (p *dnsOverTLS) exchangeWithConn(conn net.Conn, req *dns.Msg) (reply *dns.M
 }
 
 // tlsDial is basically the same as tls.DialWithDialer, but we will call our own
-// dialContext function to get connection.
-func tlsDial(dialContext bootstrap.DialHandler, conf *tls.Config) (c *tls.Conn, err error) {
+// dialContext function to get connection.  The dial is aborted once ctx is
+// canceled or timeout passes.
+func tlsDial(
+	ctx context.Context,
+	dialContext bootstrap.DialHandler,
+	conf *tls.Config,
+	timeout time.Duration,
+) (c *tls.Conn, err error) {
 	// We're using bootstrapped address instead of what's passed to the
 	// function.
-	rawConn, err := dialContext(context.Background(), networkTCP, "")
+	rawConn, err := dialContext(ctx, networkTCP, "")
 	if err != nil {
 		return nil, err
 	}
 
 	// We want the timeout to cover the whole process: TCP connection and TLS
-	// handshake dialTimeout will be used as connection deadLine.
+	// handshake timeout will be used as connection deadLine.
 	conn := tls.Client(rawConn, conf)
-	err = conn.SetDeadline(time.Now().Add(dialTimeout))
+	err = conn.SetDeadline(time.Now().Add(timeout))
 	if err != nil {
 		// Must not happen in normal circumstances.
 		panic(fmt.Errorf("dnsproxy: tls dial: setting deadline: %w", err))
 	}
 
-	err = conn.Handshake()
+	err = conn.HandshakeContext(ctx)
 	if err != nil {
 		return nil, errors.WithDeferred(err, conn.Close())
 	}
@@ -42,6 +42,42 @@ func TestUpstream_dnsOverTLS(t *testing.T) {
 	}
 }
 
+func TestUpstream_dnsOverTLS_connStats(t *testing.T) {
+	srv := startDoTServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		resp := respondToTestMessage(req)
+
+		err := w.WriteMsg(resp)
+
+		pt := testutil.PanicT{}
+		require.NoError(pt, err)
+	})
+
+	addr := fmt.Sprintf("tls://127.0.0.1:%d", srv.port)
+	u, err := AddressToUpstream(addr, &Options{
+		Logger:             testLogger,
+		InsecureSkipVerify: true,
+	})
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, u.Close)
+
+	r := testutil.RequireTypeAssert[ConnStatsReporter](t, u)
+
+	s := r.ConnStats()
+	assert.True(t, s.Established.IsZero())
+	assert.Zero(t, s.Exchanges)
+
+	const n = 3
+	for range n {
+		checkUpstream(t, u, addr)
+	}
+
+	s = r.ConnStats()
+	assert.False(t, s.Established.IsZero())
+	assert.Equal(t, "TLS 1.3", s.Protocol)
+	assert.Equal(t, uint64(n), s.Exchanges)
+	assert.NoError(t, s.LastError)
+}
+
 func TestUpstream_dnsOverTLS_race(t *testing.T) {
 	const count = 10
 
@@ -204,6 +240,66 @@ func TestUpstream_dnsOverTLS_poolDeadline(t *testing.T) {
 }
 
 // testDoTServer is a test DNS-over-TLS server that can be used in unit-tests.
+func TestUpstream_dnsOverTLS_warmStandby(t *testing.T) {
+	srv := startDoTServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		require.NoError(testutil.PanicT{}, w.WriteMsg(respondToTestMessage(req)))
+	})
+
+	addr := fmt.Sprintf("tls://127.0.0.1:%d", srv.port)
+	u, err := AddressToUpstream(addr, &Options{
+		Logger:             testLogger,
+		InsecureSkipVerify: true,
+		WarmStandby:        true,
+	})
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, u.Close)
+
+	ut := testutil.RequireTypeAssert[*dnsOverTLS](t, u)
+
+	checkUpstream(t, u, addr)
+	standby := requireStandby(t, ut.standby)
+	assert.True(t, standby.ConnectionState().DidResume)
+
+	// Break the pooled connection, so that the standby one is promoted.
+	func() {
+		ut.connsMu.Lock()
+		defer ut.connsMu.Unlock()
+
+		require.Len(t, ut.conns, 1)
+		require.NoError(t, ut.conns[0].Close())
+	}()
+
+	checkUpstream(t, u, addr)
+
+	func() {
+		ut.connsMu.Lock()
+		defer ut.connsMu.Unlock()
+
+		require.Len(t, ut.conns, 1)
+		assert.Same(t, standby, ut.conns[0])
+	}()
+
+	// A new standby connection is dialed instead of the promoted one.
+	assert.NotSame(t, standby, requireStandby(t, ut.standby))
+}
+
+// requireStandby waits for s to keep a connection and returns it.
+func requireStandby[T comparable](tb testing.TB, s *connStandby[T]) (conn T) {
+	tb.Helper()
+
+	var zero T
+	require.Eventually(tb, func() (ok bool) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		conn = s.conn
+
+		return conn != zero
+	}, testTimeout, testTimeout/10)
+
+	return conn
+}
+
 type testDoTServer struct {
 	// srv is the *dns.Server instance that listens for DoT requests.
 	srv *dns.Server
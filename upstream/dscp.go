@@ -0,0 +1,50 @@
+package upstream
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"syscall"
+
+	"github.com/AdguardTeam/dnsproxy/internal/bootstrap"
+	proxynetutil "github.com/AdguardTeam/dnsproxy/internal/netutil"
+	"github.com/AdguardTeam/golibs/errors"
+)
+
+// withDSCP returns a [DialerInitializer] which handler marks the connections
+// dialed by the handler of di with dscp.
+func withDSCP(di DialerInitializer, dscp uint8) (wrapped DialerInitializer) {
+	return func() (h bootstrap.DialHandler, err error) {
+		dial, err := di()
+		if err != nil {
+			// Don't wrap the error since it's informative enough as is.
+			return nil, err
+		}
+
+		return func(
+			ctx context.Context,
+			network bootstrap.Network,
+			addr string,
+		) (conn net.Conn, err error) {
+			conn, err = dial(ctx, network, addr)
+			if err != nil {
+				// Don't wrap the error since it's informative enough as is.
+				return nil, err
+			}
+
+			sc, ok := conn.(syscall.Conn)
+			if !ok {
+				return conn, nil
+			}
+
+			err = proxynetutil.SetDSCP(sc, dscp)
+			if err != nil {
+				err = fmt.Errorf("marking connection: %w", err)
+
+				return nil, errors.WithDeferred(err, conn.Close())
+			}
+
+			return conn, nil
+		}, nil
+	}
+}
@@ -0,0 +1,56 @@
+//go:build unix
+
+package upstream
+
+import (
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/internal/bootstrap"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestWithDSCP(t *testing.T) {
+	const dscp = 46
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, l.Close)
+
+	di := withDSCP(func() (h bootstrap.DialHandler, err error) {
+		return bootstrap.NewDialContext(testTimeout, testLogger, l.Addr().String()), nil
+	}, dscp)
+
+	h, err := di()
+	require.NoError(t, err)
+
+	conn, err := h(testutil.ContextWithTimeout(t, testTimeout), networkTCP, "")
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, conn.Close)
+
+	rc, err := testutil.RequireTypeAssert[syscall.Conn](t, conn).SyscallConn()
+	require.NoError(t, err)
+
+	var tos int
+	var opErr error
+	err = rc.Control(func(fd uintptr) {
+		tos, opErr = unix.GetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_TOS)
+	})
+	require.NoError(t, err)
+	require.NoError(t, opErr)
+
+	assert.Equal(t, dscp<<2, tos)
+}
+
+func TestAddressToUpstream_dscpOutOfRange(t *testing.T) {
+	_, err := AddressToUpstream("udp://127.0.0.1:53", &Options{
+		Logger: testLogger,
+		DSCP:   64,
+	})
+	assert.ErrorIs(t, err, errors.ErrOutOfRange)
+}
@@ -0,0 +1,41 @@
+package upstream
+
+import (
+	"context"
+	"runtime"
+
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+)
+
+// leakHook, if not nil, is called with the address of each upstream garbage
+// collected without being closed.  It's only set in tests to detect the leaks.
+var leakHook func(addr string)
+
+// setCloseFinalizer makes u closed once it's garbage collected without being
+// closed by its owner, unless opts disable the finalizers.  Such upstreams are
+// reported as leaked.  u must be allocated with new or a composite literal and
+// opts must have the logger set.
+func setCloseFinalizer[T any, PT interface {
+	*T
+	Upstream
+}](u PT, opts *Options) {
+	if opts.DisableFinalizers {
+		return
+	}
+
+	// Don't capture u in the closure, since that would keep it alive.
+	l := opts.Logger
+	runtime.SetFinalizer(u, func(u PT) {
+		addr := u.Address()
+		l.WarnContext(context.TODO(), "upstream is not closed by its owner", "addr", addr)
+
+		if h := leakHook; h != nil {
+			h(addr)
+		}
+
+		err := u.Close()
+		if err != nil {
+			l.DebugContext(context.TODO(), "closing leaked upstream", slogutil.KeyError, err)
+		}
+	})
+}
@@ -0,0 +1,174 @@
+package upstream
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// lazyUpstream is an [Upstream] which is only constructed on the first
+// exchange.  It allows keeping large numbers of rarely used upstreams, e.g.
+// the domain-specific ones generated from lists, without allocating their TLS
+// and QUIC configurations and registering finalizers at startup.
+type lazyUpstream struct {
+	// mu protects ups, err, and closed.
+	mu *sync.Mutex
+
+	// ups is the constructed upstream.  It's nil until the first exchange.
+	ups Upstream
+
+	// err is the error of constructing the upstream, if any.
+	err error
+
+	// uu is the address of the upstream to construct.  It must not be
+	// modified, since the constructors modify the URL they're given.
+	uu *url.URL
+
+	// opts are the options to construct the upstream with.
+	opts *Options
+
+	// addr is the address of the upstream as returned by the constructed one.
+	addr string
+
+	// closed is true if the upstream has been closed.
+	closed bool
+}
+
+// newLazy returns an [Upstream] for uu constructed on the first exchange.  ok
+// is false if uu can't be constructed lazily, e.g. for DNS stamps and custom
+// schemes.  The options are validated right away.
+func newLazy(uu *url.URL, opts *Options) (u Upstream, ok bool, err error) {
+	addr := *uu
+
+	switch addr.Scheme {
+	case networkUDP, networkTCP:
+		err = validateRetransmit(opts)
+		addPort(&addr, defaultPortPlain)
+	case "tls":
+		addPort(&addr, defaultPortDoT)
+	case "quic":
+		err = validateQUIC(opts)
+		if err == nil {
+			err = validateDoQNextProtos(opts.DoQNextProtos)
+		}
+
+		addPort(&addr, defaultPortDoQ)
+	case "h3", "https":
+		err = validateHTTPErrorBudget(opts.HTTPErrorBudget)
+		if err == nil {
+			err = validateQUIC(opts)
+		}
+
+		addr.Scheme = "https"
+		addPort(&addr, defaultPortDoH)
+	default:
+		return nil, false, nil
+	}
+
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return nil, true, err
+	}
+
+	return &lazyUpstream{
+		mu:   &sync.Mutex{},
+		uu:   uu,
+		opts: opts,
+		addr: lazyAddress(&addr),
+	}, true, nil
+}
+
+// lazyAddress returns the address the constructed upstream for uu returns from
+// its Address method.  uu must have the port set.
+func lazyAddress(uu *url.URL) (addr string) {
+	switch uu.Scheme {
+	case networkUDP:
+		return uu.Host
+	case "https":
+		return uu.Redacted()
+	default:
+		return uu.String()
+	}
+}
+
+// type check
+var _ Upstream = (*lazyUpstream)(nil)
+
+// Address implements the [Upstream] interface for *lazyUpstream.
+func (u *lazyUpstream) Address() (addr string) { return u.addr }
+
+// Exchange implements the [Upstream] interface for *lazyUpstream.
+func (u *lazyUpstream) Exchange(req *dns.Msg) (resp *dns.Msg, err error) {
+	return u.ExchangeContext(context.Background(), req)
+}
+
+// type check
+var _ ContextExchanger = (*lazyUpstream)(nil)
+
+// ExchangeContext implements the [ContextExchanger] interface for
+// *lazyUpstream.
+func (u *lazyUpstream) ExchangeContext(
+	ctx context.Context,
+	req *dns.Msg,
+) (resp *dns.Msg, err error) {
+	ups, err := u.upstream()
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return nil, err
+	}
+
+	return ExchangeContext(ctx, ups, req)
+}
+
+// Close implements the [Upstream] interface for *lazyUpstream.
+func (u *lazyUpstream) Close() (err error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.closed = true
+	if u.ups == nil {
+		return nil
+	}
+
+	return u.ups.Close()
+}
+
+// upstream returns the constructed upstream, constructing it if necessary.
+func (u *lazyUpstream) upstream() (ups Upstream, err error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.closed {
+		return nil, fmt.Errorf("upstream %s: %w", u.addr, net.ErrClosed)
+	} else if u.ups != nil || u.err != nil {
+		return u.ups, u.err
+	}
+
+	uu := *u.uu
+	u.ups, u.err = newBuiltin(&uu, u.opts)
+	if u.err != nil {
+		u.err = fmt.Errorf("constructing upstream %s: %w", u.addr, u.err)
+	}
+
+	return u.ups, u.err
+}
+
+// type check
+var _ ConnStatsReporter = (*lazyUpstream)(nil)
+
+// ConnStats implements the [ConnStatsReporter] interface for *lazyUpstream.
+func (u *lazyUpstream) ConnStats() (s *ConnStats) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	r, ok := u.ups.(ConnStatsReporter)
+	if !ok {
+		return &ConnStats{}
+	}
+
+	return r.ConnStats()
+}
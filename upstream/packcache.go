@@ -0,0 +1,165 @@
+package upstream
+
+import (
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// DefaultPackedQueryTTL is the suggested value of [Options.PackedQueryTTL] for
+// the proxies which don't deduplicate the identical queries.
+const DefaultPackedQueryTTL = 1 * time.Second
+
+// maxPackedQueries is the maximum number of the packed queries kept by a
+// [packedQueryCache].
+const maxPackedQueries = 1024
+
+// packedQueryKey identifies the queries having the same wire form once their
+// IDs are set to zero.
+type packedQueryKey struct {
+	// hdr is the header of the query with zero ID.
+	hdr dns.MsgHdr
+
+	// question is the only question of the query.
+	question dns.Question
+
+	// optTTL is the TTL field of the OPT record, which contains the extended
+	// RCODE, the version, and the flags of EDNS.
+	optTTL uint32
+
+	// optSize is the UDP payload size of the OPT record.
+	optSize uint16
+
+	// hasOPT is true if the query has the OPT record.
+	hasOPT bool
+
+	// compress is true if the names of the query are compressed.
+	compress bool
+}
+
+// newPackedQueryKey returns the key of req and true if the wire form of req is
+// fully determined by the key, i.e. req has a single question and no records
+// except for an OPT record without options.
+func newPackedQueryKey(req *dns.Msg) (k packedQueryKey, ok bool) {
+	if len(req.Question) != 1 || len(req.Answer) > 0 || len(req.Ns) > 0 || len(req.Extra) > 1 {
+		return k, false
+	}
+
+	k = packedQueryKey{
+		hdr:      req.MsgHdr,
+		question: req.Question[0],
+		compress: req.Compress,
+	}
+	k.hdr.Id = 0
+
+	if len(req.Extra) == 0 {
+		return k, true
+	}
+
+	opt, ok := req.Extra[0].(*dns.OPT)
+	if !ok || len(opt.Option) > 0 || opt.Hdr.Name != "." {
+		return k, false
+	}
+
+	k.hasOPT, k.optTTL, k.optSize = true, opt.Hdr.Ttl, opt.Hdr.Class
+
+	return k, true
+}
+
+// packedQuery is an entry of [packedQueryCache].
+type packedQuery[T any] struct {
+	// expire is the time after which the entry isn't used.
+	expire time.Time
+
+	// val is the packed query.
+	val T
+}
+
+// packedQueryCache keeps the packed forms of the identical queries for a short
+// time, so that bursts of those aren't packed repeatedly.  A nil
+// *packedQueryCache doesn't keep anything.
+type packedQueryCache[T any] struct {
+	// mu protects entries.
+	mu *sync.Mutex
+
+	// entries are the packed queries by their keys.
+	entries map[packedQueryKey]packedQuery[T]
+
+	// ttl is the time the packed queries are kept for.
+	ttl time.Duration
+}
+
+// newPackedQueryCache returns a new cache keeping the packed queries for ttl.
+// It returns nil if ttl isn't positive.
+func newPackedQueryCache[T any](ttl time.Duration) (c *packedQueryCache[T]) {
+	if ttl <= 0 {
+		return nil
+	}
+
+	return &packedQueryCache[T]{
+		mu:      &sync.Mutex{},
+		entries: map[packedQueryKey]packedQuery[T]{},
+		ttl:     ttl,
+	}
+}
+
+// pack returns the packed form of req with zero ID kept in c, if any.
+// Otherwise, it calls packFunc and keeps its result, if req is cacheable.  c
+// may be nil.
+func (c *packedQueryCache[T]) pack(
+	req *dns.Msg,
+	now time.Time,
+	packFunc func(req *dns.Msg) (val T, err error),
+) (val T, err error) {
+	if c == nil {
+		return packFunc(req)
+	}
+
+	k, ok := newPackedQueryKey(req)
+	if !ok {
+		return packFunc(req)
+	}
+
+	c.mu.Lock()
+	e, ok := c.entries[k]
+	c.mu.Unlock()
+
+	if ok && now.Before(e.expire) {
+		return e.val, nil
+	}
+
+	val, err = packFunc(req)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return val, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.entries) >= maxPackedQueries {
+		c.evict(now)
+	}
+
+	c.entries[k] = packedQuery[T]{
+		expire: now.Add(c.ttl),
+		val:    val,
+	}
+
+	return val, nil
+}
+
+// evict removes the expired entries from c, or all of them, if none have
+// expired.  c.mu must be locked.
+func (c *packedQueryCache[T]) evict(now time.Time) {
+	for k, e := range c.entries {
+		if !now.Before(e.expire) {
+			delete(c.entries, k)
+		}
+	}
+
+	if len(c.entries) >= maxPackedQueries {
+		clear(c.entries)
+	}
+}
@@ -0,0 +1,169 @@
+package upstream
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewPackedQueryKey(t *testing.T) {
+	t.Parallel()
+
+	newReq := func() (req *dns.Msg) {
+		return (&dns.Msg{}).SetQuestion("domain.example.", dns.TypeA)
+	}
+
+	withEDNS := newReq().SetEdns0(1232, true)
+
+	withECS := newReq().SetEdns0(1232, false)
+	withECS.IsEdns0().Option = append(withECS.IsEdns0().Option, &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		Family:        1,
+		SourceNetmask: 24,
+		Address:       net.IP{192, 0, 2, 0},
+	})
+
+	withAnswer := newReq()
+	withAnswer.Answer = append(withAnswer.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: "domain.example.", Rrtype: dns.TypeA, Class: dns.ClassINET},
+		A:   net.IP{192, 0, 2, 1},
+	})
+
+	testCases := []struct {
+		req    *dns.Msg
+		name   string
+		wantOK bool
+	}{{
+		req:    newReq(),
+		name:   "plain",
+		wantOK: true,
+	}, {
+		req:    withEDNS,
+		name:   "edns",
+		wantOK: true,
+	}, {
+		req:    withECS,
+		name:   "edns_options",
+		wantOK: false,
+	}, {
+		req:    withAnswer,
+		name:   "answer",
+		wantOK: false,
+	}, {
+		req:    &dns.Msg{},
+		name:   "no_question",
+		wantOK: false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			_, ok := newPackedQueryKey(tc.req)
+			assert.Equal(t, tc.wantOK, ok)
+		})
+	}
+
+	// The IDs don't matter, but the flags do.
+	a, b := newReq(), newReq()
+	a.Id, b.Id = 1, 2
+
+	ka, _ := newPackedQueryKey(a)
+	kb, _ := newPackedQueryKey(b)
+	assert.Equal(t, ka, kb)
+
+	b.CheckingDisabled = true
+	kb, _ = newPackedQueryKey(b)
+	assert.NotEqual(t, ka, kb)
+}
+
+func TestPackedQueryCache_pack(t *testing.T) {
+	t.Parallel()
+
+	c := newPackedQueryCache[string](time.Second)
+	require.NotNil(t, c)
+
+	var packed int
+	packFunc := func(req *dns.Msg) (query string, err error) {
+		packed++
+
+		return packDoHQuery(req)
+	}
+
+	req := (&dns.Msg{}).SetQuestion("domain.example.", dns.TypeA)
+	now := time.Now()
+
+	want, err := packDoHQuery(req)
+	require.NoError(t, err)
+
+	query, err := c.pack(req, now, packFunc)
+	require.NoError(t, err)
+	assert.Equal(t, want, query)
+
+	// The identical query with another ID is reused.
+	req.Id++
+	query, err = c.pack(req, now.Add(time.Second/2), packFunc)
+	require.NoError(t, err)
+	assert.Equal(t, want, query)
+	assert.Equal(t, 1, packed)
+
+	// The expired one is packed again.
+	query, err = c.pack(req, now.Add(time.Second), packFunc)
+	require.NoError(t, err)
+	assert.Equal(t, want, query)
+	assert.Equal(t, 2, packed)
+
+	var nilCache *packedQueryCache[string]
+	query, err = nilCache.pack(req, now, packFunc)
+	require.NoError(t, err)
+	assert.Equal(t, want, query)
+	assert.Equal(t, 3, packed)
+
+	assert.Nil(t, newPackedQueryCache[string](0))
+}
+
+func BenchmarkPackDoHQuery(b *testing.B) {
+	req := (&dns.Msg{}).SetQuestion("some.not.very.long.host.name.", dns.TypeAAAA)
+	req.SetEdns0(1232, true)
+
+	var query string
+	var err error
+
+	b.Run("pack", func(b *testing.B) {
+		b.ReportAllocs()
+
+		for b.Loop() {
+			query, err = packDoHQuery(req)
+		}
+
+		require.NoError(b, err)
+		assert.NotEmpty(b, query)
+	})
+
+	b.Run("cached", func(b *testing.B) {
+		c := newPackedQueryCache[string](time.Hour)
+		now := time.Now()
+
+		b.ReportAllocs()
+
+		for b.Loop() {
+			query, err = c.pack(req, now, packDoHQuery)
+		}
+
+		require.NoError(b, err)
+		assert.NotEmpty(b, query)
+	})
+
+	// Most recent results:
+	//
+	//	goos: linux
+	//	goarch: amd64
+	//	pkg: github.com/AdguardTeam/dnsproxy/upstream
+	//	cpu: Intel(R) Xeon(R) Processor
+	//	BenchmarkPackDoHQuery/pack         	  200000	       401.1 ns/op	     224 B/op	       3 allocs/op
+	//	BenchmarkPackDoHQuery/cached       	  200000	        97.87 ns/op	       0 B/op	       0 allocs/op
+}
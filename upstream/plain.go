@@ -7,6 +7,7 @@ import (
 	"log/slog"
 	"net"
 	"net/url"
+	"syscall"
 	"time"
 
 	"github.com/AdguardTeam/dnsproxy/internal/bootstrap"
@@ -36,6 +37,13 @@ type plainDNS struct {
 	// logger is used for exchange logging.  It is never nil.
 	logger *slog.Logger
 
+	// stats are the statistics of the exchanges.  It is never nil.
+	stats *connStats
+
+	// questions handles the responses with mismatched questions.  It is never
+	// nil.
+	questions *questionChecker
+
 	// getDialer either returns an initialized dial handler or creates a new
 	// one.
 	getDialer DialerInitializer
@@ -45,6 +53,25 @@ type plainDNS struct {
 
 	// timeout is the timeout for DNS requests.
 	timeout time.Duration
+
+	// retransmitIvl is the interval between the retransmissions of UDP
+	// queries.
+	retransmitIvl time.Duration
+
+	// retransmitAttempts is the maximum number of times a UDP query is sent.
+	// Values less than 2 disable the retransmission.
+	retransmitAttempts uint
+
+	// retransmitSwitch makes the retransmissions go through new sockets.
+	retransmitSwitch bool
+
+	// ednsBufSize is the EDNS0 UDP payload size advertised to the upstream.
+	// Zero means the size of the request is kept.
+	ednsBufSize uint16
+
+	// randomizeCase makes the UDP queries use the question names with the
+	// randomized case of letters, which the responses must repeat.
+	randomizeCase bool
 }
 
 // newPlain returns the plain DNS Upstream.  addr.Scheme should be either "udp"
@@ -57,19 +84,56 @@ func newPlain(addr *url.URL, opts *Options) (u *plainDNS, err error) {
 		return nil, fmt.Errorf("unsupported url scheme: %s", addr.Scheme)
 	}
 
+	err = validateRetransmit(opts)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return nil, err
+	}
+
+	bufSize := opts.ednsBufferSizeFor(addr.Hostname())
+	if bufSize != 0 && bufSize < dns.MinMsgSize {
+		return nil, fmt.Errorf("edns buffer size: %w: %d", errors.ErrOutOfRange, bufSize)
+	}
+
 	addPort(addr, defaultPortPlain)
 
+	stats := newConnStats()
+
 	return &plainDNS{
-		addr:      addr,
-		logger:    opts.Logger,
-		getDialer: newDialerInitializer(addr, opts),
-		net:       addr.Scheme,
-		timeout:   opts.Timeout,
+		addr:               addr,
+		logger:             opts.Logger,
+		stats:              stats,
+		questions:          newQuestionChecker(opts, stats),
+		getDialer:          newDialerInitializer(addr, opts),
+		net:                addr.Scheme,
+		timeout:            opts.Timeout,
+		retransmitIvl:      opts.UDPRetransmitInterval,
+		retransmitAttempts: opts.UDPRetransmitAttempts,
+		retransmitSwitch:   opts.UDPRetransmitSwitchServer,
+		ednsBufSize:        bufSize,
+		randomizeCase:      opts.UDPRandomizeCase,
 	}, nil
 }
 
+// validateRetransmit returns an error if the UDP retransmission options of opts
+// are invalid.
+func validateRetransmit(opts *Options) (err error) {
+	if opts.UDPRetransmitAttempts > 1 && opts.UDPRetransmitInterval <= 0 {
+		return fmt.Errorf(
+			"udp retransmit interval: %w: %s",
+			errors.ErrNotPositive,
+			opts.UDPRetransmitInterval,
+		)
+	}
+
+	return nil
+}
+
 // type check
-var _ Upstream = &plainDNS{}
+var _ ConnStatsReporter = (*plainDNS)(nil)
+
+// ConnStats implements the [ConnStatsReporter] interface for *plainDNS.
+func (p *plainDNS) ConnStats() (s *ConnStats) { return p.stats.clone() }
 
 // Address implements the [Upstream] interface for *plainDNS.
 func (p *plainDNS) Address() string {
@@ -94,10 +158,20 @@ func (p *plainDNS) dialExchange(
 	client := &dns.Client{Timeout: p.timeout}
 
 	conn := &dns.Conn{}
-	upstreamReq := setRequestForNetwork(req, conn, network)
+	upstreamReq := setRequestForNetwork(req, conn, network, p.ednsBufSize)
+	randomized := network == networkUDP && p.randomizeCase && len(req.Question) > 0
+	if randomized {
+		upstreamReq = withRandomCase(upstreamReq, upstreamReq != req)
+	}
+
 	defer func() {
-		if resp != nil {
-			resp.Id = req.Id
+		if resp == nil {
+			return
+		}
+
+		resp.Id = req.Id
+		if randomized {
+			restoreCase(resp, req.Question[0].Name)
 		}
 	}()
 
@@ -111,30 +185,110 @@ func (p *plainDNS) dialExchange(
 	}
 	defer func(c net.Conn) { err = errors.WithDeferred(err, c.Close()) }(conn.Conn)
 
-	resp, _, err = client.ExchangeWithConn(upstreamReq, conn)
-	if isExpectedConnErr(err) {
+	retransmit := network == networkUDP && p.retransmitAttempts > 1
+	if retransmit {
+		resp, err = p.exchangeWithRetransmit(ctx, dial, conn, upstreamReq)
+	} else {
+		resp, err = p.exchangeConn(ctx, client, network, conn, upstreamReq)
+	}
+
+	// The retransmission already covers the lost packets, so don't retry.
+	if !retransmit && isExpectedConnErr(err) {
 		conn.Conn, err = dial(ctx, network, "")
 		if err != nil {
 			return nil, fmt.Errorf("dialing %s over %s again: %w", p.addr.Host, network, err)
 		}
 		defer func(c net.Conn) { err = errors.WithDeferred(err, c.Close()) }(conn.Conn)
 
-		resp, _, err = client.ExchangeWithConn(upstreamReq, conn)
+		resp, err = p.exchangeConn(ctx, client, network, conn, upstreamReq)
 	}
 
 	if err != nil {
+		err = wrapFragmentationErr(err, upstreamReq, network)
+
 		return resp, fmt.Errorf("exchanging with %s over %s: %w", addr, network, err)
 	}
 
-	return resp, validateResponse(upstreamReq, resp)
+	return resp, nil
+}
+
+// exchangeConn exchanges req through conn, which must be connected over
+// network.  The responses received over UDP are checked by [plainDNS.exchangeUDP].
+func (p *plainDNS) exchangeConn(
+	ctx context.Context,
+	client *dns.Client,
+	network network,
+	conn *dns.Conn,
+	req *dns.Msg,
+) (resp *dns.Msg, err error) {
+	if network == networkUDP {
+		return p.exchangeUDP(ctx, conn, req)
+	}
+
+	resp, _, err = client.ExchangeWithConnContext(ctx, req, conn)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return resp, err
+	}
+
+	return resp, p.questions.check(req, resp)
+}
+
+// exchangeWithRetransmit sends req through conn and sends it again each
+// p.retransmitIvl until the response is received or p.retransmitAttempts is
+// reached.  The last attempt waits for the response until p.timeout.
+// Since the ID of req is kept, a late response to any previous attempt sent
+// through the same socket is accepted.  conn is closed by the caller.
+func (p *plainDNS) exchangeWithRetransmit(
+	ctx context.Context,
+	dial bootstrap.DialHandler,
+	conn *dns.Conn,
+	req *dns.Msg,
+) (resp *dns.Msg, err error) {
+	for attempt := uint(1); ; attempt++ {
+		if attempt > 1 && p.retransmitSwitch {
+			conn = &dns.Conn{UDPSize: conn.UDPSize}
+			conn.Conn, err = dial(ctx, networkUDP, "")
+			if err != nil {
+				return nil, fmt.Errorf("attempt %d: dialing: %w", attempt, err)
+			}
+
+			defer func(c net.Conn) { err = errors.WithDeferred(err, c.Close()) }(conn.Conn)
+		}
+
+		if attempt == p.retransmitAttempts {
+			return p.exchangeUDP(ctx, conn, req)
+		}
+
+		attemptCtx, cancel := context.WithTimeout(ctx, p.retransmitIvl)
+		resp, err = p.exchangeUDP(attemptCtx, conn, req)
+		cancel()
+
+		if !isTimeout(err) {
+			return resp, err
+		}
+
+		p.logger.Debug(
+			"retransmitting udp query",
+			"addr", conn.RemoteAddr(),
+			"attempt", attempt+1,
+			slogutil.KeyError, err,
+		)
+	}
 }
 
 // setRequestForNetwork sets connection options in conn and overrides the
 // upstream request, if necessary, depending on network.  If network is
 // [networkUDP] and orig has a zero ID, req is a copy of orig with a new ID to
-// increase entropy.  network must be either [networkUDP] or [networkTCP].  orig
-// and conn must not be nil.
-func setRequestForNetwork(orig *dns.Msg, conn *dns.Conn, network network) (req *dns.Msg) {
+// increase entropy.  If bufSize isn't zero and orig has an OPT record, req is a
+// copy of orig advertising bufSize.  network must be either [networkUDP] or
+// [networkTCP].  orig and conn must not be nil.
+func setRequestForNetwork(
+	orig *dns.Msg,
+	conn *dns.Conn,
+	network network,
+	bufSize uint16,
+) (req *dns.Msg) {
 	req = orig
 	if network != networkUDP {
 		return req
@@ -147,9 +301,59 @@ func setRequestForNetwork(orig *dns.Msg, conn *dns.Conn, network network) (req *
 		req.Id = dns.Id()
 	}
 
+	if opt := orig.IsEdns0(); bufSize != 0 && opt != nil && opt.UDPSize() != bufSize {
+		if req == orig {
+			req = orig.Copy()
+		}
+
+		// The receive buffer is sized by the advertised payload size, so the
+		// oversized responses are cut and fail to unpack.
+		req.IsEdns0().SetUDPSize(bufSize)
+	}
+
 	return req
 }
 
+// ErrFragmentation is returned by the plain DNS upstreams when a UDP exchange
+// fails in a way typical for the middleboxes dropping the fragmented datagrams,
+// e.g. the query is too large to be sent or the response to the query
+// advertising a large EDNS0 UDP payload size never arrives.  Consider lowering
+// [Options.EDNSBufferSize] for such upstreams.
+const ErrFragmentation errors.Error = "udp exchange likely failed due to ip fragmentation"
+
+// safeEDNSBufSize is the EDNS0 UDP payload size, which avoids the IP
+// fragmentation on the most of the paths, as recommended by the DNS Flag Day
+// 2020.
+const safeEDNSBufSize = 1232
+
+// wrapFragmentationErr returns err wrapped with [ErrFragmentation], if it
+// looks like a fragmentation-related failure of exchanging req over network.
+// Otherwise, it returns err as is.  req must not be nil.
+func wrapFragmentationErr(err error, req *dns.Msg, network network) (wrapped error) {
+	if network != networkUDP {
+		return err
+	}
+
+	if errors.Is(err, syscall.EMSGSIZE) {
+		return fmt.Errorf("%w: %w", ErrFragmentation, err)
+	}
+
+	opt := req.IsEdns0()
+	if opt != nil && opt.UDPSize() > safeEDNSBufSize && isTimeout(err) {
+		return fmt.Errorf("%w: edns buffer size %d: %w", ErrFragmentation, opt.UDPSize(), err)
+	}
+
+	return err
+}
+
+// isUnpackErr returns true if err is caused by a response, which can't be
+// unpacked, e.g. since it exceeds the receive buffer and has been cut.
+func isUnpackErr(err error) (ok bool) {
+	var dnsErr *dns.Error
+
+	return errors.As(err, &dnsErr)
+}
+
 // isExpectedConnErr returns true if the error is expected.  In this case,
 // we will make a second attempt to process the request.
 func isExpectedConnErr(err error) (is bool) {
@@ -160,6 +364,8 @@ func isExpectedConnErr(err error) (is bool) {
 
 // Exchange implements the [Upstream] interface for *plainDNS.
 func (p *plainDNS) Exchange(req *dns.Msg) (resp *dns.Msg, err error) {
+	defer func() { p.stats.exchanged(err) }()
+
 	dial, err := p.getDialer()
 	if err != nil {
 		// Don't wrap the error since it's informative enough as is.
@@ -174,6 +380,19 @@ func (p *plainDNS) Exchange(req *dns.Msg) (resp *dns.Msg, err error) {
 		return resp, err
 	}
 
+	if p.ednsBufSize != 0 && isUnpackErr(err) {
+		// The response likely exceeds the advertised size, so it's been cut.
+		p.logger.Debug(
+			"plain response exceeds edns buffer size, using tcp",
+			"addr", addr,
+			"edns_buf_size", p.ednsBufSize,
+			slogutil.KeyError, err,
+		)
+		p.stats.fellBackToTCP()
+
+		return p.dialExchange(networkTCP, dial, req)
+	}
+
 	if resp == nil {
 		// There is likely an error with the upstream.
 		return resp, err
@@ -186,6 +405,7 @@ func (p *plainDNS) Exchange(req *dns.Msg) (resp *dns.Msg, err error) {
 			"addr", addr,
 			slogutil.KeyError, err,
 		)
+		p.stats.fellBackToTCP()
 
 		return p.dialExchange(networkTCP, dial, req)
 	} else if resp.Truncated {
@@ -195,6 +415,7 @@ func (p *plainDNS) Exchange(req *dns.Msg) (resp *dns.Msg, err error) {
 			"question", &req.Question[0],
 			"addr", addr,
 		)
+		p.stats.fellBackToTCP()
 
 		return p.dialExchange(networkTCP, dial, req)
 	}
@@ -4,7 +4,10 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"os"
+	"strings"
 	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 
@@ -66,6 +69,50 @@ func TestUpstream_plainDNS_badID(t *testing.T) {
 	assert.Nil(t, resp)
 }
 
+func TestUpstream_plainDNS_retransmit(t *testing.T) {
+	const (
+		attempts = 3
+		dropped  = attempts - 1
+	)
+
+	for _, switchServer := range []bool{false, true} {
+		t.Run(fmt.Sprintf("switch_%t", switchServer), func(t *testing.T) {
+			received := &atomic.Uint32{}
+			srv := startDNSServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+				if received.Add(1) <= dropped {
+					// Drop the query to make the upstream retransmit it.
+					return
+				}
+
+				require.NoError(testutil.PanicT{}, w.WriteMsg(respondToTestMessage(req)))
+			})
+			testutil.CleanupAndRequireSuccess(t, srv.Close)
+
+			addr := fmt.Sprintf("127.0.0.1:%d", srv.port)
+			u, err := AddressToUpstream(addr, &Options{
+				Logger:                    testLogger,
+				Timeout:                   testTimeout,
+				UDPRetransmitInterval:     50 * time.Millisecond,
+				UDPRetransmitAttempts:     attempts,
+				UDPRetransmitSwitchServer: switchServer,
+			})
+			require.NoError(t, err)
+			testutil.CleanupAndRequireSuccess(t, u.Close)
+
+			checkUpstream(t, u, addr)
+			assert.Equal(t, uint32(attempts), received.Load())
+		})
+	}
+
+	t.Run("bad_interval", func(t *testing.T) {
+		_, err := AddressToUpstream("127.0.0.1:53", &Options{
+			Logger:                testLogger,
+			UDPRetransmitAttempts: attempts,
+		})
+		assert.ErrorIs(t, err, errors.ErrNotPositive)
+	})
+}
+
 func TestUpstream_plainDNS_fallbackToTCP(t *testing.T) {
 	req := createTestMessage()
 	goodResp := respondToTestMessage(req)
@@ -138,6 +185,281 @@ func TestUpstream_plainDNS_fallbackToTCP(t *testing.T) {
 
 			assert.Equal(t, tc.wantUDP, int(udpReqNum.Load()))
 			assert.Equal(t, tc.wantTCP, int(tcpReqNum.Load()))
+
+			stats := testutil.RequireTypeAssert[ConnStatsReporter](t, u).ConnStats()
+			assert.Equal(t, uint64(1), stats.Exchanges)
+			assert.Equal(t, uint64(tc.wantTCP), stats.TCPFallbacks)
+		})
+	}
+}
+
+func TestUpstream_plainDNS_ednsBufferSize(t *testing.T) {
+	const bufSize = 1232
+
+	req := createTestMessage()
+	req.SetEdns0(dns.DefaultMsgSize, false)
+
+	smallResp := respondToTestMessage(req)
+
+	largeResp := smallResp.Copy()
+	for i := range 100 {
+		largeResp.Answer = append(largeResp.Answer, &dns.A{
+			Hdr: dns.RR_Header{
+				Name:   req.Question[0].Name,
+				Rrtype: dns.TypeA,
+				Class:  dns.ClassINET,
+				Ttl:    60,
+			},
+			A: net.IPv4(192, 0, 2, byte(i)),
+		})
+	}
+
+	testCases := []struct {
+		udpResp *dns.Msg
+		name    string
+		wantTCP uint64
+	}{{
+		udpResp: smallResp,
+		name:    "fits",
+		wantTCP: 0,
+	}, {
+		udpResp: largeResp,
+		name:    "exceeds",
+		wantTCP: 1,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var advertised atomic.Uint32
+			srv := startDNSServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+				resp := smallResp
+				if w.RemoteAddr().Network() == networkUDP {
+					advertised.Store(uint32(r.IsEdns0().UDPSize()))
+					resp = tc.udpResp
+				}
+
+				resp = resp.Copy()
+				resp.Id = r.Id
+
+				require.NoError(testutil.PanicT{}, w.WriteMsg(resp))
+			})
+			testutil.CleanupAndRequireSuccess(t, srv.Close)
+
+			addr := fmt.Sprintf("127.0.0.1:%d", srv.port)
+			u, err := AddressToUpstream(addr, &Options{
+				Logger:              testLogger,
+				HostEDNSBufferSizes: map[string]uint16{"127.0.0.1": bufSize},
+				Timeout:             testTimeout,
+			})
+			require.NoError(t, err)
+			testutil.CleanupAndRequireSuccess(t, u.Close)
+
+			resp, err := u.Exchange(req)
+			require.NoError(t, err)
+			requireResponse(t, req, resp)
+
+			assert.Equal(t, uint32(bufSize), advertised.Load())
+			assert.Equal(t, uint16(dns.DefaultMsgSize), req.IsEdns0().UDPSize())
+
+			stats := testutil.RequireTypeAssert[ConnStatsReporter](t, u).ConnStats()
+			assert.Equal(t, tc.wantTCP, stats.TCPFallbacks)
+		})
+	}
+
+	t.Run("too_small", func(t *testing.T) {
+		_, err := AddressToUpstream("127.0.0.1:53", &Options{
+			Logger:         testLogger,
+			EDNSBufferSize: 100,
+		})
+		assert.ErrorIs(t, err, errors.ErrOutOfRange)
+	})
+}
+
+func TestUpstream_plainDNS_forgedResponses(t *testing.T) {
+	req := createTestMessage()
+
+	forger, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, forger.Close)
+
+	srv := startDNSServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		pt := testutil.PanicT{}
+
+		resp := respondToTestMessage(r)
+		if w.RemoteAddr().Network() != networkUDP {
+			require.NoError(pt, w.WriteMsg(resp))
+
+			return
+		}
+
+		// From another address.
+		b, packErr := resp.Pack()
+		require.NoError(pt, packErr)
+
+		_, writeErr := forger.WriteTo(b, w.RemoteAddr())
+		require.NoError(pt, writeErr)
+
+		badID := resp.Copy()
+		badID.Id++
+		require.NoError(pt, w.WriteMsg(badID))
+
+		notResp := r.Copy()
+		require.NoError(pt, w.WriteMsg(notResp))
+
+		badName := resp.Copy()
+		badName.Question[0].Name = "example.org."
+		require.NoError(pt, w.WriteMsg(badName))
+
+		require.NoError(pt, w.WriteMsg(resp))
+	})
+	testutil.CleanupAndRequireSuccess(t, srv.Close)
+
+	addr := fmt.Sprintf("127.0.0.1:%d", srv.port)
+	u, err := AddressToUpstream(addr, &Options{
+		Logger:  testLogger,
+		Timeout: testTimeout,
+	})
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, u.Close)
+
+	resp, err := u.Exchange(req)
+	require.NoError(t, err)
+	requireResponse(t, req, resp)
+
+	stats := testutil.RequireTypeAssert[ConnStatsReporter](t, u).ConnStats()
+	assert.Zero(t, stats.TCPFallbacks)
+}
+
+func TestUpstream_plainDNS_randomizeCase(t *testing.T) {
+	req := createTestMessage()
+	name := req.Question[0].Name
+
+	testCases := []struct {
+		name         string
+		wantTCP      uint64
+		preserve     bool
+		dropQuestion bool
+	}{{
+		name:         "preserved",
+		wantTCP:      0,
+		preserve:     true,
+		dropQuestion: false,
+	}, {
+		name:         "lowercased",
+		wantTCP:      1,
+		preserve:     false,
+		dropQuestion: false,
+	}, {
+		name:         "missing",
+		wantTCP:      1,
+		preserve:     true,
+		dropQuestion: true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var udpName atomic.Pointer[string]
+			srv := startDNSServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+				qname := r.Question[0].Name
+				if w.RemoteAddr().Network() == networkUDP {
+					udpName.Store(&qname)
+				}
+
+				resp := respondToTestMessage(r)
+				resp.Answer[0].Header().Name = qname
+				if !tc.preserve {
+					resp.Question[0].Name = strings.ToLower(qname)
+				}
+
+				if tc.dropQuestion && w.RemoteAddr().Network() == networkUDP {
+					resp.Question = nil
+				}
+
+				require.NoError(testutil.PanicT{}, w.WriteMsg(resp))
+			})
+			testutil.CleanupAndRequireSuccess(t, srv.Close)
+
+			addr := fmt.Sprintf("127.0.0.1:%d", srv.port)
+			u, err := AddressToUpstream(addr, &Options{
+				Logger:           testLogger,
+				Timeout:          testTimeout,
+				UDPRandomizeCase: true,
+			})
+			require.NoError(t, err)
+			testutil.CleanupAndRequireSuccess(t, u.Close)
+
+			resp, err := u.Exchange(req)
+			require.NoError(t, err)
+			requireResponse(t, req, resp)
+
+			assert.Equal(t, name, resp.Question[0].Name)
+			assert.Equal(t, name, resp.Answer[0].Header().Name)
+			assert.Equal(t, name, req.Question[0].Name)
+
+			sent := udpName.Load()
+			require.NotNil(t, sent)
+			assert.NotEqual(t, name, *sent)
+			assert.True(t, strings.EqualFold(name, *sent))
+
+			stats := testutil.RequireTypeAssert[ConnStatsReporter](t, u).ConnStats()
+			assert.Equal(t, tc.wantTCP, stats.TCPFallbacks)
+		})
+	}
+}
+
+func TestWrapFragmentationErr(t *testing.T) {
+	t.Parallel()
+
+	smallReq := createTestMessage()
+	smallReq.SetEdns0(safeEDNSBufSize, false)
+
+	largeReq := createTestMessage()
+	largeReq.SetEdns0(dns.DefaultMsgSize, false)
+
+	testCases := []struct {
+		err     error
+		req     *dns.Msg
+		name    string
+		network network
+		want    bool
+	}{{
+		err:     syscall.EMSGSIZE,
+		req:     smallReq,
+		name:    "msgsize",
+		network: networkUDP,
+		want:    true,
+	}, {
+		err:     os.ErrDeadlineExceeded,
+		req:     largeReq,
+		name:    "timeout_large",
+		network: networkUDP,
+		want:    true,
+	}, {
+		err:     os.ErrDeadlineExceeded,
+		req:     smallReq,
+		name:    "timeout_small",
+		network: networkUDP,
+		want:    false,
+	}, {
+		err:     os.ErrDeadlineExceeded,
+		req:     largeReq,
+		name:    "tcp",
+		network: networkTCP,
+		want:    false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			err := wrapFragmentationErr(tc.err, tc.req, tc.network)
+			assert.ErrorIs(t, err, tc.err)
+
+			if tc.want {
+				assert.ErrorIs(t, err, ErrFragmentation)
+			} else {
+				assert.NotErrorIs(t, err, ErrFragmentation)
+			}
 		})
 	}
 }
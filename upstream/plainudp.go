@@ -0,0 +1,195 @@
+package upstream
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/miekg/dns"
+)
+
+// defaultUDPTimeout is the time to wait for a UDP response when the timeout
+// isn't set, the same as the default read timeout of [dns.Client].
+const defaultUDPTimeout = 2 * time.Second
+
+// exchangeUDP sends req through conn and waits for the matching response until
+// ctx is done or p.timeout passes.  To resist the off-path injection of forged
+// responses, the datagrams from the addresses other than the remote address of
+// conn, as well as the messages with mismatched ID or question, are discarded
+// and the waiting continues.  If only the responses with mismatched question
+// have been received, the last one is returned with an error wrapping
+// [errQuestion], so that the caller may retry over TCP.  conn must be
+// connected over UDP.
+func (p *plainDNS) exchangeUDP(
+	ctx context.Context,
+	conn *dns.Conn,
+	req *dns.Msg,
+) (resp *dns.Msg, err error) {
+	timeout := p.timeout
+	if timeout == 0 {
+		timeout = defaultUDPTimeout
+	}
+
+	deadline := time.Now().Add(timeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+
+	err = conn.SetDeadline(deadline)
+	if err != nil {
+		return nil, fmt.Errorf("setting deadline: %w", err)
+	}
+
+	err = conn.WriteMsg(req)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return nil, err
+	}
+
+	size := dns.MinMsgSize
+	if opt := req.IsEdns0(); opt != nil {
+		size = max(size, int(opt.UDPSize()))
+	}
+
+	buf := make([]byte, size)
+
+	var mismatchResp *dns.Msg
+	var mismatchErr error
+	for {
+		var n int
+		n, err = p.readFromRemote(conn.Conn, buf)
+		if err != nil {
+			if mismatchResp != nil && isTimeout(err) {
+				return mismatchResp, mismatchErr
+			}
+
+			// Don't wrap the error since it's informative enough as is.
+			return nil, err
+		}
+
+		resp = &dns.Msg{}
+		unpackErr := resp.Unpack(buf[:n])
+		if resp.Id != req.Id || !resp.Response {
+			p.logger.Debug("discarding udp response", "reason", "mismatched id")
+
+			continue
+		}
+
+		qErr := p.checkQuestion(req, resp)
+		if qErr != nil {
+			p.logger.Debug("discarding udp response", "reason", qErr)
+			mismatchResp, mismatchErr = resp, qErr
+
+			continue
+		}
+
+		// The response may still be cut by the receive buffer, so return it
+		// together with the unpacking error.
+		return resp, unpackErr
+	}
+}
+
+// readFromRemote reads a datagram from conn into buf, discarding the ones
+// received from the addresses other than the remote address of conn.
+func (p *plainDNS) readFromRemote(conn net.Conn, buf []byte) (n int, err error) {
+	pc, ok := conn.(net.PacketConn)
+	if !ok {
+		return conn.Read(buf)
+	}
+
+	remote := netutil.NetAddrToAddrPort(conn.RemoteAddr())
+	for {
+		var from net.Addr
+		n, from, err = pc.ReadFrom(buf)
+		if err != nil {
+			return n, err
+		}
+
+		fromAddr := netutil.NetAddrToAddrPort(from)
+		if fromAddr.Addr().Unmap() == remote.Addr().Unmap() && fromAddr.Port() == remote.Port() {
+			return n, nil
+		}
+
+		p.logger.Debug("discarding udp response", "reason", "mismatched source", "from", from)
+	}
+}
+
+// checkQuestion returns an error wrapping [errQuestion] if the question of
+// resp doesn't match the one of req and p doesn't accept such responses.  If p
+// randomizes the case of the question names, those are compared
+// case-sensitively regardless of its question mismatch mode.
+func (p *plainDNS) checkQuestion(req, resp *dns.Msg) (err error) {
+	if p.randomizeCase {
+		err = checkRandomCase(req, resp)
+		if err != nil {
+			p.stats.mismatchedQuestion()
+
+			// Don't wrap the error since it's informative enough as is.
+			return err
+		}
+	}
+
+	return p.questions.check(req, resp)
+}
+
+// checkRandomCase returns an error if resp doesn't echo the question of req
+// with the randomized case of the name.  The responses without a question are
+// rejected as well, since those can't prove the name case.
+func checkRandomCase(req, resp *dns.Msg) (err error) {
+	switch len(resp.Question) {
+	case 0:
+		return fmt.Errorf("%w: missing question", errQuestion)
+	case 1:
+		name := resp.Question[0].Name
+		if name != req.Question[0].Name && strings.EqualFold(name, req.Question[0].Name) {
+			// Don't put the name into the error, since it's logged.
+			return fmt.Errorf("%w: mismatched name case", errQuestion)
+		}
+	}
+
+	return nil
+}
+
+// withRandomCase returns req with the case of the letters of the question name
+// randomized.  If isCopy is false, req is copied first.  req must have a
+// question.
+func withRandomCase(req *dns.Msg, isCopy bool) (randomized *dns.Msg) {
+	randomized = req
+	if !isCopy {
+		randomized = req.Copy()
+	}
+
+	name := []byte(randomized.Question[0].Name)
+	for i, c := range name {
+		if ('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z') && rand.IntN(2) == 0 {
+			// Flip the case.
+			name[i] = c ^ 0x20
+		}
+	}
+
+	randomized.Question[0].Name = string(name)
+
+	return randomized
+}
+
+// restoreCase sets the question name of resp, as well as the names of its
+// resource records matching it case-insensitively, to name.
+func restoreCase(resp *dns.Msg, name string) {
+	for i := range resp.Question {
+		if strings.EqualFold(resp.Question[i].Name, name) {
+			resp.Question[i].Name = name
+		}
+	}
+
+	for _, rrs := range [][]dns.RR{resp.Answer, resp.Ns, resp.Extra} {
+		for _, rr := range rrs {
+			if hdr := rr.Header(); strings.EqualFold(hdr.Name, name) {
+				hdr.Name = name
+			}
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package upstream
+
+import (
+	"encoding"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+
+	"github.com/AdguardTeam/dnsproxy/redact"
+	"github.com/miekg/dns"
+)
+
+// QuestionMismatchMode is an enumeration of the ways the upstreams handle the
+// responses with the question section not matching the one of the query.
+type QuestionMismatchMode string
+
+const (
+	// QuestionMismatchReject rejects the responses with a missing question or
+	// the one of another type or name with an error.  The question names
+	// differing only in case are accepted as is.  It's the default.
+	QuestionMismatchReject QuestionMismatchMode = "reject"
+
+	// QuestionMismatchFix replaces the missing question, as well as the one
+	// differing only in the case of the name, with the question of the query.
+	// The other mismatches are rejected.
+	QuestionMismatchFix QuestionMismatchMode = "fix"
+
+	// QuestionMismatchLog logs the mismatches and accepts the responses as is.
+	// It should only be used for debugging, since it accepts the responses
+	// for other questions.
+	QuestionMismatchLog QuestionMismatchMode = "log"
+)
+
+// type check
+var _ encoding.TextUnmarshaler = (*QuestionMismatchMode)(nil)
+
+// UnmarshalText implements the [encoding.TextUnmarshaler] interface for
+// *QuestionMismatchMode.  The empty string is unmarshaled as
+// [QuestionMismatchReject].
+func (m *QuestionMismatchMode) UnmarshalText(b []byte) (err error) {
+	switch qm := QuestionMismatchMode(b); qm {
+	case "":
+		*m = QuestionMismatchReject
+	case QuestionMismatchReject, QuestionMismatchFix, QuestionMismatchLog:
+		*m = qm
+	default:
+		return fmt.Errorf(
+			"invalid question mismatch mode %q, supported: %q, %q, %q",
+			b,
+			QuestionMismatchReject,
+			QuestionMismatchFix,
+			QuestionMismatchLog,
+		)
+	}
+
+	return nil
+}
+
+// questionChecker validates the question sections of the responses received by
+// an upstream and handles the mismatches according to its mode.
+type questionChecker struct {
+	// logger is used to log the mismatches.  It is never nil.
+	logger *slog.Logger
+
+	// stats counts the mismatches.  It is never nil.
+	stats *connStats
+
+	// mode is the way the mismatches are handled.  The empty string means
+	// [QuestionMismatchReject].
+	mode QuestionMismatchMode
+}
+
+// newQuestionChecker returns a new properly initialized *questionChecker
+// counting the mismatches in stats.
+func newQuestionChecker(opts *Options, stats *connStats) (c *questionChecker) {
+	return &questionChecker{
+		logger: opts.Logger,
+		stats:  stats,
+		mode:   opts.QuestionMismatch,
+	}
+}
+
+// check validates the question section of resp against the one of req.  The
+// mismatches, including the ones in the case of the name, are counted.  Any
+// error returned wraps [errQuestion].  The responses to the queries without a
+// single question aren't checked.  req and resp must not be nil.
+func (c *questionChecker) check(req, resp *dns.Msg) (err error) {
+	if len(req.Question) != 1 || len(resp.Question) == 1 && resp.Question[0] == req.Question[0] {
+		return nil
+	}
+
+	c.stats.mismatchedQuestion()
+
+	err = validateResponse(req, resp)
+	switch c.mode {
+	case QuestionMismatchLog:
+		c.logMismatch("accepting response with mismatched question", resp)
+
+		return nil
+	case QuestionMismatchFix:
+		if isFixableQuestion(req, resp) {
+			c.logMismatch("fixing response question", resp)
+			resp.Question = slices.Clone(req.Question)
+
+			return nil
+		}
+	default:
+		// Go on.
+	}
+
+	return err
+}
+
+// logMismatch logs msg with the question of resp.  The name is logged under
+// [redact.KeyQName] so that it's redacted along with the other query names.
+// resp must not be nil.
+func (c *questionChecker) logMismatch(msg string, resp *dns.Msg) {
+	if len(resp.Question) != 1 {
+		c.logger.Debug(msg, "questions", len(resp.Question))
+
+		return
+	}
+
+	q := resp.Question[0]
+	c.logger.Debug(
+		msg,
+		redact.KeyQName, q.Name,
+		"qtype", dns.Type(q.Qtype),
+		"qclass", dns.Class(q.Qclass),
+	)
+}
+
+// isFixableQuestion returns true if the question of resp is either missing or
+// only differs from the one of req in the case of the name.
+func isFixableQuestion(req, resp *dns.Msg) (ok bool) {
+	switch len(resp.Question) {
+	case 0:
+		return true
+	case 1:
+		reqQ, respQ := req.Question[0], resp.Question[0]
+
+		return reqQ.Qtype == respQ.Qtype &&
+			reqQ.Qclass == respQ.Qclass &&
+			strings.EqualFold(reqQ.Name, respQ.Name)
+	default:
+		return false
+	}
+}
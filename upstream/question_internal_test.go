@@ -0,0 +1,220 @@
+package upstream
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/redact"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQuestionChecker_check(t *testing.T) {
+	t.Parallel()
+
+	req := createTestMessage()
+	reqQ := req.Question[0]
+
+	upperQ := reqQ
+	upperQ.Name = strings.ToUpper(reqQ.Name)
+
+	otherQ := reqQ
+	otherQ.Name = "other.example."
+
+	testCases := []struct {
+		name         string
+		mode         QuestionMismatchMode
+		question     []dns.Question
+		wantQuestion []dns.Question
+		wantErr      bool
+		wantCount    uint64
+	}{{
+		name:         "match",
+		mode:         QuestionMismatchReject,
+		question:     []dns.Question{reqQ},
+		wantQuestion: []dns.Question{reqQ},
+		wantErr:      false,
+		wantCount:    0,
+	}, {
+		name:         "reject_case",
+		mode:         QuestionMismatchReject,
+		question:     []dns.Question{upperQ},
+		wantQuestion: []dns.Question{upperQ},
+		wantErr:      false,
+		wantCount:    1,
+	}, {
+		name:         "reject_missing",
+		mode:         QuestionMismatchReject,
+		question:     nil,
+		wantQuestion: nil,
+		wantErr:      true,
+		wantCount:    1,
+	}, {
+		name:         "fix_case",
+		mode:         QuestionMismatchFix,
+		question:     []dns.Question{upperQ},
+		wantQuestion: []dns.Question{reqQ},
+		wantErr:      false,
+		wantCount:    1,
+	}, {
+		name:         "fix_missing",
+		mode:         QuestionMismatchFix,
+		question:     nil,
+		wantQuestion: []dns.Question{reqQ},
+		wantErr:      false,
+		wantCount:    1,
+	}, {
+		name:         "fix_other",
+		mode:         QuestionMismatchFix,
+		question:     []dns.Question{otherQ},
+		wantQuestion: []dns.Question{otherQ},
+		wantErr:      true,
+		wantCount:    1,
+	}, {
+		name:         "log_other",
+		mode:         QuestionMismatchLog,
+		question:     []dns.Question{otherQ},
+		wantQuestion: []dns.Question{otherQ},
+		wantErr:      false,
+		wantCount:    1,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			stats := newConnStats()
+			c := newQuestionChecker(&Options{
+				Logger:           testLogger,
+				QuestionMismatch: tc.mode,
+			}, stats)
+
+			resp := respondToTestMessage(req)
+			resp.Question = tc.question
+
+			err := c.check(req, resp)
+			if tc.wantErr {
+				assert.ErrorIs(t, err, errQuestion)
+			} else {
+				assert.NoError(t, err)
+			}
+
+			assert.Equal(t, tc.wantQuestion, resp.Question)
+			assert.Equal(t, tc.wantCount, stats.clone().QuestionMismatches)
+		})
+	}
+}
+
+func TestQuestionChecker_check_redact(t *testing.T) {
+	t.Parallel()
+
+	req := createTestMessage()
+	const otherName = "secret.example."
+
+	testCases := []struct {
+		name string
+		mode QuestionMismatchMode
+	}{{
+		name: "log",
+		mode: QuestionMismatchLog,
+	}, {
+		name: "fix",
+		mode: QuestionMismatchFix,
+	}, {
+		name: "reject",
+		mode: QuestionMismatchReject,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			buf := &bytes.Buffer{}
+			h := slog.NewTextHandler(buf, &slog.HandlerOptions{Level: slog.LevelDebug})
+			logger := slog.New(redact.NewHandler(h, &redact.Config{
+				QNameMode:    redact.QNameModeNone,
+				ClientIPMode: redact.ClientIPModeFull,
+			}))
+
+			c := newQuestionChecker(&Options{
+				Logger:           logger,
+				QuestionMismatch: tc.mode,
+			}, newConnStats())
+
+			resp := respondToTestMessage(req)
+			resp.Question[0].Name = strings.ToUpper(req.Question[0].Name)
+			if tc.mode != QuestionMismatchFix {
+				resp.Question[0].Name = otherName
+			}
+
+			err := c.check(req, resp)
+			if err != nil {
+				assert.NotContains(t, err.Error(), otherName)
+			}
+
+			out := buf.String()
+			assert.NotContains(t, out, otherName)
+			assert.NotContains(t, out, strings.ToUpper(req.Question[0].Name))
+		})
+	}
+}
+
+func TestUpstream_questionMismatch(t *testing.T) {
+	t.Parallel()
+
+	srv := startDNSServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		resp := respondToTestMessage(r)
+		resp.Question = nil
+
+		require.NoError(testutil.PanicT{}, w.WriteMsg(resp))
+	})
+	testutil.CleanupAndRequireSuccess(t, srv.Close)
+
+	addr := fmt.Sprintf("tcp://127.0.0.1:%d", srv.port)
+	req := createTestMessage()
+
+	for _, mode := range []QuestionMismatchMode{
+		QuestionMismatchReject,
+		QuestionMismatchFix,
+	} {
+		t.Run(string(mode), func(t *testing.T) {
+			u, err := AddressToUpstream(addr, &Options{
+				Logger:           testLogger,
+				Timeout:          testTimeout,
+				QuestionMismatch: mode,
+			})
+			require.NoError(t, err)
+			testutil.CleanupAndRequireSuccess(t, u.Close)
+
+			resp, err := u.Exchange(req)
+			if mode == QuestionMismatchReject {
+				assert.ErrorIs(t, err, errQuestion)
+			} else {
+				require.NoError(t, err)
+				requireResponse(t, req, resp)
+				assert.Equal(t, req.Question, resp.Question)
+			}
+
+			stats := testutil.RequireTypeAssert[ConnStatsReporter](t, u).ConnStats()
+			assert.Equal(t, uint64(1), stats.QuestionMismatches)
+		})
+	}
+}
+
+func TestQuestionMismatchMode_UnmarshalText(t *testing.T) {
+	t.Parallel()
+
+	var m QuestionMismatchMode
+	require.NoError(t, m.UnmarshalText([]byte("")))
+	assert.Equal(t, QuestionMismatchReject, m)
+
+	require.NoError(t, m.UnmarshalText([]byte("fix")))
+	assert.Equal(t, QuestionMismatchFix, m)
+
+	assert.Error(t, m.UnmarshalText([]byte("ignore")))
+}
@@ -0,0 +1,145 @@
+package upstream
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+
+	proxynetutil "github.com/AdguardTeam/dnsproxy/internal/netutil"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/quic-go/quic-go"
+)
+
+// quicSocket is the configuration of the UDP sockets of the QUIC connections
+// of DNS-over-QUIC and HTTP/3 upstreams.
+type quicSocket struct {
+	// disableOffload hides the UDP optimizations supported by the socket from
+	// quic-go, see [Options.QUICDisableOffload].
+	disableOffload bool
+
+	// flowLabel makes the kernel set the IPv6 flow labels of the socket, see
+	// [Options.QUICFlowLabel].
+	flowLabel bool
+}
+
+// newQUICSocket returns the configuration of the QUIC sockets from opts.
+func newQUICSocket(opts *Options) (s quicSocket) {
+	return quicSocket{
+		disableOffload: opts.QUICDisableOffload,
+		flowLabel:      opts.QUICFlowLabel,
+	}
+}
+
+// dial establishes a new 0-RTT QUIC connection to addr, which must be an IP
+// address with port, over a new UDP socket configured according to s.  The
+// socket is closed along with the connection.
+func (s quicSocket) dial(
+	ctx context.Context,
+	addr string,
+	tlsConf *tls.Config,
+	conf *quic.Config,
+) (conn *quic.Conn, err error) {
+	if !s.disableOffload && !s.flowLabel {
+		return quic.DialAddrEarly(ctx, addr, tlsConf, conf)
+	}
+
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("resolving address: %w", err)
+	}
+
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4zero, Port: 0})
+	if err != nil {
+		return nil, fmt.Errorf("opening socket: %w", err)
+	}
+
+	if s.flowLabel && udpAddr.IP.To4() == nil {
+		err = proxynetutil.SetAutoFlowLabel(udpConn)
+		if err != nil {
+			return nil, errors.WithDeferred(err, udpConn.Close())
+		}
+	}
+
+	var pc net.PacketConn = udpConn
+	if s.disableOffload {
+		pc = noOffloadConn{UDPConn: udpConn}
+	}
+
+	conn, err = quic.DialEarly(ctx, pc, udpAddr, tlsConf, conf)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return nil, errors.WithDeferred(err, udpConn.Close())
+	}
+
+	// quic-go doesn't close the sockets it hasn't opened itself.
+	context.AfterFunc(conn.Context(), func() { _ = udpConn.Close() })
+
+	return conn, nil
+}
+
+// noOffloadConn is a UDP connection which doesn't implement the methods for
+// reading and writing the ancillary data, so that quic-go uses neither GSO,
+// ECN, nor batched reads for it.  It still allows adjusting the buffer sizes
+// and the DF bit.
+type noOffloadConn struct {
+	// UDPConn is the underlying connection.  It's not embedded as is to hide
+	// its ReadMsgUDP and WriteMsgUDP methods.
+	UDPConn *net.UDPConn
+}
+
+// type check
+var _ net.PacketConn = noOffloadConn{}
+
+// ReadFrom implements the [net.PacketConn] interface for noOffloadConn.
+func (c noOffloadConn) ReadFrom(b []byte) (n int, addr net.Addr, err error) {
+	return c.UDPConn.ReadFrom(b)
+}
+
+// WriteTo implements the [net.PacketConn] interface for noOffloadConn.
+func (c noOffloadConn) WriteTo(b []byte, addr net.Addr) (n int, err error) {
+	return c.UDPConn.WriteTo(b, addr)
+}
+
+// Close implements the [net.PacketConn] interface for noOffloadConn.
+func (c noOffloadConn) Close() (err error) {
+	return c.UDPConn.Close()
+}
+
+// LocalAddr implements the [net.PacketConn] interface for noOffloadConn.
+func (c noOffloadConn) LocalAddr() (addr net.Addr) {
+	return c.UDPConn.LocalAddr()
+}
+
+// SetDeadline implements the [net.PacketConn] interface for noOffloadConn.
+func (c noOffloadConn) SetDeadline(t time.Time) (err error) {
+	return c.UDPConn.SetDeadline(t)
+}
+
+// SetReadDeadline implements the [net.PacketConn] interface for noOffloadConn.
+func (c noOffloadConn) SetReadDeadline(t time.Time) (err error) {
+	return c.UDPConn.SetReadDeadline(t)
+}
+
+// SetWriteDeadline implements the [net.PacketConn] interface for
+// noOffloadConn.
+func (c noOffloadConn) SetWriteDeadline(t time.Time) (err error) {
+	return c.UDPConn.SetWriteDeadline(t)
+}
+
+// SetReadBuffer sets the size of the receive buffer of the socket.
+func (c noOffloadConn) SetReadBuffer(n int) (err error) {
+	return c.UDPConn.SetReadBuffer(n)
+}
+
+// SetWriteBuffer sets the size of the send buffer of the socket.
+func (c noOffloadConn) SetWriteBuffer(n int) (err error) {
+	return c.UDPConn.SetWriteBuffer(n)
+}
+
+// SyscallConn returns the raw connection of the socket.
+func (c noOffloadConn) SyscallConn() (rc syscall.RawConn, err error) {
+	return c.UDPConn.SyscallConn()
+}
@@ -0,0 +1,96 @@
+package upstream
+
+import (
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/AdguardTeam/golibs/errors"
+)
+
+// Factory creates an [Upstream] for an address with a custom URL scheme, see
+// [RegisterScheme].  u is the parsed address, opts are the options passed to
+// [AddressToUpstream].  Neither u nor opts is nil, and opts.Logger is set.
+type Factory func(u *url.URL, opts *Options) (ups Upstream, err error)
+
+// builtinSchemes are the URL schemes handled by [AddressToUpstream] itself.
+var builtinSchemes = []string{
+	"h3",
+	"https",
+	"quic",
+	"sdns",
+	"tcp",
+	"tls",
+	"udp",
+}
+
+// registry contains the factories for custom URL schemes.
+var registry = &schemeRegistry{
+	mu:        &sync.RWMutex{},
+	factories: map[string]Factory{},
+}
+
+// schemeRegistry is the concurrency-safe set of factories by URL scheme.
+type schemeRegistry struct {
+	// mu protects factories.
+	mu        *sync.RWMutex
+	factories map[string]Factory
+}
+
+// RegisterScheme makes [AddressToUpstream] use f to create upstreams for the
+// addresses with the given URL scheme, e.g. "rpc" for "rpc://resolver".  The
+// scheme is case-insensitive.  It returns an error if scheme is empty, built-in,
+// or already registered, or if f is nil.  It's safe for concurrent use.
+//
+// The addresses with custom schemes are passed to f as is, so f is responsible
+// for validating them.  Note that the fixed IP addresses after "#" aren't
+// supported for those.
+func RegisterScheme(scheme string, f Factory) (err error) {
+	scheme = strings.ToLower(scheme)
+	switch {
+	case scheme == "":
+		return fmt.Errorf("scheme: %w", errors.ErrEmptyValue)
+	case f == nil:
+		return fmt.Errorf("factory for scheme %q: %w", scheme, errors.ErrNoValue)
+	case isBuiltinScheme(scheme):
+		return fmt.Errorf("scheme %q is built-in", scheme)
+	}
+
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+
+	if _, ok := registry.factories[scheme]; ok {
+		return fmt.Errorf("scheme %q: %w", scheme, errors.ErrDuplicated)
+	}
+
+	registry.factories[scheme] = f
+
+	return nil
+}
+
+// UnregisterScheme removes the factory for the custom URL scheme registered
+// with [RegisterScheme], if any.  It's safe for concurrent use.
+func UnregisterScheme(scheme string) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+
+	delete(registry.factories, strings.ToLower(scheme))
+}
+
+// isBuiltinScheme returns true if scheme is handled by [AddressToUpstream]
+// itself.  scheme must be in lower case.
+func isBuiltinScheme(scheme string) (ok bool) {
+	return slices.Contains(builtinSchemes, scheme)
+}
+
+// customFactory returns the factory registered for scheme, if any.
+func customFactory(scheme string) (f Factory, ok bool) {
+	registry.mu.RLock()
+	defer registry.mu.RUnlock()
+
+	f, ok = registry.factories[strings.ToLower(scheme)]
+
+	return f, ok
+}
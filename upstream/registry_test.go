@@ -0,0 +1,108 @@
+package upstream_test
+
+import (
+	"bytes"
+	"log/slog"
+	"net/url"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/internal/dnsproxytest"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegisterScheme(t *testing.T) {
+	const (
+		scheme = "rpc"
+		addr   = "rpc://resolver.internal/dns"
+	)
+
+	var gotURL *url.URL
+	factory := func(u *url.URL, opts *upstream.Options) (ups upstream.Upstream, err error) {
+		gotURL = u
+
+		return &dnsproxytest.Upstream{
+			OnAddress:  func() (a string) { return u.String() },
+			OnExchange: nil,
+			OnClose:    func() (err error) { return nil },
+		}, nil
+	}
+
+	require.NoError(t, upstream.RegisterScheme(scheme, factory))
+	t.Cleanup(func() { upstream.UnregisterScheme(scheme) })
+
+	u, err := upstream.AddressToUpstream(addr, &upstream.Options{
+		Logger: testLogger,
+	})
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, u.Close)
+
+	require.NotNil(t, gotURL)
+	assert.Equal(t, "resolver.internal", gotURL.Host)
+	assert.Equal(t, addr, u.Address())
+
+	t.Run("duplicated", func(t *testing.T) {
+		err = upstream.RegisterScheme("RPC", factory)
+		assert.ErrorIs(t, err, errors.ErrDuplicated)
+	})
+
+	t.Run("builtin", func(t *testing.T) {
+		err = upstream.RegisterScheme("https", factory)
+		testutil.AssertErrorMsg(t, `scheme "https" is built-in`, err)
+	})
+
+	t.Run("nil_factory", func(t *testing.T) {
+		err = upstream.RegisterScheme("other", nil)
+		assert.ErrorIs(t, err, errors.ErrNoValue)
+	})
+
+	t.Run("unregistered", func(t *testing.T) {
+		_, err = upstream.AddressToUpstream("other://resolver.internal", &upstream.Options{
+			Logger: testLogger,
+		})
+		testutil.AssertErrorMsg(t, "unsupported url scheme: other", err)
+	})
+}
+
+func TestAddressToUpstream_logger(t *testing.T) {
+	const scheme = "logged"
+
+	var gotLogger *slog.Logger
+	factory := func(u *url.URL, opts *upstream.Options) (ups upstream.Upstream, err error) {
+		gotLogger = opts.Logger
+
+		return &dnsproxytest.Upstream{
+			OnAddress:  func() (a string) { return u.String() },
+			OnExchange: nil,
+			OnClose:    func() (err error) { return nil },
+		}, nil
+	}
+
+	require.NoError(t, upstream.RegisterScheme(scheme, factory))
+	t.Cleanup(func() { upstream.UnregisterScheme(scheme) })
+
+	buf := &bytes.Buffer{}
+	opts := &upstream.Options{
+		Logger: slog.New(slog.NewTextHandler(buf, nil)).With(upstream.KeyGroup, "main"),
+	}
+	baseLogger := opts.Logger
+
+	u, err := upstream.AddressToUpstream(scheme+"://user:secret@resolver.internal", opts)
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, u.Close)
+
+	// The options of the caller must not be modified.
+	assert.Same(t, baseLogger, opts.Logger)
+
+	require.NotNil(t, gotLogger)
+	gotLogger.Info("test")
+
+	logged := buf.String()
+	assert.Contains(t, logged, upstream.KeyGroup+"=main")
+	assert.Contains(t, logged, upstream.KeyProto+"="+scheme)
+	assert.Contains(t, logged, upstream.KeyAddr+"="+scheme+"://user:xxxxx@resolver.internal")
+	assert.NotContains(t, logged, "secret")
+}
@@ -261,18 +261,38 @@ func (r *UpstreamResolver) resolveAsync(resCh chan<- any, host, network string)
 }
 
 // CachingResolver is a [Resolver] that caches the results of lookups.  It's
-// required to be created with [NewCachingResolver].
+// required to be created with [NewCachingResolver].  Concurrent lookups of the
+// same host share a single request, so that a single CachingResolver is fine
+// for large numbers of upstreams.
 type CachingResolver struct {
 	// resolver is the underlying resolver to use for lookups.
 	resolver *UpstreamResolver
 
-	// mu protects cache and it's elements.
+	// mu protects cache, inflight, and their elements.
 	mu *sync.RWMutex
 
 	// cache is the set of resolved hostnames mapped to cached addresses.
 	//
 	// TODO(e.burkov):  Use expiration cache.
 	cache map[string]*ipResult
+
+	// inflight is the set of hostnames being resolved mapped to the lookups in
+	// progress.
+	inflight map[string]*inflightLookup
+}
+
+// inflightLookup is a lookup of a hostname in progress.
+type inflightLookup struct {
+	// res is the result of the lookup.  It must only be accessed after done is
+	// closed.
+	res *ipResult
+
+	// err is the error of the lookup.  It must only be accessed after done is
+	// closed.
+	err error
+
+	// done is closed once the lookup is finished.
+	done chan struct{}
 }
 
 // NewCachingResolver creates a new caching resolver that uses r for lookups.
@@ -281,6 +301,7 @@ func NewCachingResolver(r *UpstreamResolver) (cr *CachingResolver) {
 		resolver: r,
 		mu:       &sync.RWMutex{},
 		cache:    map[string]*ipResult{},
+		inflight: map[string]*inflightLookup{},
 	}
 }
 
@@ -288,9 +309,6 @@ func NewCachingResolver(r *UpstreamResolver) (cr *CachingResolver) {
 var _ Resolver = (*CachingResolver)(nil)
 
 // LookupNetIP implements the [Resolver] interface for *CachingResolver.
-//
-// TODO(e.burkov):  It may appear that several concurrent lookup results rewrite
-// each other in the cache.
 func (r *CachingResolver) LookupNetIP(
 	ctx context.Context,
 	network bootstrap.Network,
@@ -304,16 +322,52 @@ func (r *CachingResolver) LookupNetIP(
 		return slices.Clone(addrs), nil
 	}
 
-	res, err := r.resolver.lookupNetIP(ctx, network, host)
+	res, err := r.lookupShared(ctx, network, host)
 	if err != nil {
 		return []netip.Addr{}, err
 	}
 
-	r.setCached(host, res)
-
 	return slices.Clone(res.addrs), nil
 }
 
+// lookupShared performs a DNS lookup of host, or waits for the one already in
+// progress, and caches the result.  It's safe for concurrent use.
+func (r *CachingResolver) lookupShared(
+	ctx context.Context,
+	network bootstrap.Network,
+	host string,
+) (res *ipResult, err error) {
+	r.mu.Lock()
+	l, ok := r.inflight[host]
+	if !ok {
+		l = &inflightLookup{
+			done: make(chan struct{}),
+		}
+		r.inflight[host] = l
+	}
+	r.mu.Unlock()
+
+	if ok {
+		<-l.done
+
+		return l.res, l.err
+	}
+
+	defer close(l.done)
+
+	l.res, l.err = r.resolver.lookupNetIP(ctx, network, host)
+	if l.err == nil {
+		r.setCached(host, l.res)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.inflight, host)
+
+	return l.res, l.err
+}
+
 // findCached returns the cached addresses for host if it's not expired yet, and
 // the corresponding cached result, if any.  It's safe for concurrent use.
 func (r *CachingResolver) findCached(host string, now time.Time) (addrs []netip.Addr) {
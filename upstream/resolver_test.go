@@ -3,6 +3,8 @@ package upstream_test
 import (
 	"context"
 	"net/netip"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -103,6 +105,10 @@ func TestNewUpstreamResolver_validity(t *testing.T) {
 			t.Parallel()
 
 			r, err := upstream.NewUpstreamResolver(tc.addr, withTimeoutOpt)
+			if r != nil {
+				testutil.CleanupAndRequireSuccess(t, r.Close)
+			}
+
 			if tc.wantErrMsg != "" {
 				assert.Equal(t, tc.wantErrMsg, err.Error())
 				if nberr := (&upstream.NotBootstrapError{}); errors.As(err, &nberr) {
@@ -207,3 +213,59 @@ func TestCachingResolver_staleness(t *testing.T) {
 		require.Empty(t, cached)
 	})
 }
+
+func TestCachingResolver_concurrent(t *testing.T) {
+	const (
+		fqdn    = "shared.example."
+		lookups = 10
+	)
+
+	var exchanges atomic.Int32
+	started := make(chan struct{}, 2)
+	release := make(chan struct{})
+
+	ups := &dnsproxytest.Upstream{
+		OnAddress: func() (_ string) { panic(testutil.UnexpectedCall()) },
+		OnClose:   func() (_ error) { panic(testutil.UnexpectedCall()) },
+		OnExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+			exchanges.Add(1)
+			started <- struct{}{}
+			<-release
+
+			resp = (&dns.Msg{}).SetReply(req)
+			if req.Question[0].Qtype == dns.TypeA {
+				resp.Answer = append(resp.Answer, &dns.A{
+					Hdr: dns.RR_Header{
+						Name:   req.Question[0].Name,
+						Rrtype: dns.TypeA,
+						Class:  dns.ClassINET,
+						Ttl:    60,
+					},
+					A: netip.MustParseAddr("1.2.3.4").AsSlice(),
+				})
+			}
+
+			return resp, nil
+		},
+	}
+
+	r := upstream.NewCachingResolver(&upstream.UpstreamResolver{Upstream: ups})
+
+	wg := &sync.WaitGroup{}
+	for range lookups {
+		wg.Go(func() {
+			addrs, err := r.LookupNetIP(context.Background(), bootstrap.NetworkIP, fqdn)
+			assert.NoError(t, err)
+			assert.Len(t, addrs, 1)
+		})
+	}
+
+	// Wait for both A and AAAA requests of the single lookup.
+	testutil.RequireReceive(t, started, testTimeout)
+	testutil.RequireReceive(t, started, testTimeout)
+	close(release)
+
+	wg.Wait()
+
+	assert.EqualValues(t, 2, exchanges.Load())
+}
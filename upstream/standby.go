@@ -0,0 +1,167 @@
+package upstream
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+)
+
+// connStandby keeps an established connection to the upstream server in
+// addition to the active ones, so that it's used right away once those fail,
+// without waiting for a new handshake.  The upstreams only dial the standby
+// connections after the successful exchanges, so that their TLS sessions are
+// resumed using the tickets received before.  A nil *connStandby keeps
+// nothing.
+//
+// The dialing functions are passed to the methods instead of being stored, so
+// that the upstream isn't kept alive by the standby it owns.
+type connStandby[T comparable] struct {
+	// logger is used to log the failures of the standby connections.  It is
+	// never nil.
+	logger *slog.Logger
+
+	// mu protects conn, dialing, and closed.
+	mu *sync.Mutex
+
+	// isAlive returns false if the connection has already been closed.  If
+	// nil, the connections are considered alive until used.
+	isAlive func(conn T) (ok bool)
+
+	// closeConn closes the connection.  It must not be nil.
+	closeConn func(conn T) (err error)
+
+	// conn is the standby connection.  It's zero if there is none.
+	conn T
+
+	// dialing is true while a new standby connection is being dialed.
+	dialing bool
+
+	// closed is true once the standby has been closed.
+	closed bool
+}
+
+// newConnStandby returns a new properly initialized *connStandby.  isAlive may
+// be nil, closeConn must not be nil.
+func newConnStandby[T comparable](
+	l *slog.Logger,
+	isAlive func(conn T) (ok bool),
+	closeConn func(conn T) (err error),
+) (s *connStandby[T]) {
+	return &connStandby[T]{
+		logger:    l,
+		mu:        &sync.Mutex{},
+		isAlive:   isAlive,
+		closeConn: closeConn,
+	}
+}
+
+// take returns the standby connection and true, if there is an alive one.  If
+// there has been any, a new one is dialed using dial.  s may be nil.
+func (s *connStandby[T]) take(dial func(ctx context.Context) (conn T, err error)) (conn T, ok bool) {
+	if s == nil {
+		return conn, false
+	}
+
+	var zero T
+
+	s.mu.Lock()
+	conn, s.conn = s.conn, zero
+	s.mu.Unlock()
+
+	if conn == zero {
+		return conn, false
+	}
+
+	defer s.refill(dial)
+
+	if s.isAlive != nil && !s.isAlive(conn) {
+		s.close(conn)
+
+		return zero, false
+	}
+
+	s.logger.Debug("promoting standby connection")
+
+	return conn, true
+}
+
+// refill starts dialing a new standby connection using dial, unless there is
+// an alive one already or it's being dialed.  s may be nil.
+func (s *connStandby[T]) refill(dial func(ctx context.Context) (conn T, err error)) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var zero T
+	if s.closed || s.dialing {
+		return
+	} else if s.conn != zero {
+		if s.isAlive == nil || s.isAlive(s.conn) {
+			return
+		}
+
+		s.close(s.conn)
+		s.conn = zero
+	}
+
+	s.dialing = true
+	go s.dial(dial)
+}
+
+// dial dials a new standby connection and keeps it.  It's intended to be used
+// as a goroutine.
+func (s *connStandby[T]) dial(dial func(ctx context.Context) (conn T, err error)) {
+	defer slogutil.RecoverAndLog(context.Background(), s.logger)
+
+	conn, err := dial(context.Background())
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.dialing = false
+	if err != nil {
+		s.logger.Debug("dialing standby connection", slogutil.KeyError, err)
+
+		return
+	}
+
+	if s.closed {
+		s.close(conn)
+
+		return
+	}
+
+	s.conn = conn
+}
+
+// shutdown closes the standby connection, if any, and prevents dialing the new
+// ones.  s may be nil.
+func (s *connStandby[T]) shutdown() {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+
+	var zero T
+	if s.conn != zero {
+		s.close(s.conn)
+		s.conn = zero
+	}
+}
+
+// close closes conn and logs the error, if any.
+func (s *connStandby[T]) close(conn T) {
+	err := s.closeConn(conn)
+	if err != nil {
+		s.logger.Debug("closing standby connection", slogutil.KeyError, err)
+	}
+}
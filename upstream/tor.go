@@ -0,0 +1,105 @@
+package upstream
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/internal/bootstrap"
+	"github.com/AdguardTeam/golibs/errors"
+	"golang.org/x/net/proxy"
+)
+
+const (
+	// torMinTimeout is the minimum timeout of the exchanges with the onion
+	// services, since the first one also builds the circuit.
+	torMinTimeout = 30 * time.Second
+
+	// torConnTimeout is the timeout for establishing the TLS connections to
+	// the onion services, each handshake message of which travels through
+	// several relays.
+	torConnTimeout = 60 * time.Second
+)
+
+// isOnion returns true if host is a hostname of an onion service.
+func isOnion(host string) (ok bool) {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	return strings.HasSuffix(host, ".onion")
+}
+
+// usesTor returns true if the upstream with host should be dialed through Tor.
+func (o *Options) usesTor(host string) (ok bool) {
+	return o.TorSOCKSAddr.IsValid() && isOnion(host)
+}
+
+// withTor returns the copy of opts adjusted for the onion service at uu.  It
+// returns an error if the protocol of uu can't be used through Tor.
+func withTor(uu *url.URL, opts *Options) (torOpts *Options, err error) {
+	if len(opts.serverIPs) > 0 {
+		return nil, fmt.Errorf("tor: onion service %s has no ip addresses", uu.Hostname())
+	}
+
+	torOpts = opts.Clone()
+
+	switch uu.Scheme {
+	case "tls":
+		// Go on.
+	case "https":
+		// Tor only carries TCP, so HTTP/3 is unavailable.
+		versions := opts.HTTPVersions
+		if len(versions) == 0 {
+			versions = DefaultHTTPVersions
+		}
+
+		torOpts.HTTPVersions = slices.DeleteFunc(slices.Clone(versions), func(v HTTPVersion) (ok bool) {
+			return v == HTTPVersion3
+		})
+		if len(torOpts.HTTPVersions) == 0 {
+			return nil, errors.Error("tor: http/3 is not supported")
+		}
+	default:
+		return nil, fmt.Errorf("tor: unsupported url scheme: %s", uu.Scheme)
+	}
+
+	if opts.Timeout != 0 {
+		torOpts.Timeout = max(opts.Timeout, torMinTimeout)
+	}
+
+	torOpts.connTimeout = torConnTimeout
+
+	return torOpts, nil
+}
+
+// newTorDialHandler returns a dial handler connecting to addr through the Tor
+// SOCKS5 proxy at socksAddr, so that the hostname of addr is resolved by Tor.
+// l must not be nil.
+func newTorDialHandler(socksAddr netip.AddrPort, addr string, l *slog.Logger) (h bootstrap.DialHandler) {
+	// [proxy.SOCKS5] never returns an error.
+	dialer, _ := proxy.SOCKS5(networkTCP, socksAddr.String(), nil, &net.Dialer{})
+	ctxDialer := dialer.(proxy.ContextDialer)
+
+	return func(ctx context.Context, network bootstrap.Network, _ string) (conn net.Conn, err error) {
+		if network != networkTCP {
+			return nil, fmt.Errorf("tor: unsupported network: %s", network)
+		}
+
+		l.DebugContext(ctx, "dialing through tor", "addr", addr, "socks_addr", socksAddr)
+
+		start := time.Now()
+		conn, err = ctxDialer.DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, fmt.Errorf("dialing %s through tor: %w", addr, err)
+		}
+
+		l.DebugContext(ctx, "connection succeeded", "elapsed", time.Since(start))
+
+		return conn, nil
+	}
+}
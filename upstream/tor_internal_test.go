@@ -0,0 +1,184 @@
+package upstream
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testOnionHost is the hostname of an onion service for tests.
+const testOnionHost = "dnsexampleonionserviceaddressforthetestsxxxxxxxxxxxxxxxx.onion"
+
+func TestUpstream_tor(t *testing.T) {
+	srv := startDoTServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		require.NoError(testutil.PanicT{}, w.WriteMsg(respondToTestMessage(req)))
+	})
+
+	dotAddr := fmt.Sprintf("127.0.0.1:%d", srv.port)
+	socksAddr, hostCh := startSOCKS5Server(t, dotAddr)
+
+	u, err := AddressToUpstream("tls://"+testOnionHost, &Options{
+		Logger:             testLogger,
+		Timeout:            testTimeout,
+		TorSOCKSAddr:       socksAddr,
+		InsecureSkipVerify: true,
+	})
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, u.Close)
+
+	req := createTestMessage()
+	resp, err := u.Exchange(req)
+	require.NoError(t, err)
+	requireResponse(t, req, resp)
+
+	host, ok := testutil.RequireReceive(t, hostCh, testTimeout)
+	require.True(t, ok)
+
+	assert.Equal(t, testOnionHost+":853", host)
+}
+
+func TestWithTor(t *testing.T) {
+	t.Parallel()
+
+	opts := &Options{
+		Timeout:      time.Second,
+		TorSOCKSAddr: netip.MustParseAddrPort("127.0.0.1:9050"),
+	}
+
+	testCases := []struct {
+		opts         *Options
+		wantVersions []HTTPVersion
+		name         string
+		addr         string
+		wantErrMsg   string
+	}{{
+		opts:         opts,
+		wantVersions: nil,
+		name:         "dot",
+		addr:         "tls://" + testOnionHost,
+		wantErrMsg:   "",
+	}, {
+		opts:         opts,
+		wantVersions: []HTTPVersion{HTTPVersion11, HTTPVersion2},
+		name:         "doh",
+		addr:         "https://" + testOnionHost + "/dns-query",
+		wantErrMsg:   "",
+	}, {
+		opts:         opts,
+		wantVersions: nil,
+		name:         "h3",
+		addr:         "h3://" + testOnionHost + "/dns-query",
+		wantErrMsg:   "tor: unsupported url scheme: h3",
+	}, {
+		opts:         opts,
+		wantVersions: nil,
+		name:         "doq",
+		addr:         "quic://" + testOnionHost,
+		wantErrMsg:   "tor: unsupported url scheme: quic",
+	}, {
+		opts: &Options{
+			HTTPVersions: []HTTPVersion{HTTPVersion3},
+			TorSOCKSAddr: opts.TorSOCKSAddr,
+		},
+		wantVersions: nil,
+		name:         "doh_only_h3",
+		addr:         "https://" + testOnionHost + "/dns-query",
+		wantErrMsg:   "tor: http/3 is not supported",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			uu, err := url.Parse(tc.addr)
+			require.NoError(t, err)
+
+			torOpts, err := withTor(uu, tc.opts)
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, err)
+			if err != nil {
+				return
+			}
+
+			assert.Equal(t, torMinTimeout, torOpts.Timeout)
+			assert.Equal(t, torConnTimeout, torOpts.connTimeout)
+			assert.Equal(t, tc.wantVersions, torOpts.HTTPVersions)
+		})
+	}
+}
+
+// startSOCKS5Server starts a SOCKS5 server, which accepts a single connection
+// and forwards it to fwdAddr.  The address requested by the client is sent to
+// hostCh.
+func startSOCKS5Server(
+	tb testing.TB,
+	fwdAddr string,
+) (addr netip.AddrPort, hostCh <-chan string) {
+	tb.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(tb, err)
+	testutil.CleanupAndRequireSuccess(tb, l.Close)
+
+	ch := make(chan string, 1)
+
+	go func() {
+		pt := testutil.PanicT{}
+
+		conn, acceptErr := l.Accept()
+		require.NoError(pt, acceptErr)
+
+		defer func() { _ = conn.Close() }()
+
+		var ioErr error
+
+		// Read the greeting and choose no authentication.
+		hdr := make([]byte, 2)
+		_, ioErr = io.ReadFull(conn, hdr)
+		require.NoError(pt, ioErr)
+
+		_, ioErr = io.ReadFull(conn, make([]byte, hdr[1]))
+		require.NoError(pt, ioErr)
+
+		_, ioErr = conn.Write([]byte{5, 0})
+		require.NoError(pt, ioErr)
+
+		// Read the connect request with a domain name.
+		req := make([]byte, 5)
+		_, ioErr = io.ReadFull(conn, req)
+		require.NoError(pt, ioErr)
+		require.Equal(pt, byte(3), req[3])
+
+		hostPort := make([]byte, int(req[4])+2)
+		_, ioErr = io.ReadFull(conn, hostPort)
+		require.NoError(pt, ioErr)
+
+		nameLen := len(hostPort) - 2
+		port := binary.BigEndian.Uint16(hostPort[nameLen:])
+		ch <- fmt.Sprintf("%s:%d", hostPort[:nameLen], port)
+
+		fwd, dialErr := net.Dial("tcp", fwdAddr)
+		require.NoError(pt, dialErr)
+
+		defer func() { _ = fwd.Close() }()
+
+		_, ioErr = conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+		require.NoError(pt, ioErr)
+
+		go func() { _, _ = io.Copy(fwd, conn) }()
+		_, _ = io.Copy(conn, fwd)
+	}()
+
+	tcpAddr := testutil.RequireTypeAssert[*net.TCPAddr](tb, l.Addr())
+
+	return tcpAddr.AddrPort(), ch
+}
@@ -19,6 +19,7 @@ import (
 
 	"github.com/AdguardTeam/dnscrypt"
 	"github.com/AdguardTeam/dnsproxy/internal/bootstrap"
+	proxynetutil "github.com/AdguardTeam/dnsproxy/internal/netutil"
 	"github.com/AdguardTeam/golibs/errors"
 	"github.com/AdguardTeam/golibs/logutil/slogutil"
 	"github.com/AdguardTeam/golibs/netutil"
@@ -46,6 +47,27 @@ type Upstream interface {
 	io.Closer
 }
 
+// ContextExchanger is an optional interface for the [Upstream] implementations
+// that establish connections on demand.  Those are aborted, along with the
+// exchange itself, once the context is canceled.
+type ContextExchanger interface {
+	// ExchangeContext is like [Upstream.Exchange], but it uses ctx for
+	// establishing the connections and probing the upstream.  ctx must not be
+	// nil.
+	ExchangeContext(ctx context.Context, req *dns.Msg) (resp *dns.Msg, err error)
+}
+
+// ExchangeContext sends req to u using ctx, if u implements [ContextExchanger].
+// Otherwise, it calls [Upstream.Exchange] ignoring ctx.  u and req must not be
+// nil.
+func ExchangeContext(ctx context.Context, u Upstream, req *dns.Msg) (resp *dns.Msg, err error) {
+	if ce, ok := u.(ContextExchanger); ok {
+		return ce.ExchangeContext(ctx, req)
+	}
+
+	return u.Exchange(req)
+}
+
 // QUICTracer creates [qlogwriter.Trace] instances for QUIC connection tracing.
 type QUICTracer interface {
 	// TraceForConnection creates a [qlogwriter.Trace] specific for a given
@@ -93,40 +115,277 @@ type Options struct {
 	// [net.DefaultResolver] will be used.
 	Bootstrap Resolver
 
+	// HostBootstraps maps the hostnames of upstreams to the resolvers used to
+	// resolve them instead of Bootstrap.  Hostnames must be in lower case and
+	// without the trailing dot.  Upstreams with hostnames missing from the map
+	// are resolved with Bootstrap.
+	HostBootstraps map[string]Resolver
+
+	// HostEDNSBufferSizes maps the hostnames, or the IP addresses, of plain
+	// DNS upstreams to the EDNS0 UDP payload sizes advertised to them,
+	// overriding EDNSBufferSize.  The keys must be lowercased.
+	HostEDNSBufferSizes map[string]uint16
+
+	// TorSOCKSAddr is the address of the SOCKS5 port of a Tor client.  If
+	// set, the DNS-over-TLS and DNS-over-HTTPS upstreams with the .onion
+	// hostnames are dialed through it, since those can't be bootstrapped.
+	// Such upstreams don't use HTTP/3, and their timeouts are raised to at
+	// least 30 seconds, since building the circuits to the onion services
+	// takes a while.  Upstreams of other protocols with the .onion hostnames
+	// are rejected.
+	TorSOCKSAddr netip.AddrPort
+
 	// HTTPVersions is a list of HTTP versions that should be supported by the
 	// DNS-over-HTTPS client.  If not set, HTTP/1.1 and HTTP/2 will be used.
 	HTTPVersions []HTTPVersion
 
+	// HTTPProbeStorage persists the outcomes of probing the DNS-over-HTTPS
+	// upstreams for HTTP/3, so that those survive restarts.  If nil, the
+	// outcomes are only kept in memory.  It's only used when HTTPProbeCacheTTL
+	// is positive.
+	HTTPProbeStorage HTTPProbeStorage
+
 	// Timeout is the default upstream timeout.  It's also used as a timeout for
 	// bootstrap DNS requests.  Zero value disables the timeout.
 	Timeout time.Duration
 
+	// HTTPProbeCacheTTL is the duration for which the outcome of racing QUIC
+	// against TLS for a DNS-over-HTTPS upstream supporting both HTTP/3 and
+	// HTTP/2 is reused when the HTTP client is re-created.  If zero, the
+	// upstream is probed each time.
+	HTTPProbeCacheTTL time.Duration
+
+	// HTTPDowngradePeriod is the time a DNS-over-HTTPS upstream downgraded
+	// because of HTTPErrorBudget keeps using the lower HTTP version before
+	// trying the higher ones again.  If zero, [DefaultHTTPDowngradePeriod] is
+	// used.
+	HTTPDowngradePeriod time.Duration
+
+	// QUICKeepAlivePeriod is the period of sending keep-alive PINGs on idle
+	// DNS-over-QUIC and DNS-over-HTTP/3 connections.  A connection, which
+	// stops responding to those, is closed and re-established in the
+	// background.  If zero, [QUICKeepAlivePeriod] is used.
+	QUICKeepAlivePeriod time.Duration
+
+	// QUICMaxIdleTimeout is the maximum time a DNS-over-QUIC or HTTP/3
+	// connection may stay idle before it's closed.  If zero, the default of
+	// quic-go is used.  It's negotiated with the server, so the actual timeout
+	// may be lower.
+	QUICMaxIdleTimeout time.Duration
+
+	// UDPRetransmitInterval is the time to wait for the response from a plain
+	// UDP upstream before sending the query again.  It must be positive if
+	// UDPRetransmitAttempts is greater than 1.
+	UDPRetransmitInterval time.Duration
+
+	// QUICVersions are the QUIC versions offered by the DNS-over-QUIC and
+	// HTTP/3 upstreams in the order of preference.  If empty, the default
+	// versions of quic-go are used.  Only [quic.Version1] and [quic.Version2]
+	// are supported.
+	QUICVersions []quic.Version
+
+	// DoQNextProtos are the ALPN tokens offered by the DNS-over-QUIC upstreams
+	// in the order of preference.  The messages are framed according to the
+	// token negotiated with the server, so that the servers implementing only
+	// the drafts of RFC 9250 are still supported.  If empty, [NextProtoDQ] is
+	// preferred, followed by the draft tokens from the newest to the oldest.
+	// Only [NextProtoDQ], [NextProtoDQDraft02], [NextProtoDQDraft00], and
+	// [NextProtoDQLegacy] are supported.
+	DoQNextProtos []string
+
+	// QUICInitialStreamReceiveWindow is the initial size of the receive window
+	// of a QUIC stream.  If zero, the default of quic-go is used.
+	QUICInitialStreamReceiveWindow uint64
+
+	// QUICMaxStreamReceiveWindow is the maximum size of the receive window of
+	// a QUIC stream.  If zero, the default of quic-go is used.  It must not be
+	// less than QUICInitialStreamReceiveWindow, if both are set.
+	QUICMaxStreamReceiveWindow uint64
+
+	// QUICInitialConnectionReceiveWindow is the initial size of the receive
+	// window of a QUIC connection.  If zero, the default of quic-go is used.
+	QUICInitialConnectionReceiveWindow uint64
+
+	// QUICMaxConnectionReceiveWindow is the maximum size of the receive window
+	// of a QUIC connection.  If zero, the default of quic-go is used.  It must
+	// not be less than QUICInitialConnectionReceiveWindow, if both are set.
+	QUICMaxConnectionReceiveWindow uint64
+
+	// HTTPErrorBudget is the maximum share of failed exchanges among the
+	// recent ones made by a DNS-over-HTTPS upstream using a single HTTP
+	// version.  Once it's exceeded, the upstream is downgraded to the next
+	// supported lower version: from HTTP/3 to HTTP/2 and from HTTP/2 to
+	// HTTP/1.1.  It must be within the [0, 1] range, zero disables the
+	// downgrades.
+	HTTPErrorBudget float64
+
+	// UDPRetransmitAttempts is the maximum number of times a query is sent to
+	// a plain UDP upstream.  The last attempt waits for the response until
+	// Timeout.  Values less than 2 disable the retransmission.
+	UDPRetransmitAttempts uint
+
+	// UDPRetransmitSwitchServer makes the retransmitted queries go through a
+	// new socket and, if several addresses of the upstream are specified
+	// explicitly, to the next of those.
+	UDPRetransmitSwitchServer bool
+
+	// UDPRandomizeCase makes the plain DNS upstreams randomize the case of the
+	// letters of the question names sent over UDP and require the responses
+	// to repeat it exactly, also known as the 0x20 encoding.  It makes the
+	// off-path injection of forged responses harder, but some upstreams don't
+	// preserve the case of the question and fall back to TCP then.
+	UDPRandomizeCase bool
+
+	// QuestionMismatch is the way the upstreams handle the responses with the
+	// question section not matching the one of the query, e.g. missing or
+	// repeating the name in another case.  If empty,
+	// [QuestionMismatchReject] is used.  The plain DNS upstreams randomizing
+	// the case over UDP still require it to be repeated exactly, see
+	// [Options.UDPRandomizeCase].
+	QuestionMismatch QuestionMismatchMode
+
+	// QUICEnableDatagrams makes the DNS-over-QUIC and HTTP/3 upstreams
+	// announce the support of the unreliable QUIC datagrams, see RFC 9221.
+	QUICEnableDatagrams bool
+
+	// PackedQueryTTL is the time the DNS-over-HTTPS and DNS-over-QUIC
+	// upstreams reuse the packed form of the identical queries for, so that
+	// the bursts of those aren't packed repeatedly.  It's useful when the
+	// identical queries aren't deduplicated before reaching the upstreams, see
+	// [DefaultPackedQueryTTL].  If zero, each query is packed.
+	PackedQueryTTL time.Duration
+
+	// QUICDisableOffload disables the UDP optimizations quic-go uses for the
+	// sockets of the DNS-over-QUIC and HTTP/3 upstreams on Linux: the generic
+	// segmentation offload of the outgoing packets, the ECN marking, and the
+	// batched reads.  Those reduce the CPU usage at high throughput, but may
+	// not work through some network interfaces and tunnels.
+	QUICDisableOffload bool
+
+	// QUICFlowLabel makes the IPv6 packets of the DNS-over-QUIC and HTTP/3
+	// upstreams carry the flow labels stable for each connection, so that the
+	// routers with ECMP keep those on the same path.  It's only supported on
+	// Linux.
+	QUICFlowLabel bool
+
+	// WarmStandby makes the DNS-over-TLS and DNS-over-QUIC upstreams keep an
+	// additional established connection, which is used right away once the
+	// active one fails, so that the failover doesn't wait for a new handshake.
+	// The standby connection is dialed after the first successful exchange, so
+	// its TLS session is resumed.
+	WarmStandby bool
+
 	// InsecureSkipVerify disables verifying the server's certificate.
 	InsecureSkipVerify bool
 
 	// PreferIPv6 tells the bootstrapper to prefer IPv6 addresses for an
 	// upstream.
 	PreferIPv6 bool
+
+	// EDNSBufferSize is the EDNS0 UDP payload size advertised in the queries
+	// sent to the plain DNS upstreams over UDP, so that the responses are
+	// small enough to pass the middleboxes dropping the fragmented datagrams.
+	// Larger responses are retried over TCP.  It must not be less than 512,
+	// zero keeps the size requested by the client.
+	EDNSBufferSize uint16
+
+	// DSCP is the Differentiated Services Code Point to mark the packets sent
+	// to the plain DNS, DNS-over-TLS, and DNS-over-HTTPS upstreams with, so
+	// that those could be prioritized by the network QoS policies.  The
+	// packets of DNS-over-QUIC and HTTP/3 aren't marked.  It must not be
+	// greater than 63, zero keeps the default marking.
+	DSCP uint8
+
+	// LazyInit makes [AddressToUpstream] only validate the address and the
+	// options of plain DNS, DNS-over-TLS, DNS-over-HTTPS, and DNS-over-QUIC
+	// upstreams, deferring the construction until the first exchange.  It's
+	// useful for the configurations with large numbers of rarely used
+	// upstreams.
+	LazyInit bool
+
+	// DisableFinalizers disables closing the DNS-over-TLS, DNS-over-HTTPS, and
+	// DNS-over-QUIC upstreams once those are garbage collected without being
+	// closed.  It's useful for the embedders which manage the lifecycles of
+	// the upstreams explicitly and don't want to pay for the finalizers.  The
+	// owner of an upstream must always close it, e.g. the proxy closes the
+	// upstreams of its configuration on shutdown.
+	DisableFinalizers bool
+
+	// serverIPs are the IP addresses of the upstream server specified within
+	// its address, see [AddressToUpstream].  If set, the upstream hostname
+	// isn't bootstrapped.
+	serverIPs []netip.Addr
+
+	// connTimeout is the timeout for establishing the TLS connections.  If
+	// zero, [dialTimeout] is used.
+	connTimeout time.Duration
 }
 
 // Clone copies o to a new struct.  Note, that this is not a deep clone.
 func (o *Options) Clone() (clone *Options) {
 	return &Options{
-		Bootstrap:                 o.Bootstrap,
-		Timeout:                   o.Timeout,
+		Bootstrap:           o.Bootstrap,
+		HostBootstraps:      o.HostBootstraps,
+		HostEDNSBufferSizes: o.HostEDNSBufferSizes,
+		EDNSBufferSize:      o.EDNSBufferSize,
+		Timeout:             o.Timeout,
+		QUICKeepAlivePeriod: o.QUICKeepAlivePeriod,
+		QUICMaxIdleTimeout:  o.QUICMaxIdleTimeout,
+		QUICVersions:        o.QUICVersions,
+		DoQNextProtos:       o.DoQNextProtos,
+		QUICEnableDatagrams: o.QUICEnableDatagrams,
+		QUICDisableOffload:  o.QUICDisableOffload,
+		QUICFlowLabel:       o.QUICFlowLabel,
+		PackedQueryTTL:      o.PackedQueryTTL,
+
+		QUICInitialStreamReceiveWindow:     o.QUICInitialStreamReceiveWindow,
+		QUICMaxStreamReceiveWindow:         o.QUICMaxStreamReceiveWindow,
+		QUICInitialConnectionReceiveWindow: o.QUICInitialConnectionReceiveWindow,
+		QUICMaxConnectionReceiveWindow:     o.QUICMaxConnectionReceiveWindow,
+
 		HTTPVersions:              o.HTTPVersions,
+		HTTPProbeStorage:          o.HTTPProbeStorage,
+		HTTPProbeCacheTTL:         o.HTTPProbeCacheTTL,
+		HTTPDowngradePeriod:       o.HTTPDowngradePeriod,
+		HTTPErrorBudget:           o.HTTPErrorBudget,
 		VerifyServerCertificate:   o.VerifyServerCertificate,
 		VerifyConnection:          o.VerifyConnection,
 		VerifyDNSCryptCertificate: o.VerifyDNSCryptCertificate,
 		InsecureSkipVerify:        o.InsecureSkipVerify,
+		UDPRetransmitInterval:     o.UDPRetransmitInterval,
+		UDPRetransmitAttempts:     o.UDPRetransmitAttempts,
+		UDPRetransmitSwitchServer: o.UDPRetransmitSwitchServer,
+		UDPRandomizeCase:          o.UDPRandomizeCase,
+		QuestionMismatch:          o.QuestionMismatch,
+		WarmStandby:               o.WarmStandby,
 		PreferIPv6:                o.PreferIPv6,
+		DSCP:                      o.DSCP,
+		LazyInit:                  o.LazyInit,
+		DisableFinalizers:         o.DisableFinalizers,
 		QUICTracer:                o.QUICTracer,
 		RootCAs:                   o.RootCAs,
 		CipherSuites:              o.CipherSuites,
 		Logger:                    o.Logger,
+		TorSOCKSAddr:              o.TorSOCKSAddr,
+		serverIPs:                 o.serverIPs,
+		connTimeout:               o.connTimeout,
 	}
 }
 
+// Logging attribute keys attached to the loggers of upstreams.
+const (
+	// KeyAddr is the attribute key for the redacted address of the upstream.
+	KeyAddr = "upstream"
+
+	// KeyProto is the attribute key for the scheme of the upstream address.
+	KeyProto = "upstream_proto"
+
+	// KeyGroup is the attribute key for the name of the group of upstreams,
+	// for example, "fallback".  It's not attached by [AddressToUpstream], but
+	// may be attached by the caller to [Options.Logger].
+	KeyGroup = "upstream_group"
+)
+
 // HTTPVersion is an enumeration of the HTTP versions that we support.  Values
 // that we use in this enumeration are also used as ALPN values.
 type HTTPVersion string
@@ -176,18 +435,25 @@ const (
 //   - quic://5.3.5.3:853 for DNS-over-QUIC using IP address;
 //   - quic://name.server:853 for DNS-over-QUIC using domain name;
 //   - h3://dns.google for DNS-over-HTTPS that only works with HTTP/3;
-//   - sdns://... for DNS stamp, see https://dnscrypt.info/stamps-specifications.
+//   - tls://name.server#1.2.3.4,2001:db8::1 for DNS-over-TLS using domain
+//     name with a fixed list of its IP addresses, the same form is valid for
+//     any other URL, except for DNS stamps;
+//   - sdns://... for DNS stamp, see https://dnscrypt.info/stamps-specifications;
+//   - any URL with a custom scheme registered with [RegisterScheme].
 //
 // If addr doesn't have port specified, the default port of the appropriate
-// protocol will be used.
-//
-// opts are applied to the u and shouldn't be modified afterwards, nil value is
-// valid.
+// protocol will be used.  If the IP addresses are specified after "#", the
+// hostname isn't bootstrapped and the connections are spread between the
+// addresses, falling back to the next one on failure.
 //
-// TODO(e.burkov):  Clone opts?
+// opts are cloned and applied to the u, nil value is valid.  The logger of u
+// has [KeyAddr] and [KeyProto] attributes attached.  The caller owns u and
+// must close it once it's no longer needed, see [Options.DisableFinalizers].
 func AddressToUpstream(addr string, opts *Options) (u Upstream, err error) {
 	if opts == nil {
 		opts = &Options{}
+	} else {
+		opts = opts.Clone()
 	}
 
 	if opts.Logger == nil {
@@ -207,6 +473,18 @@ func AddressToUpstream(addr string, opts *Options) (u Upstream, err error) {
 		}
 	}
 
+	opts.Logger = opts.Logger.With(KeyAddr, uu.Redacted(), KeyProto, uu.Scheme)
+
+	err = proxynetutil.ValidateDSCP(opts.DSCP)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return nil, err
+	}
+
+	if f, ok := customFactory(uu.Scheme); ok {
+		return f(uu, opts)
+	}
+
 	err = validateUpstreamURL(uu)
 	if err != nil {
 		// Don't wrap the error, because it's informative enough as is.
@@ -260,6 +538,36 @@ func validateUpstreamURL(u *url.URL) (err error) {
 
 // urlToUpstream converts uu to an Upstream using opts.
 func urlToUpstream(uu *url.URL, opts *Options) (u Upstream, err error) {
+	if uu.Fragment != "" && uu.Scheme != "sdns" {
+		opts, err = withServerIPs(uu, opts)
+		if err != nil {
+			// Don't wrap the error since it's informative enough as is.
+			return nil, err
+		}
+	}
+
+	if opts.usesTor(uu.Hostname()) {
+		opts, err = withTor(uu, opts)
+		if err != nil {
+			// Don't wrap the error since it's informative enough as is.
+			return nil, err
+		}
+	}
+
+	if opts.LazyInit {
+		var ok bool
+		u, ok, err = newLazy(uu, opts)
+		if ok {
+			return u, err
+		}
+	}
+
+	return newBuiltin(uu, opts)
+}
+
+// newBuiltin converts uu to an Upstream of one of the built-in schemes using
+// opts.
+func newBuiltin(uu *url.URL, opts *Options) (u Upstream, err error) {
 	switch sch := uu.Scheme; sch {
 	case "sdns":
 		return parseStamp(uu, opts)
@@ -276,6 +584,29 @@ func urlToUpstream(uu *url.URL, opts *Options) (u Upstream, err error) {
 	}
 }
 
+// withServerIPs parses the comma-separated list of IP addresses from the
+// fragment of uu, removes the fragment, and returns the copy of opts with the
+// addresses set.
+func withServerIPs(uu *url.URL, opts *Options) (withIPs *Options, err error) {
+	var ips []netip.Addr
+	for s := range strings.SplitSeq(uu.Fragment, ",") {
+		var ip netip.Addr
+		ip, err = netip.ParseAddr(strings.TrimSpace(s))
+		if err != nil {
+			return nil, fmt.Errorf("parsing server ips of %s: %w", uu.Host, err)
+		}
+
+		ips = append(ips, ip)
+	}
+
+	uu.Fragment, uu.RawFragment = "", ""
+
+	withIPs = opts.Clone()
+	withIPs.serverIPs = ips
+
+	return withIPs, nil
+}
+
 // parseStamp converts a DNS stamp to an Upstream.
 func parseStamp(upsURL *url.URL, opts *Options) (u Upstream, err error) {
 	stamp, err := dnsstamps.NewServerStampFromString(upsURL.String())
@@ -391,6 +722,18 @@ type DialerInitializer func() (handler bootstrap.DialHandler, err error)
 // newDialerInitializer creates an initializer of the dialer that will dial the
 // addresses resolved from u using opts.
 func newDialerInitializer(u *url.URL, opts *Options) (di DialerInitializer) {
+	di = newBootstrapDialerInitializer(u, opts)
+	if opts.DSCP != 0 {
+		di = withDSCP(di, opts.DSCP)
+	}
+
+	return di
+}
+
+// newBootstrapDialerInitializer creates an initializer of the dialer that will
+// dial the addresses resolved from u using opts without setting any socket
+// options.
+func newBootstrapDialerInitializer(u *url.URL, opts *Options) (di DialerInitializer) {
 	var l *slog.Logger
 	if opts.Logger != nil {
 		l = opts.Logger.With(slogutil.KeyPrefix, "bootstrap")
@@ -398,6 +741,15 @@ func newDialerInitializer(u *url.URL, opts *Options) (di DialerInitializer) {
 		l = slog.Default()
 	}
 
+	if opts.usesTor(u.Hostname()) {
+		// The onion services have no IP addresses, so let Tor resolve those.
+		handler := newTorDialHandler(opts.TorSOCKSAddr, u.Host, l)
+
+		return func() (h bootstrap.DialHandler, dialerErr error) {
+			return handler, nil
+		}
+	}
+
 	if netutil.IsValidIPPortString(u.Host) {
 		// Don't resolve the address of the server since it's already an IP.
 		handler := bootstrap.NewDialContext(opts.Timeout, l, u.Host)
@@ -407,15 +759,54 @@ func newDialerInitializer(u *url.URL, opts *Options) (di DialerInitializer) {
 		}
 	}
 
-	boot := opts.Bootstrap
+	if len(opts.serverIPs) > 0 {
+		// The addresses are specified explicitly so there is no need to
+		// bootstrap.
+		port := u.Port()
+		addrs := make([]string, 0, len(opts.serverIPs))
+		for _, ip := range opts.serverIPs {
+			addrs = append(addrs, net.JoinHostPort(ip.String(), port))
+		}
+
+		handler := bootstrap.NewRotatingDialContext(opts.Timeout, l, addrs...)
+
+		return func() (h bootstrap.DialHandler, dialerErr error) {
+			return handler, nil
+		}
+	}
+
+	boot := opts.bootstrapFor(u.Hostname())
+
+	return func() (h bootstrap.DialHandler, err error) {
+		return bootstrap.ResolveDialContext(u, opts.Timeout, boot, opts.PreferIPv6, l)
+	}
+}
+
+// bootstrapFor returns the resolver to bootstrap the upstream with the given
+// hostname.
+func (o *Options) bootstrapFor(host string) (boot Resolver) {
+	boot, ok := o.HostBootstraps[strings.ToLower(host)]
+	if !ok {
+		boot = o.Bootstrap
+	}
+
 	if boot == nil {
 		// Use the default resolver for bootstrapping.
 		boot = net.DefaultResolver
 	}
 
-	return func() (h bootstrap.DialHandler, err error) {
-		return bootstrap.ResolveDialContext(u, opts.Timeout, boot, opts.PreferIPv6, l)
+	return boot
+}
+
+// ednsBufferSizeFor returns the EDNS0 UDP payload size to advertise to the
+// plain DNS upstream with the given hostname.
+func (o *Options) ednsBufferSizeFor(host string) (size uint16) {
+	size, ok := o.HostEDNSBufferSizes[strings.ToLower(host)]
+	if !ok {
+		size = o.EDNSBufferSize
 	}
+
+	return size
 }
 
 // errQuestion is returned when a message has malformed question section.
@@ -437,7 +828,8 @@ func validateResponse(req, resp *dns.Msg) (err error) {
 
 	// Compare the names case-insensitively, just like CoreDNS does.
 	if !strings.EqualFold(reqQ.Name, respQ.Name) {
-		return fmt.Errorf("%w: mismatched name %q", errQuestion, respQ.Name)
+		// Don't put the name into the error, since it may be logged.
+		return fmt.Errorf("%w: mismatched name", errQuestion)
 	}
 
 	return nil
@@ -10,6 +10,8 @@ import (
 	"crypto/x509/pkix"
 	"encoding/pem"
 	"fmt"
+	"io"
+	"log"
 	"math/big"
 	"net"
 	"net/netip"
@@ -46,7 +48,53 @@ func TestMain(m *testing.M) {
 	// See https://github.com/quic-go/quic-go/issues/4228.
 	errors.Check(os.Setenv("QUIC_GO_DISABLE_GSO", "1"))
 
-	testutil.DiscardLogOutput(m)
+	leaks := &leakDetector{}
+	leakHook = leaks.add
+
+	log.SetOutput(io.Discard)
+
+	code := m.Run()
+	if code == 0 && leaks.check() {
+		code = 1
+	}
+
+	os.Exit(code)
+}
+
+// leakDetector collects the addresses of the upstreams garbage collected without
+// being closed.
+type leakDetector struct {
+	// mu protects addrs.
+	mu    sync.Mutex
+	addrs []string
+}
+
+// add records the leaked upstream with addr.  It's safe for concurrent use.
+func (d *leakDetector) add(addr string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.addrs = append(d.addrs, addr)
+}
+
+// check collects the garbage and reports the leaked upstreams, if any.  Note
+// that it may miss some leaks, since the finalizers aren't guaranteed to run.
+func (d *leakDetector) check() (leaked bool) {
+	// Run the collection several times, since the finalizers run in a separate
+	// goroutine after the collection.
+	for range 3 {
+		runtime.GC()
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, addr := range d.addrs {
+		fmt.Fprintf(os.Stderr, "upstream %s is not closed\n", addr)
+	}
+
+	return len(d.addrs) > 0
 }
 
 // TODO(a.garipov):  Refactor.
@@ -534,6 +582,89 @@ func TestAddressToUpstream_StaticResolver(t *testing.T) {
 	}
 }
 
+func TestAddressToUpstream_hostBootstraps(t *testing.T) {
+	t.Parallel()
+
+	h := func(w dns.ResponseWriter, m *dns.Msg) {
+		require.NoError(testutil.PanicT{}, w.WriteMsg(respondToTestMessage(m)))
+	}
+	dotSrv := startDoTServer(t, h)
+
+	// emptyResolver never resolves anything.
+	emptyResolver := StaticResolver{}
+	opts := &Options{
+		Logger:    testLogger,
+		Bootstrap: emptyResolver,
+		HostBootstraps: map[string]Resolver{
+			"some.dns.server": StaticResolver{netutil.IPv4Localhost()},
+		},
+		Timeout:            testTimeout,
+		InsecureSkipVerify: true,
+	}
+
+	t.Run("override", func(t *testing.T) {
+		t.Parallel()
+
+		addr := fmt.Sprintf("tls://Some.DNS.Server:%d", dotSrv.port)
+		u, err := AddressToUpstream(addr, opts)
+		require.NoError(t, err)
+		testutil.CleanupAndRequireSuccess(t, u.Close)
+
+		checkUpstream(t, u, addr)
+	})
+
+	t.Run("global", func(t *testing.T) {
+		t.Parallel()
+
+		addr := fmt.Sprintf("tls://other.dns.server:%d", dotSrv.port)
+		u, err := AddressToUpstream(addr, opts)
+		require.NoError(t, err)
+		testutil.CleanupAndRequireSuccess(t, u.Close)
+
+		_, err = u.Exchange(createTestMessage())
+		assert.Error(t, err)
+	})
+}
+
+func TestAddressToUpstream_serverIPs(t *testing.T) {
+	t.Parallel()
+
+	h := func(w dns.ResponseWriter, m *dns.Msg) {
+		require.NoError(testutil.PanicT{}, w.WriteMsg(respondToTestMessage(m)))
+	}
+	dotSrv := startDoTServer(t, h)
+
+	opts := &Options{
+		Logger:             testLogger,
+		Bootstrap:          StaticResolver{},
+		Timeout:            testTimeout,
+		InsecureSkipVerify: true,
+	}
+
+	t.Run("success", func(t *testing.T) {
+		t.Parallel()
+
+		addr := fmt.Sprintf("tls://some.dns.server:%d", dotSrv.port)
+		u, err := AddressToUpstream(addr+"#127.0.0.1", opts)
+		require.NoError(t, err)
+		testutil.CleanupAndRequireSuccess(t, u.Close)
+
+		assert.Equal(t, addr, u.Address())
+		checkUpstream(t, u, addr)
+	})
+
+	t.Run("bad_ip", func(t *testing.T) {
+		t.Parallel()
+
+		_, err := AddressToUpstream("tls://some.dns.server#127.0.0.1,bad", opts)
+		testutil.AssertErrorMsg(
+			t,
+			`parsing server ips of some.dns.server: ParseAddr("bad"): unable to parse IP`,
+			err,
+		)
+	})
+}
+
 func TestAddPort(t *testing.T) {
 	testCases := []struct {
 		name string